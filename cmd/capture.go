@@ -4,6 +4,7 @@ package cmd
 import (
 	"github.com/shine-o/shine.engine.packet-sniffer/service"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // captureCmd represents the capture command
@@ -15,4 +16,67 @@ var captureCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(captureCmd)
+
+	captureCmd.Flags().String("pcap", "", "decode packets from a pcap file instead of capturing on the network interface")
+	if err := viper.BindPFlag("network.pcapFile", captureCmd.Flags().Lookup("pcap")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Float64("pace", 0, "with --pcap, wait between packets as the capture did, divided by this speed, e.g 1 or 10, 0 reads as fast as possible")
+	if err := viper.BindPFlag("network.pcapPace", captureCmd.Flags().Lookup("pace")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Bool("best-effort", false, "with network.interfaces, capture on the interfaces that could be opened instead of failing")
+	if err := viper.BindPFlag("network.bestEffort", captureCmd.Flags().Lookup("best-effort")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Bool("wait-for-interface", false, "if the interface doesn't exist or isn't up yet, try again with a growing wait until it is instead of failing, same as network.waitForInterface")
+	if err := viper.BindPFlag("network.waitForInterface", captureCmd.Flags().Lookup("wait-for-interface")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().StringSlice("client-ip", nil, "only decode the flows of these client ips or CIDR ranges, e.g 192.168.1.20,10.0.0.0/24")
+	if err := viper.BindPFlag("network.clientIP", captureCmd.Flags().Lookup("client-ip")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Bool("clean", false, "delete everything in output/ before starting, including previous runs")
+
+	captureCmd.Flags().Bool("quiet", false, "only print errors and the periodic stats line")
+
+	captureCmd.Flags().Bool("container", false, "running in a container, the UI listens on 0.0.0.0 unless ui.listen is set")
+
+	captureCmd.Flags().Bool("anonymize", false, "replace ip addresses with pseudonyms like client-1 in every output, same as output.anonymize.enabled")
+
+	captureCmd.Flags().Bool("no-redact", false, "write passwords and login tokens as they are, for local debugging, same as output.redact.enabled: false")
+
+	captureCmd.Flags().Bool("pprof", false, "serve net/http/pprof under /debug/pprof/ next to the api, same as ui.pprof")
+	if err := viper.BindPFlag("ui.pprof", captureCmd.Flags().Lookup("pprof")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Bool("tui", false, "show the flows, their packets and the stats in a terminal interface instead of printing packets, the web UI keeps running")
+	captureCmd.Flags().Bool("no-color", false, "don't color packets by flow, colors are also off when stdout isn't a terminal")
+
+	captureCmd.Flags().Bool("raw-tap", false, "also write the reassembled bytes of each stream to <flowName>-<flowID>.raw, same as output.rawTap.enabled, needs --no-redact")
+	if err := viper.BindPFlag("output.rawTap.enabled", captureCmd.Flags().Lookup("raw-tap")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Bool("enable-injection", false, "serve POST /api/inject to write crafted packets into live connections, only against servers you run, same as injection.enabled")
+	if err := viper.BindPFlag("injection.enabled", captureCmd.Flags().Lookup("enable-injection")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Duration("duration", 0, "stop capturing after this long, e.g 60s")
+	if err := viper.BindPFlag("network.duration", captureCmd.Flags().Lookup("duration")); err != nil {
+		panic(err)
+	}
+
+	captureCmd.Flags().Int("max-packets", 0, "stop capturing after this many tcp packets")
+	if err := viper.BindPFlag("network.maxPackets", captureCmd.Flags().Lookup("max-packets")); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,18 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+)
+
+// checkFilterCmd represents the check-filter command
+var checkFilterCmd = &cobra.Command{
+	Use:   "check-filter [expression]",
+	Short: "Validate the bpf filter without starting a capture",
+	Run:   service.CheckFilter,
+}
+
+func init() {
+	rootCmd.AddCommand(checkFilterCmd)
+}
@@ -0,0 +1,21 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+)
+
+// commandsCmd represents the commands command
+var commandsCmd = &cobra.Command{
+	Use:   "commands [opcode|name|part of a name]",
+	Short: "Look up operation codes and command names in the commands file",
+	Run:   service.Commands,
+}
+
+func init() {
+	rootCmd.AddCommand(commandsCmd)
+
+	commandsCmd.Flags().String("generate-go", "", "write a go file with a typed constant per command to this path, - for stdout")
+	commandsCmd.Flags().String("package", "opcodes", "package of the generated go file")
+}
@@ -0,0 +1,24 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+)
+
+// convertCmd represents the convert command
+var convertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Convert the packets of a saved capture between output formats",
+	Run:   service.Convert,
+}
+
+func init() {
+	rootCmd.AddCommand(convertCmd)
+
+	convertCmd.Flags().String("from", "", "format of --in: jsonl, sqlite, csv or pcap-decrypted")
+	convertCmd.Flags().String("to", "", "format of --out: jsonl, sqlite, csv or pcap-decrypted")
+	convertCmd.Flags().String("in", "", "file to read, or for jsonl, sqlite and pcap-decrypted a session directory, its manifest lists the files")
+	convertCmd.Flags().String("out", "", "file to write, or for jsonl and pcap-decrypted the directory the flow files are written to")
+	convertCmd.Flags().Bool("no-redact", false, "copy passwords and login tokens as they are, same as output.redact.enabled: false")
+}
@@ -6,13 +6,17 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// captureCmd represents the capture command
+// decodeCmd represents the decode command
 var decodeCmd = &cobra.Command{
-	Use:   "decode",
-	Short: "Decode file with packet data",
-	Run:   service.Capture,
+	Use:   "decode [hex]",
+	Short: "Decode the packets of a hex string, e.g one pasted from a capture",
+	Run:   service.Decode,
 }
 
 func init() {
 	rootCmd.AddCommand(decodeCmd)
+
+	decodeCmd.Flags().String("file", "", "file with one hex string per line, instead of the argument")
+	decodeCmd.Flags().String("type", "", "length header of the packets, small (1 byte) or big (0 followed by 2 bytes), read from the data by default")
+	decodeCmd.Flags().Int("xor-offset", -1, "xor the payloads with protocol.xorKey starting at this offset, as client packets are")
 }
@@ -0,0 +1,20 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+)
+
+// decodeRawCmd represents the decode-raw command
+var decodeRawCmd = &cobra.Command{
+	Use:   "decode-raw [raw files or session directories]",
+	Short: "Decode the raw streams written by capture --raw-tap as a new session",
+	Run:   service.DecodeRaw,
+}
+
+func init() {
+	rootCmd.AddCommand(decodeRawCmd)
+
+	decodeRawCmd.Flags().Bool("quiet", false, "only print errors, the packets still go to the session directory")
+}
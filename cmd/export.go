@@ -0,0 +1,24 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Render the output of a capture into a single html report",
+	Run:   service.Export,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String("session", "", "session directory with the json output of a capture, e.g output/2020-05-01T12-30-00")
+	exportCmd.Flags().String("db", "", "sqlite database written by capture, instead of --session")
+	exportCmd.Flags().String("out", "", "html file to write, defaults to report.html in the session directory")
+	exportCmd.Flags().Bool("anonymize", false, "replace the ip addresses of the flows with the pseudonyms in output.anonymize.mapping")
+	exportCmd.Flags().Int("max-packets-per-flow", 1000, "packets shown per flow, the rest are only counted in the summary, 0 shows every packet")
+}
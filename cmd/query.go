@@ -0,0 +1,27 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// queryCmd represents the query command
+var queryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "Print the packets stored in the sqlite database with an operation code",
+	Run:   service.Query,
+}
+
+func init() {
+	rootCmd.AddCommand(queryCmd)
+
+	queryCmd.Flags().String("db", "", "sqlite database written by capture, defaults to output.sqlite.path")
+	if err := viper.BindPFlag("output.sqlite.path", queryCmd.Flags().Lookup("db")); err != nil {
+		panic(err)
+	}
+	queryCmd.Flags().String("opcode", "", "operation code or command name, e.g 2055 or NC_MISC_SEED_ACK")
+	queryCmd.Flags().String("from", "", "only packets seen after this time, e.g 2020-05-01T12:30:00Z")
+	queryCmd.Flags().String("to", "", "only packets seen before this time, defaults to now")
+}
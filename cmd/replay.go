@@ -0,0 +1,26 @@
+// Package cmd used for various command configs
+package cmd
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/service"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Replay the server packets of a saved flow to a game client",
+	Run:   service.Replay,
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().String("flow", "", "flow saved by capture with protocol.log.jsonOutput, e.g output/<session>/login-client-<flowID>.jsonl")
+	replayCmd.Flags().Float64("speed", 1, "divide the time between packets by this")
+	replayCmd.Flags().Int("port", 9010, "port the game client connects to")
+	if err := viper.BindPFlag("replay.port", replayCmd.Flags().Lookup("port")); err != nil {
+		panic(err)
+	}
+}
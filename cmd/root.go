@@ -65,6 +65,10 @@ func initConfig() {
 	}
 
 	for _, v := range required {
+		// network.interfaces replaces network.interface
+		if v == "network.interface" && viper.IsSet("network.interfaces") {
+			continue
+		}
 		if !viper.IsSet(v) {
 			panic(fmt.Sprintf("required config parameter is missing: %v", v))
 		}
@@ -76,11 +80,69 @@ func initConfig() {
 
 	viper.SetDefault("network.interface", 65536)
 
+	viper.SetDefault("network.flushInterval", "2m")
+
+	viper.SetDefault("network.pcapPaceMaxGap", "30s")
+
+	viper.SetDefault("network.pcapRotateMB", 100)
+
+	viper.SetDefault("network.backend", "pcap")
+
+	viper.SetDefault("network.afpacket.ringSizeMB", 64)
+
+	viper.SetDefault("network.afpacket.blockTimeout", "100ms")
+
+	viper.SetDefault("network.statsInterval", "30s")
+
+	viper.SetDefault("ui.historySize", 2000)
+	viper.SetDefault("ui.health.window", "60s")
+	viper.SetDefault("ui.heatmap.retention", "30m")
+
+	viper.SetDefault("output.broker.queueSize", 10000)
+
+	viper.SetDefault("output.elasticsearch.indexPrefix", "shine-packets")
+	viper.SetDefault("output.elasticsearch.batchSize", 500)
+	viper.SetDefault("output.elasticsearch.flushInterval", "5s")
+	viper.SetDefault("output.elasticsearch.queueSize", 10000)
+
+	viper.SetDefault("output.grpc.queueSize", 1000)
+	viper.SetDefault("output.maxPayloadBytes", 1024)
+
+	viper.SetDefault("output.anonymize.mapping", "output/anonymize.json")
+
 	viper.SetDefault("protocol.xorKey", "0759694a941194858c8805cba09ecd583a365b1a6a16febddf9402f82196c8e99ef7bfbdcfcdb27a009f4022fc11f90c2e12fba7740a7d78401e2ca02d06cba8b97eefde49ea4e13161680f43dc29ad486d7942417f4d665bd3fdbe4e10f50f6ec7a9a0c273d2466d322689c9a520be0f9a50b25da80490dfd3e77d156a8b7f40f9be80f5247f56f832022db0f0bb14385c1cba40b0219dff08becdb6c6d66ad45be89147e2f8910b89360d860def6fe6e9bca06c1759533cfc0b2e0cca5ce12f6e5b5b426c5b2184f2a5d261b654df545c98414dc7c124b189cc724e73c64ffd63a2cee8c8149396cb7dcbd94e232f7dd0afc020164ec4c940ab156f5c9a934de0f3827bc81300f7b3825fee83e29ba5543bf6b9f1f8a4952187f8af888245c4fe1a830878e501f2fd10cb4fd0abcdc1285e252ee4a5838abffc63db960640ab450d54089179ad585cfec0d7e817fe3c3040122ec27ccfa3e21a654c8de00b6df279ff625340785bfa7a5a5e0830c3d5d2040af60a36456f305c41c7d3798c3e85a6e5885a49a6b6af4a37b619b09401e604b32d951a4fef95d4e4afb4ad47c330233d59dce5baa5a7cd8f805fa1f2b8c725750ae6c1989ca01fcfc299b61126863654626c45b50aa2bbeef9a790223752c2013fdd95a7623f10bb5b859f99f7ae606e9a53ab450bf165898b39a6e36ee8deb")
 
 	viper.SetDefault("protocol.xorLimit", 350)
 
+	viper.SetDefault("protocol.xorKeyOpcode", "2055")
+	viper.SetDefault("protocol.serverXor", "false")
+	viper.SetDefault("protocol.serverXorSeed", -1)
+	viper.SetDefault("protocol.serverXorKeyOffset", 2)
+
+	// NC_USER_CLIENT_VERSION_CHECK_REQ
+	viper.SetDefault("protocol.versionOpcode", "3173")
+
+	viper.SetDefault("protocol.discoverZones", true)
+	viper.SetDefault("network.segmentQueue.size", 512)
+	viper.SetDefault("protocol.xorState.interval", "10s")
+	viper.SetDefault("protocol.xorState.expiry", "10m")
+	viper.SetDefault("protocol.decoderWatchdog", "30s")
+	viper.SetDefault("protocol.udpIdleTimeout", "30s")
+	viper.SetDefault("output.redact.enabled", true)
+	viper.SetDefault("output.entropy", true)
+
+	viper.SetDefault("protocol.xorBruteForceSegments", 5)
+
 	viper.SetDefault("protocol.log.client", true)
 
 	viper.SetDefault("protocol.log.server", true)
+	viper.SetDefault("protocol.dedup.enabled", true)
+	viper.SetDefault("protocol.dedup.window", "100ms")
+	viper.SetDefault("protocol.dedup.size", 64)
+
+	viper.SetDefault("protocol.latencyTimeout", "10s")
+
+	viper.SetDefault("protocol.sessionIdleTimeout", "1m")
+	viper.SetDefault("protocol.timelineOpcodes", []string{})
+	viper.SetDefault("output.rawTap.decode", true)
 }
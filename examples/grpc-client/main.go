@@ -0,0 +1,62 @@
+// grpc-client prints the packets streamed by a sniffer started with output.grpc.address set
+//
+//	go run ./examples/grpc-client -address localhost:9091 -flow zone00-client -opcode 2055
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/shine-o/shine.engine.packet-sniffer/snifferpb"
+	"google.golang.org/grpc"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	address := flag.String("address", "localhost:9091", "address of the sniffer's grpc server")
+	flows := flag.String("flow", "", "comma separated flow names, e.g zone00-client,login-client")
+	opCodes := flag.String("opcode", "", "comma separated operation codes, e.g 2055,3173")
+	flag.Parse()
+
+	req := &snifferpb.SubscribeRequest{}
+	if *flows != "" {
+		req.FlowNames = strings.Split(*flows, ",")
+	}
+	if *opCodes != "" {
+		for _, s := range strings.Split(*opCodes, ",") {
+			o, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+			if err != nil {
+				log.Fatalf("bad operation code %q: %v", s, err)
+			}
+			req.OpCodes = append(req.OpCodes, uint32(o))
+		}
+	}
+
+	conn, err := grpc.Dial(*address, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := snifferpb.NewSnifferServiceClient(conn).Subscribe(context.Background(), req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%v %v %v %v %v %v\n",
+			time.Unix(0, e.SeenUnixNano).Format("15:04:05.000"), e.FlowName, e.Direction, e.Command, e.OpCode, hex.EncodeToString(e.Payload))
+	}
+}
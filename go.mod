@@ -1,16 +1,20 @@
 module github.com/shine-o/shine.engine.packet-sniffer
 
-go 1.13
+go 1.16
 
 require (
+	github.com/gdamore/tcell v1.3.0
+	github.com/golang/protobuf v1.4.1
 	github.com/google/gopacket v1.1.17
 	github.com/google/logger v1.1.0
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pelletier/go-toml v1.6.0 // indirect
-	github.com/pkg/profile v1.4.0
-	github.com/segmentio/ksuid v1.0.2
+	github.com/pierrec/lz4/v4 v4.1.15
+	github.com/segmentio/kafka-go v0.4.10
 	github.com/shine-o/shine.engine.core v0.0.3-0.20200413150635-0c5ca393755f
 	github.com/spf13/afero v1.2.2 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
@@ -18,8 +22,12 @@ require (
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.6.2
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/ini.v1 v1.55.0 // indirect
 	gopkg.in/restruct.v1 v1.0.0-20190323193435-3c2afb705f3c
+	gopkg.in/yaml.v2 v2.2.8
 )
 
 replace github.com/shine-o/shine.engine.core => C:\Users\marbo\go\src\github.com\shine-o\shine.engine.core
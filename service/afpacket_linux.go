@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"os"
+)
+
+// afpacketSource reads packets from a TPACKETv3 ring shared with the kernel, which copes with higher packet rates than libpcap
+type afpacketSource struct {
+	tp      *afpacket.TPacket
+	snaplen int
+}
+
+func openAFPacketSource(c Config) (PacketSourceProvider, error) {
+	snaplen := c.Snaplen
+	if snaplen <= 0 {
+		snaplen = 65536
+	}
+	frameSize, blockSize, numBlocks, err := afpacketSizes(c.AFPacketRingMB, snaplen, os.Getpagesize())
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []interface{}{
+		afpacket.OptFrameSize(frameSize),
+		afpacket.OptBlockSize(blockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		afpacket.OptBlockTimeout(c.AFPacketBlockTimeout),
+		afpacket.TPacketVersion3,
+	}
+	if c.Interface != "" {
+		opts = append(opts, afpacket.OptInterface(c.Interface))
+	}
+
+	tp, err := afpacket.NewTPacket(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error opening af_packet socket: %v", captureSetupError(c.Interface, err))
+	}
+
+	as := &afpacketSource{tp: tp, snaplen: snaplen}
+	if c.Filter != "" {
+		if err := as.SetFilter(c.Filter); err != nil {
+			tp.Close()
+			return nil, err
+		}
+	}
+
+	log.Infof("capturing with af_packet, %v blocks of %v bytes", numBlocks, blockSize)
+	return as, nil
+}
+
+// af_packet takes the filter as raw bpf instructions, libpcap still compiles them
+func (as *afpacketSource) SetFilter(filter string) error {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, as.snaplen, filter)
+	if err != nil {
+		return fmt.Errorf("error compiling BPF filter %q: %v", filter, err)
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: ins.Code,
+			Jt: ins.Jt,
+			Jf: ins.Jf,
+			K:  ins.K,
+		}
+	}
+	if err := as.tp.SetBPF(raw); err != nil {
+		return fmt.Errorf("error setting BPF filter %q: %v", filter, err)
+	}
+	return nil
+}
+
+// frames hold a whole packet, blocks hold 128 frames and as many blocks as fit in the ring are used
+func afpacketSizes(ringMB, snaplen, pageSize int) (frameSize, blockSize, numBlocks int, err error) {
+	if snaplen < pageSize {
+		frameSize = pageSize / (pageSize / snaplen)
+	} else {
+		frameSize = (snaplen/pageSize + 1) * pageSize
+	}
+	blockSize = frameSize * 128
+	numBlocks = ringMB * 1024 * 1024 / blockSize
+	if numBlocks == 0 {
+		return 0, 0, 0, fmt.Errorf("network.afpacket.ringSizeMB: %vMB can't hold a single block of %v bytes", ringMB, blockSize)
+	}
+	return frameSize, blockSize, numBlocks, nil
+}
+
+func (as *afpacketSource) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(as.tp, layers.LinkTypeEthernet)
+}
+
+func (as *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return as.tp.ReadPacketData()
+}
+
+func (as *afpacketSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (as *afpacketSource) Stats() (CaptureStats, error) {
+	_, v3, err := as.tp.SocketStats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{
+		Received: uint64(v3.Packets()),
+		Dropped:  uint64(v3.Drops()),
+	}, nil
+}
+
+func (as *afpacketSource) Close() {
+	as.tp.Close()
+}
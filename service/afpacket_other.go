@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+import "fmt"
+
+func openAFPacketSource(c Config) (PacketSourceProvider, error) {
+	return nil, fmt.Errorf("network.backend: afpacket is only available on linux")
+}
@@ -0,0 +1,404 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// alerts waiting for the webhook, more are dropped
+const alertWebhookQueueSize = 64
+
+const alertWebhookTimeout = 5 * time.Second
+
+// AlertRule is an entry of alerts.rules, it fires once Count events it matches happen within Window of capture time
+// Event is "packet", matched by OpCode, Direction, Flow and Payload, or "decode-error", matched by Direction and Flow
+// once fired, the rule stays quiet for Cooldown, what it matches meanwhile is counted as suppressed
+type AlertRule struct {
+	ID      string `mapstructure:"id"`
+	Message string `mapstructure:"message"`
+	Event   string `mapstructure:"event"`
+	// operation code (9277) or command name, every packet if empty
+	OpCode    string `mapstructure:"opcode"`
+	Direction string `mapstructure:"direction"`
+	Flow      string `mapstructure:"flow"`
+	// hex bytes the payload must contain
+	Payload  string        `mapstructure:"payload"`
+	Count    int           `mapstructure:"count"`
+	Window   time.Duration `mapstructure:"window"`
+	Cooldown time.Duration `mapstructure:"cooldown"`
+}
+
+const (
+	alertEventPacket      = "packet"
+	alertEventDecodeError = "decode-error"
+)
+
+type alertRule struct {
+	AlertRule
+	opCode    uint16
+	hasOpCode bool
+	payload   []byte
+	// capture times of the last matches, at most Count
+	matches    []time.Time
+	lastFired  time.Time
+	fired      uint64
+	suppressed uint64
+}
+
+// alerts evaluates alerts.rules on the packets and decode errors of every stream, nil without rules
+type alerts struct {
+	rules   []*alertRule
+	webhook *alertWebhook
+	// the UI clients alerts are sent to
+	ws *webSockets
+	mu sync.Mutex
+}
+
+func newAlerts(p *protocol, ws *webSockets, rules []AlertRule, webhookURL string) (*alerts, error) {
+	if len(rules) == 0 {
+		if webhookURL != "" {
+			log.Warning("alerts.webhook is set but alerts.rules is empty, no alert will be sent")
+		}
+		return nil, nil
+	}
+	a := &alerts{ws: ws}
+	seen := make(map[string]bool)
+	for i, r := range rules {
+		rule, err := newAlertRule(p, r)
+		if err != nil {
+			return nil, fmt.Errorf("alerts.rules[%v]: %v", i, err)
+		}
+		if seen[r.ID] {
+			return nil, fmt.Errorf("alerts.rules[%v]: id %q is used by another rule", i, r.ID)
+		}
+		seen[r.ID] = true
+		a.rules = append(a.rules, rule)
+	}
+	if webhookURL != "" {
+		u, err := url.Parse(webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("alerts.webhook: %q is not an http(s) url", webhookURL)
+		}
+		a.webhook = newAlertWebhook(webhookURL)
+	}
+	return a, nil
+}
+
+func newAlertRule(p *protocol, r AlertRule) (*alertRule, error) {
+	if r.ID == "" {
+		return nil, fmt.Errorf("id is needed")
+	}
+	rule := &alertRule{AlertRule: r}
+	switch r.Event {
+	case "":
+		rule.Event = alertEventPacket
+	case alertEventPacket, alertEventDecodeError:
+	default:
+		return nil, fmt.Errorf("%v: unknown event %q, use packet or decode-error", r.ID, r.Event)
+	}
+	if r.Direction != "" && r.Direction != "inbound" && r.Direction != "outbound" {
+		return nil, fmt.Errorf("%v: direction must be inbound or outbound", r.ID)
+	}
+	if rule.Event == alertEventDecodeError && (r.OpCode != "" || r.Payload != "") {
+		return nil, fmt.Errorf("%v: decode errors have no operation code or payload to match", r.ID)
+	}
+	if r.OpCode != "" {
+		opCode, err := p.parseOpCode(r.OpCode)
+		if err != nil {
+			return nil, fmt.Errorf("%v: opcode: %v", r.ID, err)
+		}
+		rule.opCode, rule.hasOpCode = opCode, true
+	}
+	if r.Payload != "" {
+		payload, err := hex.DecodeString(r.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("%v: payload: %v", r.ID, err)
+		}
+		rule.payload = payload
+	}
+	if rule.Count < 1 {
+		rule.Count = 1
+	}
+	if rule.Count > 1 && rule.Window <= 0 {
+		return nil, fmt.Errorf("%v: a count of %v needs a window, e.g 1m", r.ID, rule.Count)
+	}
+	if rule.Cooldown < 0 {
+		return nil, fmt.Errorf("%v: cooldown must not be negative", r.ID)
+	}
+	return rule, nil
+}
+
+func (r *alertRule) matchesPacket(pe PacketEvent) bool {
+	if r.Event != alertEventPacket || !r.matchesFlow(pe.FlowName, pe.Direction) {
+		return false
+	}
+	if r.hasOpCode && pe.Packet.Base.OperationCode != r.opCode {
+		return false
+	}
+	return r.payload == nil || bytes.Contains(pe.Packet.Base.Data, r.payload)
+}
+
+func (r *alertRule) matchesFlow(flowName, direction string) bool {
+	return (r.Flow == "" || r.Flow == flowName) && (r.Direction == "" || r.Direction == direction)
+}
+
+// count a match at seen, true if the rule fires, called with the lock of alerts held
+func (r *alertRule) match(seen time.Time) bool {
+	if len(r.matches) == r.Count {
+		r.matches = append(r.matches[:0], r.matches[1:]...)
+	}
+	r.matches = append(r.matches, seen)
+	if len(r.matches) < r.Count {
+		return false
+	}
+	if r.Count > 1 && seen.Sub(r.matches[0]) > r.Window {
+		return false
+	}
+	// the matches that fired don't count towards the next alert
+	r.matches = r.matches[:0]
+	if !r.lastFired.IsZero() && seen.Sub(r.lastFired) < r.Cooldown {
+		r.suppressed++
+		return false
+	}
+	r.lastFired = seen
+	r.fired++
+	return true
+}
+
+// alertEvent is sent to every UI connection and to alerts.webhook when a rule fires
+type alertEvent struct {
+	RuleID        string    `json:"ruleID"`
+	Message       string    `json:"message"`
+	Event         string    `json:"event"`
+	Seen          time.Time `json:"seen"`
+	FlowID        string    `json:"flowID"`
+	FlowName      string    `json:"flowName"`
+	SessionID     string    `json:"sessionID"`
+	Direction     string    `json:"direction"`
+	OperationCode uint16    `json:"operationCode,omitempty"`
+	Command       string    `json:"command,omitempty"`
+	// matches it took, within WindowSeconds
+	Count         int     `json:"count"`
+	WindowSeconds float64 `json:"windowSeconds,omitempty"`
+}
+
+func (r *alertRule) event(seen time.Time, flowID, flowName, sessionID, direction string) alertEvent {
+	ae := alertEvent{
+		RuleID:    r.ID,
+		Message:   r.Message,
+		Event:     r.Event,
+		Seen:      seen,
+		FlowID:    flowID,
+		FlowName:  flowName,
+		SessionID: sessionID,
+		Direction: direction,
+		Count:     r.Count,
+	}
+	if r.Count > 1 {
+		ae.WindowSeconds = r.Window.Seconds()
+	}
+	return ae
+}
+
+// evaluate the rules on a handled packet
+func (a *alerts) packet(pe PacketEvent) {
+	if a == nil {
+		return
+	}
+	var fired []alertEvent
+	a.mu.Lock()
+	for _, r := range a.rules {
+		if !r.matchesPacket(pe) || !r.match(pe.Seen) {
+			continue
+		}
+		ae := r.event(pe.Seen, pe.FlowID, pe.FlowName, pe.SessionID, pe.Direction)
+		ae.OperationCode = pe.Packet.Base.OperationCode
+		ae.Command = pe.Packet.Base.ClientStructName
+		fired = append(fired, ae)
+	}
+	a.mu.Unlock()
+	for _, ae := range fired {
+		a.fire(ae)
+	}
+}
+
+// evaluate the rules on a packet of the stream that couldn't be decoded
+func (a *alerts) decodeError(ss *shineStream, direction string, seen time.Time) {
+	if a == nil {
+		return
+	}
+	var fired []alertEvent
+	a.mu.Lock()
+	for _, r := range a.rules {
+		if r.Event != alertEventDecodeError || !r.matchesFlow(ss.flowName, direction) || !r.match(seen) {
+			continue
+		}
+		fired = append(fired, r.event(seen, ss.flowID, ss.flowName, ss.sessionID, direction))
+	}
+	a.mu.Unlock()
+	for _, ae := range fired {
+		a.fire(ae)
+	}
+}
+
+// log the alert, send it to the UI and to the webhook
+func (a *alerts) fire(ae alertEvent) {
+	what := fmt.Sprintf("%v %v", ae.Direction, ae.Command)
+	if ae.Event == alertEventDecodeError {
+		what = fmt.Sprintf("%v decode errors", ae.Direction)
+	}
+	if ae.Count > 1 {
+		what = fmt.Sprintf("%v x %v in %v", ae.Count, what, time.Duration(ae.WindowSeconds*float64(time.Second)))
+	}
+	if ae.Message != "" {
+		what = ae.Message + ", " + what
+	}
+	log.Warningf("[%v] alert %v: %v", ae.FlowName, ae.RuleID, what)
+	a.ws.broadcast(envelope(wsAlert, ae))
+	a.webhook.post(ae)
+}
+
+// AlertStats is what a rule did, in /api/stats
+type AlertStats struct {
+	ID         string     `json:"id"`
+	Fired      uint64     `json:"fired"`
+	Suppressed uint64     `json:"suppressed"`
+	LastFired  *time.Time `json:"lastFired,omitempty"`
+}
+
+func (a *alerts) stats() []AlertStats {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]AlertStats, 0, len(a.rules))
+	for _, r := range a.rules {
+		s := AlertStats{
+			ID:         r.ID,
+			Fired:      r.fired,
+			Suppressed: r.suppressed,
+		}
+		if !r.lastFired.IsZero() {
+			last := r.lastFired
+			s.LastFired = &last
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+func (a *alerts) close() {
+	if a == nil {
+		return
+	}
+	a.webhook.close()
+}
+
+// alertWebhook posts every alert as json to alerts.webhook, one at a time, firing never waits for it
+type alertWebhook struct {
+	url    string
+	client *http.Client
+	queue  chan alertEvent
+	done   chan bool
+	failed uint64
+	// workers of streams that weren't drained in time may still fire after close
+	closed bool
+	mu     sync.RWMutex
+}
+
+func newAlertWebhook(u string) *alertWebhook {
+	aw := &alertWebhook{
+		url:    u,
+		client: &http.Client{Timeout: alertWebhookTimeout},
+		queue:  make(chan alertEvent, alertWebhookQueueSize),
+		done:   make(chan bool),
+	}
+	go aw.run()
+	return aw
+}
+
+func (aw *alertWebhook) post(ae alertEvent) {
+	if aw == nil {
+		return
+	}
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+	if aw.closed {
+		return
+	}
+	select {
+	case aw.queue <- ae:
+	default:
+		atomic.AddUint64(&aw.failed, 1)
+		log.Warningf("alert %v not sent to alerts.webhook, %v alerts are already waiting", ae.RuleID, alertWebhookQueueSize)
+	}
+}
+
+func (aw *alertWebhook) run() {
+	defer close(aw.done)
+	for ae := range aw.queue {
+		if err := aw.send(ae); err != nil {
+			atomic.AddUint64(&aw.failed, 1)
+			log.Warningf("alert %v not sent to alerts.webhook: %v", ae.RuleID, err)
+		}
+	}
+}
+
+func (aw *alertWebhook) send(ae alertEvent) error {
+	d, err := json.Marshal(ae)
+	if err != nil {
+		return err
+	}
+	res, err := aw.client.Post(aw.url, "application/json", bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%v answered %v", aw.url, res.Status)
+	}
+	return nil
+}
+
+// alerts the webhook dropped or failed to send
+func (a *alerts) webhookFailures() uint64 {
+	if a == nil {
+		return 0
+	}
+	return a.webhook.failures()
+}
+
+func (aw *alertWebhook) failures() uint64 {
+	if aw == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&aw.failed)
+}
+
+// send the alerts still queued, for at most alertWebhookTimeout
+func (aw *alertWebhook) close() {
+	if aw == nil {
+		return
+	}
+	aw.mu.Lock()
+	if aw.closed {
+		aw.mu.Unlock()
+		return
+	}
+	aw.closed = true
+	close(aw.queue)
+	aw.mu.Unlock()
+	select {
+	case <-aw.done:
+	case <-time.After(alertWebhookTimeout):
+		log.Warningf("alerts still queued for alerts.webhook after %v, giving up", alertWebhookTimeout)
+	}
+}
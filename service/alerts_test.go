@@ -0,0 +1,296 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/shine-o/shine.engine.core/networking"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func alertPacket(p *protocol, flowName, direction string, opCode uint16, data []byte, seen time.Time) PacketEvent {
+	return PacketEvent{
+		FlowID:    "login",
+		FlowName:  flowName,
+		Direction: direction,
+		Seen:      seen,
+		Packet: &networking.Command{
+			Base: networking.CommandBase{
+				OperationCode:    opCode,
+				ClientStructName: p.commandName(opCode),
+				Data:             data,
+			},
+		},
+	}
+}
+
+func TestNewAlertRule(t *testing.T) {
+	p := testProtocol(t)
+	tests := []struct {
+		name string
+		rule AlertRule
+		err  bool
+	}{
+		{"defaults", AlertRule{ID: "any"}, false},
+		{"opcode", AlertRule{ID: "login", OpCode: strconv.Itoa(int(opLoginAck))}, false},
+		{"command name", AlertRule{ID: "login", OpCode: "NC_USER_LOGIN_ACK"}, false},
+		{"decode errors", AlertRule{ID: "errors", Event: alertEventDecodeError, Direction: "inbound", Count: 3, Window: time.Second}, false},
+		{"no id", AlertRule{}, true},
+		{"unknown event", AlertRule{ID: "r", Event: "flow"}, true},
+		{"direction", AlertRule{ID: "r", Direction: "sideways"}, true},
+		{"decode error with an opcode", AlertRule{ID: "r", Event: alertEventDecodeError, OpCode: "3082"}, true},
+		{"decode error with a payload", AlertRule{ID: "r", Event: alertEventDecodeError, Payload: "00"}, true},
+		{"unknown command", AlertRule{ID: "r", OpCode: "NC_NOTHING"}, true},
+		{"payload", AlertRule{ID: "r", Payload: "zz"}, true},
+		{"count without a window", AlertRule{ID: "r", Count: 2}, true},
+		{"negative cooldown", AlertRule{ID: "r", Cooldown: -time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newAlertRule(p, tt.rule)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if r.Count < 1 || (tt.rule.Event == "" && r.Event != alertEventPacket) {
+				t.Errorf("count %v and event %q", r.Count, r.Event)
+			}
+			if tt.rule.OpCode != "" && (!r.hasOpCode || r.opCode != opLoginAck) {
+				t.Errorf("operation code %v, %v", r.opCode, r.hasOpCode)
+			}
+		})
+	}
+
+	if _, err := newAlerts(p, newWebSockets(), []AlertRule{{ID: "r"}, {ID: "r"}}, ""); err == nil {
+		t.Error("two rules with the same id")
+	}
+	if _, err := newAlerts(p, newWebSockets(), []AlertRule{{ID: "r"}}, "ftp://hooks.example.com"); err == nil {
+		t.Error("a webhook that isn't http")
+	}
+	if a, err := newAlerts(p, newWebSockets(), nil, "http://hooks.example.com"); a != nil || err != nil {
+		t.Errorf("alerts %v and error %v without rules", a, err)
+	}
+}
+
+func TestAlertRuleMatchesPacket(t *testing.T) {
+	p := testProtocol(t)
+	seen := testStart
+	tests := []struct {
+		name    string
+		rule    AlertRule
+		packet  PacketEvent
+		matches bool
+	}{
+		{"every packet", AlertRule{}, alertPacket(p, "login-client", "inbound", opLoginAck, nil, seen), true},
+		{"opcode", AlertRule{OpCode: "3082"}, alertPacket(p, "login-client", "inbound", opLoginAck, nil, seen), true},
+		{"other opcode", AlertRule{OpCode: "3082"}, alertPacket(p, "login-client", "outbound", opChatReq, nil, seen), false},
+		{"direction", AlertRule{Direction: "outbound"}, alertPacket(p, "login-client", "outbound", opChatReq, nil, seen), true},
+		{"other direction", AlertRule{Direction: "outbound"}, alertPacket(p, "login-client", "inbound", opLoginAck, nil, seen), false},
+		{"flow", AlertRule{Flow: "zone00-client"}, alertPacket(p, "zone00-client", "inbound", opLoginAck, nil, seen), true},
+		{"other flow", AlertRule{Flow: "zone00-client"}, alertPacket(p, "login-client", "inbound", opLoginAck, nil, seen), false},
+		{"payload", AlertRule{Payload: "0b0c"}, alertPacket(p, "login-client", "inbound", opLoginAck, []byte{0x0a, 0x0b, 0x0c, 0x0d}, seen), true},
+		{"payload it doesn't have", AlertRule{Payload: "0c0b"}, alertPacket(p, "login-client", "inbound", opLoginAck, []byte{0x0a, 0x0b, 0x0c, 0x0d}, seen), false},
+		{"payload longer than the packet's", AlertRule{Payload: "0a0b0c0d0e"}, alertPacket(p, "login-client", "inbound", opLoginAck, []byte{0x0a, 0x0b, 0x0c, 0x0d}, seen), false},
+		{"empty payload", AlertRule{Payload: "00"}, alertPacket(p, "login-client", "inbound", opLoginAck, nil, seen), false},
+		{"everything", AlertRule{OpCode: "3082", Direction: "inbound", Flow: "login-client", Payload: "0d"}, alertPacket(p, "login-client", "inbound", opLoginAck, []byte{0x0a, 0x0b, 0x0c, 0x0d}, seen), true},
+		{"decode errors", AlertRule{Event: alertEventDecodeError}, alertPacket(p, "login-client", "inbound", opLoginAck, nil, seen), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.ID = "r"
+			r, err := newAlertRule(p, tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matches := r.matchesPacket(tt.packet); matches != tt.matches {
+				t.Errorf("matches %v, expected %v", matches, tt.matches)
+			}
+		})
+	}
+}
+
+// a rule fires once count matches happen within its window, then stays quiet for its cooldown
+func TestAlertRuleMatch(t *testing.T) {
+	p := testProtocol(t)
+	tests := []struct {
+		name     string
+		count    int
+		window   time.Duration
+		cooldown time.Duration
+		// capture times of the matches, in seconds after testStart, and whether each fires
+		at         []float64
+		fires      []bool
+		suppressed uint64
+	}{
+		{
+			name:  "every match",
+			at:    []float64{0, 0, 1},
+			fires: []bool{true, true, true},
+		},
+		{
+			name:       "cooldown",
+			cooldown:   10 * time.Second,
+			at:         []float64{0, 5, 9.9, 10, 15, 25},
+			fires:      []bool{true, false, false, true, false, true},
+			suppressed: 3,
+		},
+		{
+			name:   "count within the window",
+			count:  3,
+			window: 10 * time.Second,
+			at:     []float64{0, 1, 2, 3, 4, 5},
+			fires:  []bool{false, false, true, false, false, true},
+		},
+		{
+			name:   "matches too far apart",
+			count:  3,
+			window: 10 * time.Second,
+			at:     []float64{0, 6, 11, 12, 30, 31, 40},
+			// 0 and 11 are more than the window apart, 6, 11 and 12 aren't, nor are 30, 31 and 40
+			fires: []bool{false, false, false, true, false, false, true},
+		},
+		{
+			name:   "on the edge of the window",
+			count:  2,
+			window: 10 * time.Second,
+			at:     []float64{0, 10, 20.5, 30.6},
+			fires:  []bool{false, true, false, false},
+		},
+		{
+			name:       "count and cooldown",
+			count:      2,
+			window:     10 * time.Second,
+			cooldown:   time.Minute,
+			at:         []float64{0, 1, 2, 3, 4, 5, 61, 62},
+			fires:      []bool{false, true, false, false, false, false, false, true},
+			suppressed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newAlertRule(p, AlertRule{ID: "r", Count: tt.count, Window: tt.window, Cooldown: tt.cooldown})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fires []bool
+			for _, s := range tt.at {
+				fires = append(fires, r.match(testStart.Add(time.Duration(s*float64(time.Second)))))
+			}
+			if !reflect.DeepEqual(fires, tt.fires) {
+				t.Errorf("fired %v, expected %v", fires, tt.fires)
+			}
+			var fired uint64
+			for _, f := range tt.fires {
+				if f {
+					fired++
+				}
+			}
+			if r.fired != fired || r.suppressed != tt.suppressed {
+				t.Errorf("%v fired and %v suppressed, expected %v and %v", r.fired, r.suppressed, fired, tt.suppressed)
+			}
+		})
+	}
+}
+
+// fired alerts are posted to the webhook as json, failures are counted
+func TestAlertsWebhook(t *testing.T) {
+	p := testProtocol(t)
+	received := make(chan alertEvent, alertWebhookQueueSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%v with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var ae alertEvent
+		if err := json.NewDecoder(r.Body).Decode(&ae); err != nil {
+			t.Error(err)
+		}
+		received <- ae
+	}))
+	defer srv.Close()
+
+	a, err := newAlerts(p, newWebSockets(), []AlertRule{
+		{ID: "login", Message: "someone logged in", OpCode: "NC_USER_LOGIN_ACK", Direction: "inbound"},
+		{ID: "errors", Event: alertEventDecodeError, Count: 2, Window: time.Minute},
+	}, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.packet(alertPacket(p, "login-client", "outbound", opChatReq, nil, testStart))
+	a.packet(alertPacket(p, "login-client", "inbound", opLoginAck, nil, testStart.Add(time.Second)))
+	ss := sessionStream("login", "192.168.1.20")
+	a.decodeError(ss, "outbound", testStart.Add(2*time.Second))
+	a.decodeError(ss, "outbound", testStart.Add(3*time.Second))
+	a.close()
+	close(received)
+
+	var events []alertEvent
+	for ae := range received {
+		events = append(events, ae)
+	}
+	expected := []alertEvent{
+		{
+			RuleID:        "login",
+			Message:       "someone logged in",
+			Event:         alertEventPacket,
+			Seen:          testStart.Add(time.Second),
+			FlowID:        "login",
+			FlowName:      "login-client",
+			Direction:     "inbound",
+			OperationCode: opLoginAck,
+			Command:       "NC_USER_LOGIN_ACK",
+			Count:         1,
+		},
+		{
+			RuleID:        "errors",
+			Event:         alertEventDecodeError,
+			Seen:          testStart.Add(3 * time.Second),
+			FlowID:        "login",
+			FlowName:      "login-client",
+			Direction:     "outbound",
+			Count:         2,
+			WindowSeconds: 60,
+		},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("%v alerts posted, expected %v: %+v", len(events), len(expected), events)
+	}
+	for i, e := range expected {
+		if !events[i].Seen.Equal(e.Seen) {
+			t.Errorf("alert %v seen at %v, expected %v", i, events[i].Seen, e.Seen)
+		}
+		events[i].Seen = e.Seen
+		if events[i] != e {
+			t.Errorf("alert %v posted as %+v, expected %+v", i, events[i], e)
+		}
+	}
+	if f := a.webhookFailures(); f != 0 {
+		t.Errorf("%v webhook failures", f)
+	}
+	stats := a.stats()
+	if len(stats) != 2 || stats[0].Fired != 1 || stats[1].Fired != 1 || stats[0].LastFired == nil {
+		t.Errorf("stats %+v", stats)
+	}
+	// nothing is posted once the webhook is closed
+	a.packet(alertPacket(p, "login-client", "inbound", opLoginAck, nil, testStart.Add(time.Hour)))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	a, err = newAlerts(p, newWebSockets(), []AlertRule{{ID: "every"}}, failing.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		a.packet(alertPacket(p, "login-client", "inbound", opLoginAck, nil, testStart))
+	}
+	a.close()
+	if f := a.webhookFailures(); f != 3 {
+		t.Errorf("%v webhook failures, expected 3", f)
+	}
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pseudonyms are numbered per role, e.g client-1, server-1
+// addresses only seen in log lines, or in a database recorded without --anonymize, are hosts
+const (
+	roleClient = "client"
+	roleServer = "server"
+	roleHost   = "host"
+)
+
+// anonymizer maps ip addresses to stable pseudonyms, the mapping is saved to path every time it grows
+// so later runs, and exports of their output, use the same names
+// loaded by capture --anonymize and export --anonymize, a nil anonymizer leaves the addresses as they are
+// streams keep their real endpoints, the xor state and the bpf filter depend on them
+// addresses are only replaced as they are written to the logs, the json files, the websocket, the api and the other outputs
+type anonymizer struct {
+	path string
+	// aes-gcm key derived from output.anonymize.key, the mapping is plain json without one
+	key     []byte
+	mapping anonymizerMapping
+	mu      sync.Mutex
+}
+
+type anonymizerMapping struct {
+	// ip to pseudonym
+	Names map[string]string `json:"names"`
+	// last number given to each role
+	Counts map[string]int `json:"counts"`
+}
+
+// load the mapping saved at path, a missing file starts an empty one
+func loadAnonymizer(path, passphrase string) (*anonymizer, error) {
+	a := &anonymizer{
+		path: path,
+		mapping: anonymizerMapping{
+			Names:  make(map[string]string),
+			Counts: make(map[string]int),
+		},
+	}
+	if passphrase != "" {
+		sum := sha256.Sum256([]byte(passphrase))
+		a.key = sum[:]
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.key != nil {
+		data, err = a.open(data)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting %v: %v, is output.anonymize.key the one it was written with?", path, err)
+		}
+	}
+	if err := json.Unmarshal(data, &a.mapping); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if a.mapping.Names == nil {
+		a.mapping.Names = make(map[string]string)
+	}
+	if a.mapping.Counts == nil {
+		a.mapping.Counts = make(map[string]int)
+	}
+	log.Infof("loaded %v pseudonyms from %v", len(a.mapping.Names), path)
+	return a, nil
+}
+
+func (a *anonymizer) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(a.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the nonce is written before the sealed mapping
+func (a *anonymizer) seal(data []byte) ([]byte, error) {
+	gcm, err := a.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func (a *anonymizer) open(data []byte) ([]byte, error) {
+	gcm, err := a.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("file too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// write the mapping to a temporary file first, like the xor state, called with the lock held
+func (a *anonymizer) save() error {
+	data, err := json.MarshalIndent(a.mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	if a.key != nil {
+		if data, err = a.seal(data); err != nil {
+			return err
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// the pseudonym of ip, given the next number of role if it has none yet
+// anything that isn't an ip, loopback and unspecified addresses are returned as they are
+func (a *anonymizer) name(ip, role string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsLoopback() || parsed.IsUnspecified() {
+		return ip
+	}
+	key := parsed.String()
+
+	a.mu.Lock()
+	name, ok := a.mapping.Names[key]
+	if ok {
+		a.mu.Unlock()
+		return name
+	}
+	a.mapping.Counts[role]++
+	name = fmt.Sprintf("%v-%v", role, a.mapping.Counts[role])
+	a.mapping.Names[key] = name
+	err := a.save()
+	a.mu.Unlock()
+
+	// logged without the lock, the log goes through the anonymizer too
+	if err != nil {
+		log.Errorf("saving the pseudonyms to %v: %v", a.path, err)
+	}
+	return name
+}
+
+// name both ends of a new stream, so clients and servers are numbered in the order they show up
+func (a *anonymizer) endpoints(network gopacket.Flow, srcIsServer bool) {
+	if a == nil {
+		return
+	}
+	client, server := network.Src().String(), network.Dst().String()
+	if srcIsServer {
+		client, server = server, client
+	}
+	a.name(client, roleClient)
+	a.name(server, roleServer)
+}
+
+// the zone a world manager announces is a server, even before a client connects to it
+func (a *anonymizer) server(ip string) {
+	if a == nil {
+		return
+	}
+	a.name(ip, roleServer)
+}
+
+// ip as written to the outputs
+func (a *anonymizer) ip(ip string) string {
+	if a == nil {
+		return ip
+	}
+	return a.name(ip, roleHost)
+}
+
+// ip:port as written to the outputs, e.g client-1:53412
+func (a *anonymizer) address(hostPort string) string {
+	if a == nil {
+		return hostPort
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return a.ip(hostPort)
+	}
+	return net.JoinHostPort(a.ip(host), port)
+}
+
+// pe with the addresses of both sides as written to the outputs, done once before the packet is handed to the sinks
+func (a *anonymizer) packet(pe PacketEvent) PacketEvent {
+	pe.Src, pe.Dst = a.address(pe.Src), a.address(pe.Dst)
+	return pe
+}
+
+// src->dst as written to the outputs
+func (a *anonymizer) flow(network gopacket.Flow) string {
+	if a == nil {
+		return network.String()
+	}
+	return fmt.Sprintf("%v->%v", a.ip(network.Src().String()), a.ip(network.Dst().String()))
+}
+
+// a made up address for the pcap outputs, which can't hold names, 10.<role>.<number>
+func (a *anonymizer) tcpAddr(addr *net.TCPAddr) *net.TCPAddr {
+	if a == nil {
+		return addr
+	}
+	name := a.ip(addr.IP.String())
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return addr
+	}
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return addr
+	}
+	roles := map[string]byte{roleClient: 0, roleServer: 1, roleHost: 2}
+	return &net.TCPAddr{
+		IP:   net.IPv4(10, roles[name[:i]], byte(n>>8), byte(n)),
+		Port: addr.Port,
+	}
+}
+
+// ipv4 and ipv6 lookalikes, net.ParseIP decides, so times like 12:30:00 are left alone
+var textAddresses = regexp.MustCompile(`(?:\d{1,3}\.){3}\d{1,3}|[0-9a-fA-F]{0,4}(?::[0-9a-fA-F]{0,4}){2,7}`)
+
+// s with every ip address in it replaced, used for log lines
+func (a *anonymizer) text(s string) string {
+	if a == nil {
+		return s
+	}
+	return textAddresses.ReplaceAllStringFunc(s, a.ip)
+}
+
+// anonymizedWriter replaces the ip addresses of the log lines written through it
+type anonymizedWriter struct {
+	w io.Writer
+	a *anonymizer
+}
+
+func (aw anonymizedWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(aw.w, aw.a.text(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
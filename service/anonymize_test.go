@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clients and servers are numbered in the order they show up, the names stay the same for the next run
+func TestAnonymizerNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pseudonyms.json")
+	a, err := loadAnonymizer(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.ParseIP("192.168.1.20").To4(), net.ParseIP("192.168.1.10").To4()
+	// the server sent the first packet the stream saw
+	a.endpoints(gopacket.NewFlow(layers.EndpointIPv4, server, client), true)
+	a.server("10.0.0.5")
+
+	tests := []struct {
+		in, out string
+	}{
+		{"192.168.1.20", "client-1"},
+		{"192.168.1.10", "server-1"},
+		{"10.0.0.5", "server-2"},
+		{"172.16.0.1", "host-1"},
+		{"2001:db8::1", "host-2"},
+		{"2001:0db8:0000::1", "host-2"},
+		{"127.0.0.1", "127.0.0.1"},
+		{"::", "::"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		if name := a.ip(tt.in); name != tt.out {
+			t.Errorf("%v named %v, expected %v", tt.in, name, tt.out)
+		}
+	}
+	if addr := a.address("192.168.1.20:50000"); addr != "client-1:50000" {
+		t.Errorf("address %v", addr)
+	}
+	if addr := a.tcpAddr(&net.TCPAddr{IP: server, Port: 9010}); !addr.IP.Equal(net.IPv4(10, 1, 0, 1)) || addr.Port != 9010 {
+		t.Errorf("pcap address of server-1 %v", addr)
+	}
+	line := "new stream from 192.168.1.20:50000 to 192.168.1.10 at 12:30:00"
+	if s := a.text(line); s != "new stream from client-1:50000 to server-1 at 12:30:00" {
+		t.Errorf("log line %q", s)
+	}
+
+	again, err := loadAnonymizer(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := again.ip("192.168.1.10"); name != "server-1" {
+		t.Errorf("the next run named the server %v", name)
+	}
+	if name := again.ip("10.9.9.9"); name != "host-3" {
+		t.Errorf("the next run named a new host %v, expected the numbers to go on", name)
+	}
+
+	var none *anonymizer
+	if none.ip("192.168.1.20") != "192.168.1.20" || none.text(line) != line {
+		t.Error("a nil anonymizer changed addresses")
+	}
+}
+
+// a mapping written with a key is only readable with it
+func TestAnonymizerKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pseudonyms.json")
+	a, err := loadAnonymizer(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.ip("192.168.1.20")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("192.168.1.20")) || bytes.Contains(data, []byte("host-1")) {
+		t.Errorf("the mapping is readable without the key: %s", data)
+	}
+	if _, err := loadAnonymizer(path, "other"); err == nil || !strings.Contains(err.Error(), "output.anonymize.key") {
+		t.Errorf("loading with another key: %v", err)
+	}
+	if _, err := loadAnonymizer(path, ""); err == nil {
+		t.Error("loaded a sealed mapping without a key")
+	}
+	again, err := loadAnonymizer(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := again.ip("192.168.1.20"); name != "host-1" {
+		t.Errorf("named %v with the key, expected host-1", name)
+	}
+}
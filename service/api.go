@@ -0,0 +1,121 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// flowView is the json representation of an active stream
+type flowView struct {
+	FlowID           string    `json:"flowID"`
+	FlowName         string    `json:"flowName"`
+	Transport        string    `json:"transport"`
+	Src              string    `json:"src"`
+	Dst              string    `json:"dst"`
+	Packets          int       `json:"packets"`
+	Bytes            int       `json:"bytes"`
+	FirstSeen        time.Time `json:"firstSeen"`
+	LastSeen         time.Time `json:"lastSeen"`
+	XorKeyFound      bool      `json:"xorKeyFound"`
+	Unreliable       bool      `json:"unreliable"`
+	TruncatedPackets int       `json:"truncatedPackets"`
+	SegmentsDropped  int       `json:"segmentsDropped"`
+	Duplicates       int       `json:"duplicatePackets"`
+	// "detected" if the xor offset of the client stream drifted, "corrected" once it was found again
+	XorDrift string `json:"xorDrift,omitempty"`
+	// times the watchdog found a decoder of the stream receiving without decoding, and times one was reset
+	DecodersWedged int `json:"decodersWedged"`
+	DecoderResets  int `json:"decoderResets"`
+	// segments waiting for the client and server decoders, a deep queue is a decoder that can't keep up
+	ClientQueueDepth int             `json:"clientQueueDepth"`
+	ServerQueueDepth int             `json:"serverQueueDepth"`
+	RecentPackets    []packetSummary `json:"recentPackets,omitempty"`
+}
+
+func (ss *shineStream) view(withRecent bool) flowView {
+	ss.stats.mu.Lock()
+	defer ss.stats.mu.Unlock()
+	fv := flowView{
+		FlowID:           ss.flowID,
+		FlowName:         ss.flowName,
+		Transport:        "tcp",
+		Src:              ss.sniffer.session.anonymizer().address(srcAddress(ss.net, ss.transport)),
+		Dst:              ss.sniffer.session.anonymizer().address(dstAddress(ss.net, ss.transport)),
+		Packets:          ss.stats.packets,
+		Bytes:            ss.stats.bytes,
+		FirstSeen:        ss.stats.firstSeen,
+		LastSeen:         ss.stats.lastSeen,
+		XorKeyFound:      ss.stats.xorKeyFound || ss.sniffer.config.ServerSideCapture,
+		Unreliable:       ss.stats.truncated > 0,
+		TruncatedPackets: ss.stats.truncated,
+		SegmentsDropped:  ss.stats.dropped,
+		Duplicates:       ss.stats.duplicates,
+		XorDrift:         ss.stats.xorDrift,
+		DecodersWedged:   ss.stats.wedged,
+		DecoderResets:    ss.stats.resets,
+		ClientQueueDepth: ss.client.depth(),
+		ServerQueueDepth: ss.server.depth(),
+	}
+	if withRecent {
+		fv.RecentPackets = append([]packetSummary(nil), ss.stats.recent...)
+	}
+	return fv
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+// GET /api/flows lists every active stream and udp flow, GET /api/flows/{flowID} shows one with its recent packets
+func (sn *Sniffer) flowsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flowID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/flows"), "/")
+
+	if flowID == "" {
+		writeJSON(w, sn.flowViews())
+		return
+	}
+
+	sn.streams.mu.Lock()
+	ss, ok := sn.streams.streams[flowID]
+	sn.streams.mu.Unlock()
+	if !ok {
+		if fv, ok := sn.udp.find(flowID); ok {
+			writeJSON(w, fv)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, ss.view(true))
+}
+
+// every active stream and udp flow, oldest first
+func (sn *Sniffer) flowViews() []flowView {
+	sn.streams.mu.Lock()
+	streams := make([]*shineStream, 0, len(sn.streams.streams))
+	for _, ss := range sn.streams.streams {
+		streams = append(streams, ss)
+	}
+	sn.streams.mu.Unlock()
+
+	flows := make([]flowView, 0, len(streams))
+	for _, ss := range streams {
+		flows = append(flows, ss.view(false))
+	}
+	flows = append(flows, sn.udp.views()...)
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].FirstSeen.Before(flows[j].FirstSeen)
+	})
+	return flows
+}
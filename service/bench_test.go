@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/logger"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flows connections to the login server sending packets alternately from the client and the server, each payload
+// starts with its number so protocol.dedup doesn't drop any
+func benchSource(b *testing.B, size, flows, packets int) *MemorySource {
+	b.Helper()
+	ms := NewMemorySource()
+	for f := 0; f < flows; f++ {
+		client := fmt.Sprintf("10.%v.%v.%v:%v", f/62500%250, f/250%250, f%250+1, 50000+f%10000)
+		conv, err := NewTCPConversation(ms, client, testServerAddr, testStart)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := conv.Open(); err != nil {
+			b.Fatal(err)
+		}
+		if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+			b.Fatal(err)
+		}
+		conv.XorClient(testXorSettings(), testSeed)
+		for i := 0; i < packets/flows; i++ {
+			payload := make([]byte, size)
+			binary.LittleEndian.PutUint32(payload, uint32(i))
+			if i%2 == 0 {
+				err = conv.FromClient(EncodeShinePacket(opChatReq, payload))
+			} else {
+				err = conv.FromServer(EncodeShinePacket(opLoginAck, payload))
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := conv.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return ms
+}
+
+// the assembler, the stream factory and the decoders with every output off, an op is a decoded packet
+//
+//	go test ./service -run XXX -bench Pipeline -benchmem -count 10 > new.txt && benchstat old.txt new.txt
+func BenchmarkPipeline(b *testing.B) {
+	// the streams log every flow they open, it would end up between the results
+	defer func(l *logger.Logger) { log = l }(log)
+	log = newLogger(io.Discard, false, nil)
+	for _, size := range []int{16, 256, 1400} {
+		for _, flows := range []int{1, 16, 64} {
+			b.Run(fmt.Sprintf("size=%v/flows=%v", size, flows), func(b *testing.B) {
+				// every flow gets at least one packet each way
+				packets := b.N
+				if packets < 2*flows {
+					packets = 2 * flows
+				}
+				ms := benchSource(b, size, flows, packets)
+				sn, err := NewSniffer(testConfig())
+				if err != nil {
+					b.Fatal(err)
+				}
+				var handled uint64
+				sn.Handler = func(pe PacketEvent) {
+					atomic.AddUint64(&handled, 1)
+				}
+				sn.Source = ms
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				started := time.Now()
+				if err := sn.Start(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				<-sn.Done()
+				sn.Stop()
+				b.StopTimer()
+				elapsed := time.Since(started)
+
+				// and the seed of every flow
+				expected := packets/flows*flows + flows
+				if n := atomic.LoadUint64(&handled); n != uint64(expected) {
+					b.Fatalf("%v packets decoded, expected %v", n, expected)
+				}
+				b.ReportMetric(float64(expected)/elapsed.Seconds(), "packets/s")
+			})
+		}
+	}
+}
+
+// one flow of a million packets handled by pools of workers, an op is the whole stream
+//
+//	go test ./service -run XXX -bench StreamWorkers -benchmem -count 5
+func BenchmarkStreamWorkers(b *testing.B) {
+	const packets = 1000000
+	defer func(l *logger.Logger) { log = l }(log)
+	log = newLogger(io.Discard, false, nil)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%v", workers), func(b *testing.B) {
+			c := testConfig()
+			c.Workers = workers
+			b.ReportAllocs()
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				ms := benchSource(b, 16, 1, packets)
+				sn, err := NewSniffer(c)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var handled uint64
+				sn.Handler = func(pe PacketEvent) {
+					atomic.AddUint64(&handled, 1)
+				}
+				sn.Source = ms
+				b.StartTimer()
+
+				started := time.Now()
+				if err := sn.Start(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				<-sn.Done()
+				sn.Stop()
+				elapsed += time.Since(started)
+
+				// and the seed
+				if n := atomic.LoadUint64(&handled); n != packets+1 {
+					b.Fatalf("%v packets decoded, expected %v", n, packets+1)
+				}
+			}
+			b.ReportMetric(float64(packets+1)*float64(b.N)/elapsed.Seconds(), "packets/s")
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	brokerDialTimeout  = 5 * time.Second
+	brokerRetryDelay   = time.Second
+	brokerDropsLogging = 10 * time.Second
+	// how long kafka messages wait to be sent with the next ones in a batch
+	kafkaBatchTimeout = 50 * time.Millisecond
+)
+
+// BrokerConfig is read from output.broker, an empty Type publishes nothing
+type BrokerConfig struct {
+	// nats or kafka
+	Type string
+	// host:port of the nats server, comma separated host:port of kafka brokers
+	Address string
+	// nats subject or kafka topic the events are published on
+	Topic string
+	// events waiting to be published, once full new events are dropped
+	QueueSize int
+}
+
+// brokerEvent is a decoded packet as published to the broker
+type brokerEvent struct {
+	PacketID      string          `json:"packetID"`
+	Seq           uint64          `json:"seq"`
+	FlowID        string          `json:"flowID"`
+	FlowName      string          `json:"flowName"`
+	Src           string          `json:"src"`
+	Dst           string          `json:"dst"`
+	Seen          time.Time       `json:"seen"`
+	Direction     string          `json:"direction"`
+	OperationCode uint16          `json:"operationCode"`
+	Command       string          `json:"command"`
+	Data          string          `json:"data"`
+	Decoded       json.RawMessage `json:"decoded,omitempty"`
+}
+
+// the sink publishing to output.broker, nil if no broker is set
+// events it drops are counted in sm
+func newPublisher(c BrokerConfig, sm *snifferMetrics) (Sink, error) {
+	switch strings.ToLower(c.Type) {
+	case "":
+		return nil, nil
+	case "nats":
+		if c.Address == "" || c.Topic == "" {
+			return nil, fmt.Errorf("output.broker: nats needs an address and a topic")
+		}
+		if c.QueueSize < 1 {
+			c.QueueSize = 1
+		}
+		conn, err := newNatsConn(c)
+		if err != nil {
+			return nil, err
+		}
+		return newQueuedPublisher(conn, c.QueueSize, sm), nil
+	case "kafka":
+		if c.Address == "" || c.Topic == "" {
+			return nil, fmt.Errorf("output.broker: kafka needs an address and a topic")
+		}
+		if c.QueueSize < 1 {
+			c.QueueSize = 1
+		}
+		return newQueuedPublisher(newKafkaConn(c, sm), c.QueueSize, sm), nil
+	default:
+		return nil, fmt.Errorf("output.broker: unknown type %q", c.Type)
+	}
+}
+
+// brokerConn sends serialized events to a broker, it's only used from the queuedPublisher goroutine
+type brokerConn interface {
+	send(b []byte) error
+	close()
+}
+
+// queuedPublisher serializes events into a bounded queue that a single goroutine sends to the broker
+type queuedPublisher struct {
+	conn    brokerConn
+	queue   chan []byte
+	dropped uint64
+	metrics *snifferMetrics
+	done    chan bool
+	// workers of streams that weren't drained in time may still publish after close
+	closed bool
+	mu     sync.RWMutex
+}
+
+func newQueuedPublisher(conn brokerConn, size int, sm *snifferMetrics) *queuedPublisher {
+	qp := &queuedPublisher{
+		conn:    conn,
+		queue:   make(chan []byte, size),
+		metrics: sm,
+		done:    make(chan bool),
+	}
+	go qp.run()
+	return qp
+}
+
+func (qp *queuedPublisher) Publish(pe PacketEvent) {
+	e := brokerEvent{
+		PacketID:      pe.ID,
+		Seq:           pe.Seq,
+		FlowID:        pe.FlowID,
+		FlowName:      pe.FlowName,
+		Src:           pe.Src,
+		Dst:           pe.Dst,
+		Seen:          pe.Seen,
+		Direction:     pe.Direction,
+		OperationCode: pe.Packet.Base.OperationCode,
+		Command:       pe.Packet.Base.ClientStructName,
+		Data:          hex.EncodeToString(pe.Packet.Base.Data),
+	}
+	if pe.Decoded != "" {
+		e.Decoded = json.RawMessage(pe.Decoded)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	qp.mu.RLock()
+	defer qp.mu.RUnlock()
+	if qp.closed {
+		return
+	}
+	select {
+	case qp.queue <- b:
+	default:
+		atomic.AddUint64(&qp.dropped, 1)
+		qp.metrics.brokerEventDropped()
+	}
+}
+
+func (qp *queuedPublisher) run() {
+	defer close(qp.done)
+	defer qp.conn.close()
+
+	t := time.NewTicker(brokerDropsLogging)
+	defer t.Stop()
+
+	var (
+		logged    uint64
+		lastError time.Time
+	)
+
+	for {
+		select {
+		case b, ok := <-qp.queue:
+			if !ok {
+				return
+			}
+			// don't hammer a broker that is down, events are dropped until the retry delay passes
+			if time.Since(lastError) < brokerRetryDelay {
+				atomic.AddUint64(&qp.dropped, 1)
+				qp.metrics.brokerEventDropped()
+				break
+			}
+			if err := qp.conn.send(b); err != nil {
+				log.Errorf("publishing to broker: %v", err)
+				lastError = time.Now()
+				atomic.AddUint64(&qp.dropped, 1)
+				qp.metrics.brokerEventDropped()
+			}
+		case <-t.C:
+			if dropped := atomic.LoadUint64(&qp.dropped); dropped > logged {
+				log.Warningf("%v events dropped before reaching the broker", dropped-logged)
+				logged = dropped
+			}
+		}
+	}
+}
+
+// publish what is left in the queue and disconnect
+func (qp *queuedPublisher) Close() {
+	qp.mu.Lock()
+	if qp.closed {
+		qp.mu.Unlock()
+		return
+	}
+	qp.closed = true
+	close(qp.queue)
+	qp.mu.Unlock()
+
+	<-qp.done
+	if dropped := atomic.LoadUint64(&qp.dropped); dropped > 0 {
+		log.Warningf("%v events were dropped in total before reaching the broker", dropped)
+	}
+}
+
+// natsConn publishes on a single subject with the nats client, which reconnects in the background
+// events published while it is disconnected are buffered by the client until its reconnect buffer is full
+type natsConn struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func newNatsConn(c BrokerConfig) (*natsConn, error) {
+	nc, err := nats.Connect(c.Address,
+		nats.Name("shine-sniffer"),
+		nats.Timeout(brokerDialTimeout),
+		// a server that isn't up yet is retried like one that went away
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(brokerRetryDelay),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Errorf("disconnected from nats: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Infof("reconnected to nats on %v", nc.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Errorf("nats: %v", err)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("output.broker: %v", err)
+	}
+	log.Infof("publishing to nats on %v, subject %v", c.Address, c.Topic)
+	return &natsConn{nc: nc, subject: c.Topic}, nil
+}
+
+func (nc *natsConn) send(b []byte) error {
+	return nc.nc.Publish(nc.subject, b)
+}
+
+// send what the client still buffers and disconnect
+func (nc *natsConn) close() {
+	if nc.nc.IsConnected() {
+		if err := nc.nc.FlushTimeout(brokerDialTimeout); err != nil {
+			log.Errorf("flushing nats: %v", err)
+		}
+	}
+	nc.nc.Close()
+}
+
+// kafkaWriter is the part of kafka.Writer kafkaConn uses
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaConn produces to a kafka topic with an async writer, which batches the events and sends them in the background
+// at most limit events are handed to the writer and not acknowledged yet, past that events are refused like a broker
+// that is down, so a slow cluster costs events instead of memory
+type kafkaConn struct {
+	w       kafkaWriter
+	limit   int64
+	metrics *snifferMetrics
+	// events handed to the writer that it didn't report on yet
+	pending int64
+}
+
+func newKafkaConn(c BrokerConfig, sm *snifferMetrics) *kafkaConn {
+	kc := &kafkaConn{limit: int64(c.QueueSize), metrics: sm}
+	var brokers []string
+	for _, a := range strings.Split(c.Address, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			brokers = append(brokers, a)
+		}
+	}
+	kc.w = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        c.Topic,
+		Balancer:     &kafka.LeastBytes{},
+		BatchTimeout: kafkaBatchTimeout,
+		WriteTimeout: brokerDialTimeout,
+		Async:        true,
+		Completion:   kc.completed,
+	}
+	log.Infof("publishing to kafka on %v, topic %v", strings.Join(brokers, ", "), c.Topic)
+	return kc
+}
+
+func (kc *kafkaConn) send(b []byte) error {
+	if atomic.AddInt64(&kc.pending, 1) > kc.limit {
+		atomic.AddInt64(&kc.pending, -1)
+		return fmt.Errorf("kafka has %v events waiting to be acknowledged", kc.limit)
+	}
+	if err := kc.w.WriteMessages(context.Background(), kafka.Message{Value: b}); err != nil {
+		atomic.AddInt64(&kc.pending, -1)
+		return err
+	}
+	return nil
+}
+
+// called by the writer once a batch was sent or failed for good
+func (kc *kafkaConn) completed(messages []kafka.Message, err error) {
+	atomic.AddInt64(&kc.pending, -int64(len(messages)))
+	if err == nil {
+		return
+	}
+	log.Errorf("publishing %v events to kafka: %v", len(messages), err)
+	for range messages {
+		kc.metrics.brokerEventDropped()
+	}
+}
+
+// flush the batches that are left
+func (kc *kafkaConn) close() {
+	if err := kc.w.Close(); err != nil {
+		log.Error(err)
+	}
+}
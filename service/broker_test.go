@@ -0,0 +1,275 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/segmentio/kafka-go"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeKafkaWriter keeps the messages instead of producing them, they stay pending until complete is called
+type fakeKafkaWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	closed   bool
+}
+
+func (fw *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.messages = append(fw.messages, msgs...)
+	return nil
+}
+
+func (fw *fakeKafkaWriter) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.closed = true
+	return nil
+}
+
+func (fw *fakeKafkaWriter) written() []kafka.Message {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return append([]kafka.Message(nil), fw.messages...)
+}
+
+// fakeNatsServer answers the handshake and pings of a nats client and keeps the payloads published on each subject
+type fakeNatsServer struct {
+	l         net.Listener
+	mu        sync.Mutex
+	published map[string][][]byte
+	done      chan struct{}
+}
+
+func newFakeNatsServer(t *testing.T) *fakeNatsServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeNatsServer{l: l, published: make(map[string][][]byte), done: make(chan struct{})}
+	go fs.serve()
+	t.Cleanup(func() {
+		l.Close()
+	})
+	return fs
+}
+
+// a single client, done once it disconnects
+func (fs *fakeNatsServer) serve() {
+	defer close(fs.done)
+	c, err := fs.l.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "INFO {\"server_id\":\"fake\",\"version\":\"2.2.0\",\"proto\":1,\"max_payload\":1048576}\r\n"); err != nil {
+		return
+	}
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			if _, err := io.WriteString(c, "PONG\r\n"); err != nil {
+				return
+			}
+		case "PUB":
+			// PUB <subject> [reply] <size>
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			fs.mu.Lock()
+			fs.published[fields[1]] = append(fs.published[fields[1]], payload[:size])
+			fs.mu.Unlock()
+		}
+	}
+}
+
+func TestNewPublisher(t *testing.T) {
+	tests := []struct {
+		name string
+		c    BrokerConfig
+		sink bool
+		err  bool
+	}{
+		{"no broker", BrokerConfig{}, false, false},
+		{"nats", BrokerConfig{Type: "nats", Address: "localhost:4222", Topic: "packets"}, true, false},
+		{"nats without a subject", BrokerConfig{Type: "nats", Address: "localhost:4222"}, false, true},
+		{"kafka", BrokerConfig{Type: "kafka", Address: "kafka-1:9092, kafka-2:9092", Topic: "packets"}, true, false},
+		{"kafka upper case", BrokerConfig{Type: "Kafka", Address: "kafka-1:9092", Topic: "packets"}, true, false},
+		{"kafka without brokers", BrokerConfig{Type: "kafka", Topic: "packets"}, false, true},
+		{"kafka without a topic", BrokerConfig{Type: "kafka", Address: "kafka-1:9092"}, false, true},
+		{"unknown", BrokerConfig{Type: "amqp", Address: "localhost:5672", Topic: "packets"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := newPublisher(tt.c, newSnifferMetrics())
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, expected one %v", err, tt.err)
+			}
+			if (sink != nil) != tt.sink {
+				t.Fatalf("sink %v, expected one %v", sink, tt.sink)
+			}
+			if sink != nil {
+				sink.Close()
+			}
+		})
+	}
+}
+
+// events are refused once limit of them wait for the writer to report on them
+func TestKafkaPendingLimit(t *testing.T) {
+	fw := &fakeKafkaWriter{}
+	kc := &kafkaConn{w: fw, limit: 2, metrics: newSnifferMetrics()}
+	for i := 0; i < 2; i++ {
+		if err := kc.send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kc.send([]byte{2}); err == nil {
+		t.Fatal("an event past the limit was accepted")
+	}
+
+	kc.completed(fw.written(), nil)
+	if err := kc.send([]byte{3}); err != nil {
+		t.Fatalf("acknowledged events still count against the limit: %v", err)
+	}
+	if atomic.LoadUint64(&kc.metrics.brokerDropped) != 0 {
+		t.Error("acknowledged events were counted as dropped")
+	}
+}
+
+// a batch that failed for good frees its place and is counted as dropped
+func TestKafkaCompletionError(t *testing.T) {
+	fw := &fakeKafkaWriter{}
+	kc := &kafkaConn{w: fw, limit: 3, metrics: newSnifferMetrics()}
+	for i := 0; i < 3; i++ {
+		if err := kc.send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kc.completed(fw.written(), kafka.LeaderNotAvailable)
+	if dropped := atomic.LoadUint64(&kc.metrics.brokerDropped); dropped != 3 {
+		t.Errorf("%v events counted as dropped, expected 3", dropped)
+	}
+	if pending := atomic.LoadInt64(&kc.pending); pending != 0 {
+		t.Errorf("%v events still pending", pending)
+	}
+}
+
+// the events of a capture reach the writer as json, and closing the publisher closes the writer
+func TestKafkaPublish(t *testing.T) {
+	events := handshakeEvents(t)
+	fw := &fakeKafkaWriter{}
+	qp := newQueuedPublisher(&kafkaConn{w: fw, limit: 100}, 100, newSnifferMetrics())
+	for _, pe := range events {
+		qp.Publish(pe)
+	}
+	qp.Close()
+
+	messages := fw.written()
+	if len(messages) != len(events) {
+		t.Fatalf("%v messages written, expected %v", len(messages), len(events))
+	}
+	for i, m := range messages {
+		var e brokerEvent
+		if err := json.Unmarshal(m.Value, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.PacketID != events[i].ID || e.OperationCode != events[i].Packet.Base.OperationCode || e.FlowName != events[i].FlowName {
+			t.Errorf("message %v is %+v, expected packet %v", i, e, events[i].ID)
+		}
+	}
+	if !fw.closed {
+		t.Error("the writer wasn't closed")
+	}
+}
+
+// the events of a capture are published on the subject as json, closing the publisher flushes them
+func TestNatsPublish(t *testing.T) {
+	events := handshakeEvents(t)
+	fs := newFakeNatsServer(t)
+	conn, err := newNatsConn(BrokerConfig{Address: fs.l.Addr().String(), Topic: "packets"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qp := newQueuedPublisher(conn, 100, newSnifferMetrics())
+	for _, pe := range events {
+		qp.Publish(pe)
+	}
+	qp.Close()
+	<-fs.done
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	published := fs.published["packets"]
+	if len(published) != len(events) || len(fs.published) != 1 {
+		t.Fatalf("%v events published on packets and %v subjects, expected %v and 1", len(published), len(fs.published), len(events))
+	}
+	for i, b := range published {
+		var e brokerEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.PacketID != events[i].ID || e.OperationCode != events[i].Packet.Base.OperationCode {
+			t.Errorf("event %v is %+v, expected packet %v", i, e, events[i].ID)
+		}
+	}
+	if dropped := atomic.LoadUint64(&qp.dropped); dropped != 0 {
+		t.Errorf("%v events dropped", dropped)
+	}
+}
+
+// packets converted from a database or json lines have their addresses but no gopacket flows
+func TestBrokerConvertedAddresses(t *testing.T) {
+	tests := []struct {
+		direction string
+		src, dst  string
+	}{
+		{"outbound", testClientAddr, testServerAddr},
+		{"inbound", testServerAddr, testClientAddr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.direction, func(t *testing.T) {
+			pe := convertedPacket("flow", "login-client", tt.direction, testStart, opLoginReq, []byte{1})
+			pe.Src, pe.Dst = tt.src, tt.dst
+
+			fw := &fakeKafkaWriter{}
+			qp := newQueuedPublisher(&kafkaConn{w: fw, limit: 1}, 1, newSnifferMetrics())
+			qp.Publish(pe)
+			qp.Close()
+			messages := fw.written()
+			if len(messages) != 1 {
+				t.Fatalf("%v messages written, expected 1", len(messages))
+			}
+			var e brokerEvent
+			if err := json.Unmarshal(messages[0].Value, &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Src != tt.src || e.Dst != tt.dst {
+				t.Errorf("published from %q to %q, expected %v to %v", e.Src, e.Dst, tt.src, tt.dst)
+			}
+		})
+	}
+}
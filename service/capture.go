@@ -4,17 +4,21 @@ import (
 	"context"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/reassembly"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 5 * time.Second
+
 type Context struct {
 	ci gopacket.CaptureInfo
+	// the link layer of the packet, only kept with injection.enabled, see flowSequences
+	ethernet *layers.Ethernet
 }
 
 func (c Context) GetCaptureInfo() gopacket.CaptureInfo {
@@ -23,115 +27,159 @@ func (c Context) GetCaptureInfo() gopacket.CaptureInfo {
 
 // Capture packets and decode them
 func Capture(cmd *cobra.Command, args []string) {
-	//p := profile.Start(profile.CPUProfile, profile.ProfilePath("."),profile.NoShutdownHook)
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	config()
 
-	ocs = &opCodeStructs{
-		structs: make(map[uint16]string),
+	clean, err := cmd.Flags().GetBool("clean")
+	if err != nil {
+		log.Fatal(err)
+	}
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		log.Fatal(err)
+	}
+	noColor, err := cmd.Flags().GetBool("no-color")
+	if err != nil {
+		log.Fatal(err)
+	}
+	container, err := cmd.Flags().GetBool("container")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if container && !viper.IsSet("ui.listen") {
+		// the UI has to be reachable from outside the container
+		viper.Set("ui.listen", "0.0.0.0")
+	}
+	anonymize, err := cmd.Flags().GetBool("anonymize")
+	if err != nil {
+		log.Fatal(err)
+	}
+	noRedact, err := cmd.Flags().GetBool("no-redact")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if noRedact {
+		viper.Set("output.redact.enabled", false)
+	}
+	useTUI, err := cmd.Flags().GetBool("tui")
+	if err != nil {
+		log.Fatal(err)
 	}
+	// the tui owns the terminal, the packets and the log only go to the session directory
+	quiet = quiet || useTUI
+	s, err := startSession(clean, quiet, anonymize || viper.GetBool("output.anonymize.enabled"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	console = newConsolePrinter(os.Stdout, quiet, noColor, viper.GetBool("protocol.log.verbose"))
 
-	sf := &shineStreamFactory{
-		shineContext: ctx,
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.session = s
+	if err := s.start("capture", c); err != nil {
+		log.Fatal(err)
 	}
 
-	sp := reassembly.NewStreamPool(sf)
-	a := reassembly.NewAssembler(sp)
+	sn, err := NewSniffer(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tv *tui
+	if useTUI {
+		if tv, err = newTUI(sn, noColor); err != nil {
+			log.Fatal(err)
+		}
+	}
+	sn.AddSink(console)
+	sn.AddSink(packetViews{ws: sn.ws, maxPayload: c.MaxPayloadBytes})
+	sn.Handler = func(pe PacketEvent) {
+		logPacket(pe)
+		tv.packet(pe)
+	}
 
-	go startUI(ctx)
-	go capturePackets(ctx, a)
+	ocs = &opCodeStructs{
+		structs: make(map[uint16]string),
+	}
 
 	em.Entities = make(map[uint16][]Movement)
 
-	c := make(chan os.Signal, 2)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM) // subscribe to system signals
-	for {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM) // subscribe to system signals
+
+	// an interrupt while network.waitForInterface waits for the interface stops waiting
+	starting := make(chan struct{})
+	go func() {
 		select {
-		case <-c:
+		case <-sig:
 			cancel()
-			//generateOpCodeSwitch()
-			exportEntitiesMovements()
+		case <-starting:
 		}
-	}
-}
-
-
-func capturePackets(ctx context.Context, a *reassembly.Assembler) {
-	defer a.FlushAll()
-
-	handle, err := pcap.OpenLive(iface, int32(snaplen), true, pcap.BlockForever)
+	}()
+	err = sn.Start(ctx)
+	close(starting)
 	if err != nil {
-		log.Fatal("error opening pcap handle: ", err)
-	}
-	if err := handle.SetBPFFilter(filter); err != nil {
-		log.Fatal("error setting BPF filter: ", err)
+		if ctx.Err() != nil {
+			log.Warningf("capture not started: %v", err)
+			return
+		}
+		log.Fatal(err)
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	go sn.startUI(ctx)
+	if tv != nil {
+		go tv.run()
+	} else {
+		go console.printStats(ctx, sn, c.StatsInterval)
+	}
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+capture:
 	for {
 		select {
-		case <-ctx.Done():
-			log.Warningf("capture canceled")
-			return
-		case packet := <-packetSource.Packets():
-			if tcp, ok := packet.TransportLayer().(*layers.TCP); ok {
-				c := Context{
-					ci: packet.Metadata().CaptureInfo,
-				}
-				a.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, c)
+		case <-sig:
+			log.Info("stopping capture")
+			break capture
+		case <-tv.done():
+			log.Info("stopping capture, the tui was closed")
+			break capture
+		case <-reload:
+			log.Info("reloading configuration")
+			if _, err := sn.reloadFromViper(); err != nil {
+				log.Errorf("configuration not reloaded: %v", err)
 			}
+		case <-sn.Done():
+			// the pcap file was fully read or a capture limit was reached
+			break capture
 		}
 	}
-	//
-	//	var parser * gopacket.DecodingLayerParser
-	//	var lb layers.Loopback
-	//	var eth layers.Ethernet
-	//	var ip4 layers.IPv4
-	//	var tcp layers.TCP
-	//	var payload gopacket.Payload
-	//
-	//	if viper.GetBool("network.loopback") {
-	//		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeLoopback, &lb, &ip4, &tcp, &payload)
-	//	} else {
-	//		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip4, &tcp, &payload)
-	//	}
-	//
-	//	decoded := make([]gopacket.LayerType, 4096, 4096)
-	//
-	//loop:
-	//	for {
-	//		data, ci, err := handle.ZeroCopyReadPacketData()
-	//
-	//		if err != nil {
-	//			log.Errorf("error getting packet: %v	", err)
-	//			continue
-	//		}
-	//		err = parser.DecodeLayers(data, &decoded)
-	//		if err != nil {
-	//			continue
-	//		}
-	//		foundNetLayer := false
-	//		var netFlow gopacket.Flow
-	//		for _, typ := range decoded {
-	//			switch typ {
-	//			case layers.LayerTypeIPv4:
-	//				netFlow = ip4.NetworkFlow()
-	//				foundNetLayer = true
-	//			case layers.LayerTypeTCP:
-	//				if foundNetLayer {
-	//					c := Context{
-	//						ci: ci,
-	//					}
-	//					a.AssembleWithContext(netFlow, &tcp, c)
-	//				} else {
-	//					log.Error("could not find IPv4 or IPv6 layer, ignoring")
-	//				}
-	//				continue loop
-	//			}
-	//		}
-	//	}
+	tv.stop()
+	sn.Stop()
+	summary := sn.Summary()
+	exportSummary(s, summary)
+
+	cancel()
+	exportEntitiesMovements(s)
+	sn.stopUI()
+	// once every output is closed, so the checksums are the ones of the complete files
+	if err := s.finish(captureTotals(sn, summary)); err != nil {
+		log.Error(err)
+	}
+}
+
+// keep track of the operation code of a decoded packet and of the entity movements, the console and the UI are sinks
+func logPacket(pe PacketEvent) {
+	ocs.mu.Lock()
+	ocs.structs[pe.Packet.Base.OperationCode] = pe.Packet.Base.ClientStructName
+	ocs.mu.Unlock()
+
+	persistMovement(decodedPacket{
+		seen:      pe.Seen,
+		packet:    pe.Packet,
+		direction: pe.Direction,
+	})
 }
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type commandEntry struct {
+	name   string
+	opCode uint16
+}
+
+// the commands of the file, ordered by operation code and then by name, so the listing and the generated file never change
+// for the same commands file
+func sortedCommands(names map[uint16]string) []commandEntry {
+	commands := make([]commandEntry, 0, len(names))
+	for opCode, name := range names {
+		commands = append(commands, commandEntry{name: name, opCode: opCode})
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].opCode != commands[j].opCode {
+			return commands[i].opCode < commands[j].opCode
+		}
+		return commands[i].name < commands[j].name
+	})
+	return commands
+}
+
+// the commands an argument of sniffer commands stands for: an operation code (3090, 0xC12), a command name, or a case
+// insensitive part of command names
+func lookupCommands(commands []commandEntry, arg string) []commandEntry {
+	if n, err := strconv.ParseUint(arg, 0, 16); err == nil {
+		for _, c := range commands {
+			if c.opCode == uint16(n) {
+				return []commandEntry{c}
+			}
+		}
+		return nil
+	}
+	for _, c := range commands {
+		if strings.EqualFold(c.name, arg) {
+			return []commandEntry{c}
+		}
+	}
+	var matches []commandEntry
+	part := strings.ToUpper(arg)
+	for _, c := range commands {
+		if strings.Contains(strings.ToUpper(c.name), part) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// a go file with a typed constant per command, the header has the sha256 of the commands file it was generated from
+func generateCommandConstants(commands []commandEntry, pkg, source string, sum []byte) ([]byte, error) {
+	if !token.IsIdentifier(pkg) {
+		return nil, fmt.Errorf("--package: %q is not a go package name", pkg)
+	}
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by sniffer commands --generate-go. DO NOT EDIT.")
+	fmt.Fprintf(&b, "// source: %v, sha256 %v\n\n", filepath.ToSlash(filepath.Base(source)), hex.EncodeToString(sum))
+	fmt.Fprintf(&b, "package %v\n\n", pkg)
+	fmt.Fprintln(&b, "// OperationCode is the department << 10 | command of a packet")
+	fmt.Fprintln(&b, "type OperationCode uint16")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "const (")
+	declared := make(map[string]uint16)
+	for _, c := range commands {
+		if !token.IsIdentifier(c.name) || token.IsKeyword(c.name) {
+			return nil, fmt.Errorf("command %q is not a go identifier", c.name)
+		}
+		if opCode, ok := declared[c.name]; ok {
+			return nil, fmt.Errorf("command %v is both %v and %v", c.name, opCode, c.opCode)
+		}
+		declared[c.name] = c.opCode
+		fmt.Fprintf(&b, "\t%v OperationCode = %v\n", c.name, c.opCode)
+	}
+	fmt.Fprintln(&b, ")")
+	return format.Source(b.Bytes())
+}
+
+// Commands looks up operation codes and command names in protocol.commands, or generates go constants for all of them
+func Commands(cmd *cobra.Command, args []string) {
+	generate, err := cmd.Flags().GetString("generate-go")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pkg, err := cmd.Flags().GetString("package")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := viper.GetString("protocol.commands")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("protocol.commands: %v", err)
+	}
+	names, err := loadCommandNames(path)
+	if err != nil {
+		log.Fatalf("protocol.commands: %v", err)
+	}
+	commands := sortedCommands(names)
+
+	if generate != "" {
+		sum := sha256.Sum256(content)
+		src, err := generateCommandConstants(commands, pkg, path, sum[:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if generate == "-" {
+			os.Stdout.Write(src)
+			return
+		}
+		if err := ioutil.WriteFile(generate, src, 0666); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%v constants written to %v\n", len(commands), generate)
+		return
+	}
+
+	if len(args) > 0 {
+		commands = lookupCommands(commands, args[0])
+		if len(commands) == 0 {
+			fmt.Printf("no command matches %q in %v\n", args[0], path)
+			os.Exit(1)
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tOPCODE\tHEX")
+	for _, c := range commands {
+		fmt.Fprintf(w, "%v\t%v\t0x%04X\n", c.name, c.opCode, c.opCode)
+	}
+	w.Flush()
+}
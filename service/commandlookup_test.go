@@ -0,0 +1,82 @@
+package service
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var lookupTestCommands = sortedCommands(map[uint16]string{
+	opLoginAck: "NC_USER_LOGIN_ACK",
+	opLoginReq: "NC_USER_US_LOGIN_REQ",
+	opChatReq:  "NC_ACT_CHAT_REQ",
+})
+
+func TestLookupCommands(t *testing.T) {
+	names := func(commands []commandEntry) []string {
+		var n []string
+		for _, c := range commands {
+			n = append(n, c.name)
+		}
+		return n
+	}
+	if got := names(lookupTestCommands); !reflect.DeepEqual(got, []string{"NC_USER_LOGIN_ACK", "NC_USER_US_LOGIN_REQ", "NC_ACT_CHAT_REQ"}) {
+		t.Errorf("sorted %v, expected by operation code", got)
+	}
+
+	tests := []struct {
+		arg      string
+		expected []string
+	}{
+		{"3082", []string{"NC_USER_LOGIN_ACK"}},
+		{"0xC0A", []string{"NC_USER_LOGIN_ACK"}},
+		{"nc_act_chat_req", []string{"NC_ACT_CHAT_REQ"}},
+		{"login", []string{"NC_USER_LOGIN_ACK", "NC_USER_US_LOGIN_REQ"}},
+		{"_REQ", []string{"NC_USER_US_LOGIN_REQ", "NC_ACT_CHAT_REQ"}},
+		{"1", nil},
+		{"NC_NOTHING", nil},
+	}
+	for _, tt := range tests {
+		if got := names(lookupCommands(lookupTestCommands, tt.arg)); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q found %v, expected %v", tt.arg, got, tt.expected)
+		}
+	}
+}
+
+func TestGenerateCommandConstants(t *testing.T) {
+	src, err := generateCommandConstants(lookupTestCommands, "opcodes", "config/commands.yml", []byte{0xab, 0xcd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"// Code generated by sniffer commands --generate-go. DO NOT EDIT.\n",
+		"// source: commands.yml, sha256 abcd\n",
+		"package opcodes\n",
+	} {
+		if !bytes.Contains(src, []byte(line)) {
+			t.Errorf("%q isn't in\n%s", line, src)
+		}
+	}
+	// gofmt aligns the constants
+	if !regexp.MustCompile(`\tNC_USER_LOGIN_ACK +OperationCode = 3082\n`).Match(src) {
+		t.Errorf("no constant for NC_USER_LOGIN_ACK in\n%s", src)
+	}
+
+	tests := []struct {
+		commands []commandEntry
+		pkg      string
+		err      string
+	}{
+		{lookupTestCommands, "op-codes", "--package"},
+		{[]commandEntry{{"NC 1", 1}}, "opcodes", "not a go identifier"},
+		{[]commandEntry{{"type", 1}}, "opcodes", "not a go identifier"},
+		{[]commandEntry{{"NC_A", 1}, {"NC_A", 2}}, "opcodes", "both 1 and 2"},
+	}
+	for _, tt := range tests {
+		if _, err := generateCommandConstants(tt.commands, tt.pkg, "commands.yml", nil); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v in package %v: error %v, expected %q", tt.commands, tt.pkg, err, tt.err)
+		}
+	}
+}
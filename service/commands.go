@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// protocol names and unpacks the packets of a capture, with the command names of protocol.commands and the packets
+// described in protocol.schema, every Sniffer loads its own so two of them can decode with different files
+type protocol struct {
+	commands *commandRegistry
+	schemas  *schemaRegistry
+}
+
+// load the command names and then the schema, which can refer to operation codes by name
+// a file that can't be loaded is logged and left out, operation codes are shown as numbers without a commands file
+func loadProtocol(commandsFile, schemaFile string) *protocol {
+	p := &protocol{
+		commands: &commandRegistry{names: make(map[uint16]string)},
+		schemas:  &schemaRegistry{packets: make(map[uint16]*packetSchema)},
+	}
+	if commandsFile != "" {
+		names, err := loadCommandNames(commandsFile)
+		if err != nil {
+			log.Error(err)
+		} else {
+			p.commands.set(names)
+		}
+	}
+	if schemaFile != "" {
+		packets, err := loadSchema(schemaFile, p.commands)
+		if err != nil {
+			log.Error(err)
+		} else {
+			p.schemas.set(packets)
+			log.Infof("%v operation codes described in %v", len(packets), schemaFile)
+		}
+	}
+	return p
+}
+
+// readable name for an operation code, unknown codes are shown as UNKNOWN(0x0807)
+func (p *protocol) commandName(opCode uint16) string {
+	return p.commands.name(opCode)
+}
+
+// parse an operation code given as a number (2055, 0x807) or as a command name (NC_MISC_SEED_ACK)
+func (p *protocol) parseOpCode(s string) (uint16, error) {
+	return p.commands.parse(s)
+}
+
+// operation code => command name, e.g 2055 => NC_MISC_SEED_ACK
+// a nil registry has no names, every operation code is unknown
+type commandRegistry struct {
+	names map[uint16]string
+	mu    sync.RWMutex
+}
+
+func (cr *commandRegistry) set(names map[uint16]string) {
+	cr.mu.Lock()
+	cr.names = names
+	cr.mu.Unlock()
+}
+
+func (cr *commandRegistry) get(opCode uint16) (string, bool) {
+	if cr == nil {
+		return "", false
+	}
+	cr.mu.RLock()
+	name, ok := cr.names[opCode]
+	cr.mu.RUnlock()
+	return name, ok
+}
+
+// true if opCode has a name in the commands file
+func (cr *commandRegistry) known(opCode uint16) bool {
+	_, ok := cr.get(opCode)
+	return ok
+}
+
+// true if no commands file was loaded, every operation code is unknown then
+func (cr *commandRegistry) empty() bool {
+	if cr == nil {
+		return true
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return len(cr.names) == 0
+}
+
+// the operation code of a command name, case insensitive
+func (cr *commandRegistry) opCode(name string) (uint16, bool) {
+	if cr == nil {
+		return 0, false
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	for opCode, n := range cr.names {
+		if strings.EqualFold(n, name) {
+			return opCode, true
+		}
+	}
+	return 0, false
+}
+
+type commandsDepartment struct {
+	HexID    interface{} `mapstructure:"hexid"`
+	Name     string      `mapstructure:"name"`
+	Commands string      `mapstructure:"commands"`
+}
+
+// parse the commands file into a lookup table
+// operation codes are built as department << 10 | command
+func loadCommandNames(path string) (map[uint16]string, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var departments []commandsDepartment
+	if err := v.UnmarshalKey("departments", &departments); err != nil {
+		return nil, err
+	}
+
+	names := make(map[uint16]string)
+	for _, d := range departments {
+		department, err := departmentID(d.HexID)
+		if err != nil {
+			return nil, fmt.Errorf("department %v: %v", d.Name, err)
+		}
+		for _, c := range strings.Split(d.Commands, ",") {
+			parts := strings.Split(c, "=")
+			if len(parts) != 2 {
+				continue
+			}
+			name := strings.TrimSpace(parts[0])
+			command, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("department %v, command %v: %v", d.Name, name, err)
+			}
+			names[department<<10|uint16(command)] = name
+		}
+	}
+	return names, nil
+}
+
+// yaml reads hexId values like 0x1 as integers, but they may also be quoted
+func departmentID(hexID interface{}) (uint16, error) {
+	switch id := hexID.(type) {
+	case int:
+		return uint16(id), nil
+	case int64:
+		return uint16(id), nil
+	case uint64:
+		return uint16(id), nil
+	case string:
+		n, err := strconv.ParseUint(id, 0, 16)
+		return uint16(n), err
+	default:
+		return 0, fmt.Errorf("unexpected hexId %v", hexID)
+	}
+}
+
+// the name of an operation code, UNKNOWN(0x0807) if it has none
+func (cr *commandRegistry) name(opCode uint16) string {
+	if name, ok := cr.get(opCode); ok {
+		return name
+	}
+	return unknownCommand(opCode)
+}
+
+func unknownCommand(opCode uint16) string {
+	return fmt.Sprintf("UNKNOWN(0x%04X)", opCode)
+}
+
+// command names are only known if the registry has them, numbers always parse
+func (cr *commandRegistry) parse(s string) (uint16, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return uint16(n), nil
+	}
+	if opCode, ok := cr.opCode(s); ok {
+		return opCode, nil
+	}
+	return 0, fmt.Errorf("unknown operation code or command name %q", s)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"github.com/pierrec/lz4/v4"
+	"io"
+	"io/ioutil"
+)
+
+// decompressed payloads larger than this are rejected, so a corrupt stream can't make the decoder allocate without bound
+const maxDecompressedSize = 1 << 20
+
+// CompressedOpCode is an entry of protocol.compressedOpcodes, newer server builds compress the payload of some operation codes
+// Algorithm is zlib, a zlib stream right after the operation code, or lz4, a raw lz4 block with no frame around it
+type CompressedOpCode struct {
+	OpCode    uint16 `mapstructure:"opcode"`
+	Algorithm string `mapstructure:"algorithm"`
+}
+
+type decompressor func(payload []byte) ([]byte, error)
+
+var decompressors = map[string]decompressor{
+	"zlib": inflateZlib,
+	"lz4":  decompressLZ4Block,
+}
+
+// the decompressor of every operation code in protocol.compressedOpcodes
+func newDecompressors(opCodes []CompressedOpCode) (map[uint16]decompressor, error) {
+	ds := make(map[uint16]decompressor)
+	for _, c := range opCodes {
+		d, ok := decompressors[c.Algorithm]
+		if !ok {
+			return nil, fmt.Errorf("protocol.compressedOpcodes: unknown algorithm %q for operation code %v, use zlib or lz4", c.Algorithm, c.OpCode)
+		}
+		if _, ok := ds[c.OpCode]; ok {
+			return nil, fmt.Errorf("protocol.compressedOpcodes: operation code %v is listed more than once", c.OpCode)
+		}
+		ds[c.OpCode] = d
+	}
+	return ds, nil
+}
+
+func inflateZlib(payload []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompresses to more than %v bytes", maxDecompressedSize)
+	}
+	return data, nil
+}
+
+// a raw lz4 block doesn't say how large it decompresses to, the buffer doubles until the block fits in it
+// a block that doesn't fit in maxDecompressedSize either is rejected, like a corrupt one
+func decompressLZ4Block(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty lz4 block")
+	}
+	size := 4 * len(payload)
+	for {
+		if size > maxDecompressedSize {
+			size = maxDecompressedSize
+		}
+		data := make([]byte, size)
+		n, err := lz4.UncompressBlock(payload, data)
+		if err == nil {
+			return data[:n], nil
+		}
+		if size == maxDecompressedSize {
+			return nil, fmt.Errorf("not an lz4 block or it decompresses to more than %v bytes: %v", maxDecompressedSize, err)
+		}
+		size *= 2
+	}
+}
+
+// replace the payload of dp by its decompressed form if its operation code is in protocol.compressedOpcodes
+// a payload that doesn't decompress is kept as it is, the failure is logged once per operation code of the stream
+func (ss *shineStream) decompress(dp *decodedPacket) {
+	opCode := dp.packet.Base.OperationCode
+	d, ok := ss.sniffer.decompressors[opCode]
+	if !ok {
+		return
+	}
+	data, err := d(dp.packet.Base.Data)
+	if err != nil {
+		ss.mu.Lock()
+		logged := ss.undecompressed[opCode]
+		if ss.undecompressed == nil {
+			ss.undecompressed = make(map[uint16]bool)
+		}
+		ss.undecompressed[opCode] = true
+		ss.mu.Unlock()
+		if !logged {
+			ss.warningf("[%v] %v payload of operation code %v doesn't decompress, keeping it as it is: %v", ss.flowName, dp.direction, opCode, err)
+		}
+		return
+	}
+	dp.compressedSize = len(dp.packet.Base.Data)
+	dp.decompressedSize = len(data)
+	dp.packet.Base.Data = data
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestDecompressLZ4Block(t *testing.T) {
+	// a match of one byte repeated past maxDecompressedSize, then the literals the block ends with
+	tooLarge := append([]byte{0x1f, 'a', 1, 0}, bytes.Repeat([]byte{255}, maxDecompressedSize/255+1)...)
+	tooLarge = append(tooLarge, 0, 0x10, 'b')
+	tests := []struct {
+		name  string
+		block []byte
+		data  string
+		err   string
+	}{
+		{"literals only", append([]byte{0x50}, "hello"...), "hello", ""},
+		{"match", []byte{0x48, 'a', 'b', 'c', 'd', 4, 0, 0x50, 'X', 'Y', 'Z', '1', '2'}, "abcdabcdabcdabcdXYZ12", ""},
+		{"overlapping match", []byte{0x13, 'a', 1, 0, 0x10, 'b'}, "aaaaaaaab", ""},
+		{"long literals", append([]byte{0xf0, 5}, strings.Repeat("x", 20)...), strings.Repeat("x", 20), ""},
+		// larger than the first buffer
+		{"long match", []byte{0x1f, 'a', 1, 0, 255, 1, 0x10, 'b'}, strings.Repeat("a", 1+15+255+1+4) + "b", ""},
+		{"empty", nil, "", "empty lz4 block"},
+		{"literals cut short", []byte{0x50, 'h', 'i'}, "", "not an lz4 block"},
+		{"length cut short", []byte{0xf0, 255}, "", "not an lz4 block"},
+		{"match before the start", []byte{0x14, 'a', 2, 0, 0x10, 'b'}, "", "not an lz4 block"},
+		{"larger than maxDecompressedSize", tooLarge, "", "more than"},
+	}
+	for _, tt := range tests {
+		data, err := decompressLZ4Block(tt.block)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error %v, expected %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.data {
+			t.Errorf("%v: decompressed to %q, %v, expected %q", tt.name, data, err, tt.data)
+		}
+	}
+}
+
+func TestInflateZlib(t *testing.T) {
+	compress := func(data []byte) []byte {
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write(data)
+		w.Close()
+		return b.Bytes()
+	}
+	small := []byte("Roumen")
+	if data, err := inflateZlib(compress(small)); err != nil || !bytes.Equal(data, small) {
+		t.Errorf("inflated to %q, %v", data, err)
+	}
+	if _, err := inflateZlib(compress(make([]byte, maxDecompressedSize+1))); err == nil {
+		t.Error("a payload larger than maxDecompressedSize was inflated")
+	}
+	if _, err := inflateZlib(compress(make([]byte, maxDecompressedSize))); err != nil {
+		t.Errorf("a payload of maxDecompressedSize wasn't inflated: %v", err)
+	}
+	if _, err := inflateZlib(small); err == nil {
+		t.Error("a payload that isn't zlib was inflated")
+	}
+}
+
+func TestNewDecompressors(t *testing.T) {
+	tests := []struct {
+		name    string
+		opCodes []CompressedOpCode
+		err     bool
+	}{
+		{"none", nil, false},
+		{"zlib and lz4", []CompressedOpCode{{7200, "zlib"}, {7201, "lz4"}}, false},
+		{"unknown algorithm", []CompressedOpCode{{7200, "gzip"}}, true},
+		{"listed twice", []CompressedOpCode{{7200, "zlib"}, {7200, "lz4"}}, true},
+	}
+	for _, tt := range tests {
+		ds, err := newDecompressors(tt.opCodes)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v, expected one %v", tt.name, err, tt.err)
+		}
+		if err == nil && len(ds) != len(tt.opCodes) {
+			t.Errorf("%v: %v decompressors for %v operation codes", tt.name, len(ds), len(tt.opCodes))
+		}
+	}
+}
+
+// the recorded compressed payloads are decompressed with both sizes on the event, one that doesn't decompress is kept
+func TestCompressedPackets(t *testing.T) {
+	var entries []byte
+	for i := 0; i < 40; i++ {
+		e := make([]byte, 18)
+		copy(e, "Roumen")
+		binary.LittleEndian.PutUint16(e[12:], uint16(i))
+		binary.LittleEndian.PutUint32(e[14:], 10000)
+		entries = append(entries, e...)
+	}
+	segments := readFixture(t, "compressed.hex")
+
+	tests := []struct {
+		name    string
+		opCodes []CompressedOpCode
+		// payloads of 7200 and 7201 and their compressed sizes, 0 if they weren't decompressed
+		payloads [][]byte
+		sizes    []int
+	}{
+		{
+			name:     "decompressed",
+			opCodes:  []CompressedOpCode{{7200, "zlib"}, {7201, "lz4"}},
+			payloads: [][]byte{entries, segments[2].data[3:], []byte("abcdabcdabcdabcdXYZ12")},
+			sizes:    []int{len(segments[1].data) - 3, 0, len(segments[3].data) - 3},
+		},
+		{
+			name:     "not listed",
+			payloads: [][]byte{segments[1].data[3:], segments[2].data[3:], segments[3].data[3:]},
+			sizes:    []int{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			replayFixture(t, conv, segments)
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+			c := testConfig()
+			c.CompressedOpCodes = tt.opCodes
+			_, sink := runPipeline(t, c, ms)
+
+			var events []PacketEvent
+			for _, pe := range sink.byDirection() {
+				if op := pe.Packet.Base.OperationCode; op == 7200 || op == 7201 {
+					events = append(events, pe)
+				}
+			}
+			if len(events) != len(tt.payloads) {
+				t.Fatalf("%v compressed packets, expected %v", len(events), len(tt.payloads))
+			}
+			for i, pe := range events {
+				if !bytes.Equal(pe.Packet.Base.Data, tt.payloads[i]) {
+					t.Errorf("packet %v decoded to %x, expected %x", i, pe.Packet.Base.Data, tt.payloads[i])
+				}
+				decompressed := 0
+				if tt.sizes[i] != 0 {
+					decompressed = len(tt.payloads[i])
+				}
+				if pe.CompressedSize != tt.sizes[i] || pe.DecompressedSize != decompressed {
+					t.Errorf("packet %v has sizes %v and %v, expected %v and %v", i, pe.CompressedSize, pe.DecompressedSize, tt.sizes[i], decompressed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ansi colors handed out to flow names, bright ones first as they read better on dark terminals
+var flowColors = []int{96, 93, 95, 92, 94, 91, 36, 33, 35, 32, 34, 31}
+
+// consolePrinter writes one aligned line per decoded packet, each flow name always gets the same color
+// in quiet mode packets are not printed, only the periodic stats line
+type consolePrinter struct {
+	w       io.Writer
+	color   bool
+	quiet   bool
+	verbose bool
+	mu      sync.Mutex
+}
+
+var console = &consolePrinter{w: os.Stdout}
+
+func newConsolePrinter(w *os.File, quiet, noColor, verbose bool) *consolePrinter {
+	return &consolePrinter{
+		w:       w,
+		color:   !noColor && isTerminal(w),
+		quiet:   quiet,
+		verbose: verbose,
+	}
+}
+
+// colors only make sense when a person is reading, not when the output is piped or redirected
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (cp *consolePrinter) colorize(flowName, s string) string {
+	if !cp.color {
+		return s
+	}
+	return fmt.Sprintf("\x1b[%vm%v\x1b[0m", flowColors[flowColor(flowName)], s)
+}
+
+// the index in flowColors of a flow name, the same in the console and in the tui
+func flowColor(flowName string) int {
+	h := fnv.New32a()
+	h.Write([]byte(flowName))
+	return int(h.Sum32() % uint32(len(flowColors)))
+}
+
+// the line printed for a packet, on the console and in the per flow log files
+func packetLine(pe PacketEvent) string {
+	// the client is always on the left, the arrow points where the packet went
+	arrow, client, server := "->", pe.Src, pe.Dst
+	if pe.Direction == "inbound" {
+		arrow, client, server = "<-", pe.Dst, pe.Src
+	}
+	return fmt.Sprintf("%v  %-20v %21v %v %-21v %-40v %5v %6vB",
+		pe.Seen.Format("15:04:05.000"),
+		pe.FlowName,
+		client,
+		arrow,
+		server,
+		pe.Packet.Base.ClientStructName,
+		pe.Packet.Base.OperationCode,
+		len(pe.Packet.Base.Data))
+}
+
+func (cp *consolePrinter) packet(pe PacketEvent) {
+	if cp.quiet {
+		return
+	}
+	line := packetLine(pe)
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	fmt.Fprintln(cp.w, cp.colorize(pe.FlowName, line))
+	if cp.verbose {
+		if pe.Decoded != "" {
+			fmt.Fprintln(cp.w, pe.Decoded)
+		}
+		fmt.Fprint(cp.w, hex.Dump(pe.Packet.Base.Data))
+	}
+}
+
+// the console is a Sink, added by capture and decode-raw
+func (cp *consolePrinter) Publish(pe PacketEvent) {
+	cp.packet(pe)
+}
+
+// stdout isn't closed
+func (cp *consolePrinter) Close() {}
+
+// print what the sniffer has done so far every interval, until ctx is done
+func (cp *consolePrinter) printStats(ctx context.Context, sn *Sniffer, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			sn.streams.mu.Lock()
+			active := len(sn.streams.streams)
+			sn.streams.mu.Unlock()
+
+			sn.metrics.mu.Lock()
+			kernel := sn.metrics.kernel
+			sn.metrics.mu.Unlock()
+
+			line := fmt.Sprintf("%v  captured %v, decoded %v packets, %v active streams, kernel dropped %v",
+				time.Now().Format("15:04:05.000"), atomic.LoadUint64(&sn.captured), atomic.LoadUint64(&sn.decoded), active, kernel.lost())
+
+			cp.mu.Lock()
+			fmt.Fprintln(cp.w, line)
+			cp.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,771 @@
+package service
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/shine-o/shine.engine.core/networking"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formats sniffer convert reads and writes, jsonl and pcap-decrypted are directories of flow files like the capture writes
+const (
+	formatJSONL     = "jsonl"
+	formatSQLite    = "sqlite"
+	formatCSV       = "csv"
+	formatDecrypted = "pcap-decrypted"
+)
+
+// columns of the csv format, timestamps are RFC 3339 and payloads hex
+var csvHeader = []string{"flow_id", "flow_name", "direction", "src", "dst", "timestamp", "opcode", "command", "length", "payload", "packet_id", "seq"}
+
+// files written before packets had an id and a sequence number have the columns up to payload
+const csvColumnsWithoutID = 10
+
+// invalidRecord is a record that can't be converted, it's skipped and the conversion goes on
+type invalidRecord struct {
+	where  string
+	reason string
+}
+
+func (ir invalidRecord) Error() string {
+	return fmt.Sprintf("%v: %v", ir.where, ir.reason)
+}
+
+// recordReader streams the packets of a capture saved in one of the formats
+type recordReader interface {
+	// the next packet, io.EOF after the last one, an invalidRecord if it can't be converted
+	next() (PacketEvent, error)
+	close() error
+}
+
+// recordWriter writes packets in one of the formats, with the same code as the live outputs where there is one
+type recordWriter interface {
+	write(pe PacketEvent) error
+	close() error
+}
+
+// Convert rewrites the packets of a saved capture from one format to another, record by record
+func Convert(cmd *cobra.Command, args []string) {
+	from, err := cmd.Flags().GetString("from")
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		log.Fatal(err)
+	}
+	in, err := cmd.Flags().GetString("in")
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := cmd.Flags().GetString("out")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if in == "" || out == "" {
+		log.Fatal("--in and --out are needed, e.g --from jsonl --in output/2020-05-01T12-30-00 --to sqlite --out packets.db")
+	}
+
+	noRedact, err := cmd.Flags().GetBool("no-redact")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// command names for the formats that don't keep them
+	p := loadProtocol(c.CommandsFile, c.SchemaFile)
+
+	// a decrypted pcap or a capture made with --no-redact has the credentials as they were sent
+	var rules map[uint16]RedactRule
+	if c.Redact && !noRedact {
+		rules, err = newRedactRules(c.RedactRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r, err := openRecordReader(from, in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := createRecordWriter(to, out)
+	if err != nil {
+		r.close()
+		log.Fatal(err)
+	}
+
+	converted, skipped, err := convertRecords(p, r, w, rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := r.close(); err != nil {
+		log.Error(err)
+	}
+	if err := w.close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%v records converted from %v %v to %v %v, %v skipped\n", converted, from, in, to, out, skipped)
+}
+
+// write every record r has to w with the credentials rules have masked and the command names of p,
+// invalid records are logged and skipped
+func convertRecords(p *protocol, r recordReader, w recordWriter, rules map[uint16]RedactRule) (converted, skipped int, err error) {
+	for {
+		pe, err := r.next()
+		if err == io.EOF {
+			return converted, skipped, nil
+		}
+		if ir, ok := err.(invalidRecord); ok {
+			log.Warningf("skipping %v", ir)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return converted, skipped, err
+		}
+		pe.Packet.Base.ClientStructName = p.commandName(pe.Packet.Base.OperationCode)
+		// only the json lines keep the decoded struct, the others are unpacked again like the capture did
+		// records with credentials are too, their struct is unpacked again from the masked payload
+		if _, ok := rules[pe.Packet.Base.OperationCode]; ok || pe.Decoded == "" {
+			nc := p.unpack(pe.Packet.Base.OperationCode, pe.Packet.Base.Data)
+			pe, nc = redactEvent(p, rules, pe, nc)
+			pe.Decoded, pe.Fields = nc.UnpackedData, nc.Fields
+		}
+		if err := w.write(pe); err != nil {
+			return converted, skipped, err
+		}
+		converted++
+	}
+}
+
+func openRecordReader(format, path string) (recordReader, error) {
+	switch format {
+	case formatJSONL:
+		files, err := inputFiles(path, artifactJSONL, ".jsonl")
+		if err != nil {
+			return nil, err
+		}
+		return &jsonlReader{files: files}, nil
+	case formatSQLite:
+		files, err := inputFiles(path, artifactSQLite, ".db")
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 1 {
+			return nil, fmt.Errorf("%v has %v databases, give one of them to --in", path, len(files))
+		}
+		return openSQLiteReader(files[0])
+	case formatCSV:
+		return openCSVReader(path)
+	case formatDecrypted:
+		files, err := inputFiles(path, artifactDecryptedPcap, "-decrypted.pcap")
+		if err != nil {
+			return nil, err
+		}
+		return &decryptedReader{files: files}, nil
+	default:
+		return nil, fmt.Errorf("--from: unknown format %q, use %v, %v, %v or %v", format, formatJSONL, formatSQLite, formatCSV, formatDecrypted)
+	}
+}
+
+func createRecordWriter(format, path string) (recordWriter, error) {
+	switch format {
+	case formatJSONL:
+		s, err := useOutputDirectory(path, "*.jsonl")
+		if err != nil {
+			return nil, err
+		}
+		return &jsonlWriter{session: s, outputs: make(map[string]*flowOutput)}, nil
+	case formatSQLite:
+		db, err := openDatabase(path)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		return &sqliteWriter{store: &packetStore{db: db}, flows: make(map[string]time.Time)}, nil
+	case formatCSV:
+		return createCSVWriter(path)
+	case formatDecrypted:
+		s, err := useOutputDirectory(path, "*-decrypted.pcap")
+		if err != nil {
+			return nil, err
+		}
+		return &decryptedWriter{session: s, pcaps: make(map[string]*decryptedPcap)}, nil
+	default:
+		return nil, fmt.Errorf("--to: unknown format %q, use %v, %v, %v or %v", format, formatJSONL, formatSQLite, formatCSV, formatDecrypted)
+	}
+}
+
+// path itself, or the files of kind the manifest of the session directory lists
+// directories without a manifest, e.g sessions of older versions, are searched for the files ending with suffix
+func inputFiles(path, kind, suffix string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	files, ok, err := sessionArtifacts(path, kind)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if len(files) == 0 {
+			return nil, fmt.Errorf("the manifest of %v lists no %v files", path, kind)
+		}
+		return files, nil
+	}
+	files, err = filepath.Glob(filepath.Join(path, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *%v files in %v", suffix, path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// flow files are written to dir like to a session directory, it must not have any yet as they'd be appended to
+func useOutputDirectory(dir, pattern string) (*session, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("%v already has %v files, e.g %v", dir, pattern, existing[0])
+	}
+	return &session{dir: dir}, nil
+}
+
+// a packet read back from a saved capture, without its command name
+func convertedPacket(flowID, flowName, direction string, seen time.Time, opCode uint16, data []byte) PacketEvent {
+	return PacketEvent{
+		FlowID:    flowID,
+		FlowName:  flowName,
+		Seen:      seen,
+		Direction: direction,
+		Packet: &networking.Command{
+			Base: networking.CommandBase{
+				OperationCode: opCode,
+				Data:          data,
+			},
+		},
+	}
+}
+
+// what every format needs to place a packet, nil if the record has it
+func validateRecord(where string, pe PacketEvent) error {
+	switch {
+	case pe.FlowID == "":
+		return invalidRecord{where, "no flow id"}
+	case pe.Direction != "inbound" && pe.Direction != "outbound":
+		return invalidRecord{where, fmt.Sprintf("direction %q is neither inbound nor outbound", pe.Direction)}
+	case pe.Seen.IsZero():
+		return invalidRecord{where, "no timestamp"}
+	}
+	return nil
+}
+
+// the client and the server of the packet's flow
+func flowEndpoints(pe PacketEvent) (client, server string) {
+	if pe.Direction == "inbound" {
+		return pe.Dst, pe.Src
+	}
+	return pe.Src, pe.Dst
+}
+
+// jsonlReader reads the <flowName>-<flowID>.jsonl files of protocol.log.jsonOutput one line at a time
+type jsonlReader struct {
+	files            []string
+	f                *os.File
+	scanner          *bufio.Scanner
+	line             int
+	flowName, flowID string
+}
+
+func (jr *jsonlReader) next() (PacketEvent, error) {
+	for {
+		if jr.scanner == nil {
+			if len(jr.files) == 0 {
+				return PacketEvent{}, io.EOF
+			}
+			f, err := os.Open(jr.files[0])
+			if err != nil {
+				return PacketEvent{}, err
+			}
+			jr.flowName, jr.flowID = flowFileName(jr.files[0], ".jsonl")
+			jr.files = jr.files[1:]
+			jr.f, jr.line = f, 0
+			jr.scanner = bufio.NewScanner(f)
+			jr.scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		}
+		if !jr.scanner.Scan() {
+			err := jr.scanner.Err()
+			jr.f.Close()
+			jr.scanner = nil
+			if err != nil {
+				return PacketEvent{}, fmt.Errorf("%v: %v", jr.f.Name(), err)
+			}
+			continue
+		}
+		jr.line++
+		where := fmt.Sprintf("%v:%v", jr.f.Name(), jr.line)
+
+		r, ok, err := parseFlowRecord(jr.scanner.Bytes())
+		if err != nil {
+			return PacketEvent{}, invalidRecord{where, err.Error()}
+		}
+		if !ok {
+			continue
+		}
+		if r.Truncated {
+			return PacketEvent{}, invalidRecord{where, "the payload was truncated by output.maxPayloadBytes"}
+		}
+		data, err := hex.DecodeString(r.Data)
+		if err != nil {
+			return PacketEvent{}, invalidRecord{where, fmt.Sprintf("data: %v", err)}
+		}
+		if r.Length != len(data) {
+			return PacketEvent{}, invalidRecord{where, fmt.Sprintf("length is %v but the data has %v bytes", r.Length, len(data))}
+		}
+		flowID := r.FlowID
+		if flowID == "" {
+			// written before records had it
+			flowID = jr.flowID
+		}
+		pe := convertedPacket(flowID, jr.flowName, r.Direction, r.Seen, r.OperationCode, data)
+		pe.Src, pe.Dst = r.Src, r.Dst
+		// empty and 0 if written before records had them
+		pe.ID, pe.Seq = r.PacketID, r.Seq
+		if len(r.Decoded) > 0 {
+			pe.Decoded = string(r.Decoded)
+		}
+		pe.Fields, pe.Context = r.Fields, r.Context
+		return pe, validateRecord(where, pe)
+	}
+}
+
+func (jr *jsonlReader) close() error {
+	if jr.scanner != nil {
+		return jr.f.Close()
+	}
+	return nil
+}
+
+// jsonlWriter writes a flow file per flow with the flowOutput of the capture
+type jsonlWriter struct {
+	session *session
+	outputs map[string]*flowOutput
+}
+
+func (jw *jsonlWriter) write(pe PacketEvent) error {
+	fo, ok := jw.outputs[pe.FlowID]
+	if !ok {
+		fo = newFlowOutput(jw.session, pe.FlowName, pe.FlowID, 0)
+		jw.outputs[pe.FlowID] = fo
+	}
+	fo.write(pe)
+	return nil
+}
+
+func (jw *jsonlWriter) close() error {
+	for _, fo := range jw.outputs {
+		fo.close()
+	}
+	return nil
+}
+
+// sqliteReader reads the packets table of output.sqlite.path in insertion order, with the addresses of their flow
+type sqliteReader struct {
+	path string
+	db   *sql.DB
+	rows *sql.Rows
+}
+
+func openSQLiteReader(path string) (*sqliteReader, error) {
+	// opening a database that doesn't exist would create it
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	// databases of earlier versions get the columns they don't have yet
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT p.id, p.flow_id, p.flow_name, p.direction, p.timestamp, p.opcode, p.length, p.payload, p.packet_id, p.seq, COALESCE(f.src, ''), COALESCE(f.dst, '')
+		FROM packets p LEFT JOIN flows f ON f.flow_id = p.flow_id ORDER BY p.id`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &sqliteReader{path: path, db: db, rows: rows}, nil
+}
+
+func (sr *sqliteReader) next() (PacketEvent, error) {
+	if !sr.rows.Next() {
+		if err := sr.rows.Err(); err != nil {
+			return PacketEvent{}, fmt.Errorf("%v: %v", sr.path, err)
+		}
+		return PacketEvent{}, io.EOF
+	}
+	var (
+		id, ts                      int64
+		flowID, flowName, direction string
+		opCode                      uint16
+		length                      int
+		payload                     []byte
+		packetID, client, server    string
+		seq                         uint64
+	)
+	if err := sr.rows.Scan(&id, &flowID, &flowName, &direction, &ts, &opCode, &length, &payload, &packetID, &seq, &client, &server); err != nil {
+		return PacketEvent{}, invalidRecord{fmt.Sprintf("%v: packet %v", sr.path, id), err.Error()}
+	}
+	where := fmt.Sprintf("%v: packet %v", sr.path, id)
+	if length != len(payload) {
+		return PacketEvent{}, invalidRecord{where, fmt.Sprintf("length is %v but the payload has %v bytes", length, len(payload))}
+	}
+	pe := convertedPacket(flowID, flowName, direction, time.Unix(0, ts), opCode, payload)
+	pe.ID, pe.Seq = packetID, seq
+	pe.Src, pe.Dst = client, server
+	if direction == "inbound" {
+		pe.Src, pe.Dst = server, client
+	}
+	return pe, validateRecord(where, pe)
+}
+
+func (sr *sqliteReader) close() error {
+	sr.rows.Close()
+	return sr.db.Close()
+}
+
+// sqliteWriter inserts the rows of the packet store, in transactions of sqliteBatchSize but without dropping any
+type sqliteWriter struct {
+	store *packetStore
+	batch []sqliteRow
+	// the last packet of each flow, it completes the flow
+	flows map[string]time.Time
+}
+
+func (sw *sqliteWriter) write(pe PacketEvent) error {
+	if _, ok := sw.flows[pe.FlowID]; !ok {
+		client, server := flowEndpoints(pe)
+		sw.batch = append(sw.batch, flowStartedRow(pe.FlowID, pe.FlowName, client, server, pe.Seen))
+	}
+	if pe.Seen.After(sw.flows[pe.FlowID]) {
+		sw.flows[pe.FlowID] = pe.Seen
+	}
+	sw.batch = append(sw.batch, packetRow(pe))
+	if len(sw.batch) >= sqliteBatchSize {
+		sw.store.write(sw.batch)
+		sw.batch = sw.batch[:0]
+	}
+	return nil
+}
+
+func (sw *sqliteWriter) close() error {
+	for flowID, last := range sw.flows {
+		sw.batch = append(sw.batch, flowCompletedRow(flowID, last))
+	}
+	sw.store.write(sw.batch)
+	return sw.store.db.Close()
+}
+
+// csvReader reads a file written by the csvWriter, the header must be the one it writes
+type csvReader struct {
+	path   string
+	f      *os.File
+	r      *csv.Reader
+	record int
+}
+
+func openCSVReader(path string) (*csvReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// every record has as many fields as the header
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if strings.Join(header, ",") != strings.Join(csvHeader, ",") && strings.Join(header, ",") != strings.Join(csvHeader[:csvColumnsWithoutID], ",") {
+		f.Close()
+		return nil, fmt.Errorf("%v: the header should be %v", path, strings.Join(csvHeader, ","))
+	}
+	return &csvReader{path: path, f: f, r: r}, nil
+}
+
+func (cr *csvReader) next() (PacketEvent, error) {
+	row, err := cr.r.Read()
+	if err == io.EOF {
+		return PacketEvent{}, io.EOF
+	}
+	cr.record++
+	where := fmt.Sprintf("%v: record %v", cr.path, cr.record)
+	if pe, ok := err.(*csv.ParseError); ok {
+		return PacketEvent{}, invalidRecord{where, pe.Err.Error()}
+	}
+	if err != nil {
+		return PacketEvent{}, fmt.Errorf("%v: %v", cr.path, err)
+	}
+
+	seen, err := time.Parse(time.RFC3339Nano, row[5])
+	if err != nil {
+		return PacketEvent{}, invalidRecord{where, fmt.Sprintf("timestamp: %v", err)}
+	}
+	opCode, err := strconv.ParseUint(row[6], 10, 16)
+	if err != nil {
+		return PacketEvent{}, invalidRecord{where, fmt.Sprintf("opcode: %v", err)}
+	}
+	length, err := strconv.Atoi(row[8])
+	if err != nil {
+		return PacketEvent{}, invalidRecord{where, fmt.Sprintf("length: %v", err)}
+	}
+	payload, err := hex.DecodeString(row[9])
+	if err != nil {
+		return PacketEvent{}, invalidRecord{where, fmt.Sprintf("payload: %v", err)}
+	}
+	if length != len(payload) {
+		return PacketEvent{}, invalidRecord{where, fmt.Sprintf("length is %v but the payload has %v bytes", length, len(payload))}
+	}
+	pe := convertedPacket(row[0], row[1], row[2], seen, uint16(opCode), payload)
+	pe.Src, pe.Dst = row[3], row[4]
+	if len(row) > csvColumnsWithoutID {
+		pe.ID = row[10]
+		if pe.Seq, err = strconv.ParseUint(row[11], 10, 64); err != nil {
+			return PacketEvent{}, invalidRecord{where, fmt.Sprintf("seq: %v", err)}
+		}
+	}
+	return pe, validateRecord(where, pe)
+}
+
+func (cr *csvReader) close() error {
+	return cr.f.Close()
+}
+
+type csvWriter struct {
+	f *os.File
+	w *csv.Writer
+}
+
+func createCSVWriter(path string) (*csvWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := csv.NewWriter(f)
+	if err := w.Write(csvHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &csvWriter{f: f, w: w}, nil
+}
+
+func (cw *csvWriter) write(pe PacketEvent) error {
+	return cw.w.Write([]string{
+		pe.FlowID,
+		pe.FlowName,
+		pe.Direction,
+		pe.Src,
+		pe.Dst,
+		pe.Seen.Format(time.RFC3339Nano),
+		strconv.Itoa(int(pe.Packet.Base.OperationCode)),
+		pe.Packet.Base.ClientStructName,
+		strconv.Itoa(len(pe.Packet.Base.Data)),
+		hex.EncodeToString(pe.Packet.Base.Data),
+		pe.ID,
+		strconv.FormatUint(pe.Seq, 10),
+	})
+}
+
+func (cw *csvWriter) close() error {
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		cw.f.Close()
+		return err
+	}
+	return cw.f.Close()
+}
+
+// decryptedReader reads the <flowName>-<flowID>-decrypted.pcap files of output.decryptedPcap
+// the client is the side that opened the connection, the payload of each side is split into packets by their length headers
+type decryptedReader struct {
+	files            []string
+	f                *os.File
+	r                *pcapgo.Reader
+	frame            int
+	flowName, flowID string
+	client           string
+	// bytes of each direction that don't make a whole packet yet
+	buffered map[string][]byte
+	// packets of the last frame that weren't returned yet
+	pending []decryptedRecord
+}
+
+type decryptedRecord struct {
+	pe  PacketEvent
+	err error
+}
+
+func (dr *decryptedReader) next() (PacketEvent, error) {
+	for {
+		if len(dr.pending) > 0 {
+			r := dr.pending[0]
+			dr.pending = dr.pending[1:]
+			return r.pe, r.err
+		}
+		if dr.r == nil {
+			if len(dr.files) == 0 {
+				return PacketEvent{}, io.EOF
+			}
+			if err := dr.open(dr.files[0]); err != nil {
+				return PacketEvent{}, err
+			}
+			dr.files = dr.files[1:]
+		}
+
+		data, ci, err := dr.r.ReadPacketData()
+		if err == io.EOF {
+			dr.f.Close()
+			dr.r = nil
+			for direction, rest := range dr.buffered {
+				if len(rest) > 0 {
+					reason := fmt.Sprintf("the %v stream ends with %v bytes that aren't a whole packet", direction, len(rest))
+					dr.pending = append(dr.pending, decryptedRecord{err: invalidRecord{dr.f.Name(), reason}})
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return PacketEvent{}, fmt.Errorf("%v: %v", dr.f.Name(), err)
+		}
+		dr.frame++
+		where := fmt.Sprintf("%v: frame %v", dr.f.Name(), dr.frame)
+
+		p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok || p.NetworkLayer() == nil {
+			return PacketEvent{}, invalidRecord{where, "not a tcp segment"}
+		}
+		nf := p.NetworkLayer().NetworkFlow()
+		src := net.JoinHostPort(nf.Src().String(), strconv.Itoa(int(tcp.SrcPort)))
+		dst := net.JoinHostPort(nf.Dst().String(), strconv.Itoa(int(tcp.DstPort)))
+		if dr.client == "" {
+			dr.client = src
+			if tcp.SYN && tcp.ACK {
+				dr.client = dst
+			}
+		}
+		if len(tcp.Payload) == 0 {
+			continue
+		}
+
+		direction := "outbound"
+		if src != dr.client {
+			direction = "inbound"
+		}
+		buffered := append(dr.buffered[direction], tcp.Payload...)
+		consumed := 0
+		for _, b := range packetBoundaries(buffered, 0) {
+			consumed = b[1]
+			body := buffered[b[0]:b[1]]
+			if len(body) < 2 {
+				dr.pending = append(dr.pending, decryptedRecord{err: invalidRecord{where, "a packet without an operation code"}})
+				continue
+			}
+			pe := convertedPacket(dr.flowID, dr.flowName, direction, ci.Timestamp, binary.LittleEndian.Uint16(body), append([]byte(nil), body[2:]...))
+			pe.Src, pe.Dst = src, dst
+			dr.pending = append(dr.pending, decryptedRecord{pe: pe, err: validateRecord(where, pe)})
+		}
+		dr.buffered[direction] = append([]byte(nil), buffered[consumed:]...)
+	}
+}
+
+func (dr *decryptedReader) open(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	dr.f, dr.r, dr.frame = f, r, 0
+	dr.flowName, dr.flowID = flowFileName(path, "-decrypted.pcap")
+	dr.client = ""
+	dr.buffered = make(map[string][]byte)
+	return nil
+}
+
+func (dr *decryptedReader) close() error {
+	if dr.r != nil {
+		return dr.f.Close()
+	}
+	return nil
+}
+
+// decryptedWriter writes a decrypted pcap per flow like output.decryptedPcap
+type decryptedWriter struct {
+	session *session
+	pcaps   map[string]*decryptedPcap
+}
+
+func (dw *decryptedWriter) write(pe PacketEvent) error {
+	dp, ok := dw.pcaps[pe.FlowID]
+	if !ok {
+		client, server := flowEndpoints(pe)
+		dp = newConversationPcap(dw.session, pe.FlowName, pe.FlowID, tcpAddress(client, 1), tcpAddress(server, 2))
+		dw.pcaps[pe.FlowID] = dp
+	}
+	body := make([]byte, 2+len(pe.Packet.Base.Data))
+	binary.LittleEndian.PutUint16(body, pe.Packet.Base.OperationCode)
+	copy(body[2:], pe.Packet.Base.Data)
+	dp.write(pe.Seen, pe.Direction == "outbound", body)
+	return nil
+}
+
+func (dw *decryptedWriter) close() error {
+	for _, dp := range dw.pcaps {
+		dp.close()
+	}
+	return nil
+}
+
+// the address of host:port, hosts that aren't ips, e.g pseudonyms, become 10.0.0.n
+func tcpAddress(hostPort string, n byte) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	a := &net.TCPAddr{IP: net.ParseIP(host)}
+	if a.IP == nil {
+		a.IP = net.IPv4(10, 0, 0, n)
+	}
+	a.Port, _ = strconv.Atoi(port)
+	return a
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// convert in from one format to out in another with the credentials rules have masked, as sniffer convert does
+func convertFile(t *testing.T, from, in, to, out string, rules map[uint16]RedactRule) (converted, skipped int) {
+	t.Helper()
+	r, err := openRecordReader(from, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := createRecordWriter(to, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, skipped, err = convertRecords(testProtocol(t), r, w, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return converted, skipped
+}
+
+func readRecords(t *testing.T, format, path string) []PacketEvent {
+	t.Helper()
+	r, err := openRecordReader(format, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	var events []PacketEvent
+	for {
+		pe, err := r.next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, pe)
+	}
+}
+
+// the json lines of the golden handshake, as the capture writes them with c, in dir
+func handshakeJSONL(t *testing.T, dir string, c Config) {
+	t.Helper()
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, sink := runPipeline(t, c, ms)
+
+	w, err := createRecordWriter(formatJSONL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pe := range sink.byDirection() {
+		if err := w.write(pe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// json lines converted to another format and back are the same packets, with the same payloads byte for byte
+func TestConvertRoundTrip(t *testing.T) {
+	tests := []struct {
+		format, out string
+		// the format keeps the packet ids and sequence numbers
+		ids bool
+	}{
+		{formatSQLite, "packets.db", true},
+		{formatCSV, "packets.csv", true},
+		{formatDecrypted, "decrypted", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			dir := t.TempDir()
+			original := filepath.Join(dir, "original")
+			handshakeJSONL(t, original, testConfig())
+			expected := readRecords(t, formatJSONL, original)
+			if len(expected) == 0 {
+				t.Fatal("the capture wrote no packets")
+			}
+
+			converted, skipped := convertFile(t, formatJSONL, original, tt.format, filepath.Join(dir, tt.out), nil)
+			if converted != len(expected) || skipped != 0 {
+				t.Fatalf("%v records converted and %v skipped, expected %v and 0", converted, skipped, len(expected))
+			}
+			back := filepath.Join(dir, "back")
+			if converted, _ := convertFile(t, tt.format, filepath.Join(dir, tt.out), formatJSONL, back, nil); converted != len(expected) {
+				t.Fatalf("%v records converted back, expected %v", converted, len(expected))
+			}
+
+			got := readRecords(t, formatJSONL, back)
+			if len(got) != len(expected) {
+				t.Fatalf("%v packets after the round trip, expected %v", len(got), len(expected))
+			}
+			for i, e := range expected {
+				g := got[i]
+				if g.FlowID != e.FlowID || g.FlowName != e.FlowName || g.Direction != e.Direction || !g.Seen.Equal(e.Seen) || g.Src != e.Src || g.Dst != e.Dst {
+					t.Errorf("packet %v is %v %v %v %v %v>%v, expected %v %v %v %v %v>%v", i,
+						g.FlowID, g.FlowName, g.Direction, g.Seen, g.Src, g.Dst, e.FlowID, e.FlowName, e.Direction, e.Seen, e.Src, e.Dst)
+				}
+				if g.Packet.Base.OperationCode != e.Packet.Base.OperationCode || !bytes.Equal(g.Packet.Base.Data, e.Packet.Base.Data) {
+					t.Errorf("packet %v is %v %x, expected %v %x", i, g.Packet.Base.OperationCode, g.Packet.Base.Data, e.Packet.Base.OperationCode, e.Packet.Base.Data)
+				}
+				if tt.ids && (g.ID != e.ID || g.Seq != e.Seq) {
+					t.Errorf("packet %v is %v #%v, expected %v #%v", i, g.ID, g.Seq, e.ID, e.Seq)
+				}
+			}
+			if tt.ids {
+				a, _ := ioutil.ReadDir(original)
+				b, _ := ioutil.ReadDir(back)
+				if len(a) != len(b) {
+					t.Fatalf("%v files after the round trip, expected %v", len(b), len(a))
+				}
+				for _, fi := range a {
+					ea, _ := ioutil.ReadFile(filepath.Join(original, fi.Name()))
+					eb, err := ioutil.ReadFile(filepath.Join(back, fi.Name()))
+					if err != nil || !bytes.Equal(ea, eb) {
+						t.Errorf("%v differs after the round trip: %v\n%s\n%s", fi.Name(), err, ea, eb)
+					}
+				}
+			}
+		})
+	}
+}
+
+// records that can't be converted are skipped and counted, the others are converted
+func TestConvertSkipsInvalidRecords(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original")
+	handshakeJSONL(t, original, testConfig())
+	files, err := filepath.Glob(filepath.Join(original, "*.jsonl"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no flow files: %v", err)
+	}
+	valid := len(readRecords(t, formatJSONL, original))
+
+	// a packet record of the flow file, changed to be invalid in every way a record can be
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]interface{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r map[string]interface{}
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r["data"]; ok {
+			record = r
+			break
+		}
+	}
+	f.Close()
+	if record == nil {
+		t.Fatal("the flow file has no packet record")
+	}
+	invalid := []map[string]interface{}{
+		{"data": "zz"},
+		{"length": 1000},
+		{"direction": "sideways"},
+		{"truncated": true},
+	}
+	var lines []string
+	for _, changes := range invalid {
+		r := make(map[string]interface{})
+		for k, v := range record {
+			r[k] = v
+		}
+		for k, v := range changes {
+			r[k] = v
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(b))
+	}
+	lines = append(lines, "{not json")
+	out, err := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	converted, skipped := convertFile(t, formatJSONL, original, formatCSV, filepath.Join(dir, "packets.csv"), nil)
+	if converted != valid || skipped != len(lines) {
+		t.Errorf("%v records converted and %v skipped, expected %v and %v", converted, skipped, valid, len(lines))
+	}
+}
+
+// a capture made with the credentials as they were sent, e.g with --no-redact, is converted with them masked
+func TestConvertRedacts(t *testing.T) {
+	rules, err := newRedactRules(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original")
+	c := testConfig()
+	c.Redact = false
+	handshakeJSONL(t, original, c)
+	var sent bool
+	for _, pe := range readRecords(t, formatJSONL, original) {
+		if _, ok := containsPassword(string(pe.Packet.Base.Data)); ok {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Fatal("the json lines written without redaction don't have the password")
+	}
+
+	tests := []struct {
+		format, out string
+	}{
+		{formatJSONL, "jsonl"},
+		{formatSQLite, "packets.db"},
+		{formatCSV, "packets.csv"},
+		{formatDecrypted, "decrypted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			out := filepath.Join(dir, tt.out)
+			if converted, _ := convertFile(t, formatJSONL, original, tt.format, out, rules); converted == 0 {
+				t.Fatal("no records converted")
+			}
+			files := []string{out}
+			if fi, err := os.Stat(out); err == nil && fi.IsDir() {
+				files, _ = filepath.Glob(filepath.Join(out, "*"))
+			}
+			for _, f := range files {
+				b, err := ioutil.ReadFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if form, ok := containsPassword(string(b)); ok {
+					t.Errorf("%v has the password as %q", filepath.Base(f), form)
+				}
+			}
+			for _, pe := range readRecords(t, tt.format, out) {
+				if pe.Packet.Base.OperationCode == opLoginReq && strings.Contains(pe.Decoded, testPassword) {
+					t.Errorf("the decoded login has the password: %v", pe.Decoded)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertFormats(t *testing.T) {
+	dir := t.TempDir()
+	used := filepath.Join(dir, "used")
+	if err := os.MkdirAll(used, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(used, "login-client-1.jsonl"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRecordReader("xml", dir); err == nil {
+		t.Error("reading an unknown format")
+	}
+	if _, err := createRecordWriter("xml", dir); err == nil {
+		t.Error("writing an unknown format")
+	}
+	if _, err := createRecordWriter(formatJSONL, used); err == nil {
+		t.Error("writing json lines to a directory that has some")
+	}
+	if _, err := openRecordReader(formatSQLite, filepath.Join(dir, "missing.db")); err == nil {
+		t.Error("reading a database that doesn't exist")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Error("reading a database that doesn't exist created it")
+	}
+	if _, err := openRecordReader(formatJSONL, filepath.Join(dir, "empty")); err == nil {
+		t.Error("reading a directory that doesn't exist")
+	}
+}
@@ -1,44 +1,273 @@
 package service
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"github.com/shine-o/shine.engine.core/networking"
 	"github.com/spf13/cobra"
+	"io"
 	"os"
-	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
-// Flows utility struct for storing raw packets
-type Flows struct {
-	pfm map[string][]gopacket.Packet
-	m   sync.Mutex
+// rawPackets writes every captured packet to capture-<timestamp>.pcap in the session directory
+// once a file grows past rotateSize bytes the next packet starts a new one
+type rawPackets struct {
+	session    *session
+	rotateSize int64
+	linkType   layers.LinkType
+	snaplen    uint32
+	f          *os.File
+	w          *pcapgo.Writer
+	written    int64
+	mu         sync.Mutex
 }
 
-// write to disk pcapng files for each flow in the map
-func (pf *Flows) persist() {
-	pf.m.Lock()
-	for k, v := range pf.pfm {
-		pathName, err := filepath.Abs(fmt.Sprintf("%v%v", "output/", k))
-		if err != nil {
-			log.Fatal(err)
-		}
-		f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE, 0666)
+func newRawPackets(s *session, linkType layers.LinkType, snaplen int, rotateMB int) *rawPackets {
+	if snaplen <= 0 {
+		snaplen = 65536
+	}
+	return &rawPackets{
+		session:    s,
+		rotateSize: int64(rotateMB) * 1024 * 1024,
+		linkType:   linkType,
+		snaplen:    uint32(snaplen),
+	}
+}
 
-		r, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+// write a packet, rotating the file first if needed
+// both happen under the same lock so no packet is lost during the switch
+func (rp *rawPackets) write(ci gopacket.CaptureInfo, data []byte) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
 
-		for _, p := range v {
-			err = r.WritePacket(p.Metadata().CaptureInfo, p.Data())
+	if rp.w == nil || (rp.rotateSize > 0 && rp.written >= rp.rotateSize) {
+		if err := rp.rotate(ci.Timestamp); err != nil {
+			log.Error(err)
+			return
 		}
+	}
+
+	if err := rp.w.WritePacket(ci, data); err != nil {
+		log.Error(err)
+		return
+	}
+	// 16 bytes of record header per packet
+	rp.written += int64(len(data)) + 16
+}
 
-		r.Flush()
+func (rp *rawPackets) rotate(ts time.Time) error {
+	rp.closeFile()
+
+	pathName, err := rp.session.path(fmt.Sprintf("capture-%v.pcap", ts.Format("2006-01-02T15-04-05.000000")))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	rp.session.register(pathName, artifactPcap)
+
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(rp.snaplen, rp.linkType); err != nil {
 		f.Close()
+		return err
 	}
-	pf.m.Unlock()
+
+	log.Infof("writing raw packets to %v", pathName)
+	rp.f = f
+	rp.w = w
+	rp.written = 24
+	return nil
 }
 
+func (rp *rawPackets) closeFile() {
+	if rp.f == nil {
+		return
+	}
+	if err := rp.f.Close(); err != nil {
+		log.Error(err)
+	}
+	rp.f = nil
+	rp.w = nil
+}
+
+func (rp *rawPackets) close() {
+	rp.mu.Lock()
+	rp.closeFile()
+	rp.mu.Unlock()
+}
+
+// decode a packet payload, xoring it first from xorOffset unless xorOffset is nil
+// shared by the stream decoders and the decode command so both always read packets the same way
+func decodePacket(data []byte, xs XorSettings, xorOffset *uint16) (networking.Command, error) {
+	if xorOffset != nil {
+		xs.cipher(data, xorOffset)
+	}
+	return networking.DecodePacket(data)
+}
+
+// true if the whole length header of the packet at offset was received, PacketBoundary reads past the buffer otherwise
+// one byte tells a small header from a big one, a big one is a 0 followed by the two bytes of the length
+func lengthHeaderAvailable(data []byte, offset int) bool {
+	if offset >= len(data) {
+		return false
+	}
+	return data[offset] != 0 || len(data)-offset >= 3
+}
+
+// length of the packet at offset and the size of its length header
+// header is small for a one byte length, big for a 0 followed by a two byte length, anything else reads it like a stream does
+func packetLength(data []byte, offset int, header string) (uint16, int, error) {
+	switch header {
+	case "small":
+		return uint16(data[offset]), 1, nil
+	case "big":
+		if len(data)-offset < 3 {
+			return 0, 0, fmt.Errorf("offset %v: a big length header needs 3 bytes, %v left", offset, len(data)-offset)
+		}
+		return binary.LittleEndian.Uint16(data[offset+1:]), 3, nil
+	default:
+		if !lengthHeaderAvailable(data, offset) {
+			return 0, 0, fmt.Errorf("offset %v: the length header is cut short", offset)
+		}
+		pLen, skipBytes := networking.PacketBoundary(offset, data)
+		return pLen, skipBytes, nil
+	}
+}
+
+// Decode prints the packets of a hex string, or of every line of --file, without capturing anything
+// blobs may hold several packets, each one starts with its length header
 func Decode(cmd *cobra.Command, args []string) {
+	file, err := cmd.Flags().GetString("file")
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, err := cmd.Flags().GetString("type")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if header != "" && header != "small" && header != "big" {
+		log.Fatal("--type must be small or big")
+	}
+	xorOffsetFlag, err := cmd.Flags().GetInt("xor-offset")
+	if err != nil {
+		log.Fatal(err)
+	}
 
-}
\ No newline at end of file
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := loadProtocol(c.CommandsFile, c.SchemaFile)
+
+	xs := XorSettings{Key: c.XorKey, Limit: c.XorLimit}
+	var xorOffset *uint16
+	if xorOffsetFlag >= 0 {
+		if err := xs.validate(); err != nil {
+			log.Fatal(err)
+		}
+		if xorOffsetFlag >= int(xs.Limit) {
+			log.Fatalf("--xor-offset must be below the xor limit %v", xs.Limit)
+		}
+		o := uint16(xorOffsetFlag)
+		xorOffset = &o
+	}
+
+	var blobs []string
+	switch {
+	case file != "":
+		blobs, err = readHexLines(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case len(args) > 0:
+		blobs = []string{strings.Join(args, "")}
+	default:
+		log.Fatal("a hex string or --file is needed, e.g sniffer decode 04 07 08 2a 00")
+	}
+
+	failed := false
+	for i, blob := range blobs {
+		if len(blobs) > 1 {
+			fmt.Printf("## line %v\n", i+1)
+		}
+		// the xor offset carries over from one blob to the next, as lines of a file are usually consecutive packets
+		if err := decodeHex(os.Stdout, p, blob, header, xs, xorOffset); err != nil {
+			log.Error(err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// non empty lines of a file, lines starting with # are skipped
+func readHexLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// print every packet of a hex blob with the command names of pr, spaces, colons and a 0x prefix are ignored
+func decodeHex(w io.Writer, pr *protocol, blob, header string, xs XorSettings, xorOffset *uint16) error {
+	blob = strings.TrimPrefix(strings.TrimSpace(blob), "0x")
+	data, err := hex.DecodeString(strings.NewReplacer(" ", "", ":", "", "\t", "").Replace(blob))
+	if err != nil {
+		return err
+	}
+
+	for offset, n := 0, 1; offset < len(data); n++ {
+		pLen, skipBytes, err := packetLength(data, offset, header)
+		if err != nil {
+			return err
+		}
+		nextOffset := offset + skipBytes + int(pLen)
+		if nextOffset > len(data) {
+			return fmt.Errorf("offset %v: packet needs %v bytes, only %v left", offset, skipBytes+int(pLen), len(data)-offset)
+		}
+
+		packetData := make([]byte, pLen)
+		copy(packetData, data[offset+skipBytes:nextOffset])
+
+		p, err := decodePacket(packetData, xs, xorOffset)
+		if err != nil {
+			fmt.Fprintf(w, "#%v offset %v: %v\n%v", n, offset, err, hex.Dump(packetData))
+			offset = nextOffset
+			continue
+		}
+		b := p.Base
+		b.ClientStructName = pr.commandName(b.OperationCode)
+		fmt.Fprintf(w, "#%v offset %v  %v  %v (0x%04X)  %vB\n", n, offset, b.ClientStructName, b.OperationCode, b.OperationCode, len(b.Data))
+		if nr, err := ncStructRepresentation(b.OperationCode, b.Data); err == nil {
+			fmt.Fprintln(w, nr.UnpackedData)
+		}
+		fmt.Fprint(w, hex.Dump(b.Data))
+		offset = nextOffset
+	}
+	return nil
+}
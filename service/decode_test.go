@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLengthHeaderAvailable(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		offset    int
+		available bool
+	}{
+		{"nothing received", nil, 0, false},
+		{"offset at the end", []byte{2, 1, 1}, 3, false},
+		{"small header", []byte{2}, 0, true},
+		{"big header, the 0 only", []byte{0}, 0, false},
+		{"big header, one length byte", []byte{0, 0x10}, 0, false},
+		{"big header", []byte{0, 0x10, 0x01}, 0, true},
+		{"big header after a packet", []byte{1, 5, 0, 0x10}, 2, false},
+	}
+	for _, tt := range tests {
+		if got := lengthHeaderAvailable(tt.data, tt.offset); got != tt.available {
+			t.Errorf("%v: available %v, expected %v", tt.name, got, tt.available)
+		}
+	}
+}
+
+// a big packet after a small one, cut anywhere in its length header, is not read until the header is complete
+// once the rest of it arrives it is read the same as if it came whole
+func TestBigHeaderCutShort(t *testing.T) {
+	big := make([]byte, 300)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	small := EncodeShinePacket(opChatReq, []byte{1})
+	whole := append(append([]byte(nil), small...), EncodeShinePacket(opChatReq, big)...)
+	header := len(small)
+	expected := packetBoundaries(whole, 0)
+	if len(expected) != 2 || expected[1] != [2]int{header + 3, len(whole)} {
+		t.Fatalf("the whole stream has boundaries %v", expected)
+	}
+
+	for cut := 0; cut <= 3; cut++ {
+		t.Run(fmt.Sprintf("%v header bytes", cut), func(t *testing.T) {
+			data := whole[:header+cut]
+			if got := lengthHeaderAvailable(data, header); got != (cut == 3) {
+				t.Errorf("header available %v", got)
+			}
+			if got := packetBoundaries(data, 0); len(got) != 1 || got[0] != expected[0] {
+				t.Errorf("boundaries %v, expected only %v", got, expected[0])
+			}
+			_, _, err := packetLength(data, header, "")
+			if (err == nil) != (cut == 3) {
+				t.Errorf("reading the length: %v", err)
+			}
+			_, _, err = packetLength(data, header, "big")
+			if (err == nil) != (cut == 3) {
+				t.Errorf("reading the length as big: %v", err)
+			}
+
+			// the rest of the packet, as the next segment
+			data = append(append([]byte(nil), data...), whole[header+cut:]...)
+			if got := packetBoundaries(data, 0); fmt.Sprint(got) != fmt.Sprint(expected) {
+				t.Errorf("boundaries %v once the rest arrived, expected %v", got, expected)
+			}
+			pLen, skip, err := packetLength(data, header, "")
+			if err != nil || pLen != uint16(len(whole)-header-3) || skip != 3 {
+				t.Errorf("length %v after %v header bytes, %v, expected %v after 3", pLen, skip, err, len(whole)-header-3)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// decryptedPcap writes the packets of a stream, client ones already xored back to plain text, to
+// <flowName>-<flowID>-decrypted.pcap in the session directory, as a tcp connection wireshark can follow
+// the headers are made up, only the endpoints and timestamps are the original ones, with --anonymize the endpoints are 10.x ones
+type decryptedPcap struct {
+	session *session
+	path    string
+	conv    *TCPConversation
+	f       *os.File
+	w       *pcapgo.Writer
+	closed  bool
+	mu      sync.Mutex
+}
+
+// the client and server endpoints of the stream, net and transport are the flows of its first packet
+func newDecryptedPcap(s *session, flowName, flowID string, net, transport gopacket.Flow, srcIsServer bool) *decryptedPcap {
+	client := flowAddress(net.Src(), transport.Src())
+	server := flowAddress(net.Dst(), transport.Dst())
+	if srcIsServer {
+		client, server = server, client
+	}
+	return newConversationPcap(s, flowName, flowID, s.anonymizer().tcpAddr(client), s.anonymizer().tcpAddr(server))
+}
+
+// a decrypted pcap of a connection between client and server, sniffer convert writes them with it too
+func newConversationPcap(s *session, flowName, flowID string, client, server *net.TCPAddr) *decryptedPcap {
+	dp := &decryptedPcap{
+		session: s,
+		path:    fmt.Sprintf("%v-%v-decrypted.pcap", flowName, flowID),
+	}
+	dp.conv = newTCPConversation(dp, client, server, time.Time{})
+	return dp
+}
+
+func flowAddress(ip, port gopacket.Endpoint) *net.TCPAddr {
+	a := &net.TCPAddr{IP: net.IP(ip.Raw())}
+	if raw := port.Raw(); len(raw) == 2 {
+		a.Port = int(binary.BigEndian.Uint16(raw))
+	}
+	return a
+}
+
+// Add implements frameAdder, called by the conversation with the lock held
+func (dp *decryptedPcap) Add(seen time.Time, data []byte) {
+	ci := gopacket.CaptureInfo{
+		Timestamp:     seen,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	if err := dp.w.WritePacket(ci, data); err != nil {
+		log.Error(err)
+	}
+}
+
+// write a packet body, operation code included, as sent by the client or the server
+// the file is created, and the handshake written, with the first packet
+func (dp *decryptedPcap) write(seen time.Time, fromClient bool, body []byte) {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.closed {
+		return
+	}
+	if dp.f == nil {
+		if err := dp.open(); err != nil {
+			log.Error(err)
+			dp.closed = true
+			return
+		}
+		if err := dp.conv.handshake(seen); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := dp.conv.send(seen, fromClient, frameShinePacket(body)); err != nil {
+		log.Error(err)
+	}
+}
+
+func (dp *decryptedPcap) open() error {
+	pathName, err := dp.session.path(dp.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	dp.session.register(pathName, artifactDecryptedPcap)
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(defaultSnaplen, layers.LinkTypeEthernet); err != nil {
+		f.Close()
+		return err
+	}
+	dp.f, dp.w = f, w
+	return nil
+}
+
+func (dp *decryptedPcap) close() {
+	dp.mu.Lock()
+	defer dp.mu.Unlock()
+	if dp.closed {
+		return
+	}
+	dp.closed = true
+	if dp.f == nil {
+		return
+	}
+	if err := dp.f.Close(); err != nil {
+		log.Error(err)
+	}
+}
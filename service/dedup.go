@@ -0,0 +1,76 @@
+package service
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// packetDedup drops packets a stream already decoded a moment ago with the same operation code and payload
+// the assembler only removes tcp level retransmissions, mirrored ports and captures on two interfaces still
+// hand the same packet over twice. The last size packets are remembered, the oldest is forgotten first
+type packetDedup struct {
+	window  time.Duration
+	size    int
+	entries map[dedupKey]*list.Element
+	order   *list.List
+	mu      sync.Mutex
+}
+
+type dedupKey struct {
+	direction string
+	opCode    uint16
+	hash      uint64
+}
+
+type dedupEntry struct {
+	key  dedupKey
+	seen time.Time
+}
+
+func newPacketDedup(window time.Duration, size int) *packetDedup {
+	if size < 1 {
+		size = 1
+	}
+	return &packetDedup{
+		window:  window,
+		size:    size,
+		entries: make(map[dedupKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// true if the same packet was seen in the same direction within the window, a nil packetDedup never drops anything
+func (pd *packetDedup) duplicate(dp decodedPacket) bool {
+	if pd == nil {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(dp.packet.Base.Data)
+	key := dedupKey{
+		direction: dp.direction,
+		opCode:    dp.packet.Base.OperationCode,
+		hash:      h.Sum64(),
+	}
+
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if e, ok := pd.entries[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		if d := dp.seen.Sub(entry.seen); d >= 0 && d <= pd.window {
+			return true
+		}
+		entry.seen = dp.seen
+		pd.order.MoveToFront(e)
+		return false
+	}
+
+	pd.entries[key] = pd.order.PushFront(&dedupEntry{key: key, seen: dp.seen})
+	if pd.order.Len() > pd.size {
+		oldest := pd.order.Back()
+		pd.order.Remove(oldest)
+		delete(pd.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return false
+}
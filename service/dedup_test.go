@@ -0,0 +1,151 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.core/networking"
+	"testing"
+	"time"
+)
+
+func TestPacketDedup(t *testing.T) {
+	type packet struct {
+		direction string
+		opCode    uint16
+		data      string
+		at        time.Duration
+		duplicate bool
+	}
+	tests := []struct {
+		name    string
+		size    int
+		packets []packet
+	}{
+		{
+			name: "same packet within the window",
+			size: 4,
+			packets: []packet{
+				{"inbound", opLoginAck, "a", 0, false},
+				{"inbound", opLoginAck, "a", 50 * time.Millisecond, true},
+			},
+		},
+		{
+			name: "same packet after the window",
+			size: 4,
+			packets: []packet{
+				{"inbound", opLoginAck, "a", 0, false},
+				{"inbound", opLoginAck, "a", 150 * time.Millisecond, false},
+				{"inbound", opLoginAck, "a", 200 * time.Millisecond, true},
+			},
+		},
+		{
+			name: "other direction, operation code or payload",
+			size: 4,
+			packets: []packet{
+				{"inbound", opLoginAck, "a", 0, false},
+				{"outbound", opLoginAck, "a", 0, false},
+				{"inbound", opLoginReq, "a", 0, false},
+				{"inbound", opLoginAck, "b", 0, false},
+			},
+		},
+		{
+			name: "seen before the one remembered",
+			size: 4,
+			packets: []packet{
+				{"inbound", opLoginAck, "a", 50 * time.Millisecond, false},
+				{"inbound", opLoginAck, "a", 0, false},
+			},
+		},
+		{
+			name: "the oldest packet is forgotten",
+			size: 2,
+			packets: []packet{
+				{"inbound", opLoginAck, "a", 0, false},
+				{"inbound", opLoginAck, "b", 0, false},
+				{"inbound", opLoginAck, "c", 0, false},
+				{"inbound", opLoginAck, "a", 0, false},
+				{"inbound", opLoginAck, "c", 0, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pd := newPacketDedup(100*time.Millisecond, tt.size)
+			for i, p := range tt.packets {
+				dp := decodedPacket{
+					seen:      testStart.Add(p.at),
+					direction: p.direction,
+					packet: &networking.Command{
+						Base: networking.CommandBase{
+							OperationCode: p.opCode,
+							Data:          []byte(p.data),
+						},
+					},
+				}
+				if got := pd.duplicate(dp); got != p.duplicate {
+					t.Errorf("packet %v duplicate %v, expected %v", i, got, p.duplicate)
+				}
+			}
+		})
+	}
+
+	var disabled *packetDedup
+	if disabled.duplicate(decodedPacket{}) {
+		t.Error("a nil packetDedup dropped a packet")
+	}
+}
+
+// packets the server sent twice reach the Handler once, unless dedup is off
+// a capture that has every frame twice, as on a mirrored port, decodes to the same packets with nothing counted as duplicate
+func TestDuplicatePackets(t *testing.T) {
+	tests := []struct {
+		name       string
+		dedup      bool
+		mirrored   bool
+		payloads   int
+		duplicates int
+	}{
+		{"dedup", true, false, 2, 1},
+		{"dedup off", false, false, 3, 0},
+		{"mirrored", true, true, 2, 1},
+		{"mirrored with dedup off", false, true, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			ack := EncodeShinePacket(opLoginAck, []byte{1, 2, 3})
+			// sent twice a millisecond apart, then once more past the window
+			for _, wait := range []time.Duration{0, 0, time.Second} {
+				conv.seen = conv.seen.Add(wait)
+				if err := conv.FromServer(ack); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.mirrored {
+				frames := ms.frames
+				ms.frames = nil
+				for _, f := range frames {
+					ms.frames = append(ms.frames, f, f)
+				}
+			}
+
+			c := testConfig()
+			c.Dedup = tt.dedup
+			c.DedupWindow = 100 * time.Millisecond
+			c.DedupSize = 16
+			sn, sink := runPipeline(t, c, ms)
+			if got := len(payloadsOf(sink.byDirection(), opLoginAck)); got != tt.payloads {
+				t.Errorf("%v packets handled, expected %v", got, tt.payloads)
+			}
+			summary := sn.Summary()
+			if len(summary) != 1 {
+				t.Fatalf("%v flows, expected 1", len(summary))
+			}
+			if summary[0].Duplicates != tt.duplicates {
+				t.Errorf("%v duplicates counted, expected %v", summary[0].Duplicates, tt.duplicates)
+			}
+		})
+	}
+}
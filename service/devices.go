@@ -0,0 +1,73 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+// flags set by libpcap on each device
+const (
+	pcapIfLoopback = 0x1
+	pcapIfUp       = 0x2
+)
+
+type deviceView struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Addresses   []string `json:"addresses"`
+	Up          bool     `json:"up"`
+	Loopback    bool     `json:"loopback"`
+}
+
+// Devices lists the interfaces packets can be captured on, so the right network.interface value can be picked
+func Devices(cmd *cobra.Command, args []string) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		log.Fatal("error listing devices: ", captureSetupError("", err))
+	}
+
+	var views []deviceView
+	for _, d := range devs {
+		dv := deviceView{
+			Name:        d.Name,
+			Description: d.Description,
+			Up:          d.Flags&pcapIfUp != 0,
+			Loopback:    d.Flags&pcapIfLoopback != 0,
+		}
+		for _, a := range d.Addresses {
+			dv.Addresses = append(dv.Addresses, a.IP.String())
+		}
+		views = append(views, dv)
+	}
+
+	out := cmd.OutOrStdout()
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		sd, err := json.MarshalIndent(views, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintln(out, string(sd))
+		return
+	}
+
+	for _, dv := range views {
+		state := "down"
+		if dv.Up {
+			state = "up"
+		}
+		if dv.Loopback {
+			state += ", loopback"
+		}
+		fmt.Fprintf(out, "%v (%v)\n", dv.Name, state)
+		if dv.Description != "" {
+			fmt.Fprintf(out, "\t%v\n", dv.Description)
+		}
+		if len(dv.Addresses) > 0 {
+			fmt.Fprintf(out, "\t%v\n", strings.Join(dv.Addresses, ", "))
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// diffRun is a range of bytes that is either the same in both payloads or different
+// past the end of the shorter payload, runs differ and only hold the bytes of the longer one
+type diffRun struct {
+	Offset int  `json:"offset"`
+	Length int  `json:"length"`
+	Same   bool `json:"same"`
+	// hex of the bytes of each payload in a run that differs
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// payloadDiff compares two payloads byte by byte, at the same offsets
+type payloadDiff struct {
+	OldLength int       `json:"oldLength"`
+	NewLength int       `json:"newLength"`
+	Differing int       `json:"differing"`
+	Runs      []diffRun `json:"runs"`
+}
+
+// split two payloads into runs of equal and different bytes
+func diffPayloads(a, b []byte) payloadDiff {
+	d := payloadDiff{
+		OldLength: len(a),
+		NewLength: len(b),
+	}
+	size := len(a)
+	if len(b) > size {
+		size = len(b)
+	}
+
+	same := func(i int) bool {
+		return i < len(a) && i < len(b) && a[i] == b[i]
+	}
+	// the bytes of p in [start, end), as much of it as p has
+	bytesOf := func(p []byte, start, end int) string {
+		if start >= len(p) {
+			return ""
+		}
+		if end > len(p) {
+			end = len(p)
+		}
+		return hex.EncodeToString(p[start:end])
+	}
+
+	for start := 0; start < size; {
+		s := same(start)
+		end := start + 1
+		for end < size && same(end) == s {
+			end++
+		}
+		r := diffRun{
+			Offset: start,
+			Length: end - start,
+			Same:   s,
+		}
+		if !s {
+			r.Old = bytesOf(a, start, end)
+			r.New = bytesOf(b, start, end)
+			d.Differing += r.Length
+		}
+		d.Runs = append(d.Runs, r)
+		start = end
+	}
+	return d
+}
+
+// a packet from the sqlite database if id is a row id, from the history of the active streams otherwise, or from the
+// database if it isn't in the history anymore
+func (sn *Sniffer) findPacket(id string) (storedPacket, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+		if sn.store == nil {
+			return storedPacket{}, fmt.Errorf("packet %v: no sqlite database, set output.sqlite.path", id)
+		}
+		return findStoredPacket(sn.protocol, sn.store.db, id)
+	}
+	for _, pe := range sn.history() {
+		if pe.ID != id {
+			continue
+		}
+		b := pe.Packet.Base
+		return storedPacket{
+			ID:        pe.ID,
+			PacketID:  pe.ID,
+			Seq:       pe.Seq,
+			FlowID:    pe.FlowID,
+			FlowName:  pe.FlowName,
+			Direction: pe.Direction,
+			Seen:      pe.Seen,
+			OpCode:    b.OperationCode,
+			Command:   b.ClientStructName,
+			Length:    len(b.Data),
+			Payload:   b.Data,
+		}, nil
+	}
+	if sn.store == nil {
+		return storedPacket{}, fmt.Errorf("packet %v is not in the history", id)
+	}
+	return findStoredPacket(sn.protocol, sn.store.db, id)
+}
+
+// the packet with the row id or the PacketEvent id, the first one stored if a capture was stored more than once
+func findStoredPacket(pr *protocol, db *sql.DB, id string) (storedPacket, error) {
+	var (
+		p         storedPacket
+		rowID, ts int64
+	)
+	where, arg := "packet_id = ?", interface{}(id)
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		where, arg = "id = ?", n
+	}
+	err := db.QueryRow("SELECT id, flow_id, flow_name, direction, timestamp, opcode, length, payload, packet_id, seq FROM packets WHERE "+where+" ORDER BY id LIMIT 1", arg).
+		Scan(&rowID, &p.FlowID, &p.FlowName, &p.Direction, &ts, &p.OpCode, &p.Length, &p.Payload, &p.PacketID, &p.Seq)
+	if err == sql.ErrNoRows {
+		return p, fmt.Errorf("packet %v is not in the database", id)
+	}
+	if err != nil {
+		return p, err
+	}
+	p.ID = strconv.FormatInt(rowID, 10)
+	p.Seen = time.Unix(0, ts)
+	p.Command = pr.commandName(p.OpCode)
+	return p, nil
+}
+
+// diffRequest is the body of POST /api/diff, packet ids as returned by the search api or shown in the UI
+type diffRequest struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// diffResult is the json returned by POST /api/diff
+type diffResult struct {
+	Old  storedPacket `json:"old"`
+	New  storedPacket `json:"new"`
+	Diff payloadDiff  `json:"diff"`
+}
+
+// POST /api/diff with {"old": "<id>", "new": "<id>"} compares the payloads of two packets
+// numeric ids are sqlite row ids, any other id is looked up in the packet history
+func (sn *Sniffer) diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req diffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Old == "" || req.New == "" {
+		http.Error(w, "old and new packet ids are needed", http.StatusBadRequest)
+		return
+	}
+
+	var res diffResult
+	for _, p := range []struct {
+		id  string
+		dst *storedPacket
+	}{{req.Old, &res.Old}, {req.New, &res.New}} {
+		sp, err := sn.findPacket(p.id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		*p.dst = sp
+	}
+	if res.Old.OpCode != res.New.OpCode {
+		log.Warningf("diffing packets with different operation codes, %v and %v", res.Old.OpCode, res.New.OpCode)
+	}
+	res.Diff = diffPayloads(res.Old.Payload, res.New.Payload)
+	writeJSON(w, res)
+}
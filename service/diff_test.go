@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/shine-o/shine.engine.core/networking"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffPayloads(t *testing.T) {
+	tests := []struct {
+		name      string
+		old, new  []byte
+		differing int
+		runs      []diffRun
+	}{
+		{
+			name: "same",
+			old:  []byte{1, 2, 3},
+			new:  []byte{1, 2, 3},
+			runs: []diffRun{{Offset: 0, Length: 3, Same: true}},
+		},
+		{
+			name: "both empty",
+		},
+		{
+			name:      "one byte in the middle",
+			old:       []byte{1, 2, 3, 4},
+			new:       []byte{1, 9, 3, 4},
+			differing: 1,
+			runs: []diffRun{
+				{Offset: 0, Length: 1, Same: true},
+				{Offset: 1, Length: 1, Old: "02", New: "09"},
+				{Offset: 2, Length: 2, Same: true},
+			},
+		},
+		{
+			name:      "new is longer",
+			old:       []byte{1, 2},
+			new:       []byte{1, 2, 3, 4},
+			differing: 2,
+			runs: []diffRun{
+				{Offset: 0, Length: 2, Same: true},
+				{Offset: 2, Length: 2, New: "0304"},
+			},
+		},
+		{
+			name:      "new is shorter and differs before it ends",
+			old:       []byte{1, 2, 3, 4},
+			new:       []byte{1, 5},
+			differing: 3,
+			runs: []diffRun{
+				{Offset: 0, Length: 1, Same: true},
+				{Offset: 1, Length: 3, Old: "020304", New: "05"},
+			},
+		},
+		{
+			name:      "old is empty",
+			new:       []byte{0xaa, 0xbb},
+			differing: 2,
+			runs:      []diffRun{{Offset: 0, Length: 2, New: "aabb"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diffPayloads(tt.old, tt.new)
+			if d.OldLength != len(tt.old) || d.NewLength != len(tt.new) {
+				t.Errorf("lengths %v and %v, expected %v and %v", d.OldLength, d.NewLength, len(tt.old), len(tt.new))
+			}
+			if d.Differing != tt.differing {
+				t.Errorf("%v bytes differ, expected %v", d.Differing, tt.differing)
+			}
+			if !reflect.DeepEqual(d.Runs, tt.runs) {
+				t.Errorf("runs %+v, expected %+v", d.Runs, tt.runs)
+			}
+		})
+	}
+}
+
+// packets in the history of an active stream can be diffed by id, numeric ids need the sqlite database
+func TestDiffHandler(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := sessionStream("login", "192.168.1.20")
+	ss.history = newPacketHistory(4)
+	for _, p := range []struct {
+		id   string
+		data []byte
+	}{
+		{"login-client-0", []byte{1, 2, 3}},
+		{"login-client-10", []byte{1, 4, 3, 5}},
+	} {
+		ss.history.add(PacketEvent{
+			ID:     p.id,
+			FlowID: "login",
+			Packet: &networking.Command{
+				Base: networking.CommandBase{
+					OperationCode: opLoginReq,
+					Data:          p.data,
+				},
+			},
+		})
+	}
+	sn.streams.add(ss)
+
+	tests := []struct {
+		name, method, body string
+		status             int
+	}{
+		{"get", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"bad json", http.MethodPost, "{", http.StatusBadRequest},
+		{"missing id", http.MethodPost, `{"old": "login-client-0"}`, http.StatusBadRequest},
+		{"unknown id", http.MethodPost, `{"old": "login-client-0", "new": "login-client-99"}`, http.StatusNotFound},
+		{"row id without a database", http.MethodPost, `{"old": "1", "new": "login-client-0"}`, http.StatusNotFound},
+		{"history", http.MethodPost, `{"old": "login-client-0", "new": "login-client-10"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sn.diffHandler(w, httptest.NewRequest(tt.method, "/api/diff", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %v, expected %v: %v", w.Code, tt.status, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var res diffResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Old.ID != "login-client-0" || res.New.ID != "login-client-10" {
+				t.Errorf("diffed %v and %v", res.Old.ID, res.New.ID)
+			}
+			if !reflect.DeepEqual(res.Diff, diffPayloads([]byte{1, 2, 3}, []byte{1, 4, 3, 5})) {
+				t.Errorf("got diff %+v", res.Diff)
+			}
+		})
+	}
+}
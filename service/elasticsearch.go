@@ -0,0 +1,342 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	elasticsearchTimeout      = 10 * time.Second
+	elasticsearchRetries      = 3
+	elasticsearchDropsLogging = 10 * time.Second
+)
+
+// the wait before the first retry of a batch, doubled for each next one, the tests shorten it
+var elasticsearchRetryDelay = 500 * time.Millisecond
+
+// ElasticsearchConfig is read from output.elasticsearch, an empty URL indexes nothing
+// opensearch speaks the same bulk and index template apis
+type ElasticsearchConfig struct {
+	URL string
+	// packets are indexed in <IndexPrefix>-YYYY.MM.DD, by capture day
+	IndexPrefix string
+	// packets sent per bulk request
+	BatchSize int
+	// a batch that isn't full is sent after this long
+	FlushInterval time.Duration
+	// packets waiting to be indexed, once full new ones are dropped
+	QueueSize int
+}
+
+// elasticsearchDocument is a decoded packet as indexed
+type elasticsearchDocument struct {
+	Timestamp     time.Time         `json:"@timestamp"`
+	PacketID      string            `json:"packetID"`
+	Seq           uint64            `json:"seq"`
+	FlowID        string            `json:"flowID"`
+	FlowName      string            `json:"flowName"`
+	SessionID     string            `json:"sessionID,omitempty"`
+	Src           string            `json:"src"`
+	Dst           string            `json:"dst"`
+	Direction     string            `json:"direction"`
+	OperationCode uint16            `json:"operationCode"`
+	Command       string            `json:"command"`
+	Length        int               `json:"length"`
+	Data          string            `json:"data"`
+	Decoded       json.RawMessage   `json:"decoded,omitempty"`
+	Context       map[string]string `json:"context,omitempty"`
+}
+
+// the index template of the packet indices, so flows and commands can be aggregated on in kibana
+func elasticsearchTemplate(prefix string) map[string]interface{} {
+	keyword := map[string]string{"type": "keyword"}
+	return map[string]interface{}{
+		"index_patterns": []string{prefix + "-*"},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"@timestamp":    map[string]string{"type": "date"},
+					"packetID":      keyword,
+					"seq":           map[string]string{"type": "long"},
+					"flowID":        keyword,
+					"flowName":      keyword,
+					"sessionID":     keyword,
+					"src":           keyword,
+					"dst":           keyword,
+					"direction":     keyword,
+					"operationCode": map[string]string{"type": "integer"},
+					"command":       keyword,
+					"length":        map[string]string{"type": "integer"},
+					"data":          map[string]interface{}{"type": "keyword", "index": false},
+				},
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"context": map[string]interface{}{
+							"path_match": "context.*",
+							"mapping":    keyword,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// elasticsearchIndexer queues bulk index lines that a single goroutine sends in batches
+// a batch that can't be indexed is retried a few times and then dropped, publishing never blocks
+type elasticsearchIndexer struct {
+	c       ElasticsearchConfig
+	client  *http.Client
+	queue   chan []byte
+	dropped uint64
+	metrics *snifferMetrics
+	done    chan bool
+	// the template is put before the first batch, and again before the next ones until it succeeds
+	templated bool
+	// workers of streams that weren't drained in time may still publish after close
+	closed bool
+	mu     sync.RWMutex
+}
+
+// the sink indexing into output.elasticsearch, nil if no url is set
+// documents it drops are counted in sm
+func newElasticsearchIndexer(c ElasticsearchConfig, sm *snifferMetrics) (Sink, error) {
+	if c.URL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("output.elasticsearch.url: %q is not an http(s) url", c.URL)
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.IndexPrefix == "" {
+		return nil, fmt.Errorf("output.elasticsearch.indexPrefix is empty")
+	}
+	if c.BatchSize < 1 {
+		c.BatchSize = 1
+	}
+	if c.QueueSize < 1 {
+		c.QueueSize = 1
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	ei := &elasticsearchIndexer{
+		c:       c,
+		client:  &http.Client{Timeout: elasticsearchTimeout},
+		queue:   make(chan []byte, c.QueueSize),
+		metrics: sm,
+		done:    make(chan bool),
+	}
+	go ei.run()
+	return ei, nil
+}
+
+func (ei *elasticsearchIndexer) Publish(pe PacketEvent) {
+	d := elasticsearchDocument{
+		Timestamp:     pe.Seen,
+		PacketID:      pe.ID,
+		Seq:           pe.Seq,
+		FlowID:        pe.FlowID,
+		FlowName:      pe.FlowName,
+		SessionID:     pe.SessionID,
+		Src:           pe.Src,
+		Dst:           pe.Dst,
+		Direction:     pe.Direction,
+		OperationCode: pe.Packet.Base.OperationCode,
+		Command:       pe.Packet.Base.ClientStructName,
+		Length:        len(pe.Packet.Base.Data),
+		Data:          hex.EncodeToString(pe.Packet.Base.Data),
+		Context:       pe.Context,
+	}
+	if pe.Decoded != "" {
+		d.Decoded = json.RawMessage(pe.Decoded)
+	}
+
+	doc, err := json.Marshal(d)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	index := fmt.Sprintf("%v-%v", ei.c.IndexPrefix, pe.Seen.UTC().Format("2006.01.02"))
+	// indexed with the packet id, indexing the same capture again replaces its documents instead of adding them twice
+	action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": index, "_id": pe.ID}})
+
+	var b bytes.Buffer
+	b.Write(action)
+	b.WriteByte('\n')
+	b.Write(doc)
+	b.WriteByte('\n')
+
+	ei.mu.RLock()
+	defer ei.mu.RUnlock()
+	if ei.closed {
+		return
+	}
+	select {
+	case ei.queue <- b.Bytes():
+	default:
+		ei.drop(1)
+	}
+}
+
+func (ei *elasticsearchIndexer) drop(n int) {
+	atomic.AddUint64(&ei.dropped, uint64(n))
+	ei.metrics.elasticsearchEventsDropped(n)
+}
+
+func (ei *elasticsearchIndexer) run() {
+	defer close(ei.done)
+
+	flush := time.NewTicker(ei.c.FlushInterval)
+	defer flush.Stop()
+	t := time.NewTicker(elasticsearchDropsLogging)
+	defer t.Stop()
+
+	var (
+		batch  [][]byte
+		logged uint64
+	)
+	for {
+		select {
+		case line, ok := <-ei.queue:
+			if !ok {
+				ei.index(batch)
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) >= ei.c.BatchSize {
+				ei.index(batch)
+				batch = nil
+			}
+		case <-flush.C:
+			ei.index(batch)
+			batch = nil
+		case <-t.C:
+			if dropped := atomic.LoadUint64(&ei.dropped); dropped > logged {
+				log.Warningf("%v packets dropped before reaching elasticsearch", dropped-logged)
+				logged = dropped
+			}
+		}
+	}
+}
+
+// send a batch with the bulk api, retrying with backoff while elasticsearch is unreachable or overloaded
+func (ei *elasticsearchIndexer) index(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+	if !ei.templated {
+		ei.putTemplate()
+	}
+
+	body := bytes.Join(batch, nil)
+	delay := elasticsearchRetryDelay
+	for attempt := 0; ; attempt++ {
+		failed, retry, err := ei.bulk(body)
+		if err == nil {
+			if failed > 0 {
+				log.Errorf("elasticsearch rejected %v of %v packets", failed, len(batch))
+				ei.drop(failed)
+			}
+			return
+		}
+		if !retry || attempt == elasticsearchRetries {
+			log.Errorf("indexing %v packets in elasticsearch: %v", len(batch), err)
+			ei.drop(len(batch))
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post a bulk request, returns how many documents were rejected and whether a failed request is worth retrying
+func (ei *elasticsearchIndexer) bulk(body []byte) (failed int, retry bool, err error) {
+	res, err := ei.client.Post(ei.c.URL+"/_bulk", "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return 0, true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return 0, retry, fmt.Errorf("%v: %v", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var r struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return 0, false, fmt.Errorf("reading the bulk response: %v", err)
+	}
+	if r.Errors {
+		for _, item := range r.Items {
+			for _, result := range item {
+				if result.Status >= 300 {
+					failed++
+				}
+			}
+		}
+	}
+	return failed, false, nil
+}
+
+// create or update the index template of output.elasticsearch.indexPrefix, packets are still indexed if it fails
+func (ei *elasticsearchIndexer) putTemplate() {
+	b, err := json.Marshal(elasticsearchTemplate(ei.c.IndexPrefix))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPut, ei.c.URL+"/_index_template/"+ei.c.IndexPrefix, bytes.NewReader(b))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := ei.client.Do(req)
+	if err != nil {
+		log.Errorf("putting the elasticsearch index template: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		log.Errorf("putting the elasticsearch index template: %v: %v", res.Status, strings.TrimSpace(string(msg)))
+		return
+	}
+	ei.templated = true
+	log.Infof("elasticsearch index template %v is set for %v-*", ei.c.IndexPrefix, ei.c.IndexPrefix)
+}
+
+// index what is left in the queue
+func (ei *elasticsearchIndexer) Close() {
+	ei.mu.Lock()
+	if ei.closed {
+		ei.mu.Unlock()
+		return
+	}
+	ei.closed = true
+	close(ei.queue)
+	ei.mu.Unlock()
+
+	<-ei.done
+	if dropped := atomic.LoadUint64(&ei.dropped); dropped > 0 {
+		log.Warningf("%v packets were dropped in total before reaching elasticsearch", dropped)
+	}
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/shine-o/shine.engine.core/networking"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bulkServer mocks the _bulk and _index_template apis, bulk requests get the statuses in order, 200 once they run out
+type bulkServer struct {
+	*httptest.Server
+	statuses []int
+	// documents that get a 400 in the response items, by packet id
+	rejected map[string]bool
+	// the template put fails while set
+	templateFails bool
+	// bulk requests wait for it to be closed, if set
+	hold chan struct{}
+
+	mu        sync.Mutex
+	templates []map[string]interface{}
+	requests  int
+	// the action and document lines of the bulk requests answered with 200
+	batches [][]string
+}
+
+func newBulkServer(t *testing.T) *bulkServer {
+	bs := &bulkServer{}
+	bs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/_index_template/packets":
+			bs.mu.Lock()
+			defer bs.mu.Unlock()
+			if bs.templateFails {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			var template map[string]interface{}
+			if err := json.Unmarshal(body, &template); err != nil {
+				t.Error(err)
+			}
+			bs.templates = append(bs.templates, template)
+		case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+			if bs.hold != nil {
+				<-bs.hold
+			}
+			if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+				t.Errorf("bulk request with content type %v", ct)
+			}
+			bs.mu.Lock()
+			defer bs.mu.Unlock()
+			bs.requests++
+			if len(bs.statuses) > 0 {
+				status := bs.statuses[0]
+				bs.statuses = bs.statuses[1:]
+				if status != http.StatusOK {
+					http.Error(w, "try again", status)
+					return
+				}
+			}
+			var (
+				lines  []string
+				items  []interface{}
+				errors bool
+			)
+			s := bufio.NewScanner(bytes.NewReader(body))
+			s.Buffer(nil, 1<<20)
+			for s.Scan() {
+				lines = append(lines, s.Text())
+				if len(lines)%2 == 0 {
+					continue
+				}
+				var action struct {
+					Index struct {
+						ID string `json:"_id"`
+					} `json:"index"`
+				}
+				if err := json.Unmarshal(s.Bytes(), &action); err != nil {
+					t.Error(err)
+				}
+				status := http.StatusCreated
+				if bs.rejected[action.Index.ID] {
+					status, errors = http.StatusBadRequest, true
+				}
+				items = append(items, map[string]interface{}{"index": map[string]int{"status": status}})
+			}
+			bs.batches = append(bs.batches, lines)
+			writeJSON(w, map[string]interface{}{"errors": errors, "items": items})
+		default:
+			t.Errorf("unexpected %v %v", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(bs.Close)
+	return bs
+}
+
+func (bs *bulkServer) indexed() [][]string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return append([][]string(nil), bs.batches...)
+}
+
+func esPacketEvent(i int) PacketEvent {
+	return PacketEvent{
+		ID:        "flow-s" + string(rune('a'+i)),
+		Seq:       uint64(i + 1),
+		FlowID:    "flow",
+		FlowName:  "login-client",
+		Seen:      testStart.Add(time.Duration(i) * time.Millisecond),
+		Direction: "inbound",
+		Src:       testServerAddr,
+		Dst:       testClientAddr,
+		Packet: &networking.Command{
+			Base: networking.CommandBase{
+				OperationCode:    opLoginAck,
+				ClientStructName: "NC_USER_LOGIN_ACK",
+				Data:             []byte{byte(i), 0xff},
+			},
+		},
+		Decoded: `{"numOfWorld":1}`,
+		Context: map[string]string{"character": "Tarian"},
+	}
+}
+
+// the indexer of a mock server, with retries that don't wait
+func newTestIndexer(t *testing.T, bs *bulkServer, batchSize, queueSize int) *elasticsearchIndexer {
+	t.Helper()
+	delay := elasticsearchRetryDelay
+	elasticsearchRetryDelay = time.Millisecond
+	t.Cleanup(func() {
+		elasticsearchRetryDelay = delay
+	})
+	sink, err := newElasticsearchIndexer(ElasticsearchConfig{
+		URL:           bs.URL + "/",
+		IndexPrefix:   "packets",
+		BatchSize:     batchSize,
+		FlushInterval: time.Hour,
+		QueueSize:     queueSize,
+	}, newSnifferMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink.(*elasticsearchIndexer)
+}
+
+func TestNewElasticsearchIndexer(t *testing.T) {
+	tests := []struct {
+		name string
+		c    ElasticsearchConfig
+		sink bool
+		err  bool
+	}{
+		{"no url", ElasticsearchConfig{}, false, false},
+		{"http", ElasticsearchConfig{URL: "http://localhost:9200", IndexPrefix: "packets"}, true, false},
+		{"https", ElasticsearchConfig{URL: "https://search.example.com/", IndexPrefix: "packets"}, true, false},
+		{"not http", ElasticsearchConfig{URL: "ftp://localhost:9200", IndexPrefix: "packets"}, false, true},
+		{"no host", ElasticsearchConfig{URL: "http://", IndexPrefix: "packets"}, false, true},
+		{"no index prefix", ElasticsearchConfig{URL: "http://localhost:9200"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := newElasticsearchIndexer(tt.c, newSnifferMetrics())
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, expected one %v", err, tt.err)
+			}
+			if (sink != nil) != tt.sink {
+				t.Fatalf("sink %v, expected one %v", sink, tt.sink)
+			}
+			if sink != nil {
+				sink.Close()
+			}
+		})
+	}
+}
+
+// packets are sent in batches of batchSize, what's left on Close, after the index template
+func TestElasticsearchBulk(t *testing.T) {
+	bs := newBulkServer(t)
+	ei := newTestIndexer(t, bs, 2, 16)
+	for i := 0; i < 5; i++ {
+		ei.Publish(esPacketEvent(i))
+	}
+	ei.Close()
+
+	batches := bs.indexed()
+	if len(batches) != 3 || len(batches[0]) != 4 || len(batches[1]) != 4 || len(batches[2]) != 2 {
+		t.Fatalf("expected batches of 2, 2 and 1 packets, got %v", batches)
+	}
+	if len(bs.templates) != 1 {
+		t.Fatalf("the index template was put %v times", len(bs.templates))
+	}
+	template, _ := json.Marshal(bs.templates[0])
+	for _, s := range []string{`"index_patterns":["packets-*"]`, `"@timestamp":{"type":"date"}`, `"flowID":{"type":"keyword"}`, `"command":{"type":"keyword"}`} {
+		if !strings.Contains(string(template), s) {
+			t.Errorf("the index template has no %v: %s", s, template)
+		}
+	}
+
+	var action map[string]map[string]string
+	if err := json.Unmarshal([]byte(batches[0][0]), &action); err != nil {
+		t.Fatal(err)
+	}
+	if action["index"]["_index"] != "packets-2020.05.01" || action["index"]["_id"] != "flow-sa" {
+		t.Errorf("indexed with %v", action)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(batches[0][1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"@timestamp":    "2020-05-01T12:30:00Z",
+		"packetID":      "flow-sa",
+		"flowName":      "login-client",
+		"operationCode": float64(opLoginAck),
+		"command":       "NC_USER_LOGIN_ACK",
+		"length":        float64(2),
+		"data":          "00ff",
+	}
+	for k, v := range expected {
+		if doc[k] != v {
+			t.Errorf("%v is %v, expected %v", k, doc[k], v)
+		}
+	}
+	if decoded, ok := doc["decoded"].(map[string]interface{}); !ok || decoded["numOfWorld"] != float64(1) {
+		t.Errorf("decoded is %v, expected the decoded fields as an object", doc["decoded"])
+	}
+	if context, ok := doc["context"].(map[string]interface{}); !ok || context["character"] != "Tarian" {
+		t.Errorf("context is %v", doc["context"])
+	}
+}
+
+func TestElasticsearchRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		rejected map[string]bool
+		requests int
+		indexed  int
+		dropped  uint64
+	}{
+		{"overloaded then indexed", []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}, nil, 3, 2, 0},
+		{"unavailable past the retries", []int{503, 503, 503, 503}, nil, elasticsearchRetries + 1, 0, 2},
+		{"bad request isn't retried", []int{http.StatusBadRequest}, nil, 1, 0, 2},
+		{"documents rejected", nil, map[string]bool{"flow-sb": true}, 1, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := newBulkServer(t)
+			bs.statuses = tt.statuses
+			bs.rejected = tt.rejected
+			ei := newTestIndexer(t, bs, 2, 16)
+			ei.Publish(esPacketEvent(0))
+			ei.Publish(esPacketEvent(1))
+			ei.Close()
+
+			if bs.requests != tt.requests {
+				t.Errorf("%v bulk requests, expected %v", bs.requests, tt.requests)
+			}
+			indexed := 0
+			for _, b := range bs.indexed() {
+				indexed += len(b) / 2
+			}
+			if indexed != tt.indexed {
+				t.Errorf("%v packets indexed, expected %v", indexed, tt.indexed)
+			}
+			if dropped := atomic.LoadUint64(&ei.dropped); dropped != tt.dropped {
+				t.Errorf("%v packets dropped, expected %v", dropped, tt.dropped)
+			}
+			if dropped := atomic.LoadUint64(&ei.metrics.esDropped); dropped != tt.dropped {
+				t.Errorf("the metric counted %v packets, expected %v", dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+// packets are still indexed without the template, which is put again before the next batch
+func TestElasticsearchTemplateRetried(t *testing.T) {
+	bs := newBulkServer(t)
+	bs.templateFails = true
+	ei := newTestIndexer(t, bs, 1, 16)
+	ei.Publish(esPacketEvent(0))
+	deadline := time.Now().Add(testPipelineWait)
+	for len(bs.indexed()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first packet wasn't indexed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	bs.mu.Lock()
+	bs.templateFails = false
+	bs.mu.Unlock()
+	ei.Publish(esPacketEvent(1))
+	ei.Close()
+
+	if len(bs.indexed()) != 2 || len(bs.templates) != 1 {
+		t.Errorf("%v batches indexed, template put %v times, expected 2 and 1", len(bs.indexed()), len(bs.templates))
+	}
+}
+
+// an elasticsearch that doesn't answer never holds up publishing, packets past the queue are dropped and counted
+func TestElasticsearchQueueFull(t *testing.T) {
+	bs := newBulkServer(t)
+	bs.hold = make(chan struct{})
+	ei := newTestIndexer(t, bs, 1, 2)
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			ei.Publish(esPacketEvent(i))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(testPipelineWait):
+		t.Fatal("publishing waited for elasticsearch")
+	}
+	close(bs.hold)
+	ei.Close()
+
+	indexed := len(bs.indexed())
+	dropped := atomic.LoadUint64(&ei.dropped)
+	if dropped == 0 || indexed+int(dropped) != 20 {
+		t.Errorf("%v packets indexed and %v dropped, expected some dropped and 20 in all", indexed, dropped)
+	}
+	if got := atomic.LoadUint64(&ei.metrics.esDropped); got != dropped {
+		t.Errorf("the metric counted %v packets, expected %v", got, dropped)
+	}
+}
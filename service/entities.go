@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"github.com/shine-o/shine.engine.core/structs"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
 )
@@ -138,9 +137,9 @@ func persistMovement(dp decodedPacket) {
 	}
 }
 
-func exportEntitiesMovements() {
+func exportEntitiesMovements(s *session) {
 	log.Info("printing entity movements")
-	pathName, err := filepath.Abs("output/movements.json")
+	pathName, err := s.path("movements.json")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -148,6 +147,7 @@ func exportEntitiesMovements() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	s.register(pathName, artifactMovements)
 
 	//_,_ = f.Write([]byte("{"))
 
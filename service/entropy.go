@@ -0,0 +1,145 @@
+package service
+
+import (
+	"math"
+	"sync"
+)
+
+// payloads whose average entropy is above this many bits per byte are likely compressed or encrypted beyond the xor
+const compressedEntropy = 7.0
+
+// payloads whose bytes are on average at least this printable are likely text
+const textPrintable = 0.9
+
+// payloadEntropy keeps the entropy and the share of printable bytes of the payloads of every flow name and operation code
+// disabled by output.entropy: false, for captures where every handled packet counts
+type payloadEntropy struct {
+	stats map[intervalKey]*entropyStats
+	mu    sync.Mutex
+}
+
+type entropyStats struct {
+	payloads                   int
+	entropySum, printableSum   float64
+	minEntropy, maxEntropy     float64
+	minPrintable, maxPrintable float64
+}
+
+func newPayloadEntropy(enabled bool) *payloadEntropy {
+	if !enabled {
+		return nil
+	}
+	return &payloadEntropy{
+		stats: make(map[intervalKey]*entropyStats),
+	}
+}
+
+// shannon entropy of data in bits per byte, from 0 for a single repeated byte to 8 for uniformly random bytes, and the share
+// of printable ascii bytes, counted in a single pass over data
+func payloadMeasures(data []byte) (entropy, printable float64) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	var counts [256]int
+	var printables int
+	for _, b := range data {
+		counts[b]++
+		if b >= 0x20 && b < 0x7f || b == '\t' || b == '\n' || b == '\r' {
+			printables++
+		}
+	}
+	n := float64(len(data))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy, float64(printables) / n
+}
+
+func (pe *payloadEntropy) observe(e PacketEvent) {
+	if pe == nil || len(e.Packet.Base.Data) == 0 {
+		return
+	}
+	entropy, printable := payloadMeasures(e.Packet.Base.Data)
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	key := intervalKey{flowName: e.FlowName, opCode: e.Packet.Base.OperationCode}
+	s, ok := pe.stats[key]
+	if !ok {
+		s = &entropyStats{
+			minEntropy:   entropy,
+			maxEntropy:   entropy,
+			minPrintable: printable,
+			maxPrintable: printable,
+		}
+		pe.stats[key] = s
+	}
+	s.payloads++
+	s.entropySum += entropy
+	s.printableSum += printable
+	s.minEntropy = math.Min(s.minEntropy, entropy)
+	s.maxEntropy = math.Max(s.maxEntropy, entropy)
+	s.minPrintable = math.Min(s.minPrintable, printable)
+	s.maxPrintable = math.Max(s.maxPrintable, printable)
+}
+
+// PayloadStats sums up the payloads of an operation code in the streams of a flow
+// Class is "likely compressed", "likely text" or "structured binary", from the average entropy and printable share
+type PayloadStats struct {
+	Payloads     int     `json:"payloads"`
+	MinEntropy   float64 `json:"minEntropy"`
+	AvgEntropy   float64 `json:"avgEntropy"`
+	MaxEntropy   float64 `json:"maxEntropy"`
+	MinPrintable float64 `json:"minPrintable"`
+	AvgPrintable float64 `json:"avgPrintable"`
+	MaxPrintable float64 `json:"maxPrintable"`
+	Class        string  `json:"class"`
+}
+
+// short payloads can't reach compressedEntropy, a payload of n bytes has at most log2(n) bits per byte,
+// so they end up as text or structured binary
+func classifyPayloads(avgEntropy, avgPrintable float64) string {
+	switch {
+	case avgEntropy >= compressedEntropy:
+		return "likely compressed"
+	case avgPrintable >= textPrintable:
+		return "likely text"
+	default:
+		return "structured binary"
+	}
+}
+
+func (s *entropyStats) summary() *PayloadStats {
+	n := float64(s.payloads)
+	ps := &PayloadStats{
+		Payloads:     s.payloads,
+		MinEntropy:   s.minEntropy,
+		AvgEntropy:   s.entropySum / n,
+		MaxEntropy:   s.maxEntropy,
+		MinPrintable: s.minPrintable,
+		AvgPrintable: s.printableSum / n,
+		MaxPrintable: s.maxPrintable,
+	}
+	ps.Class = classifyPayloads(ps.AvgEntropy, ps.AvgPrintable)
+	return ps
+}
+
+func (pe *payloadEntropy) summarize(flows []FlowSummary) {
+	if pe == nil {
+		return
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for i := range flows {
+		for j := range flows[i].OpCodes {
+			oc := &flows[i].OpCodes[j]
+			if s, ok := pe.stats[intervalKey{flowName: flows[i].FlowName, opCode: oc.OperationCode}]; ok {
+				oc.Payload = s.summary()
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"bytes"
+	"github.com/shine-o/shine.engine.core/networking"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestPayloadMeasures(t *testing.T) {
+	random := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(random)
+	every := make([]byte, 256)
+	for i := range every {
+		every[i] = byte(i)
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		entropy    float64
+		printable  float64
+		precision  float64
+		minEntropy float64
+	}{
+		{name: "empty", data: nil, entropy: 0, printable: 0},
+		{name: "zeros", data: make([]byte, 1024), entropy: 0, printable: 0},
+		{name: "one printable byte repeated", data: bytes.Repeat([]byte("a"), 64), entropy: 0, printable: 1},
+		{name: "two bytes", data: bytes.Repeat([]byte{0, 1}, 512), entropy: 1, printable: 0},
+		{name: "four bytes", data: bytes.Repeat([]byte("abcd"), 100), entropy: 2, printable: 1},
+		{name: "every byte once", data: every, entropy: 8, printable: 98.0 / 256},
+		{name: "ascii", data: []byte("Tarian\tsays hello\r\n"), printable: 1, minEntropy: 3},
+		{name: "half printable", data: []byte{'a', 0, 'b', 0xff}, entropy: 2, printable: 0.5},
+		{name: "random", data: random, printable: 98.0 / 256, precision: 0.01, minEntropy: 7.99},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entropy, printable := payloadMeasures(tt.data)
+			precision := tt.precision
+			if precision == 0 {
+				precision = 1e-9
+			}
+			if tt.minEntropy > 0 {
+				if entropy < tt.minEntropy || entropy > 8 {
+					t.Errorf("entropy %v, expected between %v and 8", entropy, tt.minEntropy)
+				}
+			} else if math.Abs(entropy-tt.entropy) > 1e-9 {
+				t.Errorf("entropy %v, expected %v", entropy, tt.entropy)
+			}
+			if math.Abs(printable-tt.printable) > precision {
+				t.Errorf("printable %v, expected %v", printable, tt.printable)
+			}
+		})
+	}
+}
+
+func TestClassifyPayloads(t *testing.T) {
+	tests := []struct {
+		entropy, printable float64
+		class              string
+	}{
+		{8, 0, "likely compressed"},
+		{compressedEntropy, 0, "likely compressed"},
+		// compressed wins over text, text compresses to high entropy only when it isn't text anymore
+		{compressedEntropy, 1, "likely compressed"},
+		{compressedEntropy - 0.01, textPrintable, "likely text"},
+		{4, 1, "likely text"},
+		{4, textPrintable - 0.01, "structured binary"},
+		{0, 0, "structured binary"},
+		{6.99, 0.5, "structured binary"},
+	}
+	for _, tt := range tests {
+		if class := classifyPayloads(tt.entropy, tt.printable); class != tt.class {
+			t.Errorf("entropy %v and printable %v classified as %q, expected %q", tt.entropy, tt.printable, class, tt.class)
+		}
+	}
+}
+
+// the payloads of an operation code are summed up per flow name, empty ones aren't counted
+func TestPayloadEntropySummary(t *testing.T) {
+	if newPayloadEntropy(false) != nil {
+		t.Error("output.entropy: false keeps payload stats")
+	}
+	var disabled *payloadEntropy
+	disabled.observe(PacketEvent{})
+	disabled.summarize(nil)
+
+	pe := newPayloadEntropy(true)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	packet := func(flowName string, opCode uint16, data []byte) PacketEvent {
+		return PacketEvent{
+			FlowName: flowName,
+			Packet: &networking.Command{
+				Base: networking.CommandBase{OperationCode: opCode, Data: data},
+			},
+		}
+	}
+	pe.observe(packet("zone-client", 1, make([]byte, 64)))
+	pe.observe(packet("zone-client", 1, bytes.Repeat([]byte{0, 1}, 32)))
+	pe.observe(packet("zone-client", 1, nil))
+	pe.observe(packet("zone-client", 2, random))
+	pe.observe(packet("zone-client", 3, []byte("/chat hello everyone")))
+	pe.observe(packet("login-client", 1, random))
+
+	flows := []FlowSummary{
+		{FlowName: "zone-client", OpCodes: []OpCodeCount{{OperationCode: 1}, {OperationCode: 2}, {OperationCode: 3}, {OperationCode: 4}}},
+		{FlowName: "login-client", OpCodes: []OpCodeCount{{OperationCode: 1}}},
+	}
+	pe.summarize(flows)
+
+	zeros := flows[0].OpCodes[0].Payload
+	if zeros == nil {
+		t.Fatal("no payload stats for operation code 1")
+	}
+	if zeros.Payloads != 2 || zeros.MinEntropy != 0 || zeros.MaxEntropy != 1 || zeros.AvgEntropy != 0.5 || zeros.MaxPrintable != 0 {
+		t.Errorf("operation code 1 summed up as %+v", *zeros)
+	}
+	if zeros.Class != "structured binary" {
+		t.Errorf("operation code 1 classified as %q", zeros.Class)
+	}
+	if c := flows[0].OpCodes[1].Payload; c == nil || c.Class != "likely compressed" {
+		t.Errorf("random payloads summed up as %+v", c)
+	}
+	if c := flows[0].OpCodes[2].Payload; c == nil || c.Class != "likely text" || c.AvgPrintable != 1 {
+		t.Errorf("text payloads summed up as %+v", c)
+	}
+	if flows[0].OpCodes[3].Payload != nil {
+		t.Error("payload stats for an operation code that wasn't seen")
+	}
+	// the same operation code of another flow name is summed up apart
+	if c := flows[1].OpCodes[0].Payload; c == nil || c.Payloads != 1 || c.Class != "likely compressed" {
+		t.Errorf("operation code 1 of login-client summed up as %+v", c)
+	}
+}
+
+// payloads sampled out are classified too, the stats are of every packet like the other ones
+func TestPayloadEntropyBeforeSampling(t *testing.T) {
+	c := testConfig()
+	c.Entropy = true
+	c.Sampling = map[string]float64{strconv.Itoa(int(opChatReq)): 0}
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &shineStream{sniffer: sn, flowName: "zone-client"}
+	ss.handlePacket(PacketEvent{
+		FlowName: "zone-client",
+		Packet:   &networking.Command{Base: networking.CommandBase{OperationCode: opChatReq, Data: []byte("/chat hello")}},
+	})
+
+	flows := []FlowSummary{{FlowName: "zone-client", OpCodes: []OpCodeCount{{OperationCode: opChatReq}}}}
+	sn.entropy.summarize(flows)
+	if p := flows[0].OpCodes[0].Payload; p == nil || p.Payloads != 1 {
+		t.Errorf("a sampled out payload summed up as %+v", p)
+	}
+}
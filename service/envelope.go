@@ -0,0 +1,123 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// version of the websocket envelopes, clients ask for it with /packets?v=1 and every message in both directions carries it
+// a client asking for a version the server doesn't speak gets an error message with the ones it does and is disconnected
+const wsVersion = 1
+
+// types of the messages the server sends
+const (
+	// first message of every connection, with the version in use
+	wsHello = "hello"
+	// data is a PacketView
+	wsPacket = "packet"
+	// data is a datagramView, a datagram of a protocol.udpServices flow
+	wsDatagram = "datagram"
+	// data is a flowEvent, sent to every connection regardless of subscriptions
+	wsFlowOpen  = "flow_open"
+	wsFlowClose = "flow_close"
+	// data is a captureDrops
+	wsStats = "stats"
+	// data is a captureEvent, sent by the server, or a captureAction, sent by clients
+	wsCapture = "capture"
+	// data is a zoneDiscovered
+	wsZone = "zone"
+	// data is a protocolEvent, the client version of a flow was read
+	wsProtocol = "protocol"
+	// data is an alertEvent, a rule of alerts.rules fired
+	wsAlert = "alert"
+	// data is a wsError, e.g answering a message the server didn't understand
+	wsError = "error"
+)
+
+// types of the messages clients send, besides wsCapture
+const (
+	// data is a subscription
+	wsSubscribe = "subscribe"
+)
+
+// wsEnvelope wraps every websocket message, e.g {"v": 1, "type": "packet", "data": {...}}
+type wsEnvelope struct {
+	V    int             `json:"v"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type wsHelloData struct {
+	Version int `json:"version"`
+}
+
+type wsErrorData struct {
+	Message string `json:"message"`
+	// the versions the server speaks, if the client asked for another one
+	Versions []int `json:"versions,omitempty"`
+}
+
+// subscription only forwards the packets of these flow names, an empty list forwards every flow again
+type subscription struct {
+	Flows []string `json:"flows"`
+}
+
+// captureAction pauses or resumes forwarding
+type captureAction struct {
+	Action string `json:"action"`
+}
+
+// captureEvent tells clients forwarding was paused or resumed, or that the capture stopped
+// resuming carries the packets that were suppressed
+type captureEvent struct {
+	State      string `json:"state"`
+	Suppressed uint64 `json:"suppressed,omitempty"`
+}
+
+// a message of type t with data
+func newEnvelope(t string, data interface{}) ([]byte, error) {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(wsEnvelope{
+		V:    wsVersion,
+		Type: t,
+		Data: d,
+	})
+}
+
+// same as newEnvelope, errors are logged
+func envelope(t string, data interface{}) []byte {
+	b, err := newEnvelope(t, data)
+	if err != nil {
+		log.Error(err)
+	}
+	return b
+}
+
+// read a message a client sent, its version must be wsVersion
+func parseEnvelope(message []byte) (wsEnvelope, error) {
+	var e wsEnvelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		return e, err
+	}
+	if e.V != wsVersion {
+		return e, fmt.Errorf("version %v isn't supported, only %v is", e.V, wsVersion)
+	}
+	if e.Type == "" {
+		return e, fmt.Errorf("the message has no type")
+	}
+	return e, nil
+}
+
+// unmarshal the data of e into v, a message without data leaves v as it is
+func (e wsEnvelope) decode(v interface{}) error {
+	if len(e.Data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return fmt.Errorf("%v data: %v", e.Type, err)
+	}
+	return nil
+}
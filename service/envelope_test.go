@@ -0,0 +1,98 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// every message type the ui reads goes through json and back unchanged, in an envelope with exactly v, type and data
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		t    string
+		data interface{}
+	}{
+		{"hello", wsHello, &wsHelloData{Version: wsVersion}},
+		{"packet", wsPacket, &PacketView{PacketID: "1-2", Seq: 3, FlowName: "login-client", Direction: "outbound", PayloadLength: 2, Truncated: true, SHA1: "ab"}},
+		{"flow open", wsFlowOpen, &flowEvent{FlowID: "1", FlowName: "login-client", Transport: "tcp", Src: testClientAddr, Dst: testServerAddr}},
+		{"flow close", wsFlowClose, &flowEvent{FlowID: "1", FlowName: "login-client", Transport: "tcp", Summary: &flowClosedSummary{Duration: 1.5, Packets: 4, Bytes: 20, Truncated: map[string]int{"inbound": 3}}}},
+		{"stats", wsStats, &captureDrops{Dropped: 5, IfDropped: 2}},
+		{"capture event", wsCapture, &captureEvent{State: "resumed", Suppressed: 12}},
+		{"capture action", wsCapture, &captureAction{Action: "pause"}},
+		{"subscribe", wsSubscribe, &subscription{Flows: []string{"zone00-client"}}},
+		{"error", wsError, &wsErrorData{Message: "version \"2\" isn't supported", Versions: []int{wsVersion}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newEnvelope(tt.t, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(b, &fields); err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for k := range fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != "data,type,v" {
+				t.Errorf("the envelope %s has the fields %v", b, keys)
+			}
+
+			e, err := parseEnvelope(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.V != wsVersion || e.Type != tt.t {
+				t.Errorf("version %v and type %q, expected %v and %q", e.V, e.Type, wsVersion, tt.t)
+			}
+			got := reflect.New(reflect.TypeOf(tt.data).Elem()).Interface()
+			if err := e.decode(got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.data) {
+				t.Errorf("decoded to %+v, expected %+v", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		err     string
+	}{
+		{"subscribe", `{"v": 1, "type": "subscribe", "data": {"flows": []}}`, ""},
+		{"no data", `{"v": 1, "type": "subscribe"}`, ""},
+		{"other version", `{"v": 2, "type": "subscribe"}`, "version 2 isn't supported"},
+		{"no version", `{"type": "subscribe"}`, "version 0 isn't supported"},
+		{"no type", `{"v": 1}`, "no type"},
+		{"not json", `subscribe`, "invalid character"},
+	}
+	for _, tt := range tests {
+		_, err := parseEnvelope([]byte(tt.message))
+		if (err != nil) != (tt.err != "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: error %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+
+	// data of the wrong shape is an error naming the type, a message without data leaves the value as it is
+	e, err := parseEnvelope([]byte(`{"v": 1, "type": "subscribe", "data": {"flows": "zone00-client"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s subscription
+	if err := e.decode(&s); err == nil || !strings.HasPrefix(err.Error(), "subscribe data:") {
+		t.Errorf("decoding data of the wrong shape: %v", err)
+	}
+	s = subscription{Flows: []string{"login-client"}}
+	if err := (wsEnvelope{V: wsVersion, Type: wsSubscribe}).decode(&s); err != nil || len(s.Flows) != 1 {
+		t.Errorf("decoding no data: %v, %+v", err, s)
+	}
+}
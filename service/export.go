@@ -0,0 +1,326 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/shine-o/shine.engine.core/networking"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a flow as shown in the report, packets past the cap are only counted
+type reportFlow struct {
+	FlowID    string
+	FlowName  string
+	Src, Dst  string
+	Total     int
+	Packets   []reportPacket
+	FirstSeen time.Time
+	stats     flowStats
+}
+
+type reportPacket struct {
+	Seen          time.Time
+	Direction     string
+	OperationCode uint16
+	Command       string
+	Length        int
+	HexDump       []HexDumpRow
+}
+
+type report struct {
+	Source    string
+	Generated time.Time
+	Summary   []FlowSummary
+	Flows     []*reportFlow
+}
+
+func (rf *reportFlow) add(seen time.Time, direction string, opCode uint16, command string, data []byte, max int) {
+	if rf.Total == 0 || seen.Before(rf.FirstSeen) {
+		rf.FirstSeen = seen
+	}
+	rf.Total++
+	rf.stats.segmentReceived(seen, len(data))
+	rf.stats.packetDecoded(decodedPacket{
+		seen:      seen,
+		direction: direction,
+		packet: &networking.Command{
+			Base: networking.CommandBase{
+				OperationCode: opCode,
+				Data:          data,
+			},
+		},
+	})
+	if max > 0 && len(rf.Packets) >= max {
+		return
+	}
+	rf.Packets = append(rf.Packets, reportPacket{
+		Seen:          seen,
+		Direction:     direction,
+		OperationCode: opCode,
+		Command:       command,
+		Length:        len(data),
+		HexDump:       hexDump(data),
+	})
+}
+
+// Export renders the json output of a session directory, or the sqlite database, into a single html file that can be opened offline
+func Export(cmd *cobra.Command, args []string) {
+	session, err := cmd.Flags().GetString("session")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := cmd.Flags().GetString("db")
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := cmd.Flags().GetString("out")
+	if err != nil {
+		log.Fatal(err)
+	}
+	max, err := cmd.Flags().GetInt("max-packets-per-flow")
+	if err != nil {
+		log.Fatal(err)
+	}
+	anonymize, err := cmd.Flags().GetBool("anonymize")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if (session == "") == (db == "") {
+		log.Fatal("either --session or --db is needed, e.g --session output/2020-05-01T12-30-00")
+	}
+
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := loadProtocol(c.CommandsFile, c.SchemaFile)
+
+	var (
+		flows  []*reportFlow
+		source string
+	)
+	if session != "" {
+		flows, err = sessionFlows(p, session, max)
+		source = session
+		if out == "" {
+			out = filepath.Join(session, "report.html")
+		}
+	} else {
+		flows, err = databaseFlows(p, db, max)
+		source = db
+		if out == "" {
+			out = "report.html"
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if anonymize || viper.GetBool("output.anonymize.enabled") {
+		// same pseudonyms as the capture, addresses it already replaced are left as they are
+		a, err := loadAnonymizer(viper.GetString("output.anonymize.mapping"), viper.GetString("output.anonymize.key"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, rf := range flows {
+			rf.Src, rf.Dst = a.address(rf.Src), a.address(rf.Dst)
+		}
+	}
+
+	summaries := make(map[string]*FlowSummary)
+	for _, rf := range flows {
+		mergeStats(summaries, rf.FlowName, &rf.stats)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].FirstSeen.Before(flows[j].FirstSeen)
+	})
+
+	f, err := os.Create(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	err = exportTemplate.Execute(f, report{
+		Source:    source,
+		Generated: time.Now(),
+		Summary:   p.summarize(summaries),
+		Flows:     flows,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("report with %v flows written to %v\n", len(flows), out)
+}
+
+// flows written with protocol.log.jsonOutput, one <flowName>-<flowID>.jsonl file each
+// the files are the ones the manifest of the session lists, sessions without one are searched for *.jsonl
+func sessionFlows(p *protocol, dir string, max int) ([]*reportFlow, error) {
+	files, ok, err := sessionArtifacts(dir, artifactJSONL)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if files, err = filepath.Glob(filepath.Join(dir, "*.jsonl")); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no flow output in %v, was protocol.log.jsonOutput enabled?", dir)
+	}
+
+	var flows []*reportFlow
+	for _, file := range files {
+		rf := &reportFlow{}
+		rf.FlowName, rf.FlowID = flowFileName(file, ".jsonl")
+
+		records, err := readFlowRecords(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			data, err := hex.DecodeString(r.Data)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", file, err)
+			}
+			rf.add(r.Seen, r.Direction, r.OperationCode, p.commandName(r.OperationCode), data, max)
+		}
+		flows = append(flows, rf)
+	}
+	return flows, nil
+}
+
+// flow name and id of a <flowName>-<flowID><suffix> file, the id is empty if the name doesn't end with one
+func flowFileName(path, suffix string) (flowName, flowID string) {
+	name := strings.TrimSuffix(filepath.Base(path), suffix)
+	// flow ids are uuids, 36 characters after the last dash of the flow name
+	if len(name) > 37 && name[len(name)-37] == '-' {
+		return name[:len(name)-37], name[len(name)-36:]
+	}
+	return name, ""
+}
+
+// flows stored with output.sqlite.path
+func databaseFlows(p *protocol, path string, max int) ([]*reportFlow, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT flow_id, flow_name, src, dst FROM flows")
+	if err != nil {
+		return nil, err
+	}
+	flows := make(map[string]*reportFlow)
+	for rows.Next() {
+		rf := &reportFlow{}
+		if err := rows.Scan(&rf.FlowID, &rf.FlowName, &rf.Src, &rf.Dst); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		flows[rf.FlowID] = rf
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT flow_id, flow_name, direction, timestamp, opcode, payload FROM packets ORDER BY flow_id, timestamp")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			flowID, flowName, direction string
+			ts                          int64
+			opCode                      uint16
+			payload                     []byte
+		)
+		if err := rows.Scan(&flowID, &flowName, &direction, &ts, &opCode, &payload); err != nil {
+			return nil, err
+		}
+		rf, ok := flows[flowID]
+		if !ok {
+			rf = &reportFlow{FlowID: flowID, FlowName: flowName}
+			flows[flowID] = rf
+		}
+		rf.add(time.Unix(0, ts), direction, opCode, p.commandName(opCode), payload, max)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*reportFlow, 0, len(flows))
+	for _, rf := range flows {
+		list = append(list, rf)
+	}
+	return list, nil
+}
+
+var exportTemplate = template.Must(template.New("").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Shine packet sniffer report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { padding: 2px 8px; text-align: left; vertical-align: top; }
+tr:nth-child(even) { background: #f4f4f4; }
+pre { margin: 0; }
+.inbound { color: #1a5fb4; }
+.outbound { color: #a51d2d; }
+</style>
+</head>
+<body>
+<h1>Capture report</h1>
+<p>{{.Source}}, generated {{.Generated.Format "2006-01-02 15:04:05"}}</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Flow</th><th>Streams</th><th>Packets</th><th>Bytes</th><th>Duration</th><th>Packets/s</th><th>Top command</th></tr>
+{{range .Summary}}
+<tr>
+<td>{{.FlowName}}</td><td>{{.Streams}}</td><td>{{.Packets}}</td><td>{{.Bytes}}</td>
+<td>{{printf "%.1f" .Duration}}s</td><td>{{printf "%.2f" .PacketRate}}</td>
+<td>{{if .OpCodes}}{{with index .OpCodes 0}}{{.Command}} ({{.Count}}){{end}}{{else}}-{{end}}</td>
+</tr>
+{{end}}
+</table>
+
+<h2>Flows</h2>
+<ul>
+{{range $i, $f := .Flows}}
+<li><a href="#flow{{$i}}">{{$f.FlowName}}</a> {{$f.Src}} {{$f.Dst}} {{$f.FirstSeen.Format "15:04:05"}}, {{$f.Total}} packets</li>
+{{end}}
+</ul>
+
+{{range $i, $f := .Flows}}
+<h3 id="flow{{$i}}">{{$f.FlowName}} {{$f.FlowID}}</h3>
+{{if lt (len $f.Packets) $f.Total}}<p>showing the first {{len $f.Packets}} of {{$f.Total}} packets</p>{{end}}
+<table>
+<tr><th>Time</th><th>Direction</th><th>Opcode</th><th>Command</th><th>Length</th></tr>
+{{range $f.Packets}}
+<tr class="{{.Direction}}">
+<td>{{.Seen.Format "15:04:05.000000"}}</td><td>{{.Direction}}</td><td>{{.OperationCode}}</td>
+<td>{{if .HexDump}}<details><summary>{{.Command}}</summary><pre>{{range .HexDump}}{{printf "%04x" .Offset}}  {{.Hex}}  {{.ASCII}}
+{{end}}</pre></details>{{else}}{{.Command}}{{end}}</td>
+<td>{{.Length}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
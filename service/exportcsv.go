@@ -0,0 +1,207 @@
+package service
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rows of GET /api/export.csv unless full=1 or limit says otherwise
+const defaultExportLimit = 100000
+
+// rows written between two flushes of the response, each flush sends a chunk
+const exportFlushRows = 500
+
+// trailer set once every row is written, true if the limit cut the export
+const exportTruncatedTrailer = "X-Export-Truncated"
+
+// columns of GET /api/export.csv
+var exportCSVHeader = []string{"timestamp", "flow", "direction", "opcode", "name", "length", "payload", "packet_id", "seq"}
+
+// timestamps in UTC in a format spreadsheets read as a date, RFC 3339 isn't
+const exportTimeFormat = "2006-01-02 15:04:05.000000"
+
+// csvExport is a packetSearch with the limits of an export
+type csvExport struct {
+	search packetSearch
+	// hex of the first payloadBytes of every payload, 0 writes whole payloads
+	payloadBytes int
+}
+
+// flow, opcode, direction, from and to filter the rows as the same filters of GET /api/search do, from and to are RFC 3339
+// limit caps the rows, full=1 lifts the cap, payloadBytes caps the hex of each payload, output.maxPayloadBytes by default
+func parseCSVExport(p *protocol, r *http.Request, maxPayload int) (csvExport, error) {
+	q := r.URL.Query()
+	e := csvExport{
+		search: packetSearch{
+			flowName:  q.Get("flow"),
+			direction: q.Get("direction"),
+			limit:     defaultExportLimit,
+		},
+		payloadBytes: maxPayload,
+	}
+	s := &e.search
+
+	if v := q.Get("opcode"); v != "" {
+		o, err := p.parseOpCode(v)
+		if err != nil {
+			return e, fmt.Errorf("opcode: %v", err)
+		}
+		s.opCode, s.hasOpCode = o, true
+	}
+
+	if s.direction != "" && s.direction != "inbound" && s.direction != "outbound" {
+		return e, fmt.Errorf("direction: must be inbound or outbound")
+	}
+
+	for name, t := range map[string]*time.Time{"from": &s.since, "to": &s.until} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return e, fmt.Errorf("%v: %v", name, err)
+		}
+		*t = parsed
+	}
+	if !s.since.IsZero() && !s.until.IsZero() && s.until.Before(s.since) {
+		return e, fmt.Errorf("to: must not be before from")
+	}
+
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			return e, fmt.Errorf("limit: must be a positive number")
+		}
+		s.limit = l
+	}
+	switch q.Get("full") {
+	case "":
+	case "1":
+		s.limit = 0
+	default:
+		return e, fmt.Errorf("full: must be 1")
+	}
+
+	if v := q.Get("payloadBytes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return e, fmt.Errorf("payloadBytes: must be 0 or a positive number")
+		}
+		e.payloadBytes = n
+	}
+	return e, nil
+}
+
+func (e csvExport) row(p storedPacket) []string {
+	payload, _ := truncatePayload(p.Payload, e.payloadBytes)
+	return []string{
+		p.Seen.UTC().Format(exportTimeFormat),
+		p.FlowName,
+		p.Direction,
+		strconv.Itoa(int(p.OpCode)),
+		p.Command,
+		strconv.Itoa(p.Length),
+		hex.EncodeToString(payload),
+		p.PacketID,
+		strconv.FormatUint(p.Seq, 10),
+	}
+}
+
+// GET /api/export.csv?flow=zone00-client&opcode=3087&from=2020-05-01T12:30:00Z&to=...&full=1
+// streams the matching packets as csv, from the sqlite database if there is one, the packet history otherwise
+// the response is sent in chunks as the rows are read, so an export is never held in memory as a whole
+func (sn *Sniffer) exportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e, err := parseCSVExport(sn.protocol, r, sn.config.MaxPayloadBytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	switch source {
+	case "":
+		source = "history"
+		if sn.store != nil {
+			source = "sqlite"
+		}
+	case "history", "sqlite":
+	default:
+		http.Error(w, "source: must be history or sqlite", http.StatusBadRequest)
+		return
+	}
+	if source == "sqlite" && sn.store == nil {
+		http.Error(w, "no sqlite database, set output.sqlite.path", http.StatusBadRequest)
+		return
+	}
+	if source == "history" && sn.config.HistorySize == 0 {
+		http.Error(w, "no packet history, set ui.historySize", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="packets.csv"`)
+	w.Header().Set("Trailer", exportTruncatedTrailer)
+	flusher, _ := w.(http.Flusher)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportCSVHeader); err != nil {
+		return
+	}
+
+	var (
+		rows      int
+		truncated bool
+		writeErr  error
+	)
+	visit := func(p storedPacket) bool {
+		if e.search.limit > 0 && rows == e.search.limit {
+			truncated = true
+			return false
+		}
+		if writeErr = cw.Write(e.row(p)); writeErr != nil {
+			return false
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			cw.Flush()
+			if writeErr = cw.Error(); writeErr != nil {
+				// the client went away
+				return false
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return true
+	}
+
+	if source == "sqlite" {
+		err = eachDatabasePacket(sn.protocol, sn.store.db, e.search, visit)
+	} else {
+		sn.eachHistoryPacket(e.search, visit)
+	}
+	cw.Flush()
+	if err != nil {
+		// the status is already sent, the export ends early and the trailer is left out
+		log.Errorf("csv export stopped after %v rows: %v", rows, err)
+		return
+	}
+	if writeErr == nil {
+		writeErr = cw.Error()
+	}
+	if writeErr != nil {
+		log.Warningf("csv export stopped after %v rows: %v", rows, writeErr)
+		return
+	}
+	w.Header().Set(exportTruncatedTrailer, strconv.FormatBool(truncated))
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/shine-o/shine.engine.core/networking"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the start of the packets of the export tests, one packet every second after it
+var exportStart = time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+
+// a flow name csv has to quote
+const exportQuotedFlow = `zone,"00"-client`
+
+// n packets alternating between the flows, directions and operation codes the filters pick
+func exportPackets(n int) []PacketEvent {
+	p := loadProtocol(testConfig().CommandsFile, "")
+	var packets []PacketEvent
+	for i := 0; i < n; i++ {
+		flowName, direction, opCode := "login-client", "outbound", opLoginReq
+		if i%2 == 1 {
+			flowName, direction, opCode = exportQuotedFlow, "inbound", opLoginAck
+		}
+		if i%3 == 2 {
+			opCode = opChatReq
+		}
+		packets = append(packets, PacketEvent{
+			ID:        fmt.Sprintf("flow-%v-c%v", i%2, i),
+			Seq:       uint64(i + 1),
+			FlowID:    fmt.Sprintf("flow-%v", i%2),
+			FlowName:  flowName,
+			Direction: direction,
+			Seen:      exportStart.Add(time.Duration(i) * time.Second),
+			Packet: &networking.Command{
+				Base: networking.CommandBase{
+					OperationCode:    opCode,
+					ClientStructName: p.commandName(opCode),
+					// a comma, a quote and a line break, hex in the csv
+					Data: []byte(fmt.Sprintf("%v,\"\n", i)),
+				},
+			},
+		})
+	}
+	return packets
+}
+
+// a sniffer with packets in its history, or in its sqlite database if source is sqlite
+func exportSniffer(t *testing.T, source string, packets []PacketEvent) *Sniffer {
+	t.Helper()
+	c := testConfig()
+	c.HistorySize = len(packets)
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source == "history" {
+		ss := sessionStream("export", "192.168.1.20")
+		ss.history = newPacketHistory(len(packets))
+		for _, pe := range packets {
+			ss.history.add(pe)
+		}
+		sn.streams.add(ss)
+		return sn
+	}
+
+	db, err := openDatabase(filepath.Join(t.TempDir(), "packets.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	sn.store = &packetStore{db: db}
+	var rows []sqliteRow
+	for _, pe := range packets {
+		rows = append(rows, packetRow(pe))
+	}
+	sn.store.write(rows)
+	return sn
+}
+
+// the rows of GET /api/export.csv?query, without the header, and its truncated trailer
+func exportCSV(t *testing.T, sn *Sniffer, query string) ([][]string, string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(sn.exportCSVHandler))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/api/export.csv?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("status %v: %s", res.StatusCode, b)
+	}
+	records, err := csv.NewReader(res.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || !reflect.DeepEqual(records[0], exportCSVHeader) {
+		t.Fatalf("the export starts with %v, expected the header", records)
+	}
+	return records[1:], res.Trailer.Get(exportTruncatedTrailer)
+}
+
+// the rows of GET /api/export.csv are the packets the filters match, in both sources
+func TestExportCSVFilters(t *testing.T) {
+	packets := exportPackets(12)
+	at := func(i int) string {
+		return exportStart.Add(time.Duration(i) * time.Second).Format(time.RFC3339)
+	}
+	tests := []struct {
+		name  string
+		query string
+		// the indexes of the expected packets
+		packets []int
+	}{
+		{"everything", "", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{"flow", "flow=login-client", []int{0, 2, 4, 6, 8, 10}},
+		{"quoted flow", "flow=" + strings.NewReplacer(",", "%2C", `"`, "%22").Replace(exportQuotedFlow), []int{1, 3, 5, 7, 9, 11}},
+		{"direction", "direction=inbound", []int{1, 3, 5, 7, 9, 11}},
+		{"opcode", "opcode=" + strconv.Itoa(int(opChatReq)), []int{2, 5, 8, 11}},
+		{"opcode by name", "opcode=NC_ACT_CHAT_REQ", []int{2, 5, 8, 11}},
+		{"from and to", "from=" + at(3) + "&to=" + at(6), []int{3, 4, 5, 6}},
+		{"flow and opcode", "flow=login-client&opcode=" + strconv.Itoa(int(opChatReq)), []int{2, 8}},
+		{"direction, opcode and time", "direction=inbound&opcode=" + strconv.Itoa(int(opLoginAck)) + "&from=" + at(2) + "&to=" + at(9), []int{3, 7, 9}},
+		{"flow and direction that don't meet", "flow=login-client&direction=inbound", nil},
+	}
+	for _, source := range []string{"history", "sqlite"} {
+		t.Run(source, func(t *testing.T) {
+			sn := exportSniffer(t, source, packets)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					rows, truncated := exportCSV(t, sn, tt.query+"&source="+source)
+					if truncated != "false" {
+						t.Errorf("truncated trailer %q, expected false", truncated)
+					}
+					var got []string
+					for _, row := range rows {
+						got = append(got, row[7])
+					}
+					var expected []string
+					for _, i := range tt.packets {
+						expected = append(expected, packets[i].ID)
+					}
+					if !reflect.DeepEqual(got, expected) {
+						t.Errorf("exported %v, expected %v", got, expected)
+					}
+				})
+			}
+		})
+	}
+}
+
+// flow and command names with commas, quotes and line breaks are quoted, payloads are hex
+func TestExportCSVQuoting(t *testing.T) {
+	packets := exportPackets(2)
+	packets[1].Packet.Base.ClientStructName = "NC_\"ODD\",\nNAME"
+	sn := exportSniffer(t, "history", packets)
+
+	srv := httptest.NewServer(http.HandlerFunc(sn.exportCSVHandler))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/api/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `,"zone,""00""-client",`) || !strings.Contains(string(b), `,"NC_""ODD"",`+"\n"+`NAME",`) {
+		t.Errorf("the names aren't quoted:\n%s", b)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%v records, expected the header and 2 rows", len(records))
+	}
+	row := records[2]
+	expected := []string{
+		"2020-05-01 12:30:01.000000",
+		exportQuotedFlow,
+		"inbound",
+		strconv.Itoa(int(opLoginAck)),
+		"NC_\"ODD\",\nNAME",
+		"4",
+		hex.EncodeToString([]byte("1,\"\n")),
+		"flow-1-c1",
+		"2",
+	}
+	if !reflect.DeepEqual(row, expected) {
+		t.Errorf("row %q, expected %q", row, expected)
+	}
+}
+
+// limit cuts the export and says so in the trailer, full=1 lifts it, the rows are sent in chunks as they're read
+func TestExportCSVLimit(t *testing.T) {
+	n := 3*exportFlushRows + 10
+	packets := exportPackets(n)
+	tests := []struct {
+		query     string
+		rows      int
+		truncated string
+	}{
+		{"", n, "false"},
+		{"limit=" + strconv.Itoa(n), n, "false"},
+		{"limit=10", 10, "true"},
+		{"limit=" + strconv.Itoa(exportFlushRows+1), exportFlushRows + 1, "true"},
+		{"limit=10&full=1", n, "false"},
+		{"full=1", n, "false"},
+	}
+	for _, source := range []string{"history", "sqlite"} {
+		t.Run(source, func(t *testing.T) {
+			sn := exportSniffer(t, source, packets)
+			for _, tt := range tests {
+				rows, truncated := exportCSV(t, sn, tt.query+"&source="+source)
+				if len(rows) != tt.rows || truncated != tt.truncated {
+					t.Errorf("%q exported %v rows, truncated %q, expected %v, %q", tt.query, len(rows), truncated, tt.rows, tt.truncated)
+				}
+				for i, row := range rows {
+					if row[7] != packets[i].ID {
+						t.Fatalf("%q row %v is %v, expected %v", tt.query, i, row[7], packets[i].ID)
+					}
+				}
+			}
+
+			// no length is known up front, the rows are sent in chunks and the truncated trailer after the last one
+			srv := httptest.NewServer(http.HandlerFunc(sn.exportCSVHandler))
+			defer srv.Close()
+			res, err := http.Get(srv.URL + "/api/export.csv?source=" + source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.ContentLength != -1 || !reflect.DeepEqual(res.TransferEncoding, []string{"chunked"}) {
+				t.Errorf("content length %v and transfer encoding %v, expected a chunked response", res.ContentLength, res.TransferEncoding)
+			}
+			if _, ok := res.Trailer[exportTruncatedTrailer]; !ok {
+				t.Errorf("%v isn't announced, the trailers are %v", exportTruncatedTrailer, res.Trailer)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+				t.Errorf("content type %q", ct)
+			}
+		})
+	}
+}
+
+func TestExportCSVRefused(t *testing.T) {
+	history := exportSniffer(t, "history", exportPackets(1))
+	c := testConfig()
+	c.HistorySize = 0
+	none, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		sn     *Sniffer
+		method string
+		query  string
+		status int
+	}{
+		{"post", history, http.MethodPost, "", http.StatusMethodNotAllowed},
+		{"unknown opcode", history, http.MethodGet, "opcode=NC_NOTHING", http.StatusBadRequest},
+		{"direction", history, http.MethodGet, "direction=sideways", http.StatusBadRequest},
+		{"from", history, http.MethodGet, "from=yesterday", http.StatusBadRequest},
+		{"to before from", history, http.MethodGet, "from=2020-05-01T12:30:00Z&to=2020-05-01T12:00:00Z", http.StatusBadRequest},
+		{"limit", history, http.MethodGet, "limit=0", http.StatusBadRequest},
+		{"full", history, http.MethodGet, "full=yes", http.StatusBadRequest},
+		{"payload bytes", history, http.MethodGet, "payloadBytes=-1", http.StatusBadRequest},
+		{"source", history, http.MethodGet, "source=elasticsearch", http.StatusBadRequest},
+		{"no database", history, http.MethodGet, "source=sqlite", http.StatusBadRequest},
+		{"no history", none, http.MethodGet, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.sn.exportCSVHandler(w, httptest.NewRequest(tt.method, "/api/export.csv?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %v, expected %v: %v", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net"
+	"os"
+	"strings"
+)
+
+// build the bpf filter from the configured ports, the udp service ports and, if any, the server and client addresses
+// network.customFilter replaces the generated expression entirely, network.clientIP is still enforced on the streams
+func buildFilter() (string, error) {
+	if custom := strings.TrimSpace(viper.GetString("network.customFilter")); custom != "" {
+		return custom, nil
+	}
+
+	var ports string
+	if viper.GetBool("network.portRange.useThis") {
+		startPort := viper.GetString("network.portRange.start")
+		endPort := viper.GetString("network.portRange.end")
+		portRange := fmt.Sprintf("%v-%v", startPort, endPort)
+		ports = fmt.Sprintf("tcp and portrange %v", portRange)
+	} else {
+		specificPorts := viper.GetIntSlice("network.specificPorts.ports")
+		for i, p := range specificPorts {
+			if i == 0 {
+				ports = fmt.Sprintf("tcp port %v", p)
+			} else {
+				ports += fmt.Sprintf(" or port %v", p)
+			}
+		}
+	}
+
+	udpServices, err := udpServicesFromViper(viper.GetStringMap("protocol.udpServices"))
+	if err != nil {
+		return "", err
+	}
+	if udp := udpFilter(udpServices); udp != "" {
+		ports = fmt.Sprintf("(%v) or (%v)", ports, udp)
+	}
+
+	if viper.IsSet("network.serverIPs") {
+		hosts, err := serverNets(viper.GetStringSlice("network.serverIPs"))
+		if err != nil {
+			return "", err
+		}
+		ports = fmt.Sprintf("(%v) and (%v)", hosts, ports)
+	}
+
+	clients, err := clientNets(viper.GetStringSlice("network.clientIP"))
+	if err != nil {
+		return "", err
+	}
+	if len(clients) == 0 {
+		return ports, nil
+	}
+	var hosts []string
+	for _, n := range clients {
+		hosts = append(hosts, fmt.Sprintf("net %v", n))
+	}
+	return fmt.Sprintf("(%v) and (%v)", strings.Join(hosts, " or "), ports), nil
+}
+
+// parse network.clientIP, single ips or CIDR ranges, ipv4 or ipv6, a single ip is a range of one address
+func clientNets(addresses []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, a := range addresses {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if strings.Contains(a, "/") {
+			_, n, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, fmt.Errorf("network.clientIP: bad CIDR range %q: %v", a, err)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("network.clientIP: %q is not an ip address or a CIDR range", a)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		} else {
+			ip = ip.To4()
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// true if either endpoint of a stream is in nets, or if nets is empty
+func clientAllowed(nets []*net.IPNet, network gopacket.Flow) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	for _, e := range []gopacket.Endpoint{network.Src(), network.Dst()} {
+		ip := net.IP(e.Raw())
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckFilter compiles the bpf filter for the link type of the configured interface or pcap file, without capturing anything
+// an expression given as argument is checked instead of the configured one
+func CheckFilter(cmd *cobra.Command, args []string) {
+	filter, err := buildFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) > 0 {
+		filter = strings.Join(args, " ")
+	}
+
+	snaplen := viper.GetInt("network.snaplen")
+	if snaplen <= 0 {
+		snaplen = defaultSnaplen
+	}
+
+	var handle *pcap.Handle
+	if pcapFile := viper.GetString("network.pcapFile"); pcapFile != "" {
+		handle, err = pcap.OpenOffline(pcapFile)
+	} else {
+		handle, err = pcap.OpenLive(viper.GetString("network.interface"), int32(snaplen), false, pcap.BlockForever)
+	}
+	if err != nil {
+		log.Fatal("error opening pcap handle: ", err)
+	}
+	linkType := handle.LinkType()
+	handle.Close()
+
+	if _, err := pcap.CompileBPFFilter(linkType, snaplen, filter); err != nil {
+		fmt.Printf("invalid filter %q for link type %v: %v\n", filter, linkType, err)
+		os.Exit(1)
+	}
+	fmt.Printf("filter %q is valid for link type %v\n", filter, linkType)
+}
+
+// validate the server addresses, single ips, CIDR ranges or hostnames, and join them in a bpf expression
+// "host" and "net" match ipv4 and ipv6 alike, hostnames are resolved here so every address they have is captured
+func serverNets(addresses []string) (string, error) {
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("network.serverIPs is set but has no addresses")
+	}
+
+	var nets []string
+	for _, a := range addresses {
+		a = strings.TrimSpace(a)
+		if strings.Contains(a, "/") {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return "", fmt.Errorf("network.serverIPs: bad CIDR range %q: %v", a, err)
+			}
+			nets = append(nets, fmt.Sprintf("net %v", a))
+			continue
+		}
+		if net.ParseIP(a) != nil {
+			nets = append(nets, fmt.Sprintf("host %v", a))
+			continue
+		}
+		ips, err := net.LookupIP(a)
+		if err != nil {
+			return "", fmt.Errorf("network.serverIPs: %q is not an ip address and can't be resolved: %v", a, err)
+		}
+		for _, ip := range ips {
+			nets = append(nets, fmt.Sprintf("host %v", ip))
+		}
+	}
+	return strings.Join(nets, " or "), nil
+}
+
+// opCodeFilter is built from protocol.filters.include and protocol.filters.exclude
+// if include has any entries only those operation codes pass, otherwise everything but the excluded ones
+// packets whose operation codes don't pass it are not handed to the Sniffer's Handler
+type opCodeFilter struct {
+	include map[uint16]bool
+	exclude map[uint16]bool
+}
+
+func (f *opCodeFilter) allows(opCode uint16) bool {
+	if len(f.include) > 0 {
+		return f.include[opCode]
+	}
+	return !f.exclude[opCode]
+}
+
+// entries can be operation codes (2055, 0x807) or command names (NC_MISC_SEED_ACK)
+func newOpCodeFilter(p *protocol, includeEntries, excludeEntries []string) (*opCodeFilter, error) {
+	include, err := p.opCodeSet(includeEntries)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.filters.include: %v", err)
+	}
+	exclude, err := p.opCodeSet(excludeEntries)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.filters.exclude: %v", err)
+	}
+	return &opCodeFilter{
+		include: include,
+		exclude: exclude,
+	}, nil
+}
+
+func (p *protocol) opCodeSet(entries []string) (map[uint16]bool, error) {
+	set := make(map[uint16]bool)
+	for _, e := range entries {
+		opCode, err := p.parseOpCode(e)
+		if err != nil {
+			return nil, err
+		}
+		set[opCode] = true
+	}
+	return set, nil
+}
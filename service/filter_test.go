@@ -0,0 +1,173 @@
+package service
+
+import (
+	"github.com/spf13/viper"
+	"testing"
+)
+
+func TestOpCodeFilter(t *testing.T) {
+	p := testProtocol(t)
+	tests := []struct {
+		name             string
+		include, exclude []string
+		allowed, denied  []uint16
+	}{
+		{"no entries", nil, nil, []uint16{opSeedAck, opLoginReq}, nil},
+		{"include decimal", []string{"2055"}, nil, []uint16{opSeedAck}, []uint16{opLoginReq}},
+		{"include hex and name", []string{"0x807", "nc_user_login_ack"}, nil, []uint16{opSeedAck, opLoginAck}, []uint16{opLoginReq}},
+		{"exclude name", nil, []string{"NC_MISC_SEED_ACK"}, []uint16{opLoginReq}, []uint16{opSeedAck}},
+		{"include wins over exclude", []string{"2055"}, []string{"3162"}, []uint16{opSeedAck}, []uint16{opLoginReq, opLoginAck}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newOpCodeFilter(p, tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, opCode := range tt.allowed {
+				if !f.allows(opCode) {
+					t.Errorf("%v should pass", opCode)
+				}
+			}
+			for _, opCode := range tt.denied {
+				if f.allows(opCode) {
+					t.Errorf("%v shouldn't pass", opCode)
+				}
+			}
+		})
+	}
+}
+
+func TestOpCodeFilterErrors(t *testing.T) {
+	p := testProtocol(t)
+	if _, err := newOpCodeFilter(p, []string{"NC_NOT_A_COMMAND"}, nil); err == nil {
+		t.Error("an unknown include entry was accepted")
+	}
+	if _, err := newOpCodeFilter(p, nil, []string{"70000"}); err == nil {
+		t.Error("an exclude entry past 16 bits was accepted")
+	}
+}
+
+// filtered packets are still decoded, only the Handler doesn't get them, the seed still reaches the client decoder
+func TestFilteredSeedStillDecodes(t *testing.T) {
+	c := testConfig()
+	c.Exclude = []string{"NC_MISC_SEED_ACK"}
+
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sink := runPipeline(t, c, ms)
+	events := sink.byDirection()
+	if got := payloadsOf(events, opSeedAck); len(got) != 0 {
+		t.Errorf("%v excluded seed packets handled", len(got))
+	}
+	if got := payloadsOf(events, opLoginReq); len(got) != 1 {
+		t.Errorf("%v login requests handled, expected 1", len(got))
+	}
+}
+
+func TestBuildFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		filter   string
+		fails    bool
+	}{
+		{
+			name:     "port range",
+			settings: map[string]interface{}{"network.portRange.useThis": true, "network.portRange.start": 9000, "network.portRange.end": 9600},
+			filter:   "tcp and portrange 9000-9600",
+		},
+		{
+			name:     "specific ports",
+			settings: map[string]interface{}{"network.specificPorts.ports": []int{9010, 9110}},
+			filter:   "tcp port 9010 or port 9110",
+		},
+		{
+			name: "custom filter replaces the rest",
+			settings: map[string]interface{}{
+				"network.customFilter":        " tcp port 9999 ",
+				"network.specificPorts.ports": []int{9010},
+				"network.clientIP":            []string{"192.168.1.20"},
+			},
+			filter: "tcp port 9999",
+		},
+		{
+			name:     "udp services",
+			settings: map[string]interface{}{"network.specificPorts.ports": []int{9010}, "protocol.udpServices": map[string]interface{}{"ping": 9500}},
+			filter:   "(tcp port 9010) or (udp and (port 9500))",
+		},
+		{
+			name: "clients and servers",
+			settings: map[string]interface{}{
+				"network.specificPorts.ports": []int{9010},
+				"network.serverIPs":           []string{"192.168.1.10", "10.0.0.0/8"},
+				"network.clientIP":            []string{"192.168.1.20", "fd00::/8"},
+			},
+			filter: "(net 192.168.1.20/32 or net fd00::/8) and ((host 192.168.1.10 or net 10.0.0.0/8) and (tcp port 9010))",
+		},
+		{
+			name:     "bad client",
+			settings: map[string]interface{}{"network.specificPorts.ports": []int{9010}, "network.clientIP": []string{"192.168.1"}},
+			fails:    true,
+		},
+		{
+			name:     "bad server range",
+			settings: map[string]interface{}{"network.specificPorts.ports": []int{9010}, "network.serverIPs": []string{"10.0.0.0/40"}},
+			fails:    true,
+		},
+	}
+	defer viper.Reset()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			for k, v := range tt.settings {
+				viper.Set(k, v)
+			}
+			filter, err := buildFilter()
+			if tt.fails {
+				if err == nil {
+					t.Errorf("expected an error, got %q", filter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filter != tt.filter {
+				t.Errorf("got %q, expected %q", filter, tt.filter)
+			}
+		})
+	}
+}
+
+func TestServerNets(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		filter    string
+		err       bool
+	}{
+		{"ipv4 host", []string{"192.168.1.10"}, "host 192.168.1.10", false},
+		{"ipv6 host", []string{"2001:db8::10"}, "host 2001:db8::10", false},
+		{"ipv6 range", []string{" 2001:db8::/64"}, "net 2001:db8::/64", false},
+		{"both", []string{"10.0.0.0/8", "::1"}, "net 10.0.0.0/8 or host ::1", false},
+		{"bad range", []string{"2001:db8::/129"}, "", true},
+		{"no addresses", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := serverNets(tt.addresses)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, expected one %v", err, tt.err)
+			}
+			if filter != tt.filter {
+				t.Errorf("filter %q, expected %q", filter, tt.filter)
+			}
+		})
+	}
+}
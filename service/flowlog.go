@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// flowLog writes the packet lines and the warnings of a stream to <flowName>-<flowID>.log in the session directory,
+// so chatty flows can be followed one at a time, errors still go to the main log
+// packet lines are the ones printed on the console, without colors, warnings are prefixed like the main log ones
+// the file is only created once the first line is written
+type flowLog struct {
+	session *session
+	path    string
+	verbose bool
+	f       *os.File
+	w       *bufio.Writer
+	closed  bool
+	mu      sync.Mutex
+}
+
+func newFlowLog(s *session, flowName, flowID string, verbose bool) *flowLog {
+	return &flowLog{
+		session: s,
+		path:    fmt.Sprintf("%v-%v.log", flowName, flowID),
+		verbose: verbose,
+	}
+}
+
+func (fl *flowLog) packet(pe PacketEvent) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	fl.writeLine(packetLine(pe))
+	if fl.verbose {
+		if pe.Decoded != "" {
+			fl.writeLine(pe.Decoded)
+		}
+		fl.write(hex.Dump(pe.Packet.Base.Data))
+	}
+}
+
+// returns false once the file is closed, e.g for warnings about the stream logged after its last packet
+func (fl *flowLog) warningf(format string, args ...interface{}) bool {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.closed {
+		return false
+	}
+	fl.writeLine(fmt.Sprintf("WARN : %v %v", time.Now().Format("2006/01/02 15:04:05.000000"), fl.session.anonymizer().text(fmt.Sprintf(format, args...))))
+	return true
+}
+
+// called with the lock held
+func (fl *flowLog) writeLine(s string) {
+	fl.write(s + "\n")
+}
+
+// called with the lock held, the file is created with the first line
+func (fl *flowLog) write(s string) {
+	if fl.closed {
+		return
+	}
+	if fl.f == nil {
+		pathName, err := fl.session.path(fl.path)
+		if err != nil {
+			log.Error(err)
+			fl.closed = true
+			return
+		}
+		f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Error(err)
+			fl.closed = true
+			return
+		}
+		fl.session.register(pathName, artifactFlowLog)
+		fl.f = f
+		fl.w = bufio.NewWriter(f)
+	}
+	if _, err := fl.w.WriteString(s); err != nil {
+		log.Error(err)
+	}
+}
+
+func (fl *flowLog) flush() {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.w == nil || fl.closed {
+		return
+	}
+	if err := fl.w.Flush(); err != nil {
+		log.Error(err)
+	}
+}
+
+// flush buffered lines every so often until the stream is done
+func (fl *flowLog) flushPeriodically(ctx context.Context) {
+	t := time.NewTicker(outputFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fl.flush()
+		}
+	}
+}
+
+func (fl *flowLog) close() {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.closed {
+		return
+	}
+	fl.closed = true
+	if fl.f == nil {
+		return
+	}
+	if err := fl.w.Flush(); err != nil {
+		log.Error(err)
+	}
+	if err := fl.f.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// warnings about a stream go to its log file with protocol.log.perFlowFiles, to the main log otherwise
+func (ss *shineStream) warningf(format string, args ...interface{}) {
+	if ss.flowLog != nil && ss.flowLog.warningf(format, args...) {
+		return
+	}
+	log.WarningDepth(1, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// entries a flow context keeps, the oldest are forgotten past it
+const flowContextSize = 4096
+
+// NC_BRIEFINFO_LOGINCHARACTER_CMD, a character appeared around the player: its handle, then its nul padded name
+const briefInfoLoginCharacter = 7174
+
+// NC_BRIEFINFO_BRIEFINFODELETE_CMD, the object with the handle in the first two bytes left the view
+const briefInfoDelete = 7182
+
+// length of a character name in NC_BRIEFINFO_LOGINCHARACTER_CMD
+const characterNameSize = 20
+
+// operation codes whose payload starts with the handle of the object they are about, they are annotated with its name
+var handleReferences = map[uint16]bool{
+	8211:            true, // NC_ACT_SOMEONESTOP_CMD
+	8216:            true, // NC_ACT_SOMEONEMOVEWALK_CMD
+	8218:            true, // NC_ACT_SOMEONEMOVERUN_CMD
+	briefInfoDelete: true,
+}
+
+type contextKey struct {
+	kind string
+	id   uint64
+}
+
+type contextValue struct {
+	value string
+	// when it was set, an entry of order only evicts the value it was added with
+	seq uint64
+}
+
+type contextEntry struct {
+	key contextKey
+	seq uint64
+}
+
+// flowContext is what earlier packets of a flow told about the game, e.g the names of the characters around the player by handle
+// packets are annotated with it and then recorded into it by the decoders, so in capture order whatever protocol.workers is,
+// a stream's context is dropped once the stream is done
+type flowContext struct {
+	values map[contextKey]contextValue
+	// in the order values were set, replaced and forgotten ones included, for eviction
+	order []contextEntry
+	seq   uint64
+	mu    sync.Mutex
+}
+
+func newFlowContext() *flowContext {
+	return &flowContext{
+		values: make(map[contextKey]contextValue),
+	}
+}
+
+func (fc *flowContext) set(kind string, id uint64, value string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.seq++
+	k := contextKey{kind, id}
+	fc.values[k] = contextValue{value: value, seq: fc.seq}
+	fc.order = append(fc.order, contextEntry{key: k, seq: fc.seq})
+
+	for len(fc.values) > flowContextSize {
+		e := fc.order[0]
+		fc.order = fc.order[1:]
+		if v, ok := fc.values[e.key]; ok && v.seq == e.seq {
+			delete(fc.values, e.key)
+		}
+	}
+	// entries of replaced and forgotten values pile up if nothing is evicted
+	if len(fc.order) > 2*flowContextSize {
+		live := fc.order[:0]
+		for _, e := range fc.order {
+			if v, ok := fc.values[e.key]; ok && v.seq == e.seq {
+				live = append(live, e)
+			}
+		}
+		fc.order = live
+	}
+}
+
+func (fc *flowContext) get(kind string, id uint64) (string, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	v, ok := fc.values[contextKey{kind, id}]
+	return v.value, ok
+}
+
+func (fc *flowContext) forget(kind string, id uint64) {
+	fc.mu.Lock()
+	delete(fc.values, contextKey{kind, id})
+	fc.mu.Unlock()
+}
+
+func (fc *flowContext) clear() {
+	fc.mu.Lock()
+	fc.values = make(map[contextKey]contextValue)
+	fc.order = nil
+	fc.mu.Unlock()
+}
+
+// annotate a decoded packet with what the flow knows, then learn from it, returns nil if there's nothing to add
+func (fc *flowContext) observe(dp decodedPacket) map[string]string {
+	opCode := dp.packet.Base.OperationCode
+	data := dp.packet.Base.Data
+
+	var annotations map[string]string
+	if handleReferences[opCode] && len(data) >= 2 {
+		handle := binary.LittleEndian.Uint16(data)
+		if name, ok := fc.get("character", uint64(handle)); ok {
+			annotations = map[string]string{
+				"handle":    fmt.Sprint(handle),
+				"character": name,
+			}
+		}
+	}
+
+	switch opCode {
+	case briefInfoLoginCharacter:
+		if len(data) < 2+characterNameSize {
+			break
+		}
+		name := string(bytes.TrimRight(data[2:2+characterNameSize], "\x00"))
+		fc.set("character", uint64(binary.LittleEndian.Uint16(data)), name)
+	case briefInfoDelete:
+		if len(data) >= 2 {
+			fc.forget("character", uint64(binary.LittleEndian.Uint16(data)))
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.core/networking"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFlowContext(t *testing.T) {
+	fc := newFlowContext()
+	fc.set("character", 1, "Tarian")
+	fc.set("character", 1, "Lyra")
+	fc.set("map", 1, "Roumen")
+	if v, ok := fc.get("character", 1); !ok || v != "Lyra" {
+		t.Errorf("character 1 is %q, expected the name it was set to last", v)
+	}
+	if v, ok := fc.get("map", 1); !ok || v != "Roumen" {
+		t.Errorf("kinds share their ids, map 1 is %q", v)
+	}
+	fc.forget("character", 1)
+	if _, ok := fc.get("character", 1); ok {
+		t.Error("a forgotten character is still known")
+	}
+	fc.clear()
+	if _, ok := fc.get("map", 1); ok {
+		t.Error("the context kept a value once cleared")
+	}
+}
+
+// the oldest values are forgotten past flowContextSize, replacing a value many times neither evicts others nor grows it
+func TestFlowContextBounded(t *testing.T) {
+	fc := newFlowContext()
+	for i := 0; i <= flowContextSize; i++ {
+		fc.set("character", uint64(i), "name")
+	}
+	if _, ok := fc.get("character", 0); ok {
+		t.Error("the oldest character wasn't forgotten")
+	}
+	if _, ok := fc.get("character", flowContextSize); !ok {
+		t.Error("the newest character was forgotten")
+	}
+	if len(fc.values) != flowContextSize {
+		t.Errorf("%v values, expected %v", len(fc.values), flowContextSize)
+	}
+
+	fc = newFlowContext()
+	fc.set("character", 1, "Tarian")
+	for i := 0; i < 10*flowContextSize; i++ {
+		fc.set("character", 2, "Lyra")
+	}
+	if _, ok := fc.get("character", 1); !ok {
+		t.Error("replacing a value evicted another one")
+	}
+	if len(fc.order) > 2*flowContextSize {
+		t.Errorf("%v entries kept for %v values", len(fc.order), len(fc.values))
+	}
+}
+
+func TestFlowContextObserve(t *testing.T) {
+	named := func(handle byte, name string) []byte {
+		data := make([]byte, 2+characterNameSize)
+		data[0], data[1] = handle, 0x1f
+		copy(data[2:], name)
+		return data
+	}
+	tests := []struct {
+		name        string
+		opCode      uint16
+		data        []byte
+		annotations map[string]string
+	}{
+		{"character shown", briefInfoLoginCharacter, named(0x4c, "Tarian"), nil},
+		{"too short to have a name", briefInfoLoginCharacter, []byte{0x4d, 0x1f, 'L'}, nil},
+		{"known handle", 8216, []byte{0x4c, 0x1f, 0}, map[string]string{"handle": "8012", "character": "Tarian"}},
+		{"handle never shown", 8216, []byte{0x4d, 0x1f, 0}, nil},
+		{"too short to have a handle", 8216, []byte{0x4c}, nil},
+		{"operation code without a handle", opLoginAck, []byte{0x4c, 0x1f}, nil},
+		{"character left", briefInfoDelete, []byte{0x4c, 0x1f}, map[string]string{"handle": "8012", "character": "Tarian"}},
+		{"handle of a character that left", 8211, []byte{0x4c, 0x1f}, nil},
+	}
+	fc := newFlowContext()
+	for _, tt := range tests {
+		dp := decodedPacket{packet: &networking.Command{Base: networking.CommandBase{OperationCode: tt.opCode, Data: tt.data}}}
+		if got := fc.observe(dp); !reflect.DeepEqual(got, tt.annotations) {
+			t.Errorf("%v: annotations %v, expected %v", tt.name, got, tt.annotations)
+		}
+	}
+}
+
+// the recorded zone packets get the names of the characters shown earlier in the flow, another flow doesn't know them
+func TestCharacterNames(t *testing.T) {
+	zone := "192.168.1.10:9210"
+	ms := NewMemorySource()
+	conv := newTCPConversation(ms, mustTCPAddr(t, testClientAddr), mustTCPAddr(t, zone), testStart)
+	if err := conv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	replayFixture(t, conv, readFixture(t, "briefinfo.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the same client on a new connection, after the first one closed
+	other := newTCPConversation(ms, mustTCPAddr(t, "192.168.1.20:50001"), mustTCPAddr(t, zone), conv.tick())
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.FromServer(EncodeShinePacket(8216, []byte{0x4c, 0x1f, 0x10, 0x27, 0, 0, 0x20, 0x4e, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sink := runPipeline(t, testConfig(), ms)
+	events := sink.byDirection()
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Seen.Before(events[j].Seen) || events[i].Seen.Equal(events[j].Seen) && events[i].Seq < events[j].Seq
+	})
+	tarian := map[string]string{"handle": "8012", "character": "Tarian"}
+	expected := []struct {
+		opCode  uint16
+		context map[string]string
+	}{
+		{opSeedAck, nil},
+		{briefInfoLoginCharacter, nil},
+		{briefInfoLoginCharacter, nil},
+		{8216, tarian},
+		{8211, nil},
+		{8218, map[string]string{"handle": "8013", "character": "Lyra"}},
+		{briefInfoDelete, tarian},
+		{8211, nil},
+		// the other flow
+		{8216, nil},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("%v packets, expected %v", len(events), len(expected))
+	}
+	for i, e := range expected {
+		pe := events[i]
+		if pe.Packet.Base.OperationCode != e.opCode || !reflect.DeepEqual(pe.Context, e.context) {
+			t.Errorf("packet %v: operation code %v with context %v, expected %v with %v", i, pe.Packet.Base.OperationCode, pe.Context, e.opCode, e.context)
+		}
+	}
+	if events[0].FlowID == events[len(events)-1].FlowID {
+		t.Error("both connections are in the same flow")
+	}
+}
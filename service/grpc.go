@@ -0,0 +1,170 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.packet-sniffer/snifferpb"
+	"google.golang.org/grpc"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// grpcSubscriber gets the packets of a Subscribe call through a bounded queue
+// a subscriber that can't keep up loses packets instead of slowing down the decoders
+type grpcSubscriber struct {
+	flowNames map[string]bool
+	opCodes   map[uint32]bool
+	queue     chan *snifferpb.PacketEvent
+	dropped   uint64
+}
+
+func (gs *grpcSubscriber) wants(pe PacketEvent) bool {
+	if len(gs.flowNames) > 0 && !gs.flowNames[pe.FlowName] {
+		return false
+	}
+	if len(gs.opCodes) > 0 && !gs.opCodes[uint32(pe.Packet.Base.OperationCode)] {
+		return false
+	}
+	return true
+}
+
+// grpcServer streams decoded packets to the clients of snifferpb.SnifferService
+type grpcServer struct {
+	server      *grpc.Server
+	subscribers map[*grpcSubscriber]bool
+	queueSize   int
+	metrics     *snifferMetrics
+	closed      bool
+	mu          sync.RWMutex
+}
+
+// packets dropped for slow subscribers are counted in sm
+func newGRPCServer(queueSize int, sm *snifferMetrics) *grpcServer {
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	gs := &grpcServer{
+		subscribers: make(map[*grpcSubscriber]bool),
+		queueSize:   queueSize,
+		metrics:     sm,
+	}
+	gs.server = grpc.NewServer()
+	snifferpb.RegisterSnifferServiceServer(gs.server, gs)
+	return gs
+}
+
+func (gs *grpcServer) listen(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Infof("starting grpc server on %v", address)
+	gs.serve(l)
+	return nil
+}
+
+// serve Subscribe calls on l until the server is closed
+func (gs *grpcServer) serve(l net.Listener) {
+	go func() {
+		if err := gs.server.Serve(l); err != nil {
+			log.Error(err)
+		}
+	}()
+}
+
+func (gs *grpcServer) Subscribe(req *snifferpb.SubscribeRequest, stream snifferpb.SnifferService_SubscribeServer) error {
+	sub := &grpcSubscriber{
+		flowNames: make(map[string]bool),
+		opCodes:   make(map[uint32]bool),
+		queue:     make(chan *snifferpb.PacketEvent, gs.queueSize),
+	}
+	for _, n := range req.FlowNames {
+		sub.flowNames[n] = true
+	}
+	for _, o := range req.OpCodes {
+		sub.opCodes[o] = true
+	}
+
+	gs.mu.Lock()
+	if gs.closed {
+		gs.mu.Unlock()
+		return nil
+	}
+	gs.subscribers[sub] = true
+	gs.mu.Unlock()
+	log.Infof("grpc subscriber connected, flows %v, operation codes %v", req.FlowNames, req.OpCodes)
+
+	defer func() {
+		gs.mu.Lock()
+		delete(gs.subscribers, sub)
+		gs.mu.Unlock()
+		if dropped := atomic.LoadUint64(&sub.dropped); dropped > 0 {
+			log.Warningf("grpc subscriber was too slow, %v packets were dropped", dropped)
+		}
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case e, ok := <-sub.queue:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (gs *grpcServer) Publish(pe PacketEvent) {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	if gs.closed {
+		return
+	}
+
+	var e *snifferpb.PacketEvent
+	for sub := range gs.subscribers {
+		if !sub.wants(pe) {
+			continue
+		}
+		if e == nil {
+			e = &snifferpb.PacketEvent{
+				PacketId:     pe.ID,
+				Seq:          pe.Seq,
+				FlowId:       pe.FlowID,
+				FlowName:     pe.FlowName,
+				SessionId:    pe.SessionID,
+				Src:          pe.Src,
+				Dst:          pe.Dst,
+				Direction:    pe.Direction,
+				SeenUnixNano: pe.Seen.UnixNano(),
+				OpCode:       uint32(pe.Packet.Base.OperationCode),
+				Command:      pe.Packet.Base.ClientStructName,
+				Payload:      pe.Packet.Base.Data,
+			}
+		}
+		select {
+		case sub.queue <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			gs.metrics.grpcEventDropped()
+		}
+	}
+}
+
+// end every subscription and stop the server
+func (gs *grpcServer) Close() {
+	gs.mu.Lock()
+	if gs.closed {
+		gs.mu.Unlock()
+		return
+	}
+	gs.closed = true
+	for sub := range gs.subscribers {
+		close(sub.queue)
+	}
+	gs.mu.Unlock()
+	gs.server.Stop()
+}
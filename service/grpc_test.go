@@ -0,0 +1,215 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"github.com/shine-o/shine.engine.packet-sniffer/snifferpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the decoded packets of testdata/handshake.hex
+func handshakeEvents(t *testing.T) []PacketEvent {
+	t.Helper()
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, sink := runPipeline(t, testConfig(), ms)
+	return sink.byDirection()
+}
+
+// a client of gs over an in memory connection
+func dialGRPC(t *testing.T, gs *grpcServer) (snifferpb.SnifferServiceClient, func()) {
+	t.Helper()
+	l := bufconn.Listen(1 << 20)
+	gs.serve(l)
+	dial := func(ctx context.Context, address string) (net.Conn, error) {
+		return l.Dial()
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufconn", grpc.WithContextDialer(dial), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snifferpb.NewSnifferServiceClient(conn), func() {
+		_ = conn.Close()
+		gs.Close()
+	}
+}
+
+// wait until n Subscribe calls are registered, packets published before are not sent to them
+func waitForSubscribers(t *testing.T, gs *grpcServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testPipelineWait)
+	for {
+		gs.mu.RLock()
+		count := len(gs.subscribers)
+		gs.mu.RUnlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v grpc subscribers, expected %v", count, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	events := handshakeEvents(t)
+	tests := []struct {
+		name    string
+		req     *snifferpb.SubscribeRequest
+		opCodes []uint16
+	}{
+		{"everything", &snifferpb.SubscribeRequest{}, []uint16{opVersionCheck, opLoginReq, opSeedAck, opVersionAck, opLoginAck}},
+		{"flow name", &snifferpb.SubscribeRequest{FlowNames: []string{"login-client"}}, []uint16{opVersionCheck, opLoginReq, opSeedAck, opVersionAck, opLoginAck}},
+		{"operation codes", &snifferpb.SubscribeRequest{OpCodes: []uint32{uint32(opSeedAck), uint32(opLoginAck)}}, []uint16{opSeedAck, opLoginAck}},
+		{"flow name and operation code", &snifferpb.SubscribeRequest{FlowNames: []string{"login-client", "zone00-client"}, OpCodes: []uint32{uint32(opLoginReq)}}, []uint16{opLoginReq}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs := newGRPCServer(100, newSnifferMetrics())
+			client, closeAll := dialGRPC(t, gs)
+			defer closeAll()
+
+			ctx, cancel := context.WithTimeout(context.Background(), testPipelineWait)
+			defer cancel()
+			stream, err := client.Subscribe(ctx, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitForSubscribers(t, gs, 1)
+			// packets of another flow are only sent without a flow filter
+			if len(tt.req.FlowNames) > 0 {
+				other := events[0]
+				other.FlowName = "zone01-client"
+				gs.Publish(other)
+			}
+			for _, pe := range events {
+				gs.Publish(pe)
+			}
+
+			for i, opCode := range tt.opCodes {
+				e, err := stream.Recv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.OpCode != uint32(opCode) || e.FlowName != "login-client" {
+					t.Fatalf("packet %v is %v of %v, expected %v of login-client", i, e.OpCode, e.FlowName, opCode)
+				}
+				var pe PacketEvent
+				for _, p := range events {
+					if p.Packet.Base.OperationCode == opCode {
+						pe = p
+					}
+				}
+				if e.PacketId != pe.ID || e.Seq != pe.Seq || e.FlowId != pe.FlowID || e.Direction != pe.Direction ||
+					e.SeenUnixNano != pe.Seen.UnixNano() || !bytes.Equal(e.Payload, pe.Packet.Base.Data) {
+					t.Errorf("packet %v is %v, expected %+v", i, e, pe)
+				}
+				if e.Src != pe.Src || e.Dst != pe.Dst {
+					t.Errorf("packet %v from %v to %v", i, e.Src, e.Dst)
+				}
+			}
+		})
+	}
+}
+
+// a subscriber that doesn't read loses packets instead of blocking Publish
+func TestGRPCSlowSubscriber(t *testing.T) {
+	events := handshakeEvents(t)
+	gs := newGRPCServer(1, newSnifferMetrics())
+	client, closeAll := dialGRPC(t, gs)
+	defer closeAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := client.Subscribe(ctx, &snifferpb.SubscribeRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscribers(t, gs, 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			gs.Publish(events[i%len(events)])
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testPipelineWait):
+		t.Fatal("Publish blocked on a subscriber that doesn't read")
+	}
+	if atomic.LoadUint64(&gs.metrics.grpcDropped) == 0 {
+		t.Error("no packets were dropped")
+	}
+}
+
+// closing the server ends the subscriptions, and one that went away is unregistered
+func TestGRPCSubscriptionEnds(t *testing.T) {
+	gs := newGRPCServer(10, newSnifferMetrics())
+	client, closeAll := dialGRPC(t, gs)
+	defer closeAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := client.Subscribe(ctx, &snifferpb.SubscribeRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscribers(t, gs, 1)
+	cancel()
+	waitForSubscribers(t, gs, 0)
+
+	stream, err := client.Subscribe(context.Background(), &snifferpb.SubscribeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscribers(t, gs, 1)
+	received := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		received <- err
+	}()
+	gs.Close()
+	select {
+	case err := <-received:
+		if err == nil {
+			t.Error("a packet was received after the server closed")
+		}
+	case <-time.After(testPipelineWait):
+		t.Fatal("the subscription didn't end with the server")
+	}
+}
+
+// packets converted from a database or json lines have their addresses but no gopacket flows
+func TestGRPCConvertedAddresses(t *testing.T) {
+	gs := newGRPCServer(10, newSnifferMetrics())
+	client, closeAll := dialGRPC(t, gs)
+	defer closeAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testPipelineWait)
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &snifferpb.SubscribeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSubscribers(t, gs, 1)
+	pe := convertedPacket("flow", "login-client", "inbound", testStart, opLoginAck, []byte{1})
+	pe.Src, pe.Dst = testServerAddr, testClientAddr
+	gs.Publish(pe)
+
+	e, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Src != testServerAddr || e.Dst != testClientAddr {
+		t.Errorf("sent from %q to %q, expected %v to %v", e.Src, e.Dst, testServerAddr, testClientAddr)
+	}
+}
@@ -1,14 +1,10 @@
 package service
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"github.com/segmentio/ksuid"
 	"github.com/shine-o/shine.engine.core/networking"
-	"github.com/spf13/viper"
+	"sync"
 	"time"
 )
 
@@ -16,239 +12,494 @@ type shineSegment struct {
 	data      []byte
 	seen      time.Time
 	direction string
+	// bytes the assembler couldn't recover before this segment, -1 if unknown
+	skip int
+	// first and last segment of the connection
+	start, end bool
+	// numbered by the segment queue, see segmentSequence
+	index uint64
+	// pooled buffer data is in, see release
+	buf *[]byte
 }
 
 type decodedPacket struct {
 	seen      time.Time
-	packet   * networking.Command
+	packet    *networking.Command
 	direction string
+	// what earlier packets of the flow tell about this one, see flowContext
+	annotations map[string]string
+	// payload sizes before and after decompression, 0 if it wasn't compressed
+	compressedSize   int
+	decompressedSize int
+	// where the packet starts in the stream of its direction, and its number in that direction, see streamDecoder
+	offset uint64
+	seq    uint64
+}
+
+// waiting longer than this for the rest of a packet is logged
+const partialPacketWarning = 10 * time.Second
+
+// partialPacket is a packet at the start of the unparsed buffer that needs more segments to be complete
+// packets spanning several segments are normal, so waiting is only logged once it takes longer than partialPacketWarning
+type partialPacket struct {
+	// bytes from the current offset the packet takes up, 0 if nothing is pending
+	size   int
+	since  time.Time
+	warned bool
+}
+
+func (pp *partialPacket) wait(size int, seen time.Time) {
+	if pp.size == 0 {
+		pp.since = seen
+		pp.warned = false
+	}
+	pp.size = size
+}
+
+// true if the buffer doesn't hold the pending packet yet, so decoding can be skipped
+func (pp *partialPacket) waiting(buffered int, flowName, direction string, seen time.Time) bool {
+	if pp.size == 0 || buffered >= pp.size {
+		return false
+	}
+	if !pp.warned && seen.Sub(pp.since) > partialPacketWarning {
+		log.Warningf("[%v] %v packet of %v bytes incomplete for %v, %v bytes buffered", flowName, direction, pp.size, seen.Sub(pp.since), buffered)
+		pp.warned = true
+	}
+	return true
+}
+
+func (pp *partialPacket) reset() {
+	pp.size = 0
 }
 
 // handle stream data flowing from the client
-func (ss *shineStream) decodeClientPackets(ctx context.Context, segments <-chan shineSegment, xorKeyFound <-chan bool, xorKey <-chan uint16) {
+func (ss *shineStream) decodeClientPackets(ctx context.Context, segments <-chan shineSegment, xorKey <-chan uint16) {
 	var (
-		data       []byte
-		offset     int
-		xorOffset  uint16
-		hasXorKey  bool
-		shouldQuit bool
+		xorOffset uint16
+		hasXorKey bool
+		// segments received before the xor offset was known
+		segmentsWithoutKey int
+		// the seed packet only applies to the stream as it was before any gap
+		gapped bool
+		// where the current key was found and how many bytes it xored since, persisted in xorstate.json
+		keySeed    uint16
+		keyDecoded uint64
+		// the offset a previous run left this connection at, tried first when resynchronizing
+		resumeOffset uint16
+		resuming     bool
+		received     int
+		// client packets decoded to unknown operation codes in a row
+		drift xorDrift
+		// the first packet was checked for the client version
+		versionChecked bool
+		// the xor offset the last packet was decoded from
+		decodedFrom uint16
 	)
-	offset = 0
-	logActivated := viper.GetBool("protocol.log.client")
-
-loop:
-	for {
-		select {
-		case <-ctx.Done():
-			log.Warningf("[%v %v] decodeClientPackets(): context was canceled", ss.net, ss.transport)
-			shouldQuit = true
-			return
-		case <-xorKeyFound:
-			log.Info("xor key found, waiting for it in a select")
-			for {
-				select {
-				// retrial mechanism so it doesn't end up in infinite loop
-				case xorOffset = <-xorKey:
-					hasXorKey = true
-					continue loop
-				}
-			}
-		case segment := <-segments:
-			data = append(data, segment.data...)
+	cfg := ss.sniffer.config
+	stateKey := ss.xorStateKey()
+	// the limit is corrected if the xor offset drifts
+	xs := ss.xor
+	drift.commands = ss.sniffer.protocol.commands
+
+	sd := &streamDecoder{
+		ss:        ss,
+		direction: "outbound",
+		outbound:  true,
+		watch:     ss.clientWatch,
+		maxLength: 65534,
+		keys:      xorKey,
+	}
 
-			if offset >= len(data) {
-				log.Warningf("not enough data, next offset is %v ", offset)
-				break
-			}
+	useKey := func(o uint16) {
+		xorOffset = o
+		hasXorKey = true
+		keySeed, keyDecoded = o, 0
+		drift.packets = nil
+	}
 
-			for offset < len(data) {
-				if !serverSideCapture {
-					if !hasXorKey {
-						break
-					}
-				}
+	// a connection that was already open when the capture started may be one a previous run was decoding
+	sd.segment = func(segment shineSegment) {
+		if received == 0 && !segment.start && !cfg.ServerSideCapture {
+			if e, ok := ss.sniffer.xorState.lookup(stateKey); ok {
+				resumeOffset, resuming = e.Offset, true
+				sd.resyncing = true
+				gapped = true
+			}
+		}
+		received++
+	}
 
-				var skipBytes int
-				var pLen uint16
+	// if the seed packet was missed, guess the xor offset from the buffered data
+	sd.added = func() {
+		if cfg.ServerSideCapture || hasXorKey || sd.resyncing || !cfg.XorBruteForce {
+			return
+		}
+		segmentsWithoutKey++
+		if segmentsWithoutKey < cfg.XorBruteForceSegments {
+			return
+		}
+		if o, ok := bruteForceXorOffset(ss.sniffer.protocol.commands, sd.data, sd.offset, xs); ok {
+			log.Infof("[%v] xor offset %v found by brute force", ss.flowName, o)
+			useKey(o)
+			ss.stats.keyFound()
+		}
+	}
 
-				pLen, skipBytes = networking.PacketBoundary(offset, data)
+	sd.lost = func() {
+		gapped = true
+		if !cfg.ServerSideCapture {
+			hasXorKey = false
+		}
+	}
 
-				nextOffset := offset + skipBytes + int(pLen)
+	// look for the next packet boundary and, for xored data, the xor offset that goes with it
+	sd.boundary = func() (int, bool) {
+		if cfg.ServerSideCapture {
+			return findPacketBoundary(ss.sniffer.protocol.commands, sd.data)
+		}
+		var (
+			o     int
+			key   uint16
+			found bool
+		)
+		if resuming {
+			o, found = findResumedPacketBoundary(ss.sniffer.protocol.commands, sd.data, xs, resumeOffset)
+			key = resumeOffset
+			if found {
+				log.Infof("[%v] xor offset %v resumed from %v", ss.flowName, key, xorStateFile)
+			}
+		}
+		if !found {
+			o, key, found = findXoredPacketBoundary(ss.sniffer.protocol.commands, sd.data, xs)
+		}
+		if found {
+			useKey(key)
+			resuming = false
+		}
+		return o, found
+	}
 
-				if nextOffset > len(data) {
-					log.Warningf("not enough data, next offset is %v ", nextOffset)
-					break
-				}
+	sd.ready = func() bool {
+		return cfg.ServerSideCapture || hasXorKey
+	}
 
-				if pLen == uint16(65535) {
-					log.Errorf("bad length value %v", pLen)
-					return
-				}
+	sd.keyReceived = func(o uint16) bool {
+		if gapped {
+			ss.warningf("[%v] xor offset %v received after a gap in the stream, ignoring it", ss.flowName, o)
+			return false
+		}
+		if hasXorKey {
+			ss.warningf("[%v] xor offset %v received after one was brute forced, ignoring it", ss.flowName, o)
+			return false
+		}
+		log.Infof("[%v] xor offset %v received", ss.flowName, o)
+		useKey(o)
+		ss.stats.keyFound()
+		// client packets that arrived before the xor key can be decoded now
+		return true
+	}
 
-				packetData := make([]byte, pLen)
+	sd.decode = func(packetData []byte) (networking.Command, error) {
+		var o *uint16
+		if !cfg.ServerSideCapture {
+			o = &xorOffset
+		}
+		if !versionChecked {
+			versionChecked = true
+			xs = ss.checkVersion(packetData, xs, o)
+		}
+		decodedFrom = xorOffset
+		p, err := decodePacket(packetData, xs, o)
+		if o != nil {
+			keyDecoded += uint64(len(packetData))
+			ss.sniffer.xorState.update(stateKey, keySeed, keyDecoded, xorOffset)
+		}
+		return p, err
+	}
 
-				copy(packetData, data[offset+skipBytes:nextOffset])
+	sd.decoded = func(p *networking.Command, raw []byte) bool {
+		if cfg.ServerSideCapture || !drift.observe(p.Base.OperationCode, raw, decodedFrom, uint64(keySeed)+keyDecoded-uint64(len(raw))) {
+			return true
+		}
+		ss.warningf("[%v] %v %v packets in a row decoded to unknown operation codes from xor offset %v, the xor offset drifted", ss.flowName, xorDriftPackets, sd.last.direction, drift.start)
+		ss.stats.xorDriftDetected()
+		if next, limit, ok := drift.recover(xs); ok {
+			if limit != 0 {
+				ss.warningf("[%v] xor offset corrected to %v, the key probably wraps at %v and not at protocol.xorLimit %v", ss.flowName, next, limit, xs.Limit)
+				xs.Limit = limit
+			} else {
+				ss.warningf("[%v] xor offset corrected to %v, no xor limit explains the drift", ss.flowName, next)
+			}
+			useKey(next)
+			ss.sniffer.xorState.update(stateKey, keySeed, keyDecoded, xorOffset)
+			ss.stats.xorDriftCorrected()
+		} else {
+			ss.warningf("[%v] no xor offset decodes the last %v packets, they stay as they are", ss.flowName, xorDriftPackets)
+		}
+		return true
+	}
 
-				if !serverSideCapture {
-					networking.XorCipher(packetData, &xorOffset)
-				}
+	sd.sink = func(dp decodedPacket) {
+		if live := ss.sniffer.liveSettings.get(); live.logClient && live.filter.allows(dp.packet.Base.OperationCode) {
+			ss.packets <- dp
+		}
+	}
 
-				p, _ := networking.DecodePacket(packetData)
+	sd.state = func() string {
+		return fmt.Sprintf("xor key found %v, xor offset %v, resynchronizing %v", hasXorKey, xorOffset, sd.resyncing)
+	}
 
-				if logActivated {
-					ss.packets <- decodedPacket{
-						seen:      segment.seen,
-						packet:    &p,
-						direction: segment.direction,
-					}
-				}
-				offset += skipBytes + int(pLen)
-			}
-			if shouldQuit {
-				return
-			}
+	sd.position = func() decoderPosition {
+		return decoderPosition{
+			xorOffset: xorOffset,
+			xored:     !cfg.ServerSideCapture,
+			xor:       xs,
+			known:     cfg.ServerSideCapture || hasXorKey,
 		}
 	}
+
+	sd.run(ctx, "decodeClientPackets", segments)
 }
 
 // handle stream data flowing from the server
-func (ss *shineStream) decodeServerPackets(ctx context.Context, segments <-chan shineSegment, xorKeyFound chan<- bool, xorKey chan<- uint16) {
+func (ss *shineStream) decodeServerPackets(ctx context.Context, segments <-chan shineSegment, xorKey chan<- uint16) {
 	var (
-		data           []byte
-		offset         int
 		xorOffsetFound bool
-		shouldQuit     bool
+		// newer server builds xor the server stream with an offset of its own, see protocol.serverXor
+		serverKeyed  bool
+		serverXored  bool
+		serverOffset uint16
+		// protocol.serverXor is auto and the first packet once the offset is known wasn't checked yet
+		detecting bool
 	)
-	xorOffsetFound = false
-	offset = 0
-
-	logActivated := viper.GetBool("protocol.log.server")
-	for {
-		select {
-		case <-ctx.Done():
-			log.Warningf("[%v %v] decodeServerPackets(): context was canceled", ss.net, ss.transport)
-			shouldQuit = true
-			return
-		case segment := <-segments:
-			data = append(data, segment.data...)
-			if offset >= len(data) {
-				log.Warningf("not enough data, next offset is %v ", offset)
-				break
-			}
-
-			for offset < len(data) {
-				var skipBytes int
-				var pLen uint16
+	// the client decoder waits for the key until the server stream is decoded
+	defer close(xorKey)
+	cfg := ss.sniffer.config
+	mode := ss.sniffer.serverXor
+
+	sd := &streamDecoder{
+		ss:        ss,
+		direction: "inbound",
+		watch:     ss.serverWatch,
+		maxLength: 32767,
+	}
 
-				pLen, skipBytes = networking.PacketBoundary(offset, data)
+	useServerKey := func(o uint16) {
+		serverOffset, serverKeyed = o, true
+		serverXored = mode == serverXorOn
+		detecting = mode == serverXorAuto
+	}
+	if mode != serverXorOff && cfg.ServerXorSeed >= 0 {
+		useServerKey(uint16(cfg.ServerXorSeed))
+	}
 
-				nextOffset := offset + skipBytes + int(pLen)
+	// a xored stream loses its offset with a gap, it's found again with the boundary like the one of the client
+	sd.boundary = func() (int, bool) {
+		if !serverXored {
+			return findPacketBoundary(ss.sniffer.protocol.commands, sd.data)
+		}
+		o, key, found := findXoredPacketBoundary(ss.sniffer.protocol.commands, sd.data, ss.xor)
+		if found {
+			serverOffset = key
+		}
+		return o, found
+	}
 
-				if nextOffset > len(data) {
-					log.Warningf("not enough data for stream %v, next offset is %v ", ss.transport, nextOffset)
-					break
-				}
+	sd.decode = func(packetData []byte) (networking.Command, error) {
+		if detecting {
+			detecting = false
+			serverXored = serverPacketXored(ss.sniffer.protocol.commands, packetData, ss.xor, serverOffset)
+			if serverXored {
+				log.Infof("[%v] server stream is xored from offset %v", ss.flowName, serverOffset)
+			}
+		}
+		var o *uint16
+		if serverXored {
+			o = &serverOffset
+		}
+		return decodePacket(packetData, ss.xor, o)
+	}
 
-				if pLen > uint16(32767) {
-					log.Errorf("bad length value %v", pLen)
-					return
+	sd.decoded = func(pc *networking.Command, raw []byte) bool {
+		if mode != serverXorOff && !serverKeyed {
+			// the seed packet itself is never xored
+			if seed, ok, err := cfg.serverXorSeed(pc.Base.OperationCode, pc.Base.Data); ok {
+				switch {
+				case err != nil && mode == serverXorAuto:
+					// an older build, its seed packet only has the offset of the client
+					log.Infof("[%v] no server xor offset in the seed packet, the server stream isn't xored: %v", ss.flowName, err)
+					mode = serverXorOff
+				case err != nil:
+					log.Error(err)
+					return false
+				default:
+					log.Infof("[%v] server xor offset %v received", ss.flowName, seed)
+					useServerKey(seed)
 				}
+			}
+		}
 
-				packetData := make([]byte, pLen)
-
-				copy(packetData, data[offset+skipBytes:nextOffset])
-
-				pc, _ := networking.DecodePacket(packetData)
-
-				if !serverSideCapture {
-					if !xorOffsetFound {
-						log.Info("xor offset not found")
-						if pc.Base.OperationCode == 2055 {
-							var xorOffset uint16
-							buf := bytes.NewBuffer(pc.Base.Data)
-							if err := binary.Read(buf, binary.LittleEndian, &xorOffset); err != nil {
-								log.Error(err)
-								return
-							}
-							xorOffsetFound = true
-							xorKeyFound <- true
-							xorKey <- xorOffset
-						}
+		if !cfg.ServerSideCapture {
+			if !xorOffsetFound {
+				log.Info("xor offset not found")
+				if xorOffset, ok, err := cfg.xorSeed(pc.Base.OperationCode, pc.Base.Data); ok {
+					if err != nil {
+						log.Error(err)
+						return false
 					}
-				}
-
-				if logActivated {
-					ss.packets <- decodedPacket{
-						seen:      segment.seen,
-						packet:    &pc,
-						direction: segment.direction,
+					xorOffsetFound = true
+					// the channel has room for exactly one key, so this never waits on the client decoder
+					select {
+					case xorKey <- xorOffset:
+					default:
+						ss.warningf("[%v] xor offset %v was already delivered, dropping it", ss.flowName, xorOffset)
 					}
 				}
-				offset += skipBytes + int(pLen)
 			}
+		}
+		return true
+	}
 
-			if shouldQuit {
-				return
-			}
+	sd.sink = func(dp decodedPacket) {
+		ss.discoverZone(dp)
+		if live := ss.sniffer.liveSettings.get(); live.logServer && live.filter.allows(dp.packet.Base.OperationCode) {
+			ss.packets <- dp
 		}
 	}
-}
 
-func (ss *shineStream) handleDecodedPackets(ctx context.Context, decodedPackets <-chan decodedPacket) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case dp := <-decodedPackets:
-			go ss.logPacket(dp)
+	sd.state = func() string {
+		return fmt.Sprintf("xor offset found %v, server xored %v, resynchronizing %v", xorOffsetFound, serverXored, sd.resyncing)
+	}
+
+	// until the seed packet tells, it isn't known whether the server stream is xored
+	sd.position = func() decoderPosition {
+		return decoderPosition{
+			xorOffset: serverOffset,
+			xored:     serverXored,
+			xor:       ss.xor,
+			known:     mode == serverXorOff || (serverKeyed && !detecting),
 		}
 	}
+
+	sd.run(ctx, "decodeServerPackets", segments)
 }
 
-func (ss *shineStream) logPacket(dp decodedPacket) {
-	packetID, err := ksuid.NewRandomWithTime(dp.seen)
-	if err != nil {
-		log.Error(err)
+// called once a decoder handled every segment of its stream, bytes still buffered are a packet that was cut short
+// and are reported as truncated when the flow is closed
+func (ss *shineStream) endedMidPacket(direction string, buffered int) {
+	if buffered <= 0 {
+		return
 	}
-	dp.packet.Base.ClientStructName = networking.CommandName(dp.packet)
+	ss.warningf("[%v] %v stream ended with a truncated packet, %v bytes of it were received", ss.flowName, direction, buffered)
+	ss.stats.packetIncomplete(direction, buffered)
+}
 
-	pv := PacketView{
-		PacketID:      packetID.String(),
-		TimeStamp:     dp.seen.String(),
-		IPEndpoints:   ss.net.String(),
-		PortEndpoints: ss.transport.String(),
-		Direction:     dp.direction,
-		PacketData:    dp.packet.Base.JSON(),
+// drop the bytes that were already decoded so the stream buffer only holds the unparsed remainder
+// the xor offset of the client is kept apart from the buffer, so trimming doesn't affect it
+func trimDecoded(data []byte, offset int) ([]byte, int) {
+	if offset == 0 {
+		return data, offset
 	}
+	// what is left is moved to the front, so the next segments are appended to the same array instead of a new one
+	n := copy(data, data[offset:])
+	return data[:n], 0
+}
 
-	nr, err := ncStructRepresentation(dp.packet.Base.OperationCode, dp.packet.Base.Data)
-	if err == nil {
-		pv.NcRepresentation = nr
-		//b, _ := json.Marshal(pv.ncRepresentation)
-		//log.Info(string(b))
-	} else {
-		//log.Error(err)
+// handle decoded packets with a pool of workers, returns once the decoders are done and every packet was handled
+// with a single worker packets are handed to the Sniffer's Handler in the order they were decoded
+func (ss *shineStream) handleDecodedPackets(decodedPackets <-chan decodedPacket, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dp := range decodedPackets {
+				ss.handlePacket(ss.packetEvent(dp))
+			}
+		}()
 	}
+	wg.Wait()
 
-	var tPorts string
+	// every packet was handled, the event carries the final counts of the stream
+	fe := newFlowClosedEvent(ss)
+	if ss.output != nil {
+		ss.output.writeClosed(fe)
+		ss.output.close()
+	}
+	if ss.flowLog != nil {
+		ss.flowLog.close()
+	}
+	ss.sniffer.ws.sendFlowEvent(fe)
+	if ss.decrypted != nil {
+		ss.decrypted.close()
+	}
+	ss.rawTap.close()
+	ss.undecodable.close()
+	ss.sniffer.timing.streamDone(ss.flowID)
+	ss.gameContext.clear()
+}
+
+// the id of the packet of the flow that starts at offset in the stream of direction, c for the client stream and s for
+// the server one, e.g 1b4e28ba-2fa1-5d1e-8f2c-0c1d5b9e3a4f-c1842
+func packetID(flowID, direction string, offset uint64) string {
+	side := "c"
+	if direction == "inbound" {
+		side = "s"
+	}
+	return fmt.Sprintf("%v-%v%v", flowID, side, offset)
+}
 
+// the event of a decoded packet with the stream it belongs to, the side that sent it and the one it was sent to
+func (ss *shineStream) packetEvent(dp decodedPacket) PacketEvent {
+	src, dst := srcAddress(ss.net, ss.transport), dstAddress(ss.net, ss.transport)
 	if dp.direction == "inbound" {
-		tPorts = ss.transport.Reverse().String()
-	} else {
-		tPorts = ss.transport.String()
+		src, dst = dst, src
+	}
+	return PacketEvent{
+		ID:        packetID(ss.flowID, dp.direction, dp.offset),
+		Seq:       dp.seq,
+		FlowID:    ss.flowID,
+		FlowName:  ss.flowName,
+		SessionID: ss.sessionID,
+		Net:       ss.net,
+		Transport: ss.transport,
+		Src:       src,
+		Dst:       dst,
+		Seen:      dp.seen,
+		Direction: dp.direction,
+		Packet:    dp.packet,
+		Context:   dp.annotations,
+		stream:    ss,
+		// 0 unless decompress decompressed the payload
+		CompressedSize:   dp.compressedSize,
+		DecompressedSize: dp.decompressedSize,
 	}
+}
 
-	if viper.GetBool("protocol.log.verbose") {
-		log.Infof("\n%v\n%v\n%v\n%v\n%v\nunpacked data: %v \n%v", dp.packet.Base.ClientStructName, dp.seen, tPorts, dp.direction, dp.packet.Base.String(), pv.NcRepresentation.UnpackedData, hex.Dump(dp.packet.Base.Data))
-	} else {
-		log.Infof("%v %v %v %v %v", dp.seen, tPorts, dp.direction,dp.packet.Base.ClientStructName, dp.packet.Base.String())
+func (ss *shineStream) handlePacket(pe PacketEvent) {
+	if ss.sniffer.suppress() {
+		return
 	}
+	// before sampling, so the deltas are between packets that followed each other
+	ss.sniffer.timing.observe(pe)
+	// and so is every notable packet, every packet an alert may match and every payload classified
+	ss.sniffer.sessions.mark(pe)
+	ss.sniffer.alerts.packet(pe)
+	ss.sniffer.entropy.observe(pe)
+	if !ss.sniffer.liveSettings.get().sampling.keep(pe) {
+		ss.sniffer.metrics.packetSampledOut(ss.flowName)
+		return
+	}
+	nc := ss.sniffer.protocol.unpack(pe.Packet.Base.OperationCode, pe.Packet.Base.Data)
+	pe, nc = ss.sniffer.redact(pe, nc)
+	pe.Decoded, pe.Fields = nc.UnpackedData, nc.Fields
+	pe = ss.sniffer.session.anonymizer().packet(pe)
 
-	pv.ConnectionKey = fmt.Sprintf("%v %v", ss.net.String(), ss.transport.String())
-	ocs.mu.Lock()
-	ocs.structs[dp.packet.Base.OperationCode] = dp.packet.Base.ClientStructName
-	ocs.mu.Unlock()
+	for _, s := range ss.sniffer.sinks {
+		s.Publish(pe)
+	}
 
-	persistMovement(dp)
-	sendPacketToUI(pv)
+	if ss.sniffer.Handler != nil {
+		ss.sniffer.Handler(pe)
+	}
 }
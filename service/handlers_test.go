@@ -0,0 +1,265 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a client conversation after the seed, closed right away, so the streams complete while the key is handed over
+func seededConversation(t *testing.T, ms *MemorySource, seeds int, packets int) {
+	t.Helper()
+	key, err := hex.DecodeString(testXorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := openTestConversation(t, ms)
+	for i := 0; i < seeds; i++ {
+		if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conv.XorClient(XorSettings{Key: key, Limit: 350}, testSeed)
+	for i := 0; i < packets; i++ {
+		if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.FromServer(EncodeShinePacket(opLoginAck, []byte{byte(i)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXorKeyHandover(t *testing.T) {
+	const packets = 10
+	tests := []struct {
+		name  string
+		seeds int
+	}{
+		{"one seed", 1},
+		// the channel holds one key, the next ones are dropped instead of blocking the server decoder
+		{"repeated seed", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the client decoder can be told its stream completed before the server decoder handed the key over
+			for run := 0; run < 20; run++ {
+				ms := NewMemorySource()
+				seededConversation(t, ms, tt.seeds, packets)
+				_, sink := runPipeline(t, testConfig(), ms)
+				events := sink.byDirection()
+				if got := len(payloadsOf(events, opLoginAck)); got != packets {
+					t.Fatalf("run %v: %v server packets decoded, expected %v", run, got, packets)
+				}
+				if got := len(payloadsOf(events, opChatReq)); got != packets {
+					t.Fatalf("run %v: %v client packets decoded, expected %v", run, got, packets)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimDecoded(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int
+		rest   []byte
+	}{
+		{"nothing decoded", []byte{1, 2, 3}, 0, []byte{1, 2, 3}},
+		{"partly decoded", []byte{1, 2, 3, 4}, 3, []byte{4}},
+		{"fully decoded", []byte{1, 2, 3}, 3, []byte{}},
+		{"empty", nil, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), tt.data...)
+			rest, offset := trimDecoded(data, tt.offset)
+			if offset != 0 {
+				t.Errorf("offset %v, expected 0", offset)
+			}
+			if !bytes.Equal(rest, tt.rest) {
+				t.Errorf("%x left, expected %x", rest, tt.rest)
+			}
+			// the next segments are appended to the same array
+			if len(rest) > 0 && &rest[0] != &data[0] {
+				t.Error("the remainder was moved to a new array")
+			}
+		})
+	}
+}
+
+// a long stream is decoded with a buffer that holds about a packet, not the whole stream
+func TestStreamBufferTrimmed(t *testing.T) {
+	const packets = 2000
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	payload := make([]byte, 200)
+	for i := 0; i < packets; i++ {
+		if err := conv.FromServer(EncodeShinePacket(opLoginAck, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var largest int
+	sd := &streamDecoder{}
+	for i := 0; i < packets; i++ {
+		sd.data = append(sd.data, EncodeShinePacket(opLoginAck, payload)...)
+		sd.offset = len(sd.data)
+		sd.trim()
+		if cap(sd.data) > largest {
+			largest = cap(sd.data)
+		}
+	}
+	if largest > 2*len(payload)+16 {
+		t.Errorf("the buffer grew to %v bytes", largest)
+	}
+
+	_, sink := runPipeline(t, testConfig(), ms)
+	if got := len(payloadsOf(sink.byDirection(), opLoginAck)); got != packets {
+		t.Errorf("%v packets decoded, expected %v", got, packets)
+	}
+}
+
+// generatedStream is a source of one long server stream, the frames are built as they are read instead of being
+// held in memory like a MemorySource, so the heap of the test only shows what the pipeline keeps
+type generatedStream struct {
+	conv    *TCPConversation
+	payload []byte
+	// payload bytes left to send
+	left    int
+	pending []memoryFrame
+	closed  bool
+}
+
+func newGeneratedStream(t testing.TB, size, payload int) *generatedStream {
+	t.Helper()
+	gs := &generatedStream{payload: make([]byte, payload), left: size}
+	gs.conv = newTCPConversation(gs, mustTCPAddr(t, testClientAddr), mustTCPAddr(t, testServerAddr), testStart)
+	if err := gs.conv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return gs
+}
+
+func (gs *generatedStream) Add(seen time.Time, data []byte) {
+	gs.pending = append(gs.pending, memoryFrame{
+		ci: gopacket.CaptureInfo{
+			Timestamp:     seen,
+			CaptureLength: len(data),
+			Length:        len(data),
+		},
+		data: data,
+	})
+}
+
+// ReadPacketData implements gopacket.PacketDataSource, only the packet source goroutine calls it
+func (gs *generatedStream) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for len(gs.pending) == 0 {
+		if gs.closed {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		var err error
+		if gs.left <= 0 {
+			err = gs.conv.Close()
+			gs.closed = true
+		} else {
+			err = gs.conv.FromServer(EncodeShinePacket(opLoginAck, gs.payload))
+			gs.left -= len(gs.payload)
+		}
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+	}
+	f := gs.pending[0]
+	gs.pending = gs.pending[1:]
+	return f.data, f.ci, nil
+}
+
+func (gs *generatedStream) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(gs, layers.LinkTypeEthernet)
+}
+
+func (gs *generatedStream) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (gs *generatedStream) Stats() (CaptureStats, error) {
+	return CaptureStats{}, errNoCaptureStats
+}
+
+func (gs *generatedStream) Close() {}
+
+// 100 MB through one stream, the heap stays far below what the stream buffer would hold if it kept every segment
+func TestStreamHeapBounded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("pushes 100 MB through the pipeline")
+	}
+	const (
+		size    = 100 << 20
+		payload = 1400
+		// the heap may grow by this much while the stream is decoded, a buffer holding the stream would need size
+		bound = 32 << 20
+	)
+	gs := newGeneratedStream(t, size, payload)
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	before := ms.HeapAlloc
+
+	var (
+		mu      sync.Mutex
+		handled int
+		peak    uint64
+	)
+	sn.Handler = func(pe PacketEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		if handled%2000 != 0 {
+			return
+		}
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > peak {
+			peak = m.HeapAlloc
+		}
+	}
+	sn.Source = gs
+	if err := sn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sn.Done():
+	case <-time.After(5 * time.Minute):
+		t.Fatal("the capture didn't end within 5 minutes")
+	}
+	sn.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := (size + payload - 1) / payload; handled != expected {
+		t.Errorf("%v packets handled, expected %v", handled, expected)
+	}
+	if peak > before && peak-before > bound {
+		t.Errorf("the heap grew by %v MB while decoding %v MB", (peak-before)>>20, size>>20)
+	}
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// go test ./service -run Golden -update rewrites the golden files of testdata with what the tests decode
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// the default protocol.xorKey
+const testXorKey = "0759694a941194858c8805cba09ecd583a365b1a6a16febddf9402f82196c8e99ef7bfbdcfcdb27a009f4022fc11f90c2e12fba7740a7d78401e2ca02d06cba8b97eefde49ea4e13161680f43dc29ad486d7942417f4d665bd3fdbe4e10f50f6ec7a9a0c273d2466d322689c9a520be0f9a50b25da80490dfd3e77d156a8b7f40f9be80f5247f56f832022db0f0bb14385c1cba40b0219dff08becdb6c6d66ad45be89147e2f8910b89360d860def6fe6e9bca06c1759533cfc0b2e0cca5ce12f6e5b5b426c5b2184f2a5d261b654df545c98414dc7c124b189cc724e73c64ffd63a2cee8c8149396cb7dcbd94e232f7dd0afc020164ec4c940ab156f5c9a934de0f3827bc81300f7b3825fee83e29ba5543bf6b9f1f8a4952187f8af888245c4fe1a830878e501f2fd10cb4fd0abcdc1285e252ee4a5838abffc63db960640ab450d54089179ad585cfec0d7e817fe3c3040122ec27ccfa3e21a654c8de00b6df279ff625340785bfa7a5a5e0830c3d5d2040af60a36456f305c41c7d3798c3e85a6e5885a49a6b6af4a37b619b09401e604b32d951a4fef95d4e4afb4ad47c330233d59dce5baa5a7cd8f805fa1f2b8c725750ae6c1989ca01fcfc299b61126863654626c45b50aa2bbeef9a790223752c2013fdd95a7623f10bb5b859f99f7ae606e9a53ab450bf165898b39a6e36ee8deb"
+
+// operation codes of the test conversations
+const (
+	opSeedAck        uint16 = 2055 // NC_MISC_SEED_ACK
+	opVersionCheck   uint16 = 3173 // NC_USER_CLIENT_VERSION_CHECK_REQ
+	opVersionAck     uint16 = 3175 // NC_USER_CLIENT_RIGHTVERSION_CHECK_ACK
+	opLoginReq       uint16 = 3162 // NC_USER_US_LOGIN_REQ
+	opLoginAck       uint16 = 3082 // NC_USER_LOGIN_ACK
+	opChatReq        uint16 = 8193 // NC_ACT_CHAT_REQ, the client packet of the tests, opLoginReq payloads are redacted
+	testServerPort          = 9010
+	testClientAddr          = "192.168.1.20:50000"
+	testServerAddr          = "192.168.1.10:9010"
+	testWorldPort           = 9110
+	testZonePort            = 9210
+	testSeed         uint16 = 0x0123
+	testPipelineWait        = 10 * time.Second
+)
+
+var testStart = time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+
+// the config of the pipeline tests: the default protocol settings and commands file, the login, world manager and zone
+// services and no outputs, tests change what they need
+func testConfig() Config {
+	key, err := hex.DecodeString(testXorKey)
+	if err != nil {
+		panic(err)
+	}
+	return Config{
+		Services: map[int]string{
+			testServerPort: "login",
+			testWorldPort:  "worldmanager",
+			testZonePort:   "zone00",
+		},
+		PortRangeStart:        9000,
+		PortRangeEnd:          9600,
+		XorKey:                key,
+		XorLimit:              350,
+		XorKeyOpCode:          opSeedAck,
+		ServerXor:             "false",
+		ServerXorSeed:         -1,
+		ServerXorKeyOffset:    2,
+		XorBruteForceSegments: 5,
+		VersionOpCode:         opVersionCheck,
+		CommandsFile:          filepath.Join("..", "config", "commands.yml"),
+		LogClient:             true,
+		LogServer:             true,
+		Workers:               1,
+		SegmentQueueSize:      512,
+		ClientOverflow:        "block",
+		ServerOverflow:        "block",
+		SessionIdleTimeout:    time.Minute,
+		DiscoverZones:         true,
+		Redact:                true,
+	}
+}
+
+// the command names of the commands file of testConfig, for the tests that don't go through NewSniffer
+func testProtocol(t testing.TB) *protocol {
+	t.Helper()
+	names, err := loadCommandNames(testConfig().CommandsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := loadProtocol("", "")
+	p.commands.set(names)
+	return p
+}
+
+// the xor settings of testConfig
+func testXorSettings() XorSettings {
+	c := testConfig()
+	return XorSettings{Key: c.XorKey, Limit: c.XorLimit}
+}
+
+// seedPacket is the NC_MISC_SEED_ACK handing the client its xor offset
+func seedPacket(seed uint16) []byte {
+	return EncodeShinePacket(opSeedAck, []byte{byte(seed), byte(seed >> 8)})
+}
+
+// eventSink collects the packets a Sniffer hands to its Handler
+type eventSink struct {
+	events []PacketEvent
+	mu     sync.Mutex
+}
+
+func (es *eventSink) handle(pe PacketEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.events = append(es.events, pe)
+}
+
+// the packets handled so far, outbound ones before inbound ones and each direction in the order it was decoded
+func (es *eventSink) byDirection() []PacketEvent {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	events := append([]PacketEvent(nil), es.events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].FlowID != events[j].FlowID {
+			return events[i].Seen.Before(events[j].Seen)
+		}
+		return events[i].Direction == "outbound" && events[j].Direction == "inbound"
+	})
+	return events
+}
+
+// run the frames of ms through a Sniffer with c until they are all decoded, the Sniffer is returned stopped
+func runPipeline(t testing.TB, c Config, ms PacketSourceProvider) (*Sniffer, *eventSink) {
+	t.Helper()
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &eventSink{}
+	sn.Handler = sink.handle
+	sn.Source = ms
+	if err := sn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sn.Done():
+	case <-time.After(testPipelineWait):
+		t.Fatalf("the capture didn't end within %v", testPipelineWait)
+	}
+	sn.Stop()
+	return sn, sink
+}
+
+// a conversation with the login server of testConfig, opened
+func openTestConversation(t testing.TB, ms *MemorySource) *TCPConversation {
+	t.Helper()
+	conv, err := NewTCPConversation(ms, testClientAddr, testServerAddr, testStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return conv
+}
+
+func mustTCPAddr(t testing.TB, address string) *net.TCPAddr {
+	t.Helper()
+	a, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// the payloads of the packets with opCode, in the order they were handled
+func payloadsOf(events []PacketEvent, opCode uint16) [][]byte {
+	var payloads [][]byte
+	for _, pe := range events {
+		if pe.Packet.Base.OperationCode == opCode {
+			payloads = append(payloads, pe.Packet.Base.Data)
+		}
+	}
+	return payloads
+}
+
+// fixtureSegment is a line of a testdata conversation: the bytes one side sent in a tcp segment, as they were on the wire
+type fixtureSegment struct {
+	fromClient bool
+	data       []byte
+}
+
+// read a conversation of testdata, lines are "client <hex>" or "server <hex>", # starts a comment
+func readFixture(t testing.TB, name string) []fixtureSegment {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var segments []fixtureSegment
+	s := bufio.NewScanner(f)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || (fields[0] != "client" && fields[0] != "server") {
+			t.Fatalf("%v:%v: expected client or server followed by hex bytes", name, line)
+		}
+		data, err := hex.DecodeString(fields[1])
+		if err != nil {
+			t.Fatalf("%v:%v: %v", name, line, err)
+		}
+		segments = append(segments, fixtureSegment{fromClient: fields[0] == "client", data: data})
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+// replay the segments of a fixture on conv, the client ones as they were captured, already xored
+func replayFixture(t testing.TB, conv *TCPConversation, segments []fixtureSegment) {
+	t.Helper()
+	for _, seg := range segments {
+		var err error
+		if seg.fromClient {
+			err = conv.FromClient(seg.data)
+		} else {
+			err = conv.FromServer(seg.data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a line of a golden file per packet: flow name, direction, operation code and payload
+func goldenLines(events []PacketEvent) string {
+	var b strings.Builder
+	for _, pe := range events {
+		fmt.Fprintf(&b, "%v %v %v %x\n", pe.FlowName, pe.Direction, pe.Packet.Base.OperationCode, pe.Packet.Base.Data)
+	}
+	return b.String()
+}
+
+// compare got with the golden file of testdata, or rewrite it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("decoded packets differ from %v, run with -update if the change is expected\ngot:\n%vwant:\n%v", path, got, want)
+	}
+}
+
+// the login handshake of testdata/handshake.hex, recorded on the client side: the seed, the version check, the login and its answer
+func TestGoldenHandshake(t *testing.T) {
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, sink := runPipeline(t, testConfig(), ms)
+	events := sink.byDirection()
+	checkGolden(t, "handshake.golden", goldenLines(events))
+
+	for _, pe := range events {
+		if pe.FlowName != "login-client" {
+			t.Errorf("flow name %q, expected login-client", pe.FlowName)
+		}
+	}
+	if got := payloadsOf(events, opVersionCheck); len(got) != 1 {
+		t.Fatalf("%v version checks decoded, expected 1, is the xor key discovered from the seed?", len(got))
+	}
+	summary := sn.Summary()
+	if len(summary) != 1 {
+		t.Fatalf("%v flows, expected 1", len(summary))
+	}
+	if summary[0].DecodeErrors != 0 {
+		t.Errorf("%v decode errors", summary[0].DecodeErrors)
+	}
+}
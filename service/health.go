@@ -0,0 +1,81 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// healthStatus is the json returned by GET /healthz
+type healthStatus struct {
+	// ok, idle if packets are required and none arrived within the window, stopped once the capture is over
+	Status    string `json:"status"`
+	Capturing bool   `json:"capturing"`
+	// interface or pcap file packets are read from
+	Source     string     `json:"source"`
+	LastPacket *time.Time `json:"lastPacket,omitempty"`
+	// whether a packet was read within ui.health.window
+	RecentPackets bool    `json:"recentPackets"`
+	Window        float64 `json:"windowSeconds"`
+}
+
+// when the source handed over its last packet, zero if none yet
+func (sn *Sniffer) lastPacketSeen() time.Time {
+	ns := atomic.LoadInt64(&sn.lastPacket)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+func (sn *Sniffer) health(window time.Duration, requirePackets bool) healthStatus {
+	h := healthStatus{
+		Status:    "ok",
+		Capturing: sn.stopCapture != nil,
+		Source:    sn.config.Interface,
+		Window:    window.Seconds(),
+	}
+	if len(sn.config.Interfaces) > 0 {
+		h.Source = strings.Join(sn.config.Interfaces, ",")
+	}
+	if sn.config.PcapFile != "" {
+		h.Source = sn.config.PcapFile
+	}
+	select {
+	case <-sn.Done():
+		h.Capturing = false
+	default:
+	}
+
+	if last := sn.lastPacketSeen(); !last.IsZero() {
+		h.LastPacket = &last
+		h.RecentPackets = time.Since(last) <= window
+	}
+
+	switch {
+	case !h.Capturing:
+		h.Status = "stopped"
+	case requirePackets && !h.RecentPackets:
+		h.Status = "idle"
+	}
+	return h
+}
+
+// GET /healthz answers 200 while the capture is running, 503 once it stopped
+// with ui.health.requirePackets it also answers 503 if no packet was read within ui.health.window
+func (sn *Sniffer) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window := sn.config.HealthWindow
+	if window <= 0 {
+		window = time.Minute
+	}
+	h := sn.health(window, sn.config.HealthRequirePackets)
+	if h.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, h)
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the heatmap counts operation codes per second, GET /api/heatmap adds the seconds up into the bucket size asked for
+const heatmapResolution = time.Second
+
+const defaultHeatmapBucket = 10 * time.Second
+
+// opCodeHeatmap counts the decoded packets of every flow name by operation code and second of capture time
+// so pcap files are bucketed by their own clock, seconds older than retention are evicted as new ones start
+type opCodeHeatmap struct {
+	retention time.Duration
+	// flow name => second => operation code => packets
+	flows map[string]map[int64]map[uint16]int
+	// the latest second counted, eviction is measured from it
+	latest int64
+	mu     sync.Mutex
+}
+
+func newOpCodeHeatmap(retention time.Duration) *opCodeHeatmap {
+	return &opCodeHeatmap{
+		retention: retention,
+		flows:     make(map[string]map[int64]map[uint16]int),
+	}
+}
+
+func (h *opCodeHeatmap) add(flowName string, dp decodedPacket) {
+	if h == nil {
+		return
+	}
+	second := dp.seen.Truncate(heatmapResolution).Unix()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if second > h.latest {
+		h.latest = second
+		h.evict()
+	}
+	seconds, ok := h.flows[flowName]
+	if !ok {
+		seconds = make(map[int64]map[uint16]int)
+		h.flows[flowName] = seconds
+	}
+	counts, ok := seconds[second]
+	if !ok {
+		counts = make(map[uint16]int)
+		seconds[second] = counts
+	}
+	counts[dp.packet.Base.OperationCode]++
+}
+
+// called with the lock held
+func (h *opCodeHeatmap) evict() {
+	if h.retention <= 0 {
+		return
+	}
+	oldest := h.latest - int64(h.retention/time.Second)
+	for flowName, seconds := range h.flows {
+		for second := range seconds {
+			if second <= oldest {
+				delete(seconds, second)
+			}
+		}
+		if len(seconds) == 0 {
+			delete(h.flows, flowName)
+		}
+	}
+}
+
+// heatmapRow is the number of packets of an operation code in each bucket of a flow
+type heatmapRow struct {
+	OperationCode uint16 `json:"operationCode"`
+	Command       string `json:"command"`
+	Total         int    `json:"total"`
+	Counts        []int  `json:"counts"`
+}
+
+// heatmapFlow is the matrix of a flow name, a column per bucket from its first to its last one, a row per operation code
+type heatmapFlow struct {
+	FlowName string       `json:"flowName"`
+	Buckets  []time.Time  `json:"buckets"`
+	Rows     []heatmapRow `json:"operationCodes"`
+}
+
+// heatmapView is the json returned by GET /api/heatmap
+type heatmapView struct {
+	BucketSeconds int64         `json:"bucketSeconds"`
+	Flows         []heatmapFlow `json:"flows"`
+}
+
+func (h *opCodeHeatmap) view(p *protocol, bucket time.Duration) heatmapView {
+	size := int64(bucket / heatmapResolution)
+	hv := heatmapView{
+		BucketSeconds: size,
+		Flows:         []heatmapFlow{},
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for flowName, seconds := range h.flows {
+		first, last := int64(-1), int64(-1)
+		for second := range seconds {
+			b := second - second%size
+			if first == -1 || b < first {
+				first = b
+			}
+			if b > last {
+				last = b
+			}
+		}
+		if first == -1 {
+			continue
+		}
+
+		hf := heatmapFlow{FlowName: flowName}
+		columns := int((last-first)/size) + 1
+		for i := 0; i < columns; i++ {
+			hf.Buckets = append(hf.Buckets, time.Unix(first+int64(i)*size, 0).UTC())
+		}
+		rows := make(map[uint16]*heatmapRow)
+		for second, counts := range seconds {
+			column := (second - second%size - first) / size
+			for opCode, n := range counts {
+				row, ok := rows[opCode]
+				if !ok {
+					row = &heatmapRow{
+						OperationCode: opCode,
+						Command:       p.commandName(opCode),
+						Counts:        make([]int, columns),
+					}
+					rows[opCode] = row
+				}
+				row.Counts[column] += n
+				row.Total += n
+			}
+		}
+		for _, row := range rows {
+			hf.Rows = append(hf.Rows, *row)
+		}
+		// the busiest operation codes first
+		sort.Slice(hf.Rows, func(i, j int) bool {
+			if hf.Rows[i].Total != hf.Rows[j].Total {
+				return hf.Rows[i].Total > hf.Rows[j].Total
+			}
+			return hf.Rows[i].OperationCode < hf.Rows[j].OperationCode
+		})
+		hv.Flows = append(hv.Flows, hf)
+	}
+	sort.Slice(hv.Flows, func(i, j int) bool {
+		return hv.Flows[i].FlowName < hv.Flows[j].FlowName
+	})
+	return hv
+}
+
+// GET /api/heatmap?bucket=30s counts the packets of every flow name by operation code and bucket, 10s buckets by default
+// buckets are whole seconds, only the last ui.heatmap.retention of capture time is kept
+func (sn *Sniffer) heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bucket := defaultHeatmapBucket
+	if v := r.URL.Query().Get("bucket"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < heatmapResolution {
+			http.Error(w, "bucket: must be a duration of at least 1s, e.g 30s", http.StatusBadRequest)
+			return
+		}
+		bucket = d.Truncate(heatmapResolution)
+	}
+	writeJSON(w, sn.heatmap.view(sn.protocol, bucket))
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.core/networking"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a packet of opCode seen that many seconds after testStart
+func heatmapPacket(opCode uint16, seconds float64) decodedPacket {
+	return decodedPacket{
+		seen:   testStart.Add(time.Duration(seconds * float64(time.Second))),
+		packet: &networking.Command{Base: networking.CommandBase{OperationCode: opCode}},
+	}
+}
+
+func TestHeatmapView(t *testing.T) {
+	p := testProtocol(t)
+	h := newOpCodeHeatmap(time.Hour)
+	for _, s := range []float64{0, 0.5, 9.9, 25} {
+		h.add("zone-client", heatmapPacket(opChatReq, s))
+	}
+	h.add("zone-client", heatmapPacket(opLoginReq, 12))
+	h.add("login-client", heatmapPacket(opLoginAck, 3))
+
+	hv := h.view(p, 10*time.Second)
+	expected := heatmapView{
+		BucketSeconds: 10,
+		Flows: []heatmapFlow{
+			{
+				FlowName: "login-client",
+				Buckets:  []time.Time{testStart},
+				Rows: []heatmapRow{
+					{OperationCode: opLoginAck, Command: p.commandName(opLoginAck), Total: 1, Counts: []int{1}},
+				},
+			},
+			{
+				FlowName: "zone-client",
+				Buckets:  []time.Time{testStart, testStart.Add(10 * time.Second), testStart.Add(20 * time.Second)},
+				Rows: []heatmapRow{
+					{OperationCode: opChatReq, Command: p.commandName(opChatReq), Total: 4, Counts: []int{3, 0, 1}},
+					{OperationCode: opLoginReq, Command: p.commandName(opLoginReq), Total: 1, Counts: []int{0, 1, 0}},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(hv, expected) {
+		t.Errorf("heatmap\n%+v\nexpected\n%+v", hv, expected)
+	}
+
+	var none *opCodeHeatmap
+	none.add("zone-client", heatmapPacket(opChatReq, 0))
+}
+
+// seconds older than the retention are dropped as newer ones are counted, flows without seconds go with them
+func TestHeatmapRetention(t *testing.T) {
+	p := testProtocol(t)
+	h := newOpCodeHeatmap(30 * time.Second)
+	h.add("login-client", heatmapPacket(opLoginReq, 0))
+	h.add("zone-client", heatmapPacket(opChatReq, 5))
+	h.add("zone-client", heatmapPacket(opChatReq, 40))
+
+	hv := h.view(p, time.Second)
+	if len(hv.Flows) != 1 || hv.Flows[0].FlowName != "zone-client" {
+		t.Fatalf("flows %+v, expected only zone-client", hv.Flows)
+	}
+	if b := hv.Flows[0].Buckets; len(b) != 1 || !b[0].Equal(testStart.Add(40*time.Second)) {
+		t.Errorf("buckets %v, expected only the second 40", b)
+	}
+}
+
+func TestHeatmapHandler(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn.heatmap = newOpCodeHeatmap(time.Hour)
+	sn.heatmap.add("zone-client", heatmapPacket(opChatReq, 0))
+	tests := []struct {
+		method, query string
+		status        int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, "bucket=1m", http.StatusOK},
+		{http.MethodGet, "bucket=500ms", http.StatusBadRequest},
+		{http.MethodGet, "bucket=often", http.StatusBadRequest},
+		{http.MethodPost, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		sn.heatmapHandler(w, httptest.NewRequest(tt.method, "/api/heatmap?"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("%v %q: status %v, expected %v", tt.method, tt.query, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/hex"
+	"gopkg.in/restruct.v1"
+	"reflect"
+	"strings"
+)
+
+const hexDumpRowSize = 16
+
+// HexDumpRow is one line of a hex dump, 16 bytes of payload at Offset
+type HexDumpRow struct {
+	Offset int    `json:"offset"`
+	Hex    string `json:"hex"`
+	ASCII  string `json:"ascii"`
+}
+
+// Field is the byte range a struct field was unpacked from
+type Field struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// hex dump of a payload, bytes outside the printable ascii range are shown as dots
+func hexDump(data []byte) []HexDumpRow {
+	rows := make([]HexDumpRow, 0, (len(data)+hexDumpRowSize-1)/hexDumpRowSize)
+	for offset := 0; offset < len(data); offset += hexDumpRowSize {
+		end := offset + hexDumpRowSize
+		if end > len(data) {
+			end = len(data)
+		}
+		row := data[offset:end]
+
+		hexBytes := make([]string, len(row))
+		var ascii strings.Builder
+		for i, b := range row {
+			hexBytes[i] = hex.EncodeToString([]byte{b})
+			if b >= 0x20 && b < 0x7f {
+				ascii.WriteByte(b)
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+
+		rows = append(rows, HexDumpRow{
+			Offset: offset,
+			Hex:    strings.Join(hexBytes, " "),
+			ASCII:  ascii.String(),
+		})
+	}
+	return rows
+}
+
+// byte ranges of the top level fields of an unpacked struct, in payload order
+// nothing is returned if the field sizes don't add up to the struct size, e.g because of restruct tags
+func structFields(nc interface{}) []Field {
+	v := reflect.Indirect(reflect.ValueOf(nc))
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	total, err := restruct.SizeOf(nc)
+	if err != nil {
+		return nil
+	}
+
+	var (
+		fields []Field
+		offset int
+	)
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("struct") == "-" {
+			continue
+		}
+		n, err := restruct.SizeOf(v.Field(i).Interface())
+		if err != nil {
+			return nil
+		}
+		fields = append(fields, Field{
+			Name:   f.Name,
+			Offset: offset,
+			Length: n,
+		})
+		offset += n
+	}
+
+	if offset != total {
+		return nil
+	}
+	return fields
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHexDump(t *testing.T) {
+	data := []byte("Tarian says\x00\x01\xff hello there")
+	expected := []HexDumpRow{
+		{Offset: 0, Hex: "54 61 72 69 61 6e 20 73 61 79 73 00 01 ff 20 68", ASCII: "Tarian says... h"},
+		{Offset: 16, Hex: "65 6c 6c 6f 20 74 68 65 72 65", ASCII: "ello there"},
+	}
+	if rows := hexDump(data); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("hex dump %+v, expected %+v", rows, expected)
+	}
+	if rows := hexDump(nil); rows == nil || len(rows) != 0 {
+		t.Errorf("hex dump of nothing %#v, expected no rows", rows)
+	}
+	if rows := hexDump(make([]byte, hexDumpRowSize)); len(rows) != 1 {
+		t.Errorf("%v rows for one full row", len(rows))
+	}
+}
+
+func TestStructFields(t *testing.T) {
+	type login struct {
+		UserName [18]byte
+		Password [16]byte
+		Spare    uint8
+	}
+	expected := []Field{
+		{Name: "UserName", Offset: 0, Length: 18},
+		{Name: "Password", Offset: 18, Length: 16},
+		{Name: "Spare", Offset: 34, Length: 1},
+	}
+	if fields := structFields(&login{}); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("fields %+v, expected %+v", fields, expected)
+	}
+
+	type skipped struct {
+		Handle  uint16
+		Ignored uint32 `struct:"-"`
+		Level   uint8
+	}
+	expected = []Field{
+		{Name: "Handle", Offset: 0, Length: 2},
+		{Name: "Level", Offset: 2, Length: 1},
+	}
+	if fields := structFields(skipped{}); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("fields with a skipped one %+v, expected %+v", fields, expected)
+	}
+
+	// the tag widens the field past what its own type says, the ranges can't be told
+	type retyped struct {
+		Handle uint16 `struct:"uint32"`
+	}
+	if fields := structFields(&retyped{}); fields != nil {
+		t.Errorf("fields of a retyped struct %+v, expected none", fields)
+	}
+	if fields := structFields(42); fields != nil {
+		t.Errorf("fields of a number %+v", fields)
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+// packetHistory keeps the last decoded packets of a stream so they can be replayed to late UI clients
+// once full, the oldest packet is overwritten
+type packetHistory struct {
+	packets []PacketEvent
+	start   int
+	n       int
+	mu      sync.Mutex
+}
+
+func newPacketHistory(size int) *packetHistory {
+	return &packetHistory{
+		packets: make([]PacketEvent, size),
+	}
+}
+
+func (ph *packetHistory) add(pe PacketEvent) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if len(ph.packets) == 0 {
+		return
+	}
+	if ph.n < len(ph.packets) {
+		ph.packets[(ph.start+ph.n)%len(ph.packets)] = pe
+		ph.n++
+		return
+	}
+	ph.packets[ph.start] = pe
+	ph.start = (ph.start + 1) % len(ph.packets)
+}
+
+// the buffered packets, oldest first
+func (ph *packetHistory) snapshot() []PacketEvent {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	packets := make([]PacketEvent, 0, ph.n)
+	for i := 0; i < ph.n; i++ {
+		packets = append(packets, ph.packets[(ph.start+i)%len(ph.packets)])
+	}
+	return packets
+}
+
+// the buffered packets of every active stream, in the order they were seen
+func (sn *Sniffer) history() []PacketEvent {
+	sn.streams.mu.Lock()
+	streams := make([]*shineStream, 0, len(sn.streams.streams))
+	for _, ss := range sn.streams.streams {
+		streams = append(streams, ss)
+	}
+	sn.streams.mu.Unlock()
+
+	var packets []PacketEvent
+	for _, ss := range streams {
+		if ss.history != nil {
+			packets = append(packets, ss.history.snapshot()...)
+		}
+	}
+	sort.SliceStable(packets, func(i, j int) bool {
+		return packets[i].Seen.Before(packets[j].Seen)
+	})
+	return packets
+}
@@ -0,0 +1,340 @@
+package service
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/reassembly"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// frameWriter is the part of the pcap handle the injector uses
+type frameWriter interface {
+	WritePacketData(data []byte) error
+	Close()
+}
+
+// injector writes crafted shine packets into live connections for fuzzing test servers, only with injection.enabled
+// frames go out on the capture interface with the sequence numbers the flow's sequences tracked from the capture
+type injector struct {
+	handle   frameWriter
+	iface    string
+	injected uint64
+	mu       sync.Mutex
+}
+
+func openInjector(c Config) (*injector, error) {
+	if len(c.Interfaces) > 0 {
+		return nil, fmt.Errorf("injection.enabled: packets can only be written to network.interface, not to network.interfaces")
+	}
+	handle, err := pcap.OpenLive(c.Interface, int32(c.Snaplen), false, pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("injection.enabled: error opening pcap handle on %v: %v", c.Interface, captureSetupError(c.Interface, err))
+	}
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		handle.Close()
+		return nil, fmt.Errorf("injection.enabled: %v is a %v interface, frames can only be written to ethernet interfaces", c.Interface, handle.LinkType())
+	}
+	return &injector{handle: handle, iface: c.Interface}, nil
+}
+
+func (inj *injector) write(frame []byte) error {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	if err := inj.handle.WritePacketData(frame); err != nil {
+		return err
+	}
+	atomic.AddUint64(&inj.injected, 1)
+	return nil
+}
+
+func (inj *injector) count() uint64 {
+	if inj == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&inj.injected)
+}
+
+func (inj *injector) close() {
+	if inj == nil {
+		return
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.handle.Close()
+}
+
+// tcpSide is one direction of a connection as the capture saw it
+type tcpSide struct {
+	seen             bool
+	srcMAC, dstMAC   net.HardwareAddr
+	srcIP, dstIP     net.IP
+	srcPort, dstPort layers.TCPPort
+	// the sequence number of the next byte the side sends
+	next   uint32
+	ack    uint32
+	window uint16
+	// payload bytes of the side up to next, compared with what its decoder went through
+	bytes uint64
+	// why next can't be trusted, empty if it can, cleared by the next segment that starts at next
+	uncertain string
+	// the last injected segment, so its capture isn't taken for one of the endpoint
+	injectedSeq, injectedEnd uint32
+}
+
+// decoderPosition is where the decoder of a direction is in its stream
+type decoderPosition struct {
+	consumed  uint64
+	xorOffset uint16
+	xored     bool
+	// the key and limit the decoder xors with, the client decoder changes them for other client versions or a drift
+	xor XorSettings
+	// the xor offset, or that there is none, is known and the decoder isn't resynchronizing
+	known bool
+}
+
+// flowSequences tracks the sequence numbers of both directions of a stream and where its decoders are,
+// injecting is refused unless both tell exactly where the next byte goes and how it's xored
+type flowSequences struct {
+	client, server tcpSide
+	clientDecoder  decoderPosition
+	serverDecoder  decoderPosition
+	closed         string
+	mu             sync.Mutex
+}
+
+func (fs *flowSequences) side(outbound bool) (*tcpSide, *decoderPosition) {
+	if outbound {
+		return &fs.client, &fs.clientDecoder
+	}
+	return &fs.server, &fs.serverDecoder
+}
+
+// a before b, with the sequence numbers wrapping around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// track a tcp packet the assembler accepted, outbound if the game client sent it
+func (fs *flowSequences) observe(tcp *layers.TCP, outbound bool, src, dst gopacket.Endpoint, ac reassembly.AssemblerContext) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if tcp.RST {
+		fs.closed = "the connection was reset"
+	} else if tcp.FIN && fs.closed == "" {
+		fs.closed = "the connection is closing"
+	}
+
+	s, _ := fs.side(outbound)
+	n := uint32(len(tcp.Payload))
+	end := tcp.Seq + n
+	if tcp.SYN || tcp.FIN {
+		end++
+	}
+	if tcp.ACK {
+		s.ack = tcp.Ack
+	}
+	s.window = tcp.Window
+	if s.injectedEnd != 0 && tcp.Seq == s.injectedSeq && end == s.injectedEnd {
+		// the capture of our own segment
+		return
+	}
+	if !s.seen {
+		s.seen = true
+		s.srcIP, s.dstIP = net.IP(src.Raw()), net.IP(dst.Raw())
+		s.srcPort, s.dstPort = tcp.SrcPort, tcp.DstPort
+		if c, ok := ac.(Context); ok && c.ethernet != nil {
+			s.srcMAC, s.dstMAC = c.ethernet.SrcMAC, c.ethernet.DstMAC
+		}
+		s.next, s.bytes = end, uint64(n)
+		return
+	}
+	if tcp.Seq != s.next && n > 0 {
+		s.uncertain = fmt.Sprintf("segment at sequence number %v while %v was expected", tcp.Seq, s.next)
+	} else if tcp.Seq == s.next {
+		s.uncertain = ""
+	}
+	if seqBefore(s.next, end) {
+		// only the bytes past next are new, as the assembler hands them to the decoder
+		from := s.next
+		if seqBefore(from, tcp.Seq) {
+			from = tcp.Seq
+		}
+		if n > 0 {
+			s.bytes += uint64(end - from)
+		}
+		s.next = end
+	}
+}
+
+// called by a decoder once it handled what it had, consumed is how far in the stream it got
+func (fs *flowSequences) decoded(outbound bool, dp decoderPosition) {
+	fs.mu.Lock()
+	_, d := fs.side(outbound)
+	*d = dp
+	fs.mu.Unlock()
+}
+
+// injectRequest is the body of POST /api/inject
+type injectRequest struct {
+	FlowID string `json:"flowID"`
+	// outbound to send it as the client, inbound as the server
+	Direction string `json:"direction"`
+	// operation code or command name
+	OpCode  string `json:"opcode"`
+	Payload string `json:"payload"`
+}
+
+// injectResult is what was written, Seq and Ack are the ones of the tcp segment
+type injectResult struct {
+	FlowID        string `json:"flowID"`
+	FlowName      string `json:"flowName"`
+	Direction     string `json:"direction"`
+	OperationCode uint16 `json:"operationCode"`
+	Command       string `json:"command"`
+	Length        int    `json:"length"`
+	Seq           uint32 `json:"seq"`
+	Ack           uint32 `json:"ack"`
+	// the xor offset the packet was xored from, nil if it wasn't
+	XorOffset *uint16 `json:"xorOffset"`
+}
+
+// frame a packet as the side sends it, xored from the offset the decoder of the direction is at, and write it
+// to the interface with the next sequence number of the side, refused if any of that isn't certain
+func (ss *shineStream) inject(inj *injector, outbound bool, opCode uint16, payload []byte) (injectResult, error) {
+	fs := ss.sequences
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	s, d := fs.side(outbound)
+	peer, _ := fs.side(!outbound)
+	direction := "inbound"
+	if outbound {
+		direction = "outbound"
+	}
+	switch {
+	case fs.closed != "":
+		return injectResult{}, fmt.Errorf("%v", fs.closed)
+	case !s.seen || !peer.seen:
+		return injectResult{}, fmt.Errorf("both directions have to be seen before injecting")
+	case s.srcMAC == nil:
+		return injectResult{}, fmt.Errorf("the %v frames weren't captured on ethernet", direction)
+	case s.uncertain != "":
+		return injectResult{}, fmt.Errorf("the %v sequence number is uncertain, %v", direction, s.uncertain)
+	case peer.uncertain != "":
+		return injectResult{}, fmt.Errorf("the sequence number to acknowledge is uncertain, %v", peer.uncertain)
+	case !d.known:
+		return injectResult{}, fmt.Errorf("the %v xor offset isn't known", direction)
+	case d.consumed != s.bytes:
+		return injectResult{}, fmt.Errorf("the %v decoder went through %v of %v bytes, retry once it caught up", direction, d.consumed, s.bytes)
+	}
+
+	packet := EncodeShinePacket(opCode, payload)
+	if len(packet) > maxSegmentSize {
+		return injectResult{}, fmt.Errorf("a packet of %v bytes doesn't fit a segment of %v", len(packet), maxSegmentSize)
+	}
+	result := injectResult{
+		FlowID:        ss.flowID,
+		FlowName:      ss.flowName,
+		Direction:     direction,
+		OperationCode: opCode,
+		Command:       ss.commandName(opCode),
+		Length:        len(packet),
+		Seq:           s.next,
+		Ack:           peer.next,
+	}
+	if d.xored {
+		// only the packet body is xored, not its length header
+		offset := d.xorOffset
+		result.XorOffset = &offset
+		skip := 1
+		if packet[0] == 0 {
+			skip = 3
+		}
+		o := d.xorOffset
+		d.xor.cipher(packet[skip:], &o)
+	}
+
+	tcp := &layers.TCP{
+		SrcPort: s.srcPort,
+		DstPort: s.dstPort,
+		Seq:     s.next,
+		Ack:     peer.next,
+		ACK:     true,
+		PSH:     true,
+		Window:  s.window,
+	}
+	frame, err := tcpFrame(s.srcMAC, s.dstMAC, s.srcIP, s.dstIP, tcp, packet)
+	if err != nil {
+		return injectResult{}, err
+	}
+	if err := inj.write(frame); err != nil {
+		return injectResult{}, err
+	}
+	s.injectedSeq, s.injectedEnd = s.next, s.next+uint32(len(packet))
+	s.next = s.injectedEnd
+	s.bytes += uint64(len(packet))
+	return result, nil
+}
+
+// POST /api/inject writes a packet into a live flow, only served with injection.enabled
+func (sn *Sniffer) injectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !allowChange(w, r) {
+		return
+	}
+	if sn.injector == nil {
+		http.Error(w, "injection needs a live capture", http.StatusConflict)
+		return
+	}
+	var req injectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var outbound bool
+	switch req.Direction {
+	case "outbound":
+		outbound = true
+	case "inbound":
+	default:
+		http.Error(w, fmt.Sprintf("direction: %q, expected outbound or inbound", req.Direction), http.StatusBadRequest)
+		return
+	}
+	opCode, err := sn.protocol.parseOpCode(req.OpCode)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("opcode: %v", err), http.StatusBadRequest)
+		return
+	}
+	payload, err := hex.DecodeString(req.Payload)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	sn.streams.mu.Lock()
+	ss, ok := sn.streams.streams[req.FlowID]
+	sn.streams.mu.Unlock()
+	if !ok || ss.sequences == nil {
+		http.Error(w, fmt.Sprintf("flow %v isn't open", req.FlowID), http.StatusNotFound)
+		return
+	}
+
+	result, err := ss.inject(sn.injector, outbound, opCode, payload)
+	if err != nil {
+		log.Warningf("[%v] injection of %v %v refused: %v", ss.flowName, req.Direction, opCode, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Warningf("[%v] INJECTED %v packet %v (%v) of %v bytes at seq %v from %v", ss.flowName, result.Direction, opCode, result.Command, result.Length, result.Seq, r.RemoteAddr)
+	writeJSON(w, result)
+}
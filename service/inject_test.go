@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/pprof"
+	"strings"
+	"testing"
+)
+
+// fakeFrameWriter keeps the frames instead of writing them to an interface
+type fakeFrameWriter struct {
+	frames [][]byte
+}
+
+func (fw *fakeFrameWriter) WritePacketData(data []byte) error {
+	fw.frames = append(fw.frames, append([]byte(nil), data...))
+	return nil
+}
+
+func (fw *fakeFrameWriter) Close() {}
+
+// a stream whose sides were both seen and whose client decoder is at dp, caught up with the capture
+func injectableStream(dp decoderPosition) *shineStream {
+	side := func(src, dst string, srcPort, dstPort layers.TCPPort) tcpSide {
+		return tcpSide{
+			seen:    true,
+			srcIP:   net.ParseIP(src).To4(),
+			dstIP:   net.ParseIP(dst).To4(),
+			srcPort: srcPort,
+			dstPort: dstPort,
+			srcMAC:  net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			dstMAC:  net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			next:    1000,
+			bytes:   dp.consumed,
+			window:  512,
+		}
+	}
+	dp.known = true
+	return &shineStream{
+		flowID:   "flow",
+		flowName: "login-client",
+		xor:      testXorSettings(),
+		sniffer:  &Sniffer{protocol: loadProtocol(testConfig().CommandsFile, "")},
+		sequences: &flowSequences{
+			client:        side("192.168.1.20", "192.168.1.10", 50000, 9010),
+			server:        side("192.168.1.10", "192.168.1.20", 9010, 50000),
+			clientDecoder: dp,
+		},
+	}
+}
+
+// the tcp payload of an injected frame
+func injectedPayload(t *testing.T, frame []byte) []byte {
+	t.Helper()
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		t.Fatalf("no tcp segment in %x", frame)
+	}
+	return tcp.Payload
+}
+
+// injected packets are xored with the settings the decoder of the direction uses, which can differ from the configured ones
+func TestInjectXorsWithDecoderSettings(t *testing.T) {
+	configured := testXorSettings()
+	otherKey := XorSettings{Key: append([]byte(nil), configured.Key...), Limit: configured.Limit}
+	for i := range otherKey.Key {
+		otherKey.Key[i] ^= 0x5a
+	}
+	tests := []struct {
+		name string
+		dp   decoderPosition
+	}{
+		{"configured key", decoderPosition{xorOffset: 20, xored: true, xor: configured}},
+		{"key of another client version", decoderPosition{xorOffset: 20, xored: true, xor: otherKey}},
+		// the packet wraps around the corrected limit, but not around protocol.xorLimit
+		{"corrected limit", decoderPosition{xorOffset: 98, xored: true, xor: XorSettings{Key: configured.Key, Limit: 100}}},
+		{"not xored", decoderPosition{consumed: 64}},
+	}
+	payload := []byte{0x11, 0x22, 0x33, 0x44, 0x55}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fw := &fakeFrameWriter{}
+			ss := injectableStream(tt.dp)
+			result, err := ss.inject(&injector{handle: fw}, true, opLoginReq, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fw.frames) != 1 {
+				t.Fatalf("%v frames written, expected 1", len(fw.frames))
+			}
+
+			expected := EncodeShinePacket(opLoginReq, payload)
+			if tt.dp.xored {
+				o := tt.dp.xorOffset
+				tt.dp.xor.cipher(expected[1:], &o)
+				if result.XorOffset == nil || *result.XorOffset != tt.dp.xorOffset {
+					t.Errorf("xor offset %v in the result, expected %v", result.XorOffset, tt.dp.xorOffset)
+				}
+			}
+			if got := injectedPayload(t, fw.frames[0]); !bytes.Equal(got, expected) {
+				t.Errorf("injected %x, expected %x", got, expected)
+			}
+		})
+	}
+}
+
+// a page open in the browser can't pause, reload, inject or register a service, it can neither send json nor come from
+// the ui origin
+func TestChangeRequestsRefused(t *testing.T) {
+	c := testConfig()
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/api/capture/pause": sn.captureHandler,
+		"/api/reload":        sn.reloadHandler,
+		"/api/inject":        sn.injectHandler,
+		"/api/services":      sn.servicesHandler,
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		status      int
+	}{
+		{"no content type", "", "", http.StatusUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"text", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"json from another origin", "application/json", "http://evil.example", http.StatusForbidden},
+		{"form from another origin", "text/plain", "http://evil.example", http.StatusForbidden},
+	}
+	for path, handler := range handlers {
+		for _, tt := range tests {
+			// a service the refused requests would register
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"port": 9299, "name": "zone99"}`))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Errorf("%v %v: status %v, expected %v", path, tt.name, w.Code, tt.status)
+			}
+		}
+	}
+	if sn.Paused() {
+		t.Error("a refused request paused forwarding")
+	}
+	if _, ok := sn.services.serviceForPort(9299); ok {
+		t.Error("a refused request registered a service")
+	}
+
+	// the ui itself sends json from its own origin
+	r := httptest.NewRequest(http.MethodPost, "/api/capture/pause", nil)
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Origin", "http://"+r.Host)
+	w := httptest.NewRecorder()
+	sn.captureHandler(w, r)
+	if w.Code != http.StatusOK || !sn.Paused() {
+		t.Errorf("status %v, paused %v, expected forwarding to be paused", w.Code, sn.Paused())
+	}
+}
+
+// on a listener that isn't loopback, e.g capture --container, changes, injection and pprof need the bearer token
+func TestChangeRequestsNeedToken(t *testing.T) {
+	defer viper.Set("ui.listen", viper.Get("ui.listen"))
+	defer viper.Set("ui.token", viper.Get("ui.token"))
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/api/capture/pause":  sn.captureHandler,
+		"/api/reload":         sn.reloadHandler,
+		"/api/inject":         sn.injectHandler,
+		"/api/services":       sn.servicesHandler,
+		"/debug/pprof/symbol": requireToken(pprof.Symbol),
+	}
+	tests := []struct {
+		name, listen, token, auth string
+		status                    int
+	}{
+		{"any interface without a token", "0.0.0.0", "", "", http.StatusForbidden},
+		{"no bearer token", "0.0.0.0", "secret", "", http.StatusUnauthorized},
+		{"wrong bearer token", "0.0.0.0", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"basic auth", "0.0.0.0", "secret", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"loopback without the token it has", "127.0.0.1", "secret", "", http.StatusUnauthorized},
+	}
+	for path, handler := range handlers {
+		for _, tt := range tests {
+			viper.Set("ui.listen", tt.listen)
+			viper.Set("ui.token", tt.token)
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"port": 9299, "name": "zone99"}`))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Errorf("%v %v: status %v, expected %v", path, tt.name, w.Code, tt.status)
+			}
+		}
+	}
+	if sn.Paused() {
+		t.Error("an unauthorized request paused forwarding")
+	}
+
+	for _, listen := range []string{"", "localhost", "127.0.0.1", "::1", "0.0.0.0", "192.168.1.10"} {
+		viper.Set("ui.listen", listen)
+		if loopbackListener() != (listen != "0.0.0.0" && listen != "192.168.1.10") {
+			t.Errorf("%q loopback %v", listen, loopbackListener())
+		}
+	}
+
+	viper.Set("ui.listen", "0.0.0.0")
+	viper.Set("ui.token", "secret")
+	r := httptest.NewRequest(http.MethodPost, "/api/capture/pause", nil)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	sn.captureHandler(w, r)
+	if w.Code != http.StatusOK || !sn.Paused() {
+		t.Errorf("status %v, paused %v with the token", w.Code, sn.Paused())
+	}
+}
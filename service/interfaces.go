@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// packetReader is implemented by the sources that can be merged by interfaceSources
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+type capturedFrame struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	// set once the interface stopped capturing
+	err  error
+	name string
+}
+
+// interfaceSources captures on every interface in network.interfaces at once, with the backend in network.backend
+// their packets are read concurrently and merged into a single source, so the assembler sees a connection once
+// even if it moves from an interface to another, packets seen on more than one are handled like retransmissions
+type interfaceSources struct {
+	names    []string
+	sources  []PacketSourceProvider
+	linkType layers.LinkType
+	frames   chan capturedFrame
+	readers  sync.WaitGroup
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// open a source per interface, an interface that can't be opened fails them all unless bestEffort is set,
+// then it is only logged and the capture goes on with the others
+func openInterfaceSources(c Config, open func(Config) (PacketSourceProvider, error)) (PacketSourceProvider, error) {
+	is := &interfaceSources{
+		frames: make(chan capturedFrame, 1024),
+		closed: make(chan struct{}),
+	}
+	var failed []string
+	for _, name := range c.Interfaces {
+		ic := c
+		ic.Interface = name
+		s, err := open(ic)
+		if err == nil {
+			if _, ok := s.(packetReader); !ok {
+				s.Close()
+				err = fmt.Errorf("network.backend %v can't capture on several interfaces", c.Backend)
+			}
+		}
+		if err == nil && len(is.sources) > 0 && s.LinkType() != is.linkType {
+			s.Close()
+			err = fmt.Errorf("link type %v differs from the %v of %v", s.LinkType(), is.linkType, is.names[0])
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", name, err))
+			log.Errorf("interface %v: %v", name, err)
+			continue
+		}
+		if len(is.sources) == 0 {
+			is.linkType = s.LinkType()
+		}
+		is.names = append(is.names, name)
+		is.sources = append(is.sources, s)
+		log.Infof("capturing on interface %v", name)
+	}
+
+	if len(failed) > 0 && (!c.BestEffort || len(is.sources) == 0) {
+		for _, s := range is.sources {
+			s.Close()
+		}
+		return nil, fmt.Errorf("error opening interfaces, %v", strings.Join(failed, ", "))
+	}
+
+	for i, s := range is.sources {
+		is.readers.Add(1)
+		go is.read(is.names[i], s.(packetReader))
+	}
+	go func() {
+		is.readers.Wait()
+		close(is.frames)
+	}()
+	return is, nil
+}
+
+// same errors gopacket.PacketSource stops at, any other is retried
+func endOfCapture(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrNoProgress || err == io.ErrClosedPipe ||
+		err == io.ErrShortBuffer || err == syscall.EBADF || strings.Contains(err.Error(), "use of closed file")
+}
+
+func (is *interfaceSources) read(name string, r packetReader) {
+	defer is.readers.Done()
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil && !endOfCapture(err) {
+			// timeouts and the like, the next read may work
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		select {
+		case is.frames <- capturedFrame{data: data, ci: ci, err: err, name: name}:
+		case <-is.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadPacketData returns the packets of every interface as they are read, io.EOF once every interface is closed
+func (is *interfaceSources) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for f := range is.frames {
+		if f.err != nil {
+			// a single interface going away doesn't end the capture
+			log.Warningf("interface %v stopped capturing: %v", f.name, f.err)
+			continue
+		}
+		return f.data, f.ci, nil
+	}
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (is *interfaceSources) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(is, is.linkType)
+}
+
+func (is *interfaceSources) LinkType() layers.LinkType {
+	return is.linkType
+}
+
+// the counters of every interface added up, interfaceStats has them one by one
+func (is *interfaceSources) Stats() (CaptureStats, error) {
+	var total CaptureStats
+	for i, s := range is.sources {
+		st, err := s.Stats()
+		if err != nil {
+			return CaptureStats{}, fmt.Errorf("interface %v: %v", is.names[i], err)
+		}
+		total.Received += st.Received
+		total.Dropped += st.Dropped
+		total.IfDropped += st.IfDropped
+	}
+	return total, nil
+}
+
+// interfaceStats are the counters of each interface, by name, interfaces whose counters can't be read are left out
+func (is *interfaceSources) interfaceStats() map[string]CaptureStats {
+	stats := make(map[string]CaptureStats, len(is.sources))
+	for i, s := range is.sources {
+		st, err := s.Stats()
+		if err != nil {
+			log.Errorf("interface %v: %v", is.names[i], err)
+			continue
+		}
+		stats[is.names[i]] = st
+	}
+	return stats
+}
+
+// the filter is swapped on every interface, nothing is swapped if one of them can't change its filter at all
+func (is *interfaceSources) SetFilter(filter string) error {
+	for i, s := range is.sources {
+		if _, ok := s.(filterSetter); !ok {
+			return fmt.Errorf("interface %v can't change its filter", is.names[i])
+		}
+	}
+	for i, s := range is.sources {
+		if err := s.(filterSetter).SetFilter(filter); err != nil {
+			return fmt.Errorf("interface %v: %v", is.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (is *interfaceSources) Close() {
+	is.once.Do(func() {
+		close(is.closed)
+		for _, s := range is.sources {
+			s.Close()
+		}
+	})
+}
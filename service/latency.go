@@ -0,0 +1,228 @@
+package service
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencyPair is a client request and the server response that answers it, e.g 2061 => 2062
+type LatencyPair struct {
+	Request  uint16 `mapstructure:"request"`
+	Response uint16 `mapstructure:"response"`
+}
+
+// a request waiting for its response
+type pendingRequest struct {
+	pair LatencyPair
+	seen time.Time
+}
+
+// flowLatency matches the requests of a connection with their responses
+// a stream sees both directions of a connection, so the client and server decoders share it
+// responses are matched with the oldest pending request of their pair, requests that don't get one in time are unmatched
+type flowLatency struct {
+	requests  map[uint16]LatencyPair
+	responses map[uint16]LatencyPair
+	pending   map[LatencyPair][]time.Time
+	timeout   time.Duration
+	mu        sync.Mutex
+}
+
+func newFlowLatency(pairs []LatencyPair, timeout time.Duration) *flowLatency {
+	fl := &flowLatency{
+		requests:  make(map[uint16]LatencyPair),
+		responses: make(map[uint16]LatencyPair),
+		pending:   make(map[LatencyPair][]time.Time),
+		timeout:   timeout,
+	}
+	for _, p := range pairs {
+		fl.requests[p.Request] = p
+		fl.responses[p.Response] = p
+	}
+	return fl
+}
+
+// keep track of a decoded packet, returns the sample if it is the response to a pending request
+// requests that timed out by the time the packet was seen are returned as unmatched
+func (fl *flowLatency) observe(dp decodedPacket) (sample *latencySample, unmatched []pendingRequest) {
+	opCode := dp.packet.Base.OperationCode
+
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	unmatched = fl.expire(dp.seen)
+
+	if p, ok := fl.requests[opCode]; ok && dp.direction == "outbound" {
+		fl.pending[p] = append(fl.pending[p], dp.seen)
+	}
+
+	if p, ok := fl.responses[opCode]; ok && dp.direction == "inbound" {
+		pending := fl.pending[p]
+		if len(pending) == 0 {
+			return nil, unmatched
+		}
+		sample = &latencySample{
+			pair:         p,
+			requestSeen:  pending[0],
+			responseSeen: dp.seen,
+		}
+		fl.pending[p] = pending[1:]
+	}
+	return sample, unmatched
+}
+
+// drop the requests that were pending for longer than the timeout, all of them if now is zero
+func (fl *flowLatency) expire(now time.Time) []pendingRequest {
+	var expired []pendingRequest
+	for p, pending := range fl.pending {
+		i := 0
+		for ; i < len(pending); i++ {
+			if !now.IsZero() && now.Sub(pending[i]) <= fl.timeout {
+				break
+			}
+			expired = append(expired, pendingRequest{pair: p, seen: pending[i]})
+		}
+		fl.pending[p] = pending[i:]
+	}
+	return expired
+}
+
+// requests that never got a response once the stream is done
+func (fl *flowLatency) close() []pendingRequest {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.expire(time.Time{})
+}
+
+type latencySample struct {
+	pair         LatencyPair
+	requestSeen  time.Time
+	responseSeen time.Time
+}
+
+func (ls latencySample) latency() time.Duration {
+	return ls.responseSeen.Sub(ls.requestSeen)
+}
+
+// correlate a decoded packet with the latency pairs of the stream
+func (ss *shineStream) observeLatency(dp decodedPacket) {
+	if ss.latency == nil {
+		return
+	}
+	sample, unmatched := ss.latency.observe(dp)
+	ss.latencyUnmatched(unmatched)
+	if sample != nil {
+		log.Infof("[%v] %v => %v latency %v", ss.flowName, ss.commandName(sample.pair.Request), ss.commandName(sample.pair.Response), sample.latency())
+		ss.sniffer.metrics.latencySample(ss.flowName, sample.pair, sample.latency())
+		ss.sniffer.latencyOut.write(ss, *sample)
+	}
+}
+
+func (ss *shineStream) latencyUnmatched(unmatched []pendingRequest) {
+	for _, u := range unmatched {
+		ss.warningf("[%v] %v seen at %v got no %v response", ss.flowName, ss.commandName(u.pair.Request), u.seen, ss.commandName(u.pair.Response))
+		ss.sniffer.metrics.latencyUnmatched(ss.flowName, u.pair)
+	}
+}
+
+// latencyOutput writes the latency samples of every stream to latency.csv in the session directory
+type latencyOutput struct {
+	f  io.Closer
+	w  *csv.Writer
+	mu sync.Mutex
+}
+
+func newLatencyOutput(s *session) (*latencyOutput, error) {
+	pathName, err := s.path("latency.csv")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(pathName)
+	if err != nil {
+		return nil, err
+	}
+	s.register(pathName, artifactLatencyCSV)
+	lo := &latencyOutput{f: f, w: csv.NewWriter(f)}
+	lo.w.Write([]string{"flowID", "flowName", "request", "response", "requestSeen", "responseSeen", "latencyMs"})
+	return lo, nil
+}
+
+func (lo *latencyOutput) write(ss *shineStream, ls latencySample) {
+	if lo == nil {
+		return
+	}
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	err := lo.w.Write([]string{
+		ss.flowID,
+		ss.flowName,
+		ss.commandName(ls.pair.Request),
+		ss.commandName(ls.pair.Response),
+		ls.requestSeen.Format(time.RFC3339Nano),
+		ls.responseSeen.Format(time.RFC3339Nano),
+		strconv.FormatFloat(float64(ls.latency())/float64(time.Millisecond), 'f', 3, 64),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func (lo *latencyOutput) close() {
+	if lo == nil {
+		return
+	}
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	lo.w.Flush()
+	if err := lo.w.Error(); err != nil {
+		log.Error(err)
+	}
+	if err := lo.f.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// an operation code can't be used in more than one pair, or FIFO matching wouldn't know which request is answered
+func validateLatencyPairs(pairs []LatencyPair) error {
+	requests := make(map[uint16]bool)
+	responses := make(map[uint16]bool)
+	for _, p := range pairs {
+		if p.Request == 0 || p.Response == 0 {
+			return fmt.Errorf("protocol.latencyPairs: request and response are needed, got %+v", p)
+		}
+		if requests[p.Request] || responses[p.Response] {
+			return fmt.Errorf("protocol.latencyPairs: %v => %v overlaps with another pair", p.Request, p.Response)
+		}
+		requests[p.Request] = true
+		responses[p.Response] = true
+	}
+	return nil
+}
+
+type latencyLabels struct {
+	flowName string
+	pair     LatencyPair
+}
+
+func writeLatencyMetric(w io.Writer, p *protocol, name string, values map[latencyLabels]float64) {
+	keys := make([]latencyLabels, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].flowName != keys[j].flowName {
+			return keys[i].flowName < keys[j].flowName
+		}
+		return keys[i].pair.Request < keys[j].pair.Request
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "%v{flowName=\"%v\",request=\"%v\",response=\"%v\"} %v\n", name,
+			labelEscaper.Replace(k.flowName), labelEscaper.Replace(p.commandName(k.pair.Request)), labelEscaper.Replace(p.commandName(k.pair.Response)), values[k])
+	}
+}
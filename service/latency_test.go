@@ -0,0 +1,82 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.core/networking"
+	"testing"
+	"time"
+)
+
+// responses are matched with the oldest pending request of their pair, requests past the timeout are unmatched
+func TestFlowLatency(t *testing.T) {
+	login := LatencyPair{Request: opLoginReq, Response: opLoginAck}
+	fl := newFlowLatency([]LatencyPair{login}, time.Second)
+	packet := func(opCode uint16, direction string, ms int) decodedPacket {
+		return decodedPacket{
+			seen:      testStart.Add(time.Duration(ms) * time.Millisecond),
+			packet:    &networking.Command{Base: networking.CommandBase{OperationCode: opCode}},
+			direction: direction,
+		}
+	}
+
+	steps := []struct {
+		dp decodedPacket
+		// the latency of the sample, 0 if none
+		latency   time.Duration
+		unmatched int
+	}{
+		// a response before any request answers nothing
+		{packet(opLoginAck, "inbound", 0), 0, 0},
+		{packet(opLoginReq, "outbound", 10), 0, 0},
+		{packet(opLoginReq, "outbound", 20), 0, 0},
+		// the same operation code the other way around isn't a request
+		{packet(opLoginReq, "inbound", 30), 0, 0},
+		{packet(opLoginAck, "inbound", 40), 30 * time.Millisecond, 0},
+		{packet(opLoginAck, "inbound", 70), 50 * time.Millisecond, 0},
+		{packet(opLoginReq, "outbound", 100), 0, 0},
+		// the request waited longer than the timeout
+		{packet(opChatReq, "outbound", 1200), 0, 1},
+		{packet(opLoginAck, "inbound", 1210), 0, 0},
+		{packet(opLoginReq, "outbound", 1300), 0, 0},
+	}
+	for i, s := range steps {
+		sample, unmatched := fl.observe(s.dp)
+		if len(unmatched) != s.unmatched {
+			t.Errorf("step %v: %v unmatched requests, expected %v", i, len(unmatched), s.unmatched)
+		}
+		switch {
+		case s.latency == 0 && sample != nil:
+			t.Errorf("step %v: sample %+v, expected none", i, *sample)
+		case s.latency != 0 && sample == nil:
+			t.Errorf("step %v: no sample, expected %v", i, s.latency)
+		case s.latency != 0 && (sample.latency() != s.latency || sample.pair != login):
+			t.Errorf("step %v: sample %+v of %v, expected %v", i, *sample, sample.latency(), s.latency)
+		}
+	}
+
+	// the request still pending once the stream is done
+	if unmatched := fl.close(); len(unmatched) != 1 || !unmatched[0].seen.Equal(testStart.Add(1300*time.Millisecond)) {
+		t.Errorf("unmatched on close %+v", unmatched)
+	}
+	if unmatched := fl.close(); len(unmatched) != 0 {
+		t.Errorf("unmatched on a second close %+v", unmatched)
+	}
+}
+
+func TestValidateLatencyPairs(t *testing.T) {
+	tests := []struct {
+		pairs []LatencyPair
+		valid bool
+	}{
+		{nil, true},
+		{[]LatencyPair{{1, 2}, {3, 4}}, true},
+		{[]LatencyPair{{1, 0}}, false},
+		{[]LatencyPair{{0, 2}}, false},
+		{[]LatencyPair{{1, 2}, {1, 4}}, false},
+		{[]LatencyPair{{1, 2}, {3, 2}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateLatencyPairs(tt.pairs); (err == nil) != tt.valid {
+			t.Errorf("%v: error %v, expected valid %v", tt.pairs, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/google/logger"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the logger writes to lf and, if console is set, to the console
+// with LOG_FORMAT=json every entry is written as a json object instead, for container log collectors
+// with --anonymize the ip addresses of every line are replaced by their pseudonyms in a
+// google/logger still writes errors to stderr as text on its own
+func newLogger(lf io.Writer, console bool, a *anonymizer) *logger.Logger {
+	jsonFormat := os.Getenv("LOG_FORMAT") == "json"
+	if !jsonFormat && a == nil {
+		return logger.Init("SnifferLogger", console, false, lf)
+	}
+	w := lf
+	if console {
+		w = io.MultiWriter(os.Stdout, lf)
+	}
+	if jsonFormat {
+		w = &jsonLogWriter{w: w}
+	}
+	if a != nil {
+		w = anonymizedWriter{w: w, a: a}
+	}
+	return logger.Init("SnifferLogger", false, false, w)
+}
+
+type jsonLogEntry struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	// file:line that logged the entry
+	Source  string `json:"source,omitempty"`
+	Message string `json:"message"`
+}
+
+// jsonLogWriter turns the lines google/logger writes, e.g "WARN : 2020/05/01 12:30:00.000000 handlers.go:120: message"
+// into json lines, lines it doesn't recognize are kept whole as the message
+type jsonLogWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+var logSeverities = map[string]string{
+	"INFO : ": "info",
+	"WARN : ": "warning",
+	"ERROR: ": "error",
+	"FATAL: ": "fatal",
+}
+
+func (jw *jsonLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	e := jsonLogEntry{
+		Time:     time.Now(),
+		Severity: "info",
+		Message:  line,
+	}
+	if len(line) > 7 {
+		if severity, ok := logSeverities[line[:7]]; ok {
+			e.Severity = severity
+			// date, time, source and message
+			parts := strings.SplitN(line[7:], " ", 4)
+			if len(parts) == 4 && strings.HasSuffix(parts[2], ":") {
+				e.Source = strings.TrimSuffix(parts[2], ":")
+				e.Message = parts[3]
+			}
+		}
+	}
+
+	d, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if _, err := jw.w.Write(append(d, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version and Commit are set when building a release, e.g
+// go build -ldflags "-X github.com/shine-o/shine.engine.packet-sniffer/service.Version=v1.2.0 -X github.com/shine-o/shine.engine.packet-sniffer/service.Commit=$(git rev-parse --short HEAD)"
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+const manifestFile = "manifest.json"
+
+// kinds of the files a session produces, export and convert look their inputs up by kind
+const (
+	artifactLog           = "log"
+	artifactFlowLog       = "flow-log"
+	artifactJSONL         = "jsonl"
+	artifactPcap          = "pcap"
+	artifactDecryptedPcap = "decrypted-pcap"
+	artifactSQLite        = "sqlite"
+	artifactTimingCSV     = "timing-csv"
+	artifactLatencyCSV    = "latency-csv"
+	artifactUndecodable   = "undecodable"
+	artifactWedged        = "wedged-buffer"
+	artifactSummary       = "summary"
+	artifactMovements     = "movements"
+	artifactOpCodes       = "opcodes"
+	artifactRaw           = "raw"
+	artifactRawIndex      = "raw-index"
+)
+
+// Manifest is output/<session>/manifest.json, what a session needs to be reproduced and read later
+// it is written when the capture starts and again with Ended, Totals and the artifacts once it is over
+type Manifest struct {
+	Command   string          `json:"command"`
+	Version   string          `json:"version"`
+	Commit    string          `json:"commit,omitempty"`
+	Hostname  string          `json:"hostname"`
+	Started   time.Time       `json:"started"`
+	Ended     *time.Time      `json:"ended,omitempty"`
+	Config    ManifestConfig  `json:"config"`
+	Totals    *ManifestTotals `json:"totals,omitempty"`
+	Artifacts []Artifact      `json:"artifacts"`
+}
+
+// ManifestConfig is the part of the effective config that decides what was captured and how it was decoded
+// the xor key is never written, XorKey only tells whether one was configured
+type ManifestConfig struct {
+	Interfaces        []string       `json:"interfaces,omitempty"`
+	PcapFile          string         `json:"pcapFile,omitempty"`
+	Backend           string         `json:"backend,omitempty"`
+	Filter            string         `json:"filter"`
+	Snaplen           int            `json:"snaplen"`
+	ServerSideCapture bool           `json:"serverSideCapture"`
+	Services          map[string]int `json:"services"`
+	UDPServices       map[string]int `json:"udpServices,omitempty"`
+	XorKey            string         `json:"xorKey"`
+	XorLimit          uint16         `json:"xorLimit"`
+	XorKeyOpCode      uint16         `json:"xorKeyOpcode"`
+	XorKeyOffset      int            `json:"xorKeyOffset"`
+	ServerXor         string         `json:"serverXor,omitempty"`
+	Injection         bool           `json:"injection,omitempty"`
+	Redacted          bool           `json:"redacted"`
+	Anonymized        bool           `json:"anonymized"`
+}
+
+// ManifestTotals is what the capture did, as logged when it stops
+type ManifestTotals struct {
+	Captured   uint64 `json:"captured"`
+	Decoded    uint64 `json:"decoded"`
+	Suppressed uint64 `json:"suppressed"`
+	// packets written by POST /api/inject
+	Injected uint64 `json:"injected,omitempty"`
+	Flows    int    `json:"flows"`
+	Packets  int    `json:"packets"`
+	Bytes    int    `json:"bytes"`
+}
+
+// Artifact is a file the session produced, Path is relative to the session directory unless the file is outside of it
+type Artifact struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// sessionManifest collects the files of the session as the outputs create them
+type sessionManifest struct {
+	dir       string
+	manifest  Manifest
+	artifacts map[string]string
+	mu        sync.Mutex
+}
+
+func newSessionManifest(dir string) *sessionManifest {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return &sessionManifest{
+		dir: dir,
+		manifest: Manifest{
+			Version:  Version,
+			Commit:   Commit,
+			Hostname: hostname,
+			Started:  time.Now(),
+		},
+		artifacts: make(map[string]string),
+	}
+}
+
+// add a file to the manifest, a path registered twice is listed once
+func (sm *sessionManifest) register(path, kind string) {
+	if sm == nil {
+		return
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.artifacts[path] = kind
+}
+
+func manifestConfig(c Config, anonymized bool) ManifestConfig {
+	mc := ManifestConfig{
+		Interfaces:        c.Interfaces,
+		PcapFile:          c.PcapFile,
+		Backend:           c.Backend,
+		Filter:            c.Filter,
+		Snaplen:           c.Snaplen,
+		ServerSideCapture: c.ServerSideCapture,
+		Services:          make(map[string]int),
+		XorLimit:          c.XorLimit,
+		XorKeyOpCode:      c.XorKeyOpCode,
+		XorKeyOffset:      c.XorKeyOffset,
+		ServerXor:         c.ServerXor,
+		Injection:         c.Injection,
+		Redacted:          c.Redact,
+		Anonymized:        anonymized,
+	}
+	if len(mc.Interfaces) == 0 && c.Interface != "" && c.PcapFile == "" {
+		mc.Interfaces = []string{c.Interface}
+	}
+	for port, name := range c.Services {
+		mc.Services[name] = port
+	}
+	if len(c.UDPServices) > 0 {
+		mc.UDPServices = make(map[string]int)
+		for port, name := range c.UDPServices {
+			mc.UDPServices[name] = port
+		}
+	}
+	if len(c.XorKey) > 0 {
+		mc.XorKey = "redacted"
+	}
+	return mc
+}
+
+// write the manifest of a command starting with c, before any packet is captured
+func (sm *sessionManifest) start(command string, c Config, anonymized bool) error {
+	if sm == nil {
+		return nil
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.manifest.Command = command
+	sm.manifest.Config = manifestConfig(c, anonymized)
+	return sm.write()
+}
+
+// write the manifest again with the end time, the totals and every registered file, once the outputs are closed
+// totals is nil for the commands that don't capture
+func (sm *sessionManifest) finish(totals *ManifestTotals) error {
+	if sm == nil {
+		return nil
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	ended := time.Now()
+	sm.manifest.Ended = &ended
+	sm.manifest.Totals = totals
+
+	paths := make([]string, 0, len(sm.artifacts))
+	for path := range sm.artifacts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	sm.manifest.Artifacts = sm.manifest.Artifacts[:0]
+	for _, path := range paths {
+		a, err := sm.artifact(path, sm.artifacts[path])
+		if err != nil {
+			log.Warningf("%v is left out of the manifest: %v", path, err)
+			continue
+		}
+		sm.manifest.Artifacts = append(sm.manifest.Artifacts, a)
+	}
+	return sm.write()
+}
+
+func (sm *sessionManifest) artifact(path, kind string) (Artifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{
+		Path:   sm.relative(path),
+		Kind:   kind,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// path relative to the session directory, absolute if the file is somewhere else, e.g the sqlite database
+func (sm *sessionManifest) relative(path string) string {
+	dir, err := filepath.Abs(sm.dir)
+	if err != nil {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return abs
+	}
+	return filepath.ToSlash(rel)
+}
+
+// called with the lock held, the manifest is replaced at once so a reader never sees half of it
+func (sm *sessionManifest) write() error {
+	d, err := json.MarshalIndent(sm.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sm.dir, manifestFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, d, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// the totals of a capture for the manifest
+func captureTotals(sn *Sniffer, flows []FlowSummary) *ManifestTotals {
+	t := &ManifestTotals{
+		Captured:   atomic.LoadUint64(&sn.captured),
+		Decoded:    atomic.LoadUint64(&sn.decoded),
+		Suppressed: atomic.LoadUint64(&sn.suppressed),
+		Injected:   sn.injector.count(),
+	}
+	for _, f := range flows {
+		t.Flows += f.Streams
+		t.Packets += f.Packets
+		t.Bytes += f.Bytes
+	}
+	return t
+}
+
+// readManifest reads the manifest of a session directory, false if it has none, e.g sessions of older versions
+func readManifest(dir string) (Manifest, bool, error) {
+	d, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return Manifest{}, false, nil
+	}
+	if err != nil {
+		return Manifest{}, false, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(d, &m); err != nil {
+		return Manifest{}, false, fmt.Errorf("%v: %v", filepath.Join(dir, manifestFile), err)
+	}
+	return m, true, nil
+}
+
+// the files of kind the manifest of dir lists, sorted, false if dir has no manifest
+// a file listed but gone is an error, the session was changed after it was written
+func sessionArtifacts(dir, kind string) ([]string, bool, error) {
+	m, ok, err := readManifest(dir)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	var files []string
+	for _, a := range m.Artifacts {
+		if a.Kind != kind {
+			continue
+		}
+		path := a.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, filepath.FromSlash(path))
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, true, fmt.Errorf("%v lists %v: %v", filepath.Join(dir, manifestFile), a.Path, err)
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files, true, nil
+}
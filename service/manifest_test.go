@@ -0,0 +1,85 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the manifest is written at the start without artifacts and at the end with every registered file and its hash
+func TestSessionManifest(t *testing.T) {
+	dir := t.TempDir()
+	sm := newSessionManifest(dir)
+	c := testConfig()
+	c.Services = map[int]string{9010: "login"}
+	if err := sm.start("capture", c, true); err != nil {
+		t.Fatal(err)
+	}
+	m, ok, err := readManifest(dir)
+	if err != nil || !ok {
+		t.Fatalf("manifest after start: %v %v", ok, err)
+	}
+	if m.Command != "capture" || m.Ended != nil || len(m.Artifacts) != 0 || m.Config.Services["login"] != 9010 || !m.Config.Anonymized || !m.Config.Redacted {
+		t.Errorf("manifest after start %+v", m)
+	}
+	if m.Config.XorKey != "redacted" {
+		t.Errorf("the xor key is written as %q", m.Config.XorKey)
+	}
+
+	jsonl := filepath.Join(dir, "packets.jsonl")
+	if err := ioutil.WriteFile(jsonl, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// e.g the sqlite database, outside of the session
+	outside := filepath.Join(t.TempDir(), "packets.db")
+	if err := ioutil.WriteFile(outside, []byte("db"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sm.register(jsonl, artifactJSONL)
+	sm.register(jsonl, artifactJSONL)
+	sm.register(outside, artifactSQLite)
+	sm.register(filepath.Join(dir, "gone.csv"), artifactTimingCSV)
+	if err := sm.finish(&ManifestTotals{Captured: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _, err = readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Ended == nil || m.Totals == nil || m.Totals.Captured != 3 {
+		t.Errorf("manifest after finish %+v", m)
+	}
+	sum := sha256.Sum256([]byte("{}\n"))
+	expected := map[string]Artifact{
+		artifactJSONL:  {Path: "packets.jsonl", Kind: artifactJSONL, Size: 3, SHA256: hex.EncodeToString(sum[:])},
+		artifactSQLite: {Path: outside, Kind: artifactSQLite, Size: 2},
+	}
+	if len(m.Artifacts) != len(expected) {
+		t.Fatalf("artifacts %+v, expected %v", m.Artifacts, len(expected))
+	}
+	for _, a := range m.Artifacts {
+		e := expected[a.Kind]
+		if a.Path != e.Path || a.Size != e.Size || (e.SHA256 != "" && a.SHA256 != e.SHA256) {
+			t.Errorf("artifact %+v, expected %+v", a, e)
+		}
+	}
+
+	files, ok, err := sessionArtifacts(dir, artifactJSONL)
+	if err != nil || !ok || len(files) != 1 || files[0] != jsonl {
+		t.Errorf("jsonl files %v %v %v", files, ok, err)
+	}
+	if err := os.Remove(jsonl); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sessionArtifacts(dir, artifactJSONL); err == nil || !strings.Contains(err.Error(), "packets.jsonl") {
+		t.Errorf("a listed file that is gone: %v", err)
+	}
+	if _, ok, err := sessionArtifacts(t.TempDir(), artifactJSONL); ok || err != nil {
+		t.Errorf("a directory without a manifest: %v %v", ok, err)
+	}
+}
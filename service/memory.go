@@ -0,0 +1,300 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemorySource hands a Sniffer packets built in memory instead of captured ones, set it as the Sniffer's Source
+// once every packet was read the capture ends, the same as when a pcap file is fully read
+type MemorySource struct {
+	frames []memoryFrame
+	next   int
+	mu     sync.Mutex
+}
+
+type memoryFrame struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{}
+}
+
+// Add an ethernet frame, frames are read in the order they were added
+func (ms *MemorySource) Add(seen time.Time, data []byte) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.frames = append(ms.frames, memoryFrame{
+		ci: gopacket.CaptureInfo{
+			Timestamp:     seen,
+			CaptureLength: len(data),
+			Length:        len(data),
+		},
+		data: data,
+	})
+}
+
+// order the frames by capture time, frames of the same time keep the order they were added in
+func (ms *MemorySource) sortByTime() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	sort.SliceStable(ms.frames, func(i, j int) bool {
+		return ms.frames[i].ci.Timestamp.Before(ms.frames[j].ci.Timestamp)
+	})
+}
+
+// ReadPacketData implements gopacket.PacketDataSource
+func (ms *MemorySource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.next >= len(ms.frames) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	f := ms.frames[ms.next]
+	ms.next++
+	return f.data, f.ci, nil
+}
+
+func (ms *MemorySource) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(ms, layers.LinkTypeEthernet)
+}
+
+func (ms *MemorySource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (ms *MemorySource) Stats() (CaptureStats, error) {
+	return CaptureStats{}, errNoCaptureStats
+}
+
+func (ms *MemorySource) Close() {}
+
+// EncodeShinePacket frames an operation code and its payload the way they travel in a stream, length header first
+// client packets still have to be xored, see TCPConversation.FromClient
+func EncodeShinePacket(opCode uint16, data []byte) []byte {
+	body := make([]byte, 2+len(data))
+	binary.LittleEndian.PutUint16(body, opCode)
+	copy(body[2:], data)
+	return frameShinePacket(body)
+}
+
+// prefix a packet body, operation code included, with its length header
+func frameShinePacket(body []byte) []byte {
+	if len(body) < 256 {
+		return append([]byte{byte(len(body))}, body...)
+	}
+	header := []byte{0, 0, 0}
+	binary.LittleEndian.PutUint16(header[1:], uint16(len(body)))
+	return append(header, body...)
+}
+
+// payload bytes per tcp segment, larger payloads are split so every frame fits an ethernet MTU
+const maxSegmentSize = 1460
+
+// frameAdder takes the frames a TCPConversation builds, e.g a MemorySource
+type frameAdder interface {
+	Add(seen time.Time, data []byte)
+}
+
+// TCPConversation adds the frames of one tcp connection between a game client and a server to a MemorySource
+// segments are sent in order and acknowledged right away, each call advances the clock by a millisecond
+type TCPConversation struct {
+	frames               frameAdder
+	client, server       *net.TCPAddr
+	clientSeq, serverSeq uint32
+	clientMAC, serverMAC net.HardwareAddr
+	seen                 time.Time
+	xor                  XorSettings
+	xorOffset            uint16
+	xored                bool
+}
+
+// NewTCPConversation between client and server addresses, e.g 192.168.1.20:50000 and 192.168.1.10:9010
+func NewTCPConversation(source *MemorySource, client, server string, start time.Time) (*TCPConversation, error) {
+	c, err := net.ResolveTCPAddr("tcp", client)
+	if err != nil {
+		return nil, fmt.Errorf("client: %v", err)
+	}
+	s, err := net.ResolveTCPAddr("tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("server: %v", err)
+	}
+	return newTCPConversation(source, c, s, start), nil
+}
+
+func newTCPConversation(frames frameAdder, client, server *net.TCPAddr, start time.Time) *TCPConversation {
+	return &TCPConversation{
+		frames:    frames,
+		client:    client,
+		server:    server,
+		clientSeq: 1000,
+		serverSeq: 5000,
+		clientMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+		serverMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+		seen:      start,
+	}
+}
+
+// the time of the next segment
+func (tc *TCPConversation) tick() time.Time {
+	tc.seen = tc.seen.Add(time.Millisecond)
+	return tc.seen
+}
+
+// Open the connection with the three way handshake
+func (tc *TCPConversation) Open() error {
+	return tc.handshake(tc.tick())
+}
+
+func (tc *TCPConversation) handshake(seen time.Time) error {
+	if err := tc.segment(seen, true, &layers.TCP{SYN: true}, nil); err != nil {
+		return err
+	}
+	if err := tc.segment(seen, false, &layers.TCP{SYN: true, ACK: true}, nil); err != nil {
+		return err
+	}
+	return tc.segment(seen, true, &layers.TCP{ACK: true}, nil)
+}
+
+// XorClient xors the client packets sent from now on with xs, starting at offset, as a client does once it got its seed
+func (tc *TCPConversation) XorClient(xs XorSettings, offset uint16) {
+	tc.xor, tc.xorOffset, tc.xored = xs, offset, true
+}
+
+// FromClient sends shine packets, framed by EncodeShinePacket, from the client to the server
+func (tc *TCPConversation) FromClient(packets ...[]byte) error {
+	var payload []byte
+	for _, p := range packets {
+		if tc.xored {
+			// only the packet body is xored, not its length header
+			p = append([]byte(nil), p...)
+			skip := 1
+			if p[0] == 0 {
+				skip = 3
+			}
+			tc.xor.cipher(p[skip:], &tc.xorOffset)
+		}
+		payload = append(payload, p...)
+	}
+	return tc.send(tc.tick(), true, payload)
+}
+
+// FromServer sends shine packets, framed by EncodeShinePacket, from the server to the client
+func (tc *TCPConversation) FromServer(packets ...[]byte) error {
+	var payload []byte
+	for _, p := range packets {
+		payload = append(payload, p...)
+	}
+	return tc.send(tc.tick(), false, payload)
+}
+
+// send a payload in as many segments as it takes to stay under the MTU
+func (tc *TCPConversation) send(seen time.Time, fromClient bool, payload []byte) error {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxSegmentSize {
+			n = maxSegmentSize
+		}
+		if err := tc.segment(seen, fromClient, &layers.TCP{PSH: true, ACK: true}, payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// Close the connection, the client sends the first FIN
+func (tc *TCPConversation) Close() error {
+	seen := tc.tick()
+	if err := tc.segment(seen, true, &layers.TCP{FIN: true, ACK: true}, nil); err != nil {
+		return err
+	}
+	if err := tc.segment(seen, false, &layers.TCP{FIN: true, ACK: true}, nil); err != nil {
+		return err
+	}
+	return tc.segment(seen, true, &layers.TCP{ACK: true}, nil)
+}
+
+// serialize one segment and add it to the frames, the sequence numbers follow what was sent
+func (tc *TCPConversation) segment(seen time.Time, fromClient bool, tcp *layers.TCP, payload []byte) error {
+	src, dst := tc.client, tc.server
+	srcMAC, dstMAC := tc.clientMAC, tc.serverMAC
+	seq, ack := &tc.clientSeq, &tc.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		srcMAC, dstMAC = dstMAC, srcMAC
+		seq, ack = ack, seq
+	}
+
+	tcp.SrcPort = layers.TCPPort(src.Port)
+	tcp.DstPort = layers.TCPPort(dst.Port)
+	tcp.Seq = *seq
+	if tcp.ACK {
+		tcp.Ack = *ack
+	}
+	tcp.Window = 65535
+	frame, err := tcpFrame(srcMAC, dstMAC, src.IP, dst.IP, tcp, payload)
+	if err != nil {
+		return fmt.Errorf("serializing %v => %v: %v", src, dst, err)
+	}
+
+	// SYN and FIN take a sequence number of their own
+	*seq += uint32(len(payload))
+	if tcp.SYN || tcp.FIN {
+		*seq++
+	}
+	tc.frames.Add(seen, frame)
+	return nil
+}
+
+// an ethernet frame from src to dst with a tcp segment holding payload, the ports, sequence numbers and flags of tcp are set by the caller
+func tcpFrame(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, tcp *layers.TCP, payload []byte) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       dstMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var ip gopacket.SerializableLayer
+	if srcIP.To4() != nil {
+		ipv4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    srcIP.To4(),
+			DstIP:    dstIP.To4(),
+		}
+		if err := tcp.SetNetworkLayerForChecksum(ipv4); err != nil {
+			return nil, err
+		}
+		ip = ipv4
+	} else {
+		ipv6 := &layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolTCP,
+			HopLimit:   64,
+			SrcIP:      srcIP,
+			DstIP:      dstIP,
+		}
+		if err := tcp.SetNetworkLayerForChecksum(ipv6); err != nil {
+			return nil, err
+		}
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = ipv6
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
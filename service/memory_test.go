@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+// the segments of a conversation, in the order they were added
+func conversationSegments(t *testing.T, ms *MemorySource) []gopacket.Packet {
+	t.Helper()
+	var packets []gopacket.Packet
+	for _, f := range ms.frames {
+		p := gopacket.NewPacket(f.data, layers.LayerTypeEthernet, gopacket.Default)
+		if p.ErrorLayer() != nil {
+			t.Fatalf("frame %x doesn't decode: %v", f.data, p.ErrorLayer().Error())
+		}
+		if _, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP); !ok {
+			t.Fatalf("no tcp segment in %x", f.data)
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// the handshake, a payload split at the MTU and the close follow each other's sequence numbers
+func TestTCPConversationSequences(t *testing.T) {
+	for _, addrs := range [][2]string{
+		{testClientAddr, testServerAddr},
+		{"[2001:db8::20]:50000", "[2001:db8::10]:9010"},
+	} {
+		t.Run(addrs[0], func(t *testing.T) {
+			ms := NewMemorySource()
+			conv, err := NewTCPConversation(ms, addrs[0], addrs[1], testStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := bytes.Repeat([]byte{0xAB}, maxSegmentSize+10)
+			if err := conv.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.FromClient(payload); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.FromServer([]byte{1, 2, 3}); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []struct {
+				fromClient bool
+				syn, fin   bool
+				seq, ack   uint32
+				length     int
+			}{
+				{true, true, false, 1000, 0, 0},
+				{false, true, false, 5000, 1001, 0},
+				{true, false, false, 1001, 5001, 0},
+				{true, false, false, 1001, 5001, maxSegmentSize},
+				{true, false, false, 1001 + maxSegmentSize, 5001, 10},
+				{false, false, false, 5001, 1011 + maxSegmentSize, 3},
+				{true, false, true, 1011 + maxSegmentSize, 5004, 0},
+				{false, false, true, 5004, 1012 + maxSegmentSize, 0},
+				{true, false, false, 1012 + maxSegmentSize, 5005, 0},
+			}
+			packets := conversationSegments(t, ms)
+			if len(packets) != len(expected) {
+				t.Fatalf("%v segments, expected %v", len(packets), len(expected))
+			}
+			for i, p := range packets {
+				e := expected[i]
+				tcp := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				srcPort := layers.TCPPort(50000)
+				if !e.fromClient {
+					srcPort = 9010
+				}
+				if tcp.SrcPort != srcPort || tcp.SYN != e.syn || tcp.FIN != e.fin || tcp.Seq != e.seq || tcp.Ack != e.ack || len(tcp.Payload) != e.length {
+					t.Errorf("segment %v from port %v syn %v fin %v seq %v ack %v with %v bytes, expected %+v", i, tcp.SrcPort, tcp.SYN, tcp.FIN, tcp.Seq, tcp.Ack, len(tcp.Payload), e)
+				}
+			}
+		})
+	}
+}
+
+// a frame tcpFrame builds carries the addresses it was given and a valid checksum
+func TestTCPFrame(t *testing.T) {
+	srcMAC, dstMAC := net.HardwareAddr{0, 1, 2, 3, 4, 5}, net.HardwareAddr{0, 1, 2, 3, 4, 6}
+	for _, ips := range [][2]string{{"192.168.1.20", "192.168.1.10"}, {"2001:db8::20", "2001:db8::10"}} {
+		srcIP, dstIP := net.ParseIP(ips[0]), net.ParseIP(ips[1])
+		tcp := &layers.TCP{SrcPort: 50000, DstPort: 9010, Seq: 7, Ack: 9, ACK: true, PSH: true, Window: 512}
+		frame, err := tcpFrame(srcMAC, dstMAC, srcIP, dstIP, tcp, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		eth, _ := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		if eth == nil || !bytes.Equal(eth.SrcMAC, srcMAC) || !bytes.Equal(eth.DstMAC, dstMAC) {
+			t.Errorf("%v: ethernet layer %+v", ips, eth)
+		}
+		network := p.NetworkLayer()
+		if network == nil || !net.IP(network.NetworkFlow().Src().Raw()).Equal(srcIP) || !net.IP(network.NetworkFlow().Dst().Raw()).Equal(dstIP) {
+			t.Fatalf("%v: network layer %v", ips, network)
+		}
+		got, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if got == nil || got.Seq != 7 || got.Ack != 9 || got.Window != 512 || string(got.Payload) != "hello" {
+			t.Fatalf("%v: tcp layer %+v", ips, got)
+		}
+		// the checksum of a frame that was sent as is adds up
+		if err := got.SetNetworkLayerForChecksum(network); err != nil {
+			t.Fatal(err)
+		}
+		checksum := got.Checksum
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{ComputeChecksums: true}, got, gopacket.Payload(got.Payload)); err != nil {
+			t.Fatal(err)
+		}
+		if recomputed := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeTCP, gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP).Checksum; recomputed != checksum {
+			t.Errorf("%v: checksum %x, expected %x", ips, checksum, recomputed)
+		}
+	}
+}
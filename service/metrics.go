@@ -0,0 +1,250 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type flowLabels struct {
+	flowName  string
+	direction string
+}
+
+// snifferMetrics holds the counters exposed on /metrics in the prometheus text format
+// gauges (active streams, websocket clients, channel depth) are read when scraped
+type snifferMetrics struct {
+	packetsCaptured uint64
+	kernel          CaptureStats
+	brokerDropped   uint64
+	grpcDropped     uint64
+	esDropped       uint64
+	sqliteDropped   uint64
+	suppressed      uint64
+	packetsDecoded  map[flowLabels]uint64
+	decodeErrors    map[flowLabels]uint64
+	bytesProcessed  map[flowLabels]uint64
+	segmentDrops    map[flowLabels]uint64
+	truncated       map[string]uint64
+	assemblerSkips  map[string]uint64
+	sampledOut      map[string]uint64
+	latencySum      map[latencyLabels]float64
+	latencyCount    map[latencyLabels]float64
+	unmatched       map[latencyLabels]float64
+	mu              sync.Mutex
+}
+
+func newSnifferMetrics() *snifferMetrics {
+	return &snifferMetrics{
+		packetsDecoded: make(map[flowLabels]uint64),
+		decodeErrors:   make(map[flowLabels]uint64),
+		bytesProcessed: make(map[flowLabels]uint64),
+		segmentDrops:   make(map[flowLabels]uint64),
+		truncated:      make(map[string]uint64),
+		assemblerSkips: make(map[string]uint64),
+		sampledOut:     make(map[string]uint64),
+		latencySum:     make(map[latencyLabels]float64),
+		latencyCount:   make(map[latencyLabels]float64),
+		unmatched:      make(map[latencyLabels]float64),
+	}
+}
+
+func (sm *snifferMetrics) packetCaptured() {
+	atomic.AddUint64(&sm.packetsCaptured, 1)
+}
+
+func (sm *snifferMetrics) brokerEventDropped() {
+	atomic.AddUint64(&sm.brokerDropped, 1)
+}
+
+// keep the last kernel counters, returns the ones they replace
+func (sm *snifferMetrics) captureStats(s CaptureStats) CaptureStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	previous := sm.kernel
+	sm.kernel = s
+	return previous
+}
+
+func (sm *snifferMetrics) packetSuppressed() {
+	atomic.AddUint64(&sm.suppressed, 1)
+}
+
+func (sm *snifferMetrics) grpcEventDropped() {
+	atomic.AddUint64(&sm.grpcDropped, 1)
+}
+
+func (sm *snifferMetrics) elasticsearchEventsDropped(n int) {
+	atomic.AddUint64(&sm.esDropped, uint64(n))
+}
+
+func (sm *snifferMetrics) sqliteRowDropped() {
+	atomic.AddUint64(&sm.sqliteDropped, 1)
+}
+
+func (sm *snifferMetrics) packetDecoded(flowName, direction string) {
+	sm.mu.Lock()
+	sm.packetsDecoded[flowLabels{flowName, direction}]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) decodeError(flowName, direction string) {
+	sm.mu.Lock()
+	sm.decodeErrors[flowLabels{flowName, direction}]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) segmentReceived(flowName, direction string, length int) {
+	sm.mu.Lock()
+	sm.bytesProcessed[flowLabels{flowName, direction}] += uint64(length)
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) segmentDropped(flowName, direction string) {
+	sm.mu.Lock()
+	sm.segmentDrops[flowLabels{flowName, direction}]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) packetTruncated(flowName string) {
+	sm.mu.Lock()
+	sm.truncated[flowName]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) assemblerSkip(flowName string) {
+	sm.mu.Lock()
+	sm.assemblerSkips[flowName]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) packetSampledOut(flowName string) {
+	sm.mu.Lock()
+	sm.sampledOut[flowName]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) latencySample(flowName string, pair LatencyPair, latency time.Duration) {
+	sm.mu.Lock()
+	sm.latencySum[latencyLabels{flowName, pair}] += latency.Seconds()
+	sm.latencyCount[latencyLabels{flowName, pair}]++
+	sm.mu.Unlock()
+}
+
+func (sm *snifferMetrics) latencyUnmatched(flowName string, pair LatencyPair) {
+	sm.mu.Lock()
+	sm.unmatched[latencyLabels{flowName, pair}]++
+	sm.mu.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeFlowMetric(w io.Writer, name string, values map[flowLabels]uint64) {
+	keys := make([]flowLabels, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].flowName == keys[j].flowName {
+			return keys[i].direction < keys[j].direction
+		}
+		return keys[i].flowName < keys[j].flowName
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "%v{flowName=\"%v\",direction=\"%v\"} %v\n", name, labelEscaper.Replace(k.flowName), labelEscaper.Replace(k.direction), values[k])
+	}
+}
+
+func writeFlowNameMetric(w io.Writer, name string, values map[string]uint64) {
+	flowNames := make([]string, 0, len(values))
+	for flowName := range values {
+		flowNames = append(flowNames, flowName)
+	}
+	sort.Strings(flowNames)
+	for _, flowName := range flowNames {
+		fmt.Fprintf(w, "%v{flowName=\"%v\"} %v\n", name, labelEscaper.Replace(flowName), values[flowName])
+	}
+}
+
+// the counters, and the gauges of the streams and the UI clients of sn
+func (sm *snifferMetrics) write(w io.Writer, sn *Sniffer) {
+	writeMetricHeader(w, "sniffer_packets_captured_total", "TCP packets read from the capture handle.", "counter")
+	fmt.Fprintf(w, "sniffer_packets_captured_total %v\n", atomic.LoadUint64(&sm.packetsCaptured))
+
+	writeMetricHeader(w, "sniffer_broker_events_dropped_total", "Decoded packets that were not published to the broker.", "counter")
+	fmt.Fprintf(w, "sniffer_broker_events_dropped_total %v\n", atomic.LoadUint64(&sm.brokerDropped))
+
+	writeMetricHeader(w, "sniffer_grpc_events_dropped_total", "Decoded packets that were not sent to a slow grpc subscriber.", "counter")
+	fmt.Fprintf(w, "sniffer_grpc_events_dropped_total %v\n", atomic.LoadUint64(&sm.grpcDropped))
+
+	writeMetricHeader(w, "sniffer_elasticsearch_events_dropped_total", "Decoded packets that were not indexed in elasticsearch.", "counter")
+	fmt.Fprintf(w, "sniffer_elasticsearch_events_dropped_total %v\n", atomic.LoadUint64(&sm.esDropped))
+
+	writeMetricHeader(w, "sniffer_sqlite_rows_dropped_total", "Flow and packet rows that were not written to the sqlite database.", "counter")
+	fmt.Fprintf(w, "sniffer_sqlite_rows_dropped_total %v\n", atomic.LoadUint64(&sm.sqliteDropped))
+
+	writeMetricHeader(w, "sniffer_packets_suppressed_total", "Decoded packets that were not forwarded because forwarding was paused.", "counter")
+	fmt.Fprintf(w, "sniffer_packets_suppressed_total %v\n", atomic.LoadUint64(&sm.suppressed))
+
+	sm.mu.Lock()
+	writeMetricHeader(w, "sniffer_kernel_packets_received_total", "Packets received by the kernel for the capture, as of the last report.", "counter")
+	fmt.Fprintf(w, "sniffer_kernel_packets_received_total %v\n", sm.kernel.Received)
+	writeMetricHeader(w, "sniffer_kernel_packets_dropped_total", "Packets the kernel dropped because the capture didn't keep up, as of the last report.", "counter")
+	fmt.Fprintf(w, "sniffer_kernel_packets_dropped_total %v\n", sm.kernel.Dropped)
+	writeMetricHeader(w, "sniffer_interface_packets_dropped_total", "Packets the network interface dropped before the kernel saw them, as of the last report.", "counter")
+	fmt.Fprintf(w, "sniffer_interface_packets_dropped_total %v\n", sm.kernel.IfDropped)
+	writeMetricHeader(w, "sniffer_packets_decoded_total", "Shine packets decoded.", "counter")
+	writeFlowMetric(w, "sniffer_packets_decoded_total", sm.packetsDecoded)
+	writeMetricHeader(w, "sniffer_decode_errors_total", "Shine packets that could not be decoded.", "counter")
+	writeFlowMetric(w, "sniffer_decode_errors_total", sm.decodeErrors)
+	writeMetricHeader(w, "sniffer_bytes_processed_total", "Reassembled bytes received by the decoders.", "counter")
+	writeFlowMetric(w, "sniffer_bytes_processed_total", sm.bytesProcessed)
+	writeMetricHeader(w, "sniffer_segments_dropped_total", "Reassembled segments dropped because the decoder fell behind, see network.segmentQueue.", "counter")
+	writeFlowMetric(w, "sniffer_segments_dropped_total", sm.segmentDrops)
+	writeMetricHeader(w, "sniffer_packets_truncated_total", "TCP packets cut short by network.snaplen, they are not decoded.", "counter")
+	writeFlowNameMetric(w, "sniffer_packets_truncated_total", sm.truncated)
+	writeMetricHeader(w, "sniffer_assembler_skips_total", "Gaps in streams because the assembler reached network.assembler page limits.", "counter")
+	writeFlowNameMetric(w, "sniffer_assembler_skips_total", sm.assemblerSkips)
+	writeMetricHeader(w, "sniffer_packets_sampled_out_total", "Decoded packets not forwarded because of protocol.sampling.", "counter")
+	writeFlowNameMetric(w, "sniffer_packets_sampled_out_total", sm.sampledOut)
+	writeMetricHeader(w, "sniffer_request_latency_seconds", "Time between a request and its response, for the pairs in protocol.latencyPairs.", "summary")
+	writeLatencyMetric(w, sn.protocol, "sniffer_request_latency_seconds_sum", sm.latencySum)
+	writeLatencyMetric(w, sn.protocol, "sniffer_request_latency_seconds_count", sm.latencyCount)
+	writeMetricHeader(w, "sniffer_unmatched_requests_total", "Requests that got no response within protocol.latencyTimeout.", "counter")
+	writeLatencyMetric(w, sn.protocol, "sniffer_unmatched_requests_total", sm.unmatched)
+	sm.mu.Unlock()
+
+	depth := make(map[flowLabels]uint64)
+	sn.streams.mu.Lock()
+	activeStreams := len(sn.streams.streams)
+	for _, ss := range sn.streams.streams {
+		depth[flowLabels{ss.flowName, "outbound"}] += uint64(ss.client.depth())
+		depth[flowLabels{ss.flowName, "inbound"}] += uint64(ss.server.depth())
+	}
+	sn.streams.mu.Unlock()
+
+	writeMetricHeader(w, "sniffer_active_streams", "Streams that haven't been completed yet.", "gauge")
+	fmt.Fprintf(w, "sniffer_active_streams %v\n", activeStreams)
+	writeMetricHeader(w, "sniffer_segment_channel_depth", "Segments waiting to be decoded.", "gauge")
+	writeFlowMetric(w, "sniffer_segment_channel_depth", depth)
+
+	sn.ws.mu.Lock()
+	clients := len(sn.ws.cons)
+	sn.ws.mu.Unlock()
+	writeMetricHeader(w, "sniffer_websocket_clients", "Connected websocket clients.", "gauge")
+	fmt.Fprintf(w, "sniffer_websocket_clients %v\n", clients)
+}
+
+func (sn *Sniffer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	sn.metrics.write(w, sn)
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const outputFlushInterval = 2 * time.Second
+
+// packetRecord is a decoded packet as written to the json lines output
+type packetRecord struct {
+	// stable across runs over the same capture, see PacketEvent
+	PacketID      string    `json:"packetId"`
+	Seq           uint64    `json:"seq"`
+	FlowID        string    `json:"flowId"`
+	Seen          time.Time `json:"seen"`
+	Direction     string    `json:"direction"`
+	Src           string    `json:"src"`
+	Dst           string    `json:"dst"`
+	OperationCode uint16    `json:"operationCode"`
+	Command       string    `json:"command"`
+	Length        int       `json:"length"`
+	Data          string    `json:"data"`
+	// data only has the first output.maxPayloadBytes of the payload, sha1 is the one of the whole payload
+	Truncated bool   `json:"truncated,omitempty"`
+	SHA1      string `json:"sha1,omitempty"`
+	// the unpacked struct, if one is registered for the operation code
+	Decoded json.RawMessage   `json:"decoded,omitempty"`
+	Fields  []Field           `json:"fields,omitempty"`
+	Context map[string]string `json:"context,omitempty"`
+	// the payload as captured was compressedSize bytes, see protocol.compressedOpcodes
+	CompressedSize   int `json:"compressedSize,omitempty"`
+	DecompressedSize int `json:"decompressedSize,omitempty"`
+}
+
+// flowClosedRecord is the last line of a flow file, written once every packet of the stream was handled
+type flowClosedRecord struct {
+	FlowID     string             `json:"flowId"`
+	FlowName   string             `json:"flowName"`
+	FlowClosed *flowClosedSummary `json:"flowClosed"`
+}
+
+// flowOutput appends the decoded packets of a stream to <flowName>-<flowID>.jsonl in the session directory
+// the file is only created once the first packet is written
+type flowOutput struct {
+	session *session
+	path    string
+	// payloads are truncated past it, 0 writes them whole
+	maxPayload int
+	f          *os.File
+	w          *bufio.Writer
+	closed     bool
+	mu         sync.Mutex
+}
+
+func newFlowOutput(s *session, flowName, flowID string, maxPayload int) *flowOutput {
+	return &flowOutput{
+		session:    s,
+		path:       fmt.Sprintf("%v-%v.jsonl", flowName, flowID),
+		maxPayload: maxPayload,
+	}
+}
+
+// the first max bytes of payload and the hex sha1 of the whole of it if it's longer, payload and "" otherwise
+// 0 means no limit
+func truncatePayload(payload []byte, max int) ([]byte, string) {
+	if max <= 0 || len(payload) <= max {
+		return payload, ""
+	}
+	sum := sha1.Sum(payload)
+	return payload[:max], hex.EncodeToString(sum[:])
+}
+
+func (fo *flowOutput) write(pe PacketEvent) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	if fo.closed {
+		return
+	}
+
+	// the struct was unpacked from the whole payload, only what is written is cut
+	data, sum := truncatePayload(pe.Packet.Base.Data, fo.maxPayload)
+	r := packetRecord{
+		PacketID:      pe.ID,
+		Seq:           pe.Seq,
+		FlowID:        pe.FlowID,
+		Seen:          pe.Seen,
+		Direction:     pe.Direction,
+		Src:           pe.Src,
+		Dst:           pe.Dst,
+		OperationCode: pe.Packet.Base.OperationCode,
+		Command:       pe.Packet.Base.ClientStructName,
+		Length:        len(pe.Packet.Base.Data),
+		Data:          hex.EncodeToString(data),
+		Truncated:     sum != "",
+		SHA1:          sum,
+	}
+	if pe.Decoded != "" {
+		r.Decoded = json.RawMessage(pe.Decoded)
+		r.Fields = pe.Fields
+	}
+	r.Context = pe.Context
+	r.CompressedSize, r.DecompressedSize = pe.CompressedSize, pe.DecompressedSize
+
+	fo.writeLine(r)
+}
+
+// the flow closed event ends the file, flows closed before any packet was written get a file with it alone
+func (fo *flowOutput) writeClosed(fe flowEvent) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+
+	if fo.closed {
+		return
+	}
+	fo.writeLine(flowClosedRecord{
+		FlowID:     fe.FlowID,
+		FlowName:   fe.FlowName,
+		FlowClosed: fe.Summary,
+	})
+}
+
+// called with the lock held, the file is created with the first line
+func (fo *flowOutput) writeLine(v interface{}) {
+	if fo.f == nil {
+		pathName, err := fo.session.path(fo.path)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		fo.session.register(pathName, artifactJSONL)
+		fo.f = f
+		fo.w = bufio.NewWriter(f)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	b = append(b, '\n')
+	if _, err := fo.w.Write(b); err != nil {
+		log.Error(err)
+	}
+}
+
+func (fo *flowOutput) flush() {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	if fo.w == nil || fo.closed {
+		return
+	}
+	if err := fo.w.Flush(); err != nil {
+		log.Error(err)
+	}
+}
+
+// flush buffered records every so often until the stream is done
+func (fo *flowOutput) flushPeriodically(ctx context.Context) {
+	t := time.NewTicker(outputFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fo.flush()
+		}
+	}
+}
+
+func (fo *flowOutput) close() {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	if fo.closed {
+		return
+	}
+	fo.closed = true
+	if fo.f == nil {
+		return
+	}
+	if err := fo.w.Flush(); err != nil {
+		log.Error(err)
+	}
+	if err := fo.f.Close(); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Pause stops handing decoded packets to the Handler and the outputs, streams are still reassembled and decoded
+// so the tcp and xor state stay correct, returns false if forwarding was already paused
+func (sn *Sniffer) Pause() bool {
+	if !atomic.CompareAndSwapUint32(&sn.paused, 0, 1) {
+		return false
+	}
+	log.Info("packet forwarding paused")
+	sn.ws.broadcast(envelope(wsCapture, captureEvent{State: "paused"}))
+	return true
+}
+
+// Resume forwards decoded packets again, returns how many were suppressed while paused
+func (sn *Sniffer) Resume() uint64 {
+	if !atomic.CompareAndSwapUint32(&sn.paused, 1, 0) {
+		return 0
+	}
+	suppressed := atomic.SwapUint64(&sn.suppressed, 0)
+	log.Infof("packet forwarding resumed, %v packets were suppressed", suppressed)
+	sn.ws.broadcast(envelope(wsCapture, captureEvent{State: "resumed", Suppressed: suppressed}))
+	return suppressed
+}
+
+// Paused reports whether forwarding is paused
+func (sn *Sniffer) Paused() bool {
+	return atomic.LoadUint32(&sn.paused) == 1
+}
+
+// true if the packet must not be forwarded, counting it as suppressed
+func (sn *Sniffer) suppress() bool {
+	if atomic.LoadUint32(&sn.paused) == 0 {
+		return false
+	}
+	atomic.AddUint64(&sn.suppressed, 1)
+	sn.metrics.packetSuppressed()
+	return true
+}
+
+// captureState is the json returned by the pause and resume endpoints
+type captureState struct {
+	Paused     bool   `json:"paused"`
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// POST /api/capture/pause and POST /api/capture/resume, GET /api/capture shows whether forwarding is paused
+func (sn *Sniffer) captureHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/capture"), "/")
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, captureState{
+			Paused:     sn.Paused(),
+			Suppressed: atomic.LoadUint64(&sn.suppressed),
+		})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !allowChange(w, r) {
+		return
+	}
+	switch action {
+	case "pause":
+		sn.Pause()
+		writeJSON(w, captureState{Paused: true})
+	case "resume":
+		writeJSON(w, captureState{Paused: false, Suppressed: sn.Resume()})
+	default:
+		http.NotFound(w, r)
+	}
+}
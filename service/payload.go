@@ -0,0 +1,53 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// payloadView is the whole payload of a packet, the outputs only have its first output.maxPayloadBytes
+type payloadView struct {
+	ID            string `json:"id"`
+	PacketID      string `json:"packetID"`
+	Seq           uint64 `json:"seq"`
+	FlowID        string `json:"flowID"`
+	OperationCode uint16 `json:"operationCode"`
+	Command       string `json:"command"`
+	Length        int    `json:"length"`
+	SHA1          string `json:"sha1"`
+	Data          string `json:"data"`
+}
+
+// GET /api/packets/{id}/payload returns the whole payload of a packet, as hex
+// numeric ids are sqlite row ids, any other id is the id of a packet in the history, or in the database once it left it
+func (sn *Sniffer) payloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/packets"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "payload" {
+		http.NotFound(w, r)
+		return
+	}
+
+	sp, err := sn.findPacket(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	sum := sha1.Sum(sp.Payload)
+	writeJSON(w, payloadView{
+		ID:            sp.ID,
+		PacketID:      sp.PacketID,
+		Seq:           sp.Seq,
+		FlowID:        sp.FlowID,
+		OperationCode: sp.OpCode,
+		Command:       sp.Command,
+		Length:        len(sp.Payload),
+		SHA1:          hex.EncodeToString(sum[:]),
+		Data:          hex.EncodeToString(sp.Payload),
+	})
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// waits between the attempts of network.waitForInterface, doubled after each one
+const (
+	interfaceRetryMin = time.Second
+	interfaceRetryMax = 30 * time.Second
+)
+
+// what libpcap, af_packet and npcap say when the capture isn't allowed, the interface doesn't exist (yet) or npcap is missing
+var (
+	permissionErrors = []string{"operation not permitted", "permission denied", "you don't have permission"}
+	missingErrors    = []string{"no such device", "no such network interface", "cannot find the device", "is not up", "network is down"}
+	npcapErrors      = []string{"wpcap.dll", "packet.dll", "npcap"}
+)
+
+func errorMatches(err error, messages []string) bool {
+	s := strings.ToLower(err.Error())
+	for _, m := range messages {
+		if strings.Contains(s, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// true if err means the interface isn't there or isn't up, which network.waitForInterface waits out
+func interfaceMissing(err error) bool {
+	return errorMatches(err, missingErrors)
+}
+
+// add what to do about err to it, for the failures opening a capture that have a known fix
+func captureSetupError(iface string, err error) error {
+	var hint string
+	switch {
+	case errorMatches(err, npcapErrors):
+		hint = "install Npcap from https://npcap.com/#download with the WinPcap API-compatible mode and start the sniffer again"
+	case errorMatches(err, permissionErrors):
+		hint = permissionHint()
+	case interfaceMissing(err) && runtime.GOOS == "windows":
+		hint = fmt.Sprintf("no interface %q, windows names them like \\Device\\NPF_{GUID}, sniffer devices lists them, capture --wait-for-interface waits for it to appear", iface)
+	case interfaceMissing(err):
+		hint = fmt.Sprintf("no interface %q that is up, sniffer devices lists them, capture --wait-for-interface waits for it to appear", iface)
+	default:
+		return err
+	}
+	return fmt.Errorf("%v: %v", err, hint)
+}
+
+func permissionHint() string {
+	switch runtime.GOOS {
+	case "linux":
+		executable, err := os.Executable()
+		if err != nil {
+			executable = "$(which sniffer)"
+		}
+		return fmt.Sprintf("capturing needs CAP_NET_RAW and CAP_NET_ADMIN, run it as root or grant them once with sudo setcap cap_net_raw,cap_net_admin=eip %v", executable)
+	case "darwin":
+		return "capturing needs read access to /dev/bpf*, run it with sudo or install the ChmodBPF launch daemon that comes with wireshark"
+	case "windows":
+		return "run it from an administrator prompt, or install Npcap without the option restricting capture to administrators"
+	default:
+		return "run it as root"
+	}
+}
+
+// open the capture until it works, or fails for another reason than its interface missing, waiting longer after each attempt
+// for captures that start before the network is up, e.g on a vm that is still booting
+func waitForInterface(ctx context.Context, open func() (PacketSourceProvider, error)) (PacketSourceProvider, error) {
+	wait := interfaceRetryMin
+	for attempt := 1; ; attempt++ {
+		s, err := open()
+		if err == nil || !interfaceMissing(err) {
+			return s, err
+		}
+		log.Warningf("attempt %v: %v, trying again in %v", attempt, err, wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("stopped waiting for the interface: %v", ctx.Err())
+		case <-t.C:
+		}
+		wait *= 2
+		if wait > interfaceRetryMax {
+			wait = interfaceRetryMax
+		}
+	}
+}
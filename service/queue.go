@@ -0,0 +1,134 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+)
+
+// segments a queue holds unless network.segmentQueue.size says otherwise
+const defaultSegmentQueueSize = 512
+
+// segment buffers larger than this aren't pooled, so a few huge segments don't stay in memory for the whole capture
+const maxPooledSegment = 64 << 10
+
+// buffers the reassembled bytes are copied into, the assembler reuses its pages once ReassembledSG returns
+var segmentBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+// a copy of data in a pooled buffer, the segment gives it back with release
+func pooledSegment(data []byte) *[]byte {
+	buf := segmentBuffers.Get().(*[]byte)
+	*buf = append((*buf)[:0], data...)
+	return buf
+}
+
+// release hands the buffer of the segment back to the pool once the decoder copied its bytes, or the queue dropped it
+// the segment has no data afterwards
+func (seg *shineSegment) release() {
+	if seg.buf == nil {
+		return
+	}
+	if cap(*seg.buf) <= maxPooledSegment {
+		*seg.buf = (*seg.buf)[:0]
+		segmentBuffers.Put(seg.buf)
+	}
+	seg.buf, seg.data = nil, nil
+}
+
+// what a segment queue does when its decoder falls behind
+type overflowPolicy int
+
+const (
+	// wait for the decoder, which stalls the assembler and, eventually, the capture
+	overflowBlock overflowPolicy = iota
+	// make room by dropping the segment that has waited the longest
+	overflowDropOldest
+	// drop the segment that doesn't fit
+	overflowDropNewest
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "", "block":
+		return overflowBlock, nil
+	case "drop-oldest":
+		return overflowDropOldest, nil
+	case "drop-newest":
+		return overflowDropNewest, nil
+	}
+	return overflowBlock, fmt.Errorf("unknown overflow policy %q, use block, drop-oldest or drop-newest", s)
+}
+
+// segmentQueue hands the reassembled segments of one direction of a stream to its decoder
+// segments are numbered as they are pushed, a decoder that sees a number missing knows segments were dropped
+// and treats it as a gap in the stream
+type segmentQueue struct {
+	ch     chan shineSegment
+	policy overflowPolicy
+	next   uint64
+	// called for every segment the policy drops
+	dropped func(seg shineSegment)
+}
+
+func newSegmentQueue(size int, policy overflowPolicy, dropped func(seg shineSegment)) *segmentQueue {
+	if size < 1 {
+		size = 1
+	}
+	return &segmentQueue{
+		ch:      make(chan shineSegment, size),
+		policy:  policy,
+		dropped: dropped,
+	}
+}
+
+// push is only called by the assembler, one segment at a time per stream
+func (q *segmentQueue) push(seg shineSegment) {
+	seg.index = q.next
+	q.next++
+
+	switch q.policy {
+	case overflowDropNewest:
+		select {
+		case q.ch <- seg:
+		default:
+			q.dropped(seg)
+		}
+	case overflowDropOldest:
+		for {
+			select {
+			case q.ch <- seg:
+				return
+			default:
+			}
+			// the decoder may have taken it in the meantime, then the next send has room
+			select {
+			case old := <-q.ch:
+				q.dropped(old)
+			default:
+			}
+		}
+	default:
+		q.ch <- seg
+	}
+}
+
+// segments waiting for the decoder
+func (q *segmentQueue) depth() int {
+	return len(q.ch)
+}
+
+// segmentSequence tells a decoder whether segments were dropped before the one it received
+type segmentSequence struct {
+	next uint64
+}
+
+// true if the segments before seg were all received
+func (s *segmentSequence) inOrder(seg shineSegment) bool {
+	ok := seg.index == s.next
+	s.next = seg.index + 1
+	return ok
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// indices of the segments left in a queue whose decoder stalled
+func queued(q *segmentQueue) []uint64 {
+	var indices []uint64
+	for len(q.ch) > 0 {
+		indices = append(indices, (<-q.ch).index)
+	}
+	return indices
+}
+
+func TestSegmentQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy          string
+		queued, dropped []uint64
+	}{
+		{"drop-newest", []uint64{0, 1, 2}, []uint64{3, 4, 5}},
+		{"drop-oldest", []uint64{3, 4, 5}, []uint64{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			policy, err := parseOverflowPolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dropped []uint64
+			q := newSegmentQueue(3, policy, func(seg shineSegment) {
+				dropped = append(dropped, seg.index)
+			})
+			for i := 0; i < 6; i++ {
+				q.push(shineSegment{data: []byte{byte(i)}})
+			}
+			if q.depth() != 3 {
+				t.Errorf("depth %v, expected 3", q.depth())
+			}
+			if got := queued(q); !reflect.DeepEqual(got, tt.queued) {
+				t.Errorf("segments %v queued, expected %v", got, tt.queued)
+			}
+			if !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("segments %v dropped, expected %v", dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+// a full queue with the block policy waits for its decoder and drops nothing
+func TestSegmentQueueBlocks(t *testing.T) {
+	q := newSegmentQueue(2, overflowBlock, func(seg shineSegment) {
+		t.Errorf("segment %v dropped", seg.index)
+	})
+	q.push(shineSegment{})
+	q.push(shineSegment{})
+	pushed := make(chan struct{})
+	go func() {
+		q.push(shineSegment{})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("a segment was pushed into a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-q.ch
+	select {
+	case <-pushed:
+	case <-time.After(testPipelineWait):
+		t.Fatal("the push didn't go through once the decoder took a segment")
+	}
+	if got := queued(q); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("segments %v queued, expected [1 2]", got)
+	}
+}
+
+// a decoder sees the segments dropped before the one it got as a gap
+func TestSegmentSequence(t *testing.T) {
+	var s segmentSequence
+	for _, tt := range []struct {
+		index   uint64
+		inOrder bool
+	}{
+		{0, true},
+		{1, true},
+		{3, false},
+		{4, true},
+		{7, false},
+	} {
+		if got := s.inOrder(shineSegment{index: tt.index}); got != tt.inOrder {
+			t.Errorf("segment %v in order %v, expected %v", tt.index, got, tt.inOrder)
+		}
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		s      string
+		policy overflowPolicy
+		err    bool
+	}{
+		{"", overflowBlock, false},
+		{"block", overflowBlock, false},
+		{"drop-oldest", overflowDropOldest, false},
+		{"drop-newest", overflowDropNewest, false},
+		{"drop", overflowBlock, true},
+	}
+	for _, tt := range tests {
+		policy, err := parseOverflowPolicy(tt.s)
+		if policy != tt.policy || (err != nil) != tt.err {
+			t.Errorf("%q: policy %v, error %v", tt.s, policy, err)
+		}
+	}
+}
+
+// a handler that stops taking packets stalls the decoders, the segments that don't fit are dropped and counted for
+// their flow, once it goes on the decoder resynchronizes on the segments it still has
+func TestStalledDecoderDropsSegments(t *testing.T) {
+	const packets = 2000
+	for _, policy := range []string{"drop-newest", "drop-oldest"} {
+		t.Run(policy, func(t *testing.T) {
+			c := testConfig()
+			c.SegmentQueueSize = 4
+			c.ServerOverflow = policy
+
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			for i := 0; i < packets; i++ {
+				if err := conv.FromServer(EncodeShinePacket(opLoginAck, []byte{byte(i), byte(i >> 8)})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			sn, err := NewSniffer(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := &eventSink{}
+			release := make(chan struct{})
+			sn.Handler = func(pe PacketEvent) {
+				<-release
+				sink.handle(pe)
+			}
+			sn.Source = ms
+			if err := sn.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// the capture isn't held up by the stalled decoder
+			select {
+			case <-sn.Done():
+			case <-time.After(testPipelineWait):
+				t.Fatal("the capture waited for the stalled decoder")
+			}
+			close(release)
+			sn.Stop()
+
+			summary := sn.Summary()
+			if len(summary) != 1 || summary[0].SegmentsDropped == 0 {
+				t.Fatalf("expected one flow with dropped segments, got %+v", summary)
+			}
+			payloads := payloadsOf(sink.byDirection(), opLoginAck)
+			if len(payloads) == 0 || len(payloads) >= packets {
+				t.Fatalf("%v of %v packets decoded", len(payloads), packets)
+			}
+			for _, p := range payloads {
+				if len(p) != 2 {
+					t.Errorf("a packet decoded to %x", p)
+				}
+			}
+		})
+	}
+}
+
+// the pooled segment buffers are handed back by the decoders and by the queues that drop them while the assembler takes
+// new ones and the raw tap writes them, none may be reused while its bytes are still read, run with -race
+func TestPooledSegments(t *testing.T) {
+	const packets = 5000
+	for _, policy := range []string{"drop-newest", "drop-oldest"} {
+		t.Run(policy, func(t *testing.T) {
+			dir := t.TempDir()
+			c := testConfig()
+			c.session = &session{dir: dir}
+			c.SegmentQueueSize = 2
+			c.ClientOverflow = policy
+			c.ServerOverflow = policy
+			c.RawTap = true
+			c.RawTapDecode = true
+			c.Redact = false
+
+			// every payload is its index followed by 14 copies of its low byte, bytes of another buffer show up as a mix
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			var stream []byte
+			for i := 0; i < packets; i++ {
+				payload := make([]byte, 16)
+				binary.LittleEndian.PutUint16(payload, uint16(i))
+				for j := 2; j < len(payload); j++ {
+					payload[j] = byte(i)
+				}
+				data := EncodeShinePacket(opLoginAck, payload)
+				stream = append(stream, data...)
+				if err := conv.FromServer(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			sn, err := NewSniffer(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := &eventSink{}
+			release := make(chan struct{})
+			sn.Handler = func(pe PacketEvent) {
+				<-release
+				sink.handle(pe)
+			}
+			sn.Source = ms
+			if err := sn.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-sn.Done():
+			case <-time.After(testPipelineWait):
+				t.Fatal("the capture waited for the stalled decoder")
+			}
+			close(release)
+			sn.Stop()
+
+			summary := sn.Summary()
+			if len(summary) != 1 || summary[0].SegmentsDropped == 0 {
+				t.Fatalf("expected one flow with dropped segments, got %+v", summary)
+			}
+			payloads := payloadsOf(sink.byDirection(), opLoginAck)
+			if len(payloads) == 0 {
+				t.Fatal("no packets decoded")
+			}
+			for _, p := range payloads {
+				if len(p) != 16 || !bytes.Equal(p[2:], bytes.Repeat(p[:1], 14)) {
+					t.Errorf("a packet decoded to %x", p)
+				}
+			}
+
+			// the raw tap wrote every segment before it was queued, the dropped ones too
+			raw, err := filepath.Glob(filepath.Join(dir, "*.raw"))
+			if err != nil || len(raw) != 1 {
+				t.Fatalf("raw files %v: %v", raw, err)
+			}
+			tapped, err := ioutil.ReadFile(raw[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			index, err := os.Open(raw[0] + rawTapIndexSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.Close()
+			var inbound []byte
+			lines := bufio.NewScanner(index)
+			// the header
+			lines.Scan()
+			for lines.Scan() {
+				var seg rawTapSegment
+				if err := json.Unmarshal(lines.Bytes(), &seg); err != nil {
+					t.Fatal(err)
+				}
+				if seg.Direction == "inbound" {
+					inbound = append(inbound, tapped[seg.Offset:seg.Offset+int64(seg.Length)]...)
+				}
+			}
+			if !bytes.Equal(inbound, stream) {
+				t.Errorf("the raw tap has %v bytes of the server stream, expected the %v sent", len(inbound), len(stream))
+			}
+		})
+	}
+}
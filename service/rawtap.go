@@ -0,0 +1,348 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rawTap writes the reassembled bytes of a stream as they are, before any decoding, to <flowName>-<flowID>.raw in the
+// session directory, and a line per segment to <flowName>-<flowID>.raw.idx, so sniffer decode-raw can decode them later
+// with another xor key or commands file, the endpoints are the same as the ones of the decrypted pcaps
+type rawTap struct {
+	session *session
+	path    string
+	header  rawTapHeader
+	raw     *os.File
+	index   *os.File
+	offset  int64
+	closed  bool
+	mu      sync.Mutex
+}
+
+// rawTapHeader is the first line of an index file
+type rawTapHeader struct {
+	FlowName string `json:"flowName"`
+	FlowID   string `json:"flowID"`
+	Client   string `json:"client"`
+	Server   string `json:"server"`
+}
+
+// rawTapSegment is a line of an index file, the segment is Length bytes at Offset of the raw file
+// Skip is what the assembler reported as missing before the segment, -1 if unknown
+type rawTapSegment struct {
+	Offset    int64     `json:"offset"`
+	Length    int       `json:"length"`
+	Seen      time.Time `json:"seen"`
+	Direction string    `json:"direction"`
+	Skip      int       `json:"skip,omitempty"`
+}
+
+const rawTapIndexSuffix = ".idx"
+
+func newRawTap(s *session, flowName, flowID string, net, transport gopacket.Flow, srcIsServer bool) *rawTap {
+	client := flowAddress(net.Src(), transport.Src())
+	server := flowAddress(net.Dst(), transport.Dst())
+	if srcIsServer {
+		client, server = server, client
+	}
+	return &rawTap{
+		session: s,
+		path:    fmt.Sprintf("%v-%v.raw", flowName, flowID),
+		header: rawTapHeader{
+			FlowName: flowName,
+			FlowID:   flowID,
+			Client:   s.anonymizer().tcpAddr(client).String(),
+			Server:   s.anonymizer().tcpAddr(server).String(),
+		},
+	}
+}
+
+// both files are created with the first segment
+func (rt *rawTap) open() error {
+	pathName, err := rt.session.path(rt.path)
+	if err != nil {
+		return err
+	}
+	raw, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(pathName+rawTapIndexSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		raw.Close()
+		return err
+	}
+	rt.session.register(pathName, artifactRaw)
+	rt.session.register(pathName+rawTapIndexSuffix, artifactRawIndex)
+	rt.raw, rt.index = raw, index
+	return rt.writeIndex(rt.header)
+}
+
+func (rt *rawTap) writeIndex(v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = rt.index.Write(append(d, '\n'))
+	return err
+}
+
+// write a segment as the assembler handed it over, called by the assembler before the segment is queued
+func (rt *rawTap) write(seg shineSegment) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.closed {
+		return
+	}
+	if rt.raw == nil {
+		if err := rt.open(); err != nil {
+			log.Error(err)
+			rt.closed = true
+			return
+		}
+	}
+	if _, err := rt.raw.Write(seg.data); err != nil {
+		log.Error(err)
+		return
+	}
+	err := rt.writeIndex(rawTapSegment{
+		Offset:    rt.offset,
+		Length:    len(seg.data),
+		Seen:      seg.seen,
+		Direction: seg.direction,
+		Skip:      seg.skip,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	rt.offset += int64(len(seg.data))
+}
+
+func (rt *rawTap) close() {
+	if rt == nil {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.closed {
+		return
+	}
+	rt.closed = true
+	if rt.raw == nil {
+		return
+	}
+	for _, f := range []*os.File{rt.raw, rt.index} {
+		if err := f.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// read a raw file with its index and add its segments to frames as the tcp connection they were reassembled from
+// gaps are kept, the sequence numbers jump over the missing bytes so the assembler reports them again
+func addRawTap(frames frameAdder, path string) (rawTapHeader, int, error) {
+	var header rawTapHeader
+	raw, err := os.Open(path)
+	if err != nil {
+		return header, 0, err
+	}
+	defer raw.Close()
+	index, err := os.Open(path + rawTapIndexSuffix)
+	if err != nil {
+		return header, 0, err
+	}
+	defer index.Close()
+
+	lines := bufio.NewScanner(index)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !lines.Scan() {
+		if err := lines.Err(); err != nil {
+			return header, 0, err
+		}
+		return header, 0, fmt.Errorf("%v: empty index", path+rawTapIndexSuffix)
+	}
+	if err := json.Unmarshal(lines.Bytes(), &header); err != nil {
+		return header, 0, fmt.Errorf("%v: header: %v", path+rawTapIndexSuffix, err)
+	}
+	client, err := net.ResolveTCPAddr("tcp", header.Client)
+	if err != nil {
+		return header, 0, fmt.Errorf("%v: client: %v", path+rawTapIndexSuffix, err)
+	}
+	server, err := net.ResolveTCPAddr("tcp", header.Server)
+	if err != nil {
+		return header, 0, fmt.Errorf("%v: server: %v", path+rawTapIndexSuffix, err)
+	}
+
+	conv := newTCPConversation(frames, client, server, time.Time{})
+	var (
+		segments int
+		last     time.Time
+	)
+	for line := 2; lines.Scan(); line++ {
+		var s rawTapSegment
+		if err := json.Unmarshal(lines.Bytes(), &s); err != nil {
+			return header, segments, fmt.Errorf("%v:%v: %v", path+rawTapIndexSuffix, line, err)
+		}
+		data := make([]byte, s.Length)
+		if _, err := raw.ReadAt(data, s.Offset); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return header, segments, fmt.Errorf("%v: segment at offset %v: %v", path, s.Offset, err)
+		}
+		if segments == 0 {
+			if err := conv.handshake(s.Seen); err != nil {
+				return header, segments, err
+			}
+		}
+		fromClient := s.Direction == "outbound"
+		if s.Skip != 0 {
+			gap := uint32(s.Skip)
+			if s.Skip < 0 {
+				// any gap makes the decoder resynchronize, its size only matters to the log
+				gap = 1
+			}
+			if fromClient {
+				conv.clientSeq += gap
+			} else {
+				conv.serverSeq += gap
+			}
+		}
+		if err := conv.send(s.Seen, fromClient, data); err != nil {
+			return header, segments, err
+		}
+		segments++
+		last = s.Seen
+	}
+	if err := lines.Err(); err != nil {
+		return header, segments, err
+	}
+	if segments > 0 {
+		conv.seen = last
+		if err := conv.Close(); err != nil {
+			return header, segments, err
+		}
+	}
+	return header, segments, nil
+}
+
+// the raw files of the arguments, a session directory stands for the raw files its manifest lists, or that are in it
+func rawTapFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		listed, ok, err := sessionArtifacts(arg, artifactRaw)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if listed, err = filepath.Glob(filepath.Join(arg, "*.raw")); err != nil {
+				return nil, err
+			}
+		}
+		if len(listed) == 0 {
+			return nil, fmt.Errorf("%v has no raw files, capture with --raw-tap", arg)
+		}
+		files = append(files, listed...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// DecodeRaw runs the raw files of sniffer capture --raw-tap through the assembler and the decoders as a new session,
+// with the outputs, xor key and commands file of the config
+func DecodeRaw(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatal("decode-raw needs raw files or session directories, e.g output/2020-05-01T12-30-00")
+	}
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := rawTapFiles(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := startSession(false, quiet, viper.GetBool("output.anonymize.enabled"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	console = newConsolePrinter(os.Stdout, quiet, true, viper.GetBool("protocol.log.verbose"))
+
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the raw files are the input, writing them again would only copy them
+	c.RawTap = false
+	c.RawTapDecode = true
+	c.session = s
+	if err := s.start("decode-raw", c); err != nil {
+		log.Fatal(err)
+	}
+
+	ms := NewMemorySource()
+	for _, f := range files {
+		header, segments, err := addRawTap(ms, f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("%v: %v segments of %v between %v and %v", f, segments, header.FlowName, header.Client, header.Server)
+	}
+	// the flows are reassembled side by side, as they were captured
+	ms.sortByTime()
+
+	sn, err := NewSniffer(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sn.Source = ms
+	sn.AddSink(console)
+	sn.AddSink(packetViews{ws: sn.ws, maxPayload: c.MaxPayloadBytes})
+	sn.Handler = logPacket
+	ocs = &opCodeStructs{
+		structs: make(map[uint16]string),
+	}
+	em.Entities = make(map[uint16][]Movement)
+
+	if err := sn.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sn.Done():
+	case <-sig:
+		log.Info("stopping decode-raw")
+	}
+	sn.Stop()
+	summary := sn.Summary()
+	exportSummary(s, summary)
+	exportEntitiesMovements(s)
+	if err := s.finish(captureTotals(sn, summary)); err != nil {
+		log.Error(err)
+	}
+	fmt.Printf("%v raw files decoded to %v\n", len(files), s.dir)
+}
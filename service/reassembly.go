@@ -2,7 +2,6 @@ package service
 
 import (
 	"context"
-	"encoding/hex"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -10,178 +9,356 @@ import (
 	"github.com/google/gopacket/reassembly"
 	"github.com/google/logger"
 	"github.com/google/uuid"
-	"github.com/shine-o/shine.engine.core/networking"
-	"github.com/spf13/viper"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
 func init() {
-	lf, err := os.OpenFile("output/streams.log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
+	// commands that don't start a session log here
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		logger.Fatalf("Failed to create %v: %v", outputDir, err)
+	}
+	lf, err := os.OpenFile(filepath.Join(outputDir, "streams.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
 	if err != nil {
 		logger.Fatalf("Failed to open log file: %v", err)
 	}
-	log = logger.Init("SnifferLogger", true, false, lf)
+	log = newLogger(lf, true, nil)
 	log.Info("sniffer logger init()")
 }
 
 type shineStreamFactory struct {
 	shineContext   context.Context
+	sniffer        *Sniffer
 	localAddresses []pcap.InterfaceAddress
+	// done once every stream has handled all of its decoded packets
+	wg sync.WaitGroup
 }
 
 type shineStream struct {
+	sniffer        *Sniffer
 	flowID         string
+	flowName       string
+	sessionID      string
 	net, transport gopacket.Flow
-	client         chan<- shineSegment
-	server         chan<- shineSegment
+	client         *segmentQueue
+	server         *segmentQueue
 	packets        chan<- decodedPacket
 	xorKey         chan<- uint16
-	cancel         context.CancelFunc
-	isServer       bool
-	mu             sync.Mutex
+	xor            XorSettings
+	// the xor settings of the service, xor is the ones of the protocol version of the session if it has any
+	serviceXor XorSettings
+	// the protocol version the operation codes are named with, nil for protocol.commands
+	version     *protocolVersion
+	versionMu   sync.Mutex
+	cancel      context.CancelFunc
+	isServer    bool
+	output      *flowOutput
+	flowLog     *flowLog
+	decrypted   *decryptedPcap
+	rawTap      *rawTap
+	undecodable *undecodableOutput
+	gameContext *flowContext
+	history     *packetHistory
+	dedup       *packetDedup
+	latency     *flowLatency
+	clientWatch *decoderWatch
+	serverWatch *decoderWatch
+	// nil unless packets can be injected, see injector
+	sequences *flowSequences
+	// operation codes whose payload failed to decompress, see decompress
+	undecompressed map[uint16]bool
+	// capture time of the last segment of either side, the flow completes at that time
+	lastPacket time.Time
+	stats      flowStats
+	decoders   sync.WaitGroup
+	mu         sync.Mutex
 }
 
-var (
-	iface             string
-	snaplen           int
-	filter            string
-	log               *logger.Logger
-	serverSideCapture bool
-)
+var log *logger.Logger
 
-func config() {
-	dir, err := filepath.Abs("output/")
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
+// shineStreams keeps track of the streams that haven't finished yet, by flowID
+// a client reconnecting from the same port gets a new flowID, so its stream never replaces one that is still decoding,
+// and the xor key goes from the server decoder to the client decoder over a channel of their own stream
+// the stats of finished streams are kept per flow name
+type shineStreams struct {
+	streams  map[string]*shineStream
+	finished map[string]*FlowSummary
+	mu       sync.Mutex
+}
 
-	} else {
-		err = os.RemoveAll(dir)
-		if err != nil {
-			log.Error(err)
-		}
+func (sss *shineStreams) add(ss *shineStream) {
+	sss.mu.Lock()
+	sss.streams[ss.flowID] = ss
+	sss.mu.Unlock()
+}
+
+// remove a stream once all of its packets were handled, so its stats are final
+func (sss *shineStreams) remove(ss *shineStream) {
+	sss.mu.Lock()
+	delete(sss.streams, ss.flowID)
+	mergeStats(sss.finished, ss.flowName, &ss.stats)
+	sss.mu.Unlock()
+}
+
+// ip:port of the side that opened the stream, ipv6 addresses are bracketed, e.g [::1]:9010
+func srcAddress(network, transport gopacket.Flow) string {
+	return net.JoinHostPort(network.Src().String(), transport.Src().String())
+}
+
+func dstAddress(network, transport gopacket.Flow) string {
+	return net.JoinHostPort(network.Dst().String(), transport.Dst().String())
+}
+
+// the namespace of the flow ids, they are name based so reprocessing a pcap gives its flows the same ids
+var flowIDNamespace = uuid.MustParse("5b0c6a2e-3f1d-4c8e-9a57-0d2e8f4b71c3")
+
+// the id of the stream between the endpoints of network and transport that started at seen, the capture time of its
+// first packet
+func streamFlowID(network, transport gopacket.Flow, seen time.Time) string {
+	return uuid.NewSHA1(flowIDNamespace, []byte(fmt.Sprintf("%v %v %v", network, transport, seen.UnixNano()))).String()
+}
+
+// an opened event for every stream that hasn't finished yet
+func (sss *shineStreams) openFlows() []flowEvent {
+	sss.mu.Lock()
+	defer sss.mu.Unlock()
+	events := make([]flowEvent, 0, len(sss.streams))
+	for _, ss := range sss.streams {
+		events = append(events, newFlowEvent(ss, true))
 	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].FlowName < events[j].FlowName
+	})
+	return events
+}
 
-	err = os.Mkdir(dir, 0700)
+func (ss *shineStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	ss.mu.Lock()
+	ss.lastPacket = ci.Timestamp
+	ss.mu.Unlock()
+	// a packet cut short by the snaplen is missing the end of its payload, decoding it would read lengths past the captured bytes
+	// rejecting it leaves a gap in the stream, so the decoders resynchronize instead of producing garbage
+	if ci.CaptureLength < ci.Length {
+		if ss.stats.packetTruncated() {
+			log.Errorf("[%v] [ %v ] [ %v ] packet of %v bytes truncated to %v, the flow is unreliable, raise network.snaplen to at least %v",
+				ss.flowName, ss.net, ss.transport, ci.Length, ci.CaptureLength, ci.Length)
+		}
+		ss.sniffer.metrics.packetTruncated(ss.flowName)
+		return false
+	}
+	if ss.sequences != nil {
+		src, dst := ss.net.Src(), ss.net.Dst()
+		if dir == reassembly.TCPDirServerToClient {
+			src, dst = dst, src
+		}
+		ss.sequences.observe(tcp, (dir == reassembly.TCPDirClientToServer) != ss.isServer, src, dst, ac)
+	}
+	return true
+}
 
-	if err != nil {
-		log.Error(err)
+func (ssf *shineStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	// e.g the last ack of a connection that just completed, it would open a flow that never gets any data
+	if !opensStream(tcp) {
+		return &pendingStream{factory: ssf, net: net, transport: transport}
 	}
+	return ssf.newStream(net, transport, ac)
+}
 
-	iface = viper.GetString("network.interface")
-	serverSideCapture = viper.GetBool("network.serverSideCapture")
-	snaplen = viper.GetInt("network.snaplen")
+func (ssf *shineStreamFactory) newStream(net, transport gopacket.Flow, ac reassembly.AssemblerContext) reassembly.Stream {
+	srcPort, _ := strconv.Atoi(transport.Src().String())
+	dstPort, _ := strconv.Atoi(transport.Dst().String())
 
-	if viper.GetBool("network.portRange.useThis") {
-		startPort := viper.GetString("network.portRange.start")
-		endPort := viper.GetString("network.portRange.end")
-		portRange := fmt.Sprintf("%v-%v", startPort, endPort)
-		filter = fmt.Sprintf("tcp and portrange %v", portRange)
-		log.Infof("using bpf filter %v", filter)
-	} else {
-		specificPorts := viper.GetIntSlice("network.specificPorts.ports")
-		for i, p := range specificPorts {
-			if i == 0 {
-				filter = fmt.Sprintf("tcp port %v", p)
-			} else {
-				filter += fmt.Sprintf(" or port %v", p)
-			}
+	sn := ssf.sniffer
+	// the bpf filter already does it, unless network.customFilter replaced it
+	if !clientAllowed(sn.config.ClientNets, net) {
+		return &discardStream{}
+	}
+	service, port, srcIsServer, known := sn.services.resolve(srcPort, dstPort)
+	// numbered before anything is logged about the stream
+	sn.session.anonymizer().endpoints(net, srcIsServer)
+	if !known {
+		if sn.services.isStrict() {
+			log.Warningf("discarding stream from => [ %v ] [ %v ], no known service", net, transport)
+			return &discardStream{}
 		}
-		log.Infof("using bpf filter %v", filter)
+		log.Warningf("no known service for stream [ %v ] [ %v ], using %v", net, transport, service)
 	}
 
-	s := &networking.Settings{}
+	ctx, cancel := context.WithCancel(ssf.shineContext)
 
-	xorKey, err := hex.DecodeString(viper.GetString("protocol.xorKey"))
-	if err != nil {
-		log.Fatal(err)
+	// buffered so the server decoder can hand the key over without waiting for the client decoder
+	xorKey := make(chan uint16, 1)
+
+	seen := ac.GetCaptureInfo().Timestamp
+	s := &shineStream{
+		sniffer:    sn,
+		flowID:     streamFlowID(net, transport, seen),
+		flowName:   fmt.Sprintf("%v-client", service),
+		net:        net,
+		transport:  transport,
+		xorKey:     xorKey,
+		serviceXor: sn.config.xorSettings(port),
+		cancel:     cancel,
+		// server - client
+		isServer:    srcIsServer,
+		clientWatch: newDecoderWatch(),
+		serverWatch: newDecoderWatch(),
 	}
 
-	s.XorKey = xorKey
+	// a decoder that falls behind is handled as its direction's overflow policy says
+	dropped := func(seg shineSegment) {
+		sn.metrics.segmentDropped(s.flowName, seg.direction)
+		s.stats.segmentDropped()
+		seg.release()
+	}
+	s.client = newSegmentQueue(sn.config.SegmentQueueSize, sn.clientOverflow, dropped)
+	s.server = newSegmentQueue(sn.config.SegmentQueueSize, sn.serverOverflow, dropped)
+	packets := make(chan decodedPacket, 512)
+	s.packets = packets
 
-	xorLimit, err := strconv.Atoi(viper.GetString("protocol.xorLimit"))
+	if sn.config.JSONOutput {
+		s.output = newFlowOutput(sn.session, s.flowName, s.flowID, sn.config.MaxPayloadBytes)
+		go s.output.flushPeriodically(ctx)
+	}
 
-	if err != nil {
-		log.Fatal(err)
+	if sn.config.PerFlowLogs {
+		s.flowLog = newFlowLog(sn.session, s.flowName, s.flowID, sn.config.LogVerbose)
+		go s.flowLog.flushPeriodically(ctx)
 	}
 
-	s.XorLimit = uint16(xorLimit)
-	if path, err := filepath.Abs(viper.GetString("protocol.commands")); err != nil {
-		log.Error(err)
-	} else {
-		s.CommandsFilePath = path
+	s.undecodable = newUndecodableOutput(sn.session, s.flowName, s.flowID)
+	s.gameContext = newFlowContext()
+
+	if sn.config.DecryptedPcap {
+		s.decrypted = newDecryptedPcap(sn.session, s.flowName, s.flowID, net, transport, srcIsServer)
 	}
-	s.Set()
-}
 
-func (ss *shineStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
-	// todo: save it to pcap file
-	return true
-}
+	if sn.config.RawTap {
+		s.rawTap = newRawTap(sn.session, s.flowName, s.flowID, net, transport, srcIsServer)
+	}
 
-func (ssf *shineStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
-	ctx, cancel := context.WithCancel(ssf.shineContext)
+	if sn.injector != nil {
+		s.sequences = &flowSequences{}
+	}
 
-	xorKey := make(chan uint16)
-	xorKeyFound := make(chan bool)
+	if sn.config.HistorySize > 0 {
+		s.history = newPacketHistory(sn.config.HistorySize)
+	}
 
-	s := &shineStream{
-		flowID:    uuid.New().String(),
-		net:       net,
-		transport: transport,
-		xorKey:    xorKey,
-		cancel:    cancel,
-		isServer:  false,
+	if sn.config.Dedup {
+		s.dedup = newPacketDedup(sn.config.DedupWindow, sn.config.DedupSize)
 	}
 
-	srcPort, _ := strconv.Atoi(transport.Src().String())
-	if srcPort >= 9000 && srcPort <= 9600 {
-		// server - client
-		s.isServer = true
+	if len(sn.config.LatencyPairs) > 0 {
+		s.latency = newFlowLatency(sn.config.LatencyPairs, sn.config.LatencyTimeout)
 	}
 
-	client := make(chan shineSegment, 512)
-	server := make(chan shineSegment, 512)
-	packets := make(chan decodedPacket, 512)
-	s.client = client
-	s.server = server
-	s.packets = packets
+	// before the decoders start, they decode with the protocol version of the session
+	s.sessionID = sn.sessions.flowOpened(s, seen)
+	s.version = sn.sessions.version(s.sessionID)
+	s.xor = s.version.xorSettings(s.serviceXor)
+
+	s.decoders.Add(2)
+	go func() {
+		defer s.decoders.Done()
+		s.decodeServerPackets(ctx, s.server.ch, xorKey)
+	}()
+	go func() {
+		defer s.decoders.Done()
+		s.decodeClientPackets(ctx, s.client.ch, xorKey)
+	}()
+
+	// decoders are the only ones sending packets, once they are done the workers can finish
+	go func() {
+		s.decoders.Wait()
+		close(packets)
+		if s.latency != nil {
+			s.latencyUnmatched(s.latency.close())
+		}
+	}()
 
-	go s.decodeServerPackets(ctx, server, xorKeyFound, xorKey)
-	go s.decodeClientPackets(ctx, client, xorKeyFound, xorKey)
-	go s.handleDecodedPackets(ctx, packets)
+	ssf.wg.Add(1)
+	go func() {
+		defer ssf.wg.Done()
+		s.handleDecodedPackets(packets, sn.config.Workers)
+		sn.streams.remove(s)
+	}()
 
-	log.Infof("new stream from => [ %v ] [ %v ]", net, transport)
+	sn.streams.add(s)
+	sn.ws.sendFlowEvent(newFlowEvent(s, true))
+	if sn.store != nil {
+		sn.store.flowStarted(s, seen)
+	}
+
+	log.Infof("new stream %v from => [ %v ] [ %v ]", s.flowName, net, transport)
 	return s
 }
 
 func (ss *shineStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
 	length, _ := sg.Lengths()
-	if length == 0 {
+	dir, start, end, skip := sg.Info()
+	// empty segments still matter if they report a gap
+	if length == 0 && skip == 0 {
 		return
 	}
 
-	dir, _, _, _ := sg.Info()
+	if skip > 0 && ss.sniffer.assembling && (ss.sniffer.config.MaxBufferedPages > 0 || ss.sniffer.config.MaxConnectionPages > 0) {
+		ss.sniffer.metrics.assemblerSkip(ss.flowName)
+		if ss.stats.pageLimitReached() {
+			ss.warningf("[%v] [ %v ] [ %v ] the assembler ran out of pages and skipped %v missing bytes, raise network.assembler.maxBufferedPagesTotal or maxBufferedPagesPerConnection if memory allows",
+				ss.flowName, ss.net, ss.transport, skip)
+		}
+	}
 
+	// Fetch returns the pages of the assembler as they are when the segment fits in one, they are reused once this returns
+	buf := pooledSegment(sg.Fetch(length))
 	seg := shineSegment{
-		data: sg.Fetch(length),
-		seen: ac.GetCaptureInfo().Timestamp,
+		data:  *buf,
+		buf:   buf,
+		seen:  ac.GetCaptureInfo().Timestamp,
+		skip:  skip,
+		start: start,
+		end:   end,
 	}
-	//log.Info(dir, ss.net.String())
-	ss.mu.Lock()
+	seg.direction = "inbound"
 	if dir == reassembly.TCPDirClientToServer && !ss.isServer {
 		seg.direction = "outbound"
-		ss.client <- seg
+	}
+	if ss.rawTap != nil {
+		ss.rawTap.write(seg)
+		if !ss.sniffer.config.RawTapDecode {
+			ss.sniffer.metrics.segmentReceived(ss.flowName, seg.direction, len(seg.data))
+			ss.stats.segmentReceived(seg.seen, len(seg.data))
+			seg.release()
+			return
+		}
+	}
+	ss.mu.Lock()
+	if seg.direction == "outbound" {
+		ss.client.push(seg)
 	} else {
-		seg.direction = "inbound"
-		ss.server <- seg
+		ss.server.push(seg)
 	}
 	ss.mu.Unlock()
 }
 
 func (ss *shineStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	log.Warningf("reassembly complete for stream [ %v - %v]", ss.net.String(), ss.transport.String()) // ip of the stream, port of the stream
+	log.Warningf("reassembly complete for stream %v [ %v - %v]", ss.flowName, ss.net.String(), ss.transport.String()) // ip of the stream, port of the stream
+	// the flow closed event is sent once the decoders flushed what was buffered and every packet was handled
 	ss.cancel()
-	return false
+	// the stats are updated by the decoders, they may not have caught up yet
+	ss.mu.Lock()
+	lastSeen := ss.lastPacket
+	ss.mu.Unlock()
+	ss.sniffer.sessions.flowCompleted(ss, lastSeen)
+	if ss.sniffer.store != nil {
+		ss.sniffer.store.flowCompleted(ss, lastSeen)
+	}
+	// nothing else will be decoded for this stream, so the assembler can forget about the connection
+	return true
 }
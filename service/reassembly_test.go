@@ -0,0 +1,400 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// heldSource is a MemorySource whose capture only ends once release is closed, like a live capture that went quiet
+type heldSource struct {
+	*MemorySource
+	release chan struct{}
+}
+
+func newHeldSource() *heldSource {
+	return &heldSource{MemorySource: NewMemorySource(), release: make(chan struct{})}
+}
+
+func (hs *heldSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := hs.MemorySource.ReadPacketData()
+	if err == io.EOF {
+		<-hs.release
+	}
+	return data, ci, err
+}
+
+func (hs *heldSource) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(hs, layers.LinkTypeEthernet)
+}
+
+// the number of streams that haven't completed yet
+func (sn *Sniffer) activeStreams() int {
+	sn.streams.mu.Lock()
+	defer sn.streams.mu.Unlock()
+	return len(sn.streams.streams)
+}
+
+// wait until n streams are left, the capture keeps running meanwhile
+func waitForStreams(t *testing.T, sn *Sniffer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testPipelineWait)
+	for sn.activeStreams() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v active streams, expected %v", sn.activeStreams(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// a connection that went silent without a FIN is completed once the capture moved flushInterval past it
+func TestFlushStaleStreams(t *testing.T) {
+	c := testConfig()
+	c.FlushInterval = 20 * time.Millisecond
+
+	hs := newHeldSource()
+	stale, err := NewTCPConversation(hs.MemorySource, testClientAddr, testServerAddr, testStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.FromServer(seedPacket(testSeed)); err != nil {
+		t.Fatal(err)
+	}
+	live, err := NewTCPConversation(hs.MemorySource, "192.168.1.20:50001", testServerAddr, testStart.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.FromServer(seedPacket(testSeed)); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn.Source = hs
+	if err := sn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// only the stale stream is flushed, the other one was active at the last captured packet
+	waitForStreams(t, sn, 1)
+	close(hs.release)
+	<-sn.Done()
+	sn.Stop()
+
+	summary := sn.Summary()
+	if len(summary) != 1 || summary[0].Streams != 2 || summary[0].Packets != 2 {
+		t.Errorf("expected two streams with a packet each, got %+v", summary)
+	}
+}
+
+// a client reconnecting from the same port gets a flow of its own, decoded with the xor offset of its own seed
+// while the stream of the closed connection may still be decoding
+func TestReconnectFromSamePort(t *testing.T) {
+	const packets = 10
+	seeds := []uint16{testSeed, 0x0077}
+	for run := 0; run < 10; run++ {
+		ms := NewMemorySource()
+		for i, seed := range seeds {
+			conv, err := NewTCPConversation(ms, testClientAddr, testServerAddr, testStart.Add(time.Duration(i)*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.FromServer(seedPacket(seed)); err != nil {
+				t.Fatal(err)
+			}
+			conv.XorClient(testXorSettings(), seed)
+			for p := 0; p < packets; p++ {
+				if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i), byte(p)})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, sink := runPipeline(t, testConfig(), ms)
+		// the connection each flow's packets say they were sent on
+		connections := make(map[string]map[byte]int)
+		for _, pe := range sink.byDirection() {
+			if pe.Packet.Base.OperationCode != opChatReq {
+				continue
+			}
+			if connections[pe.FlowID] == nil {
+				connections[pe.FlowID] = make(map[byte]int)
+			}
+			connections[pe.FlowID][pe.Packet.Base.Data[0]]++
+		}
+		if len(connections) != len(seeds) {
+			t.Fatalf("run %v: client packets of %v flows, expected %v: %v", run, len(connections), len(seeds), connections)
+		}
+		for flowID, c := range connections {
+			if len(c) != 1 {
+				t.Fatalf("run %v: flow %v has the packets of connections %v", run, flowID, c)
+			}
+			for conn, n := range c {
+				if n != packets {
+					t.Errorf("run %v: %v packets of connection %v decoded, expected %v", run, n, conn, packets)
+				}
+			}
+		}
+	}
+}
+
+// clients on ipv6 and ipv4 at once, each flow gets the xor key of its own seed and bracketed addresses
+func TestIPv6Flows(t *testing.T) {
+	clients := []struct {
+		client, server string
+		seed           uint16
+	}{
+		{"[2001:db8::20]:50000", "[2001:db8::10]:9010", testSeed},
+		{"[2001:db8::21]:50000", "[2001:db8::10]:9010", 0x0077},
+		{"[fe80::1]:50001", "[2001:db8::10]:9010", 0x0123},
+		{testClientAddr, testServerAddr, 0x0042},
+	}
+	const packets = 5
+	ms := NewMemorySource()
+	for i, c := range clients {
+		conv, err := NewTCPConversation(ms, c.client, c.server, testStart.Add(time.Duration(i)*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.FromServer(seedPacket(c.seed)); err != nil {
+			t.Fatal(err)
+		}
+		conv.XorClient(testXorSettings(), c.seed)
+		for p := 0; p < packets; p++ {
+			if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i), byte(p)})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, sink := runPipeline(t, testConfig(), ms)
+	decoded := make(map[string][]byte)
+	for _, pe := range sink.byDirection() {
+		if pe.Packet.Base.OperationCode != opChatReq {
+			continue
+		}
+		if len(pe.Packet.Base.Data) != 2 {
+			t.Fatalf("login request of %v decoded to %x", pe.Src, pe.Packet.Base.Data)
+		}
+		decoded[pe.Src+" "+pe.Dst] = append(decoded[pe.Src+" "+pe.Dst], pe.Packet.Base.Data[0])
+	}
+	for i, c := range clients {
+		got := decoded[c.client+" "+c.server]
+		if len(got) != packets {
+			t.Errorf("%v login requests decoded from %v to %v, expected %v: %v", len(got), c.client, c.server, packets, decoded)
+			continue
+		}
+		for _, conn := range got {
+			if conn != byte(i) {
+				t.Errorf("the flow of %v decoded the packets of client %v", c.client, conn)
+			}
+		}
+	}
+}
+
+// a packet cut short by the snaplen flags its flow instead of being decoded, the packets after it still are
+// the client stream loses its xor offset with the packet, so it needs protocol.xorBruteForce to go on
+func TestTruncatedPacket(t *testing.T) {
+	const following = 8
+	long := make([]byte, 200)
+	for i := range long {
+		long[i] = 0xee
+	}
+	tests := []struct {
+		direction  string
+		fromClient bool
+		opCode     uint16
+	}{
+		{"outbound", true, opChatReq},
+		{"inbound", false, opLoginAck},
+	}
+	for _, tt := range tests {
+		t.Run(tt.direction, func(t *testing.T) {
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+				t.Fatal(err)
+			}
+			conv.XorClient(testXorSettings(), testSeed)
+			send := func(data []byte) {
+				var err error
+				if tt.fromClient {
+					err = conv.FromClient(EncodeShinePacket(tt.opCode, data))
+				} else {
+					err = conv.FromServer(EncodeShinePacket(tt.opCode, data))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			truncated := len(ms.frames)
+			send(long)
+			for i := 0; i < following; i++ {
+				send([]byte{byte(i), 0x55, 0xaa})
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f := &ms.frames[truncated]
+			f.data = f.data[:len(f.data)-100]
+			f.ci.CaptureLength = len(f.data)
+
+			c := testConfig()
+			c.XorBruteForce = true
+			sn, sink := runPipeline(t, c, ms)
+			payloads := payloadsOf(sink.byDirection(), tt.opCode)
+			for _, p := range payloads {
+				if len(p) != 3 {
+					t.Errorf("the truncated packet was decoded to %x", p)
+				}
+			}
+			if len(payloads) == 0 || payloads[len(payloads)-1][0] != following-1 {
+				t.Errorf("decoded %x, expected the packets after the truncated one", payloads)
+			}
+			summary := sn.Summary()
+			if len(summary) != 1 || summary[0].TruncatedPackets != 1 {
+				t.Errorf("expected one flow with a truncated packet, got %+v", summary)
+			}
+		})
+	}
+}
+
+func TestSnaplenDefault(t *testing.T) {
+	tests := []struct {
+		snaplen, expected int
+	}{
+		{0, defaultSnaplen},
+		{-1, defaultSnaplen},
+		{1500, 1500},
+	}
+	for _, tt := range tests {
+		c := testConfig()
+		c.Snaplen = tt.snaplen
+		sn, err := NewSniffer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sn.config.Snaplen != tt.expected {
+			t.Errorf("snaplen %v became %v, expected %v", tt.snaplen, sn.config.Snaplen, tt.expected)
+		}
+	}
+}
+
+// frameList keeps the frames of a conversation so they can be added to a MemorySource out of order
+type frameList []memoryFrame
+
+func (fl *frameList) Add(seen time.Time, data []byte) {
+	*fl = append(*fl, memoryFrame{ci: gopacket.CaptureInfo{Timestamp: seen, CaptureLength: len(data), Length: len(data)}, data: data})
+}
+
+// many flows whose first server segment comes last, the assembler buffers the ones after it as out of order pages for
+// every flow at once, past the page limits it skips the missing segment instead of waiting for it
+func TestAssemblerPageLimits(t *testing.T) {
+	const (
+		flows = 200
+		held  = 8
+	)
+	tests := []struct {
+		name                 string
+		total, perConnection int
+		skips                bool
+	}{
+		{"no limits", 0, 0, false},
+		{"within the limits", 4 * flows * held, 4 * held, false},
+		{"per connection", 0, held / 2, true},
+		{"total", flows, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := NewMemorySource()
+			var early, late []memoryFrame
+			for i := 0; i < flows; i++ {
+				var fl frameList
+				client := net.JoinHostPort(fmt.Sprintf("10.2.%v.%v", i/250, i%250+1), "50000")
+				conv := newTCPConversation(&fl, mustTCPAddr(t, client), mustTCPAddr(t, testServerAddr), testStart.Add(time.Duration(i)*time.Microsecond))
+				if err := conv.Open(); err != nil {
+					t.Fatal(err)
+				}
+				for p := 0; p <= held; p++ {
+					if err := conv.FromServer(EncodeShinePacket(opLoginAck, []byte{byte(i), byte(i >> 8), byte(p)})); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := conv.Close(); err != nil {
+					t.Fatal(err)
+				}
+				// the handshake and the segments after the held one, the held one and the close once every flow buffered its pages
+				early = append(append(early, fl[:3]...), fl[4:4+held]...)
+				late = append(append(late, fl[3]), fl[4+held:]...)
+			}
+			for _, f := range append(early, late...) {
+				ms.Add(f.ci.Timestamp, f.data)
+			}
+
+			c := testConfig()
+			c.MaxBufferedPages = tt.total
+			c.MaxConnectionPages = tt.perConnection
+			c.SegmentQueueSize = 4096
+			sn, sink := runPipeline(t, c, ms)
+			skips := assemblerSkips(sn)
+			if (skips > 0) != tt.skips {
+				t.Fatalf("%v gaps skipped, expected skips %v", skips, tt.skips)
+			}
+
+			// the last packet of every flow comes after the gap, it's decoded whether the assembler waited or skipped
+			last := make(map[int]bool)
+			decoded := 0
+			for _, pe := range sink.byDirection() {
+				if pe.Packet.Base.OperationCode != opLoginAck {
+					continue
+				}
+				decoded++
+				d := pe.Packet.Base.Data
+				if d[2] == held {
+					last[int(d[0])|int(d[1])<<8] = true
+				}
+			}
+			if len(last) != flows {
+				t.Errorf("the last packet of %v of %v flows was decoded", len(last), flows)
+			}
+			if !tt.skips && decoded != flows*(held+1) {
+				t.Errorf("%v packets decoded, expected %v", decoded, flows*(held+1))
+			}
+		})
+	}
+}
+
+// gaps the assembler skipped because of the page limits, of every flow
+func assemblerSkips(sn *Sniffer) uint64 {
+	sn.metrics.mu.Lock()
+	defer sn.metrics.mu.Unlock()
+	var skips uint64
+	for _, n := range sn.metrics.assemblerSkips {
+		skips += n
+	}
+	return skips
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"github.com/shine-o/shine.engine.core/networking"
+	"strings"
+)
+
+// RedactRule is an entry of output.redact.rules, the credentials in the payload of an operation code are masked before
+// the packet reaches any output, the log or the UI
+// Fields are struct or schema field names, used if a struct or a schema unpacks the operation code, Ranges otherwise
+type RedactRule struct {
+	OpCode uint16      `mapstructure:"opcode"`
+	Fields []string    `mapstructure:"fields"`
+	Ranges []ByteRange `mapstructure:"ranges"`
+}
+
+// ByteRange is a part of a payload, Length bytes from Offset
+type ByteRange struct {
+	Offset int `mapstructure:"offset"`
+	Length int `mapstructure:"length"`
+}
+
+// the packets known to carry credentials, masked unless --no-redact is given
+// the user name is kept, the password and the token the login server hands over to the world manager are masked
+var builtinRedactRules = []RedactRule{
+	// NC_USER_LOGIN_REQ, user name [256]byte, password [32]byte
+	{OpCode: 3<<10 | 0x06, Fields: []string{"Password"}, Ranges: []ByteRange{{Offset: 256, Length: 32}}},
+	// NC_USER_US_LOGIN_REQ, user name [18]byte, password [36]byte
+	{OpCode: 3<<10 | 0x5A, Fields: []string{"Password"}, Ranges: []ByteRange{{Offset: 18, Length: 36}}},
+	// NC_USER_WORLDSELECT_ACK, status, ip [16]byte, port, then the token as [32]uint16
+	{OpCode: 3<<10 | 0x0C, Fields: []string{"ValidateNew"}, Ranges: []ByteRange{{Offset: 19, Length: 64}}},
+	// NC_USER_LOGINWORLD_REQ, user name [256]byte, then the token as [32]uint16
+	{OpCode: 3<<10 | 0x0F, Fields: []string{"ValidateNew"}, Ranges: []ByteRange{{Offset: 256, Length: 64}}},
+}
+
+// the byte used in place of every non zero byte of a redacted value, zeros are kept so strings keep their terminator
+const redactedByte = '*'
+
+// the rules of output.redact.rules override the built in ones for the same operation code
+func newRedactRules(rules []RedactRule) (map[uint16]RedactRule, error) {
+	rs := make(map[uint16]RedactRule)
+	for _, r := range builtinRedactRules {
+		rs[r.OpCode] = r
+	}
+	configured := make(map[uint16]bool)
+	for _, r := range rules {
+		if configured[r.OpCode] {
+			return nil, fmt.Errorf("output.redact.rules: operation code %v is listed more than once", r.OpCode)
+		}
+		configured[r.OpCode] = true
+		if len(r.Fields) == 0 && len(r.Ranges) == 0 {
+			return nil, fmt.Errorf("output.redact.rules: operation code %v has neither fields nor ranges", r.OpCode)
+		}
+		for _, br := range r.Ranges {
+			if br.Offset < 0 || br.Length <= 0 {
+				return nil, fmt.Errorf("output.redact.rules: operation code %v has a bad range, offset %v length %v", r.OpCode, br.Offset, br.Length)
+			}
+		}
+		rs[r.OpCode] = r
+	}
+	return rs, nil
+}
+
+// the parts of the payload to mask: the fields of the rule if nr has their offsets, the ranges of the rule otherwise
+func (r RedactRule) ranges(nr ncRepresentation) []ByteRange {
+	var ranges []ByteRange
+	for _, f := range nr.Fields {
+		// schema fields of nested structs are prefixed with their parents, e.g account.password
+		name := f.Name[strings.LastIndex(f.Name, ".")+1:]
+		for _, redacted := range r.Fields {
+			if strings.EqualFold(name, redacted) {
+				ranges = append(ranges, ByteRange{Offset: f.Offset, Length: f.Length})
+			}
+		}
+	}
+	if len(ranges) > 0 {
+		return ranges
+	}
+	return r.Ranges
+}
+
+// a copy of data with the ranges masked, false if a range doesn't fit in data
+func redactPayload(data []byte, ranges []ByteRange) ([]byte, bool) {
+	redacted := append([]byte(nil), data...)
+	for _, br := range ranges {
+		if br.Offset+br.Length > len(data) {
+			return nil, false
+		}
+		for i := br.Offset; i < br.Offset+br.Length; i++ {
+			if data[i] != 0 {
+				redacted[i] = redactedByte
+			}
+		}
+	}
+	return redacted, true
+}
+
+// a copy of the payload of opCode with its credentials masked if rules have the operation code, false otherwise
+// a payload the ranges of its rule don't fit in, e.g of another client build, is masked whole
+func redactData(rules map[uint16]RedactRule, flowName string, opCode uint16, data []byte, nr ncRepresentation) ([]byte, bool) {
+	r, ok := rules[opCode]
+	if !ok {
+		return data, false
+	}
+	redacted, fits := redactPayload(data, r.ranges(nr))
+	if !fits {
+		log.Warningf("[%v] the redacted ranges of operation code %v don't fit in its payload of %v bytes, masking all of it", flowName, opCode, len(data))
+		redacted, _ = redactPayload(data, []ByteRange{{Offset: 0, Length: len(data)}})
+	}
+	return redacted, true
+}
+
+// mask the credentials of pe if rules have its operation code, the packet is replaced by a copy
+// nr is unpacked again from the masked payload with the schema of pr, so the json of the struct doesn't carry them either
+func redactEvent(pr *protocol, rules map[uint16]RedactRule, pe PacketEvent, nr ncRepresentation) (PacketEvent, ncRepresentation) {
+	data, redacted := redactData(rules, pe.FlowName, pe.Packet.Base.OperationCode, pe.Packet.Base.Data, nr)
+	if !redacted {
+		return pe, nr
+	}
+	p := *pe.Packet
+	p.Base.Data = data
+	pe.Packet = &p
+	return pe, pr.unpack(p.Base.OperationCode, data)
+}
+
+// mask the credentials of pe if output.redact.rules or the built in rules have its operation code
+// the decoders still see the real payload
+func (sn *Sniffer) redact(pe PacketEvent, nr ncRepresentation) (PacketEvent, ncRepresentation) {
+	return redactEvent(sn.protocol, sn.redactRules, pe, nr)
+}
+
+// the body of a decoded packet as the decrypted pcap writes it, operation code first, with its credentials masked
+// body is returned as it is if the packet has none
+func (sn *Sniffer) redactBody(flowName string, p networking.Command, body []byte) []byte {
+	if _, ok := sn.redactRules[p.Base.OperationCode]; !ok {
+		return body
+	}
+	data, _ := redactData(sn.redactRules, flowName, p.Base.OperationCode, p.Base.Data, sn.protocol.unpack(p.Base.OperationCode, p.Base.Data))
+	header := len(body) - len(p.Base.Data)
+	return append(append([]byte(nil), body[:header]...), data...)
+}
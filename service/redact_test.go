@@ -0,0 +1,251 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/google/logger"
+	"github.com/shine-o/shine.engine.core/networking"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the password of the login of testdata/handshake.hex
+const testPassword = "5f4dcc3b5aa765d61d8327deb882cf99"
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		ranges   []ByteRange
+		redacted []byte
+		fits     bool
+	}{
+		{"range", []byte("tarian\x00secret\x00"), []ByteRange{{Offset: 7, Length: 7}}, []byte("tarian\x00******\x00"), true},
+		{"two ranges", []byte("abcdef"), []ByteRange{{Offset: 0, Length: 1}, {Offset: 4, Length: 2}}, []byte("*bcd**"), true},
+		{"up to the end", []byte("abc"), []ByteRange{{Offset: 1, Length: 2}}, []byte("a**"), true},
+		{"no ranges", []byte("abc"), nil, []byte("abc"), true},
+		{"past the end", []byte("abc"), []ByteRange{{Offset: 2, Length: 2}}, nil, false},
+		{"starts past the end", []byte("abc"), []ByteRange{{Offset: 260, Length: 36}}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), tt.data...)
+			redacted, fits := redactPayload(data, tt.ranges)
+			if fits != tt.fits || !bytes.Equal(redacted, tt.redacted) {
+				t.Errorf("redacted %q, %v, expected %q, %v", redacted, fits, tt.redacted, tt.fits)
+			}
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("the payload itself was changed to %q", data)
+			}
+		})
+	}
+}
+
+// a login payload the built in ranges don't fit in is masked whole instead of being written as it is
+func TestRedactUnexpectedLayout(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("tarian\x00" + testPassword)
+	pe := PacketEvent{
+		FlowName: "login-client",
+		Packet: &networking.Command{
+			Base: networking.CommandBase{
+				OperationCode: opLoginReq,
+				Data:          data,
+			},
+		},
+	}
+	redacted, _ := sn.redact(pe, ncRepresentation{})
+	expected := append([]byte("******\x00"), bytes.Repeat([]byte{redactedByte}, len(testPassword))...)
+	if !bytes.Equal(redacted.Packet.Base.Data, expected) {
+		t.Errorf("redacted to %q, expected %q", redacted.Packet.Base.Data, expected)
+	}
+	if string(pe.Packet.Base.Data) != string(data) {
+		t.Error("the decoded packet itself was redacted")
+	}
+}
+
+// lockedBuffer collects what the log writes, from any goroutine
+type lockedBuffer struct {
+	b  bytes.Buffer
+	mu sync.Mutex
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.String()
+}
+
+// the form the password has in s if it's there: as text, as hex, or only its start as text, hex or the spaced hex of a
+// hex dump, which cuts payloads every 16 bytes and puts another space after 8
+func containsPassword(s string) (string, bool) {
+	start := testPassword[:8]
+	var spaced []string
+	for _, b := range []byte(start[:6]) {
+		spaced = append(spaced, hex.EncodeToString([]byte{b}))
+	}
+	s = strings.ToLower(s)
+	for _, form := range []string{
+		testPassword,
+		hex.EncodeToString([]byte(testPassword)),
+		start,
+		hex.EncodeToString([]byte(start)),
+		strings.Join(spaced, " "),
+	} {
+		if strings.Contains(s, form) {
+			return form, true
+		}
+	}
+	return "", false
+}
+
+// with the default settings the login password is in none of the json lines, the websocket frames, the log, the flow
+// logs, the decrypted pcaps or the console
+func TestPasswordNotWritten(t *testing.T) {
+	dir := t.TempDir()
+
+	logged := &lockedBuffer{}
+	defer func(l *logger.Logger) { log = l }(log)
+	log = newLogger(logged, false, nil)
+
+	consoleFile, err := ioutil.TempFile(t.TempDir(), "console")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consoleFile.Close()
+	defer func(cp *consolePrinter) { console = cp }(console)
+	console = newConsolePrinter(consoleFile, false, true, true)
+
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := testConfig()
+	c.JSONOutput = true
+	c.PerFlowLogs = true
+	c.LogVerbose = true
+	c.DecryptedPcap = true
+	c.session = &session{dir: dir}
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsc, closeAll := dialPackets(t, sn)
+	defer closeAll()
+
+	var mu sync.Mutex
+	var logins int
+	sn.Handler = func(pe PacketEvent) {
+		if pe.Packet.Base.OperationCode == opLoginReq {
+			mu.Lock()
+			logins++
+			mu.Unlock()
+		}
+		console.packet(pe)
+		sn.ws.sendPacket(packetView(pe, c.MaxPayloadBytes))
+	}
+	sn.Source = ms
+	if err := sn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sn.Done():
+	case <-time.After(testPipelineWait):
+		t.Fatalf("the capture didn't end within %v", testPipelineWait)
+	}
+	sn.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if logins != 1 {
+		t.Fatalf("%v logins decoded, expected 1", logins)
+	}
+
+	// every frame up to the flow closing, which is sent once every packet was handled
+	var frames []string
+	for {
+		e := readEnvelope(t, wsc)
+		frames = append(frames, string(e.Data))
+		if e.Type == wsFlowClose {
+			break
+		}
+	}
+	for _, f := range frames {
+		if form, ok := containsPassword(f); ok {
+			t.Errorf("the websocket frame %s has the password as %q", f, form)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonl, flowLogs, pcaps int
+	for _, fi := range files {
+		switch {
+		case strings.HasSuffix(fi.Name(), ".jsonl"):
+			jsonl++
+		case strings.HasSuffix(fi.Name(), ".log"):
+			flowLogs++
+		case strings.HasSuffix(fi.Name(), "-decrypted.pcap"):
+			pcaps++
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if form, ok := containsPassword(string(b)); ok {
+			t.Errorf("%v has the password as %q", fi.Name(), form)
+		}
+	}
+	if jsonl == 0 || flowLogs == 0 || pcaps == 0 {
+		t.Errorf("%v json lines files, %v flow logs and %v decrypted pcaps written, expected all of them", jsonl, flowLogs, pcaps)
+	}
+
+	if form, ok := containsPassword(logged.String()); ok {
+		t.Errorf("the log has the password as %q", form)
+	}
+	printed, err := ioutil.ReadFile(consoleFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(printed) == 0 {
+		t.Error("nothing was printed on the console")
+	}
+	if form, ok := containsPassword(string(printed)); ok {
+		t.Errorf("the console has the password as %q", form)
+	}
+}
+
+// the raw files can't be masked, so they are only written with redaction off
+func TestRawTapNeedsNoRedact(t *testing.T) {
+	c := testConfig()
+	c.session = &session{dir: t.TempDir()}
+	c.RawTap = true
+	if _, err := NewSniffer(c); err == nil || !strings.Contains(err.Error(), "--no-redact") {
+		t.Errorf("raw tap with redaction on: %v", err)
+	}
+	c.Redact = false
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatalf("raw tap with redaction off: %v", err)
+	}
+	sn.closeOutputs()
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/shine-o/shine.engine.core/structs"
+	"reflect"
+	"sync"
+)
+
+var ncStructs = &structRegistry{
+	types: make(map[uint16]reflect.Type),
+}
+
+// structRegistry maps operation codes to the structs their payloads are unpacked into
+// payloads are little endian with the same layout binary.Read expects, plus the restruct tags used by shine.engine.core
+type structRegistry struct {
+	types map[uint16]reflect.Type
+	mu    sync.RWMutex
+}
+
+// the login and world select handshake
+func init() {
+	handshake := map[uint16]interface{}{
+		2055: &structs.NcMiscSeedAck{},               // NC_MISC_SEED_ACK
+		3162: &structs.NcUserUsLoginReq{},            // NC_USER_US_LOGIN_REQ
+		3173: &structs.NcUserClientVersionCheckReq{}, // NC_USER_CLIENT_VERSION_CHECK_REQ
+		3082: &structs.NcUserLoginAck{},              // NC_USER_LOGIN_ACK
+		3084: &structs.NcUserWorldSelectAck{},        // NC_USER_WORLDSELECT_ACK
+		3087: &structs.NcUserLoginWorldReq{},         // NC_USER_LOGINWORLD_REQ
+		3092: &structs.NcUserLoginWorldAck{},         // NC_USER_LOGINWORLD_ACK
+	}
+	for opCode, nc := range handshake {
+		if err := Register(opCode, nc); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register the struct packets with the given operation code are unpacked into, nc must be a pointer to a struct
+// a struct registered for an operation code replaces the previous one, including the built in ones
+func Register(opCode uint16, nc interface{}) error {
+	t := reflect.TypeOf(nc)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("operation code %v: expected a pointer to a struct, got %T", opCode, nc)
+	}
+	ncStructs.mu.Lock()
+	ncStructs.types[opCode] = t.Elem()
+	ncStructs.mu.Unlock()
+	return nil
+}
+
+// a new zero value of the struct registered for the operation code
+func (sr *structRegistry) new(opCode uint16) (interface{}, bool) {
+	sr.mu.RLock()
+	t, ok := sr.types[opCode]
+	sr.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return reflect.New(t).Interface(), true
+}
+
+// unpack a packet payload into its struct, packets that can't be unpacked are represented as hex
+// operation codes described in protocol.schema are unpacked with their schema instead
+func (p *protocol) unpack(opCode uint16, data []byte) ncRepresentation {
+	if ps, ok := p.schemas.get(opCode); ok {
+		nr, err := ps.representation(data)
+		if err != nil {
+			log.Warningf("unpacking %v bytes with the schema of %v: %v", len(data), p.commandName(opCode), err)
+			return ncRepresentation{
+				Hex: hex.EncodeToString(data),
+			}
+		}
+		return nr
+	}
+	nr, err := ncStructRepresentation(opCode, data)
+	if err != nil {
+		return ncRepresentation{
+			Hex: hex.EncodeToString(data),
+		}
+	}
+	return nr
+}
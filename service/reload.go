@@ -0,0 +1,223 @@
+package service
+
+import (
+	"github.com/spf13/viper"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// liveSettings is the part of the configuration that can change while capturing
+// decoders read it for every packet, Reload swaps it as a whole
+type liveSettings struct {
+	filter        *opCodeFilter
+	logClient     bool
+	logServer     bool
+	discoverZones bool
+	sampling      packetSampling
+}
+
+type liveConfig struct {
+	settings liveSettings
+	mu       sync.RWMutex
+	// one Reload at a time, SIGHUP and the api can race
+	reloading sync.Mutex
+}
+
+func (lc *liveConfig) get() liveSettings {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.settings
+}
+
+func (lc *liveConfig) set(s liveSettings) {
+	lc.mu.Lock()
+	lc.settings = s
+	lc.mu.Unlock()
+}
+
+// swap the known services, services registered through the api that aren't in services are dropped
+// discovered zones are kept unless their port is configured now
+func (s *shineServices) replace(c Config) {
+	knownServices := make(map[int]string, len(c.Services))
+	for port, name := range c.Services {
+		knownServices[port] = name
+	}
+	s.mu.Lock()
+	for port := range s.discovered {
+		if _, ok := knownServices[port]; ok {
+			delete(s.discovered, port)
+			continue
+		}
+		knownServices[port] = s.knownServices[port]
+	}
+	s.knownServices = knownServices
+	s.strict = c.StrictServices
+	s.portRangeStart = c.PortRangeStart
+	s.portRangeEnd = c.PortRangeEnd
+	s.mu.Unlock()
+}
+
+// ReloadResult tells which settings a Reload applied and which need a restart
+type ReloadResult struct {
+	Applied []string `json:"applied"`
+	Ignored []string `json:"ignoredUntilRestart"`
+}
+
+// Reload applies the services, the operation code filters and the log toggles of c without stopping the capture
+// streams created before the call keep their service name, changes to any other setting are ignored until restart
+// nothing is applied if c is invalid
+func (sn *Sniffer) Reload(c Config) (ReloadResult, error) {
+	sn.liveSettings.reloading.Lock()
+	defer sn.liveSettings.reloading.Unlock()
+
+	var res ReloadResult
+
+	f, err := newOpCodeFilter(sn.protocol, c.Include, c.Exclude)
+	if err != nil {
+		return res, err
+	}
+	sampling, err := newPacketSampling(sn.protocol, c.Sampling)
+	if err != nil {
+		return res, err
+	}
+
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	if c.Snaplen <= 0 {
+		c.Snaplen = defaultSnaplen
+	}
+	if c.SegmentQueueSize < 1 {
+		c.SegmentQueueSize = defaultSegmentQueueSize
+	}
+	restartOnly := []struct {
+		key      string
+		old, new interface{}
+	}{
+		{"network.interface", sn.config.Interface, c.Interface},
+		{"network.interfaces", sn.config.Interfaces, c.Interfaces},
+		{"network.pcapPace", sn.config.PcapPace, c.PcapPace},
+		{"network.pcapPaceMaxGap", sn.config.PcapPaceMaxGap, c.PcapPaceMaxGap},
+		{"network.assembler.maxBufferedPagesTotal", sn.config.MaxBufferedPages, c.MaxBufferedPages},
+		{"network.assembler.maxBufferedPagesPerConnection", sn.config.MaxConnectionPages, c.MaxConnectionPages},
+		{"network.bestEffort", sn.config.BestEffort, c.BestEffort},
+		{"network.waitForInterface", sn.config.WaitForInterface, c.WaitForInterface},
+		{"network.pcapFile", sn.config.PcapFile, c.PcapFile},
+		{"network.snaplen", sn.config.Snaplen, c.Snaplen},
+		{"network.backend", sn.config.Backend, c.Backend},
+		{"network.serverSideCapture", sn.config.ServerSideCapture, c.ServerSideCapture},
+		{"network.clientIP", sn.config.ClientNets, c.ClientNets},
+		{"protocol.udpServices", sn.config.UDPServices, c.UDPServices},
+		{"protocol.udpIdleTimeout", sn.config.UDPIdleTimeout, c.UDPIdleTimeout},
+		{"protocol.xorKey", sn.config.XorKey, c.XorKey},
+		{"protocol.xorLimit", sn.config.XorLimit, c.XorLimit},
+		{"protocol.services xor settings", sn.config.ServiceXor, c.ServiceXor},
+		{"protocol.commands", sn.config.CommandsFile, c.CommandsFile},
+		{"protocol.schema", sn.config.SchemaFile, c.SchemaFile},
+		{"protocol.serverXor", sn.config.ServerXor, c.ServerXor},
+		{"protocol.serverXorSeed", sn.config.ServerXorSeed, c.ServerXorSeed},
+		{"protocol.serverXorKeyOffset", sn.config.ServerXorKeyOffset, c.ServerXorKeyOffset},
+		{"protocol.versions", sn.config.Versions, c.Versions},
+		{"protocol.versionOpcode", sn.config.VersionOpCode, c.VersionOpCode},
+		{"protocol.timelineOpcodes", sn.config.TimelineOpCodes, c.TimelineOpCodes},
+		{"output.rawTap.enabled", sn.config.RawTap, c.RawTap},
+		{"output.rawTap.decode", sn.config.RawTapDecode, c.RawTapDecode},
+		{"alerts.rules", sn.config.AlertRules, c.AlertRules},
+		{"alerts.webhook", sn.config.AlertWebhook, c.AlertWebhook},
+		{"injection.enabled", sn.config.Injection, c.Injection},
+		{"protocol.workers", sn.config.Workers, c.Workers},
+		{"protocol.dedup.enabled", sn.config.Dedup, c.Dedup},
+		{"protocol.dedup.window", sn.config.DedupWindow, c.DedupWindow},
+		{"protocol.dedup.size", sn.config.DedupSize, c.DedupSize},
+		{"protocol.decoderWatchdog", sn.config.DecoderWatchdog, c.DecoderWatchdog},
+		{"network.segmentQueue.size", sn.config.SegmentQueueSize, c.SegmentQueueSize},
+		{"network.segmentQueue.clientOverflow", sn.config.ClientOverflow, c.ClientOverflow},
+		{"network.segmentQueue.serverOverflow", sn.config.ServerOverflow, c.ServerOverflow},
+		{"protocol.log.jsonOutput", sn.config.JSONOutput, c.JSONOutput},
+		{"protocol.log.perFlowFiles", sn.config.PerFlowLogs, c.PerFlowLogs},
+		{"output.broker", sn.config.Broker, c.Broker},
+		{"output.elasticsearch", sn.config.Elasticsearch, c.Elasticsearch},
+		{"output.sqlite.path", sn.config.SQLitePath, c.SQLitePath},
+		{"output.decryptedPcap", sn.config.DecryptedPcap, c.DecryptedPcap},
+		{"output.maxPayloadBytes", sn.config.MaxPayloadBytes, c.MaxPayloadBytes},
+		{"output.redact.enabled", sn.config.Redact, c.Redact},
+		{"output.redact.rules", sn.config.RedactRules, c.RedactRules},
+		{"output.timing.csv", sn.config.TimingCSV, c.TimingCSV},
+		{"output.entropy", sn.config.Entropy, c.Entropy},
+		{"output.grpc.address", sn.config.GRPCAddress, c.GRPCAddress},
+		{"ui.heatmap.retention", sn.config.HeatmapRetention, c.HeatmapRetention},
+		{"protocol.latencyPairs", sn.config.LatencyPairs, c.LatencyPairs},
+		{"protocol.compressedOpcodes", sn.config.CompressedOpCodes, c.CompressedOpCodes},
+	}
+	for _, r := range restartOnly {
+		if !reflect.DeepEqual(r.old, r.new) {
+			res.Ignored = append(res.Ignored, r.key)
+		}
+	}
+
+	// the bpf filter follows the ports, so new zones are only captured if it can be swapped on the live source
+	// a filter built from another network.clientIP or protocol.udpServices would disagree with the streams and the udp
+	// flows, which keep the old ones until restart
+	filterChanged := c.Filter != sn.config.Filter
+	if filterChanged {
+		fs, ok := sn.Source.(filterSetter)
+		if !ok || sn.config.PcapFile != "" || !reflect.DeepEqual(sn.config.ClientNets, c.ClientNets) || !reflect.DeepEqual(sn.config.UDPServices, c.UDPServices) {
+			res.Ignored = append(res.Ignored, "bpf filter")
+			filterChanged = false
+		} else if err := fs.SetFilter(c.Filter); err != nil {
+			return res, err
+		}
+	}
+
+	sn.services.replace(c)
+	sn.liveSettings.set(liveSettings{
+		filter:        f,
+		logClient:     c.LogClient,
+		logServer:     c.LogServer,
+		discoverZones: c.DiscoverZones,
+		sampling:      sampling,
+	})
+	res.Applied = []string{"protocol.services", "protocol.strictServices", "network.portRange", "protocol.filters", "protocol.log.client", "protocol.log.server", "protocol.discoverZones", "protocol.sampling"}
+	if filterChanged {
+		sn.config.Filter = c.Filter
+		res.Applied = append(res.Applied, "bpf filter")
+		log.Infof("using bpf filter %v", c.Filter)
+	}
+
+	for _, key := range res.Ignored {
+		log.Warningf("%v changed, ignored until restart", key)
+	}
+	log.Infof("configuration reloaded, %v known services, log client %v, log server %v", len(c.Services), c.LogClient, c.LogServer)
+	return res, nil
+}
+
+// read the config file again and apply it, used on SIGHUP and by POST /api/reload
+func (sn *Sniffer) reloadFromViper() (ReloadResult, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return ReloadResult{}, err
+	}
+	c, err := ConfigFromViper()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	return sn.Reload(c)
+}
+
+// POST /api/reload re-reads the config file, same as sending SIGHUP
+func (sn *Sniffer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !allowChange(w, r) {
+		return
+	}
+	res, err := sn.reloadFromViper()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, res)
+}
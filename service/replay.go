@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/shine-o/shine.engine.core/networking"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net"
+	"os"
+	"time"
+)
+
+// Replay listens for a game client and sends it the server packets of a flow saved with protocol.log.jsonOutput
+// packets keep their original timing, divided by --speed
+func Replay(cmd *cobra.Command, args []string) {
+	flowFile, err := cmd.Flags().GetString("flow")
+	if err != nil || flowFile == "" {
+		log.Fatal("a flow file is needed, e.g --flow output/<session>/login-client-<flowID>.jsonl")
+	}
+
+	speed, err := cmd.Flags().GetFloat64("speed")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if speed <= 0 {
+		log.Fatal("--speed must be greater than 0")
+	}
+
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := loadProtocol(c.CommandsFile, c.SchemaFile)
+
+	skip, err := p.opCodeSet(viper.GetStringSlice("replay.skip"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("replay.skip: %v", err))
+	}
+
+	records, err := readFlowRecords(flowFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var packets []packetRecord
+	for _, r := range records {
+		if r.Direction != "inbound" {
+			continue
+		}
+		if skip[r.OperationCode] {
+			continue
+		}
+		packets = append(packets, r)
+	}
+
+	addr := fmt.Sprintf(":%v", viper.GetInt("replay.port"))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	log.Infof("replaying %v server packets from %v on %v", len(packets), flowFile, addr)
+	fmt.Printf("waiting for a client on %v\n", addr)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		// one client at a time, each one gets the whole flow
+		replayFlow(conn, p, packets, speed, c)
+	}
+}
+
+func readFlowRecords(path string) ([]packetRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		records   []packetRecord
+		truncated int
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		r, ok, err := parseFlowRecord(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+		if r.Truncated {
+			// a client can't be sent part of a packet
+			truncated++
+			continue
+		}
+		if ok {
+			records = append(records, r)
+		}
+	}
+	if truncated > 0 {
+		log.Warningf("%v: %v packets with a payload truncated by output.maxPayloadBytes are not replayed", path, truncated)
+	}
+	return records, scanner.Err()
+}
+
+// a line of a flow file, ok is false for the flow closed line, which isn't a packet
+func parseFlowRecord(line []byte) (packetRecord, bool, error) {
+	var r struct {
+		packetRecord
+		FlowClosed *flowClosedSummary `json:"flowClosed"`
+	}
+	if err := json.Unmarshal(line, &r); err != nil {
+		return packetRecord{}, false, err
+	}
+	return r.packetRecord, r.FlowClosed == nil, nil
+}
+
+func replayFlow(conn net.Conn, p *protocol, packets []packetRecord, speed float64, c Config) {
+	defer conn.Close()
+	log.Infof("client %v connected", conn.RemoteAddr())
+
+	// the seed the client xors its packets with is the one sent in the replayed seed packet
+	seed := make(chan uint16, 1)
+	disconnected := make(chan bool)
+	go func() {
+		readReplayClient(conn, p, XorSettings{Key: c.XorKey, Limit: c.XorLimit}, seed)
+		close(disconnected)
+	}()
+
+	var previous time.Time
+	for i, r := range packets {
+		if !previous.IsZero() {
+			wait := time.Duration(float64(r.Seen.Sub(previous)) / speed)
+			select {
+			case <-disconnected:
+				log.Infof("client %v disconnected after %v of %v packets", conn.RemoteAddr(), i, len(packets))
+				return
+			case <-time.After(wait):
+			}
+		}
+		previous = r.Seen
+
+		data, err := hex.DecodeString(r.Data)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		pc := networking.Command{
+			Base: networking.CommandBase{
+				OperationCode: r.OperationCode,
+				Data:          data,
+			},
+		}
+		if _, err := conn.Write(pc.Base.RawData()); err != nil {
+			log.Infof("client %v disconnected after %v of %v packets: %v", conn.RemoteAddr(), i, len(packets), err)
+			return
+		}
+
+		if o, ok, err := c.xorSeed(r.OperationCode, data); ok && err == nil {
+			select {
+			case seed <- o:
+			default:
+			}
+		}
+		log.Infof("replayed %v %v", p.commandName(r.OperationCode), r.Seen)
+	}
+
+	log.Infof("all %v packets were replayed to %v", len(packets), conn.RemoteAddr())
+	<-disconnected
+}
+
+// log what the client sends back, decoded with the seed once it was replayed and the key of xs
+func readReplayClient(conn net.Conn, pr *protocol, xs XorSettings, seed <-chan uint16) {
+	var (
+		data      []byte
+		offset    int
+		xorOffset uint16
+		hasSeed   bool
+	)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		data = append(data, buf[:n]...)
+
+		if !hasSeed {
+			select {
+			case o := <-seed:
+				xorOffset = o
+				hasSeed = true
+			default:
+				log.Warningf("client %v sent %v bytes before the seed was replayed", conn.RemoteAddr(), n)
+				continue
+			}
+		}
+
+		for lengthHeaderAvailable(data, offset) {
+			pLen, skipBytes := networking.PacketBoundary(offset, data)
+			nextOffset := offset + skipBytes + int(pLen)
+			if nextOffset > len(data) {
+				break
+			}
+			packetData := make([]byte, pLen)
+			copy(packetData, data[offset+skipBytes:nextOffset])
+			p, err := decodePacket(packetData, xs, &xorOffset)
+			if err != nil {
+				log.Error(err)
+			} else {
+				log.Infof("client sent %v %v", pr.commandName(p.Base.OperationCode), p.Base.String())
+			}
+			offset = nextOffset
+		}
+		data, offset = trimDecoded(data, offset)
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.core/networking"
+	"strconv"
+)
+
+const (
+	// complete packets that must follow a candidate boundary before the decoder trusts it
+	resyncPackets = 3
+	// lengths above this are never seen in shine packets
+	maxPacketLength = 32767
+)
+
+// after a gap the buffer no longer starts at a packet boundary, find the first offset from which
+// resyncPackets consecutive packets have plausible lengths and known operation codes
+func findPacketBoundary(commands *commandRegistry, data []byte) (int, bool) {
+	for i := 0; i < len(data); i++ {
+		if plausibleBoundary(commands, data, i, true) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// same as findPacketBoundary for xored client data, the xor offset is lost with the gap so it's brute forced for every candidate
+func findXoredPacketBoundary(commands *commandRegistry, data []byte, xs XorSettings) (int, uint16, bool) {
+	for i := 0; i < len(data); i++ {
+		if !plausibleBoundary(commands, data, i, false) {
+			continue
+		}
+		if o, ok := bruteForceXorOffset(commands, data, i, xs); ok {
+			return i, o, true
+		}
+	}
+	return 0, 0, false
+}
+
+// lengths are never xored, so they can always be checked, operation codes only if checkOpCodes is set
+func plausibleBoundary(commands *commandRegistry, data []byte, offset int, checkOpCodes bool) bool {
+	for n := 0; n < resyncPackets; n++ {
+		// enough for the longest length header
+		if offset+3 > len(data) {
+			return false
+		}
+		pLen, skipBytes := networking.PacketBoundary(offset, data)
+		// every packet carries at least its operation code
+		if pLen < 2 || pLen > maxPacketLength {
+			return false
+		}
+		nextOffset := offset + skipBytes + int(pLen)
+		if nextOffset > len(data) {
+			return false
+		}
+		if checkOpCodes {
+			packetData := make([]byte, pLen)
+			copy(packetData, data[offset+skipBytes:nextOffset])
+			p, err := networking.DecodePacket(packetData)
+			if err != nil {
+				return false
+			}
+			if !commands.known(p.Base.OperationCode) {
+				return false
+			}
+		}
+		offset = nextOffset
+	}
+	return true
+}
+
+// bytes missing before a segment, as reported by the assembler
+func gapSize(skip int) string {
+	if skip < 0 {
+		return "an unknown number of"
+	}
+	return strconv.Itoa(skip)
+}
+
+// same as findXoredPacketBoundary when the xor offset the next packet should have is already known,
+// e.g the one persisted by a previous run, the first boundary it decodes is taken
+func findResumedPacketBoundary(commands *commandRegistry, data []byte, xs XorSettings, xorOffset uint16) (int, bool) {
+	for i := 0; i < len(data); i++ {
+		if !plausibleBoundary(commands, data, i, false) {
+			continue
+		}
+		boundaries := packetBoundaries(data, i)
+		if len(boundaries) >= xorValidationPackets && decodesWithXorOffset(commands, data, boundaries, xs, xorOffset) {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindPacketBoundary(t *testing.T) {
+	p := testProtocol(t)
+	var packets []byte
+	for i := 0; i < resyncPackets; i++ {
+		packets = append(packets, EncodeShinePacket(opLoginAck, []byte{byte(i), 0x10})...)
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int
+		found  bool
+	}{
+		{"at the start", packets, 0, true},
+		{"after the end of a lost packet", append([]byte{0x33, 0x01, 0xff}, packets...), 3, true},
+		{"too few packets", packets[:len(packets)-1], 0, false},
+		{"unknown operation codes", append(EncodeShinePacket(0xffff, nil), EncodeShinePacket(0xfffe, nil)...), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, found := findPacketBoundary(p.commands, tt.data)
+			if found != tt.found || (found && offset != tt.offset) {
+				t.Errorf("got %v found %v, expected %v found %v", offset, found, tt.offset, tt.found)
+			}
+		})
+	}
+}
+
+func TestFindXoredPacketBoundary(t *testing.T) {
+	p := testProtocol(t)
+	xs := testXorSettings()
+	data := append([]byte{0x42, 0x07}, xoredClientPackets(xs, 77, 6)...)
+	offset, xorOffset, found := findXoredPacketBoundary(p.commands, data, xs)
+	if !found || offset != 2 || xorOffset != 77 {
+		t.Errorf("got %v xor offset %v found %v, expected 2 xor offset 77", offset, xorOffset, found)
+	}
+}
+
+// dropFrames loses some of the frames of a TCPConversation, as a capture that missed them
+type dropFrames struct {
+	*MemorySource
+	n    int
+	drop map[int]bool
+}
+
+func (df *dropFrames) Add(seen time.Time, data []byte) {
+	df.n++
+	if !df.drop[df.n] {
+		df.MemorySource.Add(seen, data)
+	}
+}
+
+// a segment lost in either direction costs the packets it held, the decoders find the boundaries again after it
+func TestDecodeAfterGap(t *testing.T) {
+	const (
+		before = 3
+		after  = 6
+	)
+	key := testXorSettings()
+	ms := NewMemorySource()
+	// the handshake is 3 frames, the seed the 4th, then client and server alternate
+	lost := before*2 + 4 + 1
+	df := &dropFrames{MemorySource: ms, drop: map[int]bool{lost: true, lost + 1: true}}
+	conv := newTCPConversation(df, mustTCPAddr(t, testClientAddr), mustTCPAddr(t, testServerAddr), testStart)
+	if err := conv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+		t.Fatal(err)
+	}
+	conv.XorClient(key, testSeed)
+	for i := 0; i < before+1+after; i++ {
+		if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i), 0x55})); err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.FromServer(EncodeShinePacket(opLoginAck, []byte{byte(i), 0x66})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sink := runPipeline(t, testConfig(), ms)
+	events := sink.byDirection()
+	for _, opCode := range []uint16{opChatReq, opLoginAck} {
+		payloads := payloadsOf(events, opCode)
+		if len(payloads) < before+after-resyncPackets {
+			t.Errorf("%v packets %v decoded around the gap, expected at least %v", len(payloads), opCode, before+after-resyncPackets)
+		}
+		for _, p := range payloads {
+			if p[0] == before {
+				t.Errorf("packet %v of the lost segment was decoded", opCode)
+			}
+			if p[1] != 0x55 && p[1] != 0x66 {
+				t.Errorf("packet %v decoded to garbage %x", opCode, p)
+			}
+		}
+	}
+}
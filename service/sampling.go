@@ -0,0 +1,49 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// packetSampling forwards only a fraction of the packets of chatty operation codes to the Handler and the outputs
+// operation codes without a rate are always forwarded, statistics count every packet regardless
+type packetSampling map[uint16]float64
+
+// rates by operation code or command name, between 0 (drop all) and 1 (keep all)
+func newPacketSampling(p *protocol, rates map[string]float64) (packetSampling, error) {
+	ps := make(packetSampling, len(rates))
+	for k, rate := range rates {
+		opCode, err := p.parseOpCode(k)
+		if err != nil {
+			return nil, fmt.Errorf("protocol.sampling: %v", err)
+		}
+		if rate < 0 || rate > 1 || math.IsNaN(rate) {
+			return nil, fmt.Errorf("protocol.sampling: rate %v of %v must be between 0 and 1", rate, k)
+		}
+		ps[opCode] = rate
+	}
+	return ps, nil
+}
+
+// true if the packet is forwarded, the decision only depends on the packet itself
+// so every run over the same capture forwards the same packets
+func (ps packetSampling) keep(pe PacketEvent) bool {
+	rate, ok := ps[pe.Packet.Base.OperationCode]
+	if !ok || rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+
+	var b [10]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(pe.Seen.UnixNano()))
+	binary.LittleEndian.PutUint16(b[8:], pe.Packet.Base.OperationCode)
+	h := fnv.New64a()
+	h.Write(b[:])
+	h.Write([]byte(pe.Direction))
+	h.Write(pe.Packet.Base.Data)
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"fmt"
+	"github.com/shine-o/shine.engine.core/networking"
+	"testing"
+	"time"
+)
+
+func TestPacketSamplingRates(t *testing.T) {
+	p := testProtocol(t)
+	tests := []struct {
+		rates map[string]float64
+		valid bool
+	}{
+		{map[string]float64{"NC_ACT_CHAT_REQ": 0.5}, true},
+		{map[string]float64{fmt.Sprint(opChatReq): 0}, true},
+		{map[string]float64{"NC_ACT_CHAT_REQ": 1}, true},
+		{map[string]float64{"NC_NOTHING": 0.5}, false},
+		{map[string]float64{"NC_ACT_CHAT_REQ": 1.5}, false},
+		{map[string]float64{"NC_ACT_CHAT_REQ": -0.1}, false},
+	}
+	for _, tt := range tests {
+		ps, err := newPacketSampling(p, tt.rates)
+		if (err == nil) != tt.valid {
+			t.Errorf("%v: error %v, expected valid %v", tt.rates, err, tt.valid)
+			continue
+		}
+		if err == nil && len(ps) != 1 {
+			t.Errorf("%v: sampling %v", tt.rates, ps)
+		}
+	}
+}
+
+// about rate of the packets of an operation code are kept, always the same ones, other operation codes are all kept
+func TestPacketSamplingKeep(t *testing.T) {
+	ps := packetSampling{opChatReq: 0.25, opLoginReq: 0, opLoginAck: 1}
+	packet := func(opCode uint16, i int) PacketEvent {
+		return PacketEvent{
+			Direction: "outbound",
+			Seen:      testStart.Add(time.Duration(i) * time.Millisecond),
+			Packet: &networking.Command{
+				Base: networking.CommandBase{OperationCode: opCode, Data: []byte{byte(i)}},
+			},
+		}
+	}
+
+	const (
+		n         = 4000
+		unsampled = uint16(0x1234)
+	)
+	kept := make(map[uint16]int)
+	for i := 0; i < n; i++ {
+		for _, opCode := range []uint16{opChatReq, opLoginReq, opLoginAck, unsampled} {
+			pe := packet(opCode, i)
+			keep := ps.keep(pe)
+			if keep != ps.keep(pe) {
+				t.Fatalf("packet %v of %v was kept once and dropped once", i, opCode)
+			}
+			if keep {
+				kept[opCode]++
+			}
+		}
+	}
+	if kept[opLoginReq] != 0 || kept[opLoginAck] != n || kept[unsampled] != n {
+		t.Errorf("kept %v, expected none of %v and all of %v and %v", kept, opLoginReq, opLoginAck, unsampled)
+	}
+	if c := kept[opChatReq]; c < n/4-n/20 || c > n/4+n/20 {
+		t.Errorf("kept %v of %v packets at a rate of 0.25", c, n)
+	}
+}
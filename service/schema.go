@@ -0,0 +1,545 @@
+package service
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// packets described in protocol.schema, consulted before the registered structs
+type schemaRegistry struct {
+	packets map[uint16]*packetSchema
+	mu      sync.RWMutex
+}
+
+func (sr *schemaRegistry) set(packets map[uint16]*packetSchema) {
+	sr.mu.Lock()
+	sr.packets = packets
+	sr.mu.Unlock()
+}
+
+func (sr *schemaRegistry) get(opCode uint16) (*packetSchema, bool) {
+	sr.mu.RLock()
+	ps, ok := sr.packets[opCode]
+	sr.mu.RUnlock()
+	return ps, ok
+}
+
+type schemaKind int
+
+const (
+	schemaInt schemaKind = iota
+	schemaString
+	schemaBytes
+	schemaArray
+	schemaIf
+)
+
+// the length of a string, bytes or array field: a number, an integer field read before it or the rest of the payload
+type schemaLength struct {
+	n     int
+	field string
+	rest  bool
+}
+
+// if <field> <op> <value>, the fields of the block are only read if it holds
+type schemaCondition struct {
+	field string
+	op    string
+	value int64
+}
+
+type schemaField struct {
+	name string
+	kind schemaKind
+	// integers, in bytes
+	size   int
+	signed bool
+	order  binary.ByteOrder
+	length schemaLength
+	cond   schemaCondition
+	// the fields of an array element or of an if block
+	fields []schemaField
+}
+
+type packetSchema struct {
+	opCode uint16
+	fields []schemaField
+}
+
+// the file protocol.schema points to, e.g
+//
+//	endian: little
+//	packets:
+//	  - opcode: NC_CHAR_CHAT_REQ
+//	    fields:
+//	      - u8 length
+//	      - string[length] message
+//	  - opcode: 0x1c0a
+//	    fields:
+//	      - u16 handle
+//	      - u8 count
+//	      - array[count] items:
+//	          - u16 id
+//	          - u32be amount
+//	      - if handle != 0:
+//	          - bytes[rest] extra
+type schemaFile struct {
+	Endian  string `yaml:"endian"`
+	Packets []struct {
+		OpCode string        `yaml:"opcode"`
+		Endian string        `yaml:"endian"`
+		Fields []interface{} `yaml:"fields"`
+	} `yaml:"packets"`
+}
+
+var (
+	schemaIntType    = regexp.MustCompile(`^([ui])(8|16|32|64)(le|be)?$`)
+	schemaLengthType = regexp.MustCompile(`^(string|bytes|array)\[([^\]]+)\]$`)
+	schemaName       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	schemaOperators  = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+)
+
+// schemaLines finds the line a definition is on, yaml.v2 doesn't keep them
+// definitions are looked up in document order, so the same text in two packets is told apart
+type schemaLines struct {
+	lines []string
+	next  int
+}
+
+func (sl *schemaLines) find(text string) int {
+	for i := sl.next; i < len(sl.lines); i++ {
+		if strings.Contains(sl.lines[i], text) {
+			sl.next = i
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// schemaParser validates the packets of a schema file, every error is kept with its line and operation code
+type schemaParser struct {
+	path   string
+	lines  *schemaLines
+	opCode string
+	errs   []string
+}
+
+func (sp *schemaParser) errorf(line int, format string, a ...interface{}) {
+	sp.errs = append(sp.errs, fmt.Sprintf("%v:%v: operation code %v: %v", sp.path, line, sp.opCode, fmt.Sprintf(format, a...)))
+}
+
+// parse and validate a schema file, operation codes may be given as numbers or as command names,
+// so the commands file has to be loaded first
+func loadSchema(path string, commands *commandRegistry) (map[uint16]*packetSchema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sf schemaFile
+	if err := yaml.UnmarshalStrict(data, &sf); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	sp := &schemaParser{
+		path:  path,
+		lines: &schemaLines{lines: strings.Split(string(data), "\n")},
+	}
+	fileOrder, err := schemaByteOrder(sf.Endian, binary.LittleEndian)
+	if err != nil {
+		return nil, fmt.Errorf("%v: endian: %v", path, err)
+	}
+
+	packets := make(map[uint16]*packetSchema)
+	for _, p := range sf.Packets {
+		sp.opCode = p.OpCode
+		line := sp.lines.find("opcode:")
+		opCode, err := commands.parse(p.OpCode)
+		if err != nil {
+			sp.errorf(line, "%v", err)
+			continue
+		}
+		if _, ok := packets[opCode]; ok {
+			sp.errorf(line, "described more than once")
+			continue
+		}
+		order, err := schemaByteOrder(p.Endian, fileOrder)
+		if err != nil {
+			sp.errorf(line, "endian: %v", err)
+			continue
+		}
+		if len(p.Fields) == 0 {
+			sp.errorf(line, "no fields")
+			continue
+		}
+		packets[opCode] = &packetSchema{
+			opCode: opCode,
+			fields: sp.fields(p.Fields, order, []map[string]bool{{}}, line),
+		}
+	}
+
+	if len(sp.errs) > 0 {
+		return nil, fmt.Errorf("%v", strings.Join(sp.errs, "\n"))
+	}
+	return packets, nil
+}
+
+func schemaByteOrder(endian string, fallback binary.ByteOrder) (binary.ByteOrder, error) {
+	switch strings.ToLower(endian) {
+	case "":
+		return fallback, nil
+	case "little":
+		return binary.LittleEndian, nil
+	case "big":
+		return binary.BigEndian, nil
+	default:
+		return nil, fmt.Errorf("expected little or big, got %q", endian)
+	}
+}
+
+// parse the fields of a packet, array element or if block, scopes are the integer fields that lengths and
+// conditions can refer to, those of the struct being parsed last
+func (sp *schemaParser) fields(defs []interface{}, order binary.ByteOrder, scopes []map[string]bool, parentLine int) []schemaField {
+	var fields []schemaField
+	for _, def := range defs {
+		switch d := def.(type) {
+		case string:
+			line := sp.lines.find(d)
+			f, ok := sp.field(d, order, scopes, line)
+			if !ok {
+				continue
+			}
+			if f.kind == schemaArray {
+				sp.errorf(line, "%v: the fields of an array are given as a list under it, e.g %v:", f.name, d)
+				continue
+			}
+			fields = append(fields, f)
+		case map[interface{}]interface{}:
+			if len(d) != 1 {
+				sp.errorf(sp.lines.find(":"), "expected a single array or if block per list item, got %v keys", len(d))
+				continue
+			}
+			for k, v := range d {
+				spec := fmt.Sprint(k)
+				line := sp.lines.find(spec)
+				body, ok := v.([]interface{})
+				if !ok || len(body) == 0 {
+					sp.errorf(line, "%v: expected a list of fields", spec)
+					continue
+				}
+				if strings.HasPrefix(spec, "if ") {
+					cond, ok := sp.condition(spec, scopes, line)
+					if !ok {
+						continue
+					}
+					// the fields of the block belong to the enclosing struct
+					fields = append(fields, schemaField{
+						kind:   schemaIf,
+						cond:   cond,
+						fields: sp.fields(body, order, scopes, line),
+					})
+					continue
+				}
+				f, ok := sp.field(spec, order, scopes, line)
+				if !ok {
+					continue
+				}
+				if f.kind != schemaArray {
+					sp.errorf(line, "%v: only arrays and if blocks have fields", f.name)
+					continue
+				}
+				f.fields = sp.fields(body, order, append(scopes, map[string]bool{}), line)
+				fields = append(fields, f)
+			}
+		default:
+			sp.errorf(parentLine, "unexpected field definition %v", def)
+		}
+	}
+	return fields
+}
+
+// <type> <name>, e.g u16 handle, u32be amount, string[16] name, bytes[length] data, array[count] items
+func (sp *schemaParser) field(spec string, order binary.ByteOrder, scopes []map[string]bool, line int) (schemaField, bool) {
+	parts := strings.Fields(spec)
+	if len(parts) != 2 {
+		sp.errorf(line, "%q: expected <type> <name>", spec)
+		return schemaField{}, false
+	}
+	f := schemaField{name: parts[1]}
+	if !schemaName.MatchString(f.name) {
+		sp.errorf(line, "%v: invalid field name", f.name)
+		return schemaField{}, false
+	}
+	current := scopes[len(scopes)-1]
+	if _, ok := current[f.name]; ok {
+		sp.errorf(line, "%v: declared more than once", f.name)
+		return schemaField{}, false
+	}
+
+	if m := schemaIntType.FindStringSubmatch(parts[0]); m != nil {
+		f.kind = schemaInt
+		f.signed = m[1] == "i"
+		bits, _ := strconv.Atoi(m[2])
+		f.size = bits / 8
+		f.order = order
+		switch m[3] {
+		case "le":
+			f.order = binary.LittleEndian
+		case "be":
+			f.order = binary.BigEndian
+		}
+		current[f.name] = true
+		return f, true
+	}
+
+	m := schemaLengthType.FindStringSubmatch(parts[0])
+	if m == nil {
+		sp.errorf(line, "%v: unknown type %v", f.name, parts[0])
+		return schemaField{}, false
+	}
+	switch m[1] {
+	case "string":
+		f.kind = schemaString
+	case "bytes":
+		f.kind = schemaBytes
+	case "array":
+		f.kind = schemaArray
+	}
+	switch length := m[2]; {
+	case length == "rest":
+		if f.kind == schemaArray {
+			sp.errorf(line, "%v: arrays can't take the rest of the payload", f.name)
+			return schemaField{}, false
+		}
+		f.length.rest = true
+	case schemaName.MatchString(length):
+		if !schemaDeclared(scopes, length) {
+			sp.errorf(line, "%v: length %v is not an integer field declared before it", f.name, length)
+			return schemaField{}, false
+		}
+		f.length.field = length
+	default:
+		n, err := strconv.ParseUint(length, 0, 16)
+		if err != nil {
+			sp.errorf(line, "%v: invalid length %v", f.name, length)
+			return schemaField{}, false
+		}
+		f.length.n = int(n)
+	}
+	// only integers can be referred to, but the name is still taken
+	current[f.name] = false
+	return f, true
+}
+
+// if <field> <op> <value>, e.g if flags != 0, the operators are == != < <= > >=
+func (sp *schemaParser) condition(spec string, scopes []map[string]bool, line int) (schemaCondition, bool) {
+	parts := strings.Fields(spec)
+	if len(parts) != 4 {
+		sp.errorf(line, "%q: expected if <field> <operator> <value>", spec)
+		return schemaCondition{}, false
+	}
+	c := schemaCondition{field: parts[1], op: parts[2]}
+	if !schemaDeclared(scopes, c.field) {
+		sp.errorf(line, "%q: %v is not an integer field declared before it", spec, c.field)
+		return schemaCondition{}, false
+	}
+	if !schemaOperators[c.op] {
+		sp.errorf(line, "%q: unknown operator %v", spec, c.op)
+		return schemaCondition{}, false
+	}
+	v, err := strconv.ParseInt(parts[3], 0, 64)
+	if err != nil {
+		sp.errorf(line, "%q: invalid value %v", spec, parts[3])
+		return schemaCondition{}, false
+	}
+	c.value = v
+	return c, true
+}
+
+// whether name is an integer field of the struct being parsed or of the ones enclosing it
+func schemaDeclared(scopes []map[string]bool, name string) bool {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if isInt, ok := scopes[i][name]; ok {
+			return isInt
+		}
+	}
+	return false
+}
+
+func (c schemaCondition) holds(v int64) bool {
+	switch c.op {
+	case "==":
+		return v == c.value
+	case "!=":
+		return v != c.value
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case ">":
+		return v > c.value
+	default:
+		return v >= c.value
+	}
+}
+
+// schemaDecoder reads a payload with the fields of a packet schema
+type schemaDecoder struct {
+	data   []byte
+	offset int
+	fields []Field
+}
+
+// unpack a payload into field name => value, bytes left after the last field are kept as hex in _trailing
+func (ps *packetSchema) representation(data []byte) (ncRepresentation, error) {
+	values := make(map[string]interface{})
+	d := &schemaDecoder{data: data}
+	if err := d.decode(ps.fields, []map[string]interface{}{values}, ""); err != nil {
+		return ncRepresentation{}, err
+	}
+	if d.offset < len(data) {
+		values["_trailing"] = hex.EncodeToString(data[d.offset:])
+	}
+	sd, err := json.Marshal(values)
+	if err != nil {
+		return ncRepresentation{}, err
+	}
+	return ncRepresentation{
+		UnpackedData: string(sd),
+		Fields:       d.fields,
+	}, nil
+}
+
+// values read are added to the last scope, lengths and conditions are looked up from the last scope to the first
+func (d *schemaDecoder) decode(fields []schemaField, scopes []map[string]interface{}, prefix string) error {
+	values := scopes[len(scopes)-1]
+	for _, f := range fields {
+		switch f.kind {
+		case schemaIf:
+			v, err := schemaInteger(scopes, f.cond.field)
+			if err != nil {
+				return err
+			}
+			if !f.cond.holds(v) {
+				continue
+			}
+			if err := d.decode(f.fields, scopes, prefix); err != nil {
+				return err
+			}
+		case schemaInt:
+			b, err := d.read(prefix+f.name, f.size)
+			if err != nil {
+				return err
+			}
+			values[f.name] = f.integer(b)
+		case schemaString, schemaBytes:
+			n, err := d.length(f, scopes)
+			if err != nil {
+				return err
+			}
+			b, err := d.read(prefix+f.name, n)
+			if err != nil {
+				return err
+			}
+			if f.kind == schemaString {
+				// fixed size strings are padded with zeros
+				if i := strings.IndexByte(string(b), 0); i >= 0 {
+					b = b[:i]
+				}
+				values[f.name] = string(b)
+			} else {
+				values[f.name] = hex.EncodeToString(b)
+			}
+		case schemaArray:
+			n, err := d.length(f, scopes)
+			if err != nil {
+				return err
+			}
+			if n > len(d.data) {
+				return fmt.Errorf("%v%v: %v elements in a %v byte payload", prefix, f.name, n, len(d.data))
+			}
+			elements := make([]map[string]interface{}, n)
+			for i := range elements {
+				elements[i] = make(map[string]interface{})
+				err := d.decode(f.fields, append(scopes[:len(scopes):len(scopes)], elements[i]), fmt.Sprintf("%v%v[%v].", prefix, f.name, i))
+				if err != nil {
+					return err
+				}
+			}
+			values[f.name] = elements
+		}
+	}
+	return nil
+}
+
+func (d *schemaDecoder) read(name string, n int) ([]byte, error) {
+	if d.offset+n > len(d.data) {
+		return nil, fmt.Errorf("%v: %v bytes needed at offset %v of a %v byte payload", name, n, d.offset, len(d.data))
+	}
+	b := d.data[d.offset : d.offset+n]
+	d.fields = append(d.fields, Field{
+		Name:   name,
+		Offset: d.offset,
+		Length: n,
+	})
+	d.offset += n
+	return b, nil
+}
+
+func (d *schemaDecoder) length(f schemaField, scopes []map[string]interface{}) (int, error) {
+	switch {
+	case f.length.rest:
+		return len(d.data) - d.offset, nil
+	case f.length.field != "":
+		v, err := schemaInteger(scopes, f.length.field)
+		if err != nil {
+			return 0, err
+		}
+		if v < 0 {
+			return 0, fmt.Errorf("%v: negative length %v", f.name, v)
+		}
+		return int(v), nil
+	default:
+		return f.length.n, nil
+	}
+}
+
+// the value of an integer field, fields inside an if block that didn't hold are missing
+func schemaInteger(scopes []map[string]interface{}, name string) (int64, error) {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		switch v := scopes[i][name].(type) {
+		case uint64:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%v was not read", name)
+}
+
+func (f schemaField) integer(b []byte) interface{} {
+	var u uint64
+	switch f.size {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(f.order.Uint16(b))
+	case 4:
+		u = uint64(f.order.Uint32(b))
+	default:
+		u = f.order.Uint64(b)
+	}
+	if !f.signed {
+		return u
+	}
+	// sign extend from the size of the field
+	shift := uint(64 - 8*f.size)
+	return int64(u<<shift) >> shift
+}
@@ -0,0 +1,328 @@
+package service
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a schema file with the packets given, under endian: little
+func writeSchema(t *testing.T, packets string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schema.yml")
+	if err := ioutil.WriteFile(path, []byte("endian: little\npackets:\n"+packets), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSchemaRepresentation(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		payload []byte
+		decoded string
+		err     string
+	}{
+		{
+			name: "integers",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 a
+      - u16 b
+      - u16be c
+      - i8 d
+      - i32 e
+`,
+			payload: []byte{1, 2, 1, 1, 2, 0xff, 0xfe, 0xff, 0xff, 0xff},
+			decoded: `{"a":1,"b":258,"c":258,"d":-1,"e":-2}`,
+		},
+		{
+			name: "big endian packet",
+			packet: `
+  - opcode: 0x1001
+    endian: big
+    fields:
+      - u16 a
+      - u16le b
+`,
+			payload: []byte{1, 2, 1, 2},
+			decoded: `{"a":258,"b":513}`,
+		},
+		{
+			name: "variable length string",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 length
+      - string[length] message
+      - string[8] name
+`,
+			payload: []byte{5, 'h', 'e', 'l', 'l', 'o', 'T', 'a', 'r', 'i', 'a', 'n', 0, 0},
+			decoded: `{"length":5,"message":"hello","name":"Tarian"}`,
+		},
+		{
+			name: "empty string",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 length
+      - string[length] message
+      - bytes[rest] extra
+`,
+			payload: []byte{0, 0xaa},
+			decoded: `{"extra":"aa","length":0,"message":""}`,
+		},
+		{
+			name: "nested arrays",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 count
+      - array[count] slots:
+          - u8 items
+          - array[items] item:
+              - u16 id
+              - u8 length
+              - string[length] name
+`,
+			payload: []byte{
+				2,
+				2, 1, 0, 1, 'a', 2, 0, 2, 'b', 'c',
+				0,
+			},
+			decoded: `{"count":2,"slots":[{"item":[{"id":1,"length":1,"name":"a"},{"id":2,"length":2,"name":"bc"}],"items":2},{"item":[],"items":0}]}`,
+		},
+		{
+			name: "array length from the enclosing struct",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 count
+      - u8 size
+      - array[count] rows:
+          - bytes[size] row
+`,
+			payload: []byte{2, 3, 1, 2, 3, 4, 5, 6},
+			decoded: `{"count":2,"rows":[{"row":"010203"},{"row":"040506"}],"size":3}`,
+		},
+		{
+			name: "if block read",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 flags
+      - if flags != 0:
+          - u16 handle
+`,
+			payload: []byte{1, 2, 0},
+			decoded: `{"flags":1,"handle":2}`,
+		},
+		{
+			name: "if block skipped",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 flags
+      - if flags != 0:
+          - u16 handle
+`,
+			payload: []byte{0, 2, 0},
+			decoded: `{"_trailing":"0200","flags":0}`,
+		},
+		{
+			name: "string longer than the payload",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 length
+      - string[length] message
+`,
+			payload: []byte{5, 'h', 'i'},
+			err:     "message: 5 bytes needed at offset 1 of a 3 byte payload",
+		},
+		{
+			name: "element of a nested array cut short",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 count
+      - array[count] slots:
+          - u8 items
+          - array[items] item:
+              - u16 id
+`,
+			payload: []byte{1, 2, 1, 0, 2},
+			err:     "slots[0].item[1].id: 2 bytes needed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets, err := loadSchema(writeSchema(t, tt.packet), testProtocol(t).commands)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps, ok := packets[0x1001]
+			if !ok {
+				t.Fatal("operation code 0x1001 isn't in the schema")
+			}
+			nr, err := ps.representation(tt.payload)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, expected %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nr.UnpackedData != tt.decoded {
+				t.Errorf("decoded to\n%v\nexpected\n%v", nr.UnpackedData, tt.decoded)
+			}
+		})
+	}
+}
+
+// the fields of a schema packet are given with their place in the payload, elements of arrays by index
+func TestSchemaFields(t *testing.T) {
+	packets, err := loadSchema(writeSchema(t, `
+  - opcode: 0x1001
+    fields:
+      - u8 count
+      - array[count] items:
+          - u16 id
+`), testProtocol(t).commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr, err := packets[0x1001].representation([]byte{2, 1, 0, 2, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Field{
+		{Name: "count", Offset: 0, Length: 1},
+		{Name: "items[0].id", Offset: 1, Length: 2},
+		{Name: "items[1].id", Offset: 3, Length: 2},
+	}
+	if len(nr.Fields) != len(expected) {
+		t.Fatalf("fields %+v, expected %+v", nr.Fields, expected)
+	}
+	for i, f := range expected {
+		if nr.Fields[i].Name != f.Name || nr.Fields[i].Offset != f.Offset || nr.Fields[i].Length != f.Length {
+			t.Errorf("field %v is %+v, expected %+v", i, nr.Fields[i], f)
+		}
+	}
+}
+
+// validation errors name the line and the operation code
+func TestSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		err    string
+	}{
+		{
+			name: "unknown type",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u24 handle
+`,
+			err: ":6: operation code 0x1001: handle: unknown type u24",
+		},
+		{
+			name: "length declared after",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - string[length] message
+      - u8 length
+`,
+			err: ":6: operation code 0x1001: message: length length is not an integer field declared before it",
+		},
+		{
+			name: "length of a string field",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - string[4] name
+      - bytes[name] data
+`,
+			err: ":7: operation code 0x1001: data: length name is not an integer field declared before it",
+		},
+		{
+			name: "field of an array element used outside of it",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 count
+      - array[count] items:
+          - u8 size
+      - bytes[size] data
+`,
+			err: ":9: operation code 0x1001: data: length size is not an integer field declared before it",
+		},
+		{
+			name: "array without fields",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 count
+      - array[count] items
+`,
+			err: ":7: operation code 0x1001: items: the fields of an array are given as a list under it",
+		},
+		{
+			name: "unknown operator",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 flags
+      - if flags ~ 1:
+          - u8 extra
+`,
+			err: `:7: operation code 0x1001: "if flags ~ 1": unknown operator ~`,
+		},
+		{
+			name: "declared twice",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 a
+      - u16 a
+`,
+			err: ":7: operation code 0x1001: a: declared more than once",
+		},
+		{
+			name: "operation code described twice",
+			packet: `
+  - opcode: 0x1001
+    fields:
+      - u8 a
+  - opcode: 4097
+    fields:
+      - u8 a
+`,
+			err: ":7: operation code 4097: described more than once",
+		},
+		{
+			name: "unknown operation code",
+			packet: `
+  - opcode: NC_NOT_A_COMMAND
+    fields:
+      - u8 a
+`,
+			err: `:4: operation code NC_NOT_A_COMMAND: unknown operation code or command name "NC_NOT_A_COMMAND"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadSchema(writeSchema(t, tt.packet), testProtocol(t).commands)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
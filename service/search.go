@@ -0,0 +1,299 @@
+package service
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matches returned by a search unless limit says otherwise
+const defaultSearchLimit = 1000
+
+// packetSearch holds the filters of GET /api/search, zero values match everything
+type packetSearch struct {
+	opCode    uint16
+	hasOpCode bool
+	flowName  string
+	direction string
+	// raw bytes the payload must contain, given as hex
+	payload      []byte
+	since, until time.Time
+	limit        int
+}
+
+func parsePacketSearch(p *protocol, r *http.Request) (packetSearch, error) {
+	q := r.URL.Query()
+	s := packetSearch{
+		flowName:  q.Get("flow"),
+		direction: q.Get("direction"),
+		limit:     defaultSearchLimit,
+	}
+
+	if v := q.Get("opcode"); v != "" {
+		o, err := p.parseOpCode(v)
+		if err != nil {
+			return s, fmt.Errorf("opcode: %v", err)
+		}
+		s.opCode, s.hasOpCode = o, true
+	}
+
+	if s.direction != "" && s.direction != "inbound" && s.direction != "outbound" {
+		return s, fmt.Errorf("direction: must be inbound or outbound")
+	}
+
+	if v := q.Get("payload"); v != "" {
+		p, err := hex.DecodeString(strings.ReplaceAll(v, " ", ""))
+		if err != nil {
+			return s, fmt.Errorf("payload: %v", err)
+		}
+		s.payload = p
+	}
+
+	// times are given as RFC 3339, e.g 2020-05-01T12:30:00Z
+	for name, t := range map[string]*time.Time{"since": &s.since, "until": &s.until} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return s, fmt.Errorf("%v: %v", name, err)
+		}
+		*t = parsed
+	}
+
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			return s, fmt.Errorf("limit: must be a positive number")
+		}
+		s.limit = l
+	}
+	return s, nil
+}
+
+func (s packetSearch) matches(flowName, direction string, opCode uint16, seen time.Time, payload []byte) bool {
+	if s.hasOpCode && opCode != s.opCode {
+		return false
+	}
+	if s.flowName != "" && flowName != s.flowName {
+		return false
+	}
+	if s.direction != "" && direction != s.direction {
+		return false
+	}
+	if !s.since.IsZero() && seen.Before(s.since) {
+		return false
+	}
+	if !s.until.IsZero() && seen.After(s.until) {
+		return false
+	}
+	if len(s.payload) > 0 && !bytes.Contains(payload, s.payload) {
+		return false
+	}
+	return true
+}
+
+// the history buffers are snapshotted one stream at a time, so decoders only wait for a copy, not for the search
+func (sn *Sniffer) searchHistory(s packetSearch) (packets []storedPacket, truncated bool) {
+	sn.eachHistoryPacket(s, func(p storedPacket) bool {
+		if len(packets) == s.limit {
+			truncated = true
+			return false
+		}
+		packets = append(packets, p)
+		return true
+	})
+	return packets, truncated
+}
+
+// call visit with the packets of the history matching s, oldest first, until it returns false
+func (sn *Sniffer) eachHistoryPacket(s packetSearch, visit func(storedPacket) bool) {
+	for _, pe := range sn.history() {
+		b := pe.Packet.Base
+		if !s.matches(pe.FlowName, pe.Direction, b.OperationCode, pe.Seen, b.Data) {
+			continue
+		}
+		p := storedPacket{
+			ID:        pe.ID,
+			PacketID:  pe.ID,
+			Seq:       pe.Seq,
+			FlowID:    pe.FlowID,
+			FlowName:  pe.FlowName,
+			Direction: pe.Direction,
+			Seen:      pe.Seen,
+			OpCode:    b.OperationCode,
+			Command:   b.ClientStructName,
+			Length:    len(b.Data),
+			Payload:   b.Data,
+		}
+		if !visit(p) {
+			return
+		}
+	}
+}
+
+func searchDatabase(p *protocol, db *sql.DB, s packetSearch) (packets []storedPacket, truncated bool, err error) {
+	err = eachDatabasePacket(p, db, s, func(p storedPacket) bool {
+		if len(packets) == s.limit {
+			truncated = true
+			return false
+		}
+		packets = append(packets, p)
+		return true
+	})
+	return packets, truncated, err
+}
+
+// rows read from the database at a time by eachDatabasePacket
+const databasePageSize = 1000
+
+// call visit with the stored packets matching s, oldest first, until it returns false
+// the indexed filters are left to sqlite, the payload is matched on the returned rows
+// rows are read a page at a time and visited once the page is read, the capture writes to the database over the same
+// single connection and must not wait for a slow reader
+func eachDatabasePacket(p *protocol, db *sql.DB, s packetSearch, visit func(storedPacket) bool) error {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if s.hasOpCode {
+		where = append(where, "opcode = ?")
+		args = append(args, s.opCode)
+	}
+	if s.flowName != "" {
+		where = append(where, "flow_name = ?")
+		args = append(args, s.flowName)
+	}
+	if s.direction != "" {
+		where = append(where, "direction = ?")
+		args = append(args, s.direction)
+	}
+	if !s.since.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, s.since.UnixNano())
+	}
+	if !s.until.IsZero() {
+		where = append(where, "timestamp <= ?")
+		args = append(args, s.until.UnixNano())
+	}
+
+	// the next page starts after the last row of the previous one
+	where = append(where, "(timestamp > ? OR timestamp = ? AND id > ?)")
+	query := "SELECT id, flow_id, flow_name, direction, timestamp, opcode, length, payload, packet_id, seq FROM packets WHERE " +
+		strings.Join(where, " AND ") + " ORDER BY timestamp, id LIMIT " + strconv.Itoa(databasePageSize)
+
+	lastTS, lastID := int64(math.MinInt64), int64(0)
+	for {
+		page, err := databasePage(p, db, query, append(args, lastTS, lastTS, lastID)...)
+		if err != nil {
+			return err
+		}
+		for _, r := range page {
+			if len(s.payload) > 0 && !bytes.Contains(r.p.Payload, s.payload) {
+				continue
+			}
+			if !visit(r.p) {
+				return nil
+			}
+		}
+		if len(page) < databasePageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		lastTS, lastID = last.ts, last.id
+	}
+}
+
+type databaseRow struct {
+	p      storedPacket
+	id, ts int64
+}
+
+func databasePage(p *protocol, db *sql.DB, query string, args ...interface{}) ([]databaseRow, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]databaseRow, 0, databasePageSize)
+	for rows.Next() {
+		var r databaseRow
+		if err := rows.Scan(&r.id, &r.p.FlowID, &r.p.FlowName, &r.p.Direction, &r.ts, &r.p.OpCode, &r.p.Length, &r.p.Payload, &r.p.PacketID, &r.p.Seq); err != nil {
+			return nil, err
+		}
+		r.p.ID = strconv.FormatInt(r.id, 10)
+		r.p.Seen = time.Unix(0, r.ts)
+		r.p.Command = p.commandName(r.p.OpCode)
+		page = append(page, r)
+	}
+	return page, rows.Err()
+}
+
+// searchResult is the json returned by GET /api/search
+type searchResult struct {
+	// history or sqlite
+	Source    string         `json:"source"`
+	Packets   []storedPacket `json:"packets"`
+	Truncated bool           `json:"truncated"`
+}
+
+// GET /api/search?opcode=3087&flow=zone00-client&direction=inbound&payload=0a0b&since=...&until=...&limit=100
+// searches the sqlite database if there is one, the packet history of the active streams otherwise
+// source=history searches the history even if there is a database
+func (sn *Sniffer) searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := parsePacketSearch(sn.protocol, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	switch source {
+	case "":
+		source = "history"
+		if sn.store != nil {
+			source = "sqlite"
+		}
+	case "history", "sqlite":
+	default:
+		http.Error(w, "source: must be history or sqlite", http.StatusBadRequest)
+		return
+	}
+
+	res := searchResult{Source: source}
+	if source == "sqlite" {
+		if sn.store == nil {
+			http.Error(w, "no sqlite database, set output.sqlite.path", http.StatusBadRequest)
+			return
+		}
+		res.Packets, res.Truncated, err = searchDatabase(sn.protocol, sn.store.db, s)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		if sn.config.HistorySize == 0 {
+			http.Error(w, "no packet history, set ui.historySize", http.StatusBadRequest)
+			return
+		}
+		res.Packets, res.Truncated = sn.searchHistory(s)
+	}
+	if res.Packets == nil {
+		res.Packets = []storedPacket{}
+	}
+	writeJSON(w, res)
+}
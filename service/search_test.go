@@ -0,0 +1,128 @@
+package service
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// the result of GET /api/search?query
+func search(t *testing.T, sn *Sniffer, query string) searchResult {
+	t.Helper()
+	w := httptest.NewRecorder()
+	sn.searchHandler(w, httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%q: status %v: %v", query, w.Code, w.Body.String())
+	}
+	var res searchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// the filters of GET /api/search match the same packets in the history and in the sqlite database
+func TestSearchFilters(t *testing.T) {
+	packets := exportPackets(12)
+	at := func(i int) string {
+		return exportStart.Add(time.Duration(i) * time.Second).Format(time.RFC3339)
+	}
+	tests := []struct {
+		name  string
+		query string
+		// the indexes of the expected packets
+		packets   []int
+		truncated bool
+	}{
+		{"everything", "", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, false},
+		{"flow", "flow=login-client", []int{0, 2, 4, 6, 8, 10}, false},
+		{"direction", "direction=outbound", []int{0, 2, 4, 6, 8, 10}, false},
+		{"opcode", "opcode=" + strconv.Itoa(int(opChatReq)), []int{2, 5, 8, 11}, false},
+		{"opcode by name", "opcode=NC_ACT_CHAT_REQ", []int{2, 5, 8, 11}, false},
+		{"payload", "payload=" + hex.EncodeToString([]byte("3,")), []int{3}, false},
+		{"payload with spaces", "payload=31%202c", []int{1, 11}, false},
+		{"since and until", "since=" + at(3) + "&until=" + at(6), []int{3, 4, 5, 6}, false},
+		{"limit", "limit=3", []int{0, 1, 2}, true},
+		{"limit of every match", "flow=login-client&limit=6", []int{0, 2, 4, 6, 8, 10}, false},
+		{"nothing", "flow=login-client&direction=inbound", nil, false},
+	}
+	for _, source := range []string{"history", "sqlite"} {
+		t.Run(source, func(t *testing.T) {
+			sn := exportSniffer(t, source, packets)
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					res := search(t, sn, tt.query+"&source="+source)
+					if res.Source != source || res.Truncated != tt.truncated {
+						t.Errorf("source %v truncated %v, expected %v %v", res.Source, res.Truncated, source, tt.truncated)
+					}
+					if res.Packets == nil {
+						t.Fatal("packets is null, expected a list")
+					}
+					var got []uint64
+					for _, p := range res.Packets {
+						got = append(got, p.Seq)
+					}
+					var expected []uint64
+					for _, i := range tt.packets {
+						expected = append(expected, packets[i].Seq)
+					}
+					if !reflect.DeepEqual(got, expected) {
+						t.Errorf("found %v, expected %v", got, expected)
+					}
+				})
+			}
+		})
+	}
+}
+
+// the database is read a page at a time, the pages follow each other without gaps or repeats
+func TestSearchDatabasePages(t *testing.T) {
+	packets := exportPackets(2*databasePageSize + 10)
+	// packets seen at the same time are ordered by their row
+	for i := range packets {
+		packets[i].Seen = exportStart.Add(time.Duration(i/3) * time.Second)
+	}
+	sn := exportSniffer(t, "sqlite", packets)
+	res := search(t, sn, "limit="+strconv.Itoa(len(packets)))
+	if len(res.Packets) != len(packets) || res.Truncated {
+		t.Fatalf("found %v packets, truncated %v, expected all %v", len(res.Packets), res.Truncated, len(packets))
+	}
+	for i, p := range res.Packets {
+		if p.Seq != packets[i].Seq {
+			t.Fatalf("packet %v is %v, expected %v", i, p.Seq, packets[i].Seq)
+		}
+	}
+}
+
+func TestSearchRefused(t *testing.T) {
+	history := exportSniffer(t, "history", exportPackets(1))
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+	}{
+		{"post", http.MethodPost, "", http.StatusMethodNotAllowed},
+		{"unknown opcode", http.MethodGet, "opcode=NC_NOTHING", http.StatusBadRequest},
+		{"direction", http.MethodGet, "direction=sideways", http.StatusBadRequest},
+		{"payload", http.MethodGet, "payload=zz", http.StatusBadRequest},
+		{"since", http.MethodGet, "since=yesterday", http.StatusBadRequest},
+		{"limit", http.MethodGet, "limit=0", http.StatusBadRequest},
+		{"source", http.MethodGet, "source=elasticsearch", http.StatusBadRequest},
+		{"no database", http.MethodGet, "source=sqlite", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			history.searchHandler(w, httptest.NewRequest(tt.method, "/api/search?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %v, expected %v: %v", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
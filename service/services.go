@@ -0,0 +1,206 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// shineServices maps the ports the game services listen on to a readable name
+type shineServices struct {
+	knownServices  map[int]string
+	discovered     map[int]bool
+	strict         bool
+	portRangeStart int
+	portRangeEnd   int
+	mu             sync.Mutex
+}
+
+func newShineServices(c Config) *shineServices {
+	s := &shineServices{
+		knownServices:  make(map[int]string),
+		discovered:     make(map[int]bool),
+		strict:         c.StrictServices,
+		portRangeStart: c.PortRangeStart,
+		portRangeEnd:   c.PortRangeEnd,
+	}
+	for port, name := range c.Services {
+		s.knownServices[port] = name
+	}
+	return s
+}
+
+// name of the service listening on port, safe to call while services are being registered
+func (s *shineServices) serviceForPort(port int) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.knownServices[port]
+	return name, ok
+}
+
+// add or rename a service, only streams created afterwards use it
+func (s *shineServices) register(port int, name string) {
+	s.mu.Lock()
+	s.knownServices[port] = name
+	s.mu.Unlock()
+}
+
+// add a zone announced by the world manager, unlike registered services it survives a reload
+func (s *shineServices) discover(port int, name string) {
+	s.mu.Lock()
+	s.knownServices[port] = name
+	s.discovered[port] = true
+	s.mu.Unlock()
+}
+
+func (s *shineServices) isStrict() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.strict
+}
+
+// copy of the known services, by port
+func (s *shineServices) list() map[int]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	services := make(map[int]string, len(s.knownServices))
+	for port, name := range s.knownServices {
+		services[port] = name
+	}
+	return services
+}
+
+// find which side of the connection is the service
+// if neither port is a known service, the port range is used to guess it and known is false
+func (s *shineServices) resolve(srcPort, dstPort int) (name string, port int, srcIsServer bool, known bool) {
+	if name, ok := s.serviceForPort(srcPort); ok {
+		return name, srcPort, true, true
+	}
+
+	if name, ok := s.serviceForPort(dstPort); ok {
+		return name, dstPort, false, true
+	}
+
+	s.mu.Lock()
+	start, end := s.portRangeStart, s.portRangeEnd
+	s.mu.Unlock()
+
+	if srcPort >= start && srcPort <= end {
+		return fmt.Sprintf("unknown-%v", srcPort), srcPort, true, false
+	}
+
+	return fmt.Sprintf("unknown-%v", dstPort), dstPort, false, false
+}
+
+// RegisterService labels the streams on port with name, e.g a zone spawned on a port that wasn't configured
+// streams created before the call keep their name
+func (sn *Sniffer) RegisterService(port int, name string) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("bad port %v", port)
+	}
+	if name == "" {
+		return fmt.Errorf("a service needs a name")
+	}
+	sn.services.register(port, name)
+	log.Infof("service %v registered on port %v", name, port)
+	return nil
+}
+
+type serviceView struct {
+	Port int    `json:"port"`
+	Name string `json:"name"`
+}
+
+// GET /api/services lists the known services, POST /api/services with {"port": 9212, "name": "zone02"} adds one
+// adding one changes how the capture labels its streams, so it has to be json from an allowed origin
+func (sn *Sniffer) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		services := make([]serviceView, 0)
+		for port, name := range sn.services.list() {
+			services = append(services, serviceView{
+				Port: port,
+				Name: name,
+			})
+		}
+		sort.Slice(services, func(i, j int) bool {
+			return services[i].Port < services[j].Port
+		})
+		writeJSON(w, services)
+	case http.MethodPost:
+		if !allowChange(w, r) {
+			return
+		}
+		var sv serviceView
+		if err := json.NewDecoder(r.Body).Decode(&sv); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sn.RegisterService(sv.Port, sv.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(sv); err != nil {
+			log.Error(err)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// discardStream is used for flows that don't belong to any known service when protocol.strictServices is set
+// and for flows of clients that aren't in network.clientIP
+type discardStream struct{}
+
+func (ds *discardStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	return false
+}
+
+func (ds *discardStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {}
+
+func (ds *discardStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	return true
+}
+
+// pendingStream is the stream of a connection whose first segment neither opened it nor carried data, the flow only
+// starts with one that does, so a client reconnecting from the same port still gets its own flow
+type pendingStream struct {
+	factory        *shineStreamFactory
+	net, transport gopacket.Flow
+	stream         reassembly.Stream
+}
+
+// a SYN or a segment with data, a capture started in the middle of a connection opens its flow with the first data
+func opensStream(tcp *layers.TCP) bool {
+	return tcp.SYN || len(tcp.Payload) > 0
+}
+
+func (ps *pendingStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if ps.stream == nil {
+		if !opensStream(tcp) {
+			return false
+		}
+		ps.stream = ps.factory.newStream(ps.net, ps.transport, ac)
+	}
+	return ps.stream.Accept(tcp, ci, dir, nextSeq, start, ac)
+}
+
+func (ps *pendingStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	if ps.stream != nil {
+		ps.stream.ReassembledSG(sg, ac)
+	}
+}
+
+func (ps *pendingStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	if ps.stream == nil {
+		return true
+	}
+	return ps.stream.ReassemblyComplete(ac)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResolveService(t *testing.T) {
+	s := newShineServices(testConfig())
+	tests := []struct {
+		name             string
+		srcPort, dstPort int
+		service          string
+		port             int
+		srcIsServer      bool
+		known            bool
+	}{
+		{"client to login", 50000, 9010, "login", 9010, false, true},
+		{"login to client", 9010, 50000, "login", 9010, true, true},
+		{"client to zone", 50001, 9210, "zone00", 9210, false, true},
+		{"unknown server port in range", 9050, 50000, "unknown-9050", 9050, true, false},
+		{"unknown client to unknown port", 50000, 9051, "unknown-9051", 9051, false, false},
+		{"both ports out of range", 40000, 50000, "unknown-50000", 50000, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, port, srcIsServer, known := s.resolve(tt.srcPort, tt.dstPort)
+			if service != tt.service || port != tt.port || srcIsServer != tt.srcIsServer || known != tt.known {
+				t.Errorf("resolve(%v, %v) = %v, %v, %v, %v, expected %v, %v, %v, %v", tt.srcPort, tt.dstPort,
+					service, port, srcIsServer, known, tt.service, tt.port, tt.srcIsServer, tt.known)
+			}
+		})
+	}
+}
+
+// a stream on a port that isn't a known service is decoded under a name of its own, or discarded if strict
+func TestUnknownServicePort(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		c := testConfig()
+		c.StrictServices = strict
+
+		ms := NewMemorySource()
+		conv, err := NewTCPConversation(ms, testClientAddr, "192.168.1.10:9050", testStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.FromServer(EncodeShinePacket(opVersionAck, nil)); err != nil {
+			t.Fatal(err)
+		}
+		// the capture goes on after the unknown stream
+		known := openTestConversation(t, ms)
+		if err := known.FromServer(seedPacket(testSeed)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, sink := runPipeline(t, c, ms)
+		flows := make(map[string]int)
+		for _, pe := range sink.byDirection() {
+			flows[pe.FlowName]++
+		}
+		expected := map[string]int{"login-client": 1, "unknown-9050-client": 1}
+		if strict {
+			delete(expected, "unknown-9050-client")
+		}
+		if len(flows) != len(expected) {
+			t.Errorf("strict %v: packets by flow %v, expected %v", strict, flows, expected)
+		}
+		for name, n := range expected {
+			if flows[name] != n {
+				t.Errorf("strict %v: packets by flow %v, expected %v", strict, flows, expected)
+			}
+		}
+	}
+}
+
+// services are registered while the streams look them up, run with -race
+func TestRegisterServiceConcurrently(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for port := 9300 + i*10; port < 9300+i*10+10; port++ {
+				if err := sn.RegisterService(port, fmt.Sprintf("zone%v", port)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for port := 9300; port < 9340; port++ {
+				sn.services.resolve(50000, port)
+			}
+		}()
+	}
+	wg.Wait()
+	for port := 9300; port < 9340; port++ {
+		if name, ok := sn.services.serviceForPort(port); !ok || name != fmt.Sprintf("zone%v", port) {
+			t.Errorf("port %v is %q", port, name)
+		}
+	}
+}
+
+func TestServicesHandler(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{http.MethodPost, `{"port": 9212, "name": "zone02"}`, http.StatusCreated},
+		{http.MethodPost, `{"port": 70000, "name": "zone02"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"port": 9213}`, http.StatusBadRequest},
+		{http.MethodPost, `{"port":`, http.StatusBadRequest},
+		{http.MethodDelete, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tt.method, "/api/services", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		sn.servicesHandler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%v %v: status %v, expected %v", tt.method, tt.body, w.Code, tt.status)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	sn.servicesHandler(w, httptest.NewRequest(http.MethodGet, "/api/services", nil))
+	var services []serviceView
+	if err := json.NewDecoder(w.Body).Decode(&services); err != nil {
+		t.Fatal(err)
+	}
+	expected := []serviceView{{9010, "login"}, {9110, "worldmanager"}, {9210, "zone00"}, {9212, "zone02"}}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("got %v, expected %v", services, expected)
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const outputDir = "output"
+
+// session is the directory of a run, the manifest of the files written to it and the pseudonyms of --anonymize
+// a nil session writes to output/ and keeps neither a manifest nor pseudonyms
+type session struct {
+	dir       string
+	manifest  *sessionManifest
+	anonymous *anonymizer
+}
+
+// absolute path of a file in the directory of the session
+func (s *session) path(name string) (string, error) {
+	dir := outputDir
+	if s != nil {
+		dir = s.dir
+	}
+	return filepath.Abs(filepath.Join(dir, name))
+}
+
+// add a file to the manifest of the session, called by every output once it created its file
+func (s *session) register(path, kind string) {
+	if s == nil {
+		return
+	}
+	s.manifest.register(path, kind)
+}
+
+// the pseudonyms of the session, nil if addresses are written as they are
+func (s *session) anonymizer() *anonymizer {
+	if s == nil {
+		return nil
+	}
+	return s.anonymous
+}
+
+// write the manifest of a command starting with c, before any packet is captured
+func (s *session) start(command string, c Config) error {
+	if s == nil {
+		return nil
+	}
+	return s.manifest.start(command, c, s.anonymous != nil)
+}
+
+// write the manifest again once the outputs are closed, see sessionManifest.finish
+func (s *session) finish(totals *ManifestTotals) error {
+	if s == nil {
+		return nil
+	}
+	return s.manifest.finish(totals)
+}
+
+// create output/<timestamp>/ for this run, previous runs are only removed if clean is set
+// the log moves to the session directory too, in quiet mode only errors are also written to the console
+// with anonymize the pseudonyms are loaded before the log is opened, so no line has a real address
+func startSession(clean, quiet, anonymize bool) (*session, error) {
+	if clean {
+		if err := os.RemoveAll(outputDir); err != nil {
+			return nil, fmt.Errorf("cleaning %v: %v", outputDir, err)
+		}
+	}
+
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating %v: %v", outputDir, err)
+	}
+
+	// fail now rather than when the first file is written
+	f, err := ioutil.TempFile(outputDir, ".write-check")
+	if err != nil {
+		return nil, fmt.Errorf("%v is not writable: %v", outputDir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	s := &session{}
+	if anonymize {
+		a, err := loadAnonymizer(viper.GetString("output.anonymize.mapping"), viper.GetString("output.anonymize.key"))
+		if err != nil {
+			return nil, err
+		}
+		s.anonymous = a
+	}
+
+	name := time.Now().Format("2006-01-02T15-04-05")
+	dir := filepath.Join(outputDir, name)
+	// two runs started in the same second
+	for i := 1; ; i++ {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("creating session directory %v: %v", dir, err)
+		}
+		dir = filepath.Join(outputDir, fmt.Sprintf("%v-%v", name, i))
+	}
+	s.dir = dir
+	s.manifest = newSessionManifest(dir)
+
+	lf, err := os.OpenFile(filepath.Join(dir, "streams.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, err
+	}
+	s.register(lf.Name(), artifactLog)
+	log = newLogger(lf, !quiet, s.anonymous)
+	log.Infof("writing output to %v", dir)
+	return s, nil
+}
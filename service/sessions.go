@@ -0,0 +1,228 @@
+package service
+
+import (
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session groups the flows of a single game client, e.g its login, world manager and zone connections
+// flows are correlated by client ip, so clients behind the same NAT end up in the same session
+type Session struct {
+	ID       string        `json:"sessionID"`
+	ClientIP string        `json:"clientIP"`
+	Started  time.Time     `json:"started"`
+	LastSeen time.Time     `json:"lastSeen"`
+	Closed   bool          `json:"closed"`
+	Flows    []SessionFlow `json:"flows"`
+	// the protocol.versions entry of the version check of its client, "unknown" if the key is the one of no entry
+	Version    string `json:"version,omitempty"`
+	VersionKey string `json:"versionKey,omitempty"`
+	// the last flow completed at this time, zero while any flow is open
+	idleSince time.Time
+	// set once the version check of one of its flows was read
+	versionRead bool
+	version     *protocolVersion
+	// packets of protocol.timelineOpcodes by flow id, see Timeline
+	markers        map[string][]TimelineMarker
+	markerCount    int
+	markersDropped int
+	lastMarker     time.Time
+}
+
+type SessionFlow struct {
+	FlowID   string    `json:"flowID"`
+	FlowName string    `json:"flowName"`
+	Opened   time.Time `json:"opened"`
+	// zero while the flow is open
+	Completed time.Time `json:"completed"`
+}
+
+// sessions keeps every session seen, the open ones are also kept by client ip
+// a session closes once all of its flows completed and no new one opened for idleTimeout
+type sessions struct {
+	all         map[string]*Session
+	open        map[string]*Session
+	idleTimeout time.Duration
+	// operation codes marked on the timeline of their session
+	timelineOpCodes map[uint16]bool
+	// the pseudonyms of the client ips
+	anonymous *anonymizer
+	// capture time of the last flow event, so sessions in pcap files expire on their own clock
+	lastSeen time.Time
+	mu       sync.Mutex
+}
+
+func newSessions(idleTimeout time.Duration, timelineOpCodes map[uint16]bool, a *anonymizer) *sessions {
+	return &sessions{
+		all:             make(map[string]*Session),
+		open:            make(map[string]*Session),
+		idleTimeout:     idleTimeout,
+		timelineOpCodes: timelineOpCodes,
+		anonymous:       a,
+	}
+}
+
+// the ip of the side that is not the server
+func (ss *shineStream) clientIP() string {
+	if ss.isServer {
+		return ss.net.Dst().String()
+	}
+	return ss.net.Src().String()
+}
+
+// add a new flow to the open session of its client, starting one if needed
+func (s *sessions) flowOpened(ss *shineStream, seen time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(seen)
+
+	ip := ss.clientIP()
+	session, ok := s.open[ip]
+	if !ok {
+		session = &Session{
+			ID:       uuid.New().String(),
+			ClientIP: s.anonymous.ip(ip),
+			Started:  seen,
+		}
+		s.all[session.ID] = session
+		s.open[ip] = session
+		log.Infof("session %v started for client %v", session.ID, ip)
+	}
+	session.Flows = append(session.Flows, SessionFlow{
+		FlowID:   ss.flowID,
+		FlowName: ss.flowName,
+		Opened:   seen,
+	})
+	session.LastSeen = seen
+	session.idleSince = time.Time{}
+	return session.ID
+}
+
+// the protocol version of a session, nil until its version check was read or if it's the one of no protocol.versions entry
+func (s *sessions) version(sessionID string) *protocolVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.all[sessionID]; ok {
+		return session.version
+	}
+	return nil
+}
+
+// set the protocol version of a session from the version check of one of its flows, the first one wins
+// returns false with the version of the session if a flow already set another one
+func (s *sessions) setVersion(sessionID string, v *protocolVersion, key string) (bool, *protocolVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.all[sessionID]
+	if !ok {
+		return true, nil
+	}
+	if session.versionRead {
+		return session.version == v, session.version
+	}
+	session.versionRead = true
+	session.version = v
+	session.VersionKey = key
+	session.Version = "unknown"
+	if v != nil {
+		session.Version = v.name
+	}
+	return true, v
+}
+
+func (s *sessions) flowCompleted(ss *shineStream, seen time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.all[ss.sessionID]
+	if !ok {
+		return
+	}
+	open := 0
+	for i := range session.Flows {
+		f := &session.Flows[i]
+		if f.FlowID == ss.flowID {
+			f.Completed = seen
+		}
+		if f.Completed.IsZero() {
+			open++
+		}
+	}
+	if seen.After(session.LastSeen) {
+		session.LastSeen = seen
+	}
+	if open == 0 {
+		session.idleSince = seen
+	}
+	s.expire(seen)
+}
+
+// close the sessions that have been idle for longer than the timeout
+func (s *sessions) expire(now time.Time) {
+	if now.After(s.lastSeen) {
+		s.lastSeen = now
+	}
+	for ip, session := range s.open {
+		if session.idleSince.IsZero() || s.lastSeen.Sub(session.idleSince) < s.idleTimeout {
+			continue
+		}
+		session.Closed = true
+		delete(s.open, ip)
+		log.Infof("session %v of client %v closed after %v flows", session.ID, ip, len(session.Flows))
+	}
+}
+
+// every session, oldest first, now expires the idle ones before listing
+func (s *sessions) list(now time.Time) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !now.IsZero() {
+		s.expire(now)
+	}
+
+	list := make([]Session, 0, len(s.all))
+	for _, session := range s.all {
+		c := *session
+		c.Flows = append([]SessionFlow(nil), session.Flows...)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// Sessions seen so far, live captures expire idle sessions with the wall clock
+func (sn *Sniffer) Sessions() []Session {
+	var now time.Time
+	if sn.config.PcapFile == "" {
+		now = time.Now()
+	}
+	return sn.sessions.list(now)
+}
+
+// GET /api/sessions lists every session, GET /api/sessions/{sessionID} shows one
+func (sn *Sniffer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+	list := sn.Sessions()
+	if sessionID == "" {
+		writeJSON(w, list)
+		return
+	}
+	for _, s := range list {
+		if s.ID == sessionID {
+			writeJSON(w, s)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
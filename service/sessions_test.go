@@ -0,0 +1,221 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// a stream opened by client to the login server, enough of one for the sessions registry
+func sessionStream(flowID, client string) *shineStream {
+	return &shineStream{
+		flowID:   flowID,
+		flowName: "login-client",
+		net:      gopacket.NewFlow(layers.EndpointIPv4, net.ParseIP(client).To4(), net.ParseIP("192.168.1.10").To4()),
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	type step struct {
+		// open or complete the flow, or list the sessions at that time
+		action string
+		flowID string
+		client string
+		at     time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// the session of each flow, by the order they were started
+		sessions map[string]int
+		closed   []bool
+	}{
+		{
+			name: "flows of a client in sequence",
+			steps: []step{
+				{"open", "login", "192.168.1.20", 0},
+				{"complete", "login", "192.168.1.20", time.Second},
+				{"open", "world", "192.168.1.20", 30 * time.Second},
+				{"complete", "world", "192.168.1.20", 40 * time.Second},
+				{"open", "zone", "192.168.1.20", 90 * time.Second},
+			},
+			sessions: map[string]int{"login": 0, "world": 0, "zone": 0},
+			closed:   []bool{false},
+		},
+		{
+			name: "clients apart",
+			steps: []step{
+				{"open", "a", "192.168.1.20", 0},
+				{"open", "b", "192.168.1.30", time.Second},
+				{"open", "c", "192.168.1.20", 2 * time.Second},
+			},
+			sessions: map[string]int{"a": 0, "b": 1, "c": 0},
+			closed:   []bool{false, false},
+		},
+		{
+			name: "new flow after the idle timeout",
+			steps: []step{
+				{"open", "first", "192.168.1.20", 0},
+				{"complete", "first", "192.168.1.20", time.Second},
+				{"open", "second", "192.168.1.20", time.Second + time.Minute},
+			},
+			sessions: map[string]int{"first": 0, "second": 1},
+			closed:   []bool{true, false},
+		},
+		{
+			name: "an open flow keeps its session",
+			steps: []step{
+				{"open", "long", "192.168.1.20", 0},
+				{"open", "short", "192.168.1.20", time.Second},
+				{"complete", "short", "192.168.1.20", 2 * time.Second},
+				{"list", "", "", time.Hour},
+				{"open", "later", "192.168.1.20", 2 * time.Hour},
+			},
+			sessions: map[string]int{"long": 0, "short": 0, "later": 0},
+			closed:   []bool{false},
+		},
+		{
+			name: "listing expires idle sessions",
+			steps: []step{
+				{"open", "a", "192.168.1.20", 0},
+				{"complete", "a", "192.168.1.20", time.Second},
+				{"list", "", "", 2 * time.Minute},
+			},
+			sessions: map[string]int{"a": 0},
+			closed:   []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSessions(time.Minute, nil, nil)
+			streams := make(map[string]*shineStream)
+			var last time.Time
+			for _, st := range tt.steps {
+				last = testStart.Add(st.at)
+				switch st.action {
+				case "open":
+					ss := sessionStream(st.flowID, st.client)
+					ss.sessionID = s.flowOpened(ss, last)
+					streams[st.flowID] = ss
+				case "complete":
+					s.flowCompleted(streams[st.flowID], last)
+				case "list":
+					s.list(last)
+				}
+			}
+
+			list := s.list(last)
+			if len(list) != len(tt.closed) {
+				t.Fatalf("%v sessions, expected %v", len(list), len(tt.closed))
+			}
+			for i, session := range list {
+				if session.Closed != tt.closed[i] {
+					t.Errorf("session %v closed %v, expected %v", i, session.Closed, tt.closed[i])
+				}
+			}
+			for flowID, i := range tt.sessions {
+				if streams[flowID].sessionID != list[i].ID {
+					t.Errorf("flow %v is in session %v, expected %v", flowID, streams[flowID].sessionID, list[i].ID)
+				}
+			}
+		})
+	}
+}
+
+// two clients connecting to the login and then the world manager at the same time, each gets one session with its flows
+func TestSessionsOfClients(t *testing.T) {
+	clients := []string{"192.168.1.20", "192.168.1.30"}
+	ports := []int{testServerPort, testWorldPort}
+	ms := NewMemorySource()
+	for p, port := range ports {
+		for c, client := range clients {
+			start := testStart.Add(time.Duration(p)*time.Second + time.Duration(c)*time.Millisecond)
+			conv, err := NewTCPConversation(ms, net.JoinHostPort(client, "50000"), net.JoinHostPort("192.168.1.10", strconv.Itoa(port)), start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+				t.Fatal(err)
+			}
+			conv.XorClient(testXorSettings(), testSeed)
+			if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(c)})); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sn, sink := runPipeline(t, testConfig(), ms)
+	list := sn.sessions.list(time.Time{})
+	if len(list) != len(clients) {
+		t.Fatalf("%v sessions, expected %v: %+v", len(list), len(clients), list)
+	}
+	byClient := make(map[string]Session)
+	for _, s := range list {
+		byClient[s.ClientIP] = s
+		if len(s.Flows) != len(ports) {
+			t.Errorf("session of %v has %v flows, expected %v", s.ClientIP, len(s.Flows), len(ports))
+		}
+		for _, f := range s.Flows {
+			if f.Completed.IsZero() {
+				t.Errorf("flow %v of %v isn't completed", f.FlowName, s.ClientIP)
+			}
+		}
+	}
+	for _, pe := range sink.byDirection() {
+		if pe.Packet.Base.OperationCode != opChatReq {
+			continue
+		}
+		client := clients[pe.Packet.Base.Data[0]]
+		if s, ok := byClient[client]; !ok || pe.SessionID != s.ID {
+			t.Errorf("packet %v of %v is in session %v, expected the one of its client", pe.ID, client, pe.SessionID)
+		}
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := sessionStream("login", "192.168.1.20")
+	sessionID := sn.sessions.flowOpened(ss, time.Now())
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/api/sessions", http.StatusOK},
+		{http.MethodGet, "/api/sessions/" + sessionID, http.StatusOK},
+		{http.MethodGet, "/api/sessions/unknown", http.StatusNotFound},
+		{http.MethodPost, "/api/sessions", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		sn.sessionsHandler(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%v %v: status %v, expected %v", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	sn.sessionsHandler(w, httptest.NewRequest(http.MethodGet, "/api/sessions/"+sessionID, nil))
+	var s Session
+	if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != sessionID || len(s.Flows) != 1 || s.Flows[0].FlowID != "login" {
+		t.Errorf("got %+v, expected the session of flow login", s)
+	}
+}
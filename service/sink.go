@@ -0,0 +1,49 @@
+package service
+
+// Sink receives every decoded packet that passes the filters, like the broker, sqlite and grpc outputs do
+// a new output only has to implement it and be added with AddSink, the decoders and workers don't change
+type Sink interface {
+	// called by the stream workers, concurrently with more than one protocol.workers, it must not block them
+	Publish(pe PacketEvent)
+	// called once when the Sniffer stops, after every stream was drained
+	Close()
+}
+
+// add a sink before Start, sinks get the packets in the order they were added, before the Handler
+func (sn *Sniffer) AddSink(s Sink) {
+	sn.sinks = append(sn.sinks, s)
+}
+
+// the packets of a stream written to its jsonl file, see Config.JSONOutput
+// every stream opens and closes its own file, so there is nothing to close here
+type flowOutputSink struct{}
+
+func (flowOutputSink) Publish(pe PacketEvent) {
+	if pe.stream != nil && pe.stream.output != nil {
+		pe.stream.output.write(pe)
+	}
+}
+
+func (flowOutputSink) Close() {}
+
+// the packets of a stream written to its log file, see Config.PerFlowLogs
+type flowLogSink struct{}
+
+func (flowLogSink) Publish(pe PacketEvent) {
+	if pe.stream != nil && pe.stream.flowLog != nil {
+		pe.stream.flowLog.packet(pe)
+	}
+}
+
+func (flowLogSink) Close() {}
+
+// the last packets of a stream kept for the websocket clients that connect later, see Config.HistorySize
+type historySink struct{}
+
+func (historySink) Publish(pe PacketEvent) {
+	if pe.stream != nil && pe.stream.history != nil {
+		pe.stream.history.add(pe)
+	}
+}
+
+func (historySink) Close() {}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink is an output added with AddSink, it keeps what it got and checks nothing comes after Close
+type recordingSink struct {
+	eventSink
+	closed int
+	late   int
+	mu     sync.Mutex
+}
+
+func (rs *recordingSink) Publish(pe PacketEvent) {
+	rs.mu.Lock()
+	if rs.closed > 0 {
+		rs.late++
+	}
+	rs.mu.Unlock()
+	rs.handle(pe)
+}
+
+func (rs *recordingSink) Close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.closed++
+}
+
+// an output only implements Sink, it gets the packets of the golden handshake like the Handler does
+func TestSinkGetsEveryPacket(t *testing.T) {
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks := []*recordingSink{{}, {}}
+	for _, s := range sinks {
+		sn.AddSink(s)
+	}
+	handled := &eventSink{}
+	sn.Handler = handled.handle
+	sn.Source = ms
+	if err := sn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sn.Done():
+	case <-time.After(testPipelineWait):
+		t.Fatalf("the capture didn't end within %v", testPipelineWait)
+	}
+	sn.Stop()
+
+	checkGolden(t, "handshake.golden", goldenLines(handled.byDirection()))
+	for i, s := range sinks {
+		if got := goldenLines(s.byDirection()); got != goldenLines(handled.byDirection()) {
+			t.Errorf("sink %v got\n%vthe handler got\n%v", i, got, goldenLines(handled.byDirection()))
+		}
+		if s.closed != 1 || s.late != 0 {
+			t.Errorf("sink %v closed %v times, %v packets after Close", i, s.closed, s.late)
+		}
+	}
+}
+
+// the addresses are anonymized once before the sinks, the jsonl output and the flow logs are sinks like any other
+func TestSinksGetAnonymizedPackets(t *testing.T) {
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "handshake.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := loadAnonymizer(filepath.Join(t.TempDir(), "pseudonyms.json"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig()
+	c.JSONOutput = true
+	c.PerFlowLogs = true
+	c.HistorySize = 10
+	c.session = &session{dir: t.TempDir(), anonymous: a}
+	sn, err := NewSniffer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &recordingSink{}
+	sn.AddSink(rs)
+	sn.Source = ms
+	if err := sn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sn.Done():
+	case <-time.After(testPipelineWait):
+		t.Fatalf("the capture didn't end within %v", testPipelineWait)
+	}
+	sn.Stop()
+
+	events := rs.byDirection()
+	if len(events) == 0 {
+		t.Fatal("the sink got no packets")
+	}
+	for _, pe := range events {
+		client, server := pe.Src, pe.Dst
+		if pe.Direction == "inbound" {
+			client, server = server, client
+		}
+		if client != "client-1:50000" || server != "server-1:9010" {
+			t.Errorf("%v: client %v server %v, expected client-1:50000 and server-1:9010", pe.ID, client, server)
+		}
+		if pv := packetView(pe, 0); pv.IPEndpoints != "client-1->server-1" {
+			t.Errorf("%v: ip endpoints %v", pe.ID, pv.IPEndpoints)
+		}
+	}
+
+	for _, pattern := range []string{"*.jsonl", "*.log"} {
+		files, err := filepath.Glob(filepath.Join(c.session.dir, pattern))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("%v files %v %v", pattern, files, err)
+		}
+		b, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a pseudonym anonymized again would be a host
+		out := string(b)
+		if !strings.Contains(out, "client-1:50000") || strings.Contains(out, "192.168.1.") || strings.Contains(out, "host-") {
+			t.Errorf("%v isn't anonymized once\n%v", files[0], out)
+		}
+	}
+}
@@ -0,0 +1,991 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+	"github.com/shine-o/shine.engine.core/networking"
+	"github.com/spf13/viper"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captures whole packets, anything lower risks truncating tcp payloads
+const defaultSnaplen = 65535
+
+// Config holds everything a Sniffer needs to capture and decode shine traffic
+type Config struct {
+	// live capture interface, ignored if PcapFile is set
+	Interface string
+	PcapFile  string
+	// wait between the packets of PcapFile as long as the capture did, divided by PcapPace, 0 reads it as fast as possible
+	// waits are at most PcapPaceMaxGap
+	PcapPace       float64
+	PcapPaceMaxGap time.Duration
+	// capture on all of these interfaces at once instead of Interface, with BestEffort the ones that can't be opened are skipped
+	Interfaces []string
+	BestEffort bool
+	// bytes captured per packet, defaults to 65535 if not set
+	Snaplen int
+	// pcap or afpacket, pcap files are always read with pcap
+	Backend string
+	// size of the af_packet ring and how long the kernel waits before handing over a block that isn't full
+	AFPacketRingMB       int
+	AFPacketBlockTimeout time.Duration
+	// how often the kernel drop counters are logged, 0 disables it
+	StatsInterval time.Duration
+	// bpf filter applied to the capture handle
+	Filter string
+	// open the live capture again, with a backoff, until its interface exists and is up instead of failing
+	WaitForInterface bool
+	// only streams from or to these clients are decoded, any client if empty
+	ClientNets []*net.IPNet
+	// packets captured on the server side are not xored
+	ServerSideCapture bool
+	// port => service name, e.g 9010 => login
+	Services map[int]string
+	// udp ports whose datagrams are shown as hex, e.g latency pings, and how long their flows live without a datagram
+	UDPServices    map[int]string
+	UDPIdleTimeout time.Duration
+	// discard streams that don't belong to a known service
+	StrictServices bool
+	// register the zones announced by the world manager as ZoneDynamic-<port>
+	DiscoverZones bool
+	// used to guess which side is the server when neither port is a known service
+	PortRangeStart int
+	PortRangeEnd   int
+	XorKey         []byte
+	XorLimit       uint16
+	// services whose streams use their own xor key, by port
+	ServiceXor map[int]XorSettings
+	// where the server hands the xor offset to the client, see xorSeed
+	XorKeyOpCode    uint16
+	XorKeyOffset    int
+	XorKeyHeuristic bool
+	// newer server builds xor the server stream too, false, true or auto, see serverXorMode
+	ServerXor string
+	// offset the server stream is xored from, -1 to read it at ServerXorKeyOffset of the seed packet
+	ServerXorSeed      int
+	ServerXorKeyOffset int
+	// guess the xor offset of client streams whose seed packet was missed
+	XorBruteForce         bool
+	XorBruteForceSegments int
+	// how often the xor offsets of live client connections are written to xorstate.json, 0 disables it
+	// entries not updated for XorStateExpiry are not resumed
+	XorStateInterval time.Duration
+	XorStateExpiry   time.Duration
+	// a decoder receiving segments without decoding a packet for this long is reset, 0 disables the watchdog
+	DecoderWatchdog time.Duration
+	// path to the commands file used to name operation codes
+	CommandsFile string
+	// path to the schema file describing packet payloads, see loadSchema, empty if there's none
+	SchemaFile string
+	// client versions with a commands file and xor settings of their own, see ProtocolVersion, told apart by the key
+	// in the version check at VersionOpCode, the first packet a client sends
+	Versions      []ProtocolVersion
+	VersionOpCode uint16
+	// operation codes or command names, see opCodeFilter
+	Include []string
+	Exclude []string
+	// fraction of the packets of an operation code or command name that are handed to the Handler, see packetSampling
+	Sampling map[string]float64
+	// hand decoded client and server packets to the Handler
+	LogClient bool
+	LogServer bool
+	// drop packets a stream decoded already within DedupWindow, DedupSize packets are remembered per stream
+	Dedup       bool
+	DedupWindow time.Duration
+	DedupSize   int
+	// workers handling the decoded packets of each stream
+	Workers int
+	// reassembled segments buffered per direction of a stream and what to do when a decoder falls behind:
+	// block, drop-oldest or drop-newest
+	SegmentQueueSize int
+	ClientOverflow   string
+	ServerOverflow   string
+	// streams without data for this long are flushed and closed, 0 disables it
+	FlushInterval time.Duration
+	// pages of out of order data the assembler buffers in total and per connection, a page holds up to 1900 bytes
+	// of a segment, past them it stops waiting for the missing data and skips ahead, 0 means no limit
+	MaxBufferedPages   int
+	MaxConnectionPages int
+	// write the decoded packets of each stream to <flowName>-<flowID>.jsonl in the session directory
+	JSONOutput bool
+	// write the packet lines and the warnings of each stream to <flowName>-<flowID>.log in the session directory,
+	// with the struct and a hex dump under each packet line if LogVerbose is set
+	PerFlowLogs bool
+	LogVerbose  bool
+	// write every captured packet to rotating pcap files in the session directory
+	SavePackets  bool
+	PcapRotateMB int
+	// write the packets of each stream, client ones xored back to plain text, to <flowName>-<flowID>-decrypted.pcap
+	DecryptedPcap bool
+	// write a row per packet to timing.csv in the session directory, with the time since the previous packet of its stream and
+	// of its operation code, the summaries get the percentiles of the latter
+	TimingCSV bool
+	// the summaries get the entropy and printable share of the payloads of every operation code, see PayloadStats
+	Entropy bool
+	// stop capturing after this long, 0 means no limit
+	// when reading a pcap file it is measured with the capture timestamps
+	Duration time.Duration
+	// stop capturing after this many tcp packets, 0 means no limit
+	MaxPackets int
+	// decoded packets kept per stream to be replayed to late UI clients, 0 disables it
+	HistorySize int
+	// payload bytes written per packet to the json lines output and sent to the UI, 0 sends them whole
+	// the history and the sqlite database keep whole payloads, see GET /api/packets/{id}/payload
+	MaxPayloadBytes int
+	// GET /healthz reports whether packets were read within HealthWindow, and fails if none were and HealthRequirePackets is set
+	HealthWindow         time.Duration
+	HealthRequirePackets bool
+	// operation code counts per second are kept this long for GET /api/heatmap, 0 keeps them all
+	HeatmapRetention time.Duration
+	// publish every decoded packet to a message broker
+	Broker BrokerConfig
+	// bulk index every decoded packet into elasticsearch or opensearch
+	Elasticsearch ElasticsearchConfig
+	// store flows and decoded packets in this sqlite database, empty disables it
+	SQLitePath string
+	// stream decoded packets to snifferpb.SnifferService clients on this address, empty disables it
+	GRPCAddress string
+	// packets queued per grpc subscriber before they are dropped
+	GRPCQueueSize int
+	// request and response operation codes whose latency is measured, written to latency.csv in the session directory
+	LatencyPairs []LatencyPair
+	// requests without a response after this long are counted as unmatched
+	LatencyTimeout time.Duration
+	// operation codes whose payload is decompressed before it is unpacked, see CompressedOpCode
+	CompressedOpCodes []CompressedOpCode
+	// mask the credentials of the built in rules and of RedactRules in every output, see RedactRule
+	Redact      bool
+	RedactRules []RedactRule
+	// a client's session closes once all of its flows completed and none opened for this long
+	SessionIdleTimeout time.Duration
+	// operation codes or command names marked on the timeline of their session
+	TimelineOpCodes []string
+	// write the reassembled bytes of each stream to <flowName>-<flowID>.raw, see rawTap, refused unless Redact is off
+	RawTap bool
+	// decode the streams too, off with RawTap only writes the raw files
+	RawTapDecode bool
+	// rules evaluated on every handled packet and decode error, see AlertRule
+	AlertRules []AlertRule
+	// alerts are posted here as json if set
+	AlertWebhook string
+	// serve POST /api/inject, which writes crafted packets into live connections, see injector
+	Injection bool
+
+	// where the files are written and the pseudonyms of the addresses, nil writes to outputDir as they are
+	session *session
+}
+
+// PacketEvent is a decoded packet as handed to the Sniffer's Handler
+type PacketEvent struct {
+	// unique, the flow id followed by where the packet starts in the stream of its direction, so decoding the same
+	// capture again gives the packet the same id, the packets in the history and the packet store can be looked up with it
+	ID string
+	// the number of the packet in its direction of the flow, in the order it was decoded, starting from 1
+	// the same every time a capture is decoded, the client and the server packets are numbered apart
+	Seq            uint64
+	FlowID         string
+	FlowName       string
+	SessionID      string
+	Net, Transport gopacket.Flow
+	Seen           time.Time
+	Direction      string
+	Packet         *networking.Command
+	// host:port of the side that sent the packet and of the one it was sent to, anonymized before the sinks get them
+	Src, Dst string
+	// json of the struct registered for the operation code, empty if the payload couldn't be unpacked
+	Decoded string
+	// byte ranges of the unpacked struct fields, if they could be worked out
+	Fields []Field
+	// what earlier packets of the flow tell about this one, e.g {"handle": "8012", "character": "Tarian"}
+	Context map[string]string
+	// sizes of the payload as captured and once decompressed, 0 unless protocol.compressedOpcodes decompressed it
+	CompressedSize   int
+	DecompressedSize int
+	// the stream the packet was decoded from, for the sinks that write to a file per flow
+	stream *shineStream
+}
+
+// Sniffer captures packets, reassembles the shine streams and decodes them
+// everything it decodes with and writes to is its own, so several can run side by side in one process
+type Sniffer struct {
+	// called by the stream workers for every decoded packet that passes the filters
+	Handler func(PacketEvent)
+	// read packets from here instead of the backend in network.backend, if set before Start
+	Source PacketSourceProvider
+
+	config Config
+	// the command names and the schema of the Config
+	protocol *protocol
+	// where the outputs are written, see Config.Session
+	session *session
+	// the clients of the UI and their http server
+	ws           *webSockets
+	ui           *http.Server
+	metrics      *snifferMetrics
+	services     *shineServices
+	streams      *shineStreams
+	sessions     *sessions
+	heatmap      *opCodeHeatmap
+	liveSettings liveConfig
+	sinks        []Sink
+	store        *packetStore
+	latencyOut   *latencyOutput
+	timing       *packetTiming
+	entropy      *payloadEntropy
+	xorState     *xorState
+	grpc         *grpcServer
+	factory      *shineStreamFactory
+	stopCapture  context.CancelFunc
+	cancel       context.CancelFunc
+	done         chan struct{}
+	stopOnce     sync.Once
+	started      time.Time
+	captured     uint64
+	decoded      uint64
+	// unix nanoseconds of the last packet read from the source, for the health check
+	lastPacket int64
+	// packets not forwarded while paused, see Pause
+	suppressed uint64
+	paused     uint32
+	// overflow policies of the client and server segment queues
+	clientOverflow overflowPolicy
+	serverOverflow overflowPolicy
+	// from protocol.serverXor
+	serverXor serverXorMode
+	// by operation code, from protocol.compressedOpcodes
+	decompressors map[uint16]decompressor
+	// by operation code, nil if output.redact.enabled is off
+	redactRules map[uint16]RedactRule
+	// nil without protocol.versions
+	versions *protocolVersions
+	// nil without protocol.udpServices
+	udp *udpFlows
+	// nil without alerts.rules
+	alerts *alerts
+	// nil unless injection.enabled is set on a live capture
+	injector *injector
+	// set while the assembler handles a packet, a gap it reports meanwhile means out of order data was given up on because
+	// of the page limits, only used by the capture goroutine, which the assembler calls the streams from
+	assembling bool
+}
+
+// read the sniffer configuration from the viper keys documented in config/.sniffer.yml
+func ConfigFromViper() (Config, error) {
+	c := Config{
+		Interface:             viper.GetString("network.interface"),
+		PcapFile:              viper.GetString("network.pcapFile"),
+		PcapPace:              viper.GetFloat64("network.pcapPace"),
+		PcapPaceMaxGap:        viper.GetDuration("network.pcapPaceMaxGap"),
+		Interfaces:            viper.GetStringSlice("network.interfaces"),
+		BestEffort:            viper.GetBool("network.bestEffort"),
+		Snaplen:               viper.GetInt("network.snaplen"),
+		Backend:               viper.GetString("network.backend"),
+		AFPacketRingMB:        viper.GetInt("network.afpacket.ringSizeMB"),
+		AFPacketBlockTimeout:  viper.GetDuration("network.afpacket.blockTimeout"),
+		StatsInterval:         viper.GetDuration("network.statsInterval"),
+		WaitForInterface:      viper.GetBool("network.waitForInterface"),
+		ServerSideCapture:     viper.GetBool("network.serverSideCapture"),
+		Services:              make(map[int]string),
+		ServiceXor:            make(map[int]XorSettings),
+		StrictServices:        viper.GetBool("protocol.strictServices"),
+		DiscoverZones:         viper.GetBool("protocol.discoverZones"),
+		PortRangeStart:        viper.GetInt("network.portRange.start"),
+		PortRangeEnd:          viper.GetInt("network.portRange.end"),
+		XorBruteForce:         viper.GetBool("protocol.xorBruteForce"),
+		XorBruteForceSegments: viper.GetInt("protocol.xorBruteForceSegments"),
+		XorStateInterval:      viper.GetDuration("protocol.xorState.interval"),
+		XorStateExpiry:        viper.GetDuration("protocol.xorState.expiry"),
+		DecoderWatchdog:       viper.GetDuration("protocol.decoderWatchdog"),
+		Include:               viper.GetStringSlice("protocol.filters.include"),
+		Exclude:               viper.GetStringSlice("protocol.filters.exclude"),
+		LogClient:             viper.GetBool("protocol.log.client"),
+		LogServer:             viper.GetBool("protocol.log.server"),
+		Workers:               viper.GetInt("protocol.workers"),
+		Dedup:                 viper.GetBool("protocol.dedup.enabled"),
+		DedupWindow:           viper.GetDuration("protocol.dedup.window"),
+		DedupSize:             viper.GetInt("protocol.dedup.size"),
+		SegmentQueueSize:      viper.GetInt("network.segmentQueue.size"),
+		ClientOverflow:        viper.GetString("network.segmentQueue.clientOverflow"),
+		ServerOverflow:        viper.GetString("network.segmentQueue.serverOverflow"),
+		FlushInterval:         viper.GetDuration("network.flushInterval"),
+		MaxBufferedPages:      viper.GetInt("network.assembler.maxBufferedPagesTotal"),
+		MaxConnectionPages:    viper.GetInt("network.assembler.maxBufferedPagesPerConnection"),
+		JSONOutput:            viper.GetBool("protocol.log.jsonOutput"),
+		PerFlowLogs:           viper.GetBool("protocol.log.perFlowFiles"),
+		LogVerbose:            viper.GetBool("protocol.log.verbose"),
+		SavePackets:           viper.GetBool("network.savePackets"),
+		PcapRotateMB:          viper.GetInt("network.pcapRotateMB"),
+		DecryptedPcap:         viper.GetBool("output.decryptedPcap"),
+		TimingCSV:             viper.GetBool("output.timing.csv"),
+		Entropy:               viper.GetBool("output.entropy"),
+		Duration:              viper.GetDuration("network.duration"),
+		MaxPackets:            viper.GetInt("network.maxPackets"),
+		HistorySize:           viper.GetInt("ui.historySize"),
+		MaxPayloadBytes:       viper.GetInt("output.maxPayloadBytes"),
+		Redact:                viper.GetBool("output.redact.enabled"),
+		HealthWindow:          viper.GetDuration("ui.health.window"),
+		HealthRequirePackets:  viper.GetBool("ui.health.requirePackets"),
+		HeatmapRetention:      viper.GetDuration("ui.heatmap.retention"),
+		Broker: BrokerConfig{
+			Type:      viper.GetString("output.broker.type"),
+			Address:   viper.GetString("output.broker.address"),
+			Topic:     viper.GetString("output.broker.topic"),
+			QueueSize: viper.GetInt("output.broker.queueSize"),
+		},
+		Elasticsearch: ElasticsearchConfig{
+			URL:           viper.GetString("output.elasticsearch.url"),
+			IndexPrefix:   viper.GetString("output.elasticsearch.indexPrefix"),
+			BatchSize:     viper.GetInt("output.elasticsearch.batchSize"),
+			FlushInterval: viper.GetDuration("output.elasticsearch.flushInterval"),
+			QueueSize:     viper.GetInt("output.elasticsearch.queueSize"),
+		},
+		SQLitePath:         viper.GetString("output.sqlite.path"),
+		GRPCAddress:        viper.GetString("output.grpc.address"),
+		GRPCQueueSize:      viper.GetInt("output.grpc.queueSize"),
+		LatencyTimeout:     viper.GetDuration("protocol.latencyTimeout"),
+		SessionIdleTimeout: viper.GetDuration("protocol.sessionIdleTimeout"),
+		TimelineOpCodes:    viper.GetStringSlice("protocol.timelineOpcodes"),
+		RawTap:             viper.GetBool("output.rawTap.enabled"),
+		RawTapDecode:       viper.GetBool("output.rawTap.decode"),
+		AlertWebhook:       viper.GetString("alerts.webhook"),
+		Injection:          viper.GetBool("injection.enabled"),
+	}
+
+	if err := viper.UnmarshalKey("alerts.rules", &c.AlertRules); err != nil {
+		return c, fmt.Errorf("alerts.rules: %v", err)
+	}
+
+	if err := viper.UnmarshalKey("protocol.latencyPairs", &c.LatencyPairs); err != nil {
+		return c, fmt.Errorf("protocol.latencyPairs: %v", err)
+	}
+
+	if err := viper.UnmarshalKey("protocol.compressedOpcodes", &c.CompressedOpCodes); err != nil {
+		return c, fmt.Errorf("protocol.compressedOpcodes: %v", err)
+	}
+
+	if err := viper.UnmarshalKey("output.redact.rules", &c.RedactRules); err != nil {
+		return c, fmt.Errorf("output.redact.rules: %v", err)
+	}
+
+	if err := viper.UnmarshalKey("protocol.sampling", &c.Sampling); err != nil {
+		return c, fmt.Errorf("protocol.sampling: %v", err)
+	}
+
+	udpServices, err := udpServicesFromViper(viper.GetStringMap("protocol.udpServices"))
+	if err != nil {
+		return c, err
+	}
+	c.UDPServices = udpServices
+	c.UDPIdleTimeout = viper.GetDuration("protocol.udpIdleTimeout")
+
+	filter, err := buildFilter()
+	if err != nil {
+		return c, err
+	}
+	c.Filter = filter
+
+	clients, err := clientNets(viper.GetStringSlice("network.clientIP"))
+	if err != nil {
+		return c, err
+	}
+	c.ClientNets = clients
+
+	xorKey, err := hex.DecodeString(viper.GetString("protocol.xorKey"))
+	if err != nil {
+		return c, fmt.Errorf("protocol.xorKey: %v", err)
+	}
+	c.XorKey = xorKey
+
+	// the commands file isn't loaded yet, so the operation codes of the config are numbers
+	var commands *commandRegistry
+	c.XorKeyOpCode, err = commands.parse(viper.GetString("protocol.xorKeyOpcode"))
+	if err != nil {
+		return c, fmt.Errorf("protocol.xorKeyOpcode: %v", err)
+	}
+	c.XorKeyOffset = viper.GetInt("protocol.xorKeyOffset")
+	c.XorKeyHeuristic = viper.GetBool("protocol.xorKeyHeuristic")
+	c.ServerXor = viper.GetString("protocol.serverXor")
+	c.ServerXorSeed = viper.GetInt("protocol.serverXorSeed")
+	c.ServerXorKeyOffset = viper.GetInt("protocol.serverXorKeyOffset")
+
+	limit, err := strconv.Atoi(viper.GetString("protocol.xorLimit"))
+	if err != nil {
+		return c, fmt.Errorf("protocol.xorLimit: %v", err)
+	}
+	c.XorLimit = uint16(limit)
+
+	// services come after the global xor settings, which they default to
+	for name := range viper.GetStringMap("protocol.services") {
+		key := fmt.Sprintf("protocol.services.%v", name)
+		// a service is either a port or a port with its own xor settings
+		if !viper.IsSet(key + ".port") {
+			c.Services[viper.GetInt(key)] = name
+			continue
+		}
+		port := viper.GetInt(key + ".port")
+		c.Services[port] = name
+		if !viper.IsSet(key+".xorKey") && !viper.IsSet(key+".xorLimit") {
+			continue
+		}
+		xs := XorSettings{Key: c.XorKey, Limit: c.XorLimit}
+		if viper.IsSet(key + ".xorKey") {
+			k, err := hex.DecodeString(viper.GetString(key + ".xorKey"))
+			if err != nil {
+				return c, fmt.Errorf("%v.xorKey: %v", key, err)
+			}
+			xs.Key = k
+		}
+		if viper.IsSet(key + ".xorLimit") {
+			xs.Limit = uint16(viper.GetInt(key + ".xorLimit"))
+		}
+		c.ServiceXor[port] = xs
+	}
+
+	path, err := filepath.Abs(viper.GetString("protocol.commands"))
+	if err != nil {
+		return c, fmt.Errorf("protocol.commands: %v", err)
+	}
+	c.CommandsFile = path
+
+	if schema := viper.GetString("protocol.schema"); schema != "" {
+		path, err := filepath.Abs(schema)
+		if err != nil {
+			return c, fmt.Errorf("protocol.schema: %v", err)
+		}
+		c.SchemaFile = path
+	}
+
+	if err := viper.UnmarshalKey("protocol.versions", &c.Versions); err != nil {
+		return c, fmt.Errorf("protocol.versions: %v", err)
+	}
+	for i := range c.Versions {
+		if c.Versions[i].Commands == "" {
+			continue
+		}
+		path, err := filepath.Abs(c.Versions[i].Commands)
+		if err != nil {
+			return c, fmt.Errorf("protocol.versions[%v].commands: %v", i, err)
+		}
+		c.Versions[i].Commands = path
+	}
+	c.VersionOpCode, err = commands.parse(viper.GetString("protocol.versionOpcode"))
+	if err != nil {
+		return c, fmt.Errorf("protocol.versionOpcode: %v", err)
+	}
+
+	return c, nil
+}
+
+func NewSniffer(c Config) (*Sniffer, error) {
+	if c.Workers < 1 {
+		c.Workers = 1
+	}
+	if c.Snaplen <= 0 {
+		c.Snaplen = defaultSnaplen
+	}
+	if c.SegmentQueueSize < 1 {
+		c.SegmentQueueSize = defaultSegmentQueueSize
+	}
+	if c.PcapPace < 0 {
+		return nil, fmt.Errorf("network.pcapPace: %v, expected 0 to read as fast as possible or a speed above 0", c.PcapPace)
+	}
+	clientOverflow, err := parseOverflowPolicy(c.ClientOverflow)
+	if err != nil {
+		return nil, fmt.Errorf("network.segmentQueue.clientOverflow: %v", err)
+	}
+	serverOverflow, err := parseOverflowPolicy(c.ServerOverflow)
+	if err != nil {
+		return nil, fmt.Errorf("network.segmentQueue.serverOverflow: %v", err)
+	}
+	serverXor, err := parseServerXorMode(c.ServerXor)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.serverXor: %v", err)
+	}
+	if c.ServerXorSeed > 0xffff {
+		return nil, fmt.Errorf("protocol.serverXorSeed: %v doesn't fit an xor offset", c.ServerXorSeed)
+	}
+	if serverXor != serverXorOff && c.ServerSideCapture {
+		log.Warning("protocol.serverXor is ignored with network.serverSideCapture, streams are not xored")
+		serverXor = serverXorOff
+	}
+
+	p := loadProtocol(c.CommandsFile, c.SchemaFile)
+	metrics, ws := newSnifferMetrics(), newWebSockets()
+
+	f, err := newOpCodeFilter(p, c.Include, c.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	sampling, err := newPacketSampling(p, c.Sampling)
+	if err != nil {
+		return nil, err
+	}
+
+	timelineOpCodes, err := p.opCodeSet(c.TimelineOpCodes)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.timelineOpcodes: %v", err)
+	}
+
+	alerts, err := newAlerts(p, ws, c.AlertRules, c.AlertWebhook)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateLatencyPairs(c.LatencyPairs); err != nil {
+		return nil, err
+	}
+
+	decompressors, err := newDecompressors(c.CompressedOpCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the raw files are the bytes as captured, masking them would need the decoders the raw tap is there to bypass
+	if c.RawTap && c.Redact {
+		return nil, fmt.Errorf("output.rawTap.enabled writes passwords and login tokens as they are, it needs output.redact.enabled: false (--no-redact)")
+	}
+
+	var redactRules map[uint16]RedactRule
+	if c.Redact {
+		redactRules, err = newRedactRules(c.RedactRules)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Warning("output.redact.enabled is off, passwords and login tokens are written as they are to every output")
+	}
+
+	// client streams are xored unless captured on the server side
+	if !c.ServerSideCapture {
+		if err := (XorSettings{Key: c.XorKey, Limit: c.XorLimit}).validate(); err != nil {
+			return nil, fmt.Errorf("protocol.xorLimit: %v", err)
+		}
+		for port, xs := range c.ServiceXor {
+			if err := xs.validate(); err != nil {
+				return nil, fmt.Errorf("service on port %v: %v", port, err)
+			}
+		}
+	}
+
+	versions, err := newProtocolVersions(c.Versions, c.VersionOpCode, c.ServerSideCapture)
+	if err != nil {
+		return nil, err
+	}
+
+	broker, err := newPublisher(c.Broker, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	sn := &Sniffer{
+		config:   c,
+		protocol: p,
+		session:  c.session,
+		ws:       ws,
+		ui:       &http.Server{},
+		metrics:  metrics,
+		services: newShineServices(c),
+		streams:  &shineStreams{streams: make(map[string]*shineStream), finished: make(map[string]*FlowSummary)},
+		sessions: newSessions(c.SessionIdleTimeout, timelineOpCodes, c.session.anonymizer()),
+		heatmap:  newOpCodeHeatmap(c.HeatmapRetention),
+		liveSettings: liveConfig{settings: liveSettings{
+			filter:        f,
+			logClient:     c.LogClient,
+			logServer:     c.LogServer,
+			discoverZones: c.DiscoverZones,
+			sampling:      sampling,
+		}},
+		clientOverflow: clientOverflow,
+		serverOverflow: serverOverflow,
+		serverXor:      serverXor,
+		decompressors:  decompressors,
+		redactRules:    redactRules,
+		versions:       versions,
+		alerts:         alerts,
+		entropy:        newPayloadEntropy(c.Entropy),
+		udp:            newUDPFlows(c.UDPServices, c.UDPIdleTimeout, ws, c.session.anonymizer()),
+		done:           make(chan struct{}),
+	}
+
+	// the outputs of every stream first, as they were written before the other sinks
+	if c.JSONOutput {
+		sn.AddSink(flowOutputSink{})
+	}
+	if c.PerFlowLogs {
+		sn.AddSink(flowLogSink{})
+	}
+	if c.HistorySize > 0 {
+		sn.AddSink(historySink{})
+	}
+
+	if broker != nil {
+		sn.AddSink(broker)
+	}
+
+	es, err := newElasticsearchIndexer(c.Elasticsearch, metrics)
+	if err != nil {
+		sn.closeOutputs()
+		return nil, err
+	}
+	if es != nil {
+		sn.AddSink(es)
+	}
+
+	if c.SQLitePath != "" {
+		store, err := openPacketStore(c.SQLitePath, c.session, metrics)
+		if err != nil {
+			sn.closeOutputs()
+			return nil, err
+		}
+		sn.store = store
+		sn.AddSink(store)
+	}
+
+	if len(c.LatencyPairs) > 0 {
+		lo, err := newLatencyOutput(c.session)
+		if err != nil {
+			sn.closeOutputs()
+			return nil, err
+		}
+		sn.latencyOut = lo
+	}
+
+	if c.TimingCSV {
+		pt, err := newPacketTiming(c.session)
+		if err != nil {
+			sn.closeOutputs()
+			return nil, err
+		}
+		sn.timing = pt
+	}
+
+	if c.GRPCAddress != "" {
+		sn.grpc = newGRPCServer(c.GRPCQueueSize, metrics)
+		sn.AddSink(sn.grpc)
+	}
+
+	// pcap files and server side captures have nothing to resume
+	if c.XorStateInterval > 0 && c.PcapFile == "" && !c.ServerSideCapture {
+		xs, err := loadXorState(filepath.Join(outputDir, xorStateFile), c.XorStateExpiry)
+		if err != nil {
+			log.Warningf("ignoring %v: %v", xorStateFile, err)
+			xs = &xorState{
+				path:    filepath.Join(outputDir, xorStateFile),
+				expiry:  c.XorStateExpiry,
+				entries: make(map[string]xorStateEntry),
+			}
+		}
+		sn.xorState = xs
+	}
+	return sn, nil
+}
+
+// open the capture handle and start capturing in the background
+// decoded packets are handed to the Handler until Stop is called or, when reading a pcap file, the file ends
+func (sn *Sniffer) Start(ctx context.Context) error {
+	// only the interface the packets are captured on can be written to
+	live := sn.Source == nil && sn.config.PcapFile == ""
+	if sn.Source == nil {
+		source, err := openPacketSource(ctx, sn.config)
+		if err != nil {
+			return err
+		}
+		log.Infof("using bpf filter %v", sn.config.Filter)
+		sn.Source = source
+	}
+
+	if sn.config.Injection {
+		if !live {
+			log.Warning("injection.enabled is ignored, packets aren't captured live")
+		} else {
+			inj, err := openInjector(sn.config)
+			if err != nil {
+				sn.Source.Close()
+				return err
+			}
+			sn.injector = inj
+			log.Warningf("INJECTION IS ENABLED: POST /api/inject writes packets into live connections on %v, only use it against servers you run", inj.iface)
+		}
+	}
+
+	if sn.grpc != nil {
+		if err := sn.grpc.listen(sn.config.GRPCAddress); err != nil {
+			sn.Source.Close()
+			sn.injector.close()
+			return fmt.Errorf("output.grpc.address: %v", err)
+		}
+	}
+	sn.started = time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	sn.cancel = cancel
+
+	sn.factory = &shineStreamFactory{
+		shineContext: ctx,
+		sniffer:      sn,
+	}
+
+	sp := reassembly.NewStreamPool(sn.factory)
+	a := reassembly.NewAssembler(sp)
+	a.MaxBufferedPagesTotal = sn.config.MaxBufferedPages
+	a.MaxBufferedPagesPerConnection = sn.config.MaxConnectionPages
+
+	captureCtx, stopCapture := context.WithCancel(ctx)
+	sn.stopCapture = stopCapture
+
+	if sn.xorState != nil {
+		go sn.xorState.savePeriodically(ctx, sn.config.XorStateInterval)
+	}
+
+	if sn.config.DecoderWatchdog > 0 {
+		go sn.watchDecoders(ctx, sn.config.DecoderWatchdog)
+	}
+
+	go func() {
+		defer close(sn.done)
+		defer sn.Source.Close()
+		defer sn.injector.close()
+		sn.capturePackets(captureCtx, a)
+	}()
+	return nil
+}
+
+// closed once capturing is over: Stop was called, a duration or packet limit was reached or the pcap file was fully read
+func (sn *Sniffer) Done() <-chan struct{} {
+	return sn.done
+}
+
+// stop capturing and wait for the streams to decode what is left in their buffers
+func (sn *Sniffer) Stop() {
+	sn.stopOnce.Do(func() {
+		if sn.stopCapture == nil {
+			sn.closeOutputs()
+			return
+		}
+		sn.stopCapture()
+		<-sn.done
+
+		drained := make(chan bool)
+		go func() {
+			sn.factory.wg.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+			log.Info("all streams were drained")
+		case <-time.After(shutdownTimeout):
+			log.Warningf("streams were not drained after %v, stopping anyway", shutdownTimeout)
+		}
+		sn.cancel()
+		sn.closeOutputs()
+
+		log.Infof("captured %v packets, decoded %v packets in %v", atomic.LoadUint64(&sn.captured), atomic.LoadUint64(&sn.decoded), time.Since(sn.started))
+	})
+}
+
+func (sn *Sniffer) closeOutputs() {
+	for _, s := range sn.sinks {
+		s.Close()
+	}
+	sn.latencyOut.close()
+	sn.timing.close()
+	sn.alerts.close()
+	if err := sn.xorState.save(); err != nil {
+		log.Error(err)
+	}
+}
+
+// captureDrops warns the UI that packets were lost since the last report, streams decoded since may be unreliable
+type captureDrops struct {
+	Dropped   uint64 `json:"dropped"`
+	IfDropped uint64 `json:"if_dropped"`
+}
+
+// log what the kernel received and dropped since the last report and, if packets were dropped, warn about it
+// final logs the totals instead, once the capture is over
+func (sn *Sniffer) reportCaptureStats(final bool) {
+	s, err := sn.Source.Stats()
+	if err == errNoCaptureStats {
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	previous := sn.metrics.captureStats(s)
+	dropped, ifDropped := s.Dropped-previous.Dropped, s.IfDropped-previous.IfDropped
+
+	if dropped > 0 || ifDropped > 0 {
+		log.Warningf("%v packets dropped by the kernel and %v by the interface since the last report, decoding may be unreliable", dropped, ifDropped)
+		sn.ws.broadcast(envelope(wsStats, captureDrops{
+			Dropped:   dropped,
+			IfDropped: ifDropped,
+		}))
+	}
+	if final {
+		log.Infof("capture totals: kernel received %v packets, dropped %v, the interface dropped %v", s.Received, s.Dropped, s.IfDropped)
+		return
+	}
+	log.Infof("kernel received %v packets since the last report, dropped %v, the interface dropped %v", s.Received-previous.Received, dropped, ifDropped)
+}
+
+func (sn *Sniffer) packetDecoded() {
+	atomic.AddUint64(&sn.decoded, 1)
+}
+
+// wait as long as the capture did between two packets of the pcap file, divided by network.pcapPace and at most network.pcapPaceMaxGap
+// only the wait is paced, packets keep their capture timestamps, returns false if the context was canceled meanwhile
+func (sn *Sniffer) paceCapture(ctx context.Context, previous, next time.Time) bool {
+	wait := time.Duration(float64(next.Sub(previous)) / sn.config.PcapPace)
+	if sn.config.PcapPaceMaxGap > 0 && wait > sn.config.PcapPaceMaxGap {
+		wait = sn.config.PcapPaceMaxGap
+	}
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (sn *Sniffer) capturePackets(ctx context.Context, a *reassembly.Assembler) {
+	packets := sn.Source.PacketSource().Packets()
+
+	var raw *rawPackets
+	if sn.config.SavePackets {
+		raw = newRawPackets(sn.session, sn.Source.LinkType(), sn.config.Snaplen, sn.config.PcapRotateMB)
+		defer raw.close()
+	}
+
+	var reportStats <-chan time.Time
+	if sn.config.StatsInterval > 0 && sn.config.PcapFile == "" {
+		t := time.NewTicker(sn.config.StatsInterval)
+		defer t.Stop()
+		reportStats = t.C
+	}
+	defer sn.reportCaptureStats(true)
+
+	flushInterval := sn.config.FlushInterval
+	var flush <-chan time.Time
+	if flushInterval > 0 {
+		t := time.NewTicker(flushInterval)
+		defer t.Stop()
+		flush = t.C
+	}
+
+	// live captures are limited with a timer, so they also stop if no packets arrive
+	var limit <-chan time.Time
+	if sn.config.Duration > 0 && sn.config.PcapFile == "" {
+		t := time.NewTimer(sn.config.Duration)
+		defer t.Stop()
+		limit = t.C
+	}
+
+	// udp flows expire by capture time, so pcap files expire them as the live capture did
+	var expireUDP <-chan time.Time
+	if sn.udp != nil {
+		defer sn.udp.closeAll()
+		if sn.config.UDPIdleTimeout > 0 {
+			t := time.NewTicker(sn.config.UDPIdleTimeout / 2)
+			defer t.Stop()
+			expireUDP = t.C
+		}
+	}
+
+	var firstSeen, lastSeen time.Time
+	pace := sn.config.PcapFile != "" && sn.config.PcapPace > 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Warningf("capture canceled")
+			a.FlushAll()
+			return
+		case <-limit:
+			log.Infof("capture duration of %v reached", sn.config.Duration)
+			a.FlushAll()
+			return
+		case <-reportStats:
+			sn.reportCaptureStats(false)
+		case <-expireUDP:
+			if !lastSeen.IsZero() {
+				sn.udp.expire(lastSeen)
+			}
+		case <-flush:
+			if lastSeen.IsZero() {
+				break
+			}
+			flushed, closed := a.FlushCloseOlderThan(lastSeen.Add(-flushInterval))
+			if closed > 0 {
+				log.Infof("flushed %v and closed %v streams older than %v", flushed, closed, flushInterval)
+			}
+		case packet, ok := <-packets:
+			if !ok {
+				// the packet source only closes the channel once a pcap file has been fully read
+				log.Info("finished reading pcap file")
+				a.FlushAll()
+				return
+			}
+			atomic.StoreInt64(&sn.lastPacket, time.Now().UnixNano())
+			if raw != nil {
+				raw.write(packet.Metadata().CaptureInfo, packet.Data())
+			}
+			if tcp, ok := packet.TransportLayer().(*layers.TCP); ok {
+				c := Context{
+					ci: packet.Metadata().CaptureInfo,
+				}
+				if sn.injector != nil {
+					c.ethernet, _ = packet.LinkLayer().(*layers.Ethernet)
+				}
+				if firstSeen.IsZero() {
+					firstSeen = c.ci.Timestamp
+				}
+				if pace && !lastSeen.IsZero() && !sn.paceCapture(ctx, lastSeen, c.ci.Timestamp) {
+					log.Warningf("capture canceled")
+					a.FlushAll()
+					return
+				}
+				lastSeen = c.ci.Timestamp
+				if sn.config.Duration > 0 && sn.config.PcapFile != "" && lastSeen.Sub(firstSeen) > sn.config.Duration {
+					log.Infof("capture duration of %v reached", sn.config.Duration)
+					a.FlushAll()
+					return
+				}
+				captured := atomic.AddUint64(&sn.captured, 1)
+				sn.metrics.packetCaptured()
+				sn.assembling = true
+				a.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, c)
+				sn.assembling = false
+				if sn.config.MaxPackets > 0 && captured >= uint64(sn.config.MaxPackets) {
+					log.Infof("captured %v packets, stopping", captured)
+					a.FlushAll()
+					return
+				}
+			} else if udp, ok := packet.TransportLayer().(*layers.UDP); ok && sn.udp != nil {
+				// datagrams aren't reassembled, nor counted in network.maxPackets
+				sn.datagram(packet.NetworkLayer().NetworkFlow(), udp, packet.Metadata().CaptureInfo)
+				if ts := packet.Metadata().CaptureInfo.Timestamp; ts.After(lastSeen) {
+					lastSeen = ts
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// two Sniffers in one process decode with their own commands and count into their own metrics and websocket clients
+func TestSniffersSideBySide(t *testing.T) {
+	// NC_USER_LOGIN_ACK under another name
+	renamed := filepath.Join(t.TempDir(), "commands.yml")
+	if err := ioutil.WriteFile(renamed, []byte(`departments:
+    - hexId: 0x3
+      name: NC_USER
+      commands: |-
+        NC_USER_RENAMED_ACK = 0xA
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		commandsFile string
+		// the fixtures replayed, so the captures differ in size
+		fixtures int
+		name     string
+	}{
+		{testConfig().CommandsFile, 1, "NC_USER_LOGIN_ACK"},
+		{renamed, 2, "NC_USER_RENAMED_ACK"},
+	}
+	sniffers := make([]*Sniffer, len(tests))
+	sinks := make([]*eventSink, len(tests))
+	frames := make([]int, len(tests))
+	for i, tt := range tests {
+		ms := NewMemorySource()
+		for j := 0; j < tt.fixtures; j++ {
+			client := fmt.Sprintf("192.168.1.%v:50000", 20+j)
+			conv, err := NewTCPConversation(ms, client, testServerAddr, testStart.Add(time.Duration(j)*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Open(); err != nil {
+				t.Fatal(err)
+			}
+			replayFixture(t, conv, readFixture(t, "handshake.hex"))
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		frames[i] = len(ms.frames)
+
+		c := testConfig()
+		c.CommandsFile = tt.commandsFile
+		c.session = &session{dir: t.TempDir()}
+		sn, err := NewSniffer(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sinks[i] = &eventSink{}
+		sn.Handler = sinks[i].handle
+		sn.Source = ms
+		sniffers[i] = sn
+	}
+
+	_, closeAll := dialPackets(t, sniffers[0])
+	defer closeAll()
+	if n := sniffers[1].ws.count(); n != 0 {
+		t.Errorf("the websocket client of one sniffer is one of the %v clients of the other", n)
+	}
+
+	var wg sync.WaitGroup
+	for _, sn := range sniffers {
+		wg.Add(1)
+		go func(sn *Sniffer) {
+			defer wg.Done()
+			if err := sn.Start(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			select {
+			case <-sn.Done():
+			case <-time.After(testPipelineWait):
+				t.Errorf("the capture didn't end within %v", testPipelineWait)
+			}
+			sn.Stop()
+		}(sn)
+	}
+	wg.Wait()
+
+	for i, tt := range tests {
+		acks := 0
+		for _, pe := range sinks[i].byDirection() {
+			if pe.Packet.Base.OperationCode != opLoginAck {
+				continue
+			}
+			acks++
+			if pe.Packet.Base.ClientStructName != tt.name {
+				t.Errorf("sniffer %v named operation code %v %v, expected %v", i, opLoginAck, pe.Packet.Base.ClientStructName, tt.name)
+			}
+		}
+		if acks != tt.fixtures {
+			t.Errorf("sniffer %v decoded %v login acks, expected %v", i, acks, tt.fixtures)
+		}
+		if n := atomic.LoadUint64(&sniffers[i].metrics.packetsCaptured); n != uint64(frames[i]) {
+			t.Errorf("sniffer %v counted %v packets captured, expected the %v of its own source", i, n, frames[i])
+		}
+	}
+}
@@ -2,12 +2,19 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"github.com/gorilla/websocket"
 	networking "github.com/shine-o/shine.engine.core/networking"
 	"github.com/spf13/viper"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,100 +23,517 @@ import (
 type PacketView struct {
 	// time of capture
 	PacketID         string                 `json:"packetID"`
+	Seq              uint64                 `json:"seq"`
 	ConnectionKey    string                 `json:"connectionKey"`
+	FlowID           string                 `json:"flowID"`
+	FlowName         string                 `json:"flowName"`
+	SessionID        string                 `json:"sessionID"`
 	TimeStamp        string                 `json:"timestamp"`
 	IPEndpoints      string                 `json:"ipEndpoints"`
 	PortEndpoints    string                 `json:"portEndpoints"`
+	Src              string                 `json:"src"`
+	Dst              string                 `json:"dst"`
 	Direction        string                 `json:"direction"`
+	Command          string                 `json:"command"`
 	PacketData       networking.ExportedPcb `json:"packetData"`
 	NcRepresentation ncRepresentation       `json:"ncRepresentation"`
+	HexDump          []HexDumpRow           `json:"hexDump"`
+	// length of the whole payload, the hex and the hex dump stop at output.maxPayloadBytes
+	// if it's longer, then truncated is set and sha1 is the one of the whole payload
+	PayloadLength int    `json:"payloadLength"`
+	Truncated     bool   `json:"truncated,omitempty"`
+	SHA1          string `json:"sha1,omitempty"`
+	// payload sizes as captured and once decompressed, only for protocol.compressedOpcodes
+	CompressedSize   int `json:"compressedSize,omitempty"`
+	DecompressedSize int `json:"decompressedSize,omitempty"`
+	// sent from the history when the client connected, not live
+	Replay bool `json:"replay,omitempty"`
 }
 
+// the view of a packet, its addresses are the ones of the event, already anonymized
+func packetView(pe PacketEvent, maxPayload int) PacketView {
+	data, sum := truncatePayload(pe.Packet.Base.Data, maxPayload)
+	endpoints := ipEndpoints(pe)
+	pv := PacketView{
+		PacketID:      pe.ID,
+		Seq:           pe.Seq,
+		ConnectionKey: fmt.Sprintf("%v %v", endpoints, pe.Transport.String()),
+		FlowID:        pe.FlowID,
+		FlowName:      pe.FlowName,
+		SessionID:     pe.SessionID,
+		Command:       pe.Packet.Base.ClientStructName,
+		TimeStamp:     pe.Seen.String(),
+		IPEndpoints:   endpoints,
+		PortEndpoints: pe.Transport.String(),
+		Src:           pe.Src,
+		Dst:           pe.Dst,
+		Direction:     pe.Direction,
+		PacketData:    pe.Packet.Base.JSON(),
+		NcRepresentation: ncRepresentation{
+			UnpackedData: pe.Decoded,
+			Fields:       pe.Fields,
+			Context:      pe.Context,
+		},
+		HexDump:          hexDump(data),
+		PayloadLength:    len(pe.Packet.Base.Data),
+		Truncated:        sum != "",
+		SHA1:             sum,
+		CompressedSize:   pe.CompressedSize,
+		DecompressedSize: pe.DecompressedSize,
+	}
+	if pe.Decoded == "" {
+		pv.NcRepresentation.Hex = hex.EncodeToString(data)
+	}
+	if pv.Truncated {
+		pv.PacketData.Data = truncateHex(pv.PacketData.Data, maxPayload)
+		pv.PacketData.RawData = truncateHex(pv.PacketData.RawData, maxPayload)
+	}
+	return pv
+}
+
+// src->dst of the stream of pe, the hosts of its addresses, the other way around for inbound packets
+// events without addresses fall back to their network flow
+func ipEndpoints(pe PacketEvent) string {
+	if pe.Src == "" || pe.Dst == "" {
+		return pe.Net.String()
+	}
+	src, dst := pe.Src, pe.Dst
+	if pe.Direction == "inbound" {
+		src, dst = dst, src
+	}
+	return fmt.Sprintf("%v->%v", addressHost(src), addressHost(dst))
+}
+
+// the host of host:port, the whole address if it has no port
+func addressHost(hostPort string) string {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort
+	}
+	return host
+}
+
+// the hex of the first max bytes
+func truncateHex(h string, max int) string {
+	if len(h) <= 2*max {
+		return h
+	}
+	return h[:2*max]
+}
+
+// wsConnection serializes writes to a single websocket connection so concurrent broadcasts don't corrupt frames
+// broadcasts only queue their messages, a goroutine per connection writes them, see writeQueued
+// packets are only forwarded for the flow names the client subscribed to, every flow if it didn't
+type wsConnection struct {
+	c          *websocket.Conn
+	mu         sync.Mutex
+	queue      chan []byte
+	done       chan struct{}
+	subscribed map[string]bool
+	subMu      sync.RWMutex
+}
+
+func newWSConnection(c *websocket.Conn) *wsConnection {
+	return &wsConnection{
+		c:     c,
+		queue: make(chan []byte, wsSendQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// webSockets are the UI clients of a Sniffer
 type webSockets struct {
-	cons map[*websocket.Conn]bool
+	cons map[*websocket.Conn]*wsConnection
 	mu   sync.Mutex
+	// the writeQueued goroutines of the connections
+	writers sync.WaitGroup
 }
 
-var upgrader = websocket.Upgrader{} // use default options
+func newWebSockets() *webSockets {
+	return &webSockets{
+		cons: make(map[*websocket.Conn]*wsConnection),
+	}
+}
+
+const (
+	// clients that don't answer a ping within pongWait are dropped
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+)
+
+// clients that don't take a message within writeWait are dropped, so a stuck client can't hold up the broadcasts
+var writeWait = 10 * time.Second
+
+// messages waiting to be written to a client, one that falls further behind is disconnected
+var wsSendQueueSize = 1024
 
-var ws *webSockets // grrr, find other way to send packets to
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
 
-func startUI(ctx context.Context) {
+// serve the UI and the api of sn until stopUI is called
+func (sn *Sniffer) startUI(ctx context.Context) {
 	select {
 	case <-ctx.Done():
 		return
 	default:
-		ws = &webSockets{
-			cons: make(map[*websocket.Conn]bool),
+		host := viper.GetString("ui.listen")
+		if host == "" {
+			host = "localhost"
 		}
-
-		var addr = fmt.Sprintf("localhost:%v", viper.GetString("websocket.port"))
+		addr := net.JoinHostPort(host, viper.GetString("websocket.port"))
 		log.Infof("starting websocket server on %v", addr)
-		http.HandleFunc("/packets", packets)
+		if !loopbackListener() && viper.GetString("ui.token") == "" {
+			log.Warningf("%v isn't loopback and ui.token is not set, changes, injection and pprof are refused", host)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", uiHandler())
+		mux.HandleFunc("/api/config", uiConfigHandler)
+		mux.HandleFunc("/packets", sn.packets)
+		mux.HandleFunc("/metrics", sn.metricsHandler)
+		mux.HandleFunc("/healthz", sn.healthHandler)
+		mux.HandleFunc("/api/flows", sn.flowsHandler)
+		mux.HandleFunc("/api/flows/", sn.flowsHandler)
+		mux.HandleFunc("/api/stats", sn.statsHandler)
+		mux.HandleFunc("/api/services", sn.servicesHandler)
+		mux.HandleFunc("/api/sessions", sn.sessionsHandler)
+		mux.HandleFunc("/api/sessions/", sn.sessionsHandler)
+		mux.HandleFunc("/api/timeline", sn.timelineHandler)
+		mux.HandleFunc("/api/search", sn.searchHandler)
+		mux.HandleFunc("/api/export.csv", sn.exportCSVHandler)
+		mux.HandleFunc("/api/packets/", sn.payloadHandler)
+		mux.HandleFunc("/api/diff", sn.diffHandler)
+		mux.HandleFunc("/api/heatmap", sn.heatmapHandler)
+		mux.HandleFunc("/api/reload", sn.reloadHandler)
+		mux.HandleFunc("/api/capture", sn.captureHandler)
+		mux.HandleFunc("/api/capture/", sn.captureHandler)
+		if sn.config.Injection {
+			mux.HandleFunc("/api/inject", sn.injectHandler)
+		}
+		if viper.GetBool("ui.pprof") {
+			log.Warningf("serving profiles on http://%v/debug/pprof/", addr)
+			mux.HandleFunc("/debug/pprof/", requireToken(pprof.Index))
+			mux.HandleFunc("/debug/pprof/cmdline", requireToken(pprof.Cmdline))
+			mux.HandleFunc("/debug/pprof/profile", requireToken(pprof.Profile))
+			mux.HandleFunc("/debug/pprof/symbol", requireToken(pprof.Symbol))
+			mux.HandleFunc("/debug/pprof/trace", requireToken(pprof.Trace))
+		}
+
+		sn.ui.Addr = addr
+		sn.ui.Handler = mux
 
-		log.Error(http.ListenAndServe(addr, nil))
+		if err := sn.ui.ListenAndServe(); err != http.ErrServerClosed {
+			log.Error(err)
+		}
 	}
 }
 
-func (pv *PacketView) String() string {
-	sd, err := json.Marshal(&pv)
-	if err != nil {
+// let the UI know the capture is over, close every websocket connection and stop the http server
+func (sn *Sniffer) stopUI() {
+	ws := sn.ws
+	stopped := envelope(wsCapture, captureEvent{State: "stopped"})
+
+	ws.mu.Lock()
+	for c, wc := range ws.cons {
+		// written right away, the messages still queued are not sent anymore
+		wc.mu.Lock()
+		err := wc.writeLocked(stopped)
+		if err == nil {
+			err = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "capture stopped"), time.Now().Add(time.Second))
+		}
+		wc.mu.Unlock()
+		if err != nil {
+			log.Error(err)
+		}
+		_ = c.Close()
+		delete(ws.cons, c)
+	}
+	ws.mu.Unlock()
+	// the writes of closed connections fail right away
+	ws.writers.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := sn.ui.Shutdown(ctx); err != nil {
 		log.Error(err)
 	}
-	return string(sd)
 }
 
-func sendPacketToUI(pv PacketView) {
-	ws.mu.Lock()
-	// check if it can be done with goroutine
-	if len(ws.cons) == 0 {
+func (wc *wsConnection) write(data []byte) error {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.writeLocked(data)
+}
+
+// write with wc.mu held, a write that times out breaks the connection, every later write fails and it gets dropped
+func (wc *wsConnection) writeLocked(data []byte) error {
+	if err := wc.c.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	return wc.c.WriteMessage(websocket.TextMessage, data)
+}
+
+func (wc *wsConnection) ping() error {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.c.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+func (wc *wsConnection) subscribe(flowNames []string) {
+	wc.subMu.Lock()
+	defer wc.subMu.Unlock()
+	if len(flowNames) == 0 {
+		wc.subscribed = nil
 		return
 	}
-	for c, active := range ws.cons {
-		if active {
-			err := c.WriteMessage(websocket.TextMessage, []byte(pv.String()))
-			if err != nil {
-				log.Error("write:", err)
-				continue
-			}
-		}
-		time.Sleep(time.Millisecond * 100)
+	wc.subscribed = make(map[string]bool)
+	for _, n := range flowNames {
+		wc.subscribed[n] = true
 	}
+}
+
+func (wc *wsConnection) wants(flowName string) bool {
+	wc.subMu.RLock()
+	defer wc.subMu.RUnlock()
+	return wc.subscribed == nil || wc.subscribed[flowName]
+}
+
+func (ws *webSockets) add(wc *wsConnection) {
+	ws.mu.Lock()
+	ws.cons[wc.c] = wc
+	ws.mu.Unlock()
+}
+
+func (ws *webSockets) remove(c *websocket.Conn) {
+	ws.mu.Lock()
+	delete(ws.cons, c)
 	ws.mu.Unlock()
 }
 
-type completedFlow struct {
-	FlowCompleted bool   `json:"flow_completed"`
-	FlowID        string `json:"flow_id"`
+// write data to every live connection, connections that fail are dropped
+func (ws *webSockets) broadcast(data []byte) {
+	ws.send(data, func(*wsConnection) bool { return true })
 }
 
-func (cf *completedFlow) String() string {
-	sd, err := json.Marshal(&cf)
-	if err != nil {
-		log.Error(err)
-	}
-	return string(sd)
+// write the packets of a flow to the connections subscribed to it
+func (ws *webSockets) broadcastFlow(flowName string, data []byte) {
+	ws.send(data, func(wc *wsConnection) bool { return wc.wants(flowName) })
 }
 
-func uiCompletedFlow(cf completedFlow) {
+// queue data for the connections to picks, a broadcast never waits for a client
+func (ws *webSockets) send(data []byte, to func(*wsConnection) bool) {
 	ws.mu.Lock()
-	// check if it can be done with goroutine
-	for c, active := range ws.cons {
-		if active {
-			err := c.WriteMessage(websocket.TextMessage, []byte(cf.String()))
-			if err != nil {
-				log.Error("write:", err)
-				break
-			}
+	cons := make([]*wsConnection, 0, len(ws.cons))
+	for _, wc := range ws.cons {
+		if to(wc) {
+			cons = append(cons, wc)
 		}
 	}
 	ws.mu.Unlock()
+
+	for _, wc := range cons {
+		select {
+		case wc.queue <- data:
+		default:
+			log.Warningf("websocket client %v is %v messages behind, disconnecting it", wc.c.RemoteAddr(), wsSendQueueSize)
+			ws.remove(wc.c)
+			_ = wc.c.Close()
+		}
+	}
+}
+
+// write first, then what is queued for wc until the connection is done or a write fails
+func (wc *wsConnection) writeQueued(first [][]byte) {
+	for _, data := range first {
+		if err := wc.write(data); err != nil {
+			log.Info("write:", err)
+			_ = wc.c.Close()
+			return
+		}
+	}
+	for {
+		select {
+		case <-wc.done:
+			return
+		case data := <-wc.queue:
+			if err := wc.write(data); err != nil {
+				log.Info("write:", err)
+				// the read loop of the connection fails too and removes it
+				_ = wc.c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (ws *webSockets) sendPacket(pv PacketView) {
+	ws.broadcastFlow(pv.FlowName, envelope(wsPacket, pv))
 }
 
-func packets(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool {
+// packetViews sends every packet to the websocket clients, a Sink added by capture and decode-raw
+// the connections are closed with the UI, not with the sinks
+type packetViews struct {
+	ws         *webSockets
+	maxPayload int
+}
+
+func (p packetViews) Publish(pe PacketEvent) {
+	p.ws.sendPacket(packetView(pe, p.maxPayload))
+}
+
+func (p packetViews) Close() {}
+
+// flowEvent lets the UI keep a list of the live flows, it is sent to every connection regardless of subscriptions
+type flowEvent struct {
+	FlowID   string `json:"flow_id"`
+	FlowName string `json:"flow_name"`
+	// tcp for shine streams, udp for protocol.udpServices flows
+	Transport string `json:"transport"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	// sent as flow_open if set, flow_close otherwise
+	opened bool
+
+	// only on flow_closed
+	Summary *flowClosedSummary `json:"summary,omitempty"`
+}
+
+// flowClosedSummary are the final counts of a stream, sent once all of its packets were handled
+type flowClosedSummary struct {
+	Duration float64 `json:"durationSeconds"`
+	Packets  int     `json:"packets"`
+	Bytes    int     `json:"bytes"`
+	// bytes of a last packet the stream ended in the middle of, by direction, those packets weren't decoded
+	Truncated map[string]int `json:"truncatedBytes,omitempty"`
+}
+
+func newFlowEvent(ss *shineStream, opened bool) flowEvent {
+	return flowEvent{
+		FlowID:    ss.flowID,
+		FlowName:  ss.flowName,
+		Transport: "tcp",
+		Src:       ss.sniffer.session.anonymizer().address(srcAddress(ss.net, ss.transport)),
+		Dst:       ss.sniffer.session.anonymizer().address(dstAddress(ss.net, ss.transport)),
+		opened:    opened,
+	}
+}
+
+func newFlowClosedEvent(ss *shineStream) flowEvent {
+	fe := newFlowEvent(ss, false)
+	ss.stats.mu.Lock()
+	defer ss.stats.mu.Unlock()
+	fe.Summary = &flowClosedSummary{
+		Duration:  ss.stats.lastSeen.Sub(ss.stats.firstSeen).Seconds(),
+		Packets:   ss.stats.packets,
+		Bytes:     ss.stats.bytes,
+		Truncated: ss.stats.incomplete,
+	}
+	return fe
+}
+
+func (fe flowEvent) envelope() []byte {
+	if fe.opened {
+		return envelope(wsFlowOpen, fe)
+	}
+	return envelope(wsFlowClose, fe)
+}
+
+func (ws *webSockets) sendFlowEvent(fe flowEvent) {
+	ws.broadcast(fe.envelope())
+}
+
+// same origin requests are always allowed, cross origin ones only if listed in ui.allowedOrigins
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range viper.GetStringSlice("ui.allowedOrigins") {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	log.Warningf("rejecting %v from origin %v", r.URL.Path, origin)
+	return false
+}
+
+// whether the UI listens on a loopback address only, ui.listen is localhost unless set or capture --container
+func loopbackListener() bool {
+	host := viper.GetString("ui.listen")
+	if host == "" || strings.EqualFold(host, "localhost") {
 		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requests that change the capture, inject packets or profile the process need "Authorization: Bearer <ui.token>"
+// without a token they are only served on a loopback listener, requests without an Origin pass checkOrigin
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := viper.GetString("ui.token")
+	if token == "" {
+		if loopbackListener() {
+			return true
+		}
+		log.Warningf("rejecting %v, ui.listen isn't loopback and ui.token is not set", r.URL.Path)
+		http.Error(w, "ui.token has to be set to use this api on a listener that isn't loopback", http.StatusForbidden)
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+		log.Warningf("rejecting %v from %v, missing or wrong bearer token", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sniffer"`)
+		http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// h behind authorized, for the handlers that don't go through allowChange, e.g net/http/pprof
+func requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorized(w, r) {
+			h(w, r)
+		}
+	}
+}
+
+// requests that change the capture have to be json from an allowed origin, a page open in the browser can post a
+// form to localhost but not json without the browser asking first, and they have to be authorized
+func allowChange(w http.ResponseWriter, r *http.Request) bool {
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+	if !authorized(w, r) {
+		return false
+	}
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		http.Error(w, "content type has to be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// the version a client asked for with ?v=, the current one if it didn't
+func requestedVersion(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("v")
+	if v == "" {
+		return wsVersion, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func (sn *Sniffer) packets(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
@@ -117,28 +541,124 @@ func packets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ws.mu.Lock()
-	ws.cons[c] = true
-	ws.mu.Unlock()
+	if v, err := requestedVersion(r); err != nil || v != wsVersion {
+		log.Warningf("websocket client asked for version %q, only %v is supported", r.URL.Query().Get("v"), wsVersion)
+		_ = c.SetWriteDeadline(time.Now().Add(writeWait))
+		_ = c.WriteMessage(websocket.TextMessage, envelope(wsError, wsErrorData{
+			Message:  fmt.Sprintf("version %q isn't supported", r.URL.Query().Get("v")),
+			Versions: []int{wsVersion},
+		}))
+		_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported version"), time.Now().Add(writeWait))
+		_ = c.Close()
+		return
+	}
+
+	// broadcasts are queued from here on and written after the replay, so live packets always come after the history
+	// a packet handled while the history is read can be sent twice, but it isn't missed
+	wc := newWSConnection(c)
+	sn.ws.add(wc)
+	defer sn.ws.close(c)
+	defer close(wc.done)
+
+	// the flows that opened before the client connected and the history, read under their locks and sent without them
+	first := [][]byte{envelope(wsHello, wsHelloData{Version: wsVersion})}
+	for _, fe := range append(sn.streams.openFlows(), sn.udp.openFlows()...) {
+		first = append(first, fe.envelope())
+	}
+	replay := sn.history()
+	for _, pe := range replay {
+		pv := packetView(pe, sn.config.MaxPayloadBytes)
+		pv.Replay = true
+		first = append(first, envelope(wsPacket, pv))
+	}
+	sn.ws.writers.Add(1)
+	go func() {
+		defer sn.ws.writers.Done()
+		wc.writeQueued(first)
+	}()
+	log.Infof("websocket connection made, replaying %v packets", len(replay))
+
+	// every pong pushes the read deadline further, a client that stops answering makes ReadMessage fail
+	if err := c.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		log.Error(err)
+	}
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		t := time.NewTicker(pingPeriod)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := wc.ping(); err != nil {
+					log.Info("ping:", err)
+					_ = c.Close()
+					return
+				}
+			}
+		}
+	}()
 
-	defer closeWebSocket(c)
-	log.Info("websocket connection made")
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			log.Info("read:", err)
 			break
 		}
-		log.Info("recv: %s", message)
+		if err := sn.control(wc, message); err != nil {
+			log.Warningf("bad control message %s: %v", message, err)
+			if err := wc.write(envelope(wsError, wsErrorData{Message: err.Error()})); err != nil {
+				log.Info("write:", err)
+				break
+			}
+		}
 	}
 }
 
-func closeWebSocket(c *websocket.Conn) {
+// handle a message sent by a client, e.g {"v": 1, "type": "subscribe", "data": {"flows": ["zone00-client"]}}
+// or {"v": 1, "type": "capture", "data": {"action": "pause"}}
+func (sn *Sniffer) control(wc *wsConnection, message []byte) error {
+	e, err := parseEnvelope(message)
+	if err != nil {
+		return err
+	}
+	switch e.Type {
+	case wsSubscribe:
+		var s subscription
+		if err := e.decode(&s); err != nil {
+			return err
+		}
+		wc.subscribe(s.Flows)
+		log.Infof("websocket connection subscribed to %v", s.Flows)
+	case wsCapture:
+		var ca captureAction
+		if err := e.decode(&ca); err != nil {
+			return err
+		}
+		switch ca.Action {
+		case "pause":
+			sn.Pause()
+		case "resume":
+			sn.Resume()
+		default:
+			return fmt.Errorf("unknown capture action %q", ca.Action)
+		}
+	default:
+		return fmt.Errorf("unknown message type %q", e.Type)
+	}
+	return nil
+}
+
+func (ws *webSockets) close(c *websocket.Conn) {
+	ws.remove(c)
 	err := c.Close()
 	if err != nil {
-		log.Error()
+		log.Error(err)
 	}
-	ws.mu.Lock()
-	ws.cons[c] = false
-	ws.mu.Unlock()
 }
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the number of websocket connections broadcasts go to
+func (ws *webSockets) count() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.cons)
+}
+
+// wait until n websocket connections of sn are left
+func waitForWebSockets(t *testing.T, sn *Sniffer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testPipelineWait)
+	for sn.ws.count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v websocket connections, expected %v", sn.ws.count(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// a websocket client of the /packets endpoint of sn, past the hello
+func dialPackets(t *testing.T, sn *Sniffer) (*websocket.Conn, func()) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(sn.packets))
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/packets", nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	waitForWebSockets(t, sn, 1)
+	return c, func() {
+		_ = c.Close()
+		server.Close()
+		// the handler is done with the connection, and with log, once it's removed
+		waitForWebSockets(t, sn, 0)
+	}
+}
+
+func TestWebSocketClosedByClient(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, closeAll := dialPackets(t, sn)
+	defer closeAll()
+
+	if err := c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	waitForWebSockets(t, sn, 0)
+}
+
+// a client that stops reading is dropped once a write times out, instead of blocking every broadcast
+func TestStuckWebSocketEvicted(t *testing.T) {
+	defer func(w time.Duration) { writeWait = w }(writeWait)
+	writeWait = 50 * time.Millisecond
+
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closeAll := dialPackets(t, sn)
+	defer closeAll()
+	// writeWait is put back once nothing writes anymore
+	defer sn.ws.writers.Wait()
+
+	// the client never reads, once the socket buffers are full a write can only time out
+	message := make([]byte, 1<<20)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sn.ws.count() > 0 {
+			sn.ws.broadcast(message)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testPipelineWait):
+		t.Fatal("broadcasts blocked on a client that doesn't read")
+	}
+}
+
+// a client that doesn't read is disconnected once its send queue is full, long before a write would time out
+func TestWebSocketQueueFull(t *testing.T) {
+	defer func(w time.Duration, n int) { writeWait, wsSendQueueSize = w, n }(writeWait, wsSendQueueSize)
+	writeWait = time.Hour
+	wsSendQueueSize = 4
+
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closeAll := dialPackets(t, sn)
+	defer closeAll()
+	defer sn.ws.writers.Wait()
+
+	message := make([]byte, 1<<20)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sn.ws.count() > 0 {
+			sn.ws.broadcast(message)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testPipelineWait):
+		t.Fatal("a client that doesn't read is still connected")
+	}
+}
+
+// read the next message of c, which has to be an envelope of the current version
+func readEnvelope(t *testing.T, c *websocket.Conn) wsEnvelope {
+	t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(testPipelineWait)); err != nil {
+		t.Fatal(err)
+	}
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := parseEnvelope(message)
+	if err != nil {
+		t.Fatalf("%s: %v", message, err)
+	}
+	return e
+}
+
+// clients get a hello with the version they asked for, or an error with the supported ones before being disconnected
+func TestWebSocketVersion(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(sn.packets))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		query     string
+		supported bool
+	}{
+		{"no version", "", true},
+		{"current version", "?v=1", true},
+		{"newer version", "?v=2", false},
+		{"not a version", "?v=latest", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/packets"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			e := readEnvelope(t, c)
+			if tt.supported {
+				var hello wsHelloData
+				if err := e.decode(&hello); err != nil {
+					t.Fatal(err)
+				}
+				if e.Type != wsHello || hello.Version != wsVersion {
+					t.Errorf("first message %v %+v, expected a hello with version %v", e.Type, hello, wsVersion)
+				}
+				return
+			}
+			var we wsErrorData
+			if err := e.decode(&we); err != nil {
+				t.Fatal(err)
+			}
+			if e.Type != wsError || len(we.Versions) != 1 || we.Versions[0] != wsVersion {
+				t.Errorf("first message %v %+v, expected an error listing version %v", e.Type, we, wsVersion)
+			}
+			if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+				t.Errorf("the connection wasn't closed as a protocol error: %v", err)
+			}
+		})
+	}
+	waitForWebSockets(t, sn, 0)
+}
+
+// client messages are answered with an error unless they are a valid subscribe or capture message, which are applied
+func TestWebSocketControlMessages(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, closeAll := dialPackets(t, sn)
+	defer closeAll()
+
+	tests := []struct {
+		name    string
+		message string
+		// type of the message the server answers with
+		answer string
+	}{
+		{"unknown type", `{"v": 1, "type": "echo", "data": {"text": "hi"}}`, wsError},
+		{"other version", `{"v": 2, "type": "subscribe", "data": {"flows": []}}`, wsError},
+		{"not json", `subscribe zone00-client`, wsError},
+		{"subscribe data of the wrong shape", `{"v": 1, "type": "subscribe", "data": {"flows": "zone00-client"}}`, wsError},
+		{"unknown capture action", `{"v": 1, "type": "capture", "data": {"action": "rewind"}}`, wsError},
+		{"pause", `{"v": 1, "type": "capture", "data": {"action": "pause"}}`, wsCapture},
+		{"resume", `{"v": 1, "type": "capture", "data": {"action": "resume"}}`, wsCapture},
+	}
+	for _, tt := range tests {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(tt.message)); err != nil {
+			t.Fatal(err)
+		}
+		if e := readEnvelope(t, c); e.Type != tt.answer {
+			t.Errorf("%v: answered with %v %s, expected %v", tt.name, e.Type, e.Data, tt.answer)
+		}
+	}
+	if sn.Paused() {
+		t.Error("the capture is still paused after resuming")
+	}
+
+	// a subscription isn't answered, it shows in what the connection is sent
+	if err := c.WriteMessage(websocket.TextMessage, []byte(`{"v": 1, "type": "subscribe", "data": {"flows": ["zone00-client"]}}`)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(testPipelineWait)
+	for {
+		sn.ws.mu.Lock()
+		var wc *wsConnection
+		for _, w := range sn.ws.cons {
+			wc = w
+		}
+		sn.ws.mu.Unlock()
+		if wc != nil && !wc.wants("login-client") && wc.wants("zone00-client") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the subscription wasn't applied")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	sn.ws.sendPacket(PacketView{FlowName: "login-client"})
+	sn.ws.sendPacket(PacketView{FlowName: "zone00-client", PacketID: "wanted"})
+	e := readEnvelope(t, c)
+	var pv PacketView
+	if err := e.decode(&pv); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != wsPacket || pv.PacketID != "wanted" {
+		t.Errorf("sent %v %+v, expected the packet of zone00-client", e.Type, pv)
+	}
+}
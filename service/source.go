@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// PacketSourceProvider is where a Sniffer reads its packets from, network.backend picks one
+// new backends only need to hand over a packet source with the bpf filter already applied
+type PacketSourceProvider interface {
+	PacketSource() *gopacket.PacketSource
+	LinkType() layers.LinkType
+	// packets received and dropped by the kernel since the source was opened
+	Stats() (CaptureStats, error)
+	Close()
+}
+
+// filterSetter is implemented by sources whose bpf filter can be changed while capturing
+type filterSetter interface {
+	SetFilter(filter string) error
+}
+
+// CaptureStats are the counters kept by the kernel for a live capture
+// Dropped are packets the capture didn't read in time, IfDropped the ones the network interface dropped
+type CaptureStats struct {
+	Received  uint64 `json:"received"`
+	Dropped   uint64 `json:"dropped"`
+	IfDropped uint64 `json:"ifDropped"`
+}
+
+// packets that never reached the capture
+func (s CaptureStats) lost() uint64 {
+	return s.Dropped + s.IfDropped
+}
+
+var errNoCaptureStats = errors.New("capture statistics are only kept for live captures")
+
+// open the backend set in network.backend, pcap files are always read with pcap
+// with network.waitForInterface a live capture is opened again until its interface is there or ctx is done
+func openPacketSource(ctx context.Context, c Config) (PacketSourceProvider, error) {
+	if c.PcapFile != "" {
+		if c.Backend != "" && c.Backend != "pcap" {
+			log.Warningf("network.backend %v can't read pcap files, using pcap", c.Backend)
+		}
+		return openPcapSource(c)
+	}
+	var open func(Config) (PacketSourceProvider, error)
+	switch c.Backend {
+	case "", "pcap":
+		open = openPcapSource
+	case "afpacket":
+		open = openAFPacketSource
+	default:
+		return nil, fmt.Errorf("network.backend: unknown backend %q, use pcap or afpacket", c.Backend)
+	}
+	openLive := func() (PacketSourceProvider, error) {
+		if len(c.Interfaces) > 0 {
+			return openInterfaceSources(c, open)
+		}
+		return open(c)
+	}
+	if c.WaitForInterface {
+		return waitForInterface(ctx, openLive)
+	}
+	return openLive()
+}
+
+// pcapSource is a libpcap handle on the configured interface or, if a pcap file is set, on that file
+type pcapSource struct {
+	handle *pcap.Handle
+	live   bool
+}
+
+func openPcapSource(c Config) (PacketSourceProvider, error) {
+	var (
+		handle *pcap.Handle
+		err    error
+	)
+	if c.PcapFile != "" {
+		log.Infof("reading packets from file %v", c.PcapFile)
+		handle, err = pcap.OpenOffline(c.PcapFile)
+	} else {
+		handle, err = pcap.OpenLive(c.Interface, int32(c.Snaplen), true, pcap.BlockForever)
+		if err != nil {
+			err = captureSetupError(c.Interface, err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening pcap handle: %v", err)
+	}
+
+	if err := handle.SetBPFFilter(c.Filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("error setting BPF filter %q: %v", c.Filter, err)
+	}
+	return &pcapSource{handle: handle, live: c.PcapFile == ""}, nil
+}
+
+func (ps *pcapSource) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(ps.handle, ps.handle.LinkType())
+}
+
+func (ps *pcapSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return ps.handle.ReadPacketData()
+}
+
+func (ps *pcapSource) LinkType() layers.LinkType {
+	return ps.handle.LinkType()
+}
+
+func (ps *pcapSource) Stats() (CaptureStats, error) {
+	if !ps.live {
+		return CaptureStats{}, errNoCaptureStats
+	}
+	s, err := ps.handle.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{
+		Received:  uint64(s.PacketsReceived),
+		Dropped:   uint64(s.PacketsDropped),
+		IfDropped: uint64(s.PacketsIfDropped),
+	}, nil
+}
+
+func (ps *pcapSource) SetFilter(filter string) error {
+	if err := ps.handle.SetBPFFilter(filter); err != nil {
+		return fmt.Errorf("error setting BPF filter %q: %v", filter, err)
+	}
+	return nil
+}
+
+func (ps *pcapSource) Close() {
+	ps.handle.Close()
+}
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sqliteQueueSize     = 10000
+	sqliteBatchSize     = 500
+	sqliteFlushInterval = time.Second
+)
+
+// timestamps are stored as unix nanoseconds so time ranges can use the indexes
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS flows (
+	flow_id      TEXT PRIMARY KEY,
+	flow_name    TEXT NOT NULL,
+	src          TEXT NOT NULL,
+	dst          TEXT NOT NULL,
+	started_at   INTEGER NOT NULL,
+	completed_at INTEGER
+);
+CREATE TABLE IF NOT EXISTS packets (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	flow_id   TEXT NOT NULL,
+	flow_name TEXT NOT NULL,
+	direction TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	opcode    INTEGER NOT NULL,
+	length    INTEGER NOT NULL,
+	payload   BLOB,
+	packet_id TEXT NOT NULL DEFAULT '',
+	seq       INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS packets_opcode ON packets (opcode);
+CREATE INDEX IF NOT EXISTS packets_flow_timestamp ON packets (flow_id, timestamp);
+`
+
+// columns of packets that databases created by earlier versions don't have yet, added by openDatabase
+var sqlitePacketColumns = []struct{ name, definition string }{
+	{"packet_id", "TEXT NOT NULL DEFAULT ''"},
+	{"seq", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// created once the columns they index are there
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS packets_packet_id ON packets (packet_id);
+`
+
+// a statement waiting for the writer goroutine
+type sqliteRow struct {
+	query string
+	args  []interface{}
+}
+
+// packetStore writes flows and decoded packets to an sqlite database
+// a single goroutine inserts them in batched transactions, if it can't keep up rows are dropped
+type packetStore struct {
+	db      *sql.DB
+	queue   chan sqliteRow
+	dropped uint64
+	metrics *snifferMetrics
+	done    chan bool
+	closed  bool
+	mu      sync.RWMutex
+}
+
+// open the database at path, with the tables created if they aren't there yet
+func openDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only takes one writer at a time anyway
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addPacketColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteIndexes); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// add the columns of sqlitePacketColumns the packets table doesn't have, the packets stored before get their default
+func addPacketColumns(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(packets)")
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			value            sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &value, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range sqlitePacketColumns {
+		if columns[c.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE packets ADD COLUMN %v %v", c.name, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rows it drops are counted in sm, the database is listed in the manifest of s
+func openPacketStore(path string, s *session, sm *snifferMetrics) (*packetStore, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, fmt.Errorf("output.sqlite.path: %v", err)
+	}
+
+	ps := &packetStore{
+		db:      db,
+		queue:   make(chan sqliteRow, sqliteQueueSize),
+		metrics: sm,
+		done:    make(chan bool),
+	}
+	go ps.run()
+	s.register(path, artifactSQLite)
+	log.Infof("storing packets in %v", path)
+	return ps, nil
+}
+
+func (ps *packetStore) enqueue(row sqliteRow) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if ps.closed {
+		return
+	}
+	select {
+	case ps.queue <- row:
+	default:
+		atomic.AddUint64(&ps.dropped, 1)
+		ps.metrics.sqliteRowDropped()
+	}
+}
+
+// the rows of a flow and its packets, the store and sniffer convert write the same ones
+// src and dst are the client and the server
+func flowStartedRow(flowID, flowName, src, dst string, seen time.Time) sqliteRow {
+	return sqliteRow{
+		query: "INSERT OR REPLACE INTO flows (flow_id, flow_name, src, dst, started_at) VALUES (?, ?, ?, ?, ?)",
+		args:  []interface{}{flowID, flowName, src, dst, seen.UnixNano()},
+	}
+}
+
+func flowCompletedRow(flowID string, seen time.Time) sqliteRow {
+	return sqliteRow{
+		query: "UPDATE flows SET completed_at = ? WHERE flow_id = ?",
+		args:  []interface{}{seen.UnixNano(), flowID},
+	}
+}
+
+func packetRow(pe PacketEvent) sqliteRow {
+	return sqliteRow{
+		query: "INSERT INTO packets (flow_id, flow_name, direction, timestamp, opcode, length, payload, packet_id, seq) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		args:  []interface{}{pe.FlowID, pe.FlowName, pe.Direction, pe.Seen.UnixNano(), pe.Packet.Base.OperationCode, len(pe.Packet.Base.Data), pe.Packet.Base.Data, pe.ID, int64(pe.Seq)},
+	}
+}
+
+func (ps *packetStore) flowStarted(ss *shineStream, seen time.Time) {
+	ps.enqueue(flowStartedRow(ss.flowID, ss.flowName,
+		ss.sniffer.session.anonymizer().address(srcAddress(ss.net, ss.transport)),
+		ss.sniffer.session.anonymizer().address(dstAddress(ss.net, ss.transport)),
+		seen))
+}
+
+func (ps *packetStore) flowCompleted(ss *shineStream, seen time.Time) {
+	ps.enqueue(flowCompletedRow(ss.flowID, seen))
+}
+
+func (ps *packetStore) Publish(pe PacketEvent) {
+	ps.enqueue(packetRow(pe))
+}
+
+func (ps *packetStore) run() {
+	defer close(ps.done)
+
+	t := time.NewTicker(sqliteFlushInterval)
+	defer t.Stop()
+
+	batch := make([]sqliteRow, 0, sqliteBatchSize)
+	for {
+		select {
+		case row, ok := <-ps.queue:
+			if !ok {
+				ps.write(batch)
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) >= sqliteBatchSize {
+				ps.write(batch)
+				batch = batch[:0]
+			}
+		case <-t.C:
+			ps.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (ps *packetStore) write(batch []sqliteRow) {
+	if len(batch) == 0 {
+		return
+	}
+	tx, err := ps.db.Begin()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, row := range batch {
+		if _, err := tx.Exec(row.query, row.args...); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error(err)
+	}
+}
+
+// insert what is left in the queue and close the database
+func (ps *packetStore) Close() {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return
+	}
+	ps.closed = true
+	close(ps.queue)
+	ps.mu.Unlock()
+
+	<-ps.done
+	if dropped := atomic.LoadUint64(&ps.dropped); dropped > 0 {
+		log.Warningf("%v rows were dropped before reaching the sqlite database", dropped)
+	}
+	if err := ps.db.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// storedPacket is a row of the packets table
+type storedPacket struct {
+	// the row id for stored packets, the PacketEvent id for the ones in the history
+	ID string `json:"id"`
+	// the PacketEvent id and sequence number, empty and 0 for packets stored before they were
+	PacketID  string    `json:"packetID"`
+	Seq       uint64    `json:"seq"`
+	FlowID    string    `json:"flowID"`
+	FlowName  string    `json:"flowName"`
+	Direction string    `json:"direction"`
+	Seen      time.Time `json:"seen"`
+	OpCode    uint16    `json:"operationCode"`
+	Command   string    `json:"command"`
+	Length    int       `json:"length"`
+	Payload   []byte    `json:"payload"`
+}
+
+// packets with the operation code seen between from and to, oldest first
+func queryPackets(pr *protocol, db *sql.DB, opCode uint16, from, to time.Time) ([]storedPacket, error) {
+	rows, err := db.Query("SELECT id, flow_id, flow_name, direction, timestamp, opcode, length, payload, packet_id, seq FROM packets WHERE opcode = ? AND timestamp BETWEEN ? AND ? ORDER BY timestamp",
+		opCode, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packets []storedPacket
+	for rows.Next() {
+		var (
+			p      storedPacket
+			id, ts int64
+		)
+		if err := rows.Scan(&id, &p.FlowID, &p.FlowName, &p.Direction, &ts, &p.OpCode, &p.Length, &p.Payload, &p.PacketID, &p.Seq); err != nil {
+			return nil, err
+		}
+		p.ID = strconv.FormatInt(id, 10)
+		p.Seen = time.Unix(0, ts)
+		p.Command = pr.commandName(p.OpCode)
+		packets = append(packets, p)
+	}
+	return packets, rows.Err()
+}
+
+// Query prints the stored packets with an operation code seen between --from and --to as json lines
+func Query(cmd *cobra.Command, args []string) {
+	path := viper.GetString("output.sqlite.path")
+	if path == "" {
+		log.Fatal("no database, set output.sqlite.path or --db")
+	}
+
+	c, err := ConfigFromViper()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := loadProtocol(c.CommandsFile, c.SchemaFile)
+
+	opCodeFlag, err := cmd.Flags().GetString("opcode")
+	if err != nil {
+		log.Fatal(err)
+	}
+	opCode, err := p.parseOpCode(opCodeFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	from, err := queryTime(cmd, "from", time.Unix(0, 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, err := queryTime(cmd, "to", time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// databases of earlier versions get the columns they don't have yet
+	db, err := openDatabase(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	packets, err := queryPackets(p, db, opCode, from, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	e := json.NewEncoder(os.Stdout)
+	for _, p := range packets {
+		if err := e.Encode(p); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// times are given as RFC 3339, e.g 2020-05-01T12:30:00Z
+func queryTime(cmd *cobra.Command, name string, fallback time.Time) (time.Time, error) {
+	s, err := cmd.Flags().GetString(name)
+	if err != nil {
+		return fallback, err
+	}
+	if s == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fallback, fmt.Errorf("--%v: %v", name, err)
+	}
+	return t, nil
+}
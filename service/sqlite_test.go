@@ -0,0 +1,34 @@
+package service
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// rows the writer can't keep up with are dropped, and counted on /metrics
+func TestSqliteRowDropped(t *testing.T) {
+	// no writer goroutine, so nothing leaves the queue
+	ps := &packetStore{queue: make(chan sqliteRow, 2), metrics: newSnifferMetrics()}
+	for i := 0; i < 5; i++ {
+		ps.enqueue(sqliteRow{query: "SELECT 1"})
+	}
+	if dropped := atomic.LoadUint64(&ps.dropped); dropped != 3 {
+		t.Errorf("%v rows dropped, expected 3", dropped)
+	}
+	if dropped := atomic.LoadUint64(&ps.metrics.sqliteDropped); dropped != 3 {
+		t.Errorf("the metric counted %v rows, expected 3", dropped)
+	}
+
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn.metrics = ps.metrics
+	w := httptest.NewRecorder()
+	sn.metrics.write(w, sn)
+	if !strings.Contains(w.Body.String(), "sniffer_sqlite_rows_dropped_total ") {
+		t.Error("sniffer_sqlite_rows_dropped_total is missing from /metrics")
+	}
+}
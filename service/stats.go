@@ -0,0 +1,342 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// summaries kept per stream for /api/flows/{flowID}
+const recentPacketsSize = 20
+
+type packetSummary struct {
+	Seen          time.Time `json:"seen"`
+	Direction     string    `json:"direction"`
+	OperationCode uint16    `json:"operationCode"`
+	Command       string    `json:"command"`
+	Length        int       `json:"length"`
+}
+
+// flowStats are updated by the decoders of a stream and read by the http api
+type flowStats struct {
+	packets      int
+	bytes        int
+	decodeErrors int
+	opCodes      map[uint16]int
+	firstSeen    time.Time
+	lastSeen     time.Time
+	xorKeyFound  bool
+	truncated    int
+	duplicates   int
+	incomplete   map[string]int
+	pageSkips    int
+	// "detected" once client packets decoded to unknown operation codes, "corrected" once the xor offset was found again
+	xorDrift string
+	// segments dropped by the overflow policy of the segment queues
+	dropped int
+	// times the watchdog found a decoder receiving without decoding, and times a decoder reset its state because of it
+	wedged int
+	resets int
+	recent []packetSummary
+	mu     sync.Mutex
+}
+
+func (fs *flowStats) segmentReceived(seen time.Time, length int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.firstSeen.IsZero() {
+		fs.firstSeen = seen
+	}
+	fs.lastSeen = seen
+	fs.bytes += length
+}
+
+func (fs *flowStats) packetDecoded(dp decodedPacket) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.packets++
+	if fs.opCodes == nil {
+		fs.opCodes = make(map[uint16]int)
+	}
+	fs.opCodes[dp.packet.Base.OperationCode]++
+	fs.recent = append(fs.recent, packetSummary{
+		Seen:          dp.seen,
+		Direction:     dp.direction,
+		OperationCode: dp.packet.Base.OperationCode,
+		Command:       dp.packet.Base.ClientStructName,
+		Length:        len(dp.packet.Base.Data),
+	})
+	if len(fs.recent) > recentPacketsSize {
+		fs.recent = fs.recent[len(fs.recent)-recentPacketsSize:]
+	}
+}
+
+func (fs *flowStats) decodeError() {
+	fs.mu.Lock()
+	fs.decodeErrors++
+	fs.mu.Unlock()
+}
+
+// returns true for the first truncated packet of the stream
+func (fs *flowStats) packetTruncated() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.truncated++
+	return fs.truncated == 1
+}
+
+// the stream ended in the middle of a packet, buffered are the bytes of it that were received
+func (fs *flowStats) packetIncomplete(direction string, buffered int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.incomplete == nil {
+		fs.incomplete = make(map[string]int)
+	}
+	fs.incomplete[direction] += buffered
+}
+
+// returns true for the first gap the assembler page limits forced on the stream
+func (fs *flowStats) pageLimitReached() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.pageSkips++
+	return fs.pageSkips == 1
+}
+
+func (fs *flowStats) duplicate() {
+	fs.mu.Lock()
+	fs.duplicates++
+	fs.mu.Unlock()
+}
+
+func (fs *flowStats) segmentDropped() {
+	fs.mu.Lock()
+	fs.dropped++
+	fs.mu.Unlock()
+}
+
+func (fs *flowStats) keyFound() {
+	fs.mu.Lock()
+	fs.xorKeyFound = true
+	fs.mu.Unlock()
+}
+
+func (fs *flowStats) xorDriftDetected() {
+	fs.mu.Lock()
+	fs.xorDrift = "detected"
+	fs.mu.Unlock()
+}
+
+func (fs *flowStats) xorDriftCorrected() {
+	fs.mu.Lock()
+	fs.xorDrift = "corrected"
+	fs.mu.Unlock()
+}
+
+func (fs *flowStats) decoderWedged() {
+	fs.mu.Lock()
+	fs.wedged++
+	fs.mu.Unlock()
+}
+
+// returns how many resets the stream had, this one included
+func (fs *flowStats) decoderReset() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.resets++
+	return fs.resets
+}
+
+// FlowSummary adds up the stats of every stream that shares a flow name, e.g all the zone connections
+type FlowSummary struct {
+	FlowName         string        `json:"flowName"`
+	Streams          int           `json:"streams"`
+	Packets          int           `json:"packets"`
+	Bytes            int           `json:"bytes"`
+	DecodeErrors     int           `json:"decodeErrors"`
+	Unreliable       int           `json:"unreliableStreams"`
+	TruncatedPackets int           `json:"truncatedPackets"`
+	SegmentsDropped  int           `json:"segmentsDropped"`
+	Duplicates       int           `json:"duplicatePackets"`
+	DecodersWedged   int           `json:"decodersWedged"`
+	DecoderResets    int           `json:"decoderResets"`
+	FirstSeen        time.Time     `json:"firstSeen"`
+	LastSeen         time.Time     `json:"lastSeen"`
+	Duration         float64       `json:"durationSeconds"`
+	PacketRate       float64       `json:"packetsPerSecond"`
+	OpCodes          []OpCodeCount `json:"operationCodes"`
+	opCodes          map[uint16]int
+}
+
+type OpCodeCount struct {
+	OperationCode uint16 `json:"operationCode"`
+	Command       string `json:"command"`
+	Count         int    `json:"count"`
+	// time between consecutive packets of the operation code, only with output.timing.csv
+	Interval *IntervalPercentiles `json:"interval,omitempty"`
+	// entropy and printable share of the payloads, unless output.entropy is off
+	Payload *PayloadStats `json:"payload,omitempty"`
+}
+
+// add the stats of a stream to the summary of its flow name
+func mergeStats(summaries map[string]*FlowSummary, flowName string, fs *flowStats) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	sum, ok := summaries[flowName]
+	if !ok {
+		sum = &FlowSummary{
+			FlowName: flowName,
+			opCodes:  make(map[uint16]int),
+		}
+		summaries[flowName] = sum
+	}
+	sum.Streams++
+	sum.Packets += fs.packets
+	sum.Bytes += fs.bytes
+	sum.DecodeErrors += fs.decodeErrors
+	sum.SegmentsDropped += fs.dropped
+	sum.Duplicates += fs.duplicates
+	sum.DecodersWedged += fs.wedged
+	sum.DecoderResets += fs.resets
+	if fs.truncated > 0 {
+		sum.Unreliable++
+		sum.TruncatedPackets += fs.truncated
+	}
+	for opCode, n := range fs.opCodes {
+		sum.opCodes[opCode] += n
+	}
+	if !fs.firstSeen.IsZero() && (sum.FirstSeen.IsZero() || fs.firstSeen.Before(sum.FirstSeen)) {
+		sum.FirstSeen = fs.firstSeen
+	}
+	if fs.lastSeen.After(sum.LastSeen) {
+		sum.LastSeen = fs.lastSeen
+	}
+}
+
+// Summary of every flow seen so far, finished and active streams alike
+func (sn *Sniffer) Summary() []FlowSummary {
+	summaries := make(map[string]*FlowSummary)
+
+	sn.streams.mu.Lock()
+	for _, finished := range sn.streams.finished {
+		sum := *finished
+		sum.opCodes = make(map[uint16]int)
+		for opCode, n := range finished.opCodes {
+			sum.opCodes[opCode] = n
+		}
+		summaries[sum.FlowName] = &sum
+	}
+	for _, ss := range sn.streams.streams {
+		mergeStats(summaries, ss.flowName, &ss.stats)
+	}
+	sn.streams.mu.Unlock()
+
+	flows := sn.protocol.summarize(summaries)
+	sn.timing.summarize(flows)
+	sn.entropy.summarize(flows)
+	return flows
+}
+
+// work out the rates and sorted operation codes of merged summaries, sorted by flow name
+func (p *protocol) summarize(summaries map[string]*FlowSummary) []FlowSummary {
+	flows := make([]FlowSummary, 0, len(summaries))
+	for _, sum := range summaries {
+		sum.Duration = sum.LastSeen.Sub(sum.FirstSeen).Seconds()
+		if sum.Duration > 0 {
+			sum.PacketRate = float64(sum.Packets) / sum.Duration
+		}
+		sum.OpCodes = make([]OpCodeCount, 0, len(sum.opCodes))
+		for opCode, n := range sum.opCodes {
+			sum.OpCodes = append(sum.OpCodes, OpCodeCount{
+				OperationCode: opCode,
+				Command:       p.commandName(opCode),
+				Count:         n,
+			})
+		}
+		sort.Slice(sum.OpCodes, func(i, j int) bool {
+			if sum.OpCodes[i].Count == sum.OpCodes[j].Count {
+				return sum.OpCodes[i].OperationCode < sum.OpCodes[j].OperationCode
+			}
+			return sum.OpCodes[i].Count > sum.OpCodes[j].Count
+		})
+		flows = append(flows, *sum)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].FlowName < flows[j].FlowName
+	})
+	return flows
+}
+
+// log the summary as a table and write it to summary.json in the session directory
+func exportSummary(s *session, flows []FlowSummary) {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FLOW\tSTREAMS\tPACKETS\tBYTES\tERRORS\tTRUNCATED\tDURATION\tPACKETS/S\tTOP COMMAND")
+	for _, f := range flows {
+		top := "-"
+		if len(f.OpCodes) > 0 {
+			top = fmt.Sprintf("%v (%v)", f.OpCodes[0].Command, f.OpCodes[0].Count)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%.1fs\t%.2f\t%v\n", f.FlowName, f.Streams, f.Packets, f.Bytes, f.DecodeErrors, f.TruncatedPackets, f.Duration, f.PacketRate, top)
+	}
+	w.Flush()
+	log.Infof("capture summary\n%v", b.String())
+
+	d, err := json.MarshalIndent(flows, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	pathName, err := s.path("summary.json")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile(pathName, d, 0666); err != nil {
+		log.Error(err)
+		return
+	}
+	s.register(pathName, artifactSummary)
+}
+
+// statsView is the json returned by GET /api/stats
+type statsView struct {
+	Flows []FlowSummary `json:"flows"`
+	// kernel counters since the capture started, only for live captures
+	Capture *CaptureStats `json:"capture,omitempty"`
+	// the same counters per interface, when capturing on network.interfaces
+	Interfaces map[string]CaptureStats `json:"interfaces,omitempty"`
+	// what every rule of alerts.rules did
+	Alerts []AlertStats `json:"alerts,omitempty"`
+	// alerts alerts.webhook dropped or failed to send
+	AlertWebhookFailures uint64 `json:"alertWebhookFailures,omitempty"`
+}
+
+// GET /api/stats summarizes every flow seen so far
+func (sn *Sniffer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v := statsView{
+		Flows:                sn.Summary(),
+		Alerts:               sn.alerts.stats(),
+		AlertWebhookFailures: sn.alerts.webhookFailures(),
+	}
+	if s, err := sn.Source.Stats(); err == nil {
+		v.Capture = &s
+	} else if err != errNoCaptureStats {
+		log.Error(err)
+	}
+	if is, ok := sn.Source.(*interfaceSources); ok {
+		v.Interfaces = is.interfaceStats()
+	}
+	writeJSON(w, v)
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	"github.com/shine-o/shine.engine.core/networking"
+)
+
+// streamDecoder is the loop the client and server decoders share, it buffers the segments of one direction, cuts the
+// buffer at packet boundaries, decodes the packets and looks for a boundary again after gaps and undecodable packets
+// what differs between the directions, the xor offsets and what the seed packets tell, is left to the hooks
+type streamDecoder struct {
+	ss        *shineStream
+	direction string
+	// the client stream, for the decrypted pcap
+	outbound bool
+	watch    *decoderWatch
+	// a longer packet means the stream can't be decoded anymore
+	maxLength uint16
+
+	data   []byte
+	offset int
+	last   shineSegment
+	// after a gap, the buffer doesn't start at a packet boundary
+	resyncing bool
+	partial   partialPacket
+	sequence  segmentSequence
+	// bytes appended to the buffer so far, the offset of a packet in the stream is worked out from it
+	receivedBytes uint64
+	// packets DecodePacket rejected in a row
+	failures int
+	// the number given to the last decoded packet of the direction, only this decoder's goroutine counts
+	seq uint64
+
+	// xor offsets sent by the other decoder, closed once it is done, nil if none are expected
+	keys <-chan uint16
+	// an offset was received from keys, returns true if the buffer can be decoded with it
+	keyReceived func(o uint16) bool
+
+	// a segment arrived, called before a gap it reports is handled
+	segment func(segment shineSegment)
+	// a segment was added, called before the buffer is decoded
+	added func()
+	// the buffer was discarded from a packet boundary on, after a gap, undecodable packets or a wedged decoder
+	lost func()
+	// the offset of the next packet boundary in the buffer
+	boundary func() (int, bool)
+	// false while packets can't be decoded yet
+	ready func() bool
+	// decode a packet, data is a copy of it without the length header
+	decode func(data []byte) (networking.Command, error)
+	// a packet was decoded, raw is the packet as it is in the buffer, returns false if it can't be trusted, it is then
+	// counted as a decode error and the decoder resynchronizes after it
+	decoded func(p *networking.Command, raw []byte) bool
+	// where the packets that aren't duplicates go once they are accounted for
+	sink func(dp decodedPacket)
+	// what the wedged decoder was at, for the log
+	state func() string
+	// the xor offset of the next packet, for flowSequences, consumed is filled in
+	position func() decoderPosition
+}
+
+func (sd *streamDecoder) add(segment shineSegment) {
+	ss := sd.ss
+	ss.sniffer.metrics.segmentReceived(ss.flowName, segment.direction, len(segment.data))
+	ss.stats.segmentReceived(segment.seen, len(segment.data))
+	sd.watch.segmentReceived()
+	if !sd.sequence.inOrder(segment) && segment.skip == 0 {
+		// the queue dropped segments before this one
+		segment.skip = -1
+	}
+	if sd.segment != nil {
+		sd.segment(segment)
+	}
+	if segment.skip != 0 {
+		ss.warningf("[%v] %v stream lost %v bytes, discarding %v buffered bytes", ss.flowName, segment.direction, gapSize(segment.skip), len(sd.data)-sd.offset)
+		sd.data, sd.offset = nil, 0
+		sd.partial.reset()
+		sd.resyncing = true
+		if sd.lost != nil {
+			sd.lost()
+		}
+	}
+	sd.data = append(sd.data, segment.data...)
+	sd.receivedBytes += uint64(len(segment.data))
+	segment.release()
+	sd.last = segment
+	if sd.resyncing {
+		sd.resync()
+	}
+}
+
+// look for the next packet boundary, the buffer stays as it is until one is found
+func (sd *streamDecoder) resync() {
+	o, found := sd.boundary()
+	if !found {
+		return
+	}
+	sd.ss.warningf("[%v] %v stream resynchronized, %v bytes skipped to find a packet boundary", sd.ss.flowName, sd.last.direction, o)
+	sd.offset = o
+	sd.resyncing = false
+}
+
+// start over from a packet boundary found in what is left of the buffer
+func (sd *streamDecoder) restart() {
+	sd.trim()
+	sd.partial.reset()
+	sd.resyncing = true
+	if sd.lost != nil {
+		sd.lost()
+	}
+	sd.resync()
+}
+
+func (sd *streamDecoder) trim() {
+	sd.data, sd.offset = trimDecoded(sd.data, sd.offset)
+}
+
+// true while the buffer can't be decoded until more segments or a key arrive
+func (sd *streamDecoder) waiting() bool {
+	return sd.resyncing || (sd.ready != nil && !sd.ready())
+}
+
+// count a packet that couldn't be decoded, for the metrics, the summary and the alert rules
+func (sd *streamDecoder) decodeError() {
+	ss := sd.ss
+	ss.sniffer.metrics.decodeError(ss.flowName, sd.last.direction)
+	ss.stats.decodeError()
+	ss.sniffer.alerts.decodeError(ss, sd.last.direction, sd.last.seen)
+}
+
+// decode every complete packet available in the buffer
+func (sd *streamDecoder) decodeBuffered() {
+	ss := sd.ss
+	if sd.partial.waiting(len(sd.data)-sd.offset, ss.flowName, sd.last.direction, sd.last.seen) {
+		return
+	}
+	for sd.offset < len(sd.data) {
+		if sd.waiting() {
+			return
+		}
+
+		// a long length header is a 0 followed by two bytes, the header itself can be split across segments
+		if !lengthHeaderAvailable(sd.data, sd.offset) {
+			sd.partial.wait(3, sd.last.seen)
+			return
+		}
+
+		pLen, skipBytes := networking.PacketBoundary(sd.offset, sd.data)
+
+		if pLen > sd.maxLength {
+			// the buffer isn't at a packet boundary, skip the byte that was taken for one and look for the next,
+			// stopping here would leave the queues of the stream undrained and block the capture
+			ss.warningf("[%v] %v bad length value %v, resynchronizing", ss.flowName, sd.last.direction, pLen)
+			sd.decodeError()
+			sd.partial.reset()
+			sd.offset++
+			sd.restart()
+			continue
+		}
+
+		nextOffset := sd.offset + skipBytes + int(pLen)
+
+		if nextOffset > len(sd.data) {
+			// the rest of the packet is in the next segments
+			sd.partial.wait(skipBytes+int(pLen), sd.last.seen)
+			return
+		}
+		sd.partial.reset()
+
+		packetData := make([]byte, pLen)
+
+		copy(packetData, sd.data[sd.offset+skipBytes:nextOffset])
+
+		// where the packet starts in the stream of its direction, the same every time a capture is decoded
+		streamOffset := sd.receivedBytes - uint64(len(sd.data)-sd.offset)
+
+		p, err := sd.decode(packetData)
+		p.Base.ClientStructName = ss.commandName(p.Base.OperationCode)
+		if ss.decrypted != nil {
+			body := packetData
+			if err == nil {
+				body = ss.sniffer.redactBody(ss.flowName, p, packetData)
+			}
+			ss.decrypted.write(sd.last.seen, sd.outbound, body)
+		}
+		if err != nil {
+			failed := ss.undecodablePacket(sd.last.seen, sd.last.direction, streamOffset, sd.data[sd.offset:nextOffset], err, &sd.failures)
+			sd.offset = nextOffset
+			if failed {
+				// the boundaries or the xor offset are wrong, find them again from here
+				ss.warningf("[%v] %v %v packets in a row can't be decoded, resynchronizing", ss.flowName, decodeErrorsBeforeResync, sd.last.direction)
+				sd.restart()
+			}
+			continue
+		}
+		sd.failures = 0
+		sd.watch.packetDecoded()
+		ss.sniffer.metrics.packetDecoded(ss.flowName, sd.last.direction)
+		ss.sniffer.packetDecoded()
+
+		if sd.decoded != nil && !sd.decoded(&p, sd.data[sd.offset+skipBytes:nextOffset]) {
+			sd.decodeError()
+			sd.offset = nextOffset
+			sd.restart()
+			continue
+		}
+
+		dp := decodedPacket{
+			seen:      sd.last.seen,
+			packet:    &p,
+			direction: sd.last.direction,
+			offset:    streamOffset,
+		}
+		ss.decompress(&dp)
+		if ss.dedup.duplicate(dp) {
+			ss.stats.duplicate()
+			sd.offset = nextOffset
+			continue
+		}
+		ss.stats.packetDecoded(dp)
+		ss.sniffer.heatmap.add(ss.flowName, dp)
+		dp.annotations = ss.gameContext.observe(dp)
+		ss.observeLatency(dp)
+		// numbered before the sink, so every output gives the packet the same number
+		sd.seq++
+		dp.seq = sd.seq
+
+		sd.sink(dp)
+		sd.offset = nextOffset
+	}
+}
+
+// tell flowSequences where the decoder is, packets are only injected at the end of what it decoded
+func (sd *streamDecoder) publish() {
+	dp := sd.position()
+	buffered := len(sd.data) - sd.offset
+	if buffered < 0 {
+		buffered = 0
+	}
+	dp.consumed = sd.receivedBytes - uint64(buffered)
+	dp.known = dp.known && !sd.resyncing
+	sd.ss.sequences.decoded(sd.outbound, dp)
+}
+
+// add a segment and decode what it completes
+func (sd *streamDecoder) receive(segment shineSegment) {
+	sd.add(segment)
+	if sd.added != nil {
+		sd.added()
+	}
+	sd.decodeBuffered()
+}
+
+// decode segments until ctx is done, name is the decoder in the logs
+func (sd *streamDecoder) run(ctx context.Context, name string, segments <-chan shineSegment) {
+	ss := sd.ss
+	for {
+		select {
+		case <-ctx.Done():
+			log.Warningf("[%v %v] %v(): context was canceled", ss.net, ss.transport, name)
+			// decode the segments that were reassembled before the stream was completed
+			for {
+				select {
+				case segment := <-segments:
+					sd.receive(segment)
+				default:
+					// the other decoder may still be draining the packet with the key the buffer waits for
+					if sd.keys != nil && sd.ready != nil && !sd.ready() {
+						if o, ok := <-sd.keys; ok && sd.keyReceived(o) {
+							sd.decodeBuffered()
+						}
+						sd.keys = nil
+						continue
+					}
+					ss.endedMidPacket(sd.direction, len(sd.data)-sd.offset)
+					return
+				}
+			}
+		case o, ok := <-sd.keys:
+			if !ok {
+				// the other decoder is done, no key will come
+				sd.keys = nil
+				break
+			}
+			if !sd.keyReceived(o) {
+				break
+			}
+			sd.decodeBuffered()
+			sd.trim()
+		case segment := <-segments:
+			sd.receive(segment)
+			sd.trim()
+		case <-sd.watch.wedged:
+			ss.decoderWedged(sd.direction, sd.data, sd.offset, sd.state())
+			// whatever got the decoder there, start over from a packet boundary found in what is buffered
+			if sd.offset > len(sd.data) {
+				sd.offset = len(sd.data)
+			}
+			sd.restart()
+			sd.watch.packetDecoded()
+		}
+		// without a key or a packet boundary the decoder can only wait for more segments
+		sd.watch.setWaiting(sd.waiting())
+		if ss.sequences != nil {
+			sd.publish()
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// a decoder that meets a packet it can't make sense of resynchronizes and keeps draining its queue, with the block
+// overflow policy and a short queue a decoder that stopped would stall the capture
+func TestDecoderResynchronizes(t *testing.T) {
+	const following = 20
+	tests := []struct {
+		name      string
+		serverXor string
+		// what the server sends first, the packets after it are decoded
+		corrupted []byte
+	}{
+		{
+			name:      "corrupted length byte",
+			serverXor: "false",
+			// a long length header of 65535 bytes
+			corrupted: append([]byte{0, 0xff, 0xff}, EncodeShinePacket(opVersionAck, nil)...),
+		},
+		{
+			name:      "seed without the client xor offset",
+			serverXor: "false",
+			corrupted: EncodeShinePacket(opSeedAck, nil),
+		},
+		{
+			name:      "seed without the server xor offset",
+			serverXor: "true",
+			corrupted: seedPacket(testSeed),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			c.ServerXor = tt.serverXor
+			c.SegmentQueueSize = 4
+
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			if err := conv.FromServer(tt.corrupted, EncodeShinePacket(opVersionAck, nil)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < following; i++ {
+				if err := conv.FromServer(EncodeShinePacket(opLoginAck, []byte{byte(i)})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			sn, sink := runPipeline(t, c, ms)
+			if got := payloadsOf(sink.byDirection(), opLoginAck); len(got) != following {
+				t.Errorf("%v packets decoded after the bad one, expected %v", len(got), following)
+			}
+			summary := sn.Summary()
+			if len(summary) != 1 || summary[0].DecodeErrors != 1 {
+				t.Errorf("expected one flow with a decode error, got %+v", summary)
+			}
+		})
+	}
+}
+
+// segments holding several packets are decoded whole, in both directions
+func TestSeveralPacketsPerSegment(t *testing.T) {
+	const packets = 5
+	key, err := hex.DecodeString(testXorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	var fromServer, fromClient [][]byte
+	for i := 0; i < packets; i++ {
+		fromServer = append(fromServer, EncodeShinePacket(opLoginAck, []byte{byte(i)}))
+		fromClient = append(fromClient, EncodeShinePacket(opChatReq, []byte{byte(i), byte(i)}))
+	}
+	if err := conv.FromServer(append([][]byte{seedPacket(testSeed)}, fromServer...)...); err != nil {
+		t.Fatal(err)
+	}
+	conv.XorClient(XorSettings{Key: key, Limit: 350}, testSeed)
+	if err := conv.FromClient(fromClient...); err != nil {
+		t.Fatal(err)
+	}
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sink := runPipeline(t, testConfig(), ms)
+	events := sink.byDirection()
+	for _, opCode := range []uint16{opLoginAck, opChatReq} {
+		payloads := payloadsOf(events, opCode)
+		if len(payloads) != packets {
+			t.Fatalf("%v packets %v decoded, expected %v", len(payloads), opCode, packets)
+		}
+		for i, p := range payloads {
+			if p[0] != byte(i) {
+				t.Errorf("packet %v of %v has payload %x", i, opCode, p)
+			}
+		}
+	}
+}
+
+// a packet split across segments decodes as if it came whole, wherever the segments start, its length header included
+// every split is a connection of its own so they all go through one capture
+func TestPacketsSplitAcrossSegments(t *testing.T) {
+	long := make([]byte, 256)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	fromServer := [][]byte{seedPacket(testSeed), EncodeShinePacket(opLoginAck, long), EncodeShinePacket(opLoginAck, []byte{2})}
+	fromClient := [][]byte{EncodeShinePacket(opChatReq, []byte{1}), EncodeShinePacket(opChatReq, long), EncodeShinePacket(opChatReq, []byte{3})}
+
+	var serverStream, clientStream []byte
+	for _, p := range fromServer {
+		serverStream = append(serverStream, p...)
+	}
+	xs, xorOffset := testXorSettings(), testSeed
+	for _, p := range fromClient {
+		p = append([]byte(nil), p...)
+		skip := 1
+		if p[0] == 0 {
+			skip = 3
+		}
+		xs.cipher(p[skip:], &xorOffset)
+		clientStream = append(clientStream, p...)
+	}
+
+	// the segment boundaries of the split stream
+	splits := func(n int) [][]int {
+		var s [][]int
+		for i := 1; i < n; i++ {
+			s = append(s, []int{i})
+			// the middle segment holds part of a length header or a single byte of a packet
+			for _, middle := range []int{1, 2} {
+				if i+middle < n {
+					s = append(s, []int{i, i + middle})
+				}
+			}
+		}
+		return s
+	}
+	tests := []struct {
+		direction string
+		stream    []byte
+	}{
+		{"inbound", serverStream},
+		{"outbound", clientStream},
+	}
+
+	type connection struct {
+		direction  string
+		boundaries []int
+	}
+	connections := make(map[string]connection)
+	ms := NewMemorySource()
+	for _, tt := range tests {
+		for _, boundaries := range splits(len(tt.stream)) {
+			n := len(connections)
+			client := fmt.Sprintf("10.1.%v.%v:50000", n/250, n%250+1)
+			connections[client] = connection{tt.direction, boundaries}
+			conv, err := NewTCPConversation(ms, client, testServerAddr, testStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Open(); err != nil {
+				t.Fatal(err)
+			}
+
+			send := func(fromClient bool, stream []byte, boundaries []int) {
+				start := 0
+				for _, end := range append(boundaries, len(stream)) {
+					if err := conv.send(conv.tick(), fromClient, stream[start:end]); err != nil {
+						t.Fatal(err)
+					}
+					start = end
+				}
+			}
+			if tt.direction == "inbound" {
+				send(false, serverStream, boundaries)
+				send(true, clientStream, nil)
+			} else {
+				send(false, serverStream, nil)
+				send(true, clientStream, boundaries)
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expected := map[string][]string{
+		"inbound":  {fmt.Sprintf("%v %x", opSeedAck, fromServer[0][3:]), fmt.Sprintf("%v %x", opLoginAck, long), fmt.Sprintf("%v 02", opLoginAck)},
+		"outbound": {fmt.Sprintf("%v 01", opChatReq), fmt.Sprintf("%v %x", opChatReq, long), fmt.Sprintf("%v 03", opChatReq)},
+	}
+	c := testConfig()
+	c.SegmentQueueSize = 4096
+	_, sink := runPipeline(t, c, ms)
+	// in the order they were decoded, byDirection orders the packets of different flows by time
+	events := append([]PacketEvent(nil), sink.events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+	decoded := make(map[string]map[string][]string)
+	for _, pe := range events {
+		client := pe.Src
+		if pe.Direction == "inbound" {
+			client = pe.Dst
+		}
+		if decoded[client] == nil {
+			decoded[client] = make(map[string][]string)
+		}
+		decoded[client][pe.Direction] = append(decoded[client][pe.Direction], fmt.Sprintf("%v %x", pe.Packet.Base.OperationCode, pe.Packet.Base.Data))
+	}
+	for client, conn := range connections {
+		for _, direction := range []string{"inbound", "outbound"} {
+			got, want := decoded[client][direction], expected[direction]
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%v split at %v: %v packets decoded %v, expected %v", conn.direction, conn.boundaries, direction, got, want)
+			}
+		}
+	}
+}
+
+// each direction numbers its packets from 1 in stream order, decoding the same capture again gives the same numbers
+func TestPacketSeqByDirection(t *testing.T) {
+	decode := func() map[string]uint64 {
+		ms := NewMemorySource()
+		conv := openTestConversation(t, ms)
+		replayFixture(t, conv, readFixture(t, "handshake.hex"))
+		if err := conv.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, sink := runPipeline(t, testConfig(), ms)
+		seqs := make(map[string]uint64)
+		last := make(map[string]uint64)
+		for _, pe := range sink.byDirection() {
+			last[pe.Direction]++
+			if pe.Seq != last[pe.Direction] {
+				t.Errorf("%v %v is #%v, expected #%v", pe.Direction, pe.ID, pe.Seq, last[pe.Direction])
+			}
+			seqs[pe.ID] = pe.Seq
+		}
+		if last["outbound"] == 0 || last["inbound"] == 0 {
+			t.Fatalf("%v outbound and %v inbound packets decoded", last["outbound"], last["inbound"])
+		}
+		return seqs
+	}
+	first, again := decode(), decode()
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("decoded again as %v, expected %v", again, first)
+	}
+}
@@ -1,7 +1,6 @@
 package service
 
 import (
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/shine-o/shine.engine.core/structs"
@@ -22,9 +21,15 @@ type opCodeStructs struct {
 
 type ncRepresentation struct {
 	UnpackedData string `json:"unpacked_data"`
+	// the raw payload, only set if it couldn't be unpacked
+	Hex string `json:"hex,omitempty"`
+	// where each field of the struct is in the payload
+	Fields []Field `json:"fields,omitempty"`
+	// what earlier packets of the flow tell about this one, e.g the name of the character a handle belongs to
+	Context map[string]string `json:"context,omitempty"`
 }
 
-func generateOpCodeSwitch() {
+func generateOpCodeSwitch(s *session) {
 	type processedStructs struct {
 		List map[uint16]bool `json:"processedStructs"`
 	}
@@ -63,7 +68,7 @@ func generateOpCodeSwitch() {
 	ocs.mu.Unlock()
 	end := "}}"
 
-	pathName, err := filepath.Abs("output/opcodes-switch.go")
+	pathName, err := s.path("opcodes-switch.go")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -71,6 +76,7 @@ func generateOpCodeSwitch() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	s.register(pathName, artifactOpCodes)
 	_, err = f.Write([]byte(start + end))
 	if err != nil {
 		log.Fatal(err)
@@ -79,16 +85,10 @@ func generateOpCodeSwitch() {
 }
 
 func ncStructRepresentation(opCode uint16, data []byte) (ncRepresentation, error) {
+	if nc, ok := ncStructs.new(opCode); ok {
+		return ncStructData(nc, data)
+	}
 	switch opCode {
-	case 3173:
-		nc := structs.NcUserClientVersionCheckReq{}
-		return ncStructData(&nc, data)
-	case 3084:
-		nc := structs.NcUserWorldSelectAck{}
-		return ncStructData(&nc, data)
-	case 3162:
-		nc := structs.NcUserUsLoginReq{}
-		return ncStructData(&nc, data)
 	case 4153:
 		// NC_CHAR_CLIENT_SHAPE_CMD
 		nc := structs.NcCharClientShapeCmd{}
@@ -106,10 +106,6 @@ func ncStructRepresentation(opCode uint16, data []byte) (ncRepresentation, error
 		// NC_ACT_CHAT_REQ
 		nc := structs.NcActChatReq{}
 		return ncStructData(&nc, data)
-	case 2055:
-		// NC_MISC_SEED_ACK
-		nc := structs.NcMiscSeedAck{}
-		return ncStructData(&nc, data)
 	case 4154:
 		// NC_CHAR_CLIENT_QUEST_DOING_CMD
 		nc := structs.NcCharClientQuestDoingCmd{}
@@ -275,10 +271,6 @@ func ncStructRepresentation(opCode uint16, data []byte) (ncRepresentation, error
 		// NC_MAP_LOGOUT_CMD
 		nc := structs.MapLogoutCmd{}
 		return ncStructData(&nc, data)
-	case 3092:
-		// NC_USER_LOGINWORLD_ACK
-		nc := structs.NcUserLoginWorldAck{}
-		return ncStructData(&nc, data)
 	case 4387:
 		// NC_CHAR_USEITEM_MINIMON_INFO_CLIENT_CMD
 		nc := structs.CharUseItemMiniMonsterInfoClientCmd{}
@@ -295,10 +287,6 @@ func ncStructRepresentation(opCode uint16, data []byte) (ncRepresentation, error
 		// NC_CHARSAVE_UI_STATE_SAVE_REQ
 		nc := structs.NcCharUiStateSaveReq{}
 		return ncStructData(&nc, data)
-	case 3082:
-		// NC_USER_LOGIN_ACK
-		nc := structs.NcUserLoginAck{}
-		return ncStructData(&nc, data)
 	case 4099:
 		// NC_CHAR_LOGIN_ACK
 		nc := structs.NcCharLoginAck{}
@@ -384,10 +372,6 @@ func ncStructRepresentation(opCode uint16, data []byte) (ncRepresentation, error
 		// NC_ITEM_REWARDINVENOPEN_ACK
 		nc := structs.NcItemRewardInventoryOpenAck{}
 		return ncStructData(&nc, data)
-	case 3087:
-		// NC_USER_LOGINWORLD_REQ
-		nc := structs.NcUserLoginWorldReq{}
-		return ncStructData(&nc, data)
 	case 12320:
 		// NC_ITEM_CHARGEDINVENOPEN_REQ
 		nc := structs.NcITemChargedInventoryOpenReq{}
@@ -1123,14 +1107,9 @@ func ncStructRepresentation(opCode uint16, data []byte) (ncRepresentation, error
 func ncStructData(nc interface{}, data []byte) (ncRepresentation, error) {
 	err := structs.Unpack(data, nc)
 	if err != nil {
-		log.Error(err)
-		n, err := restruct.SizeOf(nc)
-		if err != nil {
-			log.Error(err)
-		}
-		hexString := hex.EncodeToString(data)
-		log.Error(hexString)
-		log.Errorf("struct: %v, size: %v", reflect.TypeOf(nc).String(), n)
+		// short or malformed payloads are expected now and then, the caller falls back to hex
+		n, _ := restruct.SizeOf(nc)
+		log.Warningf("unpacking %v bytes into struct: %v, size: %v: %v", len(data), reflect.TypeOf(nc).String(), n, err)
 		return ncRepresentation{}, err
 	}
 
@@ -1140,6 +1119,7 @@ func ncStructData(nc interface{}, data []byte) (ncRepresentation, error) {
 	}
 	nr := ncRepresentation{
 		UnpackedData: string(sd),
+		Fields:       structFields(nc),
 	}
 
 	return nr, nil
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// markers kept per session, the notable packets after that are only counted
+const maxTimelineMarkers = 10000
+
+// Timeline is a session as flows opened and closed over time, with a marker for every packet of
+// protocol.timelineOpcodes, built from the session bookkeeping as packets are handled
+type Timeline struct {
+	SessionID string    `json:"sessionID"`
+	ClientIP  string    `json:"clientIP"`
+	Started   time.Time `json:"started"`
+	// the last flow event or marker of the session, open flows are drawn up to it
+	Ended  time.Time      `json:"ended"`
+	Closed bool           `json:"closed"`
+	Flows  []TimelineFlow `json:"flows"`
+	// notable packets past maxTimelineMarkers, left out of Markers
+	MarkersDropped int `json:"markersDropped"`
+}
+
+// TimelineFlow is the interval of a flow, Completed is nil while the flow is open
+type TimelineFlow struct {
+	FlowID    string           `json:"flowID"`
+	FlowName  string           `json:"flowName"`
+	Opened    time.Time        `json:"opened"`
+	Completed *time.Time       `json:"completed"`
+	Markers   []TimelineMarker `json:"markers"`
+}
+
+// TimelineMarker is a packet of protocol.timelineOpcodes
+type TimelineMarker struct {
+	Seen          time.Time `json:"seen"`
+	Direction     string    `json:"direction"`
+	OperationCode uint16    `json:"operationCode"`
+	Command       string    `json:"command"`
+}
+
+// keep a marker for pe if its operation code is notable
+func (s *sessions) mark(pe PacketEvent) {
+	if !s.timelineOpCodes[pe.Packet.Base.OperationCode] {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.all[pe.SessionID]
+	if !ok {
+		return
+	}
+	if session.markerCount == maxTimelineMarkers {
+		session.markersDropped++
+		return
+	}
+	if session.markers == nil {
+		session.markers = make(map[string][]TimelineMarker)
+	}
+	session.markers[pe.FlowID] = append(session.markers[pe.FlowID], TimelineMarker{
+		Seen:          pe.Seen,
+		Direction:     pe.Direction,
+		OperationCode: pe.Packet.Base.OperationCode,
+		Command:       pe.Packet.Base.ClientStructName,
+	})
+	session.markerCount++
+	if pe.Seen.After(session.lastMarker) {
+		session.lastMarker = pe.Seen
+	}
+}
+
+// the timeline of a session, false if there is no such session
+func (s *sessions) timeline(sessionID string, now time.Time) (Timeline, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !now.IsZero() {
+		s.expire(now)
+	}
+	session, ok := s.all[sessionID]
+	if !ok {
+		return Timeline{}, false
+	}
+
+	t := Timeline{
+		SessionID:      session.ID,
+		ClientIP:       session.ClientIP,
+		Started:        session.Started,
+		Ended:          session.LastSeen,
+		Closed:         session.Closed,
+		Flows:          make([]TimelineFlow, 0, len(session.Flows)),
+		MarkersDropped: session.markersDropped,
+	}
+	if session.lastMarker.After(t.Ended) {
+		t.Ended = session.lastMarker
+	}
+	if t.Ended.Before(t.Started) {
+		t.Ended = t.Started
+	}
+	for _, f := range session.Flows {
+		tf := TimelineFlow{
+			FlowID:   f.FlowID,
+			FlowName: f.FlowName,
+			Opened:   f.Opened,
+			Markers:  append([]TimelineMarker{}, session.markers[f.FlowID]...),
+		}
+		if !f.Completed.IsZero() {
+			completed := f.Completed
+			tf.Completed = &completed
+		}
+		// packets of several workers may have been handled out of order
+		sort.SliceStable(tf.Markers, func(i, j int) bool {
+			return tf.Markers[i].Seen.Before(tf.Markers[j].Seen)
+		})
+		t.Flows = append(t.Flows, tf)
+	}
+	return t, true
+}
+
+// GET /api/timeline?session=... shows the flows of a session as intervals with their protocol.timelineOpcodes packets
+func (sn *Sniffer) timelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := r.URL.Query().Get("session")
+	if sessionID == "" {
+		http.Error(w, "session: missing, see /api/sessions", http.StatusBadRequest)
+		return
+	}
+	var now time.Time
+	if sn.config.PcapFile == "" {
+		now = time.Now()
+	}
+	t, ok := sn.sessions.timeline(sessionID, now)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, t)
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"github.com/shine-o/shine.engine.core/networking"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flows are intervals of the session, their notable packets markers ordered by time
+func TestTimeline(t *testing.T) {
+	s := newSessions(time.Minute, map[uint16]bool{opLoginReq: true, opLoginAck: true}, nil)
+	login, world := sessionStream("login", "192.168.1.20"), sessionStream("world", "192.168.1.20")
+	login.sessionID = s.flowOpened(login, testStart)
+	world.sessionID = s.flowOpened(world, testStart.Add(2*time.Second))
+	s.flowCompleted(login, testStart.Add(3*time.Second))
+
+	mark := func(ss *shineStream, opCode uint16, direction string, at time.Duration) {
+		s.mark(PacketEvent{
+			SessionID: ss.sessionID,
+			FlowID:    ss.flowID,
+			Direction: direction,
+			Seen:      testStart.Add(at),
+			Packet:    &networking.Command{Base: networking.CommandBase{OperationCode: opCode, ClientStructName: "NC"}},
+		})
+	}
+	// handled out of order by two workers
+	mark(login, opLoginAck, "inbound", 1500*time.Millisecond)
+	mark(login, opLoginReq, "outbound", time.Second)
+	mark(login, opChatReq, "outbound", 1200*time.Millisecond)
+	mark(world, opLoginReq, "outbound", 5*time.Second)
+	// a packet of no session isn't kept
+	s.mark(PacketEvent{SessionID: "nothing", Packet: &networking.Command{Base: networking.CommandBase{OperationCode: opLoginReq}}})
+
+	tl, ok := s.timeline(login.sessionID, time.Time{})
+	if !ok {
+		t.Fatal("no timeline for the session")
+	}
+	completed := testStart.Add(3 * time.Second)
+	expected := Timeline{
+		SessionID: login.sessionID,
+		ClientIP:  "192.168.1.20",
+		Started:   testStart,
+		// the last marker is after the last flow event
+		Ended: testStart.Add(5 * time.Second),
+		Flows: []TimelineFlow{
+			{
+				FlowID:    "login",
+				FlowName:  "login-client",
+				Opened:    testStart,
+				Completed: &completed,
+				Markers: []TimelineMarker{
+					{Seen: testStart.Add(time.Second), Direction: "outbound", OperationCode: opLoginReq, Command: "NC"},
+					{Seen: testStart.Add(1500 * time.Millisecond), Direction: "inbound", OperationCode: opLoginAck, Command: "NC"},
+				},
+			},
+			{
+				FlowID:   "world",
+				FlowName: "login-client",
+				Opened:   testStart.Add(2 * time.Second),
+				Markers: []TimelineMarker{
+					{Seen: testStart.Add(5 * time.Second), Direction: "outbound", OperationCode: opLoginReq, Command: "NC"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(tl, expected) {
+		t.Errorf("timeline\n%+v\nexpected\n%+v", tl, expected)
+	}
+	if _, ok := s.timeline("nothing", time.Time{}); ok {
+		t.Error("a timeline for a session that doesn't exist")
+	}
+}
+
+// markers past maxTimelineMarkers are only counted
+func TestTimelineMarkersDropped(t *testing.T) {
+	s := newSessions(time.Minute, map[uint16]bool{opChatReq: true}, nil)
+	ss := sessionStream("zone", "192.168.1.20")
+	ss.sessionID = s.flowOpened(ss, testStart)
+	for i := 0; i < maxTimelineMarkers+3; i++ {
+		s.mark(PacketEvent{
+			SessionID: ss.sessionID,
+			FlowID:    ss.flowID,
+			Seen:      testStart.Add(time.Duration(i) * time.Millisecond),
+			Packet:    &networking.Command{Base: networking.CommandBase{OperationCode: opChatReq}},
+		})
+	}
+	tl, _ := s.timeline(ss.sessionID, time.Time{})
+	if n := len(tl.Flows[0].Markers); n != maxTimelineMarkers || tl.MarkersDropped != 3 {
+		t.Errorf("%v markers, %v dropped, expected %v and 3", n, tl.MarkersDropped, maxTimelineMarkers)
+	}
+}
+
+func TestTimelineHandler(t *testing.T) {
+	sn, err := NewSniffer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := sessionStream("login", "192.168.1.20")
+	ss.sessionID = sn.sessions.flowOpened(ss, time.Now())
+	tests := []struct {
+		method, query string
+		status        int
+	}{
+		{http.MethodGet, "session=" + ss.sessionID, http.StatusOK},
+		{http.MethodGet, "", http.StatusBadRequest},
+		{http.MethodGet, "session=nothing", http.StatusNotFound},
+		{http.MethodPost, "session=" + ss.sessionID, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		sn.timelineHandler(w, httptest.NewRequest(tt.method, "/api/timeline?"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("%v %q: status %v, expected %v", tt.method, tt.query, w.Code, tt.status)
+		}
+	}
+}
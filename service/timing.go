@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/csv"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// intervals kept per flow name and operation code for the percentiles, a random sample of them past this
+const timingSamples = 10000
+
+// the last packet of a stream and of each of its operation codes
+type streamTiming struct {
+	last    time.Time
+	opCodes map[uint16]time.Time
+}
+
+type intervalKey struct {
+	flowName string
+	opCode   uint16
+}
+
+// intervalSamples is a reservoir of the intervals between packets of an operation code
+type intervalSamples struct {
+	seen    int
+	samples []time.Duration
+}
+
+func (is *intervalSamples) add(d time.Duration) {
+	is.seen++
+	if len(is.samples) < timingSamples {
+		is.samples = append(is.samples, d)
+		return
+	}
+	if i := rand.Intn(is.seen); i < timingSamples {
+		is.samples[i] = d
+	}
+}
+
+// IntervalPercentiles sums up the time between consecutive packets of an operation code in the streams of a flow
+type IntervalPercentiles struct {
+	Intervals int     `json:"intervals"`
+	P50       float64 `json:"p50Ms"`
+	P95       float64 `json:"p95Ms"`
+	P99       float64 `json:"p99Ms"`
+}
+
+// nearest rank percentiles, in milliseconds
+func (is *intervalSamples) percentiles() *IntervalPercentiles {
+	sorted := make([]time.Duration, len(is.samples))
+	copy(sorted, is.samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	at := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return float64(sorted[i]) / float64(time.Millisecond)
+	}
+	return &IntervalPercentiles{
+		Intervals: is.seen,
+		P50:       at(0.50),
+		P95:       at(0.95),
+		P99:       at(0.99),
+	}
+}
+
+// packetTiming writes a row per handled packet to timing.csv in the session directory, with the time since the previous packet
+// of its stream and since the previous one of its operation code, both from capture timestamps
+// with more than one protocol.workers packets of a stream are handled out of order, so a delta can be negative
+type packetTiming struct {
+	f         io.Closer
+	w         *csv.Writer
+	streams   map[string]*streamTiming
+	intervals map[intervalKey]*intervalSamples
+	mu        sync.Mutex
+}
+
+func newPacketTiming(s *session) (*packetTiming, error) {
+	pathName, err := s.path("timing.csv")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(pathName)
+	if err != nil {
+		return nil, err
+	}
+	s.register(pathName, artifactTimingCSV)
+	pt := &packetTiming{
+		f:         f,
+		w:         csv.NewWriter(f),
+		streams:   make(map[string]*streamTiming),
+		intervals: make(map[intervalKey]*intervalSamples),
+	}
+	pt.w.Write([]string{"flowID", "flowName", "direction", "operationCode", "seenUs", "flowDeltaUs", "opCodeDeltaUs", "packetID", "seq"})
+	return pt, nil
+}
+
+// deltas are left empty for the first packet of a stream and of an operation code
+func (pt *packetTiming) observe(pe PacketEvent) {
+	if pt == nil {
+		return
+	}
+	opCode := pe.Packet.Base.OperationCode
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	st, ok := pt.streams[pe.FlowID]
+	if !ok {
+		st = &streamTiming{opCodes: make(map[uint16]time.Time)}
+		pt.streams[pe.FlowID] = st
+	}
+	var flowDelta, opCodeDelta string
+	if !st.last.IsZero() {
+		flowDelta = strconv.FormatInt(int64(pe.Seen.Sub(st.last)/time.Microsecond), 10)
+	}
+	if last, ok := st.opCodes[opCode]; ok {
+		d := pe.Seen.Sub(last)
+		opCodeDelta = strconv.FormatInt(int64(d/time.Microsecond), 10)
+
+		key := intervalKey{flowName: pe.FlowName, opCode: opCode}
+		is, ok := pt.intervals[key]
+		if !ok {
+			is = &intervalSamples{}
+			pt.intervals[key] = is
+		}
+		is.add(d)
+	}
+	st.last = pe.Seen
+	st.opCodes[opCode] = pe.Seen
+
+	err := pt.w.Write([]string{
+		pe.FlowID,
+		pe.FlowName,
+		pe.Direction,
+		strconv.Itoa(int(opCode)),
+		strconv.FormatInt(pe.Seen.UnixNano()/int64(time.Microsecond), 10),
+		flowDelta,
+		opCodeDelta,
+		pe.ID,
+		strconv.FormatUint(pe.Seq, 10),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// forget the last packets of a stream once all of them were handled
+func (pt *packetTiming) streamDone(flowID string) {
+	if pt == nil {
+		return
+	}
+	pt.mu.Lock()
+	delete(pt.streams, flowID)
+	pt.mu.Unlock()
+}
+
+// add the interval percentiles to the operation codes of the summaries
+func (pt *packetTiming) summarize(flows []FlowSummary) {
+	if pt == nil {
+		return
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for i := range flows {
+		for j := range flows[i].OpCodes {
+			oc := &flows[i].OpCodes[j]
+			if is, ok := pt.intervals[intervalKey{flowName: flows[i].FlowName, opCode: oc.OperationCode}]; ok {
+				oc.Interval = is.percentiles()
+			}
+		}
+	}
+}
+
+func (pt *packetTiming) close() {
+	if pt == nil {
+		return
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.w.Flush()
+	if err := pt.w.Error(); err != nil {
+		log.Error(err)
+	}
+	if err := pt.f.Close(); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"encoding/csv"
+	"github.com/shine-o/shine.engine.core/networking"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// the rows of timing.csv have the time since the previous packet of the stream and of the operation code
+func TestPacketTimingRows(t *testing.T) {
+	s := &session{dir: t.TempDir()}
+	pt, err := newPacketTiming(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := func(flowID string, opCode uint16, ms int) PacketEvent {
+		return PacketEvent{
+			FlowID:    flowID,
+			FlowName:  "zone-client",
+			Direction: "outbound",
+			Seen:      testStart.Add(time.Duration(ms) * time.Millisecond),
+			Packet:    &networking.Command{Base: networking.CommandBase{OperationCode: opCode}},
+		}
+	}
+	pt.observe(packet("a", opChatReq, 0))
+	pt.observe(packet("a", opLoginReq, 5))
+	pt.observe(packet("b", opChatReq, 6))
+	pt.observe(packet("a", opChatReq, 20))
+	pt.streamDone("a")
+	// the stream starts over once it was done
+	pt.observe(packet("a", opChatReq, 30))
+	pt.close()
+
+	f, err := os.Open(filepath.Join(s.dir, "timing.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, r := range records[1:] {
+		// flowID, operation code, flow delta and operation code delta
+		got = append(got, []string{r[0], r[3], r[5], r[6]})
+	}
+	chat, login := strconv.Itoa(int(opChatReq)), strconv.Itoa(int(opLoginReq))
+	expected := [][]string{
+		{"a", chat, "", ""},
+		{"a", login, "5000", ""},
+		{"b", chat, "", ""},
+		{"a", chat, "15000", "20000"},
+		{"a", chat, "", ""},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("rows %v, expected %v", got, expected)
+	}
+}
+
+// the percentiles are nearest rank over the intervals of a flow name and operation code
+func TestPacketTimingPercentiles(t *testing.T) {
+	pt, err := newPacketTiming(&session{dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.close()
+	seen := testStart
+	for i := 0; i <= 100; i++ {
+		// intervals of 1 to 100 ms
+		seen = seen.Add(time.Duration(i) * time.Millisecond)
+		pt.observe(PacketEvent{
+			FlowID:   "a",
+			FlowName: "zone-client",
+			Seen:     seen,
+			Packet:   &networking.Command{Base: networking.CommandBase{OperationCode: opChatReq}},
+		})
+	}
+
+	flows := []FlowSummary{{FlowName: "zone-client", OpCodes: []OpCodeCount{{OperationCode: opChatReq}, {OperationCode: opLoginReq}}}}
+	pt.summarize(flows)
+	expected := IntervalPercentiles{Intervals: 100, P50: 50, P95: 95, P99: 99}
+	if p := flows[0].OpCodes[0].Interval; p == nil || *p != expected {
+		t.Errorf("percentiles %+v, expected %+v", p, expected)
+	}
+	if p := flows[0].OpCodes[1].Interval; p != nil {
+		t.Errorf("percentiles %+v of an operation code without intervals", p)
+	}
+
+	var none *packetTiming
+	none.observe(PacketEvent{})
+	none.summarize(flows)
+}
@@ -0,0 +1,460 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/gdamore/tcell"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packets kept for every flow in the packet pane, older ones scroll out
+const tuiPacketsPerFlow = 1000
+
+// packets waiting for the tui to draw them, the stream workers drop packets instead of waiting for a slow terminal
+const tuiQueueSize = 4096
+
+// how often the flow list and the stats footer are refreshed
+const tuiRefresh = 250 * time.Millisecond
+
+// the tcell colors of flowColors, in the same order
+var tuiFlowColors = []tcell.Color{
+	tcell.ColorAqua, tcell.ColorYellow, tcell.ColorFuchsia, tcell.ColorLime, tcell.ColorBlue, tcell.ColorRed,
+	tcell.ColorTeal, tcell.ColorOlive, tcell.ColorPurple, tcell.ColorGreen, tcell.ColorNavy, tcell.ColorMaroon,
+}
+
+// tui is the terminal interface of sniffer capture --tui: the flows on the left, the packets of the selected flow on the
+// right and the stats in the footer, for hosts without a browser
+// it is fed the packets handed to the Sniffer's Handler, as the websocket, everything else is only touched by run
+type tui struct {
+	sn     *Sniffer
+	screen tcell.Screen
+	color  bool
+
+	packets chan PacketEvent
+	dropped uint64
+
+	quit     chan struct{}
+	quitOnce sync.Once
+	stopping chan struct{}
+	stopOnce sync.Once
+	exited   chan struct{}
+
+	flows    []flowView
+	byFlow   map[string][]PacketEvent
+	selected string
+	// the packet pane has the focus instead of the flow list
+	packetFocus bool
+	// lines scrolled up from the last packet, 0 follows new packets
+	scroll  int
+	hexDump bool
+	// the operation code typed after /, only its packets are shown when filtering
+	filtering bool
+	filter    uint16
+	typing    bool
+	input     string
+	inputErr  string
+}
+
+func newTUI(sn *Sniffer, noColor bool) (*tui, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, fmt.Errorf("tui: %v", err)
+	}
+	if err := screen.Init(); err != nil {
+		return nil, fmt.Errorf("tui: %v", err)
+	}
+	screen.HideCursor()
+	return &tui{
+		sn:     sn,
+		screen: screen,
+		// terminals without colors report less than 8, the tui only relies on reverse video there
+		color:    !noColor && screen.Colors() >= 8,
+		packets:  make(chan PacketEvent, tuiQueueSize),
+		quit:     make(chan struct{}),
+		stopping: make(chan struct{}),
+		exited:   make(chan struct{}),
+		byFlow:   make(map[string][]PacketEvent),
+	}, nil
+}
+
+// hand a decoded packet to the tui, called by the stream workers
+func (t *tui) packet(pe PacketEvent) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.packets <- pe:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// closed once q or ctrl+c is pressed, nil without a tui so the capture loop never selects it
+func (t *tui) done() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	return t.quit
+}
+
+// restore the terminal, waiting for run to return
+func (t *tui) stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.stopping)
+	})
+	<-t.exited
+}
+
+// draw the tui and handle the keys until stop
+func (t *tui) run() {
+	defer close(t.exited)
+	defer t.screen.Fini()
+
+	events := make(chan tcell.Event)
+	go func() {
+		for {
+			// nil once the screen is finalized
+			ev := t.screen.PollEvent()
+			if ev == nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-t.stopping:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	t.refresh()
+	for {
+		select {
+		case <-t.stopping:
+			return
+		case pe := <-t.packets:
+			t.add(pe)
+		case <-ticker.C:
+			t.refresh()
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *tcell.EventKey:
+				t.key(ev)
+			case *tcell.EventResize:
+				t.screen.Sync()
+			}
+			t.draw()
+		}
+	}
+}
+
+func (t *tui) add(pe PacketEvent) {
+	packets := append(t.byFlow[pe.FlowID], pe)
+	if len(packets) > tuiPacketsPerFlow {
+		packets = packets[len(packets)-tuiPacketsPerFlow:]
+	}
+	t.byFlow[pe.FlowID] = packets
+	if t.selected == "" {
+		t.selected = pe.FlowID
+	}
+}
+
+// take the flows from the sniffer again, the packets of the flows that are gone are dropped unless their flow is selected
+func (t *tui) refresh() {
+	t.flows = t.sn.flowViews()
+	active := make(map[string]bool, len(t.flows))
+	for _, fv := range t.flows {
+		active[fv.FlowID] = true
+	}
+	for flowID := range t.byFlow {
+		if !active[flowID] && flowID != t.selected {
+			delete(t.byFlow, flowID)
+		}
+	}
+	if t.selected == "" && len(t.flows) > 0 {
+		t.selected = t.flows[0].FlowID
+	}
+	t.draw()
+}
+
+func (t *tui) quitting() {
+	t.quitOnce.Do(func() {
+		close(t.quit)
+	})
+}
+
+func (t *tui) key(ev *tcell.EventKey) {
+	if ev.Key() == tcell.KeyCtrlC {
+		t.quitting()
+		return
+	}
+	if t.typing {
+		t.typeFilter(ev)
+		return
+	}
+	_, height := t.screen.Size()
+	switch ev.Key() {
+	case tcell.KeyTab:
+		t.packetFocus = !t.packetFocus
+	case tcell.KeyUp:
+		t.move(-1)
+	case tcell.KeyDown:
+		t.move(1)
+	case tcell.KeyPgUp:
+		t.scroll += height - 3
+	case tcell.KeyPgDn:
+		t.scroll -= height - 3
+	case tcell.KeyEnd:
+		t.scroll = 0
+	case tcell.KeyCtrlL:
+		t.screen.Sync()
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			t.quitting()
+		case 'k':
+			t.move(-1)
+		case 'j':
+			t.move(1)
+		case 'G':
+			t.scroll = 0
+		case 'p', ' ':
+			if !t.sn.Pause() {
+				t.sn.Resume()
+			}
+		case 'x':
+			t.hexDump = !t.hexDump
+			t.scroll = 0
+		case '/':
+			t.typing = true
+			t.input = ""
+			t.inputErr = ""
+		}
+	}
+	if t.scroll < 0 {
+		t.scroll = 0
+	}
+}
+
+// up and down select a flow in the flow list, scroll the packets in the packet pane
+func (t *tui) move(by int) {
+	if t.packetFocus {
+		// the packet pane counts lines from the bottom
+		t.scroll -= by
+		return
+	}
+	if len(t.flows) == 0 {
+		return
+	}
+	i := 0
+	for j, fv := range t.flows {
+		if fv.FlowID == t.selected {
+			i = j + by
+		}
+	}
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(t.flows) {
+		i = len(t.flows) - 1
+	}
+	t.selected = t.flows[i].FlowID
+	t.scroll = 0
+}
+
+// the operation code after /, in decimal or 0x hex, enter applies it, an empty one clears the filter, esc cancels
+func (t *tui) typeFilter(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEscape:
+		t.typing = false
+	case tcell.KeyEnter:
+		t.typing = false
+		if t.input == "" {
+			t.filtering = false
+			break
+		}
+		opCode, err := strconv.ParseUint(t.input, 0, 16)
+		if err != nil {
+			t.inputErr = fmt.Sprintf("%q is not an operation code", t.input)
+			break
+		}
+		t.filtering, t.filter, t.scroll = true, uint16(opCode), 0
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if t.input != "" {
+			t.input = t.input[:len(t.input)-1]
+		}
+	case tcell.KeyRune:
+		t.input += string(ev.Rune())
+	}
+}
+
+func (t *tui) flowStyle(flowName string) tcell.Style {
+	if !t.color {
+		return tcell.StyleDefault
+	}
+	return tcell.StyleDefault.Foreground(tuiFlowColors[flowColor(flowName)])
+}
+
+// write s from x on line y, cut at width, returns where it stopped
+func (t *tui) text(x, y, width int, style tcell.Style, s string) int {
+	end := x + width
+	for _, r := range s {
+		if x >= end {
+			break
+		}
+		t.screen.SetContent(x, y, r, nil, style)
+		x++
+	}
+	return x
+}
+
+// fill line y from x to width with spaces of style, for the selected flow and the footer
+func (t *tui) fill(x, y, width int, style tcell.Style) {
+	for ; x < width; x++ {
+		t.screen.SetContent(x, y, ' ', nil, style)
+	}
+}
+
+type tuiLine struct {
+	style tcell.Style
+	text  string
+}
+
+// the lines of the packet pane for the selected flow, a packet per line and its hex dump below it when toggled
+func (t *tui) packetLines() []tuiLine {
+	var lines []tuiLine
+	for _, fv := range t.flows {
+		if fv.FlowID == t.selected && fv.Transport == "udp" {
+			return []tuiLine{{tcell.StyleDefault, "udp datagrams are not decoded, the web UI shows them"}}
+		}
+	}
+	for _, pe := range t.byFlow[t.selected] {
+		if t.filtering && pe.Packet.Base.OperationCode != t.filter {
+			continue
+		}
+		arrow, style := "->", tcell.StyleDefault
+		if pe.Direction == "inbound" {
+			arrow = "<-"
+			if t.color {
+				style = style.Foreground(tcell.ColorTeal)
+			}
+		}
+		lines = append(lines, tuiLine{style, fmt.Sprintf("%v %v %-40v %5v %6vB",
+			pe.Seen.Format("15:04:05.000"), arrow, pe.Packet.Base.ClientStructName, pe.Packet.Base.OperationCode, len(pe.Packet.Base.Data))})
+		if !t.hexDump {
+			continue
+		}
+		dim := tcell.StyleDefault
+		if t.color {
+			dim = dim.Foreground(tcell.ColorGray)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(hex.Dump(pe.Packet.Base.Data), "\n"), "\n") {
+			lines = append(lines, tuiLine{dim, "  " + l})
+		}
+	}
+	return lines
+}
+
+func (t *tui) draw() {
+	s := t.screen
+	s.Clear()
+	width, height := s.Size()
+	if width < 20 || height < 4 {
+		s.Show()
+		return
+	}
+	bar := tcell.StyleDefault.Reverse(true)
+	listWidth := width / 3
+	if listWidth > 40 {
+		listWidth = 40
+	}
+	paneTop, paneHeight := 1, height-2
+
+	// header
+	t.fill(0, 0, width, bar)
+	title := "flows"
+	if t.packetFocus {
+		title = "packets"
+	}
+	header := fmt.Sprintf(" shine sniffer  [%v]", title)
+	if t.filtering {
+		header += fmt.Sprintf("  opcode %v", t.filter)
+	}
+	if t.hexDump {
+		header += "  hex"
+	}
+	if t.sn.Paused() {
+		header += "  PAUSED"
+	}
+	t.text(0, 0, width, bar, header)
+
+	// flow list
+	for i, fv := range t.flows {
+		if i >= paneHeight {
+			break
+		}
+		style := t.flowStyle(fv.FlowName)
+		if fv.FlowID == t.selected {
+			style = style.Reverse(true)
+			t.fill(0, paneTop+i, listWidth-1, style)
+		}
+		t.text(0, paneTop+i, listWidth-1, style, fmt.Sprintf("%-16v %v %v", fv.FlowName, fv.Transport, fv.Packets))
+	}
+	for y := paneTop; y < paneTop+paneHeight; y++ {
+		s.SetContent(listWidth-1, y, '|', nil, tcell.StyleDefault)
+	}
+
+	// packet pane, the last lines unless scrolled up
+	lines := t.packetLines()
+	if top := len(lines) - paneHeight; t.scroll > top {
+		t.scroll = top
+		if t.scroll < 0 {
+			t.scroll = 0
+		}
+	}
+	first := len(lines) - paneHeight - t.scroll
+	if first < 0 {
+		first = 0
+	}
+	for i := 0; i < paneHeight && first+i < len(lines); i++ {
+		l := lines[first+i]
+		t.text(listWidth+1, paneTop+i, width-listWidth-1, l.style, l.text)
+	}
+
+	// footer
+	y := height - 1
+	t.fill(0, y, width, bar)
+	if t.typing {
+		t.text(0, y, width, bar, " opcode (enter to apply, empty to clear, esc to cancel): "+t.input)
+		s.Show()
+		return
+	}
+	t.sn.metrics.mu.Lock()
+	kernel := t.sn.metrics.kernel
+	t.sn.metrics.mu.Unlock()
+	footer := fmt.Sprintf(" captured %v  decoded %v  flows %v  kernel dropped %v",
+		atomic.LoadUint64(&t.sn.captured), atomic.LoadUint64(&t.sn.decoded), len(t.flows), kernel.lost())
+	if t.sn.Paused() {
+		footer += fmt.Sprintf("  suppressed %v", atomic.LoadUint64(&t.sn.suppressed))
+	}
+	if dropped := atomic.LoadUint64(&t.dropped); dropped > 0 {
+		footer += fmt.Sprintf("  tui dropped %v", dropped)
+	}
+	if t.inputErr != "" {
+		footer += "  " + t.inputErr
+	}
+	x := t.text(0, y, width, bar, footer)
+	keys := "q quit  p pause  / opcode  x hex  tab focus "
+	if x+len(keys)+2 <= width {
+		t.text(width-len(keys), y, len(keys), bar, keys)
+	}
+	s.Show()
+}
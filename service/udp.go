@@ -0,0 +1,293 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpFlow is the datagrams exchanged between a client and a protocol.udpServices port, e.g latency pings
+// datagrams are not reassembled nor decoded, they are timestamped, counted and shown as hex
+type udpFlow struct {
+	flowID   string
+	flowName string
+	// oriented from the client to the service
+	net, transport gopacket.Flow
+	packets        int
+	bytes          int
+	firstSeen      time.Time
+	lastSeen       time.Time
+	recent         []packetSummary
+}
+
+// udpFlows are keyed by their client to service 4-tuple, only touched by the capture goroutine and the http api
+type udpFlows struct {
+	// port => service name
+	services map[int]string
+	timeout  time.Duration
+	flows    map[string]*udpFlow
+	// the UI clients the flows are sent to and the pseudonyms of their addresses
+	ws        *webSockets
+	anonymous *anonymizer
+	mu        sync.Mutex
+}
+
+func newUDPFlows(services map[int]string, timeout time.Duration, ws *webSockets, a *anonymizer) *udpFlows {
+	if len(services) == 0 {
+		return nil
+	}
+	return &udpFlows{
+		services:  services,
+		timeout:   timeout,
+		flows:     make(map[string]*udpFlow),
+		ws:        ws,
+		anonymous: a,
+	}
+}
+
+// datagramView is sent to the UI for every datagram of a udp flow, as a datagram message
+type datagramView struct {
+	FlowID    string       `json:"flowID"`
+	FlowName  string       `json:"flowName"`
+	Transport string       `json:"transport"`
+	TimeStamp string       `json:"timestamp"`
+	Direction string       `json:"direction"`
+	Src       string       `json:"src"`
+	Dst       string       `json:"dst"`
+	Length    int          `json:"length"`
+	Hex       string       `json:"hex"`
+	HexDump   []HexDumpRow `json:"hexDump"`
+}
+
+// the flow a datagram belongs to and whether the client sent it, false if neither port is a udp service
+func (uf *udpFlows) flow(network gopacket.Flow, udp *layers.UDP, seen time.Time) (*udpFlow, bool, bool) {
+	srcPort, dstPort := int(udp.SrcPort), int(udp.DstPort)
+	transport := udp.TransportFlow()
+
+	fromClient := true
+	service, ok := uf.services[dstPort]
+	if !ok {
+		if service, ok = uf.services[srcPort]; !ok {
+			return nil, false, false
+		}
+		fromClient = false
+		network, transport = network.Reverse(), transport.Reverse()
+	}
+
+	key := fmt.Sprintf("%v %v", network, transport)
+	f, ok := uf.flows[key]
+	if !ok {
+		f = &udpFlow{
+			flowID:    streamFlowID(network, transport, seen),
+			flowName:  fmt.Sprintf("%v-udp", service),
+			net:       network,
+			transport: transport,
+			firstSeen: seen,
+		}
+		uf.flows[key] = f
+		uf.anonymous.endpoints(network, false)
+		log.Infof("[%v] new udp flow [ %v ] [ %v ]", f.flowName, network, transport)
+		uf.ws.sendFlowEvent(f.event(uf.anonymous, true))
+	}
+	return f, fromClient, true
+}
+
+// count a datagram and hand it to the UI, datagrams of ports that aren't udp services are ignored
+func (sn *Sniffer) datagram(network gopacket.Flow, udp *layers.UDP, ci gopacket.CaptureInfo) {
+	uf := sn.udp
+	uf.mu.Lock()
+	f, fromClient, ok := uf.flow(network, udp, ci.Timestamp)
+	if !ok {
+		uf.mu.Unlock()
+		return
+	}
+	direction := "inbound"
+	src, dst := srcAddress(f.net, f.transport), dstAddress(f.net, f.transport)
+	if fromClient {
+		direction = "outbound"
+	} else {
+		src, dst = dst, src
+	}
+	f.packets++
+	f.bytes += len(udp.Payload)
+	f.lastSeen = ci.Timestamp
+	f.recent = append(f.recent, packetSummary{
+		Seen:      ci.Timestamp,
+		Direction: direction,
+		Length:    len(udp.Payload),
+	})
+	if len(f.recent) > recentPacketsSize {
+		f.recent = f.recent[len(f.recent)-recentPacketsSize:]
+	}
+	flowID, flowName := f.flowID, f.flowName
+	uf.mu.Unlock()
+
+	if sn.suppress() {
+		return
+	}
+	if sn.config.LogVerbose {
+		log.Infof("[%v] %v datagram of %v bytes\n%v", flowName, direction, len(udp.Payload), hex.Dump(udp.Payload))
+	}
+	uf.ws.broadcastFlow(flowName, envelope(wsDatagram, datagramView{
+		FlowID:    flowID,
+		FlowName:  flowName,
+		Transport: "udp",
+		TimeStamp: ci.Timestamp.String(),
+		Direction: direction,
+		Src:       uf.anonymous.address(src),
+		Dst:       uf.anonymous.address(dst),
+		Length:    len(udp.Payload),
+		Hex:       hex.EncodeToString(udp.Payload),
+		HexDump:   hexDump(udp.Payload),
+	}))
+}
+
+// close the flows without a datagram for protocol.udpIdleTimeout before now, the time of the last captured packet
+func (uf *udpFlows) expire(now time.Time) {
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	for key, f := range uf.flows {
+		if now.Sub(f.lastSeen) <= uf.timeout {
+			continue
+		}
+		delete(uf.flows, key)
+		log.Infof("[%v] udp flow [ %v ] [ %v ] idle for %v, closed after %v datagrams", f.flowName, f.net, f.transport, uf.timeout, f.packets)
+		uf.ws.sendFlowEvent(f.event(uf.anonymous, false))
+	}
+}
+
+// close every flow, once the capture is over
+func (uf *udpFlows) closeAll() {
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	for key, f := range uf.flows {
+		delete(uf.flows, key)
+		uf.ws.sendFlowEvent(f.event(uf.anonymous, false))
+	}
+}
+
+// called with the lock held, a has the pseudonyms of the addresses
+func (f *udpFlow) event(a *anonymizer, opened bool) flowEvent {
+	fe := flowEvent{
+		FlowID:    f.flowID,
+		FlowName:  f.flowName,
+		Transport: "udp",
+		Src:       a.address(srcAddress(f.net, f.transport)),
+		Dst:       a.address(dstAddress(f.net, f.transport)),
+		opened:    opened,
+	}
+	if !opened {
+		fe.Summary = &flowClosedSummary{
+			Duration: f.lastSeen.Sub(f.firstSeen).Seconds(),
+			Packets:  f.packets,
+			Bytes:    f.bytes,
+		}
+	}
+	return fe
+}
+
+// called with the lock held, a has the pseudonyms of the addresses
+func (f *udpFlow) view(a *anonymizer, withRecent bool) flowView {
+	fv := flowView{
+		FlowID:      f.flowID,
+		FlowName:    f.flowName,
+		Transport:   "udp",
+		Src:         a.address(srcAddress(f.net, f.transport)),
+		Dst:         a.address(dstAddress(f.net, f.transport)),
+		Packets:     f.packets,
+		Bytes:       f.bytes,
+		FirstSeen:   f.firstSeen,
+		LastSeen:    f.lastSeen,
+		XorKeyFound: true,
+	}
+	if withRecent {
+		fv.RecentPackets = append([]packetSummary(nil), f.recent...)
+	}
+	return fv
+}
+
+func (uf *udpFlows) views() []flowView {
+	if uf == nil {
+		return nil
+	}
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	views := make([]flowView, 0, len(uf.flows))
+	for _, f := range uf.flows {
+		views = append(views, f.view(uf.anonymous, false))
+	}
+	return views
+}
+
+func (uf *udpFlows) find(flowID string) (flowView, bool) {
+	if uf == nil {
+		return flowView{}, false
+	}
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	for _, f := range uf.flows {
+		if f.flowID == flowID {
+			return f.view(uf.anonymous, true), true
+		}
+	}
+	return flowView{}, false
+}
+
+// an opened event for every udp flow, for the clients that connect late
+func (uf *udpFlows) openFlows() []flowEvent {
+	if uf == nil {
+		return nil
+	}
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	events := make([]flowEvent, 0, len(uf.flows))
+	for _, f := range uf.flows {
+		events = append(events, f.event(uf.anonymous, true))
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].FlowName < events[j].FlowName
+	})
+	return events
+}
+
+// the bpf expression of the udp service ports, empty if there are none
+func udpFilter(services map[int]string) string {
+	ports := make([]int, 0, len(services))
+	for port := range services {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	var filter string
+	for i, port := range ports {
+		if i == 0 {
+			filter = "udp and (port " + strconv.Itoa(port)
+			continue
+		}
+		filter += " or port " + strconv.Itoa(port)
+	}
+	if filter != "" {
+		filter += ")"
+	}
+	return filter
+}
+
+// protocol.udpServices, name => port as protocol.services
+func udpServicesFromViper(services map[string]interface{}) (map[int]string, error) {
+	ports := make(map[int]string)
+	for name, v := range services {
+		port, err := strconv.Atoi(fmt.Sprint(v))
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("protocol.udpServices.%v: %q is not a port", name, fmt.Sprint(v))
+		}
+		if other, ok := ports[port]; ok {
+			return nil, fmt.Errorf("protocol.udpServices: port %v is both %v and %v", port, other, name)
+		}
+		ports[port] = name
+	}
+	return ports, nil
+}
@@ -0,0 +1,472 @@
+// the UI is fed by the websocket, the url of which comes from /api/config, and by the json api
+// every part of the page is rendered by its own functions, socket messages are routed to them by the event they carry
+window.addEventListener("load", function(evt) {
+    var output = document.getElementById("output");
+    var config = {};
+    var socket;
+
+    // helpers
+
+    var print = function(message) {
+        var d = document.createElement("pre");
+        d.textContent = message;
+        output.insertBefore(d, output.firstChild);
+        return d;
+    };
+
+    var hex = function(n, width) {
+        var s = n.toString(16);
+        while (s.length < width) {
+            s = "0" + s;
+        }
+        return s;
+    };
+
+    // errors are answered as plain text
+    var fetchJSON = function(url, options) {
+        return fetch(url, options).then(function(r) {
+            if (!r.ok) {
+                return r.text().then(function(t) { throw new Error(t); });
+            }
+            return r.json();
+        });
+    };
+
+    // packets
+
+    // the field a payload offset belongs to, if the struct could be mapped
+    var fieldAt = function(fields, offset) {
+        for (var i = 0; i < fields.length; i++) {
+            if (offset >= fields[i].offset && offset < fields[i].offset + fields[i].length) {
+                return i;
+            }
+        }
+        return -1;
+    };
+
+    var printPacket = function(title, pv) {
+        var d = document.createElement("details");
+        var s = document.createElement("summary");
+        s.textContent = title;
+        d.appendChild(s);
+
+        var fields = (pv.ncRepresentation && pv.ncRepresentation.fields) || [];
+        var dump = document.createElement("pre");
+        (pv.hexDump || []).forEach(function(row) {
+            dump.appendChild(document.createTextNode(hex(row.offset, 4) + "  "));
+            row.hex.split(" ").forEach(function(b, i) {
+                var span = document.createElement("span");
+                span.textContent = b + " ";
+                var f = fieldAt(fields, row.offset + i);
+                if (f >= 0) {
+                    span.title = fields[f].name;
+                    span.className = "field" + (f % 2);
+                }
+                dump.appendChild(span);
+            });
+            dump.appendChild(document.createTextNode(" " + row.ascii + "\n"));
+        });
+        d.appendChild(dump);
+
+        if (fields.length > 0) {
+            var legend = document.createElement("pre");
+            legend.textContent = fields.map(function(f) {
+                return hex(f.offset, 4) + "-" + hex(f.offset + f.length - 1, 4) + " " + f.name;
+            }).join("\n");
+            d.appendChild(legend);
+        }
+
+        var id = document.createElement("pre");
+        id.textContent = "id " + pv.packetID;
+        d.appendChild(id);
+
+        var decoded = document.createElement("pre");
+        decoded.textContent = pv.ncRepresentation && pv.ncRepresentation.unpacked_data ? pv.ncRepresentation.unpacked_data : JSON.stringify(pv.packetData);
+        d.appendChild(decoded);
+
+        if (pv.replay) {
+            d.className = "replay";
+        }
+        output.insertBefore(d, output.firstChild);
+    };
+
+    var packetEvent = function(pv) {
+        var replay = pv.replay ? "[history] " : "";
+        // e.g the name of the character a handle belongs to, learned from earlier packets
+        var context = (pv.ncRepresentation && pv.ncRepresentation.context) || {};
+        var about = context.character ? " (" + context.character + ")" : "";
+        printPacket(replay + pv.timestamp + " " + pv.flowName + " " + pv.portEndpoints + " " + pv.direction + " " + pv.command + about, pv);
+    };
+
+    // datagrams of udp flows are not decoded, only their hex dump is shown
+    var datagramEvent = function(dv) {
+        var d = document.createElement("details");
+        var s = document.createElement("summary");
+        s.textContent = dv.timestamp + " " + dv.flowName + " [" + dv.transport + "] " + dv.src + " => " + dv.dst + " " + dv.direction + " " + dv.length + " bytes";
+        d.appendChild(s);
+        var dump = document.createElement("pre");
+        dump.textContent = (dv.hexDump || []).map(function(row) {
+            return hex(row.offset, 4) + "  " + row.hex + " " + row.ascii;
+        }).join("\n");
+        d.appendChild(dump);
+        output.insertBefore(d, output.firstChild);
+    };
+
+    // flows
+
+    var flowList = document.getElementById("flows");
+    // flow name => {checkbox, label, open flow ids}
+    var flows = {};
+
+    // only the checked flow names are forwarded, none checked means every flow
+    var subscribe = function() {
+        if (!socket) {
+            return;
+        }
+        var names = Object.keys(flows).filter(function(name) {
+            return flows[name].checkbox.checked;
+        });
+        send("subscribe", {flows: names});
+    };
+
+    var updateFlow = function(name) {
+        var f = flows[name];
+        var open = Object.keys(f.ids).length;
+        f.text.textContent = " " + name + " [" + (f.transport || "tcp") + "] (" + open + " open)";
+        f.label.className = open > 0 ? "" : "closed";
+    };
+
+    // the server sends the flows that are still open right away, so the ones known are reset when connecting
+    var resetFlows = function() {
+        Object.keys(flows).forEach(function(name) {
+            flows[name].ids = {};
+            updateFlow(name);
+        });
+    };
+
+    var flowEvent = function(fe, opened) {
+        var f = flows[fe.flow_name];
+        if (!f) {
+            var label = document.createElement("label");
+            var checkbox = document.createElement("input");
+            checkbox.type = "checkbox";
+            checkbox.onchange = subscribe;
+            var text = document.createElement("span");
+            label.appendChild(checkbox);
+            label.appendChild(text);
+            flowList.appendChild(label);
+            f = flows[fe.flow_name] = {checkbox: checkbox, label: label, text: text, ids: {}, transport: fe.transport};
+        }
+        if (opened) {
+            f.ids[fe.flow_id] = fe.src + " => " + fe.dst;
+        } else {
+            delete f.ids[fe.flow_id];
+            closedFlow(fe);
+        }
+        updateFlow(fe.flow_name);
+    };
+
+    var closedList = document.getElementById("closedFlows");
+    // closed flows kept on the page, the oldest are removed past it
+    var closedFlowsShown = 100;
+
+    // the final counts of a flow, newest first
+    var closedFlow = function(fe) {
+        var s = fe.summary || {};
+        var line = fe.flow_name + " " + fe.flow_id + " " + fe.src + " => " + fe.dst + ", " +
+            (s.durationSeconds || 0).toFixed(1) + "s, " + (s.packets || 0) + " packets, " + (s.bytes || 0) + " bytes";
+        var truncated = s.truncatedBytes || {};
+        Object.keys(truncated).forEach(function(direction) {
+            line += ", " + direction + " packet truncated after " + truncated[direction] + " bytes";
+        });
+        var d = document.createElement("div");
+        d.textContent = line;
+        closedList.insertBefore(d, closedList.firstChild);
+        while (closedList.childNodes.length > closedFlowsShown) {
+            closedList.removeChild(closedList.lastChild);
+        }
+    };
+
+    // capture events
+
+    var dropsEvent = function(e) {
+        var drops = document.getElementById("drops");
+        drops.textContent = "Packets were dropped (" + e.dropped + " by the kernel, " + e.if_dropped + " by the interface), flows decoded since may be unreliable";
+        drops.style.display = "block";
+        print("packets dropped by the kernel: " + e.dropped + ", by the interface: " + e.if_dropped);
+    };
+
+    var captureEvent = function(e) {
+        switch (e.state) {
+        case "stopped":
+            print("capture stopped");
+            break;
+        case "paused":
+            print("forwarding paused");
+            break;
+        case "resumed":
+            print("forwarding resumed, " + (e.suppressed || 0) + " packets were suppressed while paused");
+            break;
+        }
+    };
+
+    // the client version of a flow, unknown and mismatched versions are decoded with the default commands file
+    var protocolEvent = function(e) {
+        switch (e.status) {
+        case "detected":
+            print("client version " + e.version + " detected on " + e.flowName + ", session " + e.sessionID);
+            break;
+        case "unknown":
+            print("WARNING: client version \"" + e.key + "\" on " + e.flowName + " is not in protocol.versions, operation codes may be misnamed");
+            break;
+        case "mismatch":
+            print("WARNING: client version " + e.version + " on " + e.flowName + " doesn't match the one of session " + e.sessionID + ", operation codes may be misnamed");
+            break;
+        }
+    };
+
+    // every message is an envelope, {v: 1, type: "packet", data: {...}}, the handler of its type gets the data
+    var handlers = {
+        hello: function(h) { print("protocol version " + h.version); },
+        packet: packetEvent,
+        datagram: datagramEvent,
+        flow_open: function(fe) { flowEvent(fe, true); },
+        flow_close: function(fe) { flowEvent(fe, false); },
+        stats: dropsEvent,
+        capture: captureEvent,
+        zone: function(e) {
+            print("zone " + e.service + " discovered on " + e.address);
+        },
+        protocol: protocolEvent,
+        alert: function(e) {
+            var what = e.event === "decode-error" ? "decode errors" : (e.command || e.operationCode);
+            if (e.count > 1) {
+                what = e.count + " x " + what + " in " + e.windowSeconds + "s";
+            }
+            print("ALERT " + e.ruleID + (e.message ? ": " + e.message : "") + ", " + e.flowName + " " + e.direction + " " + what).className = "alert";
+        },
+        error: function(e) {
+            print("ERROR: " + e.message);
+        }
+    };
+
+    var dispatch = function(message) {
+        var handle = handlers[message.type];
+        if (!handle) {
+            print("unknown message type " + message.type);
+            return;
+        }
+        handle(message.data || {});
+    };
+
+    // diff
+
+    // both payloads side by side, 16 bytes per row, the bytes that differ are highlighted
+    var printDiff = function(res) {
+        var d = document.createElement("details");
+        d.open = true;
+        var s = document.createElement("summary");
+        s.textContent = "diff " + res.old.command + " " + res.old.id + " => " + res.new.command + " " + res.new.id + ", " + res.diff.differing + " bytes differ";
+        d.appendChild(s);
+
+        var differs = {};
+        res.diff.runs.forEach(function(r) {
+            for (var i = r.offset; !r.same && i < r.offset + r.length; i++) {
+                differs[i] = true;
+            }
+        });
+        var bytes = function(p) {
+            var raw = atob(p || "");
+            var out = [];
+            for (var i = 0; i < raw.length; i++) {
+                out.push(raw.charCodeAt(i));
+            }
+            return out;
+        };
+        var a = bytes(res.old.payload), b = bytes(res.new.payload);
+        var row = function(dump, p, offset) {
+            for (var i = offset; i < offset + 16; i++) {
+                var span = document.createElement("span");
+                span.textContent = i < p.length ? hex(p[i], 2) + " " : "   ";
+                if (differs[i]) {
+                    span.className = "diff";
+                }
+                dump.appendChild(span);
+            }
+        };
+        var dump = document.createElement("pre");
+        for (var offset = 0; offset < Math.max(a.length, b.length); offset += 16) {
+            dump.appendChild(document.createTextNode(hex(offset, 4) + "  "));
+            row(dump, a, offset);
+            dump.appendChild(document.createTextNode(" | "));
+            row(dump, b, offset);
+            dump.appendChild(document.createTextNode("\n"));
+        }
+        d.appendChild(dump);
+        output.insertBefore(d, output.firstChild);
+    };
+
+    // heatmap
+
+    // a table per flow, a row per operation code and a column per bucket, the busier the redder
+    var printHeatmap = function(hm) {
+        var div = document.getElementById("heatmap");
+        div.textContent = "";
+        hm.flows.forEach(function(f) {
+            var max = 1;
+            f.operationCodes.forEach(function(row) {
+                row.counts.forEach(function(n) {
+                    max = Math.max(max, n);
+                });
+            });
+            var title = document.createElement("p");
+            title.textContent = f.flowName + ", " + hm.bucketSeconds + "s buckets from " + f.buckets[0];
+            div.appendChild(title);
+            var table = document.createElement("table");
+            f.operationCodes.forEach(function(row) {
+                var tr = document.createElement("tr");
+                var name = document.createElement("td");
+                name.textContent = row.command || row.operationCode;
+                tr.appendChild(name);
+                row.counts.forEach(function(n, i) {
+                    var td = document.createElement("td");
+                    td.textContent = n || "";
+                    td.title = f.buckets[i];
+                    td.style.background = "rgba(255, 0, 0, " + (n / max) + ")";
+                    tr.appendChild(td);
+                });
+                table.appendChild(tr);
+            });
+            div.appendChild(table);
+        });
+    };
+
+    // timeline
+
+    // a row per flow, its bar goes from opened to completed, or to the end of the session while it is open,
+    // with a tick for every notable packet, hovering a tick shows its command
+    var printTimeline = function(t) {
+        var div = document.getElementById("timeline");
+        div.textContent = "";
+        var title = document.createElement("p");
+        title.textContent = "session " + t.sessionID + " of " + t.clientIP + ", " + t.started + " to " + t.ended + (t.closed ? "" : ", open");
+        div.appendChild(title);
+        if (t.flows.length === 0) {
+            title.textContent += ", no flows";
+            return;
+        }
+        var start = Date.parse(t.started);
+        var span = Math.max(Date.parse(t.ended) - start, 1);
+        var percent = function(time) {
+            return Math.min(100, Math.max(0, (Date.parse(time) - start) * 100 / span)) + "%";
+        };
+        t.flows.forEach(function(f) {
+            var row = document.createElement("div");
+            row.className = "timelineRow";
+            var name = document.createElement("span");
+            name.className = "name";
+            name.textContent = f.flowName;
+            row.appendChild(name);
+            var bar = document.createElement("div");
+            bar.className = f.completed ? "timelineFlow" : "timelineFlow open";
+            bar.style.left = percent(f.opened);
+            bar.style.right = (100 - parseFloat(percent(f.completed || t.ended))) + "%";
+            bar.title = f.flowName + " " + f.flowID + ", " + f.opened + " to " + (f.completed || "still open");
+            row.appendChild(bar);
+            f.markers.forEach(function(m) {
+                var tick = document.createElement("div");
+                tick.className = "timelineMarker";
+                tick.style.left = percent(m.seen);
+                tick.title = m.seen + " " + m.direction + " " + (m.command || m.operationCode);
+                row.appendChild(tick);
+            });
+            div.appendChild(row);
+        });
+        if (t.markersDropped > 0) {
+            var dropped = document.createElement("p");
+            dropped.textContent = t.markersDropped + " notable packets left out";
+            div.appendChild(dropped);
+        }
+    };
+
+    // socket
+
+    // the version of the websocket envelopes this page speaks
+    var version = 1;
+
+    var send = function(type, data) {
+        socket.send(JSON.stringify({v: version, type: type, data: data}));
+    };
+
+    var open = function() {
+        if (socket || !config.websocket) {
+            return;
+        }
+        socket = new WebSocket(config.websocket + "?v=" + version);
+        socket.onopen = function(evt) {
+            print("OPEN");
+            resetFlows();
+            subscribe();
+        };
+        socket.onclose = function(evt) {
+            print("CLOSE");
+            socket = null;
+        };
+        socket.onmessage = function(evt) {
+            dispatch(JSON.parse(evt.data));
+        };
+        socket.onerror = function(evt) {
+            print("ERROR: " + evt.data);
+        };
+    };
+
+    // controls, every one is a button in a form, so they return false to stay on the page
+
+    var control = function(id, action) {
+        document.getElementById(id).onclick = function(evt) {
+            action();
+            return false;
+        };
+    };
+
+    var captureAction = function(action) {
+        return function() {
+            if (socket) {
+                send("capture", {action: action});
+            }
+        };
+    };
+
+    control("open", open);
+    control("close", function() {
+        if (socket) {
+            socket.close();
+        }
+    });
+    control("pause", captureAction("pause"));
+    control("resume", captureAction("resume"));
+    control("diff", function() {
+        var req = {old: document.getElementById("diffOld").value.trim(), new: document.getElementById("diffNew").value.trim()};
+        fetchJSON("/api/diff", {method: "POST", body: JSON.stringify(req)}).then(printDiff).catch(function(err) {
+            print("diff: " + err.message);
+        });
+    });
+    control("heatmapLoad", function() {
+        var bucket = document.getElementById("heatmapBucket").value.trim() || "10s";
+        fetchJSON("/api/heatmap?bucket=" + encodeURIComponent(bucket)).then(printHeatmap).catch(function(err) {
+            print("heatmap: " + err.message);
+        });
+    });
+    control("timelineLoad", function() {
+        var session = document.getElementById("timelineSession").value.trim();
+        fetchJSON("/api/timeline?session=" + encodeURIComponent(session)).then(printTimeline).catch(function(err) {
+            print("timeline: " + err.message);
+        });
+    });
+
+    fetchJSON("/api/config").then(function(c) {
+        config = c;
+    }).catch(function(err) {
+        print("config: " + err.message);
+    });
+});
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// packets DecodePacket rejects in a row before the decoder stops trusting the packet boundaries, or the xor offset, and resynchronizes
+const decodeErrorsBeforeResync = 3
+
+// undecodableOutput appends the packets of a stream DecodePacket rejected to <flowName>-<flowID>-undecodable.bin in the session directory
+// every record is, little endian: the capture time in unix nanoseconds (int64), the offset of the packet among the bytes received
+// in its direction (uint64), the direction, 0 outbound and 1 inbound (uint8), the length of the packet (uint32) and the packet
+// as received, length header included and client packets still xored
+// the file is only created once the first packet is written
+type undecodableOutput struct {
+	session *session
+	path    string
+	f       *os.File
+	closed  bool
+	mu      sync.Mutex
+}
+
+func newUndecodableOutput(s *session, flowName, flowID string) *undecodableOutput {
+	return &undecodableOutput{
+		session: s,
+		path:    fmt.Sprintf("%v-%v-undecodable.bin", flowName, flowID),
+	}
+}
+
+func (uo *undecodableOutput) write(seen time.Time, direction string, offset uint64, raw []byte) {
+	uo.mu.Lock()
+	defer uo.mu.Unlock()
+	if uo.closed {
+		return
+	}
+	if uo.f == nil {
+		pathName, err := uo.session.path(uo.path)
+		if err != nil {
+			log.Error(err)
+			uo.closed = true
+			return
+		}
+		f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Error(err)
+			uo.closed = true
+			return
+		}
+		uo.session.register(pathName, artifactUndecodable)
+		uo.f = f
+	}
+
+	record := make([]byte, 21, 21+len(raw))
+	binary.LittleEndian.PutUint64(record[0:], uint64(seen.UnixNano()))
+	binary.LittleEndian.PutUint64(record[8:], offset)
+	if direction == "inbound" {
+		record[16] = 1
+	}
+	binary.LittleEndian.PutUint32(record[17:], uint32(len(raw)))
+	record = append(record, raw...)
+	if _, err := uo.f.Write(record); err != nil {
+		log.Error(err)
+	}
+}
+
+func (uo *undecodableOutput) close() {
+	uo.mu.Lock()
+	defer uo.mu.Unlock()
+	if uo.closed {
+		return
+	}
+	uo.closed = true
+	if uo.f == nil {
+		return
+	}
+	if err := uo.f.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// count a packet DecodePacket rejected and keep its raw bytes, returns true once decodeErrorsBeforeResync
+// packets failed in a row, failures is the count of the decoder's direction
+func (ss *shineStream) undecodablePacket(seen time.Time, direction string, offset uint64, raw []byte, err error, failures *int) bool {
+	ss.warningf("[%v] %v packet of %v bytes at offset %v can't be decoded: %v", ss.flowName, direction, len(raw), offset, err)
+	ss.sniffer.metrics.decodeError(ss.flowName, direction)
+	ss.stats.decodeError()
+	ss.sniffer.alerts.decodeError(ss, direction, seen)
+	ss.undecodable.write(seen, direction, offset, raw)
+
+	*failures++
+	if *failures < decodeErrorsBeforeResync {
+		return false
+	}
+	*failures = 0
+	return true
+}
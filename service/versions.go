@@ -0,0 +1,209 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// ProtocolVersion is an entry of protocol.versions, a client version with the commands file and the xor settings of its
+// protocol, XorKey and XorLimit fall back to the ones of the service if empty
+type ProtocolVersion struct {
+	Name     string `mapstructure:"name"`
+	Key      string `mapstructure:"key"`
+	Commands string `mapstructure:"commands"`
+	XorKey   string `mapstructure:"xorKey"`
+	XorLimit uint16 `mapstructure:"xorLimit"`
+}
+
+// protocolVersion is a loaded ProtocolVersion
+type protocolVersion struct {
+	name     string
+	key      string
+	commands map[uint16]string
+	// Key is nil if the version uses the xor settings of the service
+	xor XorSettings
+}
+
+// protocolVersions picks the protocol version of a session from the version check its client sends first
+// nil without protocol.versions, every flow is decoded with protocol.commands and the xor settings of its service
+type protocolVersions struct {
+	opCode   uint16
+	versions []*protocolVersion
+}
+
+func newProtocolVersions(versions []ProtocolVersion, opCode uint16, serverSide bool) (*protocolVersions, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	pv := &protocolVersions{opCode: opCode}
+	seen := make(map[string]bool)
+	for i, v := range versions {
+		if v.Name == "" || v.Key == "" {
+			return nil, fmt.Errorf("protocol.versions[%v]: name and key are needed", i)
+		}
+		if seen[v.Key] {
+			return nil, fmt.Errorf("protocol.versions[%v]: %v has the key %q of another version", i, v.Name, v.Key)
+		}
+		seen[v.Key] = true
+		if v.Commands == "" {
+			return nil, fmt.Errorf("protocol.versions[%v]: %v has no commands file", i, v.Name)
+		}
+		commands, err := loadCommandNames(v.Commands)
+		if err != nil {
+			return nil, fmt.Errorf("protocol.versions[%v]: %v: %v", i, v.Name, err)
+		}
+		loaded := &protocolVersion{
+			name:     v.Name,
+			key:      v.Key,
+			commands: commands,
+		}
+		if v.XorKey != "" {
+			key, err := hex.DecodeString(v.XorKey)
+			if err != nil {
+				return nil, fmt.Errorf("protocol.versions[%v]: %v xorKey: %v", i, v.Name, err)
+			}
+			loaded.xor = XorSettings{Key: key, Limit: v.XorLimit}
+			if err := loaded.xor.validate(); err != nil && !serverSide {
+				return nil, fmt.Errorf("protocol.versions[%v]: %v: %v", i, v.Name, err)
+			}
+		} else if v.XorLimit != 0 {
+			return nil, fmt.Errorf("protocol.versions[%v]: %v has a xorLimit without a xorKey", i, v.Name)
+		}
+		pv.versions = append(pv.versions, loaded)
+		log.Infof("protocol version %v: %v commands from %v", v.Name, len(commands), v.Commands)
+	}
+	return pv, nil
+}
+
+// the xor settings of the version, the ones of the service if it has none
+func (v *protocolVersion) xorSettings(service XorSettings) XorSettings {
+	if v == nil || v.xor.Key == nil {
+		return service
+	}
+	return v.xor
+}
+
+func (v *protocolVersion) String() string {
+	if v == nil {
+		return "default"
+	}
+	return v.name
+}
+
+// the version key of a version check payload, the string up to its first zero byte
+func versionKey(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}
+
+// decode a copy of the first client packet of a flow with the xor settings of every version, and of the service
+// isCheck is false if none of them decodes it to the version check, e.g the first packet of a zone flow
+// v is nil with isCheck if the key it carries is the one of no version
+func (pv *protocolVersions) detect(packetData []byte, service XorSettings, xorOffset *uint16) (v *protocolVersion, key string, isCheck bool) {
+	decode := func(xs XorSettings) (string, bool) {
+		data := append([]byte(nil), packetData...)
+		var o *uint16
+		if xorOffset != nil {
+			offset := *xorOffset
+			o = &offset
+		}
+		p, err := decodePacket(data, xs, o)
+		if err != nil || p.Base.OperationCode != pv.opCode {
+			return "", false
+		}
+		return versionKey(p.Base.Data), true
+	}
+	for _, candidate := range pv.versions {
+		k, ok := decode(candidate.xorSettings(service))
+		if !ok {
+			continue
+		}
+		if k == candidate.key {
+			return candidate, k, true
+		}
+		key, isCheck = k, true
+	}
+	if !isCheck {
+		key, isCheck = decode(service)
+	}
+	return nil, key, isCheck
+}
+
+// protocolEvent is sent to every UI connection once the version check of a flow was read
+// Status is "detected", "unknown" for a key of no version or "mismatch" for a version other than the one of its session,
+// both decode the flow with the default commands file and xor settings
+type protocolEvent struct {
+	SessionID string `json:"sessionID"`
+	FlowID    string `json:"flowID"`
+	FlowName  string `json:"flowName"`
+	Version   string `json:"version"`
+	Key       string `json:"key"`
+	Status    string `json:"status"`
+}
+
+// the protocol version the stream decodes with, nil for the default one
+func (ss *shineStream) protocolVersion() *protocolVersion {
+	ss.versionMu.Lock()
+	defer ss.versionMu.Unlock()
+	return ss.version
+}
+
+func (ss *shineStream) setProtocolVersion(v *protocolVersion) {
+	ss.versionMu.Lock()
+	ss.version = v
+	ss.versionMu.Unlock()
+}
+
+// readable name for an operation code in the commands of the protocol version of the stream
+func (ss *shineStream) commandName(opCode uint16) string {
+	v := ss.protocolVersion()
+	if v == nil {
+		return ss.sniffer.protocol.commandName(opCode)
+	}
+	if name, ok := v.commands[opCode]; ok {
+		return name
+	}
+	return unknownCommand(opCode)
+}
+
+// read the protocol version from the first client packet of the flow if it is the version check, returns the xor
+// settings to decode the flow with from there
+// the version becomes the one of the session, flows opened later in it start with it
+func (ss *shineStream) checkVersion(packetData []byte, xs XorSettings, xorOffset *uint16) XorSettings {
+	pv := ss.sniffer.versions
+	if pv == nil {
+		return xs
+	}
+	v, key, isCheck := pv.detect(packetData, ss.serviceXor, xorOffset)
+	if !isCheck {
+		return xs
+	}
+	event := protocolEvent{
+		SessionID: ss.sessionID,
+		FlowID:    ss.flowID,
+		FlowName:  ss.flowName,
+		Key:       key,
+	}
+	matches, previous := ss.sniffer.sessions.setVersion(ss.sessionID, v, key)
+	switch {
+	case v == nil:
+		// an error so it also reaches the console in quiet mode, every operation code of the session may be misnamed
+		log.Errorf("[%v] client version %q of session %v is not in protocol.versions, operation codes are named with protocol.commands and may be wrong", ss.flowName, key, ss.sessionID)
+		event.Status = "unknown"
+	case !matches:
+		log.Errorf("[%v] client version %v of session %v doesn't match its version %v, the flow is decoded with protocol.commands and may be wrong", ss.flowName, v, ss.sessionID, previous)
+		event.Status = "mismatch"
+		event.Version = v.name
+		v = nil
+	default:
+		log.Infof("[%v] client version %v detected for session %v", ss.flowName, v, ss.sessionID)
+		event.Status = "detected"
+		event.Version = v.name
+	}
+	ss.sniffer.ws.broadcast(envelope(wsProtocol, event))
+	ss.setProtocolVersion(v)
+	return v.xorSettings(ss.serviceXor)
+}
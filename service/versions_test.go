@@ -0,0 +1,95 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// the first client packet of a flow without its length header, xored with xs from offset
+func versionCheck(xs XorSettings, offset uint16, opCode uint16, key string) []byte {
+	data := make([]byte, 2, 2+len(key)+1)
+	binary.LittleEndian.PutUint16(data, opCode)
+	data = append(data, key...)
+	data = append(data, 0)
+	xs.cipher(data, &offset)
+	return data
+}
+
+func TestDetectProtocolVersion(t *testing.T) {
+	service := testXorSettings()
+	// a newer client with its own key
+	newer := XorSettings{Key: bytes.Repeat([]byte{0x5A, 0xC3}, 8), Limit: 16}
+	commandsFile := testConfig().CommandsFile
+	pv, err := newProtocolVersions([]ProtocolVersion{
+		{Name: "old", Key: "20200501", Commands: commandsFile},
+		{Name: "new", Key: "20210301", Commands: commandsFile, XorKey: hex.EncodeToString(newer.Key), XorLimit: newer.Limit},
+	}, opVersionCheck, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		version string
+		key     string
+		isCheck bool
+	}{
+		{"old", versionCheck(service, 7, opVersionCheck, "20200501"), "old", "20200501", true},
+		{"new", versionCheck(newer, 7, opVersionCheck, "20210301"), "new", "20210301", true},
+		{"unknown key", versionCheck(service, 7, opVersionCheck, "19990101"), "default", "19990101", true},
+		{"the key of the old version with the xor of the new one", versionCheck(newer, 7, opVersionCheck, "20200501"), "default", "20200501", true},
+		{"another packet", versionCheck(service, 7, opChatReq, "20200501"), "default", "", false},
+	}
+	for _, tt := range tests {
+		offset := uint16(7)
+		data := append([]byte(nil), tt.data...)
+		v, key, isCheck := pv.detect(data, service, &offset)
+		if v.String() != tt.version || key != tt.key || isCheck != tt.isCheck {
+			t.Errorf("%v: version %v key %q check %v, expected %v %q %v", tt.name, v, key, isCheck, tt.version, tt.key, tt.isCheck)
+		}
+		// the packet and offset are decoded again with the settings picked
+		if !bytes.Equal(data, tt.data) || offset != 7 {
+			t.Errorf("%v: detect changed the packet or the offset", tt.name)
+		}
+	}
+
+	if xs := pv.versions[1].xorSettings(service); !bytes.Equal(xs.Key, newer.Key) {
+		t.Error("the new version doesn't xor with its own key")
+	}
+	if xs := pv.versions[0].xorSettings(service); !bytes.Equal(xs.Key, service.Key) {
+		t.Error("the old version doesn't xor with the key of the service")
+	}
+}
+
+func TestProtocolVersionsRefused(t *testing.T) {
+	commandsFile := testConfig().CommandsFile
+	if pv, err := newProtocolVersions(nil, opVersionCheck, false); pv != nil || err != nil {
+		t.Errorf("versions %v, error %v without protocol.versions", pv, err)
+	}
+	tests := []struct {
+		name     string
+		versions []ProtocolVersion
+		err      string
+	}{
+		{"no key", []ProtocolVersion{{Name: "old", Commands: commandsFile}}, "name and key are needed"},
+		{"same key", []ProtocolVersion{{Name: "old", Key: "1", Commands: commandsFile}, {Name: "new", Key: "1", Commands: commandsFile}}, "the key \"1\" of another version"},
+		{"no commands", []ProtocolVersion{{Name: "old", Key: "1"}}, "no commands file"},
+		{"missing commands", []ProtocolVersion{{Name: "old", Key: "1", Commands: "nothing.yml"}}, "old"},
+		{"xor key", []ProtocolVersion{{Name: "old", Key: "1", Commands: commandsFile, XorKey: "zz"}}, "xorKey"},
+		{"xor limit past the key", []ProtocolVersion{{Name: "old", Key: "1", Commands: commandsFile, XorKey: "0102", XorLimit: 3}}, "xor limit"},
+		{"xor limit without a key", []ProtocolVersion{{Name: "old", Key: "1", Commands: commandsFile, XorLimit: 3}}, "without a xorKey"},
+	}
+	for _, tt := range tests {
+		if _, err := newProtocolVersions(tt.versions, opVersionCheck, false); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+	// server side captures don't xor, a key that doesn't fit its limit is kept as it is
+	if _, err := newProtocolVersions([]ProtocolVersion{{Name: "old", Key: "1", Commands: commandsFile, XorKey: "0102", XorLimit: 3}}, opVersionCheck, true); err != nil {
+		t.Errorf("server side: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// decoderWatch tells when a decoder of a stream last received a segment and last decoded a packet
+// a decoder that keeps receiving without decoding for protocol.decoderWatchdog is wedged, e.g its offset points past its buffer
+type decoderWatch struct {
+	lastSegment time.Time
+	lastDecoded time.Time
+	// the decoder has nothing to decode until something else happens, e.g the client waits for its xor key
+	waiting bool
+	// the watchdog asks the decoder to reset its state, the decoder is the only one touching it
+	wedged chan struct{}
+	mu     sync.Mutex
+}
+
+func newDecoderWatch() *decoderWatch {
+	return &decoderWatch{
+		lastDecoded: time.Now(),
+		wedged:      make(chan struct{}, 1),
+	}
+}
+
+func (dw *decoderWatch) segmentReceived() {
+	dw.mu.Lock()
+	dw.lastSegment = time.Now()
+	dw.mu.Unlock()
+}
+
+func (dw *decoderWatch) packetDecoded() {
+	dw.mu.Lock()
+	dw.lastDecoded = time.Now()
+	dw.mu.Unlock()
+}
+
+// once it stops waiting the decoder gets a whole timeout to decode something again
+func (dw *decoderWatch) setWaiting(waiting bool) {
+	dw.mu.Lock()
+	if dw.waiting && !waiting {
+		dw.lastDecoded = time.Now()
+	}
+	dw.waiting = waiting
+	dw.mu.Unlock()
+}
+
+// true if segments kept arriving for longer than timeout since the last decoded packet
+func (dw *decoderWatch) wedgedFor(timeout time.Duration) bool {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	return !dw.waiting && dw.lastSegment.Sub(dw.lastDecoded) > timeout
+}
+
+// look for wedged decoders every half timeout until ctx is done, they are told to reset their decode state
+func (sn *Sniffer) watchDecoders(ctx context.Context, timeout time.Duration) {
+	t := time.NewTicker(timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		sn.streams.mu.Lock()
+		for _, ss := range sn.streams.streams {
+			for _, dw := range []*decoderWatch{ss.clientWatch, ss.serverWatch} {
+				if !dw.wedgedFor(timeout) {
+					continue
+				}
+				select {
+				case dw.wedged <- struct{}{}:
+					ss.stats.decoderWedged()
+				default:
+					// the decoder didn't get to the last one yet
+				}
+			}
+		}
+		sn.streams.mu.Unlock()
+	}
+}
+
+// log what a wedged decoder was at and dump its buffer to the session directory before its state is reset
+func (ss *shineStream) decoderWedged(direction string, data []byte, offset int, state string) {
+	n := ss.stats.decoderReset()
+	log.Errorf("[%v] %v decoder received segments for %v without decoding a packet, resetting it: offset %v, %v bytes buffered, %v",
+		ss.flowName, direction, ss.sniffer.config.DecoderWatchdog, offset, len(data), state)
+
+	pathName, err := ss.sniffer.session.path(fmt.Sprintf("%v-%v-%v-wedged-%v.bin", ss.flowName, ss.flowID, direction, n))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile(pathName, data, 0666); err != nil {
+		log.Error(err)
+		return
+	}
+	ss.sniffer.session.register(pathName, artifactWedged)
+	log.Infof("[%v] %v buffer of the wedged decoder written to %v", ss.flowName, direction, pathName)
+}
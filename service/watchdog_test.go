@@ -0,0 +1,141 @@
+package service
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pacedSource hands its frames over one every delay, like a live capture, so the watchdog sees segments keep arriving
+type pacedSource struct {
+	*MemorySource
+	delay time.Duration
+}
+
+func (ps *pacedSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	time.Sleep(ps.delay)
+	return ps.MemorySource.ReadPacketData()
+}
+
+func (ps *pacedSource) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(ps, layers.LinkTypeEthernet)
+}
+
+func TestDecoderWatchWedged(t *testing.T) {
+	tests := []struct {
+		name                 string
+		lastSegment, decoded time.Duration
+		waiting              bool
+		wedged               bool
+	}{
+		{"decoding", time.Second, time.Second, false, false},
+		{"receiving without decoding", 2 * time.Minute, 0, false, true},
+		{"within the timeout", 30 * time.Second, 0, false, false},
+		{"waiting for a key", 2 * time.Minute, 0, true, false},
+		{"nothing received since", 0, time.Second, false, false},
+	}
+	for _, tt := range tests {
+		dw := newDecoderWatch()
+		dw.lastSegment = testStart.Add(tt.lastSegment)
+		dw.lastDecoded = testStart.Add(tt.decoded)
+		dw.waiting = tt.waiting
+		if got := dw.wedgedFor(time.Minute); got != tt.wedged {
+			t.Errorf("%v: wedged %v, expected %v", tt.name, got, tt.wedged)
+		}
+	}
+
+	// a decoder that stops waiting gets a whole timeout again
+	dw := newDecoderWatch()
+	dw.lastDecoded = time.Now().Add(-time.Hour)
+	dw.setWaiting(true)
+	dw.setWaiting(false)
+	dw.segmentReceived()
+	if dw.wedgedFor(time.Minute) {
+		t.Error("wedged right after it stopped waiting")
+	}
+}
+
+// a server packet whose length header was corrupted to a long one leaves the decoder waiting for bytes that never come
+// while segments keep arriving, the watchdog dumps its buffer and resets it, the packets after it are decoded again
+func TestWatchdogResetsWedgedDecoder(t *testing.T) {
+	const after = 40
+	tests := []struct {
+		name    string
+		corrupt bool
+	}{
+		{"corrupted length", true},
+		{"healthy stream", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+				t.Fatal(err)
+			}
+			wedging := EncodeShinePacket(opLoginAck, []byte{0xee, 0xee})
+			if tt.corrupt {
+				// a long length header, 0 and then 28688
+				wedging = append([]byte{0, 0x10, 0x70}, wedging[1:]...)
+			}
+			if err := conv.FromServer(wedging); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < after; i++ {
+				if err := conv.FromServer(EncodeShinePacket(opLoginAck, []byte{byte(i), 0x55})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			c := testConfig()
+			c.session = &session{dir: dir}
+			c.DecoderWatchdog = 40 * time.Millisecond
+			sn, sink := runPipeline(t, c, &pacedSource{MemorySource: ms, delay: 5 * time.Millisecond})
+
+			summary := sn.Summary()
+			if len(summary) != 1 {
+				t.Fatalf("%v flows, expected 1", len(summary))
+			}
+			dumps, err := filepath.Glob(filepath.Join(dir, "*-inbound-wedged-*.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.corrupt {
+				if summary[0].DecodersWedged != 0 || summary[0].DecoderResets != 0 || len(dumps) != 0 {
+					t.Errorf("a decoder of a healthy stream was wedged %v times, reset %v times, %v dumps",
+						summary[0].DecodersWedged, summary[0].DecoderResets, len(dumps))
+				}
+				return
+			}
+			if summary[0].DecodersWedged == 0 || summary[0].DecoderResets == 0 {
+				t.Fatalf("wedged %v times and reset %v times, expected both", summary[0].DecodersWedged, summary[0].DecoderResets)
+			}
+			if len(dumps) == 0 {
+				t.Fatal("the buffer of the wedged decoder wasn't dumped")
+			}
+			dump, err := ioutil.ReadFile(dumps[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(dump, []byte{0, 0x10, 0x70}) {
+				t.Errorf("the dump %x doesn't have the corrupted length header", dump)
+			}
+
+			payloads := payloadsOf(sink.byDirection(), opLoginAck)
+			if len(payloads) == 0 {
+				t.Fatal("nothing was decoded after the reset")
+			}
+			if last := payloads[len(payloads)-1]; !bytes.Equal(last, []byte{after - 1, 0x55}) {
+				t.Errorf("the last packet decoded to %x", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"embed"
+	"io"
+	"io/fs"
+	"net/http"
+)
+
+// the UI served on /, index.html, style.css and app.js, app.js asks /api/config for the websocket url
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// served instead of the UI if a build left its files out
+const fallbackPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Shine packet sniffer</title>
+</head>
+<body>
+<p>The UI files are missing from this build. Decoded packets are still sent on the websocket at /packets, and the api is under /api/.</p>
+</body>
+</html>
+`
+
+func uiHandler() http.Handler {
+	static, err := fs.Sub(uiFiles, "ui")
+	if err == nil {
+		_, err = fs.Stat(static, "index.html")
+	}
+	if err != nil {
+		log.Warningf("the UI files are missing, serving a minimal page: %v", err)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if _, err := io.WriteString(w, fallbackPage); err != nil {
+				log.Error(err)
+			}
+		})
+	}
+	return http.FileServer(http.FS(static))
+}
+
+// uiConfig is the json returned by GET /api/config, what the UI needs to know to connect
+type uiConfig struct {
+	WebSocket string `json:"websocket"`
+}
+
+func uiConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, uiConfig{
+		WebSocket: "ws://" + r.Host + "/packets",
+	})
+}
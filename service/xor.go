@@ -0,0 +1,174 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/shine-o/shine.engine.core/networking"
+	"strings"
+)
+
+// XorSettings are the key client payloads are xored with and the offset at which it wraps around
+type XorSettings struct {
+	Key   []byte
+	Limit uint16
+}
+
+func (xs XorSettings) validate() error {
+	if xs.Limit == 0 || int(xs.Limit) > len(xs.Key) {
+		return fmt.Errorf("xor limit %v doesn't fit a key of %v bytes", xs.Limit, len(xs.Key))
+	}
+	return nil
+}
+
+// xor data in place from offset, which is left where the next byte starts
+// same as networking.XorCipher but with the key of the stream instead of the process wide one
+func (xs XorSettings) cipher(data []byte, offset *uint16) {
+	if *offset >= xs.Limit {
+		*offset = 0
+	}
+	for i := range data {
+		data[i] ^= xs.Key[*offset]
+		*offset++
+		if *offset >= xs.Limit {
+			*offset = 0
+		}
+	}
+}
+
+// the xor settings of the service on port, the global ones unless protocol.services overrides them
+func (c Config) xorSettings(port int) XorSettings {
+	if xs, ok := c.ServiceXor[port]; ok {
+		return xs
+	}
+	return XorSettings{Key: c.XorKey, Limit: c.XorLimit}
+}
+
+// read the xor offset the server hands to the client, ok is false if the packet doesn't carry it
+// by default it's the first two bytes of NC_MISC_SEED_ACK, servers that changed the handshake can move it with
+// protocol.xorKeyOpcode and protocol.xorKeyOffset or, with protocol.xorKeyHeuristic, take the first server packet with a 2 byte payload
+func (c Config) xorSeed(opCode uint16, data []byte) (seed uint16, ok bool, err error) {
+	if c.XorKeyHeuristic {
+		if len(data) != 2 {
+			return 0, false, nil
+		}
+		return binary.LittleEndian.Uint16(data), true, nil
+	}
+	if opCode != c.XorKeyOpCode {
+		return 0, false, nil
+	}
+	if c.XorKeyOffset < 0 || c.XorKeyOffset+2 > len(data) {
+		return 0, true, fmt.Errorf("seed packet %v has %v bytes, the xor offset is expected at byte %v", opCode, len(data), c.XorKeyOffset)
+	}
+	return binary.LittleEndian.Uint16(data[c.XorKeyOffset:]), true, nil
+}
+
+// whether the server stream is xored, older server builds send it as it is
+type serverXorMode int
+
+const (
+	serverXorOff serverXorMode = iota
+	// xored from the packet after the seed, or from the first one with protocol.serverXorSeed
+	serverXorOn
+	// xored if the first packet once the server offset is known only decodes to a known operation code when xored
+	serverXorAuto
+)
+
+func parseServerXorMode(s string) (serverXorMode, error) {
+	switch strings.ToLower(s) {
+	case "", "false":
+		return serverXorOff, nil
+	case "true":
+		return serverXorOn, nil
+	case "auto":
+		return serverXorAuto, nil
+	}
+	return serverXorOff, fmt.Errorf("unknown mode %q, use false, true or auto", s)
+}
+
+// read the xor offset of the server stream from the seed packet, a little endian uint16 at protocol.serverXorKeyOffset
+// in the payload of protocol.xorKeyOpcode, ok is false if the packet isn't the seed packet
+func (c Config) serverXorSeed(opCode uint16, data []byte) (seed uint16, ok bool, err error) {
+	if opCode != c.XorKeyOpCode {
+		return 0, false, nil
+	}
+	if c.ServerXorKeyOffset < 0 || c.ServerXorKeyOffset+2 > len(data) {
+		return 0, true, fmt.Errorf("seed packet %v has %v bytes, the server xor offset is expected at byte %v", opCode, len(data), c.ServerXorKeyOffset)
+	}
+	return binary.LittleEndian.Uint16(data[c.ServerXorKeyOffset:]), true, nil
+}
+
+// true if a server packet decodes to an unknown operation code as it is and to a known one xored from offset,
+// a copy is decoded, packetData is left as it is
+func serverPacketXored(commands *commandRegistry, packetData []byte, xs XorSettings, offset uint16) bool {
+	if commands.empty() {
+		return false
+	}
+	plain, err := decodePacket(append([]byte(nil), packetData...), xs, nil)
+	if err == nil && commands.known(plain.Base.OperationCode) {
+		return false
+	}
+	xored, err := decodePacket(append([]byte(nil), packetData...), xs, &offset)
+	return err == nil && commands.known(xored.Base.OperationCode)
+}
+
+// client packets that must decode to known operation codes before a brute forced xor offset is trusted
+const xorValidationPackets = 4
+
+// find the xor offset of a client stream whose seed packet (2055) was never seen, e.g when the capture started mid session
+// every offset below limit is tried against the complete packets buffered from offset, a candidate is only accepted
+// if it's the single one that decodes all of them to known operation codes
+func bruteForceXorOffset(commands *commandRegistry, data []byte, offset int, xs XorSettings) (uint16, bool) {
+	boundaries := packetBoundaries(data, offset)
+	if len(boundaries) < xorValidationPackets {
+		return 0, false
+	}
+
+	var (
+		found     bool
+		candidate uint16
+	)
+
+	for c := uint16(0); c < xs.Limit; c++ {
+		if !decodesWithXorOffset(commands, data, boundaries, xs, c) {
+			continue
+		}
+		if found {
+			// more than one offset fits, wait for more packets
+			return 0, false
+		}
+		found = true
+		candidate = c
+	}
+	return candidate, found
+}
+
+// start and end of the payload of every complete packet buffered from offset
+func packetBoundaries(data []byte, offset int) [][2]int {
+	var boundaries [][2]int
+	for lengthHeaderAvailable(data, offset) {
+		pLen, skipBytes := networking.PacketBoundary(offset, data)
+		nextOffset := offset + skipBytes + int(pLen)
+		if nextOffset > len(data) || pLen == 0 {
+			break
+		}
+		boundaries = append(boundaries, [2]int{offset + skipBytes, nextOffset})
+		offset = nextOffset
+	}
+	return boundaries
+}
+
+// true if xorOffset decodes every packet in boundaries to a known operation code
+func decodesWithXorOffset(commands *commandRegistry, data []byte, boundaries [][2]int, xs XorSettings, xorOffset uint16) bool {
+	for _, b := range boundaries {
+		packetData := make([]byte, b[1]-b[0])
+		copy(packetData, data[b[0]:b[1]])
+		p, err := decodePacket(packetData, xs, &xorOffset)
+		if err != nil {
+			return false
+		}
+		if !commands.known(p.Base.OperationCode) {
+			return false
+		}
+	}
+	return true
+}
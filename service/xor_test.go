@@ -0,0 +1,368 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/spf13/viper"
+	"testing"
+	"time"
+)
+
+// client packets with known operation codes, framed and xored from offset the way the client sends them
+func xoredClientPackets(xs XorSettings, offset uint16, n int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		p := EncodeShinePacket(opChatReq, []byte{byte(i), 0x55, 0xaa})
+		xs.cipher(p[1:], &offset)
+		data = append(data, p...)
+	}
+	return data
+}
+
+func TestBruteForceXorOffset(t *testing.T) {
+	p := testProtocol(t)
+	xs := testXorSettings()
+	tests := []struct {
+		name   string
+		data   []byte
+		offset uint16
+		found  bool
+	}{
+		{"from the start of the key", xoredClientPackets(xs, 0, 6), 0, true},
+		{"mid key", xoredClientPackets(xs, 200, 6), 200, true},
+		{"wrapping at the limit", xoredClientPackets(xs, 340, 6), 340, true},
+		{"too few packets", xoredClientPackets(xs, 200, xorValidationPackets-1), 0, false},
+		{"not xored", append(EncodeShinePacket(opVersionAck, nil), EncodeShinePacket(opSeedAck, []byte{1, 2})...), 0, false},
+		{"no complete packet", []byte{0x10, 0x01}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, found := bruteForceXorOffset(p.commands, tt.data, 0, xs)
+			if found != tt.found || (found && offset != tt.offset) {
+				t.Errorf("got offset %v found %v, expected %v found %v", offset, found, tt.offset, tt.found)
+			}
+		})
+	}
+}
+
+// a capture that started after the seed packet still decodes the client once enough packets were buffered
+func TestBruteForceMissedSeed(t *testing.T) {
+	const packets = 8
+	c := testConfig()
+	c.XorBruteForce = true
+
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	conv.XorClient(testXorSettings(), 120)
+	for i := 0; i < packets; i++ {
+		if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i), 0x55, 0xaa})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, sink := runPipeline(t, c, ms)
+	payloads := payloadsOf(sink.byDirection(), opChatReq)
+	if len(payloads) != packets {
+		t.Fatalf("%v packets decoded, expected %v", len(payloads), packets)
+	}
+	for i, p := range payloads {
+		if p[0] != byte(i) {
+			t.Errorf("packet %v decoded to %x", i, p)
+		}
+	}
+	if summary := sn.Summary(); summary[0].DecodeErrors != 0 {
+		t.Errorf("%v decode errors", summary[0].DecodeErrors)
+	}
+}
+
+func TestXorSeed(t *testing.T) {
+	const customOpCode = 0x1234
+	tests := []struct {
+		name      string
+		opCode    uint16
+		offset    int
+		heuristic bool
+		// the packet the server sent
+		packetOpCode uint16
+		data         []byte
+		seed         uint16
+		ok, err      bool
+	}{
+		{"default", opSeedAck, 0, false, opSeedAck, []byte{0x34, 0x12}, 0x1234, true, false},
+		{"other packet", opSeedAck, 0, false, opLoginAck, []byte{0x34, 0x12}, 0, false, false},
+		{"custom operation code", customOpCode, 0, false, customOpCode, []byte{0x34, 0x12}, 0x1234, true, false},
+		{"default operation code with a custom one", customOpCode, 0, false, opSeedAck, []byte{0x34, 0x12}, 0, false, false},
+		{"custom offset", opSeedAck, 3, false, opSeedAck, []byte{9, 9, 9, 0x78, 0x56, 9}, 0x5678, true, false},
+		{"offset past the payload", opSeedAck, 5, false, opSeedAck, []byte{9, 9, 9, 0x78, 0x56, 9}, 0, true, true},
+		{"heuristic", opSeedAck, 0, true, customOpCode, []byte{0x22, 0x01}, 0x0122, true, false},
+		{"heuristic, not 2 bytes", opSeedAck, 0, true, opSeedAck, []byte{0x22, 0x01, 0}, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{XorKeyOpCode: tt.opCode, XorKeyOffset: tt.offset, XorKeyHeuristic: tt.heuristic}
+			seed, ok, err := c.xorSeed(tt.packetOpCode, tt.data)
+			if ok != tt.ok || (err != nil) != tt.err {
+				t.Fatalf("ok %v, error %v, expected %v and an error %v", ok, err, tt.ok, tt.err)
+			}
+			if seed != tt.seed {
+				t.Errorf("seed %#x, expected %#x", seed, tt.seed)
+			}
+		})
+	}
+}
+
+// the client decoder gets its key from wherever the seed packet is configured to be, and only from there
+func TestXorSeedPacket(t *testing.T) {
+	const customOpCode = 0x1234
+	seed := make([]byte, 2)
+	binary.LittleEndian.PutUint16(seed, testSeed)
+	// a seed packet with another offset, taking it would mis-decode the client
+	decoy := seedPacket(testSeed + 1)
+	tests := []struct {
+		name   string
+		config func(c *Config)
+		server [][]byte
+	}{
+		{"default", func(c *Config) {}, [][]byte{seedPacket(testSeed)}},
+		{"custom operation code", func(c *Config) { c.XorKeyOpCode = customOpCode }, [][]byte{decoy, EncodeShinePacket(customOpCode, seed)}},
+		{"custom offset", func(c *Config) { c.XorKeyOffset = 4 }, [][]byte{EncodeShinePacket(opSeedAck, append([]byte{1, 2, 3, 4}, seed...))}},
+		{"heuristic", func(c *Config) { c.XorKeyHeuristic = true }, [][]byte{EncodeShinePacket(opLoginAck, []byte{1, 2, 3}), EncodeShinePacket(customOpCode, seed)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			tt.config(&c)
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			if err := conv.FromServer(tt.server...); err != nil {
+				t.Fatal(err)
+			}
+			conv.XorClient(testXorSettings(), testSeed)
+			if err := conv.FromClient(clientPackets(3)...); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, sink := runPipeline(t, c, ms)
+			payloads := payloadsOf(sink.byDirection(), opChatReq)
+			if len(payloads) != 3 {
+				t.Fatalf("%v client packets decoded, expected 3", len(payloads))
+			}
+			for i, p := range payloads {
+				if len(p) != 3 || p[0] != byte(i) || p[1] != 0x55 || p[2] != 0xaa {
+					t.Errorf("packet %v decoded to %x", i, p)
+				}
+			}
+		})
+	}
+}
+
+// client packets with known operation codes, before they are xored
+func clientPackets(n int) [][]byte {
+	var packets [][]byte
+	for i := 0; i < n; i++ {
+		packets = append(packets, EncodeShinePacket(opChatReq, []byte{byte(i), 0x55, 0xaa}))
+	}
+	return packets
+}
+
+func TestServiceXorConfig(t *testing.T) {
+	defer viper.Reset()
+	viper.Reset()
+	// cmd/root.go gives the other settings their defaults, these have none here
+	viper.Set("protocol.xorKey", testXorKey)
+	viper.Set("protocol.xorLimit", "350")
+	viper.Set("protocol.xorKeyOpcode", "2055")
+	viper.Set("protocol.versionOpcode", "3173")
+	viper.Set("protocol.services", map[string]interface{}{
+		"login":        9010,
+		"worldmanager": map[string]interface{}{"port": 9110},
+		"zone00":       map[string]interface{}{"port": 9210, "xorKey": "0102", "xorLimit": 2},
+		"zone01":       map[string]interface{}{"port": 9211, "xorLimit": 100},
+	})
+	c, err := ConfigFromViper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := testXorSettings()
+	tests := []struct {
+		port    int
+		service string
+		xs      XorSettings
+	}{
+		{9010, "login", global},
+		{9110, "worldmanager", global},
+		{9210, "zone00", XorSettings{Key: []byte{1, 2}, Limit: 2}},
+		{9211, "zone01", XorSettings{Key: global.Key, Limit: 100}},
+		{9999, "", global},
+	}
+	for _, tt := range tests {
+		if c.Services[tt.port] != tt.service {
+			t.Errorf("port %v is service %q, expected %q", tt.port, c.Services[tt.port], tt.service)
+		}
+		xs := c.xorSettings(tt.port)
+		if !bytes.Equal(xs.Key, tt.xs.Key) || xs.Limit != tt.xs.Limit {
+			t.Errorf("port %v xors with %x up to %v, expected %x up to %v", tt.port, xs.Key, xs.Limit, tt.xs.Key, tt.xs.Limit)
+		}
+	}
+
+	viper.Set("protocol.services", map[string]interface{}{"zone00": map[string]interface{}{"port": 9210, "xorKey": "not hex"}})
+	if _, err := ConfigFromViper(); err == nil {
+		t.Error("a service with a bad xor key was accepted")
+	}
+}
+
+// two servers of different builds captured at once, each client xors with the key of its own server
+func TestServiceXorConcurrentFlows(t *testing.T) {
+	const packets = 10
+	override := XorSettings{Key: make([]byte, 200), Limit: 200}
+	for i := range override.Key {
+		override.Key[i] = byte(i*7 + 3)
+	}
+	c := testConfig()
+	c.ServiceXor = map[int]XorSettings{testWorldPort: override}
+
+	flows := []struct {
+		server string
+		xs     XorSettings
+		start  time.Time
+	}{
+		{testServerAddr, testXorSettings(), testStart},
+		{"192.168.1.10:9110", override, testStart.Add(time.Millisecond / 2)},
+	}
+	ms := NewMemorySource()
+	for _, f := range flows {
+		conv, err := NewTCPConversation(ms, testClientAddr, f.server, f.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+			t.Fatal(err)
+		}
+		conv.XorClient(f.xs, testSeed)
+		for i := 0; i < packets; i++ {
+			if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i), 0x55, 0xaa})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the segments of both flows take turns
+	ms.sortByTime()
+
+	_, sink := runPipeline(t, c, ms)
+	decoded := make(map[string]int)
+	for _, pe := range sink.byDirection() {
+		if pe.Packet.Base.OperationCode != opChatReq {
+			continue
+		}
+		p := pe.Packet.Base.Data
+		if len(p) != 3 || p[1] != 0x55 || p[2] != 0xaa {
+			t.Errorf("%v decoded a packet to %x", pe.FlowName, p)
+		}
+		decoded[pe.FlowName]++
+	}
+	for _, name := range []string{"login-client", "worldmanager-client"} {
+		if decoded[name] != packets {
+			t.Errorf("%v packets of %v decoded, expected %v", decoded[name], name, packets)
+		}
+	}
+}
+
+// the server stream of testdata/serverxor.hex decodes like the one of handshake.hex with protocol.serverXor true or auto,
+// auto leaves the server streams of older builds, whose seed has no server offset, and plain ones as they are
+func TestServerXor(t *testing.T) {
+	// the seed of a newer build with the server stream of handshake.hex, which isn't xored
+	newerSeed := readFixture(t, "handshake.hex")
+	newerSeed[0].data = EncodeShinePacket(opSeedAck, []byte{0x23, 0x01, 0xa5, 0x00})
+	tests := []struct {
+		name      string
+		serverXor string
+		fixture   []fixtureSegment
+		golden    string
+	}{
+		{"true", "true", readFixture(t, "serverxor.hex"), "serverxor.golden"},
+		{"auto", "auto", readFixture(t, "serverxor.hex"), "serverxor.golden"},
+		{"auto with an older build", "auto", readFixture(t, "handshake.hex"), "handshake.golden"},
+		{"auto with a server stream that isn't xored", "auto", newerSeed, "serverxor.golden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			c.ServerXor = tt.serverXor
+			ms := NewMemorySource()
+			conv := openTestConversation(t, ms)
+			replayFixture(t, conv, tt.fixture)
+			if err := conv.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			sn, sink := runPipeline(t, c, ms)
+			checkGolden(t, tt.golden, goldenLines(sink.byDirection()))
+			summary := sn.Summary()
+			if len(summary) != 1 || summary[0].DecodeErrors != 0 {
+				t.Errorf("expected one flow without decode errors, got %+v", summary)
+			}
+		})
+	}
+
+	// without protocol.serverXor the xored server packets are garbage
+	ms := NewMemorySource()
+	conv := openTestConversation(t, ms)
+	replayFixture(t, conv, readFixture(t, "serverxor.hex"))
+	if err := conv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, sink := runPipeline(t, testConfig(), ms)
+	events := sink.byDirection()
+	if got := payloadsOf(events, opLoginAck); len(got) != 0 {
+		t.Errorf("the xored login answer decoded without protocol.serverXor: %x", got)
+	}
+	if got := payloadsOf(events, opLoginReq); len(got) != 1 {
+		t.Errorf("%v logins decoded, the client stream doesn't depend on protocol.serverXor", len(got))
+	}
+}
+
+func TestServerPacketXored(t *testing.T) {
+	p := testProtocol(t)
+	xs := testXorSettings()
+	xored := func(offset uint16, p []byte) []byte {
+		p = append([]byte(nil), p...)
+		xs.cipher(p, &offset)
+		return p
+	}
+	// the body of NC_USER_LOGIN_ACK, without its length header
+	loginAck := EncodeShinePacket(opLoginAck, []byte("\x01\x00World\x00"))[1:]
+	tests := []struct {
+		name   string
+		data   []byte
+		offset uint16
+		xored  bool
+	}{
+		{"plain", loginAck, 0xa5, false},
+		{"xored", xored(0xa5, loginAck), 0xa5, true},
+		{"xored across the key limit", xored(349, loginAck), 349, true},
+		{"xored from another offset", xored(0xa5, loginAck), 0xa6, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), tt.data...)
+			if got := serverPacketXored(p.commands, data, xs, tt.offset); got != tt.xored {
+				t.Errorf("xored %v, expected %v", got, tt.xored)
+			}
+			if !bytes.Equal(data, tt.data) {
+				t.Error("the packet itself was changed")
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+// client packets in a row that must decode to unknown operation codes before the xor offset is considered drifted
+const xorDriftPackets = 3
+
+// xorDrift follows the operation codes a client stream decodes to, packets that still parse but to unknown operation codes
+// mean the xor offset drifted, most likely because protocol.xorLimit isn't the one the server wraps the key at
+type xorDrift struct {
+	// the operation codes known to the stream
+	commands *commandRegistry
+	// xor offset the first packet of the run was decoded with
+	start uint16
+	// bytes xored from the seed of the key up to the run, with the seed itself
+	position uint64
+	// payloads of the run as they were captured, still xored
+	packets [][]byte
+}
+
+// record a decoded client packet, xorOffset is the one it was decoded from and position how far the key got from its seed
+// returns true once xorDriftPackets in a row decoded to unknown operation codes, never if there's no list of known ones
+func (d *xorDrift) observe(opCode uint16, xored []byte, xorOffset uint16, position uint64) bool {
+	if d.commands.empty() {
+		return false
+	}
+	if d.commands.known(opCode) {
+		d.packets = nil
+		return false
+	}
+	if len(d.packets) == 0 {
+		d.start, d.position = xorOffset, position
+	}
+	d.packets = append(d.packets, append([]byte(nil), xored...))
+	return len(d.packets) >= xorDriftPackets
+}
+
+// look for the xor offset that decodes the whole run to known operation codes, every offset of the key is tried from the
+// nearest to the one the run started at, limit is the one closest to xs.Limit the key wraps at to get there from its seed,
+// 0 if none does, next is where the xor offset is after the run
+func (d *xorDrift) recover(xs XorSettings) (next uint16, limit uint16, ok bool) {
+	defer func() {
+		d.packets = nil
+	}()
+	full := XorSettings{Key: xs.Key, Limit: uint16(len(xs.Key))}
+	for distance := 1; distance < len(xs.Key); distance++ {
+		for _, c := range []int{int(d.start) - distance, int(d.start) + distance} {
+			if c < 0 || c >= len(xs.Key) {
+				continue
+			}
+			o := uint16(c)
+			if !d.decodes(full, &o) {
+				continue
+			}
+			if limit = d.limit(xs, uint16(c)); limit != 0 {
+				o = uint16(c)
+				d.decodes(XorSettings{Key: xs.Key, Limit: limit}, &o)
+			}
+			return o, limit, true
+		}
+	}
+	return 0, 0, false
+}
+
+// the xor limit closest to xs.Limit that puts the key at offset when the run started, 0 if none does
+// if the key never wrapped since its seed the limit is only known to be past offset, the whole key is assumed
+func (d *xorDrift) limit(xs XorSettings, offset uint16) uint16 {
+	if d.position == uint64(offset) {
+		return uint16(len(xs.Key))
+	}
+	for distance := 0; distance < len(xs.Key); distance++ {
+		for _, l := range []int{int(xs.Limit) - distance, int(xs.Limit) + distance} {
+			if l <= int(offset) || l > len(xs.Key) || uint64(l) > d.position {
+				continue
+			}
+			if d.position%uint64(l) == uint64(offset) {
+				return uint16(l)
+			}
+		}
+	}
+	return 0
+}
+
+// true if every packet of the run decodes to a known operation code from xorOffset, which is left after the last one
+func (d *xorDrift) decodes(xs XorSettings, xorOffset *uint16) bool {
+	for _, xored := range d.packets {
+		packetData := append([]byte(nil), xored...)
+		p, err := decodePacket(packetData, xs, xorOffset)
+		if err != nil {
+			return false
+		}
+		if !d.commands.known(p.Base.OperationCode) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// the xor limit that explains where the key was found, from how far it got since its seed
+func TestXorDriftLimit(t *testing.T) {
+	xs := testXorSettings()
+	tests := []struct {
+		name     string
+		limit    uint16
+		position uint64
+		offset   uint16
+		expected uint16
+	}{
+		{"configured limit too low", 300, 400, 50, 350},
+		{"configured limit too high", 400, 400, 50, 350},
+		{"configured limit right", 350, 750, 50, 350},
+		{"never wrapped", 350, 120, 120, uint16(len(xs.Key))},
+		{"no limit gets there", 350, 400, 450, 0},
+	}
+	for _, tt := range tests {
+		d := &xorDrift{position: tt.position}
+		if got := d.limit(XorSettings{Key: xs.Key, Limit: tt.limit}, tt.offset); got != tt.expected {
+			t.Errorf("%v: limit %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+// three unknown operation codes in a row are a drift, a known one in between starts the run over
+func TestXorDriftObserve(t *testing.T) {
+	d := xorDrift{commands: testProtocol(t).commands}
+	for i, tt := range []struct {
+		opCode  uint16
+		drifted bool
+	}{
+		{0xffff, false},
+		{0xfffe, false},
+		{opChatReq, false},
+		{0xffff, false},
+		{0xfffe, false},
+		{0xfffd, true},
+	} {
+		if got := d.observe(tt.opCode, []byte{1}, uint16(i), uint64(i)); got != tt.drifted {
+			t.Errorf("packet %v: drifted %v, expected %v", i, got, tt.drifted)
+		}
+	}
+	if d.start != 3 {
+		t.Errorf("the run started at offset %v, expected 3", d.start)
+	}
+}
+
+// a client whose server wraps the key at 350 while protocol.xorLimit says otherwise, the decoder finds the xor offset again,
+// keeps decoding with the limit that explains it and /api/flows shows the drift was corrected
+func TestXorDriftRecovers(t *testing.T) {
+	const packets = 300
+	tests := []struct {
+		name  string
+		limit uint16
+		drift string
+	}{
+		{"limit too low", 300, "corrected"},
+		{"limit too high", 420, "corrected"},
+		{"right limit", 350, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := newHeldSource()
+			conv, err := NewTCPConversation(hs.MemorySource, testClientAddr, testServerAddr, testStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conv.FromServer(seedPacket(testSeed)); err != nil {
+				t.Fatal(err)
+			}
+			conv.XorClient(testXorSettings(), testSeed)
+			for i := 0; i < packets; i++ {
+				if err := conv.FromClient(EncodeShinePacket(opChatReq, []byte{byte(i), byte(i >> 8), 0x55})); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := testConfig()
+			c.XorLimit = tt.limit
+			sn, err := NewSniffer(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := &eventSink{}
+			sn.Handler = sink.handle
+			sn.Source = hs
+			if err := sn.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				close(hs.release)
+				<-sn.Done()
+				sn.Stop()
+			}()
+			// the connection stays open, so the flow is still listed once every packet was decoded
+			deadline := time.Now().Add(testPipelineWait)
+			for {
+				sink.mu.Lock()
+				n := len(sink.events)
+				sink.mu.Unlock()
+				if n == packets+1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%v packets handled, expected %v", n, packets+1)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			w := httptest.NewRecorder()
+			sn.flowsHandler(w, httptest.NewRequest(http.MethodGet, "/api/flows", nil))
+			var flows []flowView
+			if err := json.NewDecoder(w.Body).Decode(&flows); err != nil {
+				t.Fatal(err)
+			}
+			if len(flows) != 1 || flows[0].XorDrift != tt.drift {
+				t.Fatalf("expected one flow with xor drift %q, got %+v", tt.drift, flows)
+			}
+
+			// packets after the drift are decoded again, only the run that showed it is lost
+			payloads := payloadsOf(sink.byDirection(), opChatReq)
+			if len(payloads) < packets-2*xorDriftPackets {
+				t.Fatalf("%v of %v packets decoded", len(payloads), packets)
+			}
+			last := payloads[len(payloads)-1]
+			if len(last) != 3 || int(last[0])|int(last[1])<<8 != packets-1 || last[2] != 0x55 {
+				t.Errorf("the last packet decoded to %x", last)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// kept in the output directory instead of the session one, so the next run finds it
+const xorStateFile = "xorstate.json"
+
+// xorStateEntry is where the xor offset of a client connection was after its last decoded packet
+type xorStateEntry struct {
+	// offset the last key was found at, by seed packet, brute force or resync
+	Seed uint16 `json:"seed"`
+	// payload bytes xored since then, so the offset can be recomputed from the seed
+	Decoded uint64 `json:"decoded"`
+	// offset the next packet of the client starts with
+	Offset  uint16    `json:"offset"`
+	Updated time.Time `json:"updated"`
+}
+
+// xorState keeps the xor offset of every client connection being decoded, by client and server address
+// it's written to xorstate.json periodically, so a restarted sniffer can keep decoding connections that stayed open
+type xorState struct {
+	path    string
+	expiry  time.Duration
+	entries map[string]xorStateEntry
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// load the entries persisted by a previous run, the ones not updated within expiry are dropped
+func loadXorState(path string, expiry time.Duration) (*xorState, error) {
+	xs := &xorState{
+		path:    path,
+		expiry:  expiry,
+		entries: make(map[string]xorStateEntry),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return xs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &xs.entries); err != nil {
+		return nil, err
+	}
+	xs.expire(time.Now())
+	if len(xs.entries) > 0 {
+		log.Infof("loaded the xor offsets of %v client connections from %v", len(xs.entries), path)
+	}
+	return xs, nil
+}
+
+// client ip:port-server ip:port of the connection a stream belongs to
+func (ss *shineStream) xorStateKey() string {
+	if ss.isServer {
+		return dstAddress(ss.net, ss.transport) + "-" + srcAddress(ss.net, ss.transport)
+	}
+	return srcAddress(ss.net, ss.transport) + "-" + dstAddress(ss.net, ss.transport)
+}
+
+func (xs *xorState) lookup(key string) (xorStateEntry, bool) {
+	if xs == nil {
+		return xorStateEntry{}, false
+	}
+	xs.mu.Lock()
+	defer xs.mu.Unlock()
+	e, ok := xs.entries[key]
+	if ok && xs.expiry > 0 && time.Since(e.Updated) > xs.expiry {
+		return xorStateEntry{}, false
+	}
+	return e, ok
+}
+
+// record the offset a client connection is at after a decoded packet
+func (xs *xorState) update(key string, seed uint16, decoded uint64, offset uint16) {
+	if xs == nil {
+		return
+	}
+	xs.mu.Lock()
+	xs.entries[key] = xorStateEntry{
+		Seed:    seed,
+		Decoded: decoded,
+		Offset:  offset,
+		Updated: time.Now(),
+	}
+	xs.dirty = true
+	xs.mu.Unlock()
+}
+
+func (xs *xorState) expire(now time.Time) {
+	if xs.expiry <= 0 {
+		return
+	}
+	for key, e := range xs.entries {
+		if now.Sub(e.Updated) > xs.expiry {
+			delete(xs.entries, key)
+			xs.dirty = true
+		}
+	}
+}
+
+// write the entries to a temporary file first, so a crash never leaves a truncated state behind
+func (xs *xorState) save() error {
+	if xs == nil {
+		return nil
+	}
+	xs.mu.Lock()
+	defer xs.mu.Unlock()
+	xs.expire(time.Now())
+	if !xs.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(xs.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(xs.path), xorStateFile+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), xs.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	xs.dirty = false
+	return nil
+}
+
+func (xs *xorState) savePeriodically(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := xs.save(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
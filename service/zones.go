@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// NC_CHAR_LOGIN_ACK, sent by the world manager once a character is picked, tells the client which zone to connect to
+const charLoginAck = 4099
+
+// payload of NC_CHAR_LOGIN_ACK, the ip is a nul padded string
+type ncCharLoginAck struct {
+	ZoneIP   [16]byte
+	ZonePort uint16
+}
+
+// the zone endpoint announced by a NC_CHAR_LOGIN_ACK payload
+func zoneEndpoint(data []byte) (string, int, error) {
+	var nc ncCharLoginAck
+	if len(data) < binary.Size(nc) {
+		return "", 0, fmt.Errorf("NC_CHAR_LOGIN_ACK payload has %v bytes, expected %v", len(data), binary.Size(nc))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &nc); err != nil {
+		return "", 0, err
+	}
+	ip := string(bytes.TrimRight(nc.ZoneIP[:], "\x00"))
+	if net.ParseIP(ip) == nil {
+		return "", 0, fmt.Errorf("NC_CHAR_LOGIN_ACK announced a bad zone ip %q", ip)
+	}
+	if nc.ZonePort == 0 {
+		return "", 0, fmt.Errorf("NC_CHAR_LOGIN_ACK announced zone port 0")
+	}
+	return ip, int(nc.ZonePort), nil
+}
+
+// zoneDiscovered is sent to every UI connection when a zone port is learned from the world manager
+type zoneDiscovered struct {
+	Service string `json:"service"`
+	Address string `json:"address"`
+}
+
+// register the zone a world manager sends its client to, so the zone connection that follows gets a proper flow name
+// zones on ports that already belong to a service are left alone
+func (ss *shineStream) discoverZone(dp decodedPacket) {
+	if !ss.sniffer.liveSettings.get().discoverZones || dp.direction != "inbound" || dp.packet.Base.OperationCode != charLoginAck {
+		return
+	}
+	ip, port, err := zoneEndpoint(dp.packet.Base.Data)
+	if err != nil {
+		ss.warningf("[%v] %v", ss.flowName, err)
+		return
+	}
+	if _, known := ss.sniffer.services.serviceForPort(port); known {
+		return
+	}
+
+	name := fmt.Sprintf("ZoneDynamic-%v", port)
+	ss.sniffer.services.discover(port, name)
+	address := net.JoinHostPort(ip, fmt.Sprint(port))
+	ss.sniffer.session.anonymizer().server(ip)
+	log.Infof("[%v] zone %v discovered on %v", ss.flowName, name, address)
+
+	ss.sniffer.ws.broadcast(envelope(wsZone, zoneDiscovered{
+		Service: name,
+		Address: ss.sniffer.session.anonymizer().address(address),
+	}))
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"testing"
+	"time"
+)
+
+// the zone testdata/worldmanager.hex sends its client to
+const testDiscoveredPort = 9321
+
+// zoneSource captures the frames of the world manager, and those of the zone once release is closed, as the client
+// only connects to the zone a while after the world manager answered
+type zoneSource struct {
+	*MemorySource
+	zone    *MemorySource
+	release chan struct{}
+}
+
+func (zs *zoneSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := zs.MemorySource.ReadPacketData()
+	if err == io.EOF {
+		<-zs.release
+		return zs.zone.ReadPacketData()
+	}
+	return data, ci, err
+}
+
+func (zs *zoneSource) PacketSource() *gopacket.PacketSource {
+	return gopacket.NewPacketSource(zs, layers.LinkTypeEthernet)
+}
+
+func TestZoneEndpoint(t *testing.T) {
+	payload := func(ip string, port uint16) []byte {
+		data := make([]byte, 18)
+		copy(data, ip)
+		binary.LittleEndian.PutUint16(data[16:], port)
+		return data
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ip   string
+		port int
+		err  bool
+	}{
+		{"ipv4", payload("192.168.1.10", 9321), "192.168.1.10", 9321, false},
+		{"trailing bytes", append(payload("10.0.0.1", 9210), 1, 2, 3), "10.0.0.1", 9210, false},
+		{"short", payload("192.168.1.10", 9321)[:17], "", 0, true},
+		{"not an ip", payload("zone.example", 9321), "", 0, true},
+		{"port 0", payload("192.168.1.10", 0), "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, port, err := zoneEndpoint(tt.data)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, expected one %v", err, tt.err)
+			}
+			if ip != tt.ip || port != tt.port {
+				t.Errorf("zone %v:%v, expected %v:%v", ip, port, tt.ip, tt.port)
+			}
+		})
+	}
+}
+
+// the recorded world manager handshake registers the zone port, so the zone connection that follows is named after it
+func TestDiscoverZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		discover bool
+		flowName string
+	}{
+		{"discovered", true, "ZoneDynamic-9321-client"},
+		{"discovery off", false, "unknown-9321-client"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zs := &zoneSource{MemorySource: NewMemorySource(), zone: NewMemorySource(), release: make(chan struct{})}
+			for _, conv := range []struct {
+				source         *MemorySource
+				client, server string
+				fixture        string
+				start          time.Time
+			}{
+				{zs.MemorySource, "192.168.1.20:50001", "192.168.1.10:9110", "worldmanager.hex", testStart},
+				{zs.zone, "192.168.1.20:50002", "192.168.1.10:9321", "zone.hex", testStart.Add(time.Second)},
+			} {
+				c, err := NewTCPConversation(conv.source, conv.client, conv.server, conv.start)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := c.Open(); err != nil {
+					t.Fatal(err)
+				}
+				replayFixture(t, c, readFixture(t, conv.fixture))
+				if err := c.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := testConfig()
+			c.DiscoverZones = tt.discover
+			sn, err := NewSniffer(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := &eventSink{}
+			sn.Handler = sink.handle
+			sn.Source = zs
+			if err := sn.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// the zone is registered before the packet that announced it is handled
+			deadline := time.Now().Add(testPipelineWait)
+			for len(payloadsOf(sink.byDirection(), charLoginAck)) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("NC_CHAR_LOGIN_ACK wasn't decoded")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			close(zs.release)
+			select {
+			case <-sn.Done():
+			case <-time.After(testPipelineWait):
+				t.Fatalf("the capture didn't end within %v", testPipelineWait)
+			}
+			sn.Stop()
+
+			name, known := sn.services.serviceForPort(testDiscoveredPort)
+			if known != tt.discover || (tt.discover && name != "ZoneDynamic-9321") {
+				t.Errorf("port %v is service %q, known %v", testDiscoveredPort, name, known)
+			}
+			// its seed, NC_MAP_LOGIN_REQ and NC_MAP_LOGIN_ACK
+			zoneAddress := "192.168.1.10:9321"
+			var zonePackets int
+			for _, pe := range sink.byDirection() {
+				if pe.Src != zoneAddress && pe.Dst != zoneAddress {
+					continue
+				}
+				zonePackets++
+				if pe.FlowName != tt.flowName {
+					t.Errorf("zone packet %v of flow %q, expected %q", pe.Packet.Base.OperationCode, pe.FlowName, tt.flowName)
+				}
+			}
+			if zonePackets != 3 {
+				t.Errorf("%v zone packets decoded, expected 3", zonePackets)
+			}
+		})
+	}
+}
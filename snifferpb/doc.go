@@ -0,0 +1,5 @@
+// Package snifferpb has the messages and the grpc service defined in sniffer.proto
+// sniffer.pb.go is generated by protoc-gen-go of github.com/golang/protobuf v1.4, regenerate it after changing sniffer.proto
+package snifferpb
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. sniffer.proto
@@ -0,0 +1,452 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.25.0
+// 	protoc        (unknown)
+// source: sniffer.proto
+
+package snifferpb
+
+import (
+	context "context"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// This is a compile-time assertion that a sufficiently up-to-date version
+// of the legacy proto package is being used.
+const _ = proto.ProtoPackageIsVersion4
+
+type SubscribeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FlowNames []string `protobuf:"bytes,1,rep,name=flow_names,json=flowNames,proto3" json:"flow_names,omitempty"`
+	OpCodes   []uint32 `protobuf:"varint,2,rep,packed,name=op_codes,json=opCodes,proto3" json:"op_codes,omitempty"`
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sniffer_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sniffer_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_sniffer_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SubscribeRequest) GetFlowNames() []string {
+	if x != nil {
+		return x.FlowNames
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetOpCodes() []uint32 {
+	if x != nil {
+		return x.OpCodes
+	}
+	return nil
+}
+
+type PacketEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FlowId    string `protobuf:"bytes,1,opt,name=flow_id,json=flowId,proto3" json:"flow_id,omitempty"`
+	FlowName  string `protobuf:"bytes,2,opt,name=flow_name,json=flowName,proto3" json:"flow_name,omitempty"`
+	SessionId string `protobuf:"bytes,3,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Src       string `protobuf:"bytes,4,opt,name=src,proto3" json:"src,omitempty"`
+	Dst       string `protobuf:"bytes,5,opt,name=dst,proto3" json:"dst,omitempty"`
+	// inbound or outbound
+	Direction    string `protobuf:"bytes,6,opt,name=direction,proto3" json:"direction,omitempty"`
+	SeenUnixNano int64  `protobuf:"varint,7,opt,name=seen_unix_nano,json=seenUnixNano,proto3" json:"seen_unix_nano,omitempty"`
+	OpCode       uint32 `protobuf:"varint,8,opt,name=op_code,json=opCode,proto3" json:"op_code,omitempty"`
+	Command      string `protobuf:"bytes,9,opt,name=command,proto3" json:"command,omitempty"`
+	Payload      []byte `protobuf:"bytes,10,opt,name=payload,proto3" json:"payload,omitempty"`
+	// the same for the packet every time a capture is decoded, flow_id followed by its offset in the stream
+	PacketId string `protobuf:"bytes,11,opt,name=packet_id,json=packetId,proto3" json:"packet_id,omitempty"`
+	// the number of the packet in its direction of the flow, in decoding order from 1
+	Seq uint64 `protobuf:"varint,12,opt,name=seq,proto3" json:"seq,omitempty"`
+}
+
+func (x *PacketEvent) Reset() {
+	*x = PacketEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sniffer_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PacketEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PacketEvent) ProtoMessage() {}
+
+func (x *PacketEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_sniffer_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PacketEvent.ProtoReflect.Descriptor instead.
+func (*PacketEvent) Descriptor() ([]byte, []int) {
+	return file_sniffer_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PacketEvent) GetFlowId() string {
+	if x != nil {
+		return x.FlowId
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetFlowName() string {
+	if x != nil {
+		return x.FlowName
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetSessionId() string {
+	if x != nil {
+		return x.SessionId
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetSrc() string {
+	if x != nil {
+		return x.Src
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetDst() string {
+	if x != nil {
+		return x.Dst
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetDirection() string {
+	if x != nil {
+		return x.Direction
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetSeenUnixNano() int64 {
+	if x != nil {
+		return x.SeenUnixNano
+	}
+	return 0
+}
+
+func (x *PacketEvent) GetOpCode() uint32 {
+	if x != nil {
+		return x.OpCode
+	}
+	return 0
+}
+
+func (x *PacketEvent) GetCommand() string {
+	if x != nil {
+		return x.Command
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *PacketEvent) GetPacketId() string {
+	if x != nil {
+		return x.PacketId
+	}
+	return ""
+}
+
+func (x *PacketEvent) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+var File_sniffer_proto protoreflect.FileDescriptor
+
+var file_sniffer_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x73, 0x6e, 0x69, 0x66, 0x66, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x07, 0x73, 0x6e, 0x69, 0x66, 0x66, 0x65, 0x72, 0x22, 0x4c, 0x0a, 0x10, 0x53, 0x75, 0x62, 0x73,
+	0x63, 0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1d, 0x0a, 0x0a,
+	0x66, 0x6c, 0x6f, 0x77, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x09, 0x66, 0x6c, 0x6f, 0x77, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x19, 0x0a, 0x08, 0x6f,
+	0x70, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x07, 0x6f,
+	0x70, 0x43, 0x6f, 0x64, 0x65, 0x73, 0x22, 0xc6, 0x02, 0x0a, 0x0b, 0x50, 0x61, 0x63, 0x6b, 0x65,
+	0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x17, 0x0a, 0x07, 0x66, 0x6c, 0x6f, 0x77, 0x5f, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x66, 0x6c, 0x6f, 0x77, 0x49, 0x64, 0x12,
+	0x1b, 0x0a, 0x09, 0x66, 0x6c, 0x6f, 0x77, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x08, 0x66, 0x6c, 0x6f, 0x77, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1d, 0x0a, 0x0a,
+	0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x09, 0x73, 0x65, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x73,
+	0x72, 0x63, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x73, 0x72, 0x63, 0x12, 0x10, 0x0a,
+	0x03, 0x64, 0x73, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x64, 0x73, 0x74, 0x12,
+	0x1c, 0x0a, 0x09, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x09, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x24, 0x0a,
+	0x0e, 0x73, 0x65, 0x65, 0x6e, 0x5f, 0x75, 0x6e, 0x69, 0x78, 0x5f, 0x6e, 0x61, 0x6e, 0x6f, 0x18,
+	0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x73, 0x65, 0x65, 0x6e, 0x55, 0x6e, 0x69, 0x78, 0x4e,
+	0x61, 0x6e, 0x6f, 0x12, 0x17, 0x0a, 0x07, 0x6f, 0x70, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x08,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x6f, 0x70, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x18, 0x0a, 0x07,
+	0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63,
+	0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61,
+	0x64, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
+	0x12, 0x1b, 0x0a, 0x09, 0x70, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x0b, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x08, 0x70, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x49, 0x64, 0x12, 0x10, 0x0a,
+	0x03, 0x73, 0x65, 0x71, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73, 0x65, 0x71, 0x32,
+	0x50, 0x0a, 0x0e, 0x53, 0x6e, 0x69, 0x66, 0x66, 0x65, 0x72, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x12, 0x3e, 0x0a, 0x09, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x12, 0x19,
+	0x2e, 0x73, 0x6e, 0x69, 0x66, 0x66, 0x65, 0x72, 0x2e, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72, 0x69,
+	0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x14, 0x2e, 0x73, 0x6e, 0x69, 0x66,
+	0x66, 0x65, 0x72, 0x2e, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x30,
+	0x01, 0x42, 0x3a, 0x5a, 0x38, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f,
+	0x73, 0x68, 0x69, 0x6e, 0x65, 0x2d, 0x6f, 0x2f, 0x73, 0x68, 0x69, 0x6e, 0x65, 0x2e, 0x65, 0x6e,
+	0x67, 0x69, 0x6e, 0x65, 0x2e, 0x70, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x2d, 0x73, 0x6e, 0x69, 0x66,
+	0x66, 0x65, 0x72, 0x2f, 0x73, 0x6e, 0x69, 0x66, 0x66, 0x65, 0x72, 0x70, 0x62, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_sniffer_proto_rawDescOnce sync.Once
+	file_sniffer_proto_rawDescData = file_sniffer_proto_rawDesc
+)
+
+func file_sniffer_proto_rawDescGZIP() []byte {
+	file_sniffer_proto_rawDescOnce.Do(func() {
+		file_sniffer_proto_rawDescData = protoimpl.X.CompressGZIP(file_sniffer_proto_rawDescData)
+	})
+	return file_sniffer_proto_rawDescData
+}
+
+var file_sniffer_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_sniffer_proto_goTypes = []interface{}{
+	(*SubscribeRequest)(nil), // 0: sniffer.SubscribeRequest
+	(*PacketEvent)(nil),      // 1: sniffer.PacketEvent
+}
+var file_sniffer_proto_depIdxs = []int32{
+	0, // 0: sniffer.SnifferService.Subscribe:input_type -> sniffer.SubscribeRequest
+	1, // 1: sniffer.SnifferService.Subscribe:output_type -> sniffer.PacketEvent
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_sniffer_proto_init() }
+func file_sniffer_proto_init() {
+	if File_sniffer_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_sniffer_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sniffer_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PacketEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_sniffer_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_sniffer_proto_goTypes,
+		DependencyIndexes: file_sniffer_proto_depIdxs,
+		MessageInfos:      file_sniffer_proto_msgTypes,
+	}.Build()
+	File_sniffer_proto = out.File
+	file_sniffer_proto_rawDesc = nil
+	file_sniffer_proto_goTypes = nil
+	file_sniffer_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// SnifferServiceClient is the client API for SnifferService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type SnifferServiceClient interface {
+	// packets decoded after the call, empty filters match everything
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (SnifferService_SubscribeClient, error)
+}
+
+type snifferServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSnifferServiceClient(cc grpc.ClientConnInterface) SnifferServiceClient {
+	return &snifferServiceClient{cc}
+}
+
+func (c *snifferServiceClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (SnifferService_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_SnifferService_serviceDesc.Streams[0], "/sniffer.SnifferService/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &snifferServiceSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SnifferService_SubscribeClient interface {
+	Recv() (*PacketEvent, error)
+	grpc.ClientStream
+}
+
+type snifferServiceSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *snifferServiceSubscribeClient) Recv() (*PacketEvent, error) {
+	m := new(PacketEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SnifferServiceServer is the server API for SnifferService service.
+type SnifferServiceServer interface {
+	// packets decoded after the call, empty filters match everything
+	Subscribe(*SubscribeRequest, SnifferService_SubscribeServer) error
+}
+
+// UnimplementedSnifferServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedSnifferServiceServer struct {
+}
+
+func (*UnimplementedSnifferServiceServer) Subscribe(*SubscribeRequest, SnifferService_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+
+func RegisterSnifferServiceServer(s *grpc.Server, srv SnifferServiceServer) {
+	s.RegisterService(&_SnifferService_serviceDesc, srv)
+}
+
+func _SnifferService_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SnifferServiceServer).Subscribe(m, &snifferServiceSubscribeServer{stream})
+}
+
+type SnifferService_SubscribeServer interface {
+	Send(*PacketEvent) error
+	grpc.ServerStream
+}
+
+type snifferServiceSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *snifferServiceSubscribeServer) Send(m *PacketEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _SnifferService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "sniffer.SnifferService",
+	HandlerType: (*SnifferServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _SnifferService_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sniffer.proto",
+}